@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+)
+
+// verifyAudit runs the verify-audit subcommand with args, checking the
+// hash chain of an audit log run -audit wrote.
+func verifyAudit(args []string, stdout, stderr io.Writer) error {
+	fset := flag.NewFlagSet("verify-audit", flag.ContinueOnError)
+	fset.SetOutput(stderr)
+	fset.Usage = func() {
+		fmt.Fprintln(stderr, "usage: cfc-ptrace verify-audit file")
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return errors.New("verify-audit: no file given")
+	}
+	f, err := os.Open(fset.Arg(0))
+	if err != nil {
+		return fmt.Errorf("verify-audit: %w", err)
+	}
+	defer f.Close()
+	n, err := tracer.VerifyAuditLog(f)
+	if err != nil {
+		return fmt.Errorf("verify-audit: %s: %w", fset.Arg(0), err)
+	}
+	fmt.Fprintf(stdout, "%s: %d entries verified\n", fset.Arg(0), n)
+	return nil
+}
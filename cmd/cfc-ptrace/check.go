@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+)
+
+// check runs the check subcommand with args, reporting what the host lets
+// the tracer do and what to enable where it does not. It fails if the
+// tracer cannot run at all.
+func check(args []string, stdout, stderr io.Writer) error {
+	fset := flag.NewFlagSet("check", flag.ContinueOnError)
+	fset.SetOutput(stderr)
+	fset.Usage = func() {
+		fmt.Fprintln(stderr, "usage: cfc-ptrace check")
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() != 0 {
+		fset.Usage()
+		return errors.New("check: takes no arguments")
+	}
+	c := tracer.Capabilities()
+	if c.PtraceScope >= 0 {
+		fmt.Fprintf(stdout, "kernel.yama.ptrace_scope: %d\n", c.PtraceScope)
+	}
+	fmt.Fprintf(stdout, "CAP_SYS_PTRACE: %v\n", c.SysPtrace)
+	for _, r := range []struct {
+		name string
+		err  error
+	}{
+		{"ptrace", c.Ptrace},
+		{"attach", c.Attach},
+		{"seccomp filters", c.Seccomp},
+		{"seccomp notifications", c.SeccompNotify},
+		{"process_vm_readv", c.ProcessVM},
+		{"user namespaces", c.UserNamespaces},
+	} {
+		if r.err == nil {
+			fmt.Fprintf(stdout, "%s: ok\n", r.name)
+		} else {
+			fmt.Fprintf(stdout, "%s: %v\n", r.name, r.err)
+		}
+	}
+	switch {
+	case c.Ptrace != nil:
+		return errors.New("check: the tracer cannot run here")
+	case c.SeccompNotify == nil && c.ProcessVM == nil:
+		fmt.Fprintln(stdout, "-engine auto: unotify")
+	default:
+		fmt.Fprintln(stdout, "-engine auto: ptrace")
+	}
+	return nil
+}
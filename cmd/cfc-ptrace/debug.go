@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+)
+
+// promptHelp lists the commands the debug subcommand reads at its prompt
+// while the command is paused. Addresses are in hex, with or without 0x.
+const promptHelp = `continue, c     run on to the next breakpoint
+step, s         run on to the thread's next syscall stop
+regs            print the thread's registers
+mem ADDR [N]    dump N bytes, 64 by default, of memory at ADDR
+str ADDR        print the NUL-terminated string at ADDR
+fds             list the thread's virtual descriptors
+quit, q         run on without pausing again
+`
+
+// parseBreakpoint parses a -break spec: a syscall name, a path pattern,
+// which has a slash or a *, or NAME:PATTERN.
+func parseBreakpoint(spec string) (tracer.Breakpoint, error) {
+	var b tracer.Breakpoint
+	name, pattern, ok := strings.Cut(spec, ":")
+	if !ok && strings.ContainsAny(spec, "/*") {
+		name, pattern = "", spec
+	}
+	if name != "" {
+		nr, ok := tracer.SyscallNumber(name)
+		if !ok {
+			return b, fmt.Errorf("unknown syscall %q", name)
+		}
+		b.Syscall = nr
+	}
+	if ok && pattern == "" {
+		return b, fmt.Errorf("%q: no path pattern", spec)
+	}
+	b.Path = pattern
+	return b, nil
+}
+
+// prompt is the debugger's prompt, reading commands from in and writing to
+// out.
+type prompt struct {
+	in   *bufio.Scanner
+	out  io.Writer
+	done bool
+}
+
+func newPrompt(in io.Reader, out io.Writer) *prompt {
+	return &prompt{in: bufio.NewScanner(in), out: out}
+}
+
+// pause describes s and reads commands until one resumes the command. The
+// end of the input resumes it for good, as quit does.
+func (p *prompt) pause(s *tracer.Syscall) tracer.DebugAction {
+	if p.done {
+		return tracer.DebugContinue
+	}
+	fmt.Fprintf(p.out, "[tid %d] %s\n", s.Tid, s)
+	for {
+		fmt.Fprint(p.out, "(cfc-ptrace) ")
+		if !p.in.Scan() {
+			fmt.Fprintln(p.out)
+			p.done = true
+			return tracer.DebugContinue
+		}
+		fields := strings.Fields(p.in.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "continue", "c":
+			return tracer.DebugContinue
+		case "step", "s":
+			return tracer.DebugStep
+		case "quit", "q":
+			p.done = true
+			return tracer.DebugContinue
+		case "regs":
+			p.regs(s)
+		case "mem", "str":
+			p.memory(s, fields)
+		case "fds":
+			for _, fd := range s.FDs() {
+				cloexec := ""
+				if fd.Cloexec {
+					cloexec = " cloexec"
+				}
+				fmt.Fprintf(p.out, "%d %s flags=%#o offset=%d%s\n", fd.FD, fd.Path, fd.Flags, fd.Offset, cloexec)
+			}
+		case "help", "h", "?":
+			fmt.Fprint(p.out, promptHelp)
+		default:
+			fmt.Fprintf(p.out, "unknown command %q; try help\n", fields[0])
+		}
+	}
+}
+
+// regs prints the registers of the thread s stopped, one to a line.
+func (p *prompt) regs(s *tracer.Syscall) {
+	r, err := s.Registers()
+	if err != nil {
+		fmt.Fprintln(p.out, err)
+		return
+	}
+	v := reflect.ValueOf(r)
+	for i := range v.NumField() {
+		name, f := strings.ToLower(v.Type().Field(i).Name), v.Field(i)
+		if f.Kind() != reflect.Array {
+			fmt.Fprintf(p.out, "%-8s %#x\n", name, f.Uint())
+			continue
+		}
+		for j := range f.Len() {
+			fmt.Fprintf(p.out, "%-8s %#x\n", fmt.Sprintf("%s%d", name[:1], j), f.Index(j).Uint())
+		}
+	}
+}
+
+// memory runs a mem or str command.
+func (p *prompt) memory(s *tracer.Syscall, fields []string) {
+	if len(fields) < 2 {
+		fmt.Fprintf(p.out, "%s: no address\n", fields[0])
+		return
+	}
+	addr, err := strconv.ParseUint(strings.TrimPrefix(fields[1], "0x"), 16, 64)
+	if err != nil {
+		fmt.Fprintf(p.out, "%s: bad address %q\n", fields[0], fields[1])
+		return
+	}
+	if fields[0] == "str" {
+		str, err := s.ReadString(uintptr(addr))
+		if err != nil {
+			fmt.Fprintln(p.out, err)
+			return
+		}
+		fmt.Fprintf(p.out, "%q\n", str)
+		return
+	}
+	n := 64
+	if len(fields) > 2 {
+		if n, err = strconv.Atoi(fields[2]); err != nil || n <= 0 {
+			fmt.Fprintf(p.out, "mem: bad count %q\n", fields[2])
+			return
+		}
+	}
+	b, err := s.ReadMemory(uintptr(addr), n)
+	if err != nil {
+		fmt.Fprintln(p.out, err)
+		return
+	}
+	fmt.Fprint(p.out, hex.Dump(b))
+}
@@ -0,0 +1,535 @@
+// Command cfc-ptrace runs programs under the tracer, with a virtual
+// filesystem mounted into their view of the host.
+//
+// Usage:
+//
+//	cfc-ptrace run [flags] -- command [args...]
+//	cfc-ptrace debug -break spec [flags] -- command [args...]
+//	cfc-ptrace resume [flags] socket
+//	cfc-ptrace serve [-listen addr] backend
+//	cfc-ptrace snapshot [-o file] backend
+//	cfc-ptrace restore [-i file] backend
+//	cfc-ptrace verify-audit file
+//	cfc-ptrace check
+//
+// The command's exit status becomes cfc-ptrace's own; a command killed by
+// a signal kills cfc-ptrace with the same signal. A run given -handoff
+// exits 0 once it has handed the command over to a resume, which then
+// takes its place.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/cache"
+	"github.com/maxmcd/cfc-ptrace/vfs/compress"
+	"github.com/maxmcd/cfc-ptrace/vfs/crypt"
+	"github.com/maxmcd/cfc-ptrace/vfs/fuse"
+	"github.com/maxmcd/cfc-ptrace/vfs/nfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/p9"
+	"github.com/maxmcd/cfc-ptrace/vfs/remote"
+	"github.com/maxmcd/cfc-ptrace/vfs/shared"
+)
+
+const usage = `usage: cfc-ptrace <command> [arguments]
+
+Commands:
+  run [flags] -- command [args...]   run a command under interception
+  debug -break spec [flags] -- ...   run a command, pausing at a prompt at the syscalls spec matches
+  resume [flags] socket              take over the command a run -handoff socket hands over
+  serve [-listen addr] backend       serve a backend to run -backend remote:ADDR
+  snapshot [-o file] backend         write the tree of a backend as a tar archive
+  restore [-i file] backend          write the entries of a tar archive into a backend
+  verify-audit file                  check the hash chain of an audit log run -audit wrote
+  check                              report what the host lets the tracer do, and what to enable
+
+Run "cfc-ptrace run -h" for the flags of run, which debug and resume take too.
+`
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("cfc-ptrace: ")
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "run", "debug", "resume":
+		var debugIn io.Reader
+		if os.Args[1] == "debug" {
+			debugIn = os.Stdin
+		}
+		exit, err := runCommand(context.Background(), os.Args[1], os.Args[2:], debugIn, os.Stdout, os.Stderr)
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if exit != nil {
+			// A command handed over, or a resumed one that the
+			// tracer saw no end of, leaves no status to pass on.
+			exit.Exit()
+		}
+	case "serve":
+		err := serve(context.Background(), os.Args[2:], os.Stderr)
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			log.Fatal(err)
+		}
+	case "snapshot":
+		err := snapshot(os.Args[2:], os.Stdout, os.Stderr)
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			log.Fatal(err)
+		}
+	case "restore":
+		err := restoreTree(os.Args[2:], os.Stdin, os.Stderr)
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			log.Fatal(err)
+		}
+	case "verify-audit":
+		err := verifyAudit(os.Args[2:], os.Stdout, os.Stderr)
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			log.Fatal(err)
+		}
+	case "check":
+		err := check(os.Args[2:], os.Stdout, os.Stderr)
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			log.Fatal(err)
+		}
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "cfc-ptrace: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
+
+// run runs the run subcommand with args, and returns how the command
+// ended.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) (*tracer.ExitState, error) {
+	return runCommand(ctx, "run", args, nil, stdout, stderr)
+}
+
+// runCommand runs the subcommand name, run, debug or resume, with args.
+// The debug subcommand takes its prompt's input from debugIn, and the
+// command gets no standard input. The resume subcommand takes over the
+// command a run given -handoff hands over at the socket it is given, in
+// place of starting one.
+func runCommand(ctx context.Context, name string, args []string, debugIn io.Reader, stdout, stderr io.Writer) (*tracer.ExitState, error) {
+	// Writers that are not files get the command's output from goroutines
+	// exec starts, while the tracer logs to stderr, so their writes are
+	// made one at a time.
+	var mu sync.Mutex
+	for _, w := range []*io.Writer{&stdout, &stderr} {
+		if _, ok := (*w).(*os.File); !ok {
+			*w = &lockedWriter{mu: &mu, w: *w}
+		}
+	}
+	fset := flag.NewFlagSet(name, flag.ContinueOnError)
+	fset.SetOutput(stderr)
+	fset.Usage = func() {
+		if name == "resume" {
+			fmt.Fprintf(stderr, "usage: cfc-ptrace %s [flags] socket\n", name)
+		} else {
+			fmt.Fprintf(stderr, "usage: cfc-ptrace %s [flags] -- command [args...]\n", name)
+		}
+		fset.PrintDefaults()
+	}
+	var breakpoints []tracer.Breakpoint
+	if debugIn != nil {
+		fset.Func("break", "pause at the syscalls `spec` matches: a syscall name, a path pattern, or both as NAME:PATTERN; repeatable", func(spec string) error {
+			b, err := parseBreakpoint(spec)
+			breakpoints = append(breakpoints, b)
+			return err
+		})
+	}
+	var (
+		configFile = fset.String("config", "", "set the tracer up as the TOML `file` describes")
+		root       = fset.String("root", "", "mount the virtual filesystem at `path`")
+		restore    = fset.String("restore", "", "seed the virtual filesystem with the tar archive in `file` first")
+		snapshot   = fset.String("snapshot", "", "write the virtual filesystem to `file` as a tar archive afterwards")
+		fuseDir    = fset.String("fuse", "", "also mount the virtual filesystem at `dir` with FUSE, for processes outside the tracer")
+		nfsAddr    = fset.String("nfs", "", "also export the virtual filesystem read-only over NFSv3 on the TCP `addr`")
+		backend    = fset.String("backend", "mem", "serve the virtual filesystem from `backend`: mem, dev, dir:PATH, overlay:PATH, archive:PATH, bolt:PATH, oci:REF, s3:URL, an http(s) URL, remote:ADDR or 9p:ADDR[,ANAME]")
+		cacheSize  = fset.Int64("cache", 0, "cache up to `bytes` of the backend's file contents in memory, writing back on close")
+		encrypt    = fset.String("encrypt", "", "encrypt the file contents and names kept in the backend with the key, in hex or base64, in the environment variable `var`")
+		level      = fset.Int("compress", 0, "compress the file contents kept in the backend with zstd at `level`, from 1 to 22")
+		policyFile = fset.String("policy", "", "block the syscalls the policy in `file` names")
+		traceFile  = fset.String("trace", "", "log syscalls to `file`, or to stderr for -")
+		traceJSON  = fset.Bool("trace-json", false, "log syscalls as JSON lines")
+		seccomp    = fset.Bool("seccomp", true, "stop only at intercepted syscalls")
+		landlock   = fset.Bool("landlock", true, "back read-only mode up with a Landlock ruleset the kernel enforces")
+		ioURing    = fset.Bool("io-uring", true, "let the command use io_uring, which bypasses the virtual filesystem")
+		pinPaths   = fset.Bool("pin-paths", false, "copy syscalls' paths where the command cannot change them before they are checked")
+		seed       = fset.Uint64("seed", 0, "serve getrandom and /dev/urandom from a stream seeded with `n`")
+		decisions  = fset.Int("decision-cache", 0, "remember up to `n` decisions about the paths the command names")
+		engine     = fset.String("engine", "ptrace", "intercept syscalls with `engine`: ptrace, unotify, or auto for the best the host allows")
+		metrics    = fset.String("metrics", "", "serve Prometheus metrics at /metrics on `addr` while the command runs")
+		auditFile  = fset.String("audit", "", "append the decisions on the files the command names to the audit log in `file`")
+		pty        = fset.Bool("pty", false, "run the command on a pseudo-terminal, standing in for the one cfc-ptrace runs on")
+		userns     = fset.Bool("userns", false, "run the command as root in new user and mount namespaces")
+		handoff    = fset.String("handoff", "", "hand the command over, with its virtual state, to the resume that connects to the Unix `socket`, and exit; needs -seccomp=false")
+		verbose    = fset.Bool("v", false, "log the tracer's debug output to stderr")
+	)
+	if err := fset.Parse(args); err != nil {
+		return nil, err
+	}
+	if fset.NArg() == 0 {
+		fset.Usage()
+		if name == "resume" {
+			return nil, errors.New("resume: no socket given")
+		}
+		return nil, fmt.Errorf("%s: no command given", name)
+	}
+	if debugIn != nil && breakpoints == nil {
+		return nil, errors.New("debug: no -break given")
+	}
+
+	if *root == "" && (*restore != "" || *snapshot != "" || *fuseDir != "" || *nfsAddr != "") {
+		return nil, fmt.Errorf("%s: -restore, -snapshot, -fuse and -nfs need -root", name)
+	}
+
+	var opts []tracer.Option
+	var mounted vfs.Backend
+	if *configFile != "" {
+		opt, err := tracer.FromConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+	if *root != "" {
+		b, closeBackend, err := openBackend(*backend)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		defer closeBackend()
+		if *encrypt != "" {
+			if b, err = crypt.New(b, crypt.Config{KeyFunc: crypt.EnvKey(*encrypt)}); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		if *level > 0 {
+			b = compress.New(b, compress.Level(*level))
+		}
+		if *cacheSize > 0 {
+			c := cache.New(b, cache.LRU(*cacheSize))
+			if *verbose {
+				defer func() {
+					st := c.Stats()
+					fmt.Fprintf(stderr, "cache: %d hits, %d misses (%.0f%%), %d evictions, %d blocks written back\n",
+						st.Hits, st.Misses, 100*st.HitRate(), st.Evictions, st.WriteBacks)
+				}()
+			}
+			b = c
+		}
+		if *restore != "" {
+			if err := readSnapshot(b, *restore); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		if *fuseDir != "" || *nfsAddr != "" {
+			// The command and the processes using the mount or export see
+			// each other's operations whole.
+			b = shared.New(b)
+		}
+		if *fuseDir != "" {
+			srv, err := fuse.Mount(*fuseDir, b, fuse.Options{})
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			defer srv.Close()
+		}
+		if *nfsAddr != "" {
+			lis, err := net.Listen("tcp", *nfsAddr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			srv := nfs.NewServer(b)
+			go srv.Serve(lis)
+			defer srv.Close()
+			if *verbose {
+				fmt.Fprintf(stderr, "nfs: exporting on %s\n", lis.Addr())
+			}
+		}
+		mounted = b
+		opts = append(opts, tracer.WithMount(*root, b))
+	}
+	if *policyFile != "" {
+		f, err := os.Open(*policyFile)
+		if err != nil {
+			return nil, err
+		}
+		rules, err := parsePolicy(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", *policyFile, err)
+		}
+		opts = append(opts, tracer.WithPolicy(rules...))
+	}
+	if *traceFile != "" {
+		var w io.Writer = stderr
+		if *traceFile != "-" {
+			f, err := os.Create(*traceFile)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			w = f
+		}
+		format := tracer.TraceText
+		if *traceJSON {
+			format = tracer.TraceJSON
+		}
+		opts = append(opts, tracer.WithTraceWriter(w, format))
+	}
+	// Flags given explicitly win over the configuration file.
+	set := make(map[string]bool)
+	fset.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if *configFile == "" || set["engine"] {
+		switch *engine {
+		case "ptrace":
+			opts = append(opts, tracer.WithEngine(tracer.EnginePtrace))
+		case "unotify":
+			opts = append(opts, tracer.WithEngine(tracer.EngineUnotify))
+		case "auto":
+			opts = append(opts, tracer.WithEngine(tracer.EngineAuto))
+		default:
+			return nil, fmt.Errorf("%s: unknown engine %q", name, *engine)
+		}
+	}
+	if *configFile == "" || set["seccomp"] {
+		opts = append(opts, tracer.WithSeccomp(*seccomp))
+	}
+	if *configFile == "" || set["landlock"] {
+		opts = append(opts, tracer.WithLandlock(*landlock))
+	}
+	if *configFile == "" || set["io-uring"] {
+		opts = append(opts, tracer.WithIOURing(*ioURing))
+	}
+	if *pinPaths {
+		opts = append(opts, tracer.WithPinnedPaths())
+	}
+	if set["seed"] {
+		opts = append(opts, tracer.WithRandomSeed(*seed))
+	}
+	if set["decision-cache"] {
+		if *userns {
+			return nil, fmt.Errorf("%s: -decision-cache cannot be used with -userns, under which the command mounts unseen", name)
+		}
+		opts = append(opts, tracer.WithDecisionCache(*decisions))
+	}
+	if *verbose {
+		opts = append(opts, tracer.WithLogger(log.New(stderr, "", log.Lmicroseconds)))
+	}
+	if *metrics != "" {
+		lis, err := net.Listen("tcp", *metrics)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		m := tracer.NewMetrics()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", m)
+		srv := &http.Server{Handler: mux}
+		go func() { _ = srv.Serve(lis) }()
+		defer srv.Close()
+		opts = append(opts, tracer.WithMetrics(m))
+	}
+	var audit *tracer.AuditLog
+	if *auditFile != "" {
+		var err error
+		if audit, err = tracer.OpenAuditLog(*auditFile); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		defer audit.Close()
+		opts = append(opts, tracer.WithAuditLog(audit))
+	}
+
+	if *pty {
+		if _, err := unix.IoctlGetTermios(int(os.Stdin.Fd()), unix.TCGETS); err == nil {
+			opts = append(opts, tracer.WithTerminal(os.Stdin))
+		} else {
+			opts = append(opts, tracer.WithPTY(24, 80))
+		}
+	}
+
+	if *userns {
+		opts = append(opts, tracer.WithUserNamespace(tracer.UserNamespace{Mount: true}))
+	}
+
+	if debugIn != nil {
+		opts = append(opts, tracer.WithDebugger(newPrompt(debugIn, stderr).pause, breakpoints...))
+	}
+	var (
+		t   *tracer.Tracer
+		cmd *exec.Cmd
+		pid int
+	)
+	if name == "resume" {
+		conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: fset.Arg(0), Net: "unix"})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		state, err := tracer.ReceiveState(conn)
+		conn.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if len(state.Processes) == 0 {
+			return nil, errors.New("resume: nothing was handed over")
+		}
+		pid = state.Processes[0].Pid
+		t = tracer.Reattach(state, opts...)
+	} else {
+		if *handoff != "" && (*seccomp || *engine != "ptrace") {
+			return nil, fmt.Errorf("%s: -handoff needs -seccomp=false and the ptrace engine", name)
+		}
+		cmd = exec.Command(fset.Arg(0), fset.Args()[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, stdout, stderr
+		if debugIn != nil {
+			cmd.Stdin = nil
+		}
+		t = tracer.New(cmd, opts...)
+	}
+	var lis *net.UnixListener
+	if *handoff != "" {
+		var err error
+		if lis, err = net.ListenUnix("unix", &net.UnixAddr{Name: *handoff, Net: "unix"}); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		defer lis.Close()
+	}
+	// Signals from the terminal reach the command by themselves; the
+	// command decides what they do. Those sent to cfc-ptrace are passed
+	// on.
+	signal.Ignore(syscall.SIGINT, syscall.SIGQUIT)
+	defer signal.Reset(syscall.SIGINT, syscall.SIGQUIT)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	if err := t.Start(ctx); err != nil {
+		return nil, err
+	}
+	if cmd != nil {
+		pid = cmd.Process.Pid
+	}
+	handedOff := make(chan struct{})
+	if lis == nil {
+		close(handedOff)
+	} else {
+		go func() {
+			defer close(handedOff)
+			// The listener is closed once the tracer has finished, and
+			// nothing is handed over after that.
+			conn, err := lis.AcceptUnix()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if err := t.Handoff(conn); err != nil {
+				fmt.Fprintf(stderr, "%s: %v\n", name, err)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				_ = unix.Kill(pid, sig.(syscall.Signal))
+			case <-done:
+				return
+			}
+		}
+	}()
+	exit, err := t.Wait()
+	if lis != nil {
+		// Wait returns as soon as the command is let go, before it has
+		// been handed over.
+		lis.Close()
+		<-handedOff
+	}
+	if *snapshot != "" {
+		// The snapshot is taken however the command ended.
+		if err := writeSnapshot(mounted, *snapshot); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if audit != nil {
+		if err := audit.Close(); err != nil {
+			return nil, fmt.Errorf("%s: audit log: %w", name, err)
+		}
+	}
+	var crash *tracer.InternalError
+	if errors.As(err, &crash) {
+		// The command was killed; what the tracer was doing goes with
+		// the error, for a bug report.
+		fmt.Fprint(stderr, crash.Report())
+		return nil, err
+	}
+	if exit == nil {
+		return nil, err
+	}
+	return exit, nil
+}
+
+// openBackend returns the backend spec names, as tracer.ParseBackend does,
+// remote:ADDR for one cfc-ptrace serve serves at ADDR, and 9p:ADDR[,ANAME]
+// for the tree ANAME a 9P2000.L server at ADDR exports. close releases the
+// backend.
+func openBackend(spec string) (b vfs.Backend, close func() error, err error) {
+	if addr, ok := strings.CutPrefix(spec, "remote:"); ok {
+		conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return nil, nil, err
+		}
+		return remote.New(conn), conn.Close, nil
+	}
+	if addr, ok := strings.CutPrefix(spec, "9p:"); ok {
+		addr, aname, _ := strings.Cut(addr, ",")
+		network := "tcp"
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			network, addr = "unix", path
+		}
+		f, err := p9.Dial(network, addr, p9.Config{Aname: aname})
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, f.Close, nil
+	}
+	b, err = tracer.ParseBackend(spec)
+	return b, func() error { return nil }, err
+}
+
+// lockedWriter is a writer shared by goroutines, making their writes one
+// at a time.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(b)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+)
+
+func TestParsePolicy(t *testing.T) {
+	rules, err := parsePolicy(strings.NewReader(`# no mounts
+deny mount
+deny connect ENETUNREACH # offline
+kill 101
+
+deny execve EACCES /usr/bin/curl /usr/bin/wget
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []tracer.Rule{
+		{Syscall: unix.SYS_MOUNT},
+		{Syscall: unix.SYS_CONNECT, Errno: syscall.ENETUNREACH},
+		{Syscall: 101, Kill: true},
+		{Syscall: unix.SYS_EXECVE, Errno: syscall.EACCES, Paths: []string{"/usr/bin/curl", "/usr/bin/wget"}},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules %+v, want %+v", rules, want)
+	}
+
+	for _, bad := range []string{"allow mount", "deny", "deny nosuchcall", "deny mount ENOTANERRNO", "deny mount /bin/sh"} {
+		if _, err := parsePolicy(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy")
+	if err := os.WriteFile(policy, []byte("deny execve EACCES /bin/true\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	trace := filepath.Join(dir, "trace")
+	var stdout, stderr bytes.Buffer
+	exit, err := run(context.Background(), []string{
+		"-root", "/mem", "-policy", policy, "-trace", trace, "--",
+		"/bin/sh", "-c", `echo virtual >/mem/f; cat /mem/f; /bin/true || echo denied; exit 3`,
+	}, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("%v: %s", err, stderr.String())
+	}
+	if exit.Code != 3 {
+		t.Errorf("exit state %v", exit)
+	}
+	if got := stdout.String(); got != "virtual\ndenied\n" {
+		t.Errorf("output %q", got)
+	}
+	if b, _ := os.ReadFile(trace); !bytes.Contains(b, []byte(`openat(AT_FDCWD, "/mem/f"`)) {
+		t.Errorf("trace:\n%s", b)
+	}
+
+	config := filepath.Join(dir, "cfc.toml")
+	if err := os.WriteFile(config, []byte("[[mount]]\npath = \"/cfg\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Reset()
+	if _, err := run(context.Background(), []string{
+		"-config", config, "--", "/bin/sh", "-c", "echo configured >/cfg/f; cat /cfg/f",
+	}, &stdout, &stderr); err != nil {
+		t.Fatalf("%v: %s", err, stderr.String())
+	}
+	if got := stdout.String(); got != "configured\n" {
+		t.Errorf("output with -config %q", got)
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"-config", filepath.Join(dir, "missing.toml"), "--", "/bin/true"},
+		{"-root", "/mem", "-backend", "tape", "--", "/bin/true"},
+		{"-engine", "dtrace", "--", "/bin/true"},
+	} {
+		if _, err := run(context.Background(), args, &stdout, &stderr); err == nil {
+			t.Errorf("run %q succeeded", args)
+		}
+	}
+}
+
+// TestRunOutput runs a command writing to stderr while -v has the tracer
+// log there too, which the race detector catches unless their writes are
+// made one at a time.
+func TestRunOutput(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if _, err := run(context.Background(), []string{
+		"-v", "-root", "/mem", "--",
+		"/bin/sh", "-c", `for i in 1 2 3 4 5 6 7 8; do echo out$i >/mem/f; cat /mem/f; echo err$i >&2; done`,
+	}, &stdout, &stderr); err != nil {
+		t.Fatalf("%v: %s", err, stderr.String())
+	}
+	if !strings.HasPrefix(stdout.String(), "out1\n") || !strings.HasSuffix(stdout.String(), "out8\n") {
+		t.Errorf("stdout %q", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "err8\n") {
+		t.Errorf("stderr %q", stderr.String())
+	}
+}
+
+func TestServe(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "f"), []byte("served\n"), 0o644)
+	sock := filepath.Join(t.TempDir(), "sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	var stderr bytes.Buffer
+	go func() { served <- serve(ctx, []string{"-listen", "unix:" + sock, "dir:" + dir}, io.Discard) }()
+	for i := 0; ; i++ {
+		if _, err := os.Stat(sock); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("serve did not listen")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var stdout bytes.Buffer
+	exit, err := run(context.Background(), []string{
+		"-root", "/remote", "-backend", "remote:unix:" + sock, "--",
+		"/bin/sh", "-c", "cat /remote/f; echo written >/remote/g",
+	}, &stdout, &stderr)
+	if err != nil || exit.Code != 0 {
+		t.Fatalf("%v %v: %s", exit, err, stderr.String())
+	}
+	if got := stdout.String(); got != "served\n" {
+		t.Errorf("output %q", got)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "g")); string(b) != "written\n" {
+		t.Errorf("written file holds %q", b)
+	}
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "tree.tar")
+	var stdout, stderr bytes.Buffer
+	exit, err := run(context.Background(), []string{
+		"-root", "/mem", "-snapshot", archive, "--",
+		"/bin/sh", "-c", "mkdir /mem/d && echo first >/mem/d/f",
+	}, &stdout, &stderr)
+	if err != nil || exit.Code != 0 {
+		t.Fatalf("%v %v: %s", exit, err, stderr.String())
+	}
+	exit, err = run(context.Background(), []string{
+		"-root", "/mem", "-restore", archive, "--", "/bin/cat", "/mem/d/f",
+	}, &stdout, &stderr)
+	if err != nil || exit.Code != 0 {
+		t.Fatalf("%v %v: %s", exit, err, stderr.String())
+	}
+	if got := stdout.String(); got != "first\n" {
+		t.Errorf("restored run printed %q", got)
+	}
+
+	out := t.TempDir()
+	if err := restoreTree([]string{"-i", archive, "dir:" + out}, nil, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(out, "d/f")); string(b) != "first\n" {
+		t.Errorf("restored file holds %q", b)
+	}
+	var tarball bytes.Buffer
+	if err := snapshot([]string{"dir:" + out}, &tarball, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	again := t.TempDir()
+	if err := restoreTree([]string{"dir:" + again}, &tarball, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(again, "d/f")); string(b) != "first\n" {
+		t.Errorf("file restored from stdin holds %q", b)
+	}
+	if _, err := run(context.Background(), []string{"-snapshot", archive, "--", "/bin/true"}, &stdout, &stderr); err == nil {
+		t.Error("-snapshot without -root succeeded")
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "in"), []byte("cached\n"), 0o644)
+	var stdout, stderr bytes.Buffer
+	exit, err := run(context.Background(), []string{
+		"-root", "/data", "-backend", "dir:" + dir, "-cache", "1048576", "-v", "--",
+		"/bin/sh", "-c", "cat /data/in /data/in >/data/out",
+	}, &stdout, &stderr)
+	if err != nil || exit.Code != 0 {
+		t.Fatalf("%v %v: %s", exit, err, stderr.String())
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "out")); string(b) != "cached\ncached\n" {
+		t.Errorf("out holds %q", b)
+	}
+	if !strings.Contains(stderr.String(), "cache: ") {
+		t.Errorf("no cache statistics in %q", stderr.String())
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CFC_TEST_KEY", strings.Repeat("ab", 32))
+	for _, script := range []string{"echo secret >/data/notes", "cat /data/notes"} {
+		var stdout, stderr bytes.Buffer
+		exit, err := run(context.Background(), []string{
+			"-root", "/data", "-backend", "dir:" + dir, "-encrypt", "CFC_TEST_KEY", "--",
+			"/bin/sh", "-c", script,
+		}, &stdout, &stderr)
+		if err != nil || exit.Code != 0 {
+			t.Fatalf("%v %v: %s", exit, err, stderr.String())
+		}
+		if script == "cat /data/notes" && stdout.String() != "secret\n" {
+			t.Errorf("read back %q", stdout.String())
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		b, _ := os.ReadFile(filepath.Join(dir, e.Name()))
+		if e.Name() == "notes" || bytes.Contains(b, []byte("secret")) {
+			t.Errorf("%s is in the clear", e.Name())
+		}
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in the backend", len(entries))
+	}
+}
+
+func TestCompress(t *testing.T) {
+	dir := t.TempDir()
+	for _, script := range []string{"seq 1 100000 >/data/numbers", "tail -n 1 /data/numbers"} {
+		var stdout, stderr bytes.Buffer
+		exit, err := run(context.Background(), []string{
+			"-root", "/data", "-backend", "dir:" + dir, "-compress", "3", "--",
+			"/bin/sh", "-c", script,
+		}, &stdout, &stderr)
+		if err != nil || exit.Code != 0 {
+			t.Fatalf("%v %v: %s", exit, err, stderr.String())
+		}
+		if script == "tail -n 1 /data/numbers" && stdout.String() != "100000\n" {
+			t.Errorf("read back %q", stdout.String())
+		}
+	}
+	fi, err := os.Stat(filepath.Join(dir, "numbers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > 100000 {
+		t.Errorf("the backend keeps %d bytes of 588895", fi.Size())
+	}
+}
+
+func TestFUSE(t *testing.T) {
+	dir := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	// The command reads back through the mount, which cat does on the host.
+	exit, err := run(context.Background(), []string{
+		"-root", "/mem", "-fuse", dir, "--",
+		"/bin/sh", "-c", "echo through the mount >/mem/f && cat " + filepath.Join(dir, "f"),
+	}, &stdout, &stderr)
+	if err != nil && strings.Contains(err.Error(), "fuse: mount") {
+		t.Skip(err)
+	}
+	if err != nil || exit.Code != 0 {
+		t.Fatalf("%v %v: %s", exit, err, stderr.String())
+	}
+	if got := stdout.String(); got != "through the mount\n" {
+		t.Errorf("read %q", got)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	audit := filepath.Join(t.TempDir(), "audit.jsonl")
+	var stdout, stderr bytes.Buffer
+	for range 2 {
+		exit, err := run(context.Background(), []string{
+			"-root", "/mem", "-audit", audit, "--", "/bin/sh", "-c", "echo audited >/mem/f",
+		}, &stdout, &stderr)
+		if err != nil || exit.Code != 0 {
+			t.Fatalf("%v %v: %s", exit, err, stderr.String())
+		}
+	}
+	if b, _ := os.ReadFile(audit); !bytes.Contains(b, []byte(`"syscall":"openat","path":"/mem/f","decision":"allowed","mount":"/mem"`)) {
+		t.Errorf("audit log:\n%s", b)
+	}
+	if err := verifyAudit([]string{audit}, &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "entries verified") {
+		t.Errorf("verify-audit output %q", stdout.String())
+	}
+
+	b, _ := os.ReadFile(audit)
+	os.WriteFile(audit, bytes.Replace(b, []byte("/mem/f"), []byte("/mem/g"), 1), 0o600)
+	if err := verifyAudit([]string{audit}, &stdout, &stderr); err == nil {
+		t.Error("verify-audit of a changed log succeeded")
+	}
+	if _, err := run(context.Background(), []string{"-audit", audit, "--", "/bin/true"}, &stdout, &stderr); err == nil {
+		t.Error("run appending to a changed log succeeded")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if err := check(nil, &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "ptrace: ok\n") || !strings.Contains(stdout.String(), "-engine auto: ") {
+		t.Errorf("check output:\n%s", stdout.String())
+	}
+	if _, err := run(context.Background(), []string{"-engine", "auto", "--", "/bin/true"}, &stdout, &stderr); err != nil {
+		t.Fatalf("-engine auto: %v", err)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	// The prompt shares stderr with the command, which a file takes
+	// without a goroutine copying to it.
+	stderr, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	var stdout bytes.Buffer
+	in := strings.NewReader("fds\nstr zz\nstep\nc\n")
+	exit, err := runCommand(context.Background(), "debug", []string{
+		"-root", "/mem", "-break", "write:/mem/*", "--", "/bin/sh", "-c", "echo hi >/mem/f; cat /mem/f",
+	}, in, &stdout, stderr)
+	b, _ := os.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatalf("%v: %s", err, b)
+	}
+	if exit.Code != 0 || stdout.String() != "hi\n" {
+		t.Errorf("exit state %v, output %q", exit, stdout.String())
+	}
+	got := string(b)
+	for _, want := range []string{
+		// The shell writes to the file as its stdout.
+		`] write(1, "hi\n", 3)` + "\n",
+		") 1 /mem/f flags=01101 offset=0\n",
+		`str: bad address "zz"`,
+		`] write(1, "hi\n", 3) = 3` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("prompt output lacks %q:\n%s", want, got)
+		}
+	}
+
+	for _, spec := range []string{"nosuchcall", "write:"} {
+		if _, err := parseBreakpoint(spec); err == nil {
+			t.Errorf("-break %q parsed", spec)
+		}
+	}
+	if _, err := runCommand(context.Background(), "debug", []string{"--", "/bin/true"}, in, &stdout, io.Discard); err == nil {
+		t.Error("debug without -break succeeded")
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	dir := t.TempDir()
+	files := filepath.Join(dir, "files")
+	if err := os.Mkdir(files, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(files, "lines"), []byte("one\ntwo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Neither supervisor copies the command's output, which goes to a
+	// file.
+	out, err := os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	sock := filepath.Join(dir, "sock")
+	mount := []string{"-root", "/dir", "-backend", "dir:" + files}
+	type result struct {
+		exit *tracer.ExitState
+		err  error
+	}
+	ran := make(chan result, 1)
+	go func() {
+		exit, err := runCommand(context.Background(), "run", append(mount, "-seccomp=false", "-handoff", sock, "--",
+			"/bin/sh", "-c", `exec 3</dir/lines; echo $$; read -r l <&3; echo $l
+while [ ! -e `+dir+`/go ]; do sleep 0.01; done
+read -r l <&3; echo $l`), nil, out, io.Discard)
+		ran <- result{exit, err}
+	}()
+	var pid int
+	for deadline := time.Now().Add(5 * time.Second); pid == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		b, _ := os.ReadFile(out.Name())
+		if p, ok := strings.CutSuffix(string(b), "\none\n"); ok {
+			pid, _ = strconv.Atoi(p)
+		}
+	}
+	if pid == 0 {
+		t.Fatal("the command did not start")
+	}
+
+	resumed := make(chan result, 1)
+	go func() {
+		exit, err := runCommand(context.Background(), "resume", append(mount, sock), nil, out, io.Discard)
+		resumed <- result{exit, err}
+	}()
+	if r := <-ran; r.err != nil || r.exit != nil {
+		t.Fatalf("run -handoff returned %v, %v", r.exit, r.err)
+	}
+	// The command goes on once resume traces it.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		b, _ := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+		if !bytes.Contains(b, []byte("TracerPid:\t0\n")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("resume did not take the command over")
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-resumed; r.err != nil {
+		t.Fatalf("resume: %v", r.err)
+	}
+	if b, _ := os.ReadFile(out.Name()); !bytes.HasSuffix(b, []byte("\none\ntwo\n")) {
+		t.Errorf("output %q", b)
+	}
+
+	if _, err := runCommand(context.Background(), "run", []string{"-handoff", sock, "--", "/bin/true"}, nil, out, io.Discard); err == nil {
+		t.Error("-handoff under a seccomp filter succeeded")
+	}
+	if _, err := runCommand(context.Background(), "resume", []string{sock}, nil, out, io.Discard); err == nil {
+		t.Error("resume without a run to hand over succeeded")
+	}
+}
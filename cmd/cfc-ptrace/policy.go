@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+)
+
+// A policy file lists one rule per line, in the order WithPolicy applies
+// them. Blank lines and text from a # on are ignored. A rule is an action,
+// a syscall name or number, and for deny an optional errno name, followed
+// for execve by the executables the rule is limited to:
+//
+//	deny mount
+//	deny connect ENETUNREACH
+//	kill ptrace
+//	deny execve EACCES /usr/bin/curl /usr/bin/wget
+
+// parsePolicy reads the rules of a policy file from r.
+func parsePolicy(r io.Reader) ([]tracer.Rule, error) {
+	var rules []tracer.Rule
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		rule, err := parseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, sc.Err()
+}
+
+func parseRule(fields []string) (tracer.Rule, error) {
+	var rule tracer.Rule
+	switch fields[0] {
+	case "deny":
+	case "kill":
+		rule.Kill = true
+	default:
+		return rule, fmt.Errorf("unknown action %q", fields[0])
+	}
+	if len(fields) < 2 {
+		return rule, fmt.Errorf("%s: no syscall", fields[0])
+	}
+	nr, ok := tracer.SyscallNumber(fields[1])
+	if !ok {
+		return rule, fmt.Errorf("unknown syscall %q", fields[1])
+	}
+	rule.Syscall = nr
+	rest := fields[2:]
+	if len(rest) > 0 && !rule.Kill && !strings.HasPrefix(rest[0], "/") {
+		errno := errnoNamed(rest[0])
+		if errno == 0 {
+			return rule, fmt.Errorf("unknown errno %q", rest[0])
+		}
+		rule.Errno = errno
+		rest = rest[1:]
+	}
+	if len(rest) > 0 {
+		if nr != unix.SYS_EXECVE {
+			return rule, fmt.Errorf("%s: executables given for a syscall other than execve", fields[1])
+		}
+		rule.Paths = rest
+	}
+	return rule, nil
+}
+
+// errnoNamed returns the errno that unix.ErrnoName names name, or 0 if
+// there is none.
+func errnoNamed(name string) syscall.Errno {
+	for errno := syscall.Errno(1); errno < 4096; errno++ {
+		if unix.ErrnoName(errno) == name {
+			return errno
+		}
+	}
+	return 0
+}
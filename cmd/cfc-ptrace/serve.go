@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs/remote"
+	"github.com/maxmcd/cfc-ptrace/vfs/remote/remotepb"
+	"github.com/maxmcd/cfc-ptrace/vfs/shared"
+)
+
+// serve runs the serve subcommand with args until ctx is cancelled. The
+// clients, each perhaps a tracer of its own, share the backend as package
+// shared orders. The connection is plain gRPC, without TLS or
+// authentication, so the address should only be reachable by those
+// allowed every file the backend holds.
+func serve(ctx context.Context, args []string, stderr io.Writer) error {
+	fset := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fset.SetOutput(stderr)
+	fset.Usage = func() {
+		fmt.Fprintln(stderr, "usage: cfc-ptrace serve [-listen addr] mem|dev|dir:PATH|overlay:PATH|bolt:PATH|s3:URL|URL")
+		fset.PrintDefaults()
+	}
+	listen := fset.String("listen", "localhost:7070", "listen on `addr`, or on a Unix socket for unix:PATH")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return errors.New("serve: no backend given")
+	}
+	b, err := tracer.ParseBackend(fset.Arg(0))
+	if err != nil {
+		return fmt.Errorf("serve: %w", err)
+	}
+	network, addr := "tcp", *listen
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", path
+	}
+	lis, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer()
+	srv := remote.NewServer(shared.New(b))
+	defer srv.Close()
+	remotepb.RegisterBackendServer(s, srv)
+	stop := context.AfterFunc(ctx, s.Stop)
+	defer stop()
+	log.Printf("serving %s on %s", fset.Arg(0), lis.Addr())
+	return s.Serve(lis)
+}
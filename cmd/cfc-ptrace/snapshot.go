@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// snapshot runs the snapshot subcommand with args, writing the tree of a
+// backend as a tar archive to stdout or the -o file.
+func snapshot(args []string, stdout, stderr io.Writer) error {
+	fset := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	fset.SetOutput(stderr)
+	fset.Usage = func() {
+		fmt.Fprintln(stderr, "usage: cfc-ptrace snapshot [-o file] backend")
+		fset.PrintDefaults()
+	}
+	out := fset.String("o", "", "write the archive to `file` instead of stdout")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return errors.New("snapshot: no backend given")
+	}
+	b, closeBackend, err := openBackend(fset.Arg(0))
+	if err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	defer closeBackend()
+	if *out == "" {
+		return vfs.Snapshot(b, stdout)
+	}
+	return writeSnapshot(b, *out)
+}
+
+// restoreTree runs the restore subcommand with args, writing the entries
+// of a tar archive from stdin or the -i file into a backend.
+func restoreTree(args []string, stdin io.Reader, stderr io.Writer) error {
+	fset := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fset.SetOutput(stderr)
+	fset.Usage = func() {
+		fmt.Fprintln(stderr, "usage: cfc-ptrace restore [-i file] backend")
+		fset.PrintDefaults()
+	}
+	in := fset.String("i", "", "read the archive from `file` instead of stdin")
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return errors.New("restore: no backend given")
+	}
+	b, closeBackend, err := openBackend(fset.Arg(0))
+	if err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	defer closeBackend()
+	if *in == "" {
+		return vfs.Restore(b, stdin)
+	}
+	return readSnapshot(b, *in)
+}
+
+// writeSnapshot writes the tree of b to the file name.
+func writeSnapshot(b vfs.Backend, name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := vfs.Snapshot(b, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readSnapshot restores the archive in the file name into b.
+func readSnapshot(b vfs.Backend, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return vfs.Restore(b, f)
+}
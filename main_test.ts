@@ -15,7 +15,7 @@ Deno.test("Integration test: Rust binary with Go binary via WebSocket", async (t
     await Promise.all([
       (async () => {
         const goCompile = new Deno.Command("go", {
-          args: ["build", "-o", "cfc-ptrace.bin", "."],
+          args: ["build", "-o", "cfc-ptrace.bin", "./testprog"],
           stdout: "piped",
           stderr: "piped",
         });
@@ -0,0 +1,184 @@
+package tracer
+
+import (
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Creds are who a process is when its access to a virtual file is checked:
+// a user, its group and its supplementary groups.
+type Creds struct {
+	Uid, Gid uint32
+	Groups   []uint32
+}
+
+// Credentials decide the Creds of the thread tid for an access check, such
+// as access and faccessat make. effective is set for a check made with
+// AT_EACCESS, which the kernel makes with the effective IDs of a process
+// rather than its real ones.
+type Credentials func(tid int, effective bool) (Creds, error)
+
+// PretendRoot checks every process as root, which can read and write any
+// file and search any directory, and execute a file with any execute bit
+// set. Backends check no permissions of their own, so this is what they let
+// processes do. It is the default.
+func PretendRoot(tid int, effective bool) (Creds, error) { return Creds{}, nil }
+
+// RealCredentials checks every process with its own IDs, as the kernel
+// checks access to host files.
+func RealCredentials(tid int, effective bool) (Creds, error) {
+	id := func(key string) (uint32, error) {
+		v, ok := statusField(tid, key)
+		f := strings.Fields(v)
+		if !ok || len(f) < 2 {
+			return 0, syscall.ESRCH
+		}
+		s := f[0]
+		if effective {
+			s = f[1]
+		}
+		n, err := strconv.ParseUint(s, 10, 32)
+		return uint32(n), err
+	}
+	var c Creds
+	var err error
+	if c.Uid, err = id("Uid"); err != nil {
+		return Creds{}, err
+	}
+	if c.Gid, err = id("Gid"); err != nil {
+		return Creds{}, err
+	}
+	groups, _ := statusField(tid, "Groups")
+	for _, g := range strings.Fields(groups) {
+		n, err := strconv.ParseUint(g, 10, 32)
+		if err != nil {
+			return Creds{}, err
+		}
+		c.Groups = append(c.Groups, uint32(n))
+	}
+	return c, nil
+}
+
+// FixedCredentials returns Credentials that check every process as uid,
+// gid and groups. Given the IDs passed to Owner, checks go by the
+// permission bits of each file's owner.
+func FixedCredentials(uid, gid uint32, groups ...uint32) Credentials {
+	c := Creds{Uid: uid, Gid: gid, Groups: groups}
+	return func(int, bool) (Creds, error) { return c, nil }
+}
+
+// WithCredentials checks access to virtual files with c, in place of
+// PretendRoot. access, faccessat and faccessat2 on a virtual path check the
+// permission bits stat reports for the file, after Owner and Perm, and for
+// the directories leading to it within its mount, as the kernel would.
+// Whatever c says, backends themselves still decide what access is allowed.
+func WithCredentials(c Credentials) Option {
+	return func(t *Tracer) { t.creds = c }
+}
+
+// sysFaccessat2 also handles access and faccessat, which take no flags.
+func (th *thread) sysFaccessat2(dirfd int, pathAddr uintptr, mode uint32, flags int) (int64, bool) {
+	var p string
+	if pathAddr != 0 || flags&unix.AT_EMPTY_PATH == 0 {
+		var err error
+		if p, err = th.mem.readString(pathAddr); err != nil {
+			return 0, false
+		}
+	}
+	var (
+		m    *mount
+		name string
+		abs  string
+	)
+	if p == "" {
+		f, ok := th.fds.get(dirfd)
+		if !ok || flags&unix.AT_EMPTY_PATH == 0 {
+			return 0, false
+		}
+		m, name, abs = f.mount, f.name, f.path
+	} else {
+		var (
+			through bool
+			err     error
+		)
+		if abs, through, err = th.resolveArg(dirfd, p); err != nil {
+			return resolveFailed(err)
+		}
+		var ok bool
+		if m, name, ok = th.lookupArg(abs, through); !ok {
+			return 0, false
+		}
+	}
+	th.t.log.Printf("faccessat: %s mode=%#o (virtual)", abs, mode)
+	switch {
+	case mode&^(unix.R_OK|unix.W_OK|unix.X_OK) != 0:
+		return -int64(unix.EINVAL), true
+	case flags&^(unix.AT_EACCESS|unix.AT_SYMLINK_NOFOLLOW|unix.AT_EMPTY_PATH) != 0:
+		return -int64(unix.EINVAL), true
+	}
+	creds := th.t.creds
+	if creds == nil {
+		creds = PretendRoot
+	}
+	c, err := creds(th.tid, flags&unix.AT_EACCESS != 0)
+	if err != nil {
+		return errnoRet(err), true
+	}
+	// Every directory on the way to the file must be searchable.
+	if p != "" {
+		for dir := name; dir != "."; {
+			dir = path.Dir(dir)
+			fi, err := m.backend.Stat(dir)
+			if err != nil {
+				return errnoRet(err), true
+			}
+			if !fi.IsDir() {
+				return -int64(unix.ENOTDIR), true
+			}
+			if !permits(c, m.stat(path.Join(m.dir, dir), fi), unix.X_OK) {
+				return -int64(unix.EACCES), true
+			}
+		}
+	}
+	stat := m.backend.Lstat
+	if p != "" && flags&unix.AT_SYMLINK_NOFOLLOW == 0 {
+		if abs, m, name, err = th.follow(abs); err != nil {
+			return errnoRet(err), true
+		}
+		stat = m.backend.Stat
+	}
+	fi, err := stat(name)
+	if err != nil {
+		return errnoRet(err), true
+	}
+	if mode&unix.W_OK != 0 && th.t.readOnly && !th.t.isWritable(abs) && (fi.Mode().IsRegular() || fi.IsDir()) {
+		return -int64(unix.EROFS), true
+	}
+	if !permits(c, m.stat(abs, fi), mode) {
+		return -int64(unix.EACCES), true
+	}
+	return 0, true
+}
+
+// permits reports whether c may access the file st describes as mode, a
+// combination of R_OK, W_OK and X_OK, asks.
+func permits(c Creds, st unix.Stat_t, mode uint32) bool {
+	if c.Uid == 0 {
+		// Root needs an execute bit only to execute a file that is not a
+		// directory.
+		return mode&unix.X_OK == 0 || st.Mode&unix.S_IFMT == unix.S_IFDIR || st.Mode&0o111 != 0
+	}
+	bits := st.Mode & 0o7
+	switch {
+	case c.Uid == st.Uid:
+		bits = st.Mode >> 6 & 0o7
+	case c.Gid == st.Gid || slices.Contains(c.Groups, st.Gid):
+		bits = st.Mode >> 3 & 0o7
+	}
+	return mode&^bits == 0
+}
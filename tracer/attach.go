@@ -0,0 +1,149 @@
+package tracer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// Attach returns a Tracer that will take over the running process pid
+// instead of starting a command. Run seizes the process and every thread
+// it has, then services their syscalls, and those of the processes it
+// starts from then on, until it exits or Run's context is cancelled. Either
+// way the tracer then detaches from everything it traces, leaving it
+// running, and Run returns the context's error, if any. The process's exit
+// status is reported by a ProcessExited event. A process that is a child of
+// the caller is reaped by the tracer, so waiting for it fails.
+//
+// An attached process makes every syscall stop, as if WithSeccomp(false)
+// had been given, and uses EnginePtrace: a seccomp filter cannot be
+// removed, and would fail the syscalls it traps once the tracer had gone.
+// Nor does it get scratch memory until it execs. Descriptors it already
+// has are left to the kernel, and virtual files it opens stop working once
+// the tracer detaches.
+func Attach(pid int, opts ...Option) *Tracer {
+	t := newTracer(nil, append(opts[:len(opts):len(opts)], WithSeccomp(false), WithEngine(EnginePtrace)))
+	t.attached = pid
+	return t
+}
+
+// attachOptions are set on an attached process. Its tracees must outlive
+// the tracer.
+const attachOptions = ptraceOptions &^ unix.PTRACE_O_EXITKILL
+
+// runAttached seizes the process given to Attach, and any others Reattach
+// was given, and services them until the first exits or ctx is cancelled.
+func (t *Tracer) runAttached(ctx context.Context) error {
+	t.leader = t.attached
+	t.done = ctx.Done()
+	pids := []int{t.leader}
+	if t.restore != nil {
+		pids = pids[:0]
+		for _, p := range t.restore.state.Processes {
+			pids = append(pids, p.Pid)
+		}
+	}
+	for _, pid := range pids {
+		if err := t.seizeProcess(pid); err != nil {
+			if pid == t.leader {
+				t.restore.closeHosts()
+				return err
+			}
+			t.log.Printf("pid %d not reattached: %v", pid, err)
+		}
+	}
+	// Host files Handoff sent that no descriptor has taken are of no use.
+	t.restore.closeHosts()
+	close(t.started)
+	// Seized threads run on untraced until they are interrupted and
+	// resumed, which the loop does once they report the stop.
+	for tid := range t.threads {
+		_ = unix.PtraceInterrupt(tid)
+	}
+	// An idle process may not stop again by itself. SIGURG is ignored by
+	// default, and Go programs take a stray one as a request to preempt,
+	// so waking it with one does no harm.
+	defer context.AfterFunc(ctx, func() { _ = unix.Kill(t.leader, unix.SIGURG) })()
+	return t.loop(ctx)
+}
+
+// seizeProcess seizes every thread of process pid, giving them the
+// descriptors restored for it, if any.
+func (t *Tracer) seizeProcess(pid int) error {
+	var fds *fdTable
+	cwd := &workDir{}
+	// Threads created while the others are being seized are found on the
+	// next pass.
+	for added := true; added; {
+		tids, err := taskIDs(pid)
+		if err != nil && fds == nil {
+			return fmt.Errorf("tracer: attach: %w", err)
+		}
+		added = false
+		for _, tid := range tids {
+			if t.threads[tid] != nil {
+				continue
+			}
+			if err := seize(tid, attachOptions); err != nil {
+				if tid == pid && fds == nil {
+					if errors.Is(err, unix.EPERM) && Capabilities().Attach != nil {
+						return Capabilities().Attach
+					}
+					return fmt.Errorf("tracer: seize: %w", err)
+				}
+				// The thread exited, or was attached by the clone
+				// that created it and is reported through that.
+				continue
+			}
+			if fds == nil {
+				fds = t.restoreFDs(pid)
+			} else {
+				fds = fds.share()
+			}
+			t.threads[tid] = &thread{t: t, tid: tid, pid: pid, mem: ptraceMemory(tid), fds: fds, cwd: cwd}
+			added = true
+		}
+	}
+	return nil
+}
+
+// taskIDs lists the threads of process pid.
+func taskIDs(pid int) ([]int, error) {
+	entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return nil, err
+	}
+	tids := make([]int, 0, len(entries))
+	for _, e := range entries {
+		if tid, err := strconv.Atoi(e.Name()); err == nil {
+			tids = append(tids, tid)
+		}
+	}
+	return tids, nil
+}
+
+// detachAll starts detaching from every tracee. Each is interrupted, and
+// let go by resume once it is stopped outside any syscall the tracer is
+// handling.
+func (t *Tracer) detachAll() {
+	t.detaching = true
+	for tid := range t.threads {
+		_ = unix.PtraceInterrupt(tid)
+	}
+}
+
+// detach lets the stopped thread go, delivering sig if it is non-zero.
+func (t *Tracer) detach(th *thread, sig unix.Signal) error {
+	if err := ptraceDetach(th.tid, sig); err != nil {
+		return err
+	}
+	t.log.Printf("tid %d detached", th.tid)
+	t.saved.save(th)
+	delete(t.threads, th.tid)
+	th.fds.release()
+	return nil
+}
@@ -0,0 +1,251 @@
+package tracer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// AuditLog is an append-only record of the decisions tracers given it
+// WithAuditLog make on the files the command names, for review of what an
+// untrusted job touched. Each decision is a line of JSON, an AuditEntry,
+// that holds the hash of the line before it, so that a line changed,
+// removed or put in later breaks the chain VerifyAuditLog checks. The
+// chain cannot tell lines cut from the end of the log; keep the hash of
+// the last line elsewhere to check for that. Its methods are safe for
+// concurrent use.
+type AuditLog struct {
+	mu   sync.Mutex
+	w    io.Writer
+	c    io.Closer
+	seq  uint64
+	prev string
+	err  error
+}
+
+// AuditEntry is a line of an AuditLog: the decision on Path, as the process
+// Pid named it to Syscall.
+type AuditEntry struct {
+	// Seq numbers the entries of the log from 1.
+	Seq uint64 `json:"seq"`
+	// Time is when the decision was made, in RFC 3339 format.
+	Time    string `json:"time"`
+	Pid     int    `json:"pid"`
+	Syscall string `json:"syscall"`
+	// Path is the absolute path the syscall names, or that of the
+	// descriptor it names, or the path as named if it could not be
+	// resolved. It is empty if the path could not be read.
+	Path string `json:"path"`
+	// Decision is "allowed", "denied", for a syscall a rule, path rule or
+	// WithReadOnly refused, or "remapped", for a path WithRemap rewrote
+	// to Target.
+	Decision string `json:"decision"`
+	// Errno names the errno a denied syscall failed with.
+	Errno  string `json:"errno,omitempty"`
+	Target string `json:"target,omitempty"`
+	// Mount is the directory of the mount the path leads into, if not the
+	// host.
+	Mount string `json:"mount,omitempty"`
+	// Prev is the Hash of the entry before, or 64 zeros for the first.
+	Prev string `json:"prev"`
+	// Hash is the hex SHA-256 of the entry's JSON with Hash empty.
+	Hash string `json:"hash,omitempty"`
+}
+
+// auditGenesis is the Prev of the first entry of a log.
+var auditGenesis = strings.Repeat("0", 2*sha256.Size)
+
+// NewAuditLog returns an AuditLog that writes a new chain to w, a line at a
+// time.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w, prev: auditGenesis}
+}
+
+// OpenAuditLog opens the audit log in the file name, creating it if need
+// be, to append to its chain. It fails if the entries already there do not
+// verify.
+func OpenAuditLog(name string) (*AuditLog, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	last, n, err := verifyAuditLog(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("audit log %s: %w", name, err)
+	}
+	a := NewAuditLog(f)
+	a.c = f
+	if n > 0 {
+		a.seq, a.prev = last.Seq, last.Hash
+	}
+	return a, nil
+}
+
+// Close closes the file of an AuditLog OpenAuditLog opened, and returns the
+// first error writing to the log, if any.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.c != nil {
+		if err := a.c.Close(); a.err == nil {
+			a.err = err
+		}
+		a.c = nil
+	}
+	return a.err
+}
+
+// WithAuditLog records in a each decision the tracer makes on a file a
+// syscall names: every path a syscall that opens, executes, inspects or
+// changes a file names, whether it was let through, refused, or remapped,
+// and which mount it led into. Syscalls on descriptors already open, such
+// as read and write, are not recorded, and neither are paths of pipes and
+// sockets.
+func WithAuditLog(a *AuditLog) Option {
+	return func(t *Tracer) { t.audit = a }
+}
+
+// auditSyscalls returns the syscalls, beyond those intercepted anyway, that
+// the audit log needs trapped.
+func (t *Tracer) auditSyscalls() []uint64 {
+	if t.audit == nil {
+		return nil
+	}
+	return append(writeSyscalls[:len(writeSyscalls):len(writeSyscalls)], pathSyscalls...)
+}
+
+// audit records the decision on the files the canonical syscall c names:
+// denied, if ret is an errno, and allowed or remapped otherwise.
+func (th *thread) audit(c sysCall, ret int64) {
+	if th.t.audit == nil {
+		return
+	}
+	refs, _ := callRefs(c)
+	for _, ref := range refs {
+		e := AuditEntry{
+			Time:     time.Now().UTC().Format(time.RFC3339Nano),
+			Pid:      th.pid,
+			Syscall:  syscallName(c.nr),
+			Path:     th.refPath(ref),
+			Decision: "allowed",
+		}
+		if e.Path != "" {
+			for _, r := range th.t.remaps {
+				if q, ok := r.apply(e.Path); ok {
+					e.Decision, e.Target = "remapped", q
+					break
+				}
+			}
+			if m, _, ok := th.t.lookup(e.Path); ok && m != &th.t.host {
+				e.Mount = m.dir
+			}
+		}
+		if ret < 0 {
+			e.Decision, e.Errno = "denied", unix.ErrnoName(unix.Errno(-ret))
+		}
+		th.t.audit.write(e)
+	}
+}
+
+// refPath returns the absolute path of the file ref names, or "" if it
+// cannot be read or has none.
+func (th *thread) refPath(ref pathRef) string {
+	if !ref.fd {
+		p, err := th.mem.readString(ref.addr)
+		if err != nil {
+			return ""
+		}
+		if p != "" || !ref.emptyPath {
+			abs, err := th.resolve(ref.dirfd, p)
+			if err != nil {
+				return p
+			}
+			return abs
+		}
+	}
+	p, ok := th.fdPath(ref.dirfd)
+	if !ok || !strings.HasPrefix(p, "/") {
+		return ""
+	}
+	return p
+}
+
+// write chains e to the log and writes it out.
+func (a *AuditLog) write(e AuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return
+	}
+	a.seq++
+	e.Seq, e.Prev = a.seq, a.prev
+	b, err := e.chained()
+	if err != nil {
+		a.err = err
+		return
+	}
+	if _, err := a.w.Write(append(b, '\n')); err != nil {
+		a.err = err
+		return
+	}
+	a.prev = e.Hash
+}
+
+// chained sets the Hash of e and returns its line.
+func (e *AuditEntry) chained() ([]byte, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	e.Hash = hex.EncodeToString(sum[:])
+	return json.Marshal(e)
+}
+
+// VerifyAuditLog reads an audit log from r and checks its chain. It returns
+// the number of entries, and an error naming the first that is out of
+// place or whose hash does not match.
+func VerifyAuditLog(r io.Reader) (int, error) {
+	_, n, err := verifyAuditLog(r)
+	return n, err
+}
+
+func verifyAuditLog(r io.Reader) (last AuditEntry, n int, err error) {
+	prev := auditGenesis
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		n++
+		var e AuditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return last, n, fmt.Errorf("entry %d: %w", n, err)
+		}
+		if e.Seq != uint64(n) {
+			return last, n, fmt.Errorf("entry %d: out of sequence: seq %d", n, e.Seq)
+		}
+		if e.Prev != prev {
+			return last, n, fmt.Errorf("entry %d: chain broken: prev %s, want %s", n, e.Prev, prev)
+		}
+		want := e.Hash
+		b, err := e.chained()
+		if err != nil {
+			return last, n, fmt.Errorf("entry %d: %w", n, err)
+		}
+		if e.Hash != want || string(b) != s.Text() {
+			return last, n, fmt.Errorf("entry %d: hash mismatch", n)
+		}
+		prev, last = e.Hash, e
+	}
+	return last, n, s.Err()
+}
@@ -0,0 +1,157 @@
+package tracer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+)
+
+// The benchmarks measure what interception costs, each under every
+// engine and natively, without a tracer, for the floor. The syscall
+// benchmarks time a loop in one traced helper, so that starting the
+// command does not count, and report nanoseconds per syscall; the others
+// time whole commands filling a mount. testdata/bench.txt holds the
+// baseline to compare a change against with benchstat.
+
+// benchEngine is a way of running a benchmarked command.
+type benchEngine struct {
+	name string
+	// opts set a tracer up, unless native is set and there is none.
+	opts   []Option
+	native bool
+}
+
+var benchEngines = []benchEngine{
+	{name: "native", native: true},
+	{name: "ptrace", opts: []Option{WithEngine(EnginePtrace)}},
+	{name: "ptrace-nofilter", opts: []Option{WithEngine(EnginePtrace), WithSeccomp(false)}},
+	{name: "unotify", opts: []Option{WithEngine(EngineUnotify)}},
+}
+
+// run runs cmd, under a tracer with the mount of dir onto b unless e is
+// native, and returns what it printed.
+func (e benchEngine) run(b *testing.B, cmd *exec.Cmd, dir string, m *memfs.FS) string {
+	b.Helper()
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	var err error
+	if e.native {
+		err = cmd.Run()
+	} else {
+		err = New(cmd, append(e.opts, WithMount(dir, m))...).Run(context.Background())
+	}
+	if err != nil {
+		b.Fatalf("%v: %s", err, stderr.String())
+	}
+	return stdout.String()
+}
+
+func BenchmarkSyscalls(b *testing.B) {
+	dir := b.TempDir()
+	m := memfs.New()
+	data := bytes.Repeat([]byte("b"), 4096)
+	if err := os.WriteFile(filepath.Join(dir, "f"), data, 0o644); err != nil {
+		b.Fatal(err)
+	}
+	f, _ := m.Open("f", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Write(data)
+	f.Close()
+	// The virtual file is at the same path as the host one native runs
+	// use; host-stat stats a file outside the mount, which the tracer
+	// lets through.
+	host := filepath.Join(b.TempDir(), "h")
+	if err := os.WriteFile(host, data, 0o644); err != nil {
+		b.Fatal(err)
+	}
+	for _, op := range []struct{ name, call, path string }{
+		{"getpid", "getpid", filepath.Join(dir, "f")},
+		{"open", "open", filepath.Join(dir, "f")},
+		{"stat", "stat", filepath.Join(dir, "f")},
+		{"pread", "pread", filepath.Join(dir, "f")},
+		{"host-stat", "stat", host},
+	} {
+		for _, e := range benchEngines {
+			b.Run(op.name+"/"+e.name, func(b *testing.B) {
+				cmd := helperCommand(b, "bench", op.call, op.path, strconv.Itoa(b.N))
+				out := e.run(b, cmd, dir, m)
+				ns, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+				if err != nil {
+					b.Fatalf("%q: %v", out, err)
+				}
+				b.ReportMetric(float64(ns)/float64(b.N), "ns/op")
+			})
+		}
+	}
+}
+
+func BenchmarkTarExtract(b *testing.B) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	data := bytes.Repeat([]byte("t"), 4096)
+	for d := range 10 {
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: fmt.Sprintf("d%d/", d), Mode: 0o755})
+		for f := range 20 {
+			tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("d%d/f%d", d, f), Mode: 0o644, Size: int64(len(data))})
+			tw.Write(data)
+		}
+	}
+	tw.Close()
+	src := filepath.Join(b.TempDir(), "a.tar")
+	if err := os.WriteFile(src, archive.Bytes(), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	for _, e := range benchEngines {
+		b.Run(e.name, func(b *testing.B) {
+			b.SetBytes(int64(archive.Len()))
+			for b.Loop() {
+				dir := b.TempDir()
+				e.run(b, exec.Command("tar", "-xf", src, "-C", dir), dir, memfs.New())
+			}
+		})
+	}
+}
+
+func BenchmarkGitClone(b *testing.B) {
+	if _, err := exec.LookPath("git"); err != nil {
+		b.Skip("no git command")
+	}
+	src := b.TempDir()
+	env := append(os.Environ(), "HOME="+b.TempDir(), "GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=bench", "GIT_AUTHOR_EMAIL=bench@example.com",
+		"GIT_COMMITTER_NAME=bench", "GIT_COMMITTER_EMAIL=bench@example.com")
+	for i := range 100 {
+		p := filepath.Join(src, fmt.Sprintf("d%d", i%10), fmt.Sprintf("f%d", i))
+		os.MkdirAll(filepath.Dir(p), 0o755)
+		if err := os.WriteFile(p, bytes.Repeat([]byte{byte('a' + i%26)}, 1024+i), 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{{"init", "-q"}, {"add", "."}, {"commit", "-q", "-m", "files"}} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir, cmd.Env = src, env
+		if out, err := cmd.CombinedOutput(); err != nil {
+			b.Fatalf("git %s: %v: %s", args[0], err, out)
+		}
+	}
+	for _, e := range benchEngines {
+		b.Run(e.name, func(b *testing.B) {
+			for b.Loop() {
+				dir := b.TempDir()
+				// A local clone would hard link the objects
+				// rather than write them.
+				cmd := exec.Command("git", "clone", "-q", "--no-local", src, filepath.Join(dir, "repo"))
+				cmd.Env = env
+				e.run(b, cmd, dir, memfs.New())
+			}
+		})
+	}
+}
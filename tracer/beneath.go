@@ -0,0 +1,362 @@
+package tracer
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// The tracer resolves the paths it serves from the host itself, in the
+// command's view, so a name the host serves is one with every symlink along
+// it already followed. Resolving the name again from its string would let
+// the command swap a directory on the way, or the file at the end, for a
+// symlink once the tracer has looked, and have the tracer follow it with
+// its own credentials: out of a remap's target, or to a file the command
+// may not read. The host is instead served through a descriptor of "/"
+// pinned for the Tracer's life. The directory of a name is opened below it
+// with openat2, RESOLVE_BENEATH and RESOLVE_NO_SYMLINKS, and the name
+// looked up there without following a final symlink, so that a symlink
+// swapped in fails with ELOOP, or is served as the symlink it is; only the
+// magic links of /proc, which cannot be swapped, are followed. realPath
+// walks host paths the same way, an element at a time from the directory
+// it reached, so that what it decides a path leads to holds together.
+// Kernels without openat2 resolve the directories as openat would.
+
+// openBeneath opens p below the directory dirfd with flags, following no
+// symlink, not even a final one unless flags hold O_PATH and O_NOFOLLOW.
+func openBeneath(dirfd int, p string, flags int) (int, error) {
+	how := unix.OpenHow{Flags: uint64(flags | unix.O_CLOEXEC), Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS}
+	fd, err := unix.Openat2(dirfd, p, &how)
+	if err == unix.ENOSYS {
+		fd, err = unix.Openat(dirfd, p, flags|unix.O_CLOEXEC, 0)
+	}
+	return fd, err
+}
+
+// fdPath returns the path through which the tracer reaches the file open
+// at fd.
+func fdPath(fd int) string { return "/proc/self/fd/" + strconv.Itoa(fd) }
+
+// readlinkFD returns the target of the symlink open at fd.
+func readlinkFD(fd int) (string, error) {
+	for n := 256; ; n *= 2 {
+		b := make([]byte, n)
+		m, err := unix.Readlinkat(fd, "", b)
+		if err != nil {
+			return "", err
+		}
+		if m < n {
+			return string(b[:m]), nil
+		}
+	}
+}
+
+// hostFS is the backend of the host, serving names below "/" without
+// following symlinks.
+type hostFS struct {
+	once sync.Once
+	root int
+	err  error
+}
+
+var (
+	_ vfs.Backend  = (*hostFS)(nil)
+	_ vfs.Xattrer  = (*hostFS)(nil)
+	_ vfs.StatFSer = (*hostFS)(nil)
+	_ vfs.Socketer = (*hostFS)(nil)
+)
+
+// rootFD returns the pinned descriptor of "/", opening it on first use.
+func (h *hostFS) rootFD() (int, error) {
+	h.once.Do(func() {
+		h.root, h.err = unix.Open("/", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	})
+	return h.root, h.err
+}
+
+// close closes the descriptor of "/", if it was opened.
+func (h *hostFS) close() {
+	h.once.Do(func() { h.err = fs.ErrClosed })
+	if h.err == nil {
+		unix.Close(h.root)
+		h.root, h.err = -1, fs.ErrClosed
+	}
+}
+
+// at calls fn with the path, through a descriptor of the directory of
+// name opened below the root, of name.
+func (h *hostFS) at(op, name string, fn func(p string) error) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: syscall.EINVAL}
+	}
+	dir, err := h.open(path.Dir(name), unix.O_PATH|unix.O_DIRECTORY)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	defer unix.Close(dir)
+	return named(fn(fdPath(dir)+"/"+path.Base(name)), op, name)
+}
+
+// pinned calls fn with the path, through a descriptor of it, of the named
+// file itself, or of the symlink if it is one, as final opens it.
+func (h *hostFS) pinned(op, name string, fn func(p string) error) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: syscall.EINVAL}
+	}
+	fd, err := h.final(name, unix.O_PATH, 0)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	defer unix.Close(fd)
+	return named(fn(fdPath(fd)), op, name)
+}
+
+// open opens name below the root with flags, as openBeneath does.
+func (h *hostFS) open(name string, flags int) (int, error) {
+	root, err := h.rootFD()
+	if err != nil {
+		return -1, err
+	}
+	return openBeneath(root, name, flags)
+}
+
+// final opens name with flags, its directory below the root as
+// openBeneath does and name itself without following a symlink; but for
+// the magic links of /proc, which the kernel resolves to the file they
+// stand for rather than by their text.
+func (h *hostFS) final(name string, flags int, perm uint32) (int, error) {
+	dir, err := h.open(path.Dir(name), unix.O_PATH|unix.O_DIRECTORY)
+	if err != nil {
+		return -1, err
+	}
+	defer unix.Close(dir)
+	base := path.Base(name)
+	fd, err := unix.Openat(dir, base, flags|unix.O_NOFOLLOW|unix.O_CLOEXEC, perm)
+	var st unix.Stat_t
+	if err == unix.ELOOP || err == nil && flags&unix.O_PATH != 0 && unix.Fstat(fd, &st) == nil && st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		var sfs unix.Statfs_t
+		if unix.Fstatfs(dir, &sfs) == nil && sfs.Type == unix.PROC_SUPER_MAGIC {
+			if err == nil {
+				unix.Close(fd)
+			}
+			return unix.Openat(dir, base, flags|unix.O_CLOEXEC, perm)
+		}
+	}
+	return fd, err
+}
+
+// named returns err, from an operation on the host path for name, as the
+// error of op on name.
+func named(err error, op, name string) error {
+	var pe *fs.PathError
+	var le *os.LinkError
+	switch {
+	case errors.As(err, &pe):
+		return &fs.PathError{Op: op, Path: name, Err: pe.Err}
+	case errors.As(err, &le):
+		return &fs.PathError{Op: op, Path: name, Err: le.Err}
+	case err != nil:
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+// namedInfo is what is known of a file, reached through a descriptor, by
+// its own name.
+type namedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi namedInfo) Name() string { return fi.name }
+
+// Open opens name as final does, failing with ELOOP for a symlink.
+func (h *hostFS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EINVAL}
+	}
+	fd, err := h.final(name, flag, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path.Join("/", name)), nil
+}
+
+// Stat describes the named file, or the symlink if it is one, as final
+// opens it.
+func (h *hostFS) Stat(name string) (fs.FileInfo, error) {
+	var fi fs.FileInfo
+	err := h.pinned("stat", name, func(p string) error {
+		var err error
+		fi, err = os.Stat(p)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return namedInfo{fi, path.Base(name)}, nil
+}
+
+func (h *hostFS) Lstat(name string) (fs.FileInfo, error) {
+	var fi fs.FileInfo
+	err := h.at("lstat", name, func(p string) error {
+		var err error
+		fi, err = os.Lstat(p)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return namedInfo{fi, path.Base(name)}, nil
+}
+
+// ReadDir reads the directory name, describing each entry through the
+// directory's descriptor as it goes.
+func (h *hostFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := h.Open(name, os.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	infos, err := f.(*os.File).Readdir(-1)
+	if err != nil {
+		return nil, named(err, "readdir", name)
+	}
+	entries := make([]fs.DirEntry, len(infos))
+	for i, fi := range infos {
+		entries[i] = fs.FileInfoToDirEntry(fi)
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+func (h *hostFS) Mkdir(name string, perm fs.FileMode) error {
+	return h.at("mkdir", name, func(p string) error { return os.Mkdir(p, perm) })
+}
+
+func (h *hostFS) Unlink(name string) error {
+	return h.at("unlink", name, func(p string) error { return syscall.Unlink(p) })
+}
+
+func (h *hostFS) Rmdir(name string) error {
+	return h.at("rmdir", name, func(p string) error { return syscall.Rmdir(p) })
+}
+
+func (h *hostFS) Rename(oldname, newname string) error {
+	return h.at("rename", oldname, func(oldp string) error {
+		return h.at("rename", newname, func(newp string) error { return os.Rename(oldp, newp) })
+	})
+}
+
+func (h *hostFS) Link(oldname, newname string) error {
+	return h.at("link", oldname, func(oldp string) error {
+		return h.at("link", newname, func(newp string) error { return os.Link(oldp, newp) })
+	})
+}
+
+func (h *hostFS) Symlink(target, newname string) error {
+	return h.at("symlink", newname, func(p string) error { return os.Symlink(target, p) })
+}
+
+func (h *hostFS) Readlink(name string) (string, error) {
+	var target string
+	err := h.at("readlink", name, func(p string) error {
+		var err error
+		target, err = os.Readlink(p)
+		return err
+	})
+	return target, err
+}
+
+func (h *hostFS) Chmod(name string, mode fs.FileMode) error {
+	return h.pinned("chmod", name, func(p string) error { return os.Chmod(p, mode) })
+}
+
+func (h *hostFS) Chtimes(name string, atime, mtime time.Time) error {
+	return h.pinned("chtimes", name, func(p string) error { return os.Chtimes(p, atime, mtime) })
+}
+
+func (h *hostFS) Getxattr(name, attr string) ([]byte, error) {
+	var v []byte
+	err := h.pinned("getxattr", name, func(p string) error {
+		var err error
+		v, err = vfs.Dir(p).Getxattr(".", attr)
+		return err
+	})
+	return v, err
+}
+
+func (h *hostFS) Setxattr(name, attr string, value []byte, flags int) error {
+	return h.pinned("setxattr", name, func(p string) error {
+		return vfs.Dir(p).Setxattr(".", attr, value, flags)
+	})
+}
+
+func (h *hostFS) Listxattr(name string) ([]string, error) {
+	var attrs []string
+	err := h.pinned("listxattr", name, func(p string) error {
+		var err error
+		attrs, err = vfs.Dir(p).Listxattr(".")
+		return err
+	})
+	return attrs, err
+}
+
+func (h *hostFS) Removexattr(name, attr string) error {
+	return h.pinned("removexattr", name, func(p string) error {
+		return vfs.Dir(p).Removexattr(".", attr)
+	})
+}
+
+func (h *hostFS) StatFS(name string) (vfs.FSStat, error) {
+	var st vfs.FSStat
+	err := h.pinned("statfs", name, func(p string) error {
+		var err error
+		st, err = vfs.Dir(p).StatFS(".")
+		return err
+	})
+	return st, err
+}
+
+// SocketPath returns the host path of the named file, which the command
+// binds or connects to itself.
+func (h *hostFS) SocketPath(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "socket", Path: name, Err: syscall.EINVAL}
+	}
+	return path.Join("/", name), nil
+}
+
+// readlinkAt returns the target of next, the element c of the directory
+// dirfd, and whether it is a symlink, in the virtual tree or on the host.
+// A host file is opened below dirfd, as openBeneath does, and its
+// descriptor returned for the walk to go on from; the descriptor is -1 for
+// a virtual file or one that cannot be opened, and for a host file below
+// one, which is read by its path.
+func (t *Tracer) readlinkAt(dirfd int, next, c string) (string, int, bool) {
+	if _, _, ok := t.lookup(next); ok || dirfd < 0 {
+		target, ok := t.readlink(next)
+		return target, -1, ok
+	}
+	fd, err := openBeneath(dirfd, c, unix.O_PATH|unix.O_NOFOLLOW)
+	if err != nil {
+		return "", -1, false
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFLNK {
+		return "", fd, false
+	}
+	target, err := readlinkFD(fd)
+	return target, fd, err == nil
+}
@@ -0,0 +1,254 @@
+package tracer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Caps is what the host lets a tracer do, as Capabilities finds it. Each
+// error is nil if the host allows what it describes, and otherwise a
+// *CapabilityError saying what to enable.
+type Caps struct {
+	// PtraceScope is Yama's kernel.yama.ptrace_scope: 0 lets a process
+	// trace any other of its user's, 1 only its descendants, 2 only with
+	// CAP_SYS_PTRACE and 3 none at all. It is -1 without Yama.
+	PtraceScope int
+	// SysPtrace is whether the tracer has CAP_SYS_PTRACE.
+	SysPtrace bool
+	// Ptrace is whether the tracer can trace the commands it starts, as
+	// both engines need, and Attach whether Attach can take over
+	// processes that are not its descendants.
+	Ptrace, Attach error
+	// Seccomp is whether seccomp filters can stop the command only at
+	// intercepted syscalls, as WithSeccomp's fast path has them, and
+	// SeccompNotify whether they can notify a listener, as EngineUnotify
+	// needs.
+	Seccomp, SeccompNotify error
+	// ProcessVM is whether process_vm_readv can read the memory of the
+	// commands the tracer starts. EngineUnotify needs it, and EnginePtrace
+	// is slower without it, reading a word at a time.
+	ProcessVM error
+	// UserNamespaces is whether the tracer can start the command in the
+	// namespaces of WithUserNamespace.
+	UserNamespaces error
+}
+
+// A CapabilityError is what Capabilities reports of something the host
+// does not let the tracer do. Run returns one when that is why it cannot
+// start the command or attach to a process.
+type CapabilityError struct {
+	// Capability names what is missing, as "ptrace" does.
+	Capability string
+	// Err is the error using it failed with, and Fix says what would let
+	// the tracer use it.
+	Err error
+	Fix string
+}
+
+func (e *CapabilityError) Error() string {
+	return fmt.Sprintf("tracer: %s unavailable: %v; %s", e.Capability, e.Err, e.Fix)
+}
+
+func (e *CapabilityError) Unwrap() error { return e.Err }
+
+var probeCaps = sync.OnceValue(probe)
+
+// Capabilities probes what the host lets a tracer do: how Yama restricts
+// ptrace, whether the command can be traced and its memory read, which
+// seccomp filters can be installed, and whether user namespaces can be
+// made. Restricted containers are the usual reason one is missing, their
+// seccomp profiles denying ptrace, process_vm_readv or new namespaces. The
+// probe starts a copy of the running program, traced, and kills it at its
+// exec, before it runs; it is made once, and its findings kept.
+func Capabilities() Caps {
+	return probeCaps()
+}
+
+func probe() Caps {
+	c := Caps{PtraceScope: -1, SysPtrace: hasCapability(unix.CAP_SYS_PTRACE)}
+	if n, ok := sysctl("kernel/yama/ptrace_scope"); ok {
+		c.PtraceScope = n
+	}
+	c.Seccomp = seccompAction("seccomp filters", unix.SECCOMP_RET_TRACE,
+		"the kernel needs CONFIG_SECCOMP_FILTER, and a container a seccomp profile allowing seccomp; WithSeccomp(false) stops at every syscall instead")
+	c.SeccompNotify = seccompAction("seccomp notifications", unix.SECCOMP_RET_USER_NOTIF,
+		"EngineUnotify needs Linux 5.0 or later, and a container a seccomp profile allowing seccomp; EnginePtrace works without")
+
+	// The children are traced by the thread that starts them.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		var err error
+		if c.ProcessVM, err = probeChild(nil); err != nil {
+			c.Ptrace = c.ptraceError(err, false)
+			c.ProcessVM = c.Ptrace
+			c.UserNamespaces = c.Ptrace
+			return
+		}
+		if _, err = probeChild(&UserNamespace{}); err != nil {
+			c.UserNamespaces = &CapabilityError{Capability: "user namespaces", Err: err, Fix: usernsFix()}
+		}
+	}()
+	<-done
+	c.Attach = c.Ptrace
+	if c.Attach == nil && c.PtraceScope >= 1 && !c.SysPtrace {
+		c.Attach = c.ptraceError(unix.EPERM, true)
+	}
+	return c
+}
+
+// ptraceError returns the CapabilityError of ptrace failing with err, on
+// a process the tracer did not start if attach is set.
+func (c *Caps) ptraceError(err error, attach bool) error {
+	e := &CapabilityError{Capability: "ptrace", Err: err}
+	switch {
+	case c.PtraceScope >= 3:
+		e.Fix = "kernel.yama.ptrace_scope is 3, which only a reboot lowers"
+	case (c.PtraceScope == 2 || attach && c.PtraceScope == 1) && !c.SysPtrace:
+		lower := 1
+		if attach {
+			lower = 0
+		}
+		e.Fix = fmt.Sprintf("kernel.yama.ptrace_scope is %d: give the tracer CAP_SYS_PTRACE, or lower it with sysctl kernel.yama.ptrace_scope=%d", c.PtraceScope, lower)
+	default:
+		e.Fix = "a seccomp profile or security module denies it: run a container with --cap-add=SYS_PTRACE, or with --security-opt seccomp=unconfined"
+	}
+	return e
+}
+
+// probeChild starts the running program traced, in the namespaces ns
+// describes if any, and kills it once it stops at its exec. It returns
+// the CapabilityError of reading the child's memory with process_vm_readv,
+// if that failed, and the error starting it failed with.
+func probeChild(ns *UserNamespace) (vm, err error) {
+	cmd := exec.Command("/proc/self/exe")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Ptrace: true, Pdeathsig: syscall.SIGKILL}
+	if ns != nil {
+		ns.apply(cmd.SysProcAttr)
+	}
+	if err := cmd.Start(); err != nil {
+		var pe *os.PathError
+		if errors.As(err, &pe) {
+			err = pe.Err
+		}
+		return nil, err
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+	var ws unix.WaitStatus
+	if _, err := unix.Wait4(pid, &ws, unix.WALL, nil); err != nil {
+		return nil, err
+	}
+	var regs unix.PtraceRegs
+	if err := getRegs(pid, &regs); err != nil {
+		return nil, err
+	}
+	if _, err := vmMemory(pid).readBytes(uintptr(stackPointer(&regs)), 8); err != nil {
+		fix := "a seccomp profile denies it, as some container runtimes' do"
+		if errors.Is(err, unix.ENOSYS) {
+			fix = "the kernel needs CONFIG_CROSS_MEMORY_ATTACH"
+		}
+		return &CapabilityError{Capability: "process_vm_readv", Err: err, Fix: fix + "; EngineUnotify needs it"}, nil
+	}
+	return nil, nil
+}
+
+// seccompAction returns the CapabilityError of the kernel not having the
+// seccomp filter action, or nil if it has it.
+func seccompAction(capability string, action uint32, fix string) error {
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_GET_ACTION_AVAIL, 0, uintptr(unsafe.Pointer(&action)))
+	if errno != 0 {
+		return &CapabilityError{Capability: capability, Err: errno, Fix: fix}
+	}
+	return nil
+}
+
+// usernsFix says what would let the tracer make user namespaces, from the
+// sysctls that can forbid them.
+func usernsFix() string {
+	if n, ok := sysctl("user/max_user_namespaces"); ok && n == 0 {
+		return "raise user.max_user_namespaces above 0 with sysctl"
+	}
+	if n, ok := sysctl("kernel/unprivileged_userns_clone"); ok && n == 0 && os.Geteuid() != 0 {
+		return "set kernel.unprivileged_userns_clone to 1 with sysctl"
+	}
+	if n, ok := sysctl("kernel/apparmor_restrict_unprivileged_userns"); ok && n != 0 && os.Geteuid() != 0 {
+		return "set kernel.apparmor_restrict_unprivileged_userns to 0 with sysctl, or give the program an AppArmor profile allowing userns"
+	}
+	return "a seccomp profile or security module denies them, as container runtimes' do by default"
+}
+
+// sysctl reads the integer sysctl at name under /proc/sys.
+func sysctl(name string) (int, bool) {
+	b, err := os.ReadFile("/proc/sys/" + name)
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	return n, err == nil
+}
+
+// hasCapability reports whether the tracer has the capability cap in its
+// effective set.
+func hasCapability(cap uint) bool {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if s, ok := strings.CutPrefix(sc.Text(), "CapEff:"); ok {
+			set, err := strconv.ParseUint(strings.TrimSpace(s), 16, 64)
+			return err == nil && set&(1<<cap) != 0
+		}
+	}
+	return false
+}
+
+// chooseEngine returns the engine EngineAuto stands for.
+func (t *Tracer) chooseEngine() Engine {
+	if t.cmd == nil || !t.useSeccomp || t.pinPaths || t.chroot || len(t.exitHooks) > 0 || t.supervisor != nil {
+		return EnginePtrace
+	}
+	c := Capabilities()
+	for _, err := range []error{c.SeccompNotify, c.ProcessVM} {
+		if err != nil {
+			t.log.Printf("using ptrace: %v", err)
+			return EnginePtrace
+		}
+	}
+	return EngineUnotify
+}
+
+// startError returns err, from starting the command, or the
+// CapabilityError that explains it if there is one.
+func (t *Tracer) startError(err error) error {
+	if !errors.Is(err, unix.EPERM) && !errors.Is(err, unix.ENOSPC) && !errors.Is(err, unix.ENOSYS) {
+		return err
+	}
+	c := Capabilities()
+	if c.Ptrace != nil {
+		return c.Ptrace
+	}
+	if t.userns != nil && c.UserNamespaces != nil {
+		return c.UserNamespaces
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package tracer
+
+import (
+	"io/fs"
+
+	"golang.org/x/sys/unix"
+)
+
+// chTarget returns the file a chmod or chown syscall names: the virtual
+// file open as dirfd if pathAddr is 0, or if the path is empty and flags
+// hold AT_EMPTY_PATH, or else what the path leads to from dirfd, without
+// following a final symlink if flags hold AT_SYMLINK_NOFOLLOW. It reports
+// false if the file is not virtual.
+func (th *thread) chTarget(op string, dirfd int, pathAddr uintptr, flags int) (abs string, m *mount, name string, ret int64, ok bool) {
+	var p string
+	if pathAddr != 0 {
+		var err error
+		if p, err = th.mem.readString(pathAddr); err != nil {
+			return "", nil, "", 0, false
+		}
+	}
+	if p == "" {
+		f, ok := th.fds.get(dirfd)
+		if !ok || (pathAddr != 0 && flags&unix.AT_EMPTY_PATH == 0) {
+			return "", nil, "", 0, false
+		}
+		th.t.log.Printf("%s: fd=%d (virtual)", op, dirfd)
+		return f.path, f.mount, f.name, 0, true
+	}
+	abs, through, err := th.resolveArg(dirfd, p)
+	if err != nil {
+		ret, ok = resolveFailed(err)
+		return "", nil, "", ret, ok
+	}
+	if m, name, ok = th.lookupArg(abs, through); !ok {
+		return "", nil, "", 0, false
+	}
+	th.t.log.Printf("%s: %s (virtual)", op, abs)
+	if flags&unix.AT_SYMLINK_NOFOLLOW == 0 {
+		if abs, m, name, err = th.follow(abs); err != nil {
+			return "", nil, "", errnoRet(err), true
+		}
+	}
+	return abs, m, name, 0, true
+}
+
+// sysFchmodat also handles fchmod, which is fchmodat2 with a null path,
+// chmod, which canonical turns into fchmodat, and fchmodat2.
+func (th *thread) sysFchmodat(dirfd int, pathAddr uintptr, mode uint32, flags int) (int64, bool) {
+	_, m, name, ret, ok := th.chTarget("fchmodat", dirfd, pathAddr, flags)
+	if !ok || ret < 0 {
+		return ret, ok
+	}
+	if flags&^(unix.AT_SYMLINK_NOFOLLOW|unix.AT_EMPTY_PATH) != 0 {
+		return -int64(unix.EINVAL), true
+	}
+	// Like Linux, the tracer cannot change the mode of a symlink itself.
+	if flags&unix.AT_SYMLINK_NOFOLLOW != 0 {
+		fi, err := m.backend.Lstat(name)
+		if err != nil {
+			return errnoRet(err), true
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return -int64(unix.EOPNOTSUPP), true
+		}
+	}
+	perm := fs.FileMode(mode & 0o777)
+	if mode&unix.S_ISUID != 0 {
+		perm |= fs.ModeSetuid
+	}
+	if mode&unix.S_ISGID != 0 {
+		perm |= fs.ModeSetgid
+	}
+	if mode&unix.S_ISVTX != 0 {
+		perm |= fs.ModeSticky
+	}
+	if err := m.backend.Chmod(name, perm); err != nil {
+		return errnoRet(err), true
+	}
+	return 0, true
+}
+
+// sysFchownat also handles fchown, which is fchownat with a null path, and
+// chown and lchown, which canonical turns into fchownat calls. Backends
+// keep no owners, so a virtual file can only be given the owner it is
+// reported to have, as chown -R and tar do when they change nothing;
+// giving it any other fails as it would for an unprivileged user, unless
+// WithFakeRoot has it recorded.
+func (th *thread) sysFchownat(dirfd int, pathAddr uintptr, uid, gid uint32, flags int) (int64, bool) {
+	abs, m, name, ret, ok := th.chTarget("fchownat", dirfd, pathAddr, flags)
+	if !ok && th.t.fakeRoot {
+		return th.fakeHostChown(dirfd, pathAddr, uid, gid, flags)
+	}
+	if !ok || ret < 0 {
+		return ret, ok
+	}
+	if flags&^(unix.AT_SYMLINK_NOFOLLOW|unix.AT_EMPTY_PATH) != 0 {
+		return -int64(unix.EINVAL), true
+	}
+	fi, err := m.backend.Lstat(name)
+	if err != nil {
+		return errnoRet(err), true
+	}
+	st := m.stat(abs, fi)
+	th.t.fakeStat(m, name, &st)
+	if th.t.fakeRoot {
+		return fakeChown(m, name, st, uid, gid), true
+	}
+	if (uid != ^uint32(0) && uid != st.Uid) || (gid != ^uint32(0) && gid != st.Gid) {
+		return -int64(unix.EPERM), true
+	}
+	return 0, true
+}
@@ -0,0 +1,287 @@
+package tracer
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithChroot emulates chroot and pivot_root, so that a command that shuts
+// itself into a directory, as a sandbox or a tool like debootstrap does,
+// can be run without privileges. Once a process has changed its root,
+// every path it names is resolved below the new root, host and virtual
+// directories alike: an absolute path or symlink starts there, and ".."
+// goes no higher. The paths of syscalls the kernel handles are rewritten
+// to the directories they lead to, and getcwd reports paths from the root.
+// The root is shared as the working directory is, by the threads and
+// children that share it with CLONE_FS, and inherited on fork; children
+// made otherwise get a copy.
+//
+// pivot_root makes new_root the root of the calling process alone, rather
+// than of the whole mount namespace, and a following umount2 of put_old,
+// as in the pivot_root(".", ".") idiom, succeeds without doing anything.
+// Nothing is mounted, and the old root is not reachable through put_old.
+// A dynamically linked program exec'd within a root is run through the
+// dynamic loader its PT_INTERP names below the root, with --argv0, which
+// glibc's loader has understood since 2.33; /proc/self/exe then names the
+// loader. Paths the kernel reports itself, such as the links in /proc and
+// the addresses of Unix sockets, are the host's, and the paths given to
+// bind, connect and inotify_add_watch are not rewritten. Run fails under
+// EngineUnotify, which cannot repoint a syscall's arguments.
+func WithChroot() Option {
+	return func(t *Tracer) { t.chroot = true }
+}
+
+// chrootSyscalls returns the syscalls WithChroot needs trapped: chroot and
+// pivot_root, and every syscall with a path to be rewritten.
+func (t *Tracer) chrootSyscalls() []uint64 {
+	if !t.chroot {
+		return nil
+	}
+	nrs := []uint64{unix.SYS_CHROOT, unix.SYS_PIVOT_ROOT, unix.SYS_UMOUNT2}
+	nrs = append(nrs, writeSyscalls...)
+	return append(nrs, pathSyscalls...)
+}
+
+func (th *thread) sysChroot(pathAddr uintptr) (int64, bool) {
+	if !th.t.chroot {
+		return 0, false
+	}
+	abs, ret := th.rootDir(pathAddr)
+	if ret < 0 {
+		return ret, true
+	}
+	th.t.log.Printf("chroot: %s", abs)
+	th.cwd.root = abs
+	if abs == "/" {
+		th.cwd.root = ""
+	}
+	return 0, true
+}
+
+// sysPivotRoot emulates pivot_root as a chroot to new_root, which put_old
+// must be at or below.
+func (th *thread) sysPivotRoot(newAddr, oldAddr uintptr) (int64, bool) {
+	if !th.t.chroot {
+		return 0, false
+	}
+	newRoot, ret := th.rootDir(newAddr)
+	if ret < 0 {
+		return ret, true
+	}
+	putOld, ret := th.rootDir(oldAddr)
+	if ret < 0 {
+		return ret, true
+	}
+	if newRoot == "/" || putOld != newRoot && !strings.HasPrefix(putOld, newRoot+"/") {
+		return -int64(unix.EINVAL), true
+	}
+	th.t.log.Printf("pivot_root: %s, %s", newRoot, putOld)
+	th.cwd.root, th.cwd.putOld = newRoot, putOld
+	return 0, true
+}
+
+// sysUmount2 has an unmount of the put_old of an emulated pivot_root
+// succeed, and leaves any other to the kernel.
+func (th *thread) sysUmount2(pathAddr uintptr) (int64, bool) {
+	if th.cwd.putOld == "" {
+		return 0, false
+	}
+	p, err := th.mem.readString(pathAddr)
+	if err != nil {
+		return 0, false
+	}
+	abs, err := th.resolve(unix.AT_FDCWD, p)
+	if err != nil {
+		return 0, false
+	}
+	if abs, _, _, err = th.follow(abs); err != nil || abs != th.cwd.putOld {
+		return 0, false
+	}
+	th.t.log.Printf("umount2: %s (virtual)", abs)
+	th.cwd.putOld = ""
+	return 0, true
+}
+
+// rootDir resolves the path at addr, symlinks and all, to the directory a
+// chroot or pivot_root makes the root, and returns it or a negated errno.
+func (th *thread) rootDir(addr uintptr) (string, int64) {
+	p, err := th.mem.readString(addr)
+	switch {
+	case errors.Is(err, errStringTooLong):
+		return "", -int64(unix.ENAMETOOLONG)
+	case err != nil:
+		return "", -int64(unix.EFAULT)
+	case p == "":
+		return "", -int64(unix.ENOENT)
+	}
+	abs, err := th.resolve(unix.AT_FDCWD, p)
+	if err != nil {
+		return "", errnoRet(err)
+	}
+	abs, m, name, err := th.follow(abs)
+	if err != nil {
+		return "", errnoRet(err)
+	}
+	fi, err := m.backend.Stat(name)
+	if err != nil {
+		return "", errnoRet(err)
+	}
+	if !fi.IsDir() {
+		return "", -int64(unix.ENOTDIR)
+	}
+	return abs, 0
+}
+
+// reroot points the paths of the syscall c, which the kernel is to run
+// for a thread with a root of its own, at copies of where they lead below
+// the root, made in its scratch memory, as pin does. It reports whether c
+// must fail instead, with the returned errno: a path that cannot be
+// resolved or copied is never left for the kernel to resolve from the
+// host's root.
+func (th *thread) reroot(c *sysCall) (int64, bool) {
+	n, ok := native(*c)
+	if !ok || th.scratch == nil {
+		return -int64(unix.ENOSYS), true
+	}
+	refs, _ := callRefs(canonical(n))
+	var copies [][2]uintptr
+	for _, ref := range refs {
+		if ref.fd || ref.addr == 0 {
+			continue
+		}
+		p, err := th.mem.readString(ref.addr)
+		if errors.Is(err, errStringTooLong) {
+			return -int64(unix.ENAMETOOLONG), true
+		} else if err != nil {
+			return -int64(unix.EFAULT), true
+		}
+		if p == "" {
+			continue
+		}
+		abs, err := th.resolve(ref.dirfd, p)
+		if err != nil {
+			if ret, ok := resolveFailed(err); ok {
+				return ret, true
+			}
+			return -int64(unix.EBADF), true
+		}
+		if ref.follow {
+			if abs, _, _, err = th.follow(abs); err != nil {
+				return errnoRet(err), true
+			}
+		} else if strings.HasSuffix(p, "/") {
+			// A trailing slash has the kernel follow the final name.
+			abs += "/"
+		}
+		addr, errno := th.pinBytes(append([]byte(abs), 0))
+		if errno != 0 {
+			return -int64(errno), true
+		}
+		copies = append(copies, [2]uintptr{ref.addr, addr})
+	}
+	return th.repoint(c, n, copies)
+}
+
+// rootExec sets x up to run the program at prog, the absolute path an
+// execve of a thread with a root of its own leads to, with the
+// interpreters of scripts and the dynamic loaders of programs found below
+// the root as well. It returns the errno to fail the execve with, if any.
+func (th *thread) rootExec(x *execution, prog string) unix.Errno {
+	t := th.t
+	for depth := 0; ; depth++ {
+		var (
+			m    *mount
+			name string
+			err  error
+		)
+		if depth == 0 && x.flags&unix.AT_SYMLINK_NOFOLLOW != 0 {
+			m, name = th.rootLookup(prog)
+			if fi, err := m.backend.Lstat(name); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+				return unix.ELOOP
+			}
+		} else if prog, m, name, err = th.follow(prog); err != nil {
+			return errnoFor(err)
+		}
+		f, interp, arg, errno := openProgram(m, name)
+		if errno != 0 {
+			return errno
+		}
+		binary := f != nil
+		if binary {
+			if interp, err = elfInterp(f); err != nil {
+				_ = f.Close()
+				return unix.ENOEXEC
+			}
+			if interp == "" && m != &t.host {
+				t.log.Printf("exec: %s (virtual)", prog)
+				x.file, x.prog = f, prog
+				return 0
+			}
+			_ = f.Close()
+			if interp == "" {
+				x.path = path.Join("/", name)
+				return 0
+			}
+		}
+		if depth == maxInterp {
+			return unix.ELOOP
+		}
+		if x.argv == nil {
+			if x.argv, err = th.stringArray(x.argvAddr); err != nil {
+				return unix.EFAULT
+			}
+		}
+		argv := []string{interp}
+		if binary {
+			// The loader runs the program itself, given its path and
+			// the argv[0] it was exec'd with.
+			argv0 := th.unroot(prog)
+			if len(x.argv) > 0 {
+				argv0 = x.argv[0]
+			}
+			argv = append(argv, "--argv0", argv0)
+		} else if arg != "" {
+			argv = append(argv, arg)
+		}
+		argv = append(argv, th.unroot(prog))
+		if len(x.argv) > 1 {
+			argv = append(argv, x.argv[1:]...)
+		}
+		x.argv = argv
+		if prog, err = th.resolve(unix.AT_FDCWD, interp); err != nil {
+			return errnoFor(err)
+		}
+	}
+}
+
+// rootLookup returns the mount of the absolute path abs, and its name
+// there, serving a path outside the virtual tree from the host.
+func (th *thread) rootLookup(abs string) (*mount, string) {
+	if m, name, ok := th.t.lookup(abs); ok {
+		return m, name
+	}
+	return &th.t.host, path.Join(".", abs)
+}
+
+// elfInterp returns the dynamic loader the ELF program r names with
+// PT_INTERP, or "" for a program that needs none.
+func elfInterp(r io.ReaderAt) (string, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_INTERP {
+			b, err := io.ReadAll(p.Open())
+			return string(bytes.TrimRight(b, "\x00")), err
+		}
+	}
+	return "", nil
+}
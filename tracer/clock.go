@@ -0,0 +1,334 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// A Clock is the time a command traced WithClock sees, which the embedder
+// controls: it can be frozen, run slower or faster than real time, or
+// stepped forward by hand, for deterministic tests of programs that depend
+// on time. Its methods are safe for concurrent use, and can be called while
+// the command runs.
+//
+// The clock stands in for the realtime, TAI, monotonic and boottime clocks
+// the command reads with clock_gettime, gettimeofday and time, and waits
+// on with nanosleep and clock_nanosleep. All of them move together: the
+// time that has passed on each since NewClock is the clock's virtual time.
+// Clocks of the CPU time used, timeouts of other syscalls, and timers are
+// left to the kernel.
+type Clock struct {
+	mu sync.Mutex
+	// elapsed is the virtual time that had passed when the real time was
+	// anchor, and scale how fast it has passed since.
+	anchor  time.Time
+	elapsed time.Duration
+	scale   float64
+	// base is the reading of each clock at NewClock, and shift what the
+	// wall clocks are set off by from the real ones.
+	base  map[int32]int64
+	shift time.Duration
+}
+
+// clockIDs are the clocks a Clock stands in for.
+var clockIDs = []int32{
+	unix.CLOCK_REALTIME, unix.CLOCK_REALTIME_COARSE, unix.CLOCK_TAI,
+	unix.CLOCK_MONOTONIC, unix.CLOCK_MONOTONIC_COARSE, unix.CLOCK_MONOTONIC_RAW,
+	unix.CLOCK_BOOTTIME,
+}
+
+// NewClock returns a Clock that runs at real speed, and whose wall time
+// starts at start, or at the real time if start is zero.
+func NewClock(start time.Time) *Clock {
+	c := &Clock{scale: 1, base: make(map[int32]int64)}
+	for _, id := range clockIDs {
+		var ts unix.Timespec
+		if err := unix.ClockGettime(id, &ts); err == nil {
+			c.base[id] = ts.Nano()
+		}
+	}
+	c.anchor = time.Now()
+	if !start.IsZero() {
+		c.shift = time.Duration(start.UnixNano() - c.base[unix.CLOCK_REALTIME])
+	}
+	return c
+}
+
+// WithClock makes the command see the time of c in place of the real time.
+// So that it asks the kernel, which the tracer can answer, programs the
+// tracer starts are not given the vDSO, which would read the real clocks
+// in user space: the entry of the auxiliary vector that locates it is
+// blanked at each exec. A program exec'd under EngineUnotify, which gets
+// no stop at the exec, and an attached process keep theirs, as does a
+// program run as i386. A sleep a signal cuts short starts over once the
+// signal is handled.
+func WithClock(c *Clock) Option {
+	return func(t *Tracer) { t.clock = c }
+}
+
+// Now returns the wall time the command sees.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Unix(0, c.read(unix.CLOCK_REALTIME, time.Now()))
+}
+
+// Freeze stops the clock. Until it is scaled again it moves only when
+// stepped, and when the command sleeps: a sleep returns at once, having
+// stepped the clock to when it was to end. A program with threads that
+// sleep in the background, as the Go runtime's do, sees its time run on.
+func (c *Clock) Freeze() { c.Scale(0) }
+
+// Scale makes the clock run f times as fast as real time from now on. It
+// panics if f is negative, as the clocks it stands in for never go back.
+func (c *Clock) Scale(f float64) {
+	if f < 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+		panic("tracer: clock scale out of range")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reanchor(time.Now())
+	c.scale = f
+}
+
+// Step moves the clock forward by d. It panics if d is negative.
+func (c *Clock) Step(d time.Duration) {
+	if d < 0 {
+		panic("tracer: negative clock step")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.elapsed += d
+}
+
+// Set sets the wall time the command sees to t, backward or forward, as
+// settimeofday would. The monotonic and boottime clocks are not changed.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shift += time.Duration(t.UnixNano() - c.read(unix.CLOCK_REALTIME, time.Now()))
+}
+
+// reanchor folds the virtual time that has passed up to now into elapsed.
+func (c *Clock) reanchor(now time.Time) {
+	c.elapsed += time.Duration(float64(now.Sub(c.anchor)) * c.scale)
+	c.anchor = now
+}
+
+// read returns the reading in nanoseconds of the clock id at the real time
+// now, which must be a clock the Clock stands in for. c.mu must be held.
+func (c *Clock) read(id int32, now time.Time) int64 {
+	ns := c.base[id] + int64(c.elapsed) + int64(float64(now.Sub(c.anchor))*c.scale)
+	if id == unix.CLOCK_REALTIME || id == unix.CLOCK_REALTIME_COARSE || id == unix.CLOCK_TAI {
+		ns += int64(c.shift)
+	}
+	return ns
+}
+
+// reading returns the reading of the clock id, which reports false for a
+// clock the Clock does not stand in for.
+func (c *Clock) reading(id int32) (int64, bool) {
+	if _, ok := c.base[id]; !ok {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.read(id, time.Now()), true
+}
+
+// wait returns how long in real time a sleep on the clock id until its
+// reading is deadline has left, or false once the sleep is over. A frozen
+// clock is stepped to the deadline instead.
+func (c *Clock) wait(id int32, deadline int64) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	left := deadline - c.read(id, time.Now())
+	switch {
+	case left <= 0:
+		return 0, false
+	case c.scale == 0:
+		c.elapsed += time.Duration(left)
+		return 0, false
+	}
+	return max(time.Duration(float64(left)/c.scale), time.Microsecond), true
+}
+
+// clockSleep is a sleep the thread is in on the virtual clock: until the
+// clock id reads deadline, next checked after real.
+type clockSleep struct {
+	id       int32
+	deadline int64
+	real     time.Duration
+}
+
+// clockSyscalls returns the syscalls a virtual clock needs trapped.
+func (t *Tracer) clockSyscalls() []uint64 {
+	if t.clock == nil {
+		return nil
+	}
+	return []uint64{
+		unix.SYS_CLOCK_GETTIME, unix.SYS_GETTIMEOFDAY, sysTime,
+		unix.SYS_NANOSLEEP, unix.SYS_CLOCK_NANOSLEEP,
+	}
+}
+
+// now returns the time the command sees.
+func (t *Tracer) now() time.Time {
+	if t.clock != nil {
+		return t.clock.Now()
+	}
+	return time.Now()
+}
+
+func (th *thread) sysClockGettime(id int32, ts uintptr) (int64, bool) {
+	c := th.t.clock
+	if c == nil {
+		return 0, false
+	}
+	ns, ok := c.reading(id)
+	if !ok {
+		return 0, false
+	}
+	return th.writeTime(ts, ns, time.Nanosecond), true
+}
+
+func (th *thread) sysGettimeofday(tv, tz uintptr) (int64, bool) {
+	c := th.t.clock
+	if c == nil {
+		return 0, false
+	}
+	ns, _ := c.reading(unix.CLOCK_REALTIME)
+	if tv != 0 {
+		if ret := th.writeTime(tv, ns, time.Microsecond); ret < 0 {
+			return ret, true
+		}
+	}
+	if tz != 0 {
+		// The kernel's timezone is all zeros unless set.
+		if err := th.mem.writeBytes(tz, make([]byte, 8)); err != nil {
+			return -int64(unix.EFAULT), true
+		}
+	}
+	return 0, true
+}
+
+func (th *thread) sysTime(tloc uintptr) (int64, bool) {
+	c := th.t.clock
+	if c == nil {
+		return 0, false
+	}
+	ns, _ := c.reading(unix.CLOCK_REALTIME)
+	sec := ns / int64(time.Second)
+	if tloc != 0 {
+		if err := th.mem.writeBytes(tloc, binary.LittleEndian.AppendUint64(nil, uint64(sec))); err != nil {
+			return -int64(unix.EFAULT), true
+		}
+	}
+	return sec, true
+}
+
+// writeTime writes ns at addr as a timespec, or, with a unit of a
+// microsecond, a timeval.
+func (th *thread) writeTime(addr uintptr, ns int64, unit time.Duration) int64 {
+	sec, frac := ns/int64(time.Second), ns%int64(time.Second)
+	b := binary.LittleEndian.AppendUint64(nil, uint64(sec))
+	b = binary.LittleEndian.AppendUint64(b, uint64(frac/int64(unit)))
+	if err := th.mem.writeBytes(addr, b); err != nil {
+		return -int64(unix.EFAULT)
+	}
+	return 0
+}
+
+// sysClockNanosleep sleeps on the virtual clock. A sleep that is not over
+// is left to the engine, which holds the thread for th.nap.real and then
+// has it make the syscall again, to go on with the sleep th.nap records.
+func (th *thread) sysClockNanosleep(id int32, flags int, req uintptr) (int64, bool) {
+	c := th.t.clock
+	if c == nil {
+		return 0, false
+	}
+	nap := th.nap
+	th.nap = nil
+	if nap == nil {
+		now, ok := c.reading(id)
+		if !ok {
+			return 0, false
+		}
+		b, err := th.mem.readBytes(req, 16)
+		if err != nil {
+			return -int64(unix.EFAULT), true
+		}
+		sec, nsec := int64(binary.LittleEndian.Uint64(b)), int64(binary.LittleEndian.Uint64(b[8:]))
+		if sec < 0 || nsec < 0 || nsec >= int64(time.Second) {
+			return -int64(unix.EINVAL), true
+		}
+		nap = &clockSleep{id: id, deadline: sec*int64(time.Second) + nsec}
+		if flags&unix.TIMER_ABSTIME == 0 {
+			nap.deadline += now
+		}
+	}
+	real, ok := c.wait(nap.id, nap.deadline)
+	if !ok {
+		return 0, true
+	}
+	nap.real = real
+	th.nap = nap
+	return 0, false
+}
+
+const (
+	atIgnore      = 1
+	atSysinfoEhdr = 33
+)
+
+// hideVDSO hides the vDSO from the program th has just exec'd, by making
+// the entry of its auxiliary vector that locates it, past argc, argv and
+// the environment at the top of the new stack, AT_IGNORE. Programs
+// without it make the syscalls the vDSO would have answered.
+func (th *thread) hideVDSO() error {
+	var regs unix.PtraceRegs
+	if err := getRegs(th.tid, &regs); err != nil {
+		return err
+	}
+	if isCompat(&regs) {
+		return nil
+	}
+	sp := uintptr(stackPointer(&regs))
+	word := func(i int) (uint64, error) {
+		b, err := th.mem.readBytes(sp+uintptr(8*i), 8)
+		if err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint64(b), nil
+	}
+	argc, err := word(0)
+	if err != nil {
+		return err
+	}
+	i := int(argc) + 2
+	for {
+		env, err := word(i)
+		if err != nil {
+			return err
+		}
+		i++
+		if env == 0 {
+			break
+		}
+	}
+	for ; ; i += 2 {
+		key, err := word(i)
+		switch {
+		case err != nil:
+			return err
+		case key == 0:
+			return nil
+		case key == atSysinfoEhdr:
+			return th.mem.writeBytes(sp+uintptr(8*i), binary.LittleEndian.AppendUint64(nil, atIgnore))
+		}
+	}
+}
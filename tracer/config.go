@@ -0,0 +1,694 @@
+package tracer
+
+import (
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/archivefs"
+	"github.com/maxmcd/cfc-ptrace/vfs/boltfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/devfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/httpfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/oci"
+	"github.com/maxmcd/cfc-ptrace/vfs/overlay"
+	"github.com/maxmcd/cfc-ptrace/vfs/s3"
+)
+
+// FromConfig reads the TOML file at path and returns the Option that sets
+// up a Tracer the way it describes, so that a policy can live in version
+// control next to the project it confines:
+//
+//	engine = "ptrace"        # or "unotify" or "auto"
+//	seccomp = true
+//	landlock = true          # WithLandlock
+//	io_uring = false         # WithIOURing
+//	pin_paths = true         # WithPinnedPaths
+//	random_seed = 42         # WithRandomSeed
+//	decision_cache = 4096    # WithDecisionCache
+//	credentials = "real"     # WithCredentials: "root", "real" or "UID:GID"
+//	read_only = true         # WithReadOnly, except at
+//	writable = ["/tmp"]
+//	egress = ["10.0.0.0/8:443"]  # WithEgress
+//
+//	[[mount]]                # WithMount
+//	path = "/data"
+//	backend = "overlay:src"  # mem, dev, dir:PATH, overlay:PATH, archive:PATH, bolt:PATH, oci:REF, s3:URL or an http(s) URL
+//	uid = 1000               # Owner, with gid
+//	gid = 1000
+//	file_perm = 0o644        # Perm, with dir_perm
+//	dir_perm = 0o755
+//	bytes_per_sec = 1048576  # Throttle, with ops_per_sec, bytes_burst and ops_burst
+//
+//	[limits]                 # WithLimits
+//	bytes = 1073741824       # with file_size, inodes and open_files
+//
+//	[[remap]]                # WithRemap
+//	from = "/etc/hosts"
+//	to = "/data/hosts"
+//
+//	[resolver]               # WithResolver
+//	hosts = ["127.0.0.1 api.internal"]  # lines of /etc/hosts
+//	nameservers = ["10.0.0.53"]
+//	search = ["corp.example"]
+//
+//	[[redirect]]             # a Redirect for WithRedirects
+//	from = "0.0.0.0:5432"
+//	to = "unix:/run/pg.sock"
+//
+//	[[path]]                 # a PathRule for WithPathRules
+//	pattern = "/home/*/.ssh"
+//	access = "hide"          # or "read_only" or "deny"
+//
+//	[[deny]]                 # a Rule for WithPolicy
+//	syscall = "connect"      # a name, or a number
+//	errno = "ENETUNREACH"
+//	# kill = true
+//	# paths = ["/usr/bin/curl"], for execve
+//
+// Every key is optional, but a key the format does not have is an error. A
+// relative backend directory is taken relative to the file's directory.
+// Options given to New after the returned one override what it sets.
+func FromConfig(path string) (Option, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if _, err := toml.Decode(string(b), &doc); err != nil {
+		return nil, fmt.Errorf("tracer: %s: %w", path, err)
+	}
+	opts, err := configOptions(doc, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("tracer: %s: %w", path, err)
+	}
+	return func(t *Tracer) {
+		for _, opt := range opts {
+			opt(t)
+		}
+	}, nil
+}
+
+// ParseBackend returns the backend spec names: "mem" for an empty
+// in-memory filesystem, "dev" for the device files of a /dev,
+// "dir:PATH" for the host directory PATH,
+// "overlay:PATH" for an in-memory layer over the host directory PATH, or
+// over the archive PATH if it is a file,
+// "archive:PATH" for the tree of the tar or zip archive PATH, read-only,
+// "bolt:PATH" for a tree kept in the database file PATH,
+// "oci:REF" for the container image REF names in a registry, or in the
+// OCI image layout or directory of layer archives if REF is a directory,
+// "s3:URL" for the S3 bucket at URL, with credentials from the environment
+// as s3.ConfigFromEnv takes them, or an http or https URL for the files
+// under it, read-only and with no listings.
+func ParseBackend(spec string) (vfs.Backend, error) {
+	return parseBackend(spec, "")
+}
+
+// parseBackend is ParseBackend, with relative directories taken relative
+// to base.
+func parseBackend(spec, base string) (vfs.Backend, error) {
+	kind, dir, _ := strings.Cut(spec, ":")
+	switch {
+	case kind == "s3" && dir != "":
+		return s3.New(s3.ConfigFromEnv(dir))
+	case kind == "http" || kind == "https":
+		return httpfs.New(httpfs.Config{URL: spec})
+	}
+	if dir != "" && base != "" && !filepath.IsAbs(dir) {
+		dir = filepath.Join(base, dir)
+	}
+	switch {
+	case kind == "mem" && dir == "":
+		return memfs.New(), nil
+	case kind == "dev" && dir == "":
+		return devfs.New(), nil
+	case kind == "dir" && dir != "":
+		return vfs.Dir(dir), nil
+	case kind == "overlay" && dir != "":
+		if fi, err := os.Stat(dir); err == nil && fi.Mode().IsRegular() {
+			a, err := archivefs.Open(dir)
+			if err != nil {
+				return nil, err
+			}
+			return overlay.New(a, memfs.New()), nil
+		}
+		return overlay.New(vfs.Dir(dir), memfs.New()), nil
+	case kind == "archive" && dir != "":
+		return archivefs.Open(dir)
+	case kind == "bolt" && dir != "":
+		return boltfs.New(dir)
+	case kind == "oci" && dir != "":
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return oci.New(oci.Config{Dir: dir})
+		}
+		_, ref, _ := strings.Cut(spec, ":")
+		return oci.New(oci.Config{Ref: ref})
+	}
+	return nil, fmt.Errorf("bad backend %q", spec)
+}
+
+// configOptions returns the options the decoded configuration doc sets.
+func configOptions(doc map[string]any, base string) ([]Option, error) {
+	var opts []Option
+	c := configTable{name: "top level", m: doc}
+	if err := c.only("engine", "seccomp", "landlock", "io_uring", "pin_paths", "random_seed", "decision_cache", "credentials", "read_only", "writable", "egress", "limits", "resolver", "mount", "remap", "redirect", "path", "deny"); err != nil {
+		return nil, err
+	}
+	if s, ok, err := c.str("engine"); err != nil {
+		return nil, err
+	} else if ok {
+		switch s {
+		case "ptrace":
+			opts = append(opts, WithEngine(EnginePtrace))
+		case "unotify":
+			opts = append(opts, WithEngine(EngineUnotify))
+		case "auto":
+			opts = append(opts, WithEngine(EngineAuto))
+		default:
+			return nil, fmt.Errorf("unknown engine %q", s)
+		}
+	}
+	if on, ok, err := c.bool("seccomp"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, WithSeccomp(on))
+	}
+	if on, ok, err := c.bool("landlock"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, WithLandlock(on))
+	}
+	if on, ok, err := c.bool("io_uring"); err != nil {
+		return nil, err
+	} else if ok {
+		opts = append(opts, WithIOURing(on))
+	}
+	if on, _, err := c.bool("pin_paths"); err != nil {
+		return nil, err
+	} else if on {
+		opts = append(opts, WithPinnedPaths())
+	}
+	if _, ok := c.m["random_seed"]; ok {
+		var seed int64
+		if err := c.count("random_seed", &seed); err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithRandomSeed(uint64(seed)))
+	}
+	if _, ok := c.m["decision_cache"]; ok {
+		var n int64
+		if err := c.count("decision_cache", &n); err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithDecisionCache(int(n)))
+	}
+	if s, ok, err := c.str("credentials"); err != nil {
+		return nil, err
+	} else if ok {
+		creds, err := configCredentials(s)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithCredentials(creds))
+	}
+	writable, err := c.strs("writable")
+	if err != nil {
+		return nil, err
+	}
+	readOnly, _, err := c.bool("read_only")
+	if err != nil {
+		return nil, err
+	}
+	if readOnly {
+		opts = append(opts, WithReadOnly(writable...))
+	} else if writable != nil {
+		return nil, fmt.Errorf("writable given without read_only")
+	}
+
+	if _, ok := c.m["egress"]; ok {
+		allow, err := c.strs("egress")
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range allow {
+			if _, err := parseEgress(s); err != nil {
+				return nil, err
+			}
+		}
+		opts = append(opts, WithEgress(allow...))
+	}
+
+	if l, ok, err := c.table("limits"); err != nil {
+		return nil, err
+	} else if ok {
+		limits, err := configLimits(l)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithLimits(limits))
+	}
+	if r, ok, err := c.table("resolver"); err != nil {
+		return nil, err
+	} else if ok {
+		resolver, err := configResolver(r)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithResolver(resolver))
+	}
+
+	mounts, err := c.tables("mount")
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range mounts {
+		opt, err := configMount(m, base)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+	remaps, err := c.tables("remap")
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range remaps {
+		if err := r.only("from", "to"); err != nil {
+			return nil, err
+		}
+		from, err := r.required("from")
+		if err != nil {
+			return nil, err
+		}
+		to, err := r.required("to")
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithRemap(Remap{From: from, To: to}))
+	}
+	redirects, err := c.tables("redirect")
+	if err != nil {
+		return nil, err
+	}
+	var redirectRules []Redirect
+	for _, r := range redirects {
+		if err := r.only("from", "to"); err != nil {
+			return nil, err
+		}
+		from, err := r.required("from")
+		if err != nil {
+			return nil, err
+		}
+		to, err := r.required("to")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parseRedirect(Redirect{From: from, To: to}); err != nil {
+			return nil, err
+		}
+		redirectRules = append(redirectRules, Redirect{From: from, To: to})
+	}
+	if redirectRules != nil {
+		opts = append(opts, WithRedirects(redirectRules...))
+	}
+	paths, err := c.tables("path")
+	if err != nil {
+		return nil, err
+	}
+	var pathRules []PathRule
+	for _, p := range paths {
+		rule, err := configPathRule(p)
+		if err != nil {
+			return nil, err
+		}
+		pathRules = append(pathRules, rule)
+	}
+	if pathRules != nil {
+		opts = append(opts, WithPathRules(pathRules...))
+	}
+	denies, err := c.tables("deny")
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	for _, d := range denies {
+		rule, err := configRule(d)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	if rules != nil {
+		opts = append(opts, WithPolicy(rules...))
+	}
+	return opts, nil
+}
+
+func configMount(m configTable, base string) (Option, error) {
+	if err := m.only("path", "backend", "uid", "gid", "file_perm", "dir_perm", "bytes_per_sec", "ops_per_sec", "bytes_burst", "ops_burst"); err != nil {
+		return nil, err
+	}
+	dir, err := m.required("path")
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(dir) {
+		return nil, fmt.Errorf("%s: path %q is not absolute", m.name, dir)
+	}
+	spec, ok, err := m.str("backend")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		spec = "mem"
+	}
+	b, err := parseBackend(spec, base)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", m.name, err)
+	}
+	var mopts []MountOption
+	uid, gid, ok, err := m.pair("uid", "gid")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		mopts = append(mopts, Owner(uint32(uid), uint32(gid)))
+	}
+	file, dirPerm, ok, err := m.pair("file_perm", "dir_perm")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		mopts = append(mopts, Perm(fs.FileMode(file)&fs.ModePerm, fs.FileMode(dirPerm)&fs.ModePerm))
+	}
+	var rate [4]int64
+	for i, key := range []string{"bytes_per_sec", "ops_per_sec", "bytes_burst", "ops_burst"} {
+		if err := m.count(key, &rate[i]); err != nil {
+			return nil, err
+		}
+	}
+	if rate != [4]int64{} {
+		mopts = append(mopts, Throttle(Rate{
+			BytesPerSec: float64(rate[0]), OpsPerSec: float64(rate[1]),
+			BytesBurst: float64(rate[2]), OpsBurst: float64(rate[3]),
+		}))
+	}
+	return WithMount(dir, b, mopts...), nil
+}
+
+// configCredentials returns the Credentials s names: "root" for
+// PretendRoot, "real" for RealCredentials, or "UID:GID" for fixed ones.
+func configCredentials(s string) (Credentials, error) {
+	switch s {
+	case "root":
+		return PretendRoot, nil
+	case "real":
+		return RealCredentials, nil
+	}
+	u, g, _ := strings.Cut(s, ":")
+	uid, uerr := strconv.ParseUint(u, 10, 32)
+	gid, gerr := strconv.ParseUint(g, 10, 32)
+	if uerr != nil || gerr != nil {
+		return nil, fmt.Errorf("bad credentials %q", s)
+	}
+	return FixedCredentials(uint32(uid), uint32(gid)), nil
+}
+
+func configLimits(l configTable) (Limits, error) {
+	var limits Limits
+	if err := l.only("bytes", "file_size", "inodes", "open_files"); err != nil {
+		return limits, err
+	}
+	for key, n := range map[string]*int64{"bytes": &limits.Bytes, "file_size": &limits.FileSize, "inodes": &limits.Inodes} {
+		if err := l.count(key, n); err != nil {
+			return limits, err
+		}
+	}
+	var files int64
+	if err := l.count("open_files", &files); err != nil {
+		return limits, err
+	}
+	limits.OpenFiles = int(files)
+	return limits, nil
+}
+
+func configResolver(r configTable) (Resolver, error) {
+	var resolver Resolver
+	if err := r.only("hosts", "nameservers", "search"); err != nil {
+		return resolver, err
+	}
+	lines, err := r.strs("hosts")
+	if err != nil {
+		return resolver, err
+	}
+	for _, line := range lines {
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			return resolver, fmt.Errorf("%s: bad hosts line %q", r.name, line)
+		}
+		if _, err := netip.ParseAddr(f[0]); err != nil {
+			return resolver, fmt.Errorf("%s: bad address in hosts line %q", r.name, line)
+		}
+		if resolver.Hosts == nil {
+			resolver.Hosts = make(map[string]string)
+		}
+		for _, name := range f[1:] {
+			resolver.Hosts[name] = f[0]
+		}
+	}
+	if resolver.Nameservers, err = r.strs("nameservers"); err != nil {
+		return resolver, err
+	}
+	for _, ns := range resolver.Nameservers {
+		if _, err := netip.ParseAddr(ns); err != nil {
+			return resolver, fmt.Errorf("%s: bad nameserver %q", r.name, ns)
+		}
+	}
+	if resolver.Search, err = r.strs("search"); err != nil {
+		return resolver, err
+	}
+	return resolver, nil
+}
+
+func configPathRule(p configTable) (PathRule, error) {
+	var rule PathRule
+	if err := p.only("pattern", "access"); err != nil {
+		return rule, err
+	}
+	pattern, err := p.required("pattern")
+	if err != nil {
+		return rule, err
+	}
+	if !filepath.IsAbs(pattern) {
+		return rule, fmt.Errorf("%s: pattern %q is not absolute", p.name, pattern)
+	}
+	access, err := p.required("access")
+	if err != nil {
+		return rule, err
+	}
+	switch access {
+	case "hide":
+		rule.Access = Hide
+	case "read_only":
+		rule.Access = ReadOnly
+	case "deny":
+		rule.Access = Deny
+	default:
+		return rule, fmt.Errorf("%s: unknown access %q", p.name, access)
+	}
+	rule.Pattern = pattern
+	return rule, nil
+}
+
+func configRule(d configTable) (Rule, error) {
+	var rule Rule
+	if err := d.only("syscall", "errno", "kill", "paths"); err != nil {
+		return rule, err
+	}
+	name, err := d.required("syscall")
+	if err != nil {
+		return rule, err
+	}
+	nr, ok := SyscallNumber(name)
+	if !ok {
+		return rule, fmt.Errorf("%s: unknown syscall %q", d.name, name)
+	}
+	rule.Syscall = nr
+	if s, ok, err := d.str("errno"); err != nil {
+		return rule, err
+	} else if ok {
+		rule.Errno = errnoNamed(s)
+		if unix.ErrnoName(rule.Errno) != s {
+			return rule, fmt.Errorf("%s: unknown errno %q", d.name, s)
+		}
+	}
+	if rule.Kill, _, err = d.bool("kill"); err != nil {
+		return rule, err
+	}
+	if rule.Kill && rule.Errno != 0 {
+		return rule, fmt.Errorf("%s: both errno and kill given", d.name)
+	}
+	if rule.Paths, err = d.strs("paths"); err != nil {
+		return rule, err
+	}
+	if rule.Paths != nil && nr != unix.SYS_EXECVE {
+		return rule, fmt.Errorf("%s: paths given for a syscall other than execve", d.name)
+	}
+	return rule, nil
+}
+
+// configTable is a table of a configuration file, named for errors.
+type configTable struct {
+	name string
+	m    map[string]any
+}
+
+// only reports an error for a key not in keys.
+func (c configTable) only(keys ...string) error {
+	for k := range c.m {
+		if !slices.Contains(keys, k) {
+			return fmt.Errorf("%s: unknown key %q", c.name, k)
+		}
+	}
+	return nil
+}
+
+func (c configTable) typeError(key, want string) error {
+	return fmt.Errorf("%s: %s is not %s", c.name, key, want)
+}
+
+func (c configTable) str(key string) (string, bool, error) {
+	v, ok := c.m[key]
+	if !ok {
+		return "", false, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", false, c.typeError(key, "a string")
+	}
+	return s, true, nil
+}
+
+// required is str for a key that must be there.
+func (c configTable) required(key string) (string, error) {
+	s, ok, err := c.str(key)
+	if err == nil && !ok {
+		err = fmt.Errorf("%s: no %s", c.name, key)
+	}
+	return s, err
+}
+
+func (c configTable) bool(key string) (bool, bool, error) {
+	v, ok := c.m[key]
+	if !ok {
+		return false, false, nil
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, false, c.typeError(key, "a boolean")
+	}
+	return b, true, nil
+}
+
+func (c configTable) uint32(key string) (uint32, bool, error) {
+	v, ok := c.m[key]
+	if !ok {
+		return 0, false, nil
+	}
+	n, ok := v.(int64)
+	if !ok || n < 0 || n > 1<<32-1 {
+		return 0, false, c.typeError(key, "a 32-bit unsigned integer")
+	}
+	return uint32(n), true, nil
+}
+
+// count sets *n to the non-negative integer key, if it is there.
+func (c configTable) count(key string, n *int64) error {
+	v, ok := c.m[key]
+	if !ok {
+		return nil
+	}
+	i, ok := v.(int64)
+	if !ok || i < 0 {
+		return c.typeError(key, "a non-negative integer")
+	}
+	*n = i
+	return nil
+}
+
+// pair returns two integers that must be given together.
+func (c configTable) pair(key1, key2 string) (n1, n2 uint32, ok bool, err error) {
+	n1, ok1, err := c.uint32(key1)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	n2, ok2, err := c.uint32(key2)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if ok1 != ok2 {
+		return 0, 0, false, fmt.Errorf("%s: %s and %s go together", c.name, key1, key2)
+	}
+	return n1, n2, ok1, nil
+}
+
+// strs returns an array of strings, or nil if key is missing.
+func (c configTable) strs(key string) ([]string, error) {
+	v, ok := c.m[key]
+	if !ok {
+		return nil, nil
+	}
+	arr, ok := v.([]any)
+	if !ok {
+		return nil, c.typeError(key, "an array")
+	}
+	ss := make([]string, 0, len(arr))
+	for _, e := range arr {
+		s, ok := e.(string)
+		if !ok {
+			return nil, c.typeError(key, "an array of strings")
+		}
+		ss = append(ss, s)
+	}
+	return ss, nil
+}
+
+// table returns the table key.
+func (c configTable) table(key string) (configTable, bool, error) {
+	v, ok := c.m[key]
+	if !ok {
+		return configTable{}, false, nil
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return configTable{}, false, fmt.Errorf("%s is not a table; write it [%s]", key, key)
+	}
+	return configTable{name: key, m: m}, true, nil
+}
+
+// tables returns the array of tables key, each named by its place.
+func (c configTable) tables(key string) ([]configTable, error) {
+	v, ok := c.m[key]
+	if !ok {
+		return nil, nil
+	}
+	ms, ok := v.([]map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an array of tables; write it [[%s]]", key, key)
+	}
+	tables := make([]configTable, len(ms))
+	for i, m := range ms {
+		tables[i] = configTable{name: fmt.Sprintf("%s %d", key, i+1), m: m}
+	}
+	return tables, nil
+}
@@ -0,0 +1,192 @@
+package tracer
+
+import (
+	"encoding/hex"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// InternalError is the error a Tracer ends with when servicing the command
+// panics, or when a backend ends the goroutine servicing it with
+// runtime.Goexit, as t.FailNow does in a test. Rather than leave the
+// tracees stopped in a syscall nobody will answer, the tracer kills the
+// command and every process it started, and lets the processes of Attach
+// go.
+type InternalError struct {
+	// Value is what was panicked with, or nil for a runtime.Goexit.
+	Value any
+	// Stack is the stack of the goroutine that panicked.
+	Stack []byte
+	// Tid is the thread that was being serviced, or 0 if none was.
+	Tid int
+	// Syscall is the syscall the thread was stopped in, as a trace line
+	// shows it, and Dump its registers and the memory at its
+	// instruction and stack pointers, where the engine can read them.
+	Syscall string
+	Dump    string
+}
+
+func (e *InternalError) Error() string {
+	if e.Value == nil {
+		return "tracer: internal error: servicing goroutine exited"
+	}
+	return fmt.Sprintf("tracer: internal error: %v", e.Value)
+}
+
+// Report describes the error in full, for a bug report.
+func (e *InternalError) Report() string {
+	var b strings.Builder
+	b.WriteString(e.Error() + "\n")
+	if e.Tid != 0 {
+		fmt.Fprintf(&b, "tid %d in %s\n", e.Tid, e.Syscall)
+	}
+	b.WriteString(e.Dump)
+	if len(e.Stack) > 0 {
+		fmt.Fprintf(&b, "\n%s", e.Stack)
+	}
+	return b.String()
+}
+
+// panicked is a panic caught on a worker, which the tracer's goroutine
+// panics with again.
+type panicked struct {
+	value any
+	stack []byte
+}
+
+// catch runs do, returning a *panicked for a panic rather than letting it
+// take the program down from a goroutine of the tracer's own.
+func catch(do func()) (p *panicked) {
+	defer func() {
+		if v := recover(); v != nil {
+			p = &panicked{value: v, stack: debug.Stack()}
+		}
+	}()
+	do()
+	return nil
+}
+
+// guard runs service, which services a stop or a notification, and
+// returns its error. Should service panic, or end the goroutine with
+// runtime.Goexit, guard records an *InternalError for the thread
+// t.serving names as t.crash and abandons the command; the error is
+// returned for a panic, and left for the goroutine's caller to find after
+// a Goexit.
+func (t *Tracer) guard(service func() error) (err error) {
+	t.serving = nil
+	exited := true
+	defer func() {
+		if exited {
+			t.crashed(&InternalError{Stack: debug.Stack()})
+		}
+	}()
+	p := catch(func() { err = service() })
+	exited = false
+	if p == nil {
+		return err
+	}
+	if again, ok := p.value.(*panicked); ok {
+		p = again
+	}
+	return t.crashed(&InternalError{Value: p.value, Stack: p.stack})
+}
+
+// crashed completes e with the thread being serviced, logs it and
+// abandons the command, unless servicing has crashed already, in which
+// case it returns that first error.
+func (t *Tracer) crashed(e *InternalError) *InternalError {
+	if t.crash != nil {
+		return t.crash
+	}
+	t.crash = e
+	if th := t.serving; th != nil {
+		e.Tid = th.tid
+		e.Syscall, e.Dump = th.dump()
+	}
+	t.log.Printf("%s", e.Report())
+	t.abandon()
+	return e
+}
+
+// abandon kills the command and every process it started, and reaps them.
+// The processes of Attach are let go when the tracer's thread exits, as
+// after any failure.
+func (t *Tracer) abandon() {
+	if t.cmd == nil || t.cmd.Process == nil || t.cmd.ProcessState != nil {
+		return
+	}
+	if t.engine == EngineUnotify {
+		t.killProcs()
+		_ = t.cmd.Process.Kill()
+		_ = t.waitLeader()
+		return
+	}
+	for pid := range t.threads {
+		_ = unix.Kill(pid, unix.SIGKILL)
+	}
+	_ = t.cmd.Process.Kill()
+	t.killRemaining()
+	// Like the others, the leader can stop on its way out.
+	for {
+		var info siginfo
+		_, _, errno := unix.Syscall6(unix.SYS_WAITID, unix.P_PID, uintptr(t.leader),
+			uintptr(unsafe.Pointer(&info)), unix.WEXITED|unix.WSTOPPED|unix.WNOWAIT|waitFlags, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 || info.Code == cldExited || info.Code == cldKilled || info.Code == cldDumped {
+			break
+		}
+		var ws unix.WaitStatus
+		_, _ = unix.Wait4(t.leader, &ws, waitFlags, nil)
+		_ = unix.PtraceCont(t.leader, 0)
+	}
+	_ = t.waitLeader()
+}
+
+// dump describes the syscall the thread is stopped in and, under the
+// ptrace engine, its registers and the memory they point to. Decoding the
+// syscall reads the paths and buffers it is passed. A dump that panics in
+// turn says so instead.
+func (th *thread) dump() (call, regs string) {
+	c := th.t.servingCall
+	if th.t.engine == EnginePtrace {
+		c = th.stoppedCall()
+	}
+	if p := catch(func() {
+		name, args, _ := th.decode(c, 0, false)
+		call = fmt.Sprintf("%s(%s)", name, strings.Join(args, ", "))
+	}); p != nil {
+		call = fmt.Sprintf("syscall %d (decoding failed: %v)", c.nr, p.value)
+	}
+	if th.t.engine != EnginePtrace {
+		return call, ""
+	}
+	var b strings.Builder
+	var r unix.PtraceRegs
+	if err := getRegs(th.tid, &r); err != nil {
+		fmt.Fprintf(&b, "registers: %v\n", err)
+		return call, b.String()
+	}
+	fmt.Fprintf(&b, "registers: %+v\n", r)
+	for _, at := range []struct {
+		name string
+		addr uint64
+		n    int
+	}{
+		{"instruction pointer", instructionPointer(&r), 32},
+		{"stack pointer", stackPointer(&r), 128},
+	} {
+		mem, err := th.mem.readBytes(uintptr(at.addr), at.n)
+		if err != nil {
+			fmt.Fprintf(&b, "%s %#x: %v\n", at.name, at.addr, err)
+			continue
+		}
+		fmt.Fprintf(&b, "%s %#x:\n%s", at.name, at.addr, hex.Dump(mem))
+	}
+	return call, b.String()
+}
@@ -0,0 +1,177 @@
+package tracer
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// workDir is the working directory of the threads that share it, as
+// CLONE_FS has them do. dir is set while it is a virtual directory, which
+// the kernel knows nothing of; the kernel keeps the threads in the last
+// host directory they changed to. root is set once chroot has given them
+// a root of their own, and putOld once pivot_root has, to the directory
+// the old root was to be moved to.
+type workDir struct {
+	dir    string
+	root   string
+	putOld string
+}
+
+// clone returns a copy of w for a child that does not share it.
+func (w *workDir) clone() *workDir { return &workDir{dir: w.dir, root: w.root, putOld: w.putOld} }
+
+// root returns the absolute path of the thread's root directory.
+func (th *thread) root() string {
+	if th.cwd.root == "" {
+		return "/"
+	}
+	return th.cwd.root
+}
+
+// unroot returns the absolute path abs as the thread sees it from its
+// root, or with "(unreachable)" before it if it is not below the root, as
+// the kernel reports such a working directory.
+func (th *thread) unroot(abs string) string {
+	root := th.root()
+	switch {
+	case root == "/":
+		return abs
+	case abs == root:
+		return "/"
+	case strings.HasPrefix(abs, root+"/"):
+		return abs[len(root):]
+	}
+	return "(unreachable)" + abs
+}
+
+func (th *thread) sysChdir(pathAddr uintptr) (int64, bool) {
+	p, err := th.mem.readString(pathAddr)
+	if err != nil || p == "" {
+		return 0, false
+	}
+	abs, through, err := th.resolveArg(unix.AT_FDCWD, p)
+	if err != nil {
+		return resolveFailed(err)
+	}
+	m, name, ok := th.lookupArg(abs, through)
+	if !ok {
+		// The kernel changes to a host directory it finds from the path
+		// itself; a failure leaves the thread in the last host directory
+		// it changed to.
+		th.cwd.dir = ""
+		return 0, false
+	}
+	th.t.log.Printf("chdir: %s (virtual)", abs)
+	if abs, m, name, err = th.follow(abs); err != nil {
+		return errnoRet(err), true
+	}
+	return th.chdir(m, name, abs), true
+}
+
+func (th *thread) sysFchdir(fd int) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		if th.realFD(fd) {
+			th.cwd.dir = ""
+		}
+		return 0, false
+	}
+	th.t.log.Printf("fchdir: fd=%d (virtual)", fd)
+	return th.chdir(f.mount, f.name, f.path), true
+}
+
+// chdir makes name in m, whose absolute path is abs, the thread's working
+// directory, and returns 0 or a negated errno. A host directory, reached
+// through the virtual tree or open as a virtual descriptor, is left to the
+// kernel to change to, by hostChdir.
+func (th *thread) chdir(m *mount, name, abs string) int64 {
+	if m == &th.t.host {
+		return th.hostChdir(abs)
+	}
+	fi, err := m.backend.Stat(name)
+	if err != nil {
+		return errnoRet(err)
+	}
+	if !fi.IsDir() {
+		return -int64(unix.ENOTDIR)
+	}
+	th.cwd.dir = abs
+	return 0
+}
+
+// hostChdir has the kernel change the thread to the host directory abs in
+// place of the syscall it is entering, so that relative paths the kernel
+// resolves are resolved there. The path is copied into the thread's scratch
+// memory, or if it has none below its stack, as installFilter copies its
+// program; chdirExit returns what the kernel made of it. EngineUnotify
+// cannot rewrite a syscall, and fails it with EOPNOTSUPP.
+func (th *thread) hostChdir(abs string) int64 {
+	if th.t.engine == EngineUnotify {
+		th.t.log.Printf("chdir: %s: host directory reached through the virtual tree", abs)
+		return -int64(unix.EOPNOTSUPP)
+	}
+	b := append([]byte(abs), 0)
+	if th.scratch != nil {
+		addr, errno := th.pinBytes(b)
+		if errno != 0 {
+			return -int64(errno)
+		}
+		th.chdirTo = addr
+		return 0
+	}
+	addr := (stackPointer(&th.regs) - 4096 - uint64(len(b))) &^ 15
+	if err := th.mem.writeBytes(uintptr(addr), b); err != nil {
+		return -int64(unix.EFAULT)
+	}
+	th.chdirTo = uintptr(addr)
+	return 0
+}
+
+// chdirExit returns what the chdir the kernel made for hostChdir returned,
+// and leaves the working directory to the kernel once it has changed.
+func (th *thread) chdirExit() int64 {
+	th.chdirTo = 0
+	var regs unix.PtraceRegs
+	if err := getRegs(th.tid, &regs); err != nil {
+		th.t.log.Printf("getregs: %v", err)
+		return -int64(unix.EIO)
+	}
+	ret := int64(returnValue(&regs))
+	if ret == 0 {
+		th.cwd.dir = ""
+	}
+	return ret
+}
+
+// sysGetcwd reports a virtual working directory, and leaves a host one to
+// the kernel unless chroot has given the thread a root, in which the path
+// is reported. Like the kernel it counts the NUL in the length it returns,
+// and fails with ENOENT once the directory has been removed.
+func (th *thread) sysGetcwd(buf uintptr, size uint64) (int64, bool) {
+	dir := th.cwd.dir
+	if dir == "" {
+		if th.cwd.root == "" {
+			return 0, false
+		}
+		var err error
+		if dir, err = os.Readlink(fmt.Sprintf("/proc/%d/cwd", th.tid)); err != nil {
+			return 0, false
+		}
+	}
+	m, name := th.rootLookup(dir)
+	th.t.log.Printf("getcwd: %s (virtual)", dir)
+	if _, err := m.backend.Stat(name); err != nil {
+		return -int64(unix.ENOENT), true
+	}
+	b := append([]byte(th.unroot(dir)), 0)
+	if uint64(len(b)) > size {
+		return -int64(unix.ERANGE), true
+	}
+	if err := th.mem.writeBytes(buf, b); err != nil {
+		return -int64(unix.EFAULT), true
+	}
+	return int64(len(b)), true
+}
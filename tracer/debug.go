@@ -0,0 +1,201 @@
+package tracer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Breakpoint selects syscalls to pause the command at, as part of the
+// breakpoints given to WithDebugger.
+type Breakpoint struct {
+	// Syscall and Path select the syscalls as they do for a Fault. A zero
+	// Syscall matches every syscall on a file Path matches, and a
+	// Breakpoint with neither every syscall.
+	Syscall uint64
+	Path    string
+}
+
+// DebugAction is what the paused thread does once a debugger's pause
+// function returns.
+type DebugAction int
+
+const (
+	// DebugContinue runs the thread on to the next breakpoint.
+	DebugContinue DebugAction = iota
+	// DebugStep pauses the thread again at its next syscall stop: at the
+	// exit of the syscall it is paused entering, where its result is
+	// known, and at the entry of the next syscall after that. Under
+	// EngineUnotify, which sees no exits, it pauses at the next entry.
+	DebugStep
+)
+
+// WithDebugger pauses the command at the syscalls the breakpoints match,
+// for looking into the virtual layer that strace and gdb cannot see. pause
+// is called with each such syscall as it enters, and with the syscalls a
+// DebugStep steps to, on the tracer's own thread: the whole command waits
+// until it returns, as if stopped in a debugger, and the Syscall it is
+// given reads the thread's registers, memory and virtual descriptors, and
+// can change the syscall as an enter hook can. Breakpoints are enter
+// hooks, run in order with those of OnSyscallEnter.
+//
+// Stepping needs every syscall trapped, so WithDebugger stops the command
+// at each of them, with what that costs, whatever the breakpoints are.
+func WithDebugger(pause func(*Syscall) DebugAction, breakpoints ...Breakpoint) Option {
+	return func(t *Tracer) {
+		d := &debugger{pause: pause, breakpoints: breakpoints, stepping: make(map[int]bool)}
+		t.enterHooks = append(t.enterHooks, hook{fn: d.enter})
+		t.exitHooks = append(t.exitHooks, hook{fn: d.exit})
+	}
+}
+
+// debugger is the state of WithDebugger: stepping holds the threads that
+// are to pause at their next stop.
+type debugger struct {
+	pause       func(*Syscall) DebugAction
+	breakpoints []Breakpoint
+	stepping    map[int]bool
+}
+
+func (d *debugger) enter(s *Syscall) {
+	if !d.stepping[s.Tid] && !d.matches(s) {
+		return
+	}
+	delete(d.stepping, s.Tid)
+	if d.pause(s) == DebugStep {
+		d.stepping[s.Tid] = true
+	}
+}
+
+func (d *debugger) exit(s *Syscall) {
+	if !d.stepping[s.Tid] {
+		return
+	}
+	if d.pause(s) != DebugStep {
+		delete(d.stepping, s.Tid)
+	}
+}
+
+// matches reports whether a breakpoint matches s.
+func (d *debugger) matches(s *Syscall) bool {
+	var (
+		p              string
+		pathOK, looked bool
+	)
+	c, ok := native(s.call())
+	if !ok {
+		return false
+	}
+	c = canonical(c)
+	for _, b := range d.breakpoints {
+		if b.Syscall != 0 && b.Syscall != c.nr {
+			continue
+		}
+		if b.Path != "" {
+			if !looked {
+				p, pathOK = s.th.callPath(c)
+				looked = true
+			}
+			if !pathOK || !matchFile(b.Path, p) {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (s *Syscall) call() sysCall {
+	return sysCall{arch: s.Arch, nr: s.Nr, args: s.Args}
+}
+
+// Name returns the name of the syscall, as traces show it, such as
+// "openat" for an open, or syscall_N for one the tracer cannot name.
+func (s *Syscall) Name() string {
+	c, ok := native(s.call())
+	if !ok {
+		return fmt.Sprintf("syscall_%d", s.Nr)
+	}
+	return syscallName(canonical(c).nr)
+}
+
+// String describes the syscall as a trace line does, with its arguments
+// decoded and, in an exit hook, its result.
+func (s *Syscall) String() string {
+	name, args, hexRet := s.th.decode(s.call(), s.Ret, s.exiting)
+	line := fmt.Sprintf("%s(%s)", name, strings.Join(args, ", "))
+	switch {
+	case !s.exiting:
+	case s.Ret < 0 && s.Ret > -4096:
+		errno := unix.Errno(-s.Ret)
+		line += fmt.Sprintf(" = -1 %s (%s)", unix.ErrnoName(errno), errno.Error())
+	case hexRet:
+		line += fmt.Sprintf(" = %#x", uint64(s.Ret))
+	default:
+		line += fmt.Sprintf(" = %d", s.Ret)
+	}
+	return line
+}
+
+// Path returns the absolute path of the file the syscall operates on, as a
+// Fault's Path is matched against, if it operates on one.
+func (s *Syscall) Path() (string, bool) {
+	c, ok := native(s.call())
+	if !ok {
+		return "", false
+	}
+	return s.th.callPath(canonical(c))
+}
+
+// Registers returns the registers of the stopped thread. It fails with
+// errors.ErrUnsupported under EngineUnotify, where the thread is not
+// stopped to read them.
+func (s *Syscall) Registers() (unix.PtraceRegs, error) {
+	if s.th.t.engine != EnginePtrace {
+		return unix.PtraceRegs{}, errors.ErrUnsupported
+	}
+	if s.regs != nil {
+		return *s.regs, nil
+	}
+	var r unix.PtraceRegs
+	err := getRegs(s.th.tid, &r)
+	return r, err
+}
+
+// VirtualFD describes a descriptor of the command that the tracer serves,
+// as Syscall.FDs reports it.
+type VirtualFD struct {
+	FD   int
+	Path string
+	// Flags are the file status flags F_GETFL reports.
+	Flags   int
+	Cloexec bool
+	// Offset is the file offset, or -1 for a file without one.
+	Offset int64
+}
+
+// FDs returns the virtual descriptors of the thread making the syscall,
+// in order: those of the files below mounts and remaps, which the kernel
+// knows nothing of.
+func (s *Syscall) FDs() []VirtualFD {
+	t := s.th.fds
+	fds := make([]int, 0, len(t.fds))
+	for fd := range t.fds {
+		fds = append(fds, fd)
+	}
+	slices.Sort(fds)
+	out := make([]VirtualFD, 0, len(fds))
+	for _, fd := range fds {
+		f, _ := t.get(fd)
+		off, err := f.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			off = -1
+		}
+		out = append(out, VirtualFD{FD: fd, Path: f.path, Flags: f.flags, Cloexec: t.cloexec(fd), Offset: off})
+	}
+	return out
+}
@@ -0,0 +1,204 @@
+package tracer
+
+import (
+	"container/list"
+	"path"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithDecisionCache remembers up to n of the decisions the tracer makes
+// about the paths the command names, the least recently used forgotten
+// first: where a path leads, and so whether it is virtual or the host's,
+// and what the path rules and read-only mode let the command do with it.
+// A command that names the same paths over and over, as shells and
+// linkers do in storms of stat calls, then has each walked and matched
+// once instead of every time. An n of 0, the default, keeps none.
+//
+// A decision is kept for the process that named the path, as it named
+// it: from its root, or from its working directory if that is virtual.
+// None is kept for a path in /proc or /dev/fd, whose links change as the
+// command opens and closes files.
+// All are forgotten when the command makes a syscall that may change what
+// a path leads to or may be done with, one that creates, removes, renames
+// or changes a file or its metadata, or a chroot, pivot_root or umount2,
+// and none are kept until that syscall is done. A process's are forgotten
+// when it exits. All are forgotten too when a mount's backend that is a
+// vfs.Changer, as a shared.FS is, counts changes made by others since the
+// last decision, whether by other tracers or the clients of -fuse. The
+// cache is off under a WithUserNamespace with a mount namespace, where the
+// command mounts without the tracer seeing. Changes made to the host's
+// files by processes the tracer does not trace, or by the command through
+// io_uring, are not noticed. WithMetrics counts the decisions found and
+// those made.
+func WithDecisionCache(n int) Option {
+	return func(t *Tracer) {
+		t.decisions = nil
+		if n > 0 {
+			t.decisions = &decisionCache{size: n, entries: make(map[decisionKey]*list.Element),
+				lru: list.New(), unsettled: make(map[int]int)}
+		}
+	}
+}
+
+// decisionOp is what a decision about a path is for.
+type decisionOp uint8
+
+const (
+	// decideResolve is where the path leads, as resolve finds it.
+	decideResolve decisionOp = iota
+	// decideRule and decideRuleFollow are the Access the path rules give
+	// the path, with a final symlink left alone or followed.
+	decideRule
+	decideRuleFollow
+	// decideWritable and decideWritableFollow are whether read-only mode
+	// lets the path be written.
+	decideWritable
+	decideWritableFollow
+)
+
+// decisionKey is a path as a process names it: path itself if it is
+// absolute, or else relative to the working directory dir.
+type decisionKey struct {
+	pid       int
+	dir, path string
+	op        decisionOp
+}
+
+// decision is what was decided: abs, through and err for decideResolve,
+// access for the path rules and writable for read-only mode.
+type decision struct {
+	abs      string
+	through  bool
+	err      error
+	access   Access
+	writable bool
+}
+
+type decisionEntry struct {
+	key decisionKey
+	decision
+}
+
+// decisionCache holds the decisions kept, the most recently used at the
+// front of lru.
+type decisionCache struct {
+	size    int
+	entries map[decisionKey]*list.Element
+	lru     *list.List // of *decisionEntry
+	// unsettled holds the pid of each thread, by tid, whose syscall may
+	// be changing the tree. No decision is kept while there are any.
+	unsettled map[int]int
+	// changes is what the mounts' backends had counted of the changes
+	// others make as the decisions kept were made.
+	changes uint64
+}
+
+func (dc *decisionCache) get(key decisionKey) (decision, bool) {
+	e, ok := dc.entries[key]
+	if !ok {
+		return decision{}, false
+	}
+	dc.lru.MoveToFront(e)
+	return e.Value.(*decisionEntry).decision, true
+}
+
+func (dc *decisionCache) put(key decisionKey, d decision) {
+	if len(dc.unsettled) > 0 {
+		return
+	}
+	dc.entries[key] = dc.lru.PushFront(&decisionEntry{key: key, decision: d})
+	for dc.lru.Len() > dc.size {
+		e := dc.lru.Remove(dc.lru.Back()).(*decisionEntry)
+		delete(dc.entries, e.key)
+	}
+}
+
+func (dc *decisionCache) reset() {
+	clear(dc.entries)
+	dc.lru.Init()
+}
+
+// enter notes that the thread tid of process pid is entering the canonical
+// syscall c, and so is done with the one it made before. If c may change
+// the tree, every decision is forgotten, and none kept until c is done.
+func (dc *decisionCache) enter(tid, pid int, c sysCall) {
+	if dc == nil {
+		return
+	}
+	delete(dc.unsettled, tid)
+	_, write := callRefs(c)
+	if write || c.nr == unix.SYS_CHROOT || c.nr == unix.SYS_PIVOT_ROOT || c.nr == unix.SYS_UMOUNT2 {
+		dc.unsettled[tid] = pid
+		dc.reset()
+	}
+}
+
+// exited forgets the thread tid of process pid, which has exited, and the
+// decisions of the process if tid is its leader.
+func (dc *decisionCache) exited(tid, pid int) {
+	if dc == nil {
+		return
+	}
+	delete(dc.unsettled, tid)
+	if tid != pid {
+		return
+	}
+	for tid, p := range dc.unsettled {
+		if p == pid {
+			delete(dc.unsettled, tid)
+		}
+	}
+	for key, e := range dc.entries {
+		if key.pid == pid {
+			dc.lru.Remove(e)
+			delete(dc.entries, key)
+		}
+	}
+}
+
+// decide returns the decision op about the path p, relative to dirfd,
+// that f makes, taking it from the cache if it is there and keeping it
+// there if it can.
+func (th *thread) decide(dirfd int, p string, op decisionOp, f func() decision) decision {
+	dc := th.t.decisions
+	if dc == nil {
+		return f()
+	}
+	if n := th.t.changes(); n != dc.changes {
+		dc.reset()
+		dc.changes = n
+	}
+	key := decisionKey{pid: th.pid, path: p, op: op}
+	switch {
+	case path.IsAbs(p):
+	case dirfd == unix.AT_FDCWD && th.cwd.dir != "":
+		key.dir = th.cwd.dir
+	default:
+		// The directory is the host's, which only the kernel knows.
+		return f()
+	}
+	if abs := path.Join("/", key.dir, p); inDir(abs, "/proc") || inDir(abs, "/dev/fd") {
+		// Where a descriptor's link leads changes as it is reopened.
+		return f()
+	}
+	d, ok := dc.get(key)
+	th.t.metrics.decision(ok)
+	if !ok {
+		d = f()
+		dc.put(key, d)
+	}
+	return d
+}
+
+// changes sums what the mounts' backends count of the changes others make
+// to them.
+func (t *Tracer) changes() uint64 {
+	var n uint64
+	for i := range t.mounts {
+		if c := t.mounts[i].changes; c != nil {
+			n += c.Changes()
+		}
+	}
+	return n
+}
@@ -0,0 +1,333 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// argKind says how a syscall argument is shown in a trace.
+type argKind int
+
+const (
+	argInt argKind = iota
+	argHex
+	argFD
+	argDirFD
+	argPath
+	// argStr is a string that is not a path.
+	argStr
+	// argBufIn is data the command passes in, whose length is the next
+	// argument.
+	argBufIn
+	// argBufOut is a buffer the syscall fills with as many bytes as it
+	// returns.
+	argBufOut
+	argMode
+	argOpenFlags
+	// argOpenMode is an open mode, shown only if the flags before it
+	// create a file.
+	argOpenMode
+	argAtFlags
+	argWhence
+	argProt
+	argMapFlags
+	argFcntlCmd
+	argFlockOp
+	argFallocMode
+	// argOpenHow is a struct open_how.
+	argOpenHow
+	// argCloneFlags is the flags of a clone, with the exit signal in the
+	// low byte. argCloneArgs is a struct clone_args.
+	argCloneFlags
+	argCloneArgs
+)
+
+//go:generate go run mksyscalls.go
+
+// syscallSpec describes a syscall, as syscalls.txt gives it, for traces
+// and for finding the file it operates on.
+type syscallSpec struct {
+	name string
+	args []argKind
+	// hexRet shows the result as an address.
+	hexRet bool
+	// fd and path are the positions of the arguments naming the file: a
+	// path, relative to the directory fd if fd is not -1, or if path is -1
+	// the descriptor fd alone. Both are -1 for a syscall on no file.
+	fd, path int
+}
+
+type flagName struct {
+	v    uint64
+	name string
+}
+
+var openFlags = []flagName{
+	{unix.O_CREAT, "O_CREAT"}, {unix.O_EXCL, "O_EXCL"}, {unix.O_NOCTTY, "O_NOCTTY"},
+	{unix.O_TRUNC, "O_TRUNC"}, {unix.O_APPEND, "O_APPEND"}, {unix.O_NONBLOCK, "O_NONBLOCK"},
+	{unix.O_DSYNC, "O_DSYNC"}, {unix.O_ASYNC, "O_ASYNC"}, {unix.O_DIRECT, "O_DIRECT"},
+	{unix.O_DIRECTORY, "O_DIRECTORY"}, {unix.O_NOFOLLOW, "O_NOFOLLOW"}, {unix.O_NOATIME, "O_NOATIME"},
+	{unix.O_CLOEXEC, "O_CLOEXEC"}, {unix.O_PATH, "O_PATH"},
+	// O_SYNC and O_TMPFILE include O_DSYNC and O_DIRECTORY, which are
+	// shown alongside them.
+	{unix.O_SYNC &^ unix.O_DSYNC, "O_SYNC"}, {unix.O_TMPFILE &^ unix.O_DIRECTORY, "O_TMPFILE"},
+}
+
+var atFlags = []flagName{
+	{unix.AT_SYMLINK_NOFOLLOW, "AT_SYMLINK_NOFOLLOW"}, {unix.AT_REMOVEDIR, "AT_REMOVEDIR"},
+	{unix.AT_SYMLINK_FOLLOW, "AT_SYMLINK_FOLLOW"}, {unix.AT_NO_AUTOMOUNT, "AT_NO_AUTOMOUNT"},
+	{unix.AT_EMPTY_PATH, "AT_EMPTY_PATH"}, {unix.AT_STATX_FORCE_SYNC, "AT_STATX_FORCE_SYNC"},
+	{unix.AT_STATX_DONT_SYNC, "AT_STATX_DONT_SYNC"},
+}
+
+var flockOps = []flagName{
+	{unix.LOCK_SH, "LOCK_SH"}, {unix.LOCK_EX, "LOCK_EX"}, {unix.LOCK_NB, "LOCK_NB"}, {unix.LOCK_UN, "LOCK_UN"},
+}
+
+var fallocModes = []flagName{
+	{unix.FALLOC_FL_KEEP_SIZE, "FALLOC_FL_KEEP_SIZE"}, {unix.FALLOC_FL_PUNCH_HOLE, "FALLOC_FL_PUNCH_HOLE"},
+	{unix.FALLOC_FL_COLLAPSE_RANGE, "FALLOC_FL_COLLAPSE_RANGE"}, {unix.FALLOC_FL_ZERO_RANGE, "FALLOC_FL_ZERO_RANGE"},
+	{unix.FALLOC_FL_INSERT_RANGE, "FALLOC_FL_INSERT_RANGE"}, {unix.FALLOC_FL_UNSHARE_RANGE, "FALLOC_FL_UNSHARE_RANGE"},
+}
+
+var resolveNames = []flagName{
+	{unix.RESOLVE_NO_XDEV, "RESOLVE_NO_XDEV"}, {unix.RESOLVE_NO_MAGICLINKS, "RESOLVE_NO_MAGICLINKS"},
+	{unix.RESOLVE_NO_SYMLINKS, "RESOLVE_NO_SYMLINKS"}, {unix.RESOLVE_BENEATH, "RESOLVE_BENEATH"},
+	{unix.RESOLVE_IN_ROOT, "RESOLVE_IN_ROOT"}, {resolveCached, "RESOLVE_CACHED"},
+}
+
+var cloneFlags = []flagName{
+	{unix.CLONE_VM, "CLONE_VM"}, {unix.CLONE_FS, "CLONE_FS"}, {unix.CLONE_FILES, "CLONE_FILES"},
+	{unix.CLONE_SIGHAND, "CLONE_SIGHAND"}, {unix.CLONE_PIDFD, "CLONE_PIDFD"},
+	{unix.CLONE_PTRACE, "CLONE_PTRACE"}, {unix.CLONE_VFORK, "CLONE_VFORK"},
+	{unix.CLONE_PARENT, "CLONE_PARENT"}, {unix.CLONE_THREAD, "CLONE_THREAD"},
+	{unix.CLONE_NEWNS, "CLONE_NEWNS"}, {unix.CLONE_SYSVSEM, "CLONE_SYSVSEM"},
+	{unix.CLONE_SETTLS, "CLONE_SETTLS"}, {unix.CLONE_PARENT_SETTID, "CLONE_PARENT_SETTID"},
+	{unix.CLONE_CHILD_CLEARTID, "CLONE_CHILD_CLEARTID"}, {unix.CLONE_UNTRACED, "CLONE_UNTRACED"},
+	{unix.CLONE_CHILD_SETTID, "CLONE_CHILD_SETTID"}, {unix.CLONE_NEWCGROUP, "CLONE_NEWCGROUP"},
+	{unix.CLONE_NEWUTS, "CLONE_NEWUTS"}, {unix.CLONE_NEWIPC, "CLONE_NEWIPC"},
+	{unix.CLONE_NEWUSER, "CLONE_NEWUSER"}, {unix.CLONE_NEWPID, "CLONE_NEWPID"},
+	{unix.CLONE_NEWNET, "CLONE_NEWNET"}, {unix.CLONE_IO, "CLONE_IO"},
+	{unix.CLONE_CLEAR_SIGHAND, "CLONE_CLEAR_SIGHAND"}, {unix.CLONE_INTO_CGROUP, "CLONE_INTO_CGROUP"},
+	{unix.CLONE_NEWTIME, "CLONE_NEWTIME"},
+}
+
+var protFlags = []flagName{
+	{unix.PROT_READ, "PROT_READ"}, {unix.PROT_WRITE, "PROT_WRITE"}, {unix.PROT_EXEC, "PROT_EXEC"},
+}
+
+var mapFlags = []flagName{
+	{unix.MAP_FIXED, "MAP_FIXED"}, {unix.MAP_ANONYMOUS, "MAP_ANONYMOUS"},
+	{unix.MAP_GROWSDOWN, "MAP_GROWSDOWN"}, {unix.MAP_DENYWRITE, "MAP_DENYWRITE"},
+	{unix.MAP_EXECUTABLE, "MAP_EXECUTABLE"}, {unix.MAP_LOCKED, "MAP_LOCKED"},
+	{unix.MAP_NORESERVE, "MAP_NORESERVE"}, {unix.MAP_POPULATE, "MAP_POPULATE"},
+	{unix.MAP_NONBLOCK, "MAP_NONBLOCK"}, {unix.MAP_STACK, "MAP_STACK"},
+	{unix.MAP_HUGETLB, "MAP_HUGETLB"}, {unix.MAP_FIXED_NOREPLACE, "MAP_FIXED_NOREPLACE"},
+}
+
+var fcntlCmds = map[uint64]string{
+	unix.F_DUPFD: "F_DUPFD", unix.F_GETFD: "F_GETFD", unix.F_SETFD: "F_SETFD",
+	unix.F_GETFL: "F_GETFL", unix.F_SETFL: "F_SETFL", unix.F_GETLK: "F_GETLK",
+	unix.F_SETLK: "F_SETLK", unix.F_SETLKW: "F_SETLKW", unix.F_DUPFD_CLOEXEC: "F_DUPFD_CLOEXEC",
+	unix.F_GETPIPE_SZ: "F_GETPIPE_SZ", unix.F_SETPIPE_SZ: "F_SETPIPE_SZ",
+	unix.F_ADD_SEALS: "F_ADD_SEALS", unix.F_GET_SEALS: "F_GET_SEALS",
+	unix.F_OFD_GETLK: "F_OFD_GETLK", unix.F_OFD_SETLK: "F_OFD_SETLK", unix.F_OFD_SETLKW: "F_OFD_SETLKW",
+}
+
+var whences = []string{"SEEK_SET", "SEEK_CUR", "SEEK_END", "SEEK_DATA", "SEEK_HOLE"}
+
+// maxTraceData is how much of a data buffer a trace shows, as strace
+// does by default.
+const maxTraceData = 32
+
+// syscallName returns the name of the native syscall nr, or syscall_N for
+// one the tracer cannot name, as traces show it.
+func syscallName(nr uint64) string {
+	if spec, ok := syscallSpecs[nr]; ok {
+		return spec.name
+	}
+	return fmt.Sprintf("syscall_%d", nr)
+}
+
+// decode returns the name and decoded arguments of the syscall c, which
+// returned ret if done is set, and whether its result is an address.
+// Syscalls the tracer cannot name are shown as syscall_N with six
+// arguments in hex.
+func (th *thread) decode(c sysCall, ret int64, done bool) (name string, args []string, hexRet bool) {
+	n, ok := native(c)
+	spec, known := syscallSpecs[n.nr]
+	if !ok || !known {
+		args = make([]string, len(c.args))
+		for i, a := range c.args {
+			args[i] = fmt.Sprintf("%#x", a)
+		}
+		return fmt.Sprintf("syscall_%d", c.nr), args, false
+	}
+	for i, kind := range spec.args {
+		a := n.args[i]
+		switch kind {
+		case argOpenMode:
+			if a&^0o7777 == 0 && n.args[i-1]&unix.O_CREAT == 0 && n.args[i-1]&unix.O_TMPFILE != unix.O_TMPFILE {
+				continue
+			}
+			args = append(args, fmt.Sprintf("%#o", a))
+		case argBufIn:
+			args = append(args, th.traceData(a, int(min(n.args[i+1], maxBufferSize))))
+		case argBufOut:
+			if !done || ret < 0 {
+				args = append(args, fmt.Sprintf("%#x", a))
+				break
+			}
+			args = append(args, th.traceData(a, int(ret)))
+		default:
+			args = append(args, th.decodeArg(kind, a))
+		}
+	}
+	return spec.name, args, spec.hexRet
+}
+
+func (th *thread) decodeArg(kind argKind, a uint64) string {
+	switch kind {
+	case argHex:
+		return fmt.Sprintf("%#x", a)
+	case argFD:
+		return strconv.Itoa(int(int32(a)))
+	case argDirFD:
+		if int32(a) == unix.AT_FDCWD {
+			return "AT_FDCWD"
+		}
+		return strconv.Itoa(int(int32(a)))
+	case argPath, argStr:
+		s, err := th.mem.readString(uintptr(a))
+		if err != nil {
+			return fmt.Sprintf("%#x", a)
+		}
+		return strconv.Quote(s)
+	case argMode:
+		return fmt.Sprintf("%#o", a)
+	case argOpenFlags:
+		mode := []string{"O_RDONLY", "O_WRONLY", "O_RDWR", "O_ACCMODE"}[a&unix.O_ACCMODE]
+		if rest := flagString(a&^unix.O_ACCMODE, openFlags); rest != "0" {
+			return mode + "|" + rest
+		}
+		return mode
+	case argAtFlags:
+		return flagString(a, atFlags)
+	case argWhence:
+		if a < uint64(len(whences)) {
+			return whences[a]
+		}
+		return strconv.FormatUint(a, 10)
+	case argProt:
+		if a == unix.PROT_NONE {
+			return "PROT_NONE"
+		}
+		return flagString(a, protFlags)
+	case argMapFlags:
+		var typ string
+		switch a & unix.MAP_TYPE {
+		case unix.MAP_SHARED:
+			typ = "MAP_SHARED"
+		case unix.MAP_PRIVATE:
+			typ = "MAP_PRIVATE"
+		case unix.MAP_SHARED_VALIDATE:
+			typ = "MAP_SHARED_VALIDATE"
+		default:
+			typ = fmt.Sprintf("%#x", a&unix.MAP_TYPE)
+		}
+		if rest := flagString(a&^unix.MAP_TYPE, mapFlags); rest != "0" {
+			return typ + "|" + rest
+		}
+		return typ
+	case argFcntlCmd:
+		if name, ok := fcntlCmds[a]; ok {
+			return name
+		}
+		return strconv.FormatUint(a, 10)
+	case argFlockOp:
+		return flagString(a, flockOps)
+	case argFallocMode:
+		return flagString(a, fallocModes)
+	case argOpenHow:
+		b, err := th.mem.readBytes(uintptr(a), openHowSize)
+		if err != nil {
+			return fmt.Sprintf("%#x", a)
+		}
+		flags, mode := binary.LittleEndian.Uint64(b), binary.LittleEndian.Uint64(b[8:])
+		s := "{flags=" + th.decodeArg(argOpenFlags, flags)
+		if mode != 0 || flags&unix.O_CREAT != 0 || flags&unix.O_TMPFILE == unix.O_TMPFILE {
+			s += fmt.Sprintf(", mode=%#o", mode)
+		}
+		if resolve := binary.LittleEndian.Uint64(b[16:]); resolve != 0 {
+			s += ", resolve=" + flagString(resolve, resolveNames)
+		}
+		return s + "}"
+	case argCloneFlags:
+		s := flagString(a&^0xff, cloneFlags)
+		if a&0xff == 0 {
+			return s
+		}
+		if s == "0" {
+			return signalName(a & 0xff)
+		}
+		return s + "|" + signalName(a&0xff)
+	case argCloneArgs:
+		// flags is the first field, and exit_signal the fifth.
+		b, err := th.mem.readBytes(uintptr(a), 40)
+		if err != nil {
+			return fmt.Sprintf("%#x", a)
+		}
+		s := "{flags=" + flagString(binary.LittleEndian.Uint64(b), cloneFlags)
+		if sig := binary.LittleEndian.Uint64(b[32:]); sig != 0 {
+			s += ", exit_signal=" + signalName(sig)
+		}
+		return s + "}"
+	}
+	return strconv.FormatInt(int64(a), 10)
+}
+
+// signalName names the signal sig, or gives its number if it has no name.
+func signalName(sig uint64) string {
+	if name := unix.SignalName(syscall.Signal(sig)); name != "" {
+		return name
+	}
+	return strconv.FormatUint(sig, 10)
+}
+
+// flagString shows the bits of v as names joined by |, with any bits
+// left over in hex.
+func flagString(v uint64, names []flagName) string {
+	if v == 0 {
+		return "0"
+	}
+	var parts []string
+	for _, f := range names {
+		if f.v != 0 && v&f.v == f.v {
+			parts = append(parts, f.name)
+			v &^= f.v
+		}
+	}
+	if v != 0 {
+		parts = append(parts, fmt.Sprintf("%#x", v))
+	}
+	return strings.Join(parts, "|")
+}
+
+// traceData shows up to maxTraceData of the n bytes at addr as a quoted
+// string, with an ellipsis if there are more.
+func (th *thread) traceData(addr uint64, n int) string {
+	b, err := th.mem.readBytes(uintptr(addr), min(n, maxTraceData))
+	if err != nil {
+		return fmt.Sprintf("%#x", addr)
+	}
+	s := strconv.Quote(string(b))
+	if n > maxTraceData {
+		s += "..."
+	}
+	return s
+}
@@ -0,0 +1,183 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Delay slows a syscall down, as part of the delays given to WithDelays,
+// to simulate a slow disk or network filesystem.
+type Delay struct {
+	// Syscall and Path select the syscalls to delay, as they do for a
+	// Fault.
+	Syscall uint64
+	Path    string
+	// Duration is how long each matching syscall is held before it runs.
+	Duration time.Duration
+	// Sample, if set, is called for each matching syscall and returns how
+	// long to hold it instead, for delays drawn from a distribution.
+	Sample func() time.Duration
+}
+
+// WithDelays holds the syscalls the delays match before they run, adding to
+// any delays given before. Only the thread making a held syscall waits;
+// the tracer goes on serving every other thread. The first delay that
+// matches a syscall decides how long it is held. Delays come before
+// everything else the tracer does with a syscall, including hooks,
+// policies and faults.
+func WithDelays(delays ...Delay) Option {
+	return func(t *Tracer) { t.delays = append(t.delays, delays...) }
+}
+
+// delaySyscalls returns the syscalls the delays need trapped.
+func (t *Tracer) delaySyscalls() []uint64 {
+	if len(t.delays) == 0 {
+		return nil
+	}
+	nrs := legacyWriteSyscalls[:len(legacyWriteSyscalls):len(legacyWriteSyscalls)]
+	for _, d := range t.delays {
+		nrs = append(nrs, d.Syscall)
+	}
+	return nrs
+}
+
+// delayFor returns how long the syscall c must be held, for the delays
+// it matches or the throttle of its mount.
+func (th *thread) delayFor(c sysCall) time.Duration {
+	c, ok := native(c)
+	if !ok {
+		return 0
+	}
+	c = canonical(c)
+	return max(th.delay(c), th.throttleFor(c))
+}
+
+// delay returns how long the canonical syscall c must be held for the
+// delays it matches.
+func (th *thread) delay(c sysCall) time.Duration {
+	if len(th.t.delays) == 0 {
+		return 0
+	}
+	var (
+		p              string
+		pathOK, looked bool
+	)
+	for _, d := range th.t.delays {
+		if d.Syscall != c.nr {
+			continue
+		}
+		if d.Path != "" {
+			if !looked {
+				p, pathOK = th.callPath(c)
+				looked = true
+			}
+			if !pathOK || !matchFile(d.Path, p) {
+				continue
+			}
+		}
+		if d.Sample != nil {
+			return d.Sample()
+		}
+		return d.Duration
+	}
+	return 0
+}
+
+// sleep is a nanosleep the thread has been made to enter in place of a
+// held syscall. The timespec it sleeps for is at addr, over saved.
+type sleep struct {
+	addr  uintptr
+	saved []byte
+}
+
+// startSleep holds the syscall c the thread is stopped entering for d, by
+// making it enter a nanosleep instead.
+func (th *thread) startSleep(c sysCall, d time.Duration) error {
+	ts := unix.NsecToTimespec(d.Nanoseconds())
+	var b []byte
+	if c.arch == compatArch {
+		b = binary.LittleEndian.AppendUint32(b, uint32(ts.Sec))
+		b = binary.LittleEndian.AppendUint32(b, uint32(ts.Nsec))
+	} else {
+		b = binary.LittleEndian.AppendUint64(b, uint64(ts.Sec))
+		b = binary.LittleEndian.AppendUint64(b, uint64(ts.Nsec))
+	}
+	// Like a mapping's memfd name, the timespec goes below the stack
+	// pointer, past the amd64 red zone.
+	addr := uintptr(stackPointer(&th.regs)-256) &^ 15
+	saved, err := th.mem.readBytes(addr, len(b))
+	if err != nil {
+		return err
+	}
+	if err := th.mem.writeBytes(addr, b); err != nil {
+		return err
+	}
+	regs := th.regs
+	if err := rewriteSyscall(th.tid, &regs, c.arch, unix.SYS_NANOSLEEP, uint64(addr), 0); err != nil {
+		_ = th.mem.writeBytes(addr, saved)
+		return err
+	}
+	th.sleep = &sleep{addr: addr, saved: saved}
+	return nil
+}
+
+// endSleep runs at the exit stop of a held syscall's nanosleep, and makes
+// the thread make the syscall again, as it first did, when it resumes. A
+// signal that cut the sleep short ends it early.
+func (th *thread) endSleep() {
+	s := th.sleep
+	th.sleep = nil
+	_ = th.mem.writeBytes(s.addr, s.saved)
+	regs := th.regs
+	rewind(&regs, syscallNo(&th.regs))
+	if err := setRegs(th.tid, &regs); err != nil {
+		th.t.log.Printf("setregs: %v", err)
+		return
+	}
+	th.slept = true
+}
+
+// heldNotification is a seccomp notification the unotify engine answers
+// once a delay is over, until which the notifying thread stays blocked in
+// its syscall. nap is the sleep on the virtual clock the thread goes on
+// with then, if it is in one.
+type heldNotification struct {
+	until time.Time
+	req   seccompNotif
+	nap   *clockSleep
+}
+
+// holdTimeout returns how long the unotify engine may wait for events
+// before the next held notification is due, or nil if none is held.
+func (t *Tracer) holdTimeout() *unix.Timespec {
+	if len(t.held) == 0 {
+		return nil
+	}
+	until := t.held[0].until
+	for _, h := range t.held[1:] {
+		if h.until.Before(until) {
+			until = h.until
+		}
+	}
+	ts := unix.NsecToTimespec(max(time.Until(until), 0).Nanoseconds())
+	return &ts
+}
+
+// answerHeld answers the held notifications that are due.
+func (t *Tracer) answerHeld(listener int) error {
+	now := time.Now()
+	held := t.held[:0]
+	for _, h := range t.held {
+		if h.until.After(now) {
+			held = append(held, h)
+			continue
+		}
+		if err := t.answer(listener, &h.req, h.nap); err != nil {
+			return err
+		}
+	}
+	t.held = held
+	return nil
+}
@@ -0,0 +1,251 @@
+package tracer
+
+import (
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"slices"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// State is what a Tracer knows about its tracees that the kernel does not,
+// as returned by Detach for Reattach. It marshals to JSON, so it can be
+// handed to another program, such as a new version of the supervisor.
+type State struct {
+	// Processes are the processes that were traced, starting with the one
+	// Run was started for.
+	Processes []ProcessState
+	// Files are the virtual files the processes had open.
+	Files []FileState
+	// Rules and PathRules are the policy the processes were traced under,
+	// as given to WithPolicy and WithPathRules.
+	Rules     []Rule     `json:",omitempty"`
+	PathRules []PathRule `json:",omitempty"`
+
+	// hosts holds the host files Handoff sends, by index in Files.
+	hosts map[int]*os.File
+}
+
+// ProcessState is a traced process in a State.
+type ProcessState struct {
+	Pid int
+	FDs []FDState
+}
+
+// FDState is a virtual descriptor of a process in a State.
+type FDState struct {
+	FD int
+	// File is the index in State.Files of the file FD refers to.
+	// Descriptors that shared a file, through dup or fork, share it again
+	// once restored.
+	File    int
+	Cloexec bool
+}
+
+// FileState is an open virtual file in a State.
+type FileState struct {
+	// Path is the absolute path the file was opened as, and Flags the
+	// flags it was opened with.
+	Path  string
+	Flags int
+	// Offset is the file offset, and DirPos how many directory entries
+	// have been read, if the file is a directory being listed.
+	Offset int64
+	DirPos int `json:",omitempty"`
+	// HostFile is set if Handoff sent the host file behind the virtual
+	// one along with the State.
+	HostFile bool `json:",omitempty"`
+}
+
+// Detach stops tracing without killing anything. Run lets every tracee go
+// once it is outside any syscall the tracer is handling, and returns nil.
+// Detach waits for Run to return, then returns the state of the tracees'
+// virtual descriptors, which Reattach can give back to them. Until then the
+// processes cannot use those descriptors, and processes they start in the
+// meantime go untraced.
+//
+// Only a Tracer without a seccomp filter can detach: one returned by Attach,
+// or one given WithSeccomp(false) that uses EnginePtrace.
+func (t *Tracer) Detach() (*State, error) {
+	if !t.detachable {
+		return nil, errors.New("tracer: cannot detach from a seccomp filter")
+	}
+	t.requestDetach()
+	<-t.finished
+	s := t.saved.state(t.leader)
+	s.Rules, s.PathRules = t.rules, t.pathRules
+	return s, nil
+}
+
+// Reattach returns a Tracer that attaches to the processes in s as Attach
+// does, and gives them back the virtual descriptors they had when Detach
+// returned s. It must be given the same mounts and remapping rules as the
+// Tracer that detached; the policy in s is applied ahead of any in opts.
+// Descriptors for files that can no longer be opened are left closed. Run
+// returns once the first of the processes exits.
+func Reattach(s *State, opts ...Option) *Tracer {
+	t := Attach(0, append([]Option{WithPolicy(s.Rules...), WithPathRules(s.PathRules...)}, opts...)...)
+	if len(s.Processes) > 0 {
+		t.attached = s.Processes[0].Pid
+	}
+	t.restore = &restorer{state: s, files: make(map[int]*vfile)}
+	return t
+}
+
+// stateSaver collects the state of the tracees as they are detached.
+type stateSaver struct {
+	// procs holds the descriptors of each process, files the state of
+	// each file they refer to.
+	procs map[int][]savedFD
+	files map[*vfile]FileState
+	// keepHosts is set by Handoff, to keep in hosts the host files behind
+	// the files.
+	keepHosts bool
+	hosts     map[*vfile]*os.File
+}
+
+type savedFD struct {
+	fd      int
+	file    *vfile
+	cloexec bool
+}
+
+func newStateSaver() *stateSaver {
+	return &stateSaver{procs: make(map[int][]savedFD), files: make(map[*vfile]FileState), hosts: make(map[*vfile]*os.File)}
+}
+
+// save records the descriptors of the thread being detached. Each thread of
+// a process overwrites what the one before saved, so the last has the final
+// say.
+func (s *stateSaver) save(th *thread) {
+	fds := make([]savedFD, 0, len(th.fds.fds))
+	for fd, d := range th.fds.fds {
+		fds = append(fds, savedFD{fd: fd, file: d.file, cloexec: d.cloexec})
+		d.file.wait()
+		fs := FileState{Path: d.file.path, Flags: d.file.flags}
+		if off, err := d.file.file.Seek(0, io.SeekCurrent); err == nil {
+			fs.Offset = off
+		}
+		if d.file.dir != nil {
+			fs.DirPos = d.file.dir.pos
+		}
+		if s.keepHosts && s.hosts[d.file] == nil {
+			if h := keepHost(d.file); h != nil {
+				s.hosts[d.file] = h
+			}
+		}
+		fs.HostFile = s.hosts[d.file] != nil
+		s.files[d.file] = fs
+	}
+	slices.SortFunc(fds, func(a, b savedFD) int { return a.fd - b.fd })
+	s.procs[th.pid] = fds
+}
+
+// state returns what has been saved, with the process leader first.
+func (s *stateSaver) state(leader int) *State {
+	st := &State{hosts: make(map[int]*os.File)}
+	pids := slices.Sorted(maps.Keys(s.procs))
+	if i := slices.Index(pids, leader); i > 0 {
+		pids = slices.Insert(slices.Delete(pids, i, i+1), 0, leader)
+	}
+	index := make(map[*vfile]int)
+	for _, pid := range pids {
+		p := ProcessState{Pid: pid}
+		for _, d := range s.procs[pid] {
+			i, ok := index[d.file]
+			if !ok {
+				i = len(st.Files)
+				index[d.file] = i
+				st.Files = append(st.Files, s.files[d.file])
+				if h := s.hosts[d.file]; h != nil {
+					st.hosts[i] = h
+				}
+			}
+			p.FDs = append(p.FDs, FDState{FD: d.fd, File: i, Cloexec: d.cloexec})
+		}
+		st.Processes = append(st.Processes, p)
+	}
+	return st
+}
+
+// restorer gives the processes a Tracer reattaches to back their state.
+type restorer struct {
+	state *State
+	// files holds the files reopened so far, by index in state.Files.
+	files map[int]*vfile
+}
+
+// closeHosts closes the host files sent with the state that have not been
+// reopened.
+func (r *restorer) closeHosts() {
+	if r != nil {
+		r.state.closeHosts()
+	}
+}
+
+// restoreFDs returns the descriptor table for process pid, holding the
+// descriptors being restored for it, if any.
+func (t *Tracer) restoreFDs(pid int) *fdTable {
+	fds := newFDTable()
+	if t.restore == nil {
+		return fds
+	}
+	i := slices.IndexFunc(t.restore.state.Processes, func(p ProcessState) bool { return p.Pid == pid })
+	if i < 0 {
+		return fds
+	}
+	for _, d := range t.restore.state.Processes[i].FDs {
+		f, err := t.reopen(pid, d.File)
+		if err != nil {
+			t.log.Printf("pid %d: fd %d not restored: %v", pid, d.FD, err)
+			continue
+		}
+		fds.set(d.FD, f, d.Cloexec)
+	}
+	return fds
+}
+
+// reopen returns file i of the state being restored, opening it for process
+// pid if no process has yet.
+func (t *Tracer) reopen(pid, i int) (*vfile, error) {
+	if f, ok := t.restore.files[i]; ok {
+		return f, nil
+	}
+	if i < 0 || i >= len(t.restore.state.Files) {
+		return nil, errors.New("no such file in the state")
+	}
+	s := t.restore.state.Files[i]
+	m, name, ok := t.lookup(s.Path)
+	if !ok {
+		return nil, errors.New(s.Path + " is not below a mount")
+	}
+	var f vfs.File
+	if h, ok := t.restore.state.hosts[i]; ok {
+		f = h
+		delete(t.restore.state.hosts, i)
+	} else {
+		var err error
+		if f, err = m.backend.Open(name, s.Flags&^(unix.O_CREAT|unix.O_EXCL|unix.O_TRUNC), 0); err != nil {
+			return nil, err
+		}
+	}
+	if s.Offset != 0 {
+		if _, err := f.Seek(s.Offset, io.SeekStart); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	vf := &vfile{file: f, path: s.Path, flags: s.Flags, mount: m, name: name}
+	vf.closed = func() { t.emit(&FileClosed{Pid: pid, Path: s.Path}) }
+	if s.DirPos > 0 {
+		if l, err := t.dirList(vf); err == nil {
+			l.pos = min(s.DirPos, len(l.entries))
+		}
+	}
+	t.restore.files[i] = vf
+	return vf, nil
+}
@@ -0,0 +1,158 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io/fs"
+	"path"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// dirList is a directory listing being read with getdents64. It is taken
+// when the first batch is read and served from memory afterwards, so
+// entries added or removed in the meantime are not seen until the
+// directory is opened again.
+type dirList struct {
+	entries []dirent
+	pos     int
+}
+
+type dirent struct {
+	ino  uint64
+	typ  uint8
+	name string
+}
+
+// read encodes entries from the current position as struct linux_dirent64
+// records, filling at most size bytes, and advances past them.
+func (d *dirList) read(size int) []byte {
+	var b []byte
+	for ; d.pos < len(d.entries); d.pos++ {
+		e := d.entries[d.pos]
+		// d_ino, d_off, d_reclen and d_type precede the name, and each
+		// record is padded to eight bytes.
+		reclen := (8 + 8 + 2 + 1 + len(e.name) + 1 + 7) &^ 7
+		if len(b)+reclen > size {
+			break
+		}
+		rec := make([]byte, reclen)
+		binary.LittleEndian.PutUint64(rec[0:], e.ino)
+		binary.LittleEndian.PutUint64(rec[8:], uint64(d.pos+1))
+		binary.LittleEndian.PutUint16(rec[16:], uint16(reclen))
+		rec[18] = e.typ
+		copy(rec[19:], e.name)
+		b = append(b, rec...)
+	}
+	return b
+}
+
+func (th *thread) sysGetdents64(fd int, buf uintptr, count int) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	th.t.log.Printf("getdents64: fd=%d (virtual)", fd)
+	if _, err := th.t.dirList(f); err != nil {
+		return errnoRet(err), true
+	}
+	pos := f.dir.pos
+	b := f.dir.read(min(count, maxBufferSize))
+	if len(b) == 0 && f.dir.pos < len(f.dir.entries) {
+		return -int64(unix.EINVAL), true
+	}
+	if err := th.mem.writeBytes(buf, b); err != nil {
+		f.dir.pos = pos
+		return -int64(unix.EFAULT), true
+	}
+	return int64(len(b)), true
+}
+
+// dirList returns the listing being read from f, taking it on first use.
+func (t *Tracer) dirList(f *vfile) (*dirList, error) {
+	if f.dir == nil {
+		entries, err := t.listDir(f)
+		if err != nil {
+			return nil, err
+		}
+		f.dir = &dirList{entries: entries}
+	}
+	return f.dir, nil
+}
+
+// listDir reads the directory open as f from its backend. Mount points
+// directly inside it are listed too, even when the backend has no such
+// entry, so that every mount can be reached by walking the tree.
+func (t *Tracer) listDir(f *vfile) ([]dirent, error) {
+	fi, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+	entries, err := f.mount.backend.ReadDir(f.name)
+	if err != nil {
+		return nil, err
+	}
+	list := []dirent{
+		{ino: inodeNumber(f.path, fi), typ: unix.DT_DIR, name: "."},
+		{ino: inodeNumber(path.Dir(f.path), nil), typ: unix.DT_DIR, name: ".."},
+	}
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		p := path.Join(f.path, e.Name())
+		info, _ := e.Info()
+		list = append(list, dirent{ino: inodeNumber(p, info), typ: direntType(e.Type()), name: e.Name()})
+		seen[e.Name()] = true
+	}
+	for _, m := range t.mounts {
+		if m.dir != f.path && path.Dir(m.dir) == f.path && !seen[path.Base(m.dir)] {
+			list = append(list, dirent{ino: inodeNumber(m.dir, nil), typ: unix.DT_DIR, name: path.Base(m.dir)})
+		}
+	}
+	return list, nil
+}
+
+// inodeNumber returns the inode number of the file at p. Backends that do
+// not report one get a number derived from the path; it is never zero,
+// which readdir implementations take to mean a deleted entry.
+func inodeNumber(p string, fi fs.FileInfo) uint64 {
+	if fi != nil {
+		switch sys := fi.Sys().(type) {
+		case *syscall.Stat_t:
+			return sys.Ino
+		case *vfs.Attr:
+			if sys.Ino != 0 {
+				return sys.Ino
+			}
+		}
+	}
+	h := fnv.New64a()
+	h.Write([]byte(p))
+	return h.Sum64() | 1
+}
+
+// direntType converts the type bits of m to a d_type value.
+func direntType(m fs.FileMode) uint8 {
+	switch {
+	case m.IsDir():
+		return unix.DT_DIR
+	case m&fs.ModeSymlink != 0:
+		return unix.DT_LNK
+	case m&fs.ModeNamedPipe != 0:
+		return unix.DT_FIFO
+	case m&fs.ModeSocket != 0:
+		return unix.DT_SOCK
+	case m&fs.ModeCharDevice != 0:
+		return unix.DT_CHR
+	case m&fs.ModeDevice != 0:
+		return unix.DT_BLK
+	case m.IsRegular():
+		return unix.DT_REG
+	}
+	return unix.DT_UNKNOWN
+}
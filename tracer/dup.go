@@ -0,0 +1,97 @@
+package tracer
+
+import "golang.org/x/sys/unix"
+
+// reservation asks the engine to make the kernel hold a placeholder
+// descriptor at fd, because a virtual descriptor now lives below fdBase.
+type reservation struct {
+	fd      int
+	cloexec bool
+}
+
+func (th *thread) sysDup2(oldfd, newfd int) (int64, bool) {
+	if oldfd == newfd {
+		if _, ok := th.fds.get(oldfd); ok {
+			return int64(newfd), true
+		}
+		return 0, false
+	}
+	return th.sysDup3(oldfd, newfd, 0)
+}
+
+func (th *thread) sysDup3(oldfd, newfd, flags int) (int64, bool) {
+	if oldfd != newfd {
+		// The descriptor duplicated over is closed.
+		th.closeLease(newfd)
+	}
+	f, ok := th.fds.get(oldfd)
+	if !ok {
+		// A real descriptor duplicated over a virtual one replaces it,
+		// and the kernel replaces the placeholder.
+		if _, ok := th.fds.get(newfd); ok && th.realFD(oldfd) {
+			old, _ := th.fds.remove(newfd)
+			_ = old.decref()
+		}
+		return 0, false
+	}
+	switch {
+	case flags&^unix.O_CLOEXEC != 0 || oldfd == newfd:
+		return -int64(unix.EINVAL), true
+	case newfd < 0:
+		return -int64(unix.EBADF), true
+	}
+	th.t.log.Printf("dup3: fd=%d to %d (virtual)", oldfd, newfd)
+	cloexec := flags&unix.O_CLOEXEC != 0
+	if old := th.fds.set(newfd, f, cloexec); old != nil {
+		_ = old.decref()
+	}
+	if newfd < fdBase {
+		th.reserve = &reservation{fd: newfd, cloexec: cloexec}
+	}
+	return int64(newfd), true
+}
+
+// fcntlSettable are the file status flags F_SETFL can change.
+const fcntlSettable = unix.O_APPEND | unix.O_NONBLOCK | unix.O_ASYNC | unix.O_DIRECT | unix.O_NOATIME
+
+func (th *thread) sysFcntl(fd, cmd int, arg uint64) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	th.t.log.Printf("fcntl: fd=%d cmd=%d (virtual)", fd, cmd)
+	switch cmd {
+	case unix.F_DUPFD, unix.F_DUPFD_CLOEXEC:
+		min := int(int32(arg))
+		if min < 0 {
+			return -int64(unix.EINVAL), true
+		}
+		if th.fdsFull() {
+			return -int64(unix.EMFILE), true
+		}
+		return int64(th.fds.add(f, max(min, fdBase), cmd == unix.F_DUPFD_CLOEXEC)), true
+	case unix.F_GETFD:
+		if th.fds.cloexec(fd) {
+			return unix.FD_CLOEXEC, true
+		}
+		return 0, true
+	case unix.F_SETFD:
+		th.fds.setCloexec(fd, arg&unix.FD_CLOEXEC != 0)
+		// The placeholder of a low descriptor takes the flag too, but
+		// for the unotify engine's, which must outlive an exec as
+		// their descriptors do.
+		return 0, fd >= fdBase || th.t.engine == EngineUnotify
+	case unix.F_GETFL:
+		return int64(f.flags), true
+	case unix.F_SETFL:
+		f.flags = f.flags&^fcntlSettable | int(arg)&fcntlSettable
+		return 0, true
+	case unix.F_GETLK, unix.F_SETLK, unix.F_SETLKW, unix.F_OFD_GETLK, unix.F_OFD_SETLK, unix.F_OFD_SETLKW:
+		return th.fcntlLock(f, cmd, uintptr(arg)), true
+	case compatGetlk64, compatSetlk64, compatSetlkw64:
+		if th.arch == compatArch {
+			return th.fcntlLock(f, cmd, uintptr(arg)), true
+		}
+	}
+	return -int64(unix.EINVAL), true
+}
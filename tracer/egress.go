@@ -0,0 +1,162 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithEgress makes the tracer an egress firewall for the command, one that
+// needs no privileges: a connect, sendto, sendmsg or sendmmsg to an IP
+// address that no rule in allow matches fails with ECONNREFUSED, and is
+// logged and reported as a SyscallDenied. Rules add to those given before.
+//
+// A rule is CIDR:PORT, as in 10.0.0.0/8:443 or [fd00::/8]:*. The CIDR may
+// be a single address, or * for every address; PORT is a port, a range
+// such as 8000-8999, or * for every port. IPv4 addresses mapped into IPv6
+// are matched as IPv4. A malformed rule fails Start. Loopback addresses
+// are refused like any other unless a rule allows them; Unix domain
+// sockets, and addresses of other families, are not checked. A call
+// WithRedirects rewrites is checked against where it is sent.
+//
+// Like WithPathRules, the check reads the address from the command's
+// memory, where another of its threads can change it before the kernel
+// reads it, and it does not cover sockets the command inherits already
+// connected.
+func WithEgress(allow ...string) Option {
+	return func(t *Tracer) {
+		if t.egress == nil {
+			t.egress = []egressRule{}
+		}
+		for _, s := range allow {
+			r, err := parseEgress(s)
+			if err != nil {
+				if t.egressErr == nil {
+					t.egressErr = fmt.Errorf("tracer: %w", err)
+				}
+				continue
+			}
+			t.egress = append(t.egress, r)
+		}
+	}
+}
+
+// egressRule is a rule of WithEgress parsed: it allows the addresses in
+// prefix, or every address if any is set, at the ports lo to hi.
+type egressRule struct {
+	prefix netip.Prefix
+	any    bool
+	lo, hi uint16
+}
+
+func parseEgress(s string) (egressRule, error) {
+	var r egressRule
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return r, fmt.Errorf("egress %q: %w", s, err)
+	}
+	switch {
+	case host == "*":
+		r.any = true
+	case strings.Contains(host, "/"):
+		p, err := netip.ParsePrefix(host)
+		if err != nil {
+			return r, fmt.Errorf("egress %q: %w", s, err)
+		}
+		r.prefix = p.Masked()
+	default:
+		a, err := netip.ParseAddr(host)
+		if err != nil {
+			return r, fmt.Errorf("egress %q: %w", s, err)
+		}
+		a = a.Unmap()
+		r.prefix = netip.PrefixFrom(a, a.BitLen())
+	}
+	if port == "*" {
+		r.lo, r.hi = 0, 1<<16-1
+		return r, nil
+	}
+	lo, hi, isRange := strings.Cut(port, "-")
+	if !isRange {
+		hi = lo
+	}
+	l, lerr := strconv.ParseUint(lo, 10, 16)
+	h, herr := strconv.ParseUint(hi, 10, 16)
+	if lerr != nil || herr != nil || l > h {
+		return r, fmt.Errorf("egress %q: bad port %q", s, port)
+	}
+	r.lo, r.hi = uint16(l), uint16(h)
+	return r, nil
+}
+
+func (r *egressRule) allows(a netip.AddrPort) bool {
+	return r.lo <= a.Port() && a.Port() <= r.hi && (r.any || r.prefix.Contains(a.Addr()))
+}
+
+// egressSyscalls returns the syscalls, beyond those a redirect traps, that
+// the firewall needs trapped.
+func (t *Tracer) egressSyscalls() []uint64 {
+	if t.egress == nil {
+		return nil
+	}
+	return []uint64{unix.SYS_SENDMSG, unix.SYS_SENDMMSG}
+}
+
+// egressDenied reports whether the command may not send to a, by the
+// syscall nr, and fails the call if so.
+func (th *thread) egressDenied(nr uint64, a netip.AddrPort) (int64, bool) {
+	if th.t.egress == nil {
+		return 0, false
+	}
+	for i := range th.t.egress {
+		if th.t.egress[i].allows(a) {
+			return 0, false
+		}
+	}
+	th.t.log.Printf("%s: %v denied: not in the egress allow-list", syscallSpecs[nr].name, a)
+	th.t.emit(&SyscallDenied{Pid: th.pid, Syscall: nr, Errno: unix.ECONNREFUSED})
+	return -int64(unix.ECONNREFUSED), true
+}
+
+// sysSendmsg checks the destination of sendmsg, or, with cnt, of each of
+// the cnt messages of a sendmmsg, against the firewall.
+func (th *thread) sysSendmsg(nr uint64, msgs uintptr, cnt int) (int64, bool) {
+	if th.t.egress == nil {
+		return 0, false
+	}
+	// A msghdr holds the address and its length first; an mmsghdr pads one
+	// out, with the length of the message sent. x32 sends the i386 ones.
+	size, stride := 8, 64
+	if th.arch == compatArch || th.x32 {
+		size, stride = 4, 32
+	}
+	for i := range min(cnt, iovMax) {
+		b, err := th.mem.readBytes(msgs+uintptr(i*stride), 2*size)
+		if err != nil {
+			// The kernel fails it as well.
+			return 0, false
+		}
+		name, n := uintptr(binary.LittleEndian.Uint64(b)), binary.LittleEndian.Uint32(b[8:])
+		if size == 4 {
+			name, n = uintptr(binary.LittleEndian.Uint32(b)), binary.LittleEndian.Uint32(b[4:])
+		}
+		if name == 0 || n < 2 || n > sockaddrMax {
+			continue
+		}
+		sa, err := th.mem.readBytes(name, int(n))
+		if err != nil {
+			continue
+		}
+		if a, ok := decodeSockaddr(sa); ok {
+			if ret, denied := th.egressDenied(nr, a); denied {
+				return ret, true
+			}
+		}
+	}
+	return 0, false
+}
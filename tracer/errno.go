@@ -0,0 +1,30 @@
+package tracer
+
+import (
+	"errors"
+	"io/fs"
+
+	"golang.org/x/sys/unix"
+)
+
+// errnoFor maps an error returned by a backend to the errno the tracee
+// should see.
+func errnoFor(err error) unix.Errno {
+	var errno unix.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return unix.ENOENT
+	case errors.Is(err, fs.ErrExist):
+		return unix.EEXIST
+	case errors.Is(err, fs.ErrPermission):
+		return unix.EACCES
+	case errors.Is(err, fs.ErrInvalid):
+		return unix.EINVAL
+	case errors.Is(err, fs.ErrClosed):
+		return unix.EBADF
+	}
+	return unix.EIO
+}
@@ -0,0 +1,121 @@
+package tracer
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// eventBuffer is how many events Events holds for a receiver that falls
+// behind before the tracer waits for it.
+const eventBuffer = 64
+
+// Event is something the command did. It is one of *FileOpened,
+// *FileWritten, *FileClosed, *ProcessForked, *ProcessExited or
+// *SyscallDenied.
+type Event interface {
+	event()
+}
+
+// FileOpened reports that a process opened a virtual file.
+type FileOpened struct {
+	Pid int
+	// FD is the descriptor the file was opened as.
+	FD   int
+	Path string
+	// Flags are the open flags, without O_CLOEXEC.
+	Flags int
+}
+
+// FileWritten reports a successful write to a virtual file.
+type FileWritten struct {
+	Pid, FD int
+	Path    string
+	// N is the number of bytes written.
+	N int
+}
+
+// FileClosed reports that the backend file behind a virtual file that
+// process Pid opened has been closed, because the last descriptor for it
+// went away through close, dup2, exec or exit.
+type FileClosed struct {
+	Pid  int
+	Path string
+}
+
+// ProcessForked reports that process Pid created a new process, Child.
+// Threads are not reported.
+type ProcessForked struct {
+	Pid, Child int
+}
+
+// ProcessExited reports that a process exited.
+type ProcessExited struct {
+	Pid int
+	// ExitCode is the exit status, or -1 if the process was killed by a
+	// signal or the tracer cannot tell, as under EngineUnotify for every
+	// process but the command itself.
+	ExitCode int
+}
+
+// SyscallDenied reports a syscall that a policy, a path rule, read-only
+// mode, WithIOURing or WithEgress blocked.
+type SyscallDenied struct {
+	Pid int
+	// Syscall is the native number of the syscall. Legacy syscalls are
+	// reported as their *at forms, such as unix.SYS_OPENAT for open.
+	Syscall uint64
+	// Errno is the error the syscall failed with, unless Killed is set
+	// because the rule killed the process instead.
+	Errno  syscall.Errno
+	Killed bool
+}
+
+func (*FileOpened) event()    {}
+func (*FileWritten) event()   {}
+func (*FileClosed) event()    {}
+func (*ProcessForked) event() {}
+func (*ProcessExited) event() {}
+func (*SyscallDenied) event() {}
+
+// Events returns a channel of the command's events, which Run closes when
+// it returns. It must be called before Run or Start; without it, no events
+// are sent. Called later, it returns the channel an earlier call made, or
+// else a closed one.
+//
+// The tracer waits for each event to be received once the channel's
+// buffer is full, stopping the command in the meantime, so a receiver that
+// falls behind slows the command down. Cancelling Run's context stops the
+// wait.
+func (t *Tracer) Events() <-chan Event {
+	if t.started != nil && t.events == nil {
+		// The tracer is already running without a channel, and would
+		// never close one made now.
+		c := make(chan Event)
+		close(c)
+		return c
+	}
+	if t.events == nil {
+		t.events = make(chan Event, eventBuffer)
+	}
+	return t.events
+}
+
+// emit sends e to the Events channel, if there is one.
+func (t *Tracer) emit(e Event) {
+	if t.events == nil {
+		return
+	}
+	select {
+	case t.events <- e:
+	case <-t.done:
+	}
+}
+
+// exitCode returns the exit code ws reports, or -1 for a signal.
+func exitCode(ws unix.WaitStatus) int {
+	if ws.Exited() {
+		return ws.ExitStatus()
+	}
+	return -1
+}
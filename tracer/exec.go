@@ -0,0 +1,477 @@
+package tracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// Exec is a program a process is about to run, as the functions given to
+// WithExec see it.
+type Exec struct {
+	// Pid is the process making the execve or execveat.
+	Pid int
+	// Path is the program's absolute path, as the process named it or as
+	// the descriptor it gave execveat is open.
+	Path string
+	// Argv and Env are the arguments and environment the program gets.
+	Argv, Env []string
+}
+
+// WithExec calls fn before each execve and execveat the command makes,
+// after any functions given before. fn may change the Exec it is given to
+// run another program, by setting Path to an absolute path, or to filter or
+// add to the arguments and the environment.
+//
+// Whether or not there are functions, programs are found the way other
+// files are, through remapping rules and mounts. One the kernel cannot see,
+// because it is in a mount, is copied into a memfd for the process to
+// execute instead. A script there is run as the kernel would run it, by
+// the interpreter its #! line names, which is given the script's path and
+// opens it like any other file.
+//
+// Under EngineUnotify, which cannot rewrite a syscall, an exec that a
+// function changes, or of a program in a mount or remapped, fails with
+// ENOSYS. So does one made through the x32 ABI under either engine,
+// though x32 execs are left alone otherwise.
+func WithExec(fn func(*Exec)) Option {
+	return func(t *Tracer) { t.execs = append(t.execs, fn) }
+}
+
+// execSyscalls returns the syscalls exec interception needs trapped, which
+// are none unless there is something for it to do.
+func (t *Tracer) execSyscalls() []uint64 {
+	if t.execs == nil && len(t.mounts) == 0 && len(t.remaps) == 0 {
+		return nil
+	}
+	return []uint64{unix.SYS_EXECVE, unix.SYS_EXECVEAT}
+}
+
+const (
+	// maxArgLength is MAX_ARG_STRLEN, the longest argument or environment
+	// string exec accepts.
+	maxArgLength = 32 << 12
+	// maxArgStrings bounds how many such strings the tracer reads.
+	maxArgStrings = 1 << 20
+	// maxInterp is how many scripts may name one another as interpreter,
+	// as BINPRM_MAX_RECURSION.
+	maxInterp = 4
+)
+
+// execution is an exec being rewritten. The kernel cannot run a program in
+// a mount, nor with arguments it was not given, so the exec becomes a
+// series of syscalls in the thread, like a mapping: a mmap of memory to
+// hold the new strings, memfd_create if the program is virtual, the exec
+// itself, and, if it fails, a close_range of the memfd and a munmap of the
+// memory, after which the thread returns the exec's error.
+type execution struct {
+	step int
+	// file is the virtual program to copy into a memfd, or nil to run one
+	// from the host, and prog its path.
+	file vfs.File
+	prog string
+	// path is the host program to run, or "" for the one the thread named
+	// through dirfd, pathAddr and flags.
+	path     string
+	dirfd    int
+	pathAddr uintptr
+	flags    int
+	// argv and env replace those at argvAddr and envAddr unless nil.
+	argv, env         []string
+	argvAddr, envAddr uintptr
+	// area is the memory the strings are written to, of size bytes, and
+	// name the address of the memfd's name in it, which is also the empty
+	// path given with the memfd.
+	area, name uintptr
+	size       int
+	memfd      int
+	// ret is the exec's error, to be returned once cleaned up after.
+	ret int64
+}
+
+const (
+	execAlloc = iota
+	execCreate
+	execRun
+	execClose
+	execUnmap
+)
+
+// execName is the name of the memfds virtual programs run from.
+const execName = "cfc-exec"
+
+// sysExecveat applies the exec functions, the remapping rules and mounts to
+// an exec. It only fails the exec itself if it cannot be rewritten or the
+// virtual program cannot be run; otherwise it sets th.exec if the exec is
+// to be rewritten and lets the kernel handle it.
+func (th *thread) sysExecveat(dirfd int, pathAddr, argvAddr, envAddr uintptr, flags int) (int64, bool) {
+	t := th.t
+	if t.execs == nil && len(t.mounts) == 0 && len(t.remaps) == 0 && th.cwd.root == "" {
+		return 0, false
+	}
+	p, err := th.mem.readString(pathAddr)
+	if err != nil {
+		return 0, false
+	}
+	var abs string
+	if p == "" && flags&unix.AT_EMPTY_PATH != 0 {
+		var ok bool
+		if abs, ok = th.fdPath(dirfd); !ok {
+			return 0, false
+		}
+	} else if abs, err = th.resolve(dirfd, p); err != nil {
+		return resolveFailed(err)
+	}
+	x := &execution{dirfd: dirfd, pathAddr: pathAddr, flags: flags, argvAddr: argvAddr, envAddr: envAddr}
+	e := &Exec{Pid: th.pid, Path: abs}
+	if t.execs != nil {
+		if e.Argv, err = th.stringArray(argvAddr); err != nil {
+			return 0, false
+		}
+		if e.Env, err = th.stringArray(envAddr); err != nil {
+			return 0, false
+		}
+		argv, env := slices.Clone(e.Argv), slices.Clone(e.Env)
+		for _, fn := range t.execs {
+			fn(e)
+		}
+		if !slices.Equal(argv, e.Argv) {
+			x.argv = append([]string{}, e.Argv...)
+		}
+		if !slices.Equal(env, e.Env) {
+			x.env = append([]string{}, e.Env...)
+		}
+	}
+	prog := e.Path
+	if th.cwd.root != "" {
+		if errno := th.rootExec(x, prog); errno != 0 {
+			return -int64(errno), true
+		}
+		// The program is set up to run, and there is nothing to look for.
+		prog = ""
+	}
+	for depth := 0; path.IsAbs(prog); depth++ {
+		prog = path.Clean(prog)
+		m, name, ok := t.lookup(prog)
+		if ok && m != &t.host {
+			if depth == 0 && flags&unix.AT_SYMLINK_NOFOLLOW != 0 {
+				if fi, err := m.backend.Lstat(name); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+					return -int64(unix.ELOOP), true
+				}
+			} else if _, m, name, err = th.follow(prog); err != nil {
+				return errnoRet(err), true
+			}
+		}
+		if !ok {
+			if prog != abs {
+				x.path = prog
+			}
+			break
+		}
+		if m == &t.host {
+			x.path = path.Join("/", name)
+			break
+		}
+		f, interp, arg, errno := openProgram(m, name)
+		if errno != 0 {
+			return -int64(errno), true
+		}
+		if f != nil {
+			t.log.Printf("exec: %s (virtual)", prog)
+			x.file, x.prog = f, prog
+			break
+		}
+		if depth == maxInterp {
+			return -int64(unix.ELOOP), true
+		}
+		if x.argv == nil {
+			if x.argv, err = th.stringArray(argvAddr); err != nil {
+				return -int64(unix.EFAULT), true
+			}
+		}
+		argv := []string{interp}
+		if arg != "" {
+			argv = append(argv, arg)
+		}
+		argv = append(argv, prog)
+		if len(x.argv) > 1 {
+			argv = append(argv, x.argv[1:]...)
+		}
+		x.argv, prog = argv, interp
+	}
+	if x.file == nil && x.path == "" && x.argv == nil && x.env == nil {
+		return 0, false
+	}
+	if t.engine == EngineUnotify || syscallNo(&th.regs)&x32Bit != 0 {
+		t.log.Printf("exec: %s cannot be rewritten", abs)
+		if x.file != nil {
+			_ = x.file.Close()
+		}
+		return -int64(unix.ENOSYS), true
+	}
+	th.exec = x
+	return 0, false
+}
+
+// openProgram opens the program at name in m to be run. A script is not
+// opened: the interpreter its #! line names, and the argument to give it,
+// are returned instead.
+func openProgram(m *mount, name string) (vfs.File, string, string, unix.Errno) {
+	f, err := m.backend.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, "", "", errnoFor(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, "", "", errnoFor(err)
+	}
+	mode := fi.Mode()
+	if m.perm != nil {
+		mode = mode&^fs.ModePerm | m.perm.file
+	}
+	if !mode.IsRegular() || mode&0o111 == 0 {
+		_ = f.Close()
+		return nil, "", "", unix.EACCES
+	}
+	// The kernel reads as much of a #! line as BINPRM_BUF_SIZE.
+	head := make([]byte, 256)
+	n, _ := f.ReadAt(head, 0)
+	line, ok := bytes.CutPrefix(head[:n], []byte("#!"))
+	if !ok {
+		return f, "", "", 0
+	}
+	_ = f.Close()
+	line, _, _ = bytes.Cut(line, []byte("\n"))
+	line = bytes.Trim(line, " \t")
+	i := bytes.IndexAny(line, " \t")
+	if i < 0 {
+		i = len(line)
+	}
+	if i == 0 {
+		return nil, "", "", unix.ENOEXEC
+	}
+	return nil, string(line[:i]), string(bytes.Trim(line[i:], " \t")), 0
+}
+
+// stringArray reads the NULL-terminated array of strings at addr, as argv
+// and envp are passed to exec, in the layout of the thread's current
+// syscall ABI. A null array has no strings.
+func (th *thread) stringArray(addr uintptr) ([]string, error) {
+	if addr == 0 {
+		return nil, nil
+	}
+	size := th.ptrSize()
+	var ss []string
+	for range maxArgStrings {
+		b, err := th.mem.readBytes(addr, size)
+		if err != nil {
+			return nil, err
+		}
+		var p uintptr
+		if size == 4 {
+			p = uintptr(binary.LittleEndian.Uint32(b))
+		} else {
+			p = uintptr(binary.LittleEndian.Uint64(b))
+		}
+		if p == 0 {
+			return ss, nil
+		}
+		s, err := th.argString(p)
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, s)
+		addr += uintptr(size)
+	}
+	return nil, unix.E2BIG
+}
+
+// argString reads the NUL-terminated string at addr, which unlike a path
+// may be as long as maxArgLength.
+func (th *thread) argString(addr uintptr) (string, error) {
+	var buf []byte
+	for len(buf) < maxArgLength {
+		chunk, err := th.mem.readBytes(addr, int(pageSize-addr%pageSize))
+		if err != nil {
+			return "", err
+		}
+		if i := bytes.IndexByte(chunk, 0); i >= 0 {
+			return string(append(buf, chunk[:i]...)), nil
+		}
+		buf = append(buf, chunk...)
+		addr += uintptr(len(chunk))
+	}
+	return "", unix.E2BIG
+}
+
+// ptrSize is the size of a pointer in the thread's current syscall ABI.
+func (th *thread) ptrSize() int {
+	if th.arch == compatArch {
+		return 4
+	}
+	return 8
+}
+
+// layout lays out the strings of x for memory at base: the memfd's name,
+// then the new path, argv and env. It sets x.name and returns the bytes
+// and the addresses of the path, argv and env to exec with.
+func (x *execution) layout(base uintptr, ptrSize int) (b []byte, pathAddr, argv, env uintptr) {
+	str := func(s string) uintptr {
+		addr := base + uintptr(len(b))
+		b = append(append(b, s...), 0)
+		return addr
+	}
+	array := func(ss []string) uintptr {
+		addrs := make([]uintptr, len(ss))
+		for i, s := range ss {
+			addrs[i] = str(s)
+		}
+		for len(b)%8 != 0 {
+			b = append(b, 0)
+		}
+		addr := base + uintptr(len(b))
+		for _, a := range append(addrs, 0) {
+			if ptrSize == 4 {
+				b = binary.LittleEndian.AppendUint32(b, uint32(a))
+			} else {
+				b = binary.LittleEndian.AppendUint64(b, uint64(a))
+			}
+		}
+		return addr
+	}
+	x.name = str(execName)
+	pathAddr, argv, env = x.pathAddr, x.argvAddr, x.envAddr
+	if x.path != "" {
+		pathAddr = str(x.path)
+	}
+	if x.argv != nil {
+		argv = array(x.argv)
+	}
+	if x.env != nil {
+		env = array(x.env)
+	}
+	return b, pathAddr, argv, env
+}
+
+// startExec replaces the exec the thread is entering with the mmap of the
+// memory its strings go in.
+func (th *thread) startExec() error {
+	x := th.exec
+	b, _, _, _ := x.layout(0, th.ptrSize())
+	x.size = (len(b) + int(pageSize) - 1) &^ (int(pageSize) - 1)
+	regs := th.regs
+	return rewriteSyscall(th.tid, &regs, th.arch, unix.SYS_MMAP, 0, uint64(x.size),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS, ^uint64(0), 0)
+}
+
+// execExit runs at the exit stop of each step of an execution and starts
+// the next one.
+func (th *thread) execExit() {
+	x := th.exec
+	var regs unix.PtraceRegs
+	if err := getRegs(th.tid, &regs); err != nil {
+		th.t.log.Printf("getregs: %v", err)
+		th.dropExec()
+		return
+	}
+	ret := int64(returnValue(&regs))
+	regs = th.regs
+	var err error
+	switch x.step {
+	case execAlloc:
+		if ret < 0 && ret > -4096 {
+			th.finishExec(ret)
+			return
+		}
+		x.area = uintptr(ret)
+		b, pathAddr, argv, env := x.layout(x.area, th.ptrSize())
+		x.argvAddr, x.envAddr = argv, env
+		if err := th.mem.writeBytes(x.area, b); err != nil {
+			x.ret, x.step = -int64(unix.EFAULT), execUnmap
+			err = th.restart(&regs, unix.SYS_MUNMAP, uint64(x.area), uint64(x.size))
+			break
+		}
+		if x.file != nil {
+			x.step = execCreate
+			err = th.restart(&regs, unix.SYS_MEMFD_CREATE, uint64(x.name), unix.MFD_CLOEXEC)
+			break
+		}
+		x.step = execRun
+		err = th.restart(&regs, unix.SYS_EXECVEAT, uint64(x.dirfd), uint64(pathAddr), uint64(argv), uint64(env), uint64(x.flags))
+	case execCreate:
+		if ret < 0 {
+			x.ret, x.step = ret, execUnmap
+			err = th.restart(&regs, unix.SYS_MUNMAP, uint64(x.area), uint64(x.size))
+			break
+		}
+		x.memfd = int(ret)
+		if ferr := th.fillMemfd(x.memfd, x.file, x.prog); ferr != nil {
+			th.t.log.Printf("exec: %v", ferr)
+			x.ret, x.step = errnoRet(ferr), execClose
+			err = th.restart(&regs, unix.SYS_CLOSE_RANGE, uint64(x.memfd), uint64(x.memfd), 0)
+			break
+		}
+		// The memfd's name ends in a NUL, which serves as the empty path.
+		x.step = execRun
+		err = th.restart(&regs, unix.SYS_EXECVEAT, uint64(x.memfd), uint64(x.name)+uint64(len(execName)),
+			uint64(x.argvAddr), uint64(x.envAddr), unix.AT_EMPTY_PATH)
+	case execRun:
+		if ret == 0 {
+			// The thread runs the new program, whose registers must be
+			// left alone.
+			th.dropExec()
+			if th.hooked != nil {
+				th.hookExit(0)
+			}
+			return
+		}
+		x.ret = ret
+		if x.file != nil {
+			x.step = execClose
+			err = th.restart(&regs, unix.SYS_CLOSE_RANGE, uint64(x.memfd), uint64(x.memfd), 0)
+			break
+		}
+		x.step = execUnmap
+		err = th.restart(&regs, unix.SYS_MUNMAP, uint64(x.area), uint64(x.size))
+	case execClose:
+		x.step = execUnmap
+		err = th.restart(&regs, unix.SYS_MUNMAP, uint64(x.area), uint64(x.size))
+	case execUnmap:
+		th.finishExec(x.ret)
+		return
+	}
+	if err != nil {
+		th.t.log.Printf("setregs: %v", err)
+		th.dropExec()
+	}
+}
+
+// finishExec ends a failed execution, putting the thread's registers back
+// as they were at the exec, which returns ret.
+func (th *thread) finishExec(ret int64) {
+	th.dropExec()
+	if th.hooked != nil {
+		ret, _ = th.hookExit(ret)
+	}
+	regs := th.regs
+	setReturn(&regs, uint64(ret))
+	if err := setRegs(th.tid, &regs); err != nil {
+		th.t.log.Printf("setregs: %v", err)
+	}
+}
+
+// dropExec forgets the thread's execution, if it has one.
+func (th *thread) dropExec() {
+	if th.exec != nil && th.exec.file != nil {
+		_ = th.exec.file.Close()
+	}
+	th.exec = nil
+}
@@ -0,0 +1,87 @@
+package tracer
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ExitState is how the command, or the process given to Attach, ended.
+type ExitState struct {
+	Pid int
+	// Code is the exit status the process exited with, if Signal is zero.
+	Code int
+	// Signal is the signal that killed the process, and CoreDumped
+	// whether it dumped core.
+	Signal     syscall.Signal
+	CoreDumped bool
+}
+
+// exitState decodes the wait status ws of process pid.
+func exitState(pid int, ws unix.WaitStatus) *ExitState {
+	if ws.Signaled() {
+		return &ExitState{Pid: pid, Signal: syscall.Signal(ws.Signal()), CoreDumped: ws.CoreDump()}
+	}
+	return &ExitState{Pid: pid, Code: ws.ExitStatus()}
+}
+
+// exiting handles the stop of a thread about to exit, whose event message
+// is its wait status. For the leader that is how the command ended, unless
+// reaping it tells otherwise, as it does if the leader exits before the
+// threads it leaves behind. It reports whether the leader is to be held
+// there, for WithSubreaper.
+func (t *Tracer) exiting(th *thread) bool {
+	if th.tid == th.pid && th.pid != t.leader {
+		t.reaper.watch(th.pid)
+	}
+	msg, err := unix.PtraceGetEventMsg(th.tid)
+	if err != nil || th.tid != t.leader {
+		return false
+	}
+	t.exit = exitState(th.pid, unix.WaitStatus(msg))
+	return t.holdExit(th)
+}
+
+// ExitCode returns the status a shell reports for the process in $?: its
+// exit status, or 128 plus the number of the signal that killed it.
+func (s *ExitState) ExitCode() int {
+	if s.Signal != 0 {
+		return 128 + int(s.Signal)
+	}
+	return s.Code
+}
+
+func (s *ExitState) String() string {
+	switch {
+	case s.Signal == 0:
+		return fmt.Sprintf("exit status %d", s.Code)
+	case s.CoreDumped:
+		return fmt.Sprintf("signal: %v (core dumped)", s.Signal)
+	}
+	return fmt.Sprintf("signal: %v", s.Signal)
+}
+
+// Exit ends the calling program the way the process ended, so that a
+// supervisor's own parent sees the same status a bare run would give it.
+// A signal is raised again with its default action, and if that does not
+// end the program, it exits with ExitCode.
+func (s *ExitState) Exit() {
+	if s.Signal != 0 {
+		// The Go runtime keeps handlers of its own for most signals,
+		// which os/signal cannot take away.
+		var act [4]uint64 // struct sigaction, with SIG_DFL as the handler
+		_, _, _ = unix.RawSyscall6(unix.SYS_RT_SIGACTION, uintptr(s.Signal), uintptr(unsafe.Pointer(&act)), 0, 8, 0, 0)
+		var set unix.Sigset_t
+		set.Val[0] = 1 << (uint(s.Signal) - 1)
+		_ = unix.PthreadSigmask(unix.SIG_UNBLOCK, &set, nil)
+		_ = unix.Tgkill(os.Getpid(), unix.Gettid(), s.Signal)
+		// A signal whose default is to stop, or to do nothing, leaves
+		// the program running.
+		time.Sleep(100 * time.Millisecond)
+	}
+	os.Exit(s.ExitCode())
+}
@@ -0,0 +1,280 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// WithFakeRoot has the command believe it runs as root, as fakeroot does,
+// so that package-build tools that expect root can run as a normal user.
+// The user and group IDs it asks for are 0, and setuid, setgroups and the
+// rest succeed without changing them. capget reports every capability,
+// and capset succeeds without changing any.
+//
+// chown and mknod of a character or block device succeed too. On a
+// virtual file, the owner and the device are recorded in an extended
+// attribute, user.cfc-ptrace.fakeroot, which stat then reports, so that a
+// later tar or dpkg-deb packs them; the device itself is an empty regular
+// file. Backends that keep no extended attributes fail as before, with
+// EPERM. On a host file, what the kernel allows the tracer's own user is
+// done, and the rest reported done without being recorded: stat goes on
+// showing the real owner, and a device is made a regular file. Mount the
+// directory a build installs into to keep what it records. chmod needs
+// nothing of the mode: the command owns what it creates, and can set the
+// setuid bits of those files as it is.
+func WithFakeRoot() Option {
+	return func(t *Tracer) { t.fakeRoot = true }
+}
+
+// fakeRootSyscalls returns the syscalls WithFakeRoot needs trapped.
+func (t *Tracer) fakeRootSyscalls() []uint64 {
+	if !t.fakeRoot {
+		return nil
+	}
+	nrs := []uint64{
+		unix.SYS_CAPGET, unix.SYS_CAPSET,
+		unix.SYS_GETUID, unix.SYS_GETEUID, unix.SYS_GETGID, unix.SYS_GETEGID,
+		unix.SYS_GETRESUID, unix.SYS_GETRESGID,
+		unix.SYS_SETUID, unix.SYS_SETGID, unix.SYS_SETREUID, unix.SYS_SETREGID,
+		unix.SYS_SETRESUID, unix.SYS_SETRESGID, unix.SYS_SETFSUID, unix.SYS_SETFSGID,
+		unix.SYS_SETGROUPS,
+	}
+	return append(nrs, writeSyscalls...)
+}
+
+// fakeRootXattr is the extended attribute fake-root mode records the owner
+// and device of a virtual file in, as "UID:GID:TYPE:RDEV" with TYPE the
+// octal S_IFMT bits of a device, or 0.
+const fakeRootXattr = "user.cfc-ptrace.fakeroot"
+
+// fakeRootCall emulates the ID and capability syscalls for fake-root mode,
+// and reports false for any other.
+func (th *thread) fakeRootCall(c sysCall) (int64, bool) {
+	if !th.t.fakeRoot {
+		return 0, false
+	}
+	arg := func(i int) uint64 { return c.args[i] }
+	switch c.nr {
+	case unix.SYS_GETUID, unix.SYS_GETEUID, unix.SYS_GETGID, unix.SYS_GETEGID,
+		unix.SYS_SETUID, unix.SYS_SETGID, unix.SYS_SETREUID, unix.SYS_SETREGID,
+		unix.SYS_SETRESUID, unix.SYS_SETRESGID, unix.SYS_SETFSUID, unix.SYS_SETFSGID,
+		unix.SYS_SETGROUPS:
+		// setfsuid and setfsgid return the ID before, which was root.
+		return 0, true
+	case unix.SYS_GETRESUID, unix.SYS_GETRESGID:
+		for i := range 3 {
+			if err := th.mem.writeBytes(uintptr(arg(i)), make([]byte, 4)); err != nil {
+				return -int64(unix.EFAULT), true
+			}
+		}
+		return 0, true
+	case unix.SYS_CAPGET:
+		return th.sysCapget(uintptr(arg(0)), uintptr(arg(1))), true
+	case unix.SYS_CAPSET:
+		return th.sysCapset(uintptr(arg(0)), uintptr(arg(1))), true
+	}
+	return 0, false
+}
+
+// capWords returns the number of struct __user_cap_data_struct a
+// capability header of the given version takes, or 0 for a version the
+// kernel does not know.
+func capWords(version uint32) int {
+	switch version {
+	case unix.LINUX_CAPABILITY_VERSION_1:
+		return 1
+	case unix.LINUX_CAPABILITY_VERSION_2, unix.LINUX_CAPABILITY_VERSION_3:
+		return 2
+	}
+	return 0
+}
+
+// capHeader reads the version of the capability header at hdr, and the
+// number of data structs it takes. An unknown version is answered with the
+// one the kernel prefers, written back to the header, and EINVAL.
+func (th *thread) capHeader(hdr uintptr) (int, int64) {
+	b, err := th.mem.readBytes(hdr, 8)
+	if err != nil {
+		return 0, -int64(unix.EFAULT)
+	}
+	n := capWords(binary.LittleEndian.Uint32(b))
+	if n == 0 {
+		v := binary.LittleEndian.AppendUint32(nil, unix.LINUX_CAPABILITY_VERSION_3)
+		if err := th.mem.writeBytes(hdr, v); err != nil {
+			return 0, -int64(unix.EFAULT)
+		}
+		return 0, -int64(unix.EINVAL)
+	}
+	return n, 0
+}
+
+// sysCapget reports every capability effective, permitted and
+// inheritable, and returns 0 or a negated errno.
+func (th *thread) sysCapget(hdr, data uintptr) int64 {
+	n, ret := th.capHeader(hdr)
+	if data == 0 && ret == -int64(unix.EINVAL) {
+		// Asking with no data is how the preferred version is found.
+		return 0
+	}
+	if ret < 0 || data == 0 {
+		return ret
+	}
+	all := uint64(1)<<(unix.CAP_LAST_CAP+1) - 1
+	var b []byte
+	for i := range n {
+		word := uint32(all >> (32 * i))
+		for range 3 {
+			b = binary.LittleEndian.AppendUint32(b, word)
+		}
+	}
+	if err := th.mem.writeBytes(data, b); err != nil {
+		return -int64(unix.EFAULT)
+	}
+	return 0
+}
+
+// sysCapset checks the header and data as the kernel would, and changes
+// nothing.
+func (th *thread) sysCapset(hdr, data uintptr) int64 {
+	n, ret := th.capHeader(hdr)
+	if ret < 0 {
+		return ret
+	}
+	if _, err := th.mem.readBytes(data, n*12); err != nil {
+		return -int64(unix.EFAULT)
+	}
+	return 0
+}
+
+// fakeChown records uid and gid, where they are not -1, as the owner of
+// name in m, which st describes.
+func fakeChown(m *mount, name string, st unix.Stat_t, uid, gid uint32) int64 {
+	if uid != ^uint32(0) {
+		st.Uid = uid
+	}
+	if gid != ^uint32(0) {
+		st.Gid = gid
+	}
+	typ := st.Mode & unix.S_IFMT
+	if typ != unix.S_IFCHR && typ != unix.S_IFBLK {
+		typ, st.Rdev = 0, 0
+	}
+	v := fmt.Sprintf("%d:%d:%o:%d", st.Uid, st.Gid, typ, st.Rdev)
+	if err := vfs.Setxattr(m.backend, name, fakeRootXattr, []byte(v), 0); err != nil {
+		if errnoFor(err) == unix.ENOTSUP {
+			return -int64(unix.EPERM)
+		}
+		return errnoRet(err)
+	}
+	return 0
+}
+
+// fakeStat applies to st, which describes name in m, the owner and device
+// fake-root mode recorded for it.
+func (t *Tracer) fakeStat(m *mount, name string, st *unix.Stat_t) {
+	if !t.fakeRoot {
+		return
+	}
+	v, err := vfs.Getxattr(m.backend, name, fakeRootXattr)
+	if err != nil {
+		return
+	}
+	var uid, gid, typ uint32
+	var rdev uint64
+	if _, err := fmt.Sscanf(string(v), "%d:%d:%o:%d", &uid, &gid, &typ, &rdev); err != nil {
+		return
+	}
+	st.Uid, st.Gid = uid, gid
+	if typ != 0 {
+		st.Mode = st.Mode&^unix.S_IFMT | typ
+		st.Rdev = rdev
+	}
+}
+
+// fakeHostChown attempts the chown of a host file itself, as the
+// tracer's user, and reports it done if the kernel refuses it.
+func (th *thread) fakeHostChown(dirfd int, pathAddr uintptr, uid, gid uint32, flags int) (int64, bool) {
+	var p string
+	if pathAddr != 0 {
+		var err error
+		if p, err = th.mem.readString(pathAddr); err != nil {
+			return 0, false
+		}
+	}
+	if p == "" {
+		if pathAddr != 0 && flags&unix.AT_EMPTY_PATH == 0 {
+			return 0, false
+		}
+		p = fmt.Sprintf("/proc/%d/fd/%d", th.tid, dirfd)
+		if dirfd == unix.AT_FDCWD {
+			p = fmt.Sprintf("/proc/%d/cwd", th.tid)
+		}
+		// The link leads to the file open as dirfd.
+		flags &^= unix.AT_SYMLINK_NOFOLLOW | unix.AT_EMPTY_PATH
+	} else {
+		abs, err := th.resolve(dirfd, p)
+		if err != nil {
+			return resolveFailed(err)
+		}
+		p = abs
+	}
+	th.t.log.Printf("fchownat: %s (fake root)", p)
+	err := unix.Fchownat(unix.AT_FDCWD, p, int(int32(uid)), int(int32(gid)), flags&unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil && err != unix.EPERM {
+		return errnoRet(err), true
+	}
+	return 0, true
+}
+
+// sysMknodat emulates mknod of a device for fake-root mode, and leaves
+// any other file to the kernel. On a virtual path the device is an empty
+// file with the device recorded; on a host path, a plain empty file made
+// by the tracer.
+func (th *thread) sysMknodat(dirfd int, pathAddr uintptr, mode uint32, dev uint64) (int64, bool) {
+	typ := mode & unix.S_IFMT
+	if !th.t.fakeRoot || typ != unix.S_IFCHR && typ != unix.S_IFBLK {
+		return 0, false
+	}
+	perm := mode & 0o7777 &^ th.umask()
+	abs, m, name, ret, ok := th.virtualPath(dirfd, pathAddr)
+	if ret < 0 {
+		return ret, true
+	}
+	if abs == "" {
+		return 0, false
+	}
+	th.t.log.Printf("mknodat: %s (fake root)", abs)
+	if !ok {
+		// The tracer's own umask is not the command's.
+		err := unix.Mknod(abs, unix.S_IFREG|perm, 0)
+		if err == nil {
+			err = unix.Chmod(abs, perm)
+		}
+		if err != nil {
+			return errnoRet(err), true
+		}
+		return 0, true
+	}
+	f, err := m.backend.Open(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fs.FileMode(perm&0o777))
+	if err != nil {
+		return errnoRet(err), true
+	}
+	_ = f.Close()
+	fi, err := m.backend.Lstat(name)
+	if err != nil {
+		return errnoRet(err), true
+	}
+	st := m.stat(abs, fi)
+	st.Mode, st.Rdev = st.Mode&^unix.S_IFMT|typ, dev
+	if ret := fakeChown(m, name, st, ^uint32(0), ^uint32(0)); ret < 0 {
+		_ = m.backend.Unlink(name)
+		return ret, true
+	}
+	return 0, true
+}
@@ -0,0 +1,132 @@
+package tracer
+
+import (
+	"path"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Fault makes a syscall fail, as part of the faults given to WithFaults,
+// for testing how the command copes with errors.
+type Fault struct {
+	// Syscall is the native number of the syscall to fail, such as
+	// unix.SYS_WRITE. Legacy syscalls count as their *at forms, such as
+	// open as openat.
+	Syscall uint64
+	// Path, if set, limits the fault to syscalls on files whose absolute
+	// path matches this path.Match pattern, or whose base name does if
+	// the pattern has no slash, as "*.log" does. A syscall on a
+	// descriptor is on the file it was opened as; one with a path
+	// argument is on the file the path names, before symlinks are
+	// resolved, or the first such file for rename and link.
+	Path string
+	// Errno is the error the syscall fails with. The default is EIO.
+	Errno syscall.Errno
+	// Every, if more than one, fails only every Every-th matching
+	// syscall, starting with the Every-th.
+	Every int
+	// Limit, if set, stops the fault once it has failed that many
+	// syscalls.
+	Limit int
+}
+
+// WithFaults fails the syscalls the faults match, adding to any faults
+// given before. Faults apply after policy rules and read-only mode, to
+// syscalls those let through, and the first fault that fails a syscall
+// decides its error. Every and Limit count the matching syscalls of the
+// command and all its descendants together.
+func WithFaults(faults ...Fault) Option {
+	return func(t *Tracer) {
+		for _, f := range faults {
+			t.faults = append(t.faults, &fault{Fault: f})
+		}
+	}
+}
+
+// fault is a Fault and its counts so far.
+type fault struct {
+	Fault
+	// seen counts the syscalls the fault matched, and failed those it
+	// failed.
+	seen, failed int
+}
+
+// faultSyscalls returns the syscalls the faults need trapped.
+func (t *Tracer) faultSyscalls() []uint64 {
+	if len(t.faults) == 0 {
+		return nil
+	}
+	nrs := legacyWriteSyscalls[:len(legacyWriteSyscalls):len(legacyWriteSyscalls)]
+	for _, f := range t.faults {
+		nrs = append(nrs, f.Syscall)
+	}
+	return nrs
+}
+
+// injectFault applies the faults to the canonical syscall c. It reports
+// whether c must fail and, if so, the value it fails with.
+func (th *thread) injectFault(c sysCall) (int64, bool) {
+	var (
+		p              string
+		pathOK, looked bool
+	)
+	for _, f := range th.t.faults {
+		if f.Syscall != c.nr || f.Limit > 0 && f.failed >= f.Limit {
+			continue
+		}
+		if f.Path != "" {
+			if !looked {
+				p, pathOK = th.callPath(c)
+				looked = true
+			}
+			if !pathOK || !matchFile(f.Path, p) {
+				continue
+			}
+		}
+		f.seen++
+		if f.Every > 1 && f.seen%f.Every != 0 {
+			continue
+		}
+		f.failed++
+		errno := f.Errno
+		if errno == 0 {
+			errno = unix.EIO
+		}
+		th.t.log.Printf("syscall %d failed by fault: %v", c.nr, errno)
+		return -int64(errno), true
+	}
+	return 0, false
+}
+
+// matchFile reports whether the absolute path p matches pattern, as the
+// Path of a Fault.
+func matchFile(pattern, p string) bool {
+	if !strings.Contains(pattern, "/") {
+		p = path.Base(p)
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// callPath returns the absolute path of the file the canonical syscall c
+// operates on, if syscallSpecs says which of its arguments names one.
+func (th *thread) callPath(c sysCall) (string, bool) {
+	spec, ok := syscallSpecs[c.nr]
+	switch {
+	case !ok:
+	case spec.path >= 0:
+		dirfd := unix.AT_FDCWD
+		if spec.fd >= 0 {
+			dirfd = int(int32(c.args[spec.fd]))
+		}
+		if c.nr == unix.SYS_UTIMENSAT && c.args[spec.path] == 0 {
+			return th.fdPath(dirfd)
+		}
+		return th.pathArg(dirfd, uintptr(c.args[spec.path]))
+	case spec.fd >= 0:
+		return th.fdPath(int(int32(c.args[spec.fd])))
+	}
+	return "", false
+}
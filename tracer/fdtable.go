@@ -0,0 +1,223 @@
+package tracer
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// fdBase is the first descriptor number handed out for virtual files. The
+// kernel never allocates descriptors at or above fs.nr_open, whose default
+// is 1<<20, so virtual descriptors cannot collide with real ones.
+const fdBase = 1 << 20
+
+// vfile is an open virtual file description. Like its kernel counterpart it
+// can be referenced from several descriptors, through dup or after a fork;
+// the backend file is closed when the last reference goes away.
+type vfile struct {
+	file vfs.File
+	path string
+	// flags holds the file status flags from open, without O_CLOEXEC,
+	// which belongs to the descriptor.
+	flags int
+	refs  int
+	// mount and name locate the file in its backend, for operations that
+	// go by name rather than through the open file.
+	mount *mount
+	name  string
+	// dir is the listing being read, once getdents64 has been called.
+	dir *dirList
+	// closed, if set, is called once the backend file has been closed.
+	closed func()
+	// locks are the advisory locks on the file, once it has been locked.
+	locks *fileLocks
+	// pending is closed once the job a worker has on the file is done.
+	pending chan struct{}
+	// ready is the eventfd backing the file in polls, once it has been
+	// polled.
+	ready *os.File
+	// tmp is set while the file is an unnamed one opened with O_TMPFILE.
+	tmp *tmpfile
+}
+
+// read reads from f at off or, if off is -1, at the file offset.
+func (f *vfile) read(b []byte, off int64) (int, error) {
+	if off == -1 {
+		return f.file.Read(b)
+	}
+	return f.file.ReadAt(b, off)
+}
+
+// write writes to f at off or, if off is -1, at the file offset.
+func (f *vfile) write(b []byte, off int64) (int, error) {
+	if off != -1 {
+		return f.file.WriteAt(b, off)
+	}
+	if f.flags&unix.O_APPEND != 0 {
+		// F_SETFL can turn O_APPEND on after the backend opened the file.
+		if _, err := f.file.Seek(0, io.SeekEnd); err != nil {
+			return 0, err
+		}
+	}
+	return f.file.Write(b)
+}
+
+func (f *vfile) decref() error {
+	if f.refs--; f.refs > 0 {
+		return nil
+	}
+	f.wait()
+	f.unlock()
+	err := f.file.Close()
+	if f.ready != nil {
+		f.ready.Close()
+	}
+	if f.closed != nil {
+		f.closed()
+	}
+	return err
+}
+
+// descriptor is an entry in an fdTable.
+type descriptor struct {
+	file    *vfile
+	cloexec bool
+}
+
+// fdTable maps a process's virtual descriptors to open files. Tasks
+// created with CLONE_FILES share one table.
+//
+// Virtual descriptors normally live at fdBase and above, but dup2 and dup3
+// can put one at any number. Below fdBase the kernel holds a placeholder of
+// its own at the same number, so that it never hands the number out again
+// while the virtual descriptor shadows it.
+type fdTable struct {
+	fds map[int]descriptor
+	// next is a lower bound on the lowest free number from fdBase.
+	next  int
+	users int
+}
+
+func newFDTable() *fdTable {
+	return &fdTable{fds: make(map[int]descriptor), next: fdBase, users: 1}
+}
+
+func (t *fdTable) get(fd int) (*vfile, bool) {
+	d, ok := t.fds[fd]
+	if ok {
+		d.file.wait()
+	}
+	return d.file, ok
+}
+
+// add installs f at the lowest free virtual descriptor that is at least
+// min.
+func (t *fdTable) add(f *vfile, min int, cloexec bool) int {
+	fd := max(min, t.next)
+	for {
+		if _, ok := t.fds[fd]; !ok {
+			break
+		}
+		fd++
+	}
+	if min <= t.next {
+		t.next = fd + 1
+	}
+	t.set(fd, f, cloexec)
+	return fd
+}
+
+// set installs f at fd and returns the file it replaces, if any, which
+// still holds the reference fd had on it.
+func (t *fdTable) set(fd int, f *vfile, cloexec bool) *vfile {
+	old := t.fds[fd].file
+	if old != nil {
+		old.closedBy(t)
+	}
+	f.refs++
+	t.fds[fd] = descriptor{file: f, cloexec: cloexec}
+	return old
+}
+
+func (t *fdTable) remove(fd int) (*vfile, bool) {
+	d, ok := t.fds[fd]
+	if ok {
+		d.file.closedBy(t)
+		delete(t.fds, fd)
+		if fd >= fdBase && fd < t.next {
+			t.next = fd
+		}
+	}
+	return d.file, ok
+}
+
+// move moves the descriptor at fd to the free number to.
+func (t *fdTable) move(fd, to int) {
+	d, ok := t.fds[fd]
+	if !ok {
+		return
+	}
+	delete(t.fds, fd)
+	if fd >= fdBase && fd < t.next {
+		t.next = fd
+	}
+	t.fds[to] = d
+}
+
+func (t *fdTable) cloexec(fd int) bool { return t.fds[fd].cloexec }
+
+func (t *fdTable) setCloexec(fd int, cloexec bool) {
+	if d, ok := t.fds[fd]; ok {
+		d.cloexec = cloexec
+		t.fds[fd] = d
+	}
+}
+
+// share returns t for use by one more task.
+func (t *fdTable) share() *fdTable {
+	t.users++
+	return t
+}
+
+// clone returns a copy of t referring to the same open files, as fork does.
+func (t *fdTable) clone() *fdTable {
+	c := &fdTable{fds: make(map[int]descriptor, len(t.fds)), next: t.next, users: 1}
+	for fd, d := range t.fds {
+		d.file.refs++
+		c.fds[fd] = d
+	}
+	return c
+}
+
+// exec returns the table of a task that has just exec'd in place of t. As
+// in the kernel, the task stops sharing the table and loses its
+// close-on-exec descriptors.
+func (t *fdTable) exec() *fdTable {
+	c := t
+	if t.users > 1 {
+		c = t.clone()
+		t.release()
+	}
+	for fd, d := range c.fds {
+		if d.cloexec {
+			c.remove(fd)
+			_ = d.file.decref()
+		}
+	}
+	return c
+}
+
+// release drops a task's use of t, closing its files once no task uses it.
+func (t *fdTable) release() {
+	if t.users--; t.users > 0 {
+		return
+	}
+	for fd, d := range t.fds {
+		d.file.closedBy(t)
+		_ = d.file.decref()
+		delete(t.fds, fd)
+	}
+}
@@ -0,0 +1,31 @@
+package tracer
+
+import (
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// syncSyscalls returns the syscalls syncing virtual files and leases
+// needs trapped, which are none without mounts.
+func (t *Tracer) syncSyscalls() []uint64 {
+	if len(t.mounts) == 0 {
+		return nil
+	}
+	return []uint64{unix.SYS_FSYNC, unix.SYS_FDATASYNC}
+}
+
+// sysFsync also handles fdatasync, since backends keep no metadata apart
+// to leave unsynced. A virtual file is synced with vfs.Sync, which does
+// nothing for files of backends that write through.
+func (th *thread) sysFsync(fd int) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return th.fsyncLease(fd)
+	}
+	th.t.log.Printf("fsync: fd=%d (virtual)", fd)
+	if err := vfs.Sync(f.file); err != nil {
+		return errnoRet(err), true
+	}
+	return 0, true
+}
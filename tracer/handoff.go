@@ -0,0 +1,183 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"slices"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxRights is the most descriptors the kernel takes in one SCM_RIGHTS
+// message.
+const maxRights = 253
+
+// maxState bounds the encoded State ReceiveState takes, so that a peer
+// cannot have it allocate whatever length it sends.
+const maxState = 256 << 20
+
+// Handoff detaches as Detach does and sends the State to the program at the
+// other end of conn, which ReceiveState reads it with and Reattach takes the
+// tracees over with: a new version of the supervisor, say, exec'd to
+// replace this one under processes that run for longer than it should.
+// Along with the State go the descriptors of the host files backing the
+// virtual ones, as a vfs.Dir's do, so that the new supervisor serves the
+// very files they had open, even ones since renamed or removed; the others
+// are opened again by path. Handoff returns once everything is sent, and
+// Run returns nil as it does after Detach.
+//
+// The new supervisor must mount the same backends, as for Reattach, and a
+// backend that lives in memory, such as a memfs, ends with this program.
+// If sending fails the tracees are left running untraced, without their
+// virtual descriptors.
+func (t *Tracer) Handoff(conn *net.UnixConn) error {
+	if !t.detachable {
+		return errors.New("tracer: cannot detach from a seccomp filter")
+	}
+	// Detach reads this once detachCtx is done.
+	t.saved.keepHosts = true
+	s, err := t.Detach()
+	if err != nil {
+		return err
+	}
+	defer s.closeHosts()
+	if err := s.send(conn); err != nil {
+		return fmt.Errorf("tracer: handoff: %w", err)
+	}
+	return nil
+}
+
+// ReceiveState reads the State a Tracer's Handoff sends over conn, with the
+// host files it sends along, for Reattach.
+func ReceiveState(conn *net.UnixConn) (*State, error) {
+	s, err := receiveState(conn)
+	if err != nil {
+		return nil, fmt.Errorf("tracer: receive state: %w", err)
+	}
+	return s, nil
+}
+
+// send writes s to conn as its length, in eight little-endian bytes, and
+// its JSON, followed by its host files in messages of one byte each.
+func (s *State) send(conn *net.UnixConn) error {
+	b, err := json.Marshal(s)
+	if err == nil && len(b) > maxState {
+		err = fmt.Errorf("state of %d bytes exceeds %d", len(b), maxState)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(append(binary.LittleEndian.AppendUint64(nil, uint64(len(b))), b...)); err != nil {
+		return err
+	}
+	fds := make([]int, 0, len(s.hosts))
+	for _, i := range slices.Sorted(maps.Keys(s.hosts)) {
+		fds = append(fds, int(s.hosts[i].Fd()))
+	}
+	for len(fds) > 0 {
+		n := min(len(fds), maxRights)
+		if _, _, err := conn.WriteMsgUnix([]byte{0}, unix.UnixRights(fds[:n]...), nil); err != nil {
+			return err
+		}
+		fds = fds[n:]
+	}
+	return nil
+}
+
+func receiveState(conn *net.UnixConn) (*State, error) {
+	var n [8]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint64(n[:])
+	if size > maxState {
+		return nil, fmt.Errorf("state of %d bytes exceeds %d", size, maxState)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	s := new(State)
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	var want []int
+	for i, f := range s.Files {
+		if f.HostFile {
+			want = append(want, i)
+		}
+	}
+	s.hosts = make(map[int]*os.File, len(want))
+	oob := make([]byte, unix.CmsgSpace(maxRights*4))
+	for len(s.hosts) < len(want) {
+		var fds []int
+		_, oobn, flags, _, err := conn.ReadMsgUnix(n[:1], oob)
+		if err == nil && flags&unix.MSG_CTRUNC != 0 {
+			err = errors.New("host files truncated")
+		}
+		if err == nil {
+			fds, err = parseRights(oob[:oobn])
+		}
+		for _, fd := range fds {
+			if len(s.hosts) == len(want) {
+				_ = unix.Close(fd)
+				continue
+			}
+			i := want[len(s.hosts)]
+			s.hosts[i] = os.NewFile(uintptr(fd), s.Files[i].Path)
+		}
+		if err == nil && fds == nil {
+			err = errors.New("message without host files")
+		}
+		if err != nil {
+			s.closeHosts()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// parseRights returns the descriptors in the control messages oob.
+func parseRights(oob []byte) ([]int, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := unix.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+// closeHosts closes the host files of s that have not been reopened.
+func (s *State) closeHosts() {
+	for i, f := range s.hosts {
+		_ = f.Close()
+		delete(s.hosts, i)
+	}
+}
+
+// keepHost returns a duplicate of the descriptor of the host file behind
+// f, if there is one.
+func keepHost(f *vfile) *os.File {
+	h, ok := f.file.(*os.File)
+	if !ok {
+		return nil
+	}
+	fd, err := unix.FcntlInt(h.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil
+	}
+	return os.NewFile(uintptr(fd), f.path)
+}
@@ -0,0 +1,1267 @@
+package tracer
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// helperEnv names the helper the test binary should run instead of the
+// tests when it is started as a tracee.
+const helperEnv = "CFC_TRACER_HELPER"
+
+// helpers are tracee programs built into the test binary. Each receives
+// the arguments given to helperCommand.
+var helpers = map[string]func(args []string){
+	// threads reads a file from several locked OS threads at once.
+	"threads": func(args []string) {
+		var wg sync.WaitGroup
+		out := make([]string, 4)
+		for i := range out {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runtime.LockOSThread()
+				b, err := os.ReadFile(args[0])
+				if err != nil {
+					out[i] = err.Error()
+					return
+				}
+				out[i] = string(b)
+			}()
+		}
+		wg.Wait()
+		for _, s := range out {
+			fmt.Println(s)
+		}
+	},
+	// readdir lists a directory, marking subdirectories with a slash.
+	"readdir": func(args []string) {
+		entries, err := os.ReadDir(args[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				fmt.Println(e.Name() + "/")
+			} else {
+				fmt.Println(e.Name())
+			}
+		}
+	},
+	// stat prints the size, mode and owner of each argument, using lstat
+	// for arguments prefixed with "l:".
+	"stat": func(args []string) {
+		for _, a := range args {
+			stat := os.Stat
+			if p, ok := strings.CutPrefix(a, "l:"); ok {
+				a, stat = p, os.Lstat
+			}
+			fi, err := stat(a)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			st := fi.Sys().(*syscall.Stat_t)
+			fmt.Println(fi.Size(), fi.Mode(), st.Uid, st.Gid)
+		}
+	},
+	// positioned patches a file with WriteAt, reads part of it back with
+	// ReadAt, and prints the offsets Seek reports around a read. It then
+	// lists a directory twice, rewinding in between.
+	"positioned": func(args []string) {
+		f, err := os.OpenFile(args[0], os.O_RDWR, 0)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		f.WriteAt([]byte("XY"), 2)
+		b := make([]byte, 4)
+		n, _ := f.ReadAt(b, 1)
+		end, _ := f.Seek(0, io.SeekEnd)
+		f.Seek(-3, io.SeekEnd)
+		f.Read(make([]byte, 2))
+		cur, _ := f.Seek(0, io.SeekCurrent)
+		fmt.Println(string(b[:n]), end, cur)
+
+		d, err := os.Open(args[1])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		first, _ := d.Readdirnames(-1)
+		d.Seek(0, io.SeekStart)
+		second, _ := d.Readdirnames(-1)
+		fmt.Println(len(first), len(second))
+	},
+	// vectored writes a file with writev and pwritev2, then reads it back
+	// with readv and preadv.
+	"vectored": func(args []string) {
+		fd, err := unix.Open(args[0], unix.O_RDWR|unix.O_CREAT|unix.O_TRUNC, 0o644)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		unix.Writev(fd, [][]byte{[]byte("scatter "), {}, []byte("gather")})
+		unix.Pwritev2(fd, [][]byte{[]byte("G")}, 8, 0)
+		unix.Pwritev2(fd, [][]byte{[]byte("!")}, -1, unix.RWF_APPEND)
+		unix.Seek(fd, 0, io.SeekStart)
+		a, b := make([]byte, 3), make([]byte, 20)
+		n, _ := unix.Readv(fd, [][]byte{a, b})
+		fmt.Printf("%d %s|%s\n", n, a, b[:n-len(a)])
+		n, _ = unix.Preadv(fd, [][]byte{a}, 8)
+		fmt.Printf("%s\n", a[:n])
+	},
+	// mmap prints a private mapping of a file, first moving the descriptor
+	// to 10 if the second argument is "low", and reports whether the
+	// number of open descriptors was left as it was.
+	"mmap": func(args []string) {
+		fd, err := unix.Open(args[0], unix.O_RDONLY, 0)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if len(args) > 1 && args[1] == "low" {
+			unix.Dup3(fd, 10, 0)
+			unix.Close(fd)
+			fd = 10
+		}
+		var st unix.Stat_t
+		unix.Fstat(fd, &st)
+		open := func() int {
+			entries, _ := os.ReadDir("/proc/self/fd")
+			return len(entries)
+		}
+		before := open()
+		b, err := unix.Mmap(fd, 0, int(st.Size), unix.PROT_READ, unix.MAP_PRIVATE)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(string(b), open() == before)
+	},
+	// openat2 opens files under the directory args[0] with openat2 and
+	// prints what each holds, or why it could not be opened.
+	"openat2": func(args []string) {
+		root, _ := unix.Open("/", unix.O_RDONLY|unix.O_DIRECTORY, 0)
+		dir := strings.TrimPrefix(args[0], "/")
+		for _, c := range []struct {
+			dirfd int
+			path  string
+			how   unix.OpenHow
+		}{
+			{unix.AT_FDCWD, "/" + dir + "/f", unix.OpenHow{Flags: unix.O_RDONLY | unix.O_CLOEXEC}},
+			{unix.AT_FDCWD, "/" + dir + "/f", unix.OpenHow{Resolve: unix.RESOLVE_NO_XDEV}},
+			{unix.AT_FDCWD, "/" + dir + "/link", unix.OpenHow{Resolve: unix.RESOLVE_NO_SYMLINKS}},
+			{root, dir + "/link", unix.OpenHow{Resolve: unix.RESOLVE_BENEATH}},
+			{root, "/" + dir + "/f", unix.OpenHow{Resolve: unix.RESOLVE_BENEATH}},
+			{root, "../../" + dir + "/f", unix.OpenHow{Resolve: unix.RESOLVE_IN_ROOT}},
+			{unix.AT_FDCWD, "/" + dir + "/f", unix.OpenHow{Mode: 0o644}},
+			{unix.AT_FDCWD, "/" + dir + "/new", unix.OpenHow{Flags: unix.O_RDWR | unix.O_CREAT, Mode: 0o644}},
+		} {
+			fd, err := unix.Openat2(c.dirfd, c.path, &c.how)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			b := make([]byte, 64)
+			n, _ := unix.Read(fd, b)
+			unix.Close(fd)
+			fmt.Printf("%q\n", b[:n])
+		}
+	},
+	// clone3 opens args[0] and starts two children with clone3, neither a
+	// thread, that close the descriptor, one with CLONE_FILES. After
+	// each it prints whether the descriptor is still open.
+	"clone3": func(args []string) {
+		fd, err := unix.Open(args[0], unix.O_RDONLY, 0)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		runtime.LockOSThread()
+		for _, flags := range []uint64{0, unix.CLONE_FILES} {
+			// struct clone_args, up to exit_signal, which is left zero
+			// for the event to be a clone.
+			cloneArgs := [8]uint64{0: flags}
+			// The Go runtime must not handle a signal in the child.
+			var all, old unix.Sigset_t
+			for i := range all.Val {
+				all.Val[i] = ^all.Val[i]
+			}
+			unix.PthreadSigmask(unix.SIG_SETMASK, &all, &old)
+			pid, _, errno := unix.RawSyscall(unix.SYS_CLONE3, uintptr(unsafe.Pointer(&cloneArgs)), unsafe.Sizeof(cloneArgs), 0)
+			if pid == 0 {
+				unix.RawSyscall(unix.SYS_CLOSE, uintptr(fd), 0, 0)
+				unix.RawSyscall(unix.SYS_EXIT_GROUP, 0, 0, 0)
+			}
+			unix.PthreadSigmask(unix.SIG_SETMASK, &old, nil)
+			if errno != 0 {
+				fmt.Println(errno)
+				os.Exit(1)
+			}
+			var ws unix.WaitStatus
+			unix.Wait4(int(pid), &ws, unix.WALL, nil)
+			_, err := unix.Seek(fd, 0, io.SeekStart)
+			fmt.Println(err)
+		}
+	},
+	// iouring sets up an io_uring and prints how that went.
+	"iouring": func(args []string) {
+		var params [120]byte
+		fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, 1, uintptr(unsafe.Pointer(&params)), 0)
+		if errno != 0 {
+			fmt.Println(errno)
+			return
+		}
+		unix.Close(int(fd))
+		fmt.Println("set up")
+	},
+	// uringcreate creates the file args[0] with an openat queued on an
+	// io_uring, which the tracer never sees, and prints how that went.
+	"uringcreate": func(args []string) {
+		const (
+			opOpenat   = 18
+			offCQRing  = 0x8000000
+			offSQEs    = 0x10000000
+			enterWait  = 1
+			sqeSize    = 64
+			cqeSize    = 16
+			paramsSize = 120
+		)
+		var params [paramsSize]byte
+		fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, 1, uintptr(unsafe.Pointer(&params)), 0)
+		if errno != 0 {
+			fmt.Println(errno)
+			return
+		}
+		u32 := func(off int) uint32 { return *(*uint32)(unsafe.Pointer(&params[off])) }
+		// struct io_sqring_offsets starts at 40, io_cqring_offsets at 80.
+		sqTail, sqArray := u32(40+4), u32(40+24)
+		cqHead, cqes := u32(80), u32(80+20)
+		sq, err := unix.Mmap(int(fd), 0, int(sqArray)+4, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		cq, err := unix.Mmap(int(fd), offCQRing, int(cqes)+2*cqeSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		sqes, err := unix.Mmap(int(fd), offSQEs, sqeSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		name, _ := unix.BytePtrFromString(args[0])
+		sqe := sqes[:sqeSize]
+		sqe[0] = opOpenat
+		dirfd := int32(unix.AT_FDCWD)
+		binary.LittleEndian.PutUint32(sqe[4:], uint32(dirfd))
+		binary.LittleEndian.PutUint64(sqe[16:], uint64(uintptr(unsafe.Pointer(name))))
+		binary.LittleEndian.PutUint32(sqe[24:], 0o644)
+		binary.LittleEndian.PutUint32(sqe[28:], unix.O_WRONLY|unix.O_CREAT|unix.O_CLOEXEC)
+		*(*uint32)(unsafe.Pointer(&sq[sqArray])) = 0
+		atomic.AddUint32((*uint32)(unsafe.Pointer(&sq[sqTail])), 1)
+		if _, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, fd, 1, 1, enterWait, 0, 0); errno != 0 {
+			fmt.Println(errno)
+			return
+		}
+		runtime.KeepAlive(name)
+		head := atomic.LoadUint32((*uint32)(unsafe.Pointer(&cq[cqHead])))
+		cqe := cq[int(cqes)+int(head&1)*cqeSize:]
+		if res := int32(binary.LittleEndian.Uint32(cqe[8:])); res < 0 {
+			fmt.Println(unix.Errno(-res))
+			return
+		}
+		fmt.Println("created")
+	},
+	// pinned opens the file "public" in its directory over and over while
+	// another thread keeps switching the name to "secret", and prints how
+	// many opens reached the secret. It then tries to unprotect the
+	// tracer's scratch memory and to open its own memory for writing.
+	"pinned": func(args []string) {
+		public := *(*uint64)(unsafe.Pointer(&[8]byte{'p', 'u', 'b', 'l', 'i', 'c'}))
+		secret := *(*uint64)(unsafe.Pointer(&[8]byte{'s', 'e', 'c', 'r', 'e', 't'}))
+		var name atomic.Uint64
+		name.Store(public)
+		// The switching has to go on while an open is stopped.
+		runtime.GOMAXPROCS(2)
+		stop := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					name.Store(secret)
+					name.Store(public)
+				}
+			}
+		}()
+		var leaks int
+		cwd := unix.AT_FDCWD
+		buf := make([]byte, 16)
+		for range 2000 {
+			fd, _, errno := unix.Syscall(unix.SYS_OPENAT, uintptr(cwd), uintptr(unsafe.Pointer(&name)), unix.O_RDONLY)
+			if errno != 0 {
+				continue
+			}
+			if n, _ := unix.Read(int(fd), buf); string(buf[:n]) == "secret\n" {
+				leaks++
+			}
+			unix.Close(int(fd))
+		}
+		close(stop)
+		fmt.Println(leaks)
+
+		// The tracer leaves the scratch memory out of /proc/self/maps; the
+		// symlink to /proc/self in the working directory is not seen as
+		// naming it.
+		maps, _ := os.ReadFile("self/maps")
+		for _, line := range strings.Split(string(maps), "\n") {
+			// The scratch memory is the only anonymous read-only mapping
+			// of its size.
+			f := strings.Fields(line)
+			var start, end uintptr
+			if len(f) != 5 || f[1] != "r--p" || f[4] != "0" {
+				continue
+			}
+			if _, err := fmt.Sscanf(f[0], "%x-%x", &start, &end); err != nil || end-start != 64<<10 {
+				continue
+			}
+			_, _, errno := unix.Syscall(unix.SYS_MPROTECT, start, end-start, unix.PROT_READ|unix.PROT_WRITE)
+			fmt.Println(errno)
+		}
+		_, err := os.OpenFile("/proc/self/mem", os.O_RDWR, 0)
+		fmt.Println(err)
+	},
+	// locks write-locks the start of the file args[0] with fcntl and takes
+	// a flock lock on it, then starts a copy of itself with "child" added
+	// to the arguments. The child reports how its tries to take the locks
+	// fail, then waits for the record lock, which the parent lets go of by
+	// closing another descriptor for the file.
+	"locks": func(args []string) {
+		fd, err := unix.Open(args[0], unix.O_RDWR, 0)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		lk := func(typ int16, start, len int64) *unix.Flock_t {
+			return &unix.Flock_t{Type: typ, Whence: io.SeekStart, Start: start, Len: len}
+		}
+		if len(args) > 1 {
+			ready := os.NewFile(3, "ready")
+			fmt.Println(unix.FcntlFlock(uintptr(fd), unix.F_SETLK, lk(unix.F_WRLCK, 5, 1)))
+			got := lk(unix.F_RDLCK, 0, 0)
+			unix.FcntlFlock(uintptr(fd), unix.F_GETLK, got)
+			fmt.Println(got.Type == unix.F_WRLCK, got.Start, got.Len, int(got.Pid) == os.Getppid())
+			fmt.Println(unix.FcntlFlock(uintptr(fd), unix.F_SETLK, lk(unix.F_RDLCK, 10, 0)))
+			fmt.Println(unix.Flock(fd, unix.LOCK_EX|unix.LOCK_NB))
+			ready.Close()
+			fmt.Println(unix.FcntlFlock(uintptr(fd), unix.F_SETLKW, lk(unix.F_WRLCK, 0, 10)))
+			return
+		}
+		unix.FcntlFlock(uintptr(fd), unix.F_SETLK, lk(unix.F_WRLCK, 0, 10))
+		unix.Flock(fd, unix.LOCK_SH)
+		r, w, _ := os.Pipe()
+		child := exec.Command(os.Args[0], args[0], "child")
+		child.Stdout, child.Stderr, child.ExtraFiles = os.Stdout, os.Stderr, []*os.File{w}
+		if err := child.Start(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		w.Close()
+		r.Read(make([]byte, 1))
+		time.Sleep(50 * time.Millisecond)
+		fmt.Println("closing")
+		other, _ := unix.Open(args[0], unix.O_RDONLY, 0)
+		unix.Close(other)
+		fmt.Println(child.Wait())
+	},
+	// getpid makes a burst of syscalls the tracer has no interest in.
+	"getpid": func(args []string) {
+		for range 1000 {
+			syscall.Getpid()
+		}
+	},
+	// execThread execs args from a thread other than the leader.
+	"execThread": func(args []string) {
+		// Pin the main goroutine to the leader so the exec below runs
+		// on another thread.
+		runtime.LockOSThread()
+		done := make(chan error)
+		go func() {
+			runtime.LockOSThread()
+			done <- syscall.Exec(args[0], args, os.Environ())
+		}()
+		fmt.Fprintln(os.Stderr, <-done)
+		os.Exit(1)
+	},
+	// supervise runs the shell script args[0] under a Tracer and exits as
+	// it did.
+	"supervise": func(args []string) {
+		t := New(exec.Command("/bin/sh", "-c", args[0]))
+		if err := t.Start(context.Background()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		exit, _ := t.Wait()
+		exit.Exit()
+	},
+	// truncate shrinks the file args[0] by name, then grows it, punches a
+	// hole in it and allocates past its end through a descriptor, printing
+	// the contents after each change and the errors of calls that fail.
+	"truncate": func(args []string) {
+		show := func() {
+			b, err := os.ReadFile(args[0])
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Printf("%q\n", b)
+		}
+		fmt.Println(unix.Truncate(args[0], 4))
+		show()
+		fd, err := unix.Open(args[0], unix.O_RDWR, 0)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(unix.Ftruncate(fd, 8))
+		unix.Pwrite(fd, []byte("7"), 7)
+		show()
+		fmt.Println(unix.Fallocate(fd, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, 1, 2))
+		show()
+		fmt.Println(unix.Fallocate(fd, unix.FALLOC_FL_PUNCH_HOLE, 1, 2))
+		fmt.Println(unix.Fallocate(fd, unix.FALLOC_FL_KEEP_SIZE, 0, 64))
+		fmt.Println(unix.Fallocate(fd, 0, 8, 2))
+		show()
+		ro, _ := unix.Open(args[0], unix.O_RDONLY, 0)
+		fmt.Println(unix.Ftruncate(ro, 0))
+	},
+	// xattr sets, reads, lists and removes extended attributes of the file
+	// args[0] and the symlink args[1], printing what each call returns.
+	"xattr": func(args []string) {
+		fmt.Println(unix.Setxattr(args[0], "user.b", []byte("two"), 0))
+		fmt.Println(unix.Setxattr(args[0], "user.a", []byte("one"), unix.XATTR_CREATE))
+		fmt.Println(unix.Setxattr(args[0], "user.a", []byte("uno"), unix.XATTR_CREATE))
+		fmt.Println(unix.Setxattr(args[0], "user.c", nil, unix.XATTR_REPLACE))
+		fmt.Println(unix.Getxattr(args[0], "user.a", nil))
+		fmt.Println(unix.Getxattr(args[0], "user.a", make([]byte, 1)))
+		buf := make([]byte, 64)
+		n, err := unix.Getxattr(args[1], "user.b", buf)
+		fmt.Printf("%q %v\n", buf[:max(n, 0)], err)
+		n, err = unix.Listxattr(args[0], buf)
+		fmt.Printf("%q %v\n", buf[:max(n, 0)], err)
+		fmt.Println(unix.Llistxattr(args[1], buf))
+		fmt.Println(unix.Lsetxattr(args[1], "user.a", []byte("one"), 0))
+		fd, err := unix.Open(args[0], unix.O_RDONLY, 0)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(unix.Fremovexattr(fd, "user.a"))
+		fmt.Println(unix.Fgetxattr(fd, "user.a", buf))
+		fmt.Println(unix.Removexattr(args[0], "user.a"))
+		fmt.Println(unix.Setxattr(args[0], "other.a", []byte("one"), 0))
+	},
+	// access checks each of args, a path and a mode joined by a colon,
+	// with faccessat, printing what each check returns.
+	"access": func(args []string) {
+		for _, arg := range args {
+			p, mode, _ := strings.Cut(arg, ":")
+			n, _ := strconv.Atoi(mode)
+			fmt.Println(arg, unix.Faccessat(unix.AT_FDCWD, p, uint32(n), 0))
+		}
+	},
+	// chdir moves between the virtual directory args[0], directories in
+	// it and the host directory args[1], by path and by descriptor,
+	// printing where getcwd finds it and what relative paths reach.
+	"chdir": func(args []string) {
+		wd := func() {
+			wd, err := unix.Getwd()
+			if wd == args[1] {
+				wd = "host"
+			}
+			fmt.Println(wd, err)
+		}
+		fmt.Println(unix.Mkdir(args[0], 0o755))
+		fmt.Println(unix.Chdir(args[0]))
+		wd()
+		fmt.Println(os.WriteFile("f", []byte("hi"), 0o644))
+		fmt.Println(unix.Mkdir("sub", 0o755))
+		fmt.Println(unix.Chdir("sub"))
+		wd()
+		b, err := os.ReadFile("../f")
+		fmt.Printf("%q %v\n", b, err)
+		fmt.Println(unix.Chdir("../f"))
+		fmt.Println(unix.Chdir("missing"))
+		fmt.Println(unix.Chdir(".."))
+		wd()
+		buf := make([]byte, 4)
+		_, err = unix.Getcwd(buf)
+		fmt.Println(err)
+		host, err := unix.Open(args[1], unix.O_RDONLY|unix.O_DIRECTORY, 0)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(unix.Fchdir(host))
+		wd()
+		virtual, err := unix.Open(args[0]+"/sub", unix.O_RDONLY|unix.O_DIRECTORY, 0)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(unix.Fchdir(virtual))
+		wd()
+		fmt.Println(unix.Rmdir(args[0] + "/sub"))
+		wd()
+		fmt.Println(unix.Chdir(args[1]))
+		wd()
+		// Host directories reached through the virtual tree.
+		fmt.Println(unix.Symlink(args[1], args[0]+"/tohost"))
+		fmt.Println(unix.Chdir(args[0] + "/tohost"))
+		wd()
+		fmt.Println(unix.Chdir(args[0]))
+		fmt.Println(unix.Chdir("../.."))
+		wd()
+	},
+	// dirfd makes a tree in the virtual directory args[0] and names files
+	// in it relative to descriptors of its directories and through
+	// symlinks, printing what each call returns.
+	"dirfd": func(args []string) {
+		dir := args[0]
+		must := func(err error) {
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		must(unix.Mkdir(dir+"/d", 0o755))
+		must(unix.Mkdir(dir+"/d/sub", 0o755))
+		must(os.WriteFile(dir+"/d/f", []byte("hi"), 0o644))
+		must(unix.Symlink("d/sub", dir+"/l"))
+		must(unix.Symlink("loop", dir+"/loop"))
+		dfd, err := unix.Open(dir+"/d", unix.O_RDONLY|unix.O_DIRECTORY, 0)
+		must(err)
+		read := func(dirfd int, p string) {
+			fd, err := unix.Openat(dirfd, p, unix.O_RDONLY, 0)
+			if err != nil {
+				fmt.Println(p, err)
+				return
+			}
+			defer unix.Close(fd)
+			b := make([]byte, 16)
+			n, err := unix.Read(fd, b)
+			fmt.Printf("%s %q %v\n", p, b[:max(n, 0)], err)
+		}
+		stat := func(dirfd int, p string) {
+			var st unix.Stat_t
+			err := unix.Fstatat(dirfd, p, &st, 0)
+			fmt.Println(p, st.Mode&unix.S_IFMT == unix.S_IFDIR, err)
+		}
+		read(dfd, "f")
+		read(dfd, "../d/f")
+		stat(dfd, "sub")
+		stat(unix.AT_FDCWD, dir+"/l/../f")
+		stat(dfd, "f/x")
+		stat(dfd, "f/..")
+		stat(dfd, "missing/../f")
+		stat(unix.AT_FDCWD, dir+"/loop/x")
+		fmt.Println(unix.Mkdirat(dfd, "sub/new", 0o755))
+		stat(unix.AT_FDCWD, dir+"/l/new")
+		fmt.Println(unix.Unlinkat(dfd, "sub/new", unix.AT_REMOVEDIR))
+		ffd, err := unix.Open(dir+"/d/f", unix.O_RDONLY, 0)
+		must(err)
+		read(ffd, "x")
+		fmt.Println(unix.Unlinkat(dfd, "f", 0))
+		stat(unix.AT_FDCWD, dir+"/d/f")
+	},
+	// symlinks follows symlinks in the virtual directory args[0] to files
+	// in it and in the host directory args[1], which holds a file h and a
+	// symlink tovirt to args[0]/d, printing what each call returns.
+	"symlinks": func(args []string) {
+		dir, host := args[0], args[1]
+		must := func(err error) {
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		must(unix.Mkdir(dir+"/d", 0o755))
+		must(os.WriteFile(dir+"/d/f", []byte("virt"), 0o644))
+		must(unix.Symlink(dir+"/d/f", dir+"/abs"))
+		must(unix.Symlink(host+"/h", dir+"/tohost"))
+		must(unix.Symlink(dir+"/loop", dir+"/loop"))
+		must(unix.Symlink("d/new", dir+"/dangling"))
+		read := func(p string, flags int) {
+			b, err := func() ([]byte, error) {
+				fd, err := unix.Open(p, flags, 0o644)
+				if err != nil {
+					return nil, err
+				}
+				defer unix.Close(fd)
+				b := make([]byte, 16)
+				n, err := unix.Read(fd, b)
+				return b[:max(n, 0)], err
+			}()
+			fmt.Printf("%s %q %v\n", strings.TrimPrefix(p, host), b, err)
+		}
+		read(dir+"/abs", unix.O_RDONLY)
+		read(dir+"/tohost", unix.O_RDONLY)
+		read(host+"/tovirt/f", unix.O_RDONLY)
+		read(dir+"/abs", unix.O_RDONLY|unix.O_NOFOLLOW)
+		read(dir+"/loop", unix.O_RDONLY)
+		read(dir+"/dangling", unix.O_RDWR|unix.O_CREAT)
+		var st unix.Stat_t
+		fmt.Println(unix.Stat(dir+"/tohost", &st), st.Size, st.Mode&unix.S_IFMT == unix.S_IFLNK)
+		fmt.Println(unix.Lstat(dir+"/tohost", &st), st.Mode&unix.S_IFMT == unix.S_IFLNK)
+		fmt.Println(unix.Stat(dir+"/d/new", &st), st.Size)
+		fmt.Println(unix.Stat(host+"/tovirt/f", &st), st.Size)
+	},
+	// proc opens a file in the virtual directory args[0], at a virtual
+	// descriptor and at 10, maps it and changes to the directory, printing
+	// what /proc shows of each.
+	"proc": func(args []string) {
+		dir := args[0]
+		must := func(err error) {
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		must(os.WriteFile(dir+"/f", []byte("hi"), 0o644))
+		fd, err := unix.Open(dir+"/f", unix.O_RDWR, 0)
+		must(err)
+		must(unix.Dup2(fd, 10))
+		self := fmt.Sprintf("/proc/self/fd/%d", fd)
+		fmt.Println(os.Readlink(self))
+		fmt.Println(os.Readlink(fmt.Sprintf("/dev/fd/%d", fd)))
+		var st unix.Stat_t
+		fmt.Println(unix.Stat(self, &st), st.Size, st.Mode&unix.S_IFMT == unix.S_IFREG)
+		fmt.Printf("%v %o\n", unix.Lstat(self, &st), st.Mode)
+		b, err := os.ReadFile(self)
+		fmt.Printf("%q %v\n", b, err)
+		entries, err := os.ReadDir("/proc/self/fd")
+		must(err)
+		for _, e := range entries {
+			if n, _ := strconv.Atoi(e.Name()); n == fd || n == 10 {
+				target, err := os.Readlink("/proc/self/fd/" + e.Name())
+				fmt.Println(n == fd, target, err)
+			}
+		}
+		_, err = unix.Mmap(10, 0, 2, unix.PROT_READ, unix.MAP_SHARED)
+		must(err)
+		maps, err := os.ReadFile("/proc/self/maps")
+		fmt.Println(strings.Contains(string(maps), " "+dir+"/f\n"), strings.Contains(string(maps), "cfc-"), err)
+		must(unix.Chdir(dir))
+		fmt.Println(os.Readlink("/proc/self/cwd"))
+		fmt.Println(os.Readlink(fmt.Sprintf("/proc/%d/cwd", os.Getpid())))
+	},
+	// net makes args[0], a connect, sendto, sendmsg or bind, to args[1], an
+	// IPv4 address or else a Unix socket path, with a socket of the family
+	// it has, and prints what comes of it: the reply to a ping it sends
+	// after a connect, the error of a sendto or sendmsg of one, or the
+	// message it echoes on the first connection it accepts after a bind.
+	"net": func(args []string) {
+		must := func(err error) {
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		var sa unix.Sockaddr = &unix.SockaddrUnix{Name: args[1]}
+		family := unix.AF_UNIX
+		if ap, err := netip.ParseAddrPort(args[1]); err == nil {
+			sa = &unix.SockaddrInet4{Port: int(ap.Port()), Addr: ap.Addr().As4()}
+			family = unix.AF_INET
+		}
+		typ := unix.SOCK_STREAM
+		if args[0] == "sendto" || args[0] == "sendmsg" {
+			typ = unix.SOCK_DGRAM
+		}
+		fd, err := unix.Socket(family, typ|unix.SOCK_CLOEXEC, 0)
+		must(err)
+		b := make([]byte, 64)
+		switch args[0] {
+		case "connect":
+			must(unix.Connect(fd, sa))
+			_, err = unix.Write(fd, []byte("ping"))
+			must(err)
+			n, err := unix.Read(fd, b)
+			must(err)
+			fmt.Printf("%s\n", b[:n])
+		case "sendto":
+			fmt.Println(unix.Sendto(fd, []byte("ping"), 0, sa))
+		case "sendmsg":
+			_, err := unix.SendmsgN(fd, []byte("ping"), nil, sa, 0)
+			fmt.Println(err)
+		case "bind":
+			must(unix.Bind(fd, sa))
+			must(unix.Listen(fd, 1))
+			conn, _, err := unix.Accept(fd)
+			must(err)
+			n, err := unix.Read(conn, b)
+			must(err)
+			_, err = unix.Write(conn, append([]byte("echo "), b[:n]...))
+			must(err)
+			fmt.Printf("echoed %s\n", b[:n])
+		}
+	},
+	// resolve prints the addresses Go's own resolver finds for args[0].
+	"resolve": func(args []string) {
+		addrs, err := net.DefaultResolver.LookupHost(context.Background(), args[0])
+		fmt.Println(addrs, err)
+	},
+	// random prints bytes from getrandom, from /dev/urandom and from a
+	// getrandom with flags it does not know.
+	"random": func(args []string) {
+		b := make([]byte, 8)
+		n, err := unix.Getrandom(b, 0)
+		fmt.Printf("%x %d %v\n", b, n, err)
+		f, err := os.Open("/dev/urandom")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		n, err = f.Read(b)
+		fmt.Printf("%x %d %v\n", b, n, err)
+		fmt.Println(unix.Getrandom(b, 0x80))
+	},
+	// statfs prints the statistics of the filesystem holding the directory
+	// args[0], before and after writing a page to a file in it, and the
+	// error of a statfs of a missing file in it.
+	"statfs": func(args []string) {
+		show := func(st unix.Statfs_t) {
+			fmt.Printf("%#x %d %d %d %d %d %v\n", st.Type, st.Bsize, st.Blocks, st.Bfree, st.Files, st.Ffree, st.Flags&unix.ST_RDONLY != 0)
+		}
+		var st unix.Statfs_t
+		if err := unix.Statfs(args[0], &st); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		show(st)
+		fd, err := unix.Open(args[0]+"/page", unix.O_WRONLY|unix.O_CREAT, 0o644)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		unix.Write(fd, make([]byte, 4096))
+		if err := unix.Fstatfs(fd, &st); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		show(st)
+		fmt.Println(unix.Statfs(args[0]+"/missing", &st))
+	},
+	// utimes sets the times of the file args[0] and the symlink args[1]
+	// to it by name and through a descriptor, printing the times after each
+	// change and the errors of calls that fail.
+	"utimes": func(args []string) {
+		show := func() {
+			var st unix.Stat_t
+			if err := unix.Stat(args[0], &st); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Println(st.Atim.Sec, st.Atim.Nsec, st.Mtim.Sec, st.Mtim.Nsec)
+		}
+		fmt.Println(unix.UtimesNano(args[0], []unix.Timespec{{Sec: 1, Nsec: 500}, {Sec: 2, Nsec: 123456789}}))
+		show()
+		fd, err := unix.Open(args[0], unix.O_RDONLY, 0)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		// futimens, as libc issues it, with a null path.
+		ts := []unix.Timespec{{Nsec: unix.UTIME_OMIT}, {Sec: 3, Nsec: 7}}
+		_, _, errno := unix.Syscall6(unix.SYS_UTIMENSAT, uintptr(fd), 0, uintptr(unsafe.Pointer(&ts[0])), 0, 0, 0)
+		fmt.Println(errno)
+		show()
+		ts = []unix.Timespec{{Sec: 4, Nsec: unix.UTIME_NOW}, {Nsec: unix.UTIME_OMIT}}
+		fmt.Println(unix.UtimesNanoAt(fd, "", ts, unix.AT_EMPTY_PATH))
+		var st unix.Stat_t
+		unix.Stat(args[0], &st)
+		fmt.Println(st.Atim.Sec > 4, st.Mtim.Sec, st.Mtim.Nsec)
+		fmt.Println(unix.UtimesNanoAt(unix.AT_FDCWD, args[1], []unix.Timespec{{Sec: 5}, {Sec: 5}}, unix.AT_SYMLINK_NOFOLLOW))
+		fmt.Println(unix.UtimesNano(args[0], []unix.Timespec{{Sec: 6}, {Sec: 6, Nsec: 1e9}}))
+		fmt.Println(unix.UtimesNano(args[1], []unix.Timespec{{Sec: 7, Nsec: 1}, {Sec: 8, Nsec: 2}}))
+		show()
+	},
+	// chmod changes the mode and owner of the file args[0] and the
+	// symlink args[1] to it by name and through a descriptor, printing the
+	// mode after each change and the errors of the calls.
+	"chmod": func(args []string) {
+		var st unix.Stat_t
+		show := func() {
+			if err := unix.Stat(args[0], &st); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Printf("%o\n", st.Mode&0o7777)
+		}
+		fmt.Println(os.Chmod(args[0], 0o750|os.ModeSetuid))
+		show()
+		fd, err := unix.Open(args[0], unix.O_RDONLY, 0)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(unix.Fchmod(fd, 0o600))
+		show()
+		link, _ := unix.BytePtrFromString(args[1])
+		cwd := int32(unix.AT_FDCWD)
+		_, _, errno := unix.Syscall6(unix.SYS_FCHMODAT2, uintptr(cwd), uintptr(unsafe.Pointer(link)), 0o644, unix.AT_SYMLINK_NOFOLLOW, 0, 0)
+		fmt.Println(errno)
+		fmt.Println(os.Chown(args[0], -1, -1))
+		fmt.Println(os.Chown(args[0], int(st.Uid), int(st.Gid)))
+		fmt.Println(os.Lchown(args[1], -1, int(st.Gid)))
+		fmt.Println(unix.Fchown(fd, int(st.Uid)+1, -1))
+	},
+	// tmpfile writes an unnamed file in the directory args[0], lists the
+	// directory, links the file in as a and b and tries to link one made
+	// with O_EXCL, and seals a memfd, printing what happens along the way.
+	"fakeroot": func(args []string) {
+		fmt.Println(unix.Getuid(), unix.Geteuid(), unix.Getgid(), unix.Getegid())
+		fmt.Println(unix.Setuid(100), unix.Setgroups([]int{5}), unix.Getuid())
+		hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+		var data [2]unix.CapUserData
+		fmt.Println(unix.Capget(&hdr, &data[0]), data[0].Effective == ^uint32(0), data[1].Permitted)
+		fmt.Println(unix.Capset(&hdr, &data[0]))
+		for _, dir := range args {
+			f := dir + "/file"
+			os.WriteFile(f, nil, 0o644)
+			fmt.Println(unix.Chown(f, 123, 456), unix.Lchown(f, -1, 789))
+			fmt.Println(unix.Mknod(dir+"/null", unix.S_IFCHR|0o666, int(unix.Mkdev(1, 3))))
+			for _, name := range []string{"file", "null"} {
+				var st unix.Stat_t
+				err := unix.Stat(dir+"/"+name, &st)
+				fmt.Printf("%s %v %d:%d %o %d,%d\n", name, err, st.Uid, st.Gid, st.Mode&unix.S_IFMT, unix.Major(st.Rdev), unix.Minor(st.Rdev))
+			}
+			n, err := unix.Listxattr(f, nil)
+			fmt.Println(n, err)
+		}
+	},
+	"ioctl": func(args []string) {
+		for _, p := range args {
+			fd, err := unix.Open(p, unix.O_RDONLY, 0)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			unix.Read(fd, make([]byte, 2))
+			fmt.Println(unix.IoctlGetInt(fd, 0x541b)) // FIONREAD
+			_, err = unix.IoctlGetTermios(fd, unix.TCGETS)
+			fmt.Println(err)
+			_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), 0x5451, 0) // FIOCLEX
+			flags, _ := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+			fmt.Println(errno, flags)
+			fmt.Println(unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS))
+			fmt.Println(unix.IoctlGetInt(fd, 0x2)) // FIGETBSZ
+		}
+	},
+	"bigwrite": func(args []string) {
+		size, _ := strconv.Atoi(args[1])
+		b := make([]byte, size)
+		for i := range b {
+			b[i] = byte(i % 251)
+		}
+		fd, err := unix.Open(args[0], unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC, 0o644)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(unix.Write(fd, b))
+		fmt.Println(unix.Pwrite(fd, b, int64(size)))
+	},
+	"chroot": func(args []string) {
+		if err := unix.Chroot(args[0]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		read := func(p string) {
+			b, err := os.ReadFile(p)
+			fmt.Printf("%q %v\n", b, err)
+		}
+		fmt.Println(unix.Chdir("/"))
+		fmt.Println(unix.Getwd())
+		read("/etc/hostname")
+		read("/../../link")
+		fmt.Println(os.Mkdir("/made", 0o755))
+		_, err := os.Stat("made")
+		fmt.Println(err)
+		unix.Chdir("/etc")
+		fmt.Println(unix.PivotRoot(".", "."), unix.Unmount(".", unix.MNT_DETACH))
+		fmt.Println(unix.Getwd())
+		read("/hostname")
+	},
+	"tmpfile": func(args []string) {
+		dir := args[0]
+		list := func() {
+			ents, err := os.ReadDir(dir)
+			fmt.Println(len(ents), err)
+		}
+		fd, err := unix.Open(dir, unix.O_TMPFILE|unix.O_WRONLY, 0o640)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		unix.Write(fd, []byte("hello\n"))
+		link, _ := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+		fmt.Println(strings.HasPrefix(link, dir+"/#"), strings.HasSuffix(link, " (deleted)"))
+		list()
+		fmt.Println(unix.Linkat(fd, "", unix.AT_FDCWD, dir+"/a", unix.AT_EMPTY_PATH))
+		unix.Write(fd, []byte("more\n"))
+		fmt.Println(unix.Linkat(unix.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", fd), unix.AT_FDCWD, dir+"/b", unix.AT_SYMLINK_FOLLOW))
+		list()
+		_, err = unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, unix.F_SEAL_WRITE)
+		fmt.Println(err)
+		excl, err := unix.Open(dir, unix.O_TMPFILE|unix.O_RDWR|unix.O_EXCL, 0o600)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(unix.Linkat(excl, "", unix.AT_FDCWD, dir+"/c", unix.AT_EMPTY_PATH))
+		fmt.Println(unix.Linkat(fd, "", unix.AT_FDCWD, dir+"/a", unix.AT_EMPTY_PATH))
+		_, err = unix.Open(dir+"/a", unix.O_TMPFILE|unix.O_WRONLY, 0o600)
+		fmt.Println(err)
+		mfd, err := unix.MemfdCreate("sealed", unix.MFD_ALLOW_SEALING)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		unix.Write(mfd, []byte("x"))
+		_, err = unix.FcntlInt(uintptr(mfd), unix.F_ADD_SEALS, unix.F_SEAL_WRITE|unix.F_SEAL_SHRINK|unix.F_SEAL_GROW)
+		fmt.Println(err)
+		_, err = unix.Write(mfd, []byte("y"))
+		fmt.Println(err)
+		fmt.Println(unix.Linkat(mfd, "", unix.AT_FDCWD, dir+"/d", unix.AT_EMPTY_PATH))
+	},
+	// lease writes to the file args[0], showing it before and after an
+	// fsync, and writes to args[1] and exits without closing it.
+	"lease": func(args []string) {
+		show := func() {
+			b, err := os.ReadFile(args[0])
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Printf("%q\n", b)
+		}
+		fd, err := unix.Open(args[0], unix.O_RDWR, 0)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		unix.Write(fd, []byte("J\n"))
+		show()
+		fmt.Println(unix.Fsync(fd))
+		show()
+		unix.Close(fd)
+		fd, err = unix.Open(args[1], unix.O_WRONLY|unix.O_CREAT, 0o644)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		unix.Write(fd, []byte("bye\n"))
+		os.Exit(0)
+	},
+	// transfer sends the file args[0] to stdout with sendfile, copies it
+	// to the file args[1] and that on to the file args[2] with
+	// copy_file_range, and splices a pipe to and from the files.
+	"transfer": func(args []string) {
+		src, err := unix.Open(args[0], unix.O_RDONLY, 0)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		n, err := unix.Sendfile(1, src, nil, 100)
+		fmt.Println(n, err)
+		off := int64(6)
+		n, err = unix.Sendfile(1, src, &off, 5)
+		fmt.Println(n, err, off)
+		real, err := unix.Open(args[1], unix.O_RDWR|unix.O_CREAT, 0o644)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		off = 0
+		n, err = unix.CopyFileRange(src, &off, real, nil, 5, 0)
+		fmt.Println(n, err, off)
+		dst, err := unix.Open(args[2], unix.O_WRONLY|unix.O_CREAT, 0o644)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		off = 0
+		n, err = unix.CopyFileRange(real, &off, dst, nil, 5, 0)
+		fmt.Println(n, err)
+		var p [2]int
+		if err := unix.Pipe(p[:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		unix.Write(p[1], []byte(" piped\n"))
+		n64, err := unix.Splice(p[0], nil, dst, nil, 7, 0)
+		fmt.Println(n64, err)
+		off = 0
+		n64, err = unix.Splice(src, &off, p[1], nil, 5, 0)
+		b := make([]byte, 16)
+		m, _ := unix.Read(p[0], b)
+		fmt.Printf("%d %v %q\n", n64, err, b[:m])
+		_, err = unix.Splice(src, nil, real, nil, 5, 0)
+		fmt.Println(err)
+	},
+	// poll polls the file args[0] alongside a pipe with poll, select and
+	// epoll, and prints what each reports.
+	"poll": func(args []string) {
+		fd, err := unix.Open(args[0], unix.O_RDONLY, 0)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		var p [2]int
+		if err := unix.Pipe(p[:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN | unix.POLLOUT}, {Fd: int32(p[0]), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, -1)
+		fmt.Println(n, err, fds[0].Revents, fds[1].Revents)
+		// Nothing is ready, and a regular file never has POLLPRI.
+		fds = []unix.PollFd{{Fd: int32(fd), Events: unix.POLLPRI}, {Fd: int32(p[0]), Events: unix.POLLIN}}
+		n, err = unix.Poll(fds, 50)
+		fmt.Println(n, err, fds[0].Revents, fds[1].Revents)
+		if err := unix.Dup3(fd, 10, 0); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		var r, w unix.FdSet
+		r.Set(10)
+		r.Set(p[0])
+		w.Set(p[1])
+		n, err = unix.Select(11, &r, &w, nil, &unix.Timeval{Sec: 1})
+		fmt.Println(n, err, r.IsSet(10), r.IsSet(p[0]), w.IsSet(p[1]))
+		ep, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(unix.EpollCtl(ep, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: 42}))
+		evs := make([]unix.EpollEvent, 4)
+		n, err = unix.EpollWait(ep, evs, 1000)
+		fmt.Println(n, err, evs[0].Fd, evs[0].Events == unix.EPOLLIN)
+		unix.Close(fd)
+		unix.Close(10)
+		n, err = unix.EpollWait(ep, evs, 0)
+		fmt.Println(n, err)
+	},
+	// inotify watches the directory args[0], and a file in it for a
+	// while, as it changes them, and prints the events.
+	"inotify": func(args []string) {
+		dir := args[0]
+		in, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		watch := func(p string, mask uint32) int {
+			wd, err := unix.InotifyAddWatch(in, p, mask)
+			if err != nil {
+				fmt.Println(err)
+			}
+			return wd
+		}
+		dirWD := watch(dir, unix.IN_ALL_EVENTS)
+		watch(dir+"/missing", unix.IN_ALL_EVENTS)
+		_, err = unix.InotifyAddWatch(unix.Stdout, dir, unix.IN_ALL_EVENTS)
+		fmt.Println(err)
+		os.WriteFile(dir+"/f", []byte("x"), 0o644)
+		fileWD := watch(dir+"/f", unix.IN_ALL_EVENTS)
+		watch(dir+"/f", unix.IN_ALL_EVENTS|unix.IN_ONLYDIR)
+		os.Mkdir(dir+"/d", 0o755)
+		os.Rename(dir+"/f", dir+"/g")
+		unix.InotifyRmWatch(in, uint32(fileWD))
+		os.Chtimes(dir+"/g", time.Unix(1, 0), time.Unix(1, 0))
+		os.Remove(dir + "/g")
+		os.Remove(dir + "/d")
+
+		names := []struct {
+			bit  uint32
+			name string
+		}{
+			{unix.IN_ACCESS, "ACCESS"}, {unix.IN_MODIFY, "MODIFY"}, {unix.IN_ATTRIB, "ATTRIB"},
+			{unix.IN_CLOSE_WRITE, "CLOSE_WRITE"}, {unix.IN_CLOSE_NOWRITE, "CLOSE_NOWRITE"},
+			{unix.IN_OPEN, "OPEN"}, {unix.IN_MOVED_FROM, "MOVED_FROM"}, {unix.IN_MOVED_TO, "MOVED_TO"},
+			{unix.IN_CREATE, "CREATE"}, {unix.IN_DELETE, "DELETE"}, {unix.IN_DELETE_SELF, "DELETE_SELF"},
+			{unix.IN_MOVE_SELF, "MOVE_SELF"}, {unix.IN_IGNORED, "IGNORED"}, {unix.IN_ISDIR, "ISDIR"},
+		}
+		buf := make([]byte, 1<<16)
+		n, err := unix.Read(in, buf)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		var cookie uint32
+		for b := buf[:n]; len(b) >= unix.SizeofInotifyEvent; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&b[0]))
+			name := strings.TrimRight(string(b[unix.SizeofInotifyEvent:unix.SizeofInotifyEvent+ev.Len]), "\x00")
+			b = b[unix.SizeofInotifyEvent+ev.Len:]
+			var line []string
+			switch int(ev.Wd) {
+			case dirWD:
+				line = append(line, "dir")
+			case fileWD:
+				line = append(line, "file")
+			}
+			for _, nm := range names {
+				if ev.Mask&nm.bit != 0 {
+					line = append(line, nm.name)
+				}
+			}
+			if name != "" {
+				line = append(line, name)
+			}
+			switch {
+			case ev.Mask&unix.IN_MOVED_FROM != 0:
+				cookie = ev.Cookie
+			case ev.Mask&unix.IN_MOVED_TO != 0 && ev.Cookie == cookie:
+				line = append(line, "paired")
+			}
+			fmt.Println(strings.Join(line, " "))
+		}
+	},
+	// goruntime leans on what Go programs do: asynchronous preemption of
+	// goroutines spinning on several threads, signals, the netpoller and
+	// the vDSO clock, serving the files of a directory over HTTP to
+	// clients asking at once.
+	"goruntime": func(args []string) {
+		var stop atomic.Bool
+		for range runtime.GOMAXPROCS(0) {
+			go func() {
+				for !stop.Load() {
+				}
+			}()
+		}
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGUSR1)
+		syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+		fmt.Println(<-sigs)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		go http.Serve(ln, http.FileServer(http.Dir(args[0])))
+		start := time.Now()
+		out := make([]string, 8)
+		var wg sync.WaitGroup
+		for i := range out {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := http.Get("http://" + ln.Addr().String() + "/f")
+				if err != nil {
+					out[i] = err.Error()
+					return
+				}
+				defer resp.Body.Close()
+				b, err := io.ReadAll(resp.Body)
+				out[i] = fmt.Sprint(resp.StatusCode, " ", string(b), " ", err)
+			}()
+		}
+		wg.Wait()
+		time.Sleep(10 * time.Millisecond)
+		elapsed := time.Since(start)
+		stop.Store(true)
+		fmt.Println(strings.Join(out, "\n"))
+		fmt.Println(elapsed >= 10*time.Millisecond, elapsed < time.Minute)
+	},
+	// bench makes the syscall args[0] names on the file args[1], as many
+	// times as args[2] says, and prints how long that took in
+	// nanoseconds.
+	"bench": func(args []string) {
+		op, p := args[0], args[1]
+		n, _ := strconv.Atoi(args[2])
+		fd, err := unix.Open(p, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		buf := make([]byte, 4096)
+		var st unix.Stat_t
+		start := time.Now()
+		for range n {
+			switch op {
+			case "getpid":
+				unix.Getpid()
+			case "open":
+				var g int
+				if g, err = unix.Open(p, unix.O_RDONLY|unix.O_CLOEXEC, 0); err == nil {
+					err = unix.Close(g)
+				}
+			case "stat":
+				err = unix.Stat(p, &st)
+			case "pread":
+				_, err = unix.Pread(fd, buf, 0)
+			}
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		fmt.Println(time.Since(start).Nanoseconds())
+	},
+	// nested runs true under a tracer of its own, and prints what the
+	// error it fails with, if any, says is missing.
+	"nested": func(args []string) {
+		err := New(exec.Command("/bin/true")).Run(context.Background())
+		if ce, ok := err.(*CapabilityError); ok {
+			fmt.Println(ce.Capability)
+		} else {
+			fmt.Println(err)
+		}
+	},
+}
+
+func TestMain(m *testing.M) {
+	if name := os.Getenv(helperEnv); name != "" {
+		helpers[name](os.Args[1:])
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// helperCommand returns a command that runs the named helper.
+func helperCommand(t testing.TB, name string, args ...string) *exec.Cmd {
+	t.Helper()
+	if _, ok := helpers[name]; !ok {
+		t.Fatalf("no helper %q", name)
+	}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), helperEnv+"="+name)
+	return cmd
+}
@@ -0,0 +1,199 @@
+package tracer
+
+import (
+	"errors"
+	"slices"
+
+	"golang.org/x/sys/unix"
+)
+
+// OnSyscallEnter calls h at the entry of each of the native syscalls nrs
+// made by the command, or of every syscall if none are given, before the
+// tracer handles it itself. Hooks run in the order they were added. In
+// 32-bit code a hook sees the same syscalls through the i386 ABI, where the
+// tracer knows their numbers.
+//
+// Hooking every syscall stops the command on each of them, which is far
+// slower than hooking the few of interest. Under EngineUnotify such hooks
+// never see close_range.
+func OnSyscallEnter(h func(*Syscall), nrs ...uint64) Option {
+	return func(t *Tracer) { t.enterHooks = append(t.enterHooks, hook{fn: h, nrs: nrs}) }
+}
+
+// OnSyscallExit calls h when each of the native syscalls nrs, or every
+// syscall if none are given, returns, including those the tracer emulates
+// and those an enter hook skipped, and sees their result. Exit hooks never
+// run under EngineUnotify, which gets no word of syscalls returning.
+func OnSyscallExit(h func(*Syscall), nrs ...uint64) Option {
+	return func(t *Tracer) { t.exitHooks = append(t.exitHooks, hook{fn: h, nrs: nrs}) }
+}
+
+type hook struct {
+	fn  func(*Syscall)
+	nrs []uint64
+}
+
+// matches reports whether h hooks c.
+func (h hook) matches(c sysCall) bool {
+	if len(h.nrs) == 0 {
+		return true
+	}
+	n, ok := native(c)
+	return ok && slices.Contains(h.nrs, n.nr)
+}
+
+// Syscall is a syscall a hook has stopped. Nr and Args are as the command
+// passed them, in the ABI Arch names; in native code Nr is one of the
+// unix.SYS_* numbers.
+type Syscall struct {
+	// Tid is the thread making the syscall.
+	Tid int
+	// Arch is the AUDIT_ARCH value of the syscall's ABI.
+	Arch uint32
+	Nr   uint64
+	Args [6]uint64
+	// Ret is the value the syscall returned, which is a negated errno if
+	// it failed. It is only set for exit hooks.
+	Ret int64
+
+	th *thread
+	// regs are the registers of the stopped thread, or nil under
+	// EngineUnotify.
+	regs    *unix.PtraceRegs
+	exiting bool
+	// Changes the hook asked for.
+	skip, argsSet, retSet bool
+}
+
+// ReadMemory reads n bytes of the command's memory at addr.
+func (s *Syscall) ReadMemory(addr uintptr, n int) ([]byte, error) {
+	return s.th.mem.readBytes(addr, n)
+}
+
+// WriteMemory writes b to the command's memory at addr.
+func (s *Syscall) WriteMemory(addr uintptr, b []byte) error {
+	return s.th.mem.writeBytes(addr, b)
+}
+
+// ReadString reads the NUL-terminated string at addr in the command's
+// memory, such as a path argument.
+func (s *Syscall) ReadString(addr uintptr) (string, error) {
+	return s.th.mem.readString(addr)
+}
+
+// WriteString writes str to the command's memory at addr, followed by a
+// NUL.
+func (s *Syscall) WriteString(addr uintptr, str string) error {
+	return s.th.mem.writeBytes(addr, append([]byte(str), 0))
+}
+
+// SetArg replaces argument i of a syscall about to run, both for the
+// kernel and for the tracer's own handling of it. It fails with
+// errors.ErrUnsupported in an exit hook and under EngineUnotify, which
+// cannot change a syscall's registers.
+func (s *Syscall) SetArg(i int, v uint64) error {
+	if s.exiting || s.regs == nil {
+		return errors.ErrUnsupported
+	}
+	*argRegs(s.regs, s.Arch == compatArch)[i] = v
+	s.Args[i] = v
+	s.argsSet = true
+	return nil
+}
+
+// Skip stops a syscall about to run from reaching the kernel or the
+// tracer; it returns ret instead, which may be a negated errno. Later
+// enter hooks are not called. It fails with errors.ErrUnsupported in an
+// exit hook.
+func (s *Syscall) Skip(ret int64) error {
+	if s.exiting {
+		return errors.ErrUnsupported
+	}
+	s.skip, s.Ret = true, ret
+	return nil
+}
+
+// SetReturn replaces the value a syscall returns to the command. It fails
+// with errors.ErrUnsupported in an enter hook; use Skip there.
+func (s *Syscall) SetReturn(ret int64) error {
+	if !s.exiting {
+		return errors.ErrUnsupported
+	}
+	s.Ret, s.retSet = ret, true
+	return nil
+}
+
+// hookEnter runs the enter hooks for c, which is updated with any
+// arguments they set. It reports whether a hook skipped the syscall and
+// the value to return in that case. Under the ptrace engine the thread's
+// recorded registers are updated; writing them back is up to the caller.
+func (th *thread) hookEnter(c *sysCall, regs *unix.PtraceRegs) (ret int64, skipped, argsSet bool) {
+	s := &Syscall{Tid: th.tid, Arch: c.arch, Nr: c.nr, Args: c.args, th: th, regs: regs}
+	for _, h := range th.t.enterHooks {
+		if !h.matches(*c) {
+			continue
+		}
+		h.fn(s)
+		if s.skip {
+			break
+		}
+	}
+	c.args = s.Args
+	if s.skip {
+		th.reserve, th.mapping, th.passing = nil, nil, nil
+	}
+	return s.Ret, s.skip, s.argsSet
+}
+
+// wantsExit reports whether any exit hook, or the trace, is interested in
+// c.
+func (t *Tracer) wantsExit(c sysCall) bool {
+	if t.trace != nil {
+		return true
+	}
+	for _, h := range t.exitHooks {
+		if h.matches(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// hookExit runs the exit hooks for the syscall the thread recorded at
+// entry, which returned ret, and reports what it should return instead.
+func (th *thread) hookExit(ret int64) (int64, bool) {
+	c := *th.hooked
+	th.hooked = nil
+	s := &Syscall{Tid: th.tid, Arch: c.arch, Nr: c.nr, Args: c.args, Ret: ret, th: th, exiting: true}
+	for _, h := range th.t.exitHooks {
+		if h.matches(c) {
+			h.fn(s)
+		}
+	}
+	if th.t.trace != nil {
+		th.traceSyscall(c, s.Ret, true, th.hookedAt)
+	}
+	return s.Ret, s.retSet
+}
+
+// hookAll reports whether a hook wants every syscall.
+func (t *Tracer) hookAll() bool {
+	for _, h := range append(t.enterHooks[:len(t.enterHooks):len(t.enterHooks)], t.exitHooks...) {
+		if len(h.nrs) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hookSyscalls returns the syscalls the hooks need trapped.
+func (t *Tracer) hookSyscalls() []uint64 {
+	var nrs []uint64
+	for _, h := range t.enterHooks {
+		nrs = append(nrs, h.nrs...)
+	}
+	for _, h := range t.exitHooks {
+		nrs = append(nrs, h.nrs...)
+	}
+	return nrs
+}
@@ -0,0 +1,67 @@
+package tracer
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// injectSyscall makes the stopped thread execute syscall nr with args and
+// returns the raw result. It temporarily patches a syscall instruction over
+// the code at the thread's program counter and single-steps it, restoring
+// both code and registers afterwards. The thread must be in a signal- or
+// event-stop rather than a syscall-stop, as it is right after exec.
+func (th *thread) injectSyscall(nr uint64, args ...uint64) (int64, error) {
+	var saved unix.PtraceRegs
+	if err := getRegs(th.tid, &saved); err != nil {
+		return 0, fmt.Errorf("tracer: inject: getregs: %w", err)
+	}
+	pc := uintptr(instructionPointer(&saved))
+	var orig, patched [8]byte
+	if _, err := unix.PtracePeekText(th.tid, pc, orig[:]); err != nil {
+		return 0, fmt.Errorf("tracer: inject: peek: %w", err)
+	}
+	patched = orig
+	copy(patched[:], syscallInsn(&saved))
+	if _, err := unix.PtracePokeText(th.tid, pc, patched[:]); err != nil {
+		return 0, fmt.Errorf("tracer: inject: poke: %w", err)
+	}
+	defer func() {
+		_, _ = unix.PtracePokeText(th.tid, pc, orig[:])
+		_ = setRegs(th.tid, &saved)
+	}()
+
+	regs := saved
+	prepareSyscall(&regs, uint64(pc), nr, args)
+	if err := setRegs(th.tid, &regs); err != nil {
+		return 0, fmt.Errorf("tracer: inject: setregs: %w", err)
+	}
+	// A signal that arrives before the step would be lost by stepping
+	// past it. It is sent again once the thread is back as it was.
+	var sigs []unix.Signal
+	defer func() {
+		for _, sig := range sigs {
+			_ = unix.Tgkill(th.pid, th.tid, sig)
+		}
+	}()
+	var ws unix.WaitStatus
+	for {
+		if err := unix.PtraceSingleStep(th.tid); err != nil {
+			return 0, fmt.Errorf("tracer: inject: singlestep: %w", err)
+		}
+		if _, err := unix.Wait4(th.tid, &ws, waitFlags, nil); err != nil {
+			return 0, fmt.Errorf("tracer: inject: wait: %w", err)
+		}
+		if !ws.Stopped() || eventStop(ws) >= 0 || ws.StopSignal() == unix.SIGTRAP {
+			break
+		}
+		sigs = append(sigs, ws.StopSignal())
+	}
+	if !ws.Stopped() || ws.StopSignal() != unix.SIGTRAP {
+		return 0, fmt.Errorf("tracer: inject: unexpected stop %#x", uint32(ws))
+	}
+	if err := getRegs(th.tid, &regs); err != nil {
+		return 0, fmt.Errorf("tracer: inject: getregs: %w", err)
+	}
+	return int64(returnValue(&regs)), nil
+}
@@ -0,0 +1,520 @@
+package tracer
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// The kernel cannot watch a virtual path, which it does not know of, so
+// inotify_add_watch naming one is the tracer's to do. It makes a shadow of
+// the path in a directory of its own: an empty regular file for a file, or
+// a directory holding a placeholder for each entry of a directory, and
+// adds the watch on the shadow to the command's inotify instance. The
+// watch descriptor is the kernel's, so inotify_rm_watch, and reading the
+// events, need nothing from the tracer.
+//
+// The backends of the mounts carry each change made through them to the
+// shadows: a file created, linked or made a directory or symlink has its
+// placeholder made, one written or truncated has its shadow and
+// placeholder truncated, one closed after being opened for writing has
+// them opened for writing and closed, and one whose mode, times or
+// attributes change has their times set. Removals and renames are done to
+// the shadows and placeholders in turn, so the kernel reports IN_DELETE,
+// IN_MOVED_FROM and IN_MOVED_TO, paired by cookie when both directories
+// are watched, and IN_DELETE_SELF and IN_MOVE_SELF. Reads are not carried
+// over, so IN_ACCESS and IN_CLOSE_NOWRITE are never reported and IN_OPEN
+// only with IN_CLOSE_WRITE, and neither are changes made to a backend
+// other than through the tracer. fanotify is not emulated.
+
+// inotifySyscalls returns the syscalls watching virtual paths needs
+// trapped, which are none without them.
+func (t *Tracer) inotifySyscalls() []uint64 {
+	if len(t.mounts) == 0 && len(t.remaps) == 0 && t.resolver == nil {
+		return nil
+	}
+	return []uint64{unix.SYS_INOTIFY_ADD_WATCH}
+}
+
+// sysInotifyAddWatch adds a watch of the shadow of a virtual path, or of
+// the host path a remap leads to, to the inotify instance fd.
+func (th *thread) sysInotifyAddWatch(fd int, pathAddr uintptr, mask uint32) (int64, bool) {
+	resolve := th.virtualTarget
+	if mask&unix.IN_DONT_FOLLOW != 0 {
+		resolve = th.virtualPath
+	}
+	abs, m, name, ret, ok := resolve(unix.AT_FDCWD, pathAddr)
+	if !ok || ret < 0 {
+		return ret, ok
+	}
+	th.t.log.Printf("inotify_add_watch: %s (virtual)", abs)
+	in, err := th.dupFD(fd)
+	if err != nil {
+		return errnoRet(err), true
+	}
+	defer unix.Close(in)
+	if link, _ := os.Readlink("/proc/self/fd/" + strconv.Itoa(in)); link != "anon_inode:inotify" {
+		return -int64(unix.EINVAL), true
+	}
+	p := path.Join("/", name)
+	if m != &th.t.host {
+		if p, err = th.t.watches.shadow(m, abs, name); err != nil {
+			return errnoRet(err), true
+		}
+	}
+	wd, err := unix.InotifyAddWatch(in, p, mask)
+	if err != nil {
+		return errnoRet(err), true
+	}
+	return int64(wd), true
+}
+
+// watches are the shadows of the virtual paths the command watches.
+type watches struct {
+	log *log.Logger
+
+	mu sync.Mutex
+	// root is the directory holding the shadows, made with the first.
+	root string
+	seq  int
+	// shadows holds the host path of each shadow by the absolute path it
+	// stands in for.
+	shadows map[string]string
+}
+
+// watchBackends puts the backend of every mount behind one carrying its
+// changes to the shadows of the watched paths.
+func (t *Tracer) watchBackends() {
+	t.watches = &watches{log: t.log, shadows: make(map[string]string)}
+	for i := range t.mounts {
+		m := &t.mounts[i]
+		m.backend = &watchedBackend{w: t.watches, dir: m.dir, b: m.backend}
+	}
+}
+
+// close removes the shadows.
+func (w *watches) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.root != "" {
+		os.RemoveAll(w.root)
+	}
+	clear(w.shadows)
+}
+
+// shadow returns the shadow of abs, which is name in m, making it if
+// there is none.
+func (w *watches) shadow(m *mount, abs, name string) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if p, ok := w.shadows[abs]; ok {
+		return p, nil
+	}
+	fi, err := m.backend.Lstat(name)
+	if err != nil {
+		return "", err
+	}
+	p, err := w.next()
+	if err != nil {
+		return "", err
+	}
+	if err := placeholder(p, fi.Mode().Type()); err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		entries, err := m.backend.ReadDir(name)
+		if err != nil {
+			os.RemoveAll(p)
+			return "", err
+		}
+		for _, e := range entries {
+			if err := placeholder(filepath.Join(p, e.Name()), e.Type()); err != nil {
+				os.RemoveAll(p)
+				return "", err
+			}
+		}
+	}
+	w.shadows[abs] = p
+	return p, nil
+}
+
+// next returns a path in the root not yet used; w.mu must be held.
+func (w *watches) next() (string, error) {
+	if w.root == "" {
+		root, err := os.MkdirTemp("", "cfc-ptrace-watches-")
+		if err != nil {
+			return "", err
+		}
+		w.root = root
+	}
+	w.seq++
+	return filepath.Join(w.root, strconv.Itoa(w.seq)), nil
+}
+
+// placeholder makes a file of type typ at p: a directory, a symlink, or
+// otherwise an empty regular file.
+func placeholder(p string, typ fs.FileMode) error {
+	switch typ {
+	case fs.ModeDir:
+		return os.Mkdir(p, 0o700)
+	case fs.ModeSymlink:
+		return os.Symlink("-", p)
+	}
+	return unix.Mknod(p, unix.S_IFREG|0o600, 0)
+}
+
+// active reports whether anything is watched.
+func (w *watches) active() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.shadows) > 0
+}
+
+// find returns the shadow of abs and its placeholder in the shadow of its
+// directory, each "" if there is none; w.mu must be held.
+func (w *watches) find(abs string) (self, entry string) {
+	if dir, ok := w.shadows[path.Dir(abs)]; ok && abs != "/" {
+		entry = filepath.Join(dir, path.Base(abs))
+	}
+	return w.shadows[abs], entry
+}
+
+// each calls fn with the shadow of abs and its placeholder, those there
+// are, logging what fails other than because they are gone.
+func (w *watches) each(op, abs string, fn func(p string) error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	self, entry := w.find(abs)
+	for _, p := range []string{self, entry} {
+		if p != "" {
+			w.check(op, abs, fn(p))
+		}
+	}
+}
+
+// check logs err, of carrying op on abs to the shadows, unless it is nil
+// or because a shadow is gone.
+func (w *watches) check(op, abs string, err error) {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		w.log.Printf("inotify: %s %s: %v", op, abs, err)
+	}
+}
+
+// created makes the placeholder of abs, a new file of type typ.
+func (w *watches) created(abs string, typ fs.FileMode) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, entry := w.find(abs); entry != "" {
+		w.check("create", abs, placeholder(entry, typ))
+	}
+}
+
+// modified truncates the shadow and placeholder of abs, for IN_MODIFY.
+func (w *watches) modified(abs string) {
+	w.each("modify", abs, func(p string) error { return unix.Truncate(p, 0) })
+}
+
+// closedWrite opens the shadow and placeholder of abs for writing and
+// closes them, for IN_CLOSE_WRITE.
+func (w *watches) closedWrite(abs string) {
+	w.each("close", abs, func(p string) error {
+		f, err := os.OpenFile(p, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	})
+}
+
+// changed sets the times of the shadow and placeholder of abs, for
+// IN_ATTRIB.
+func (w *watches) changed(abs string) {
+	now := []unix.Timespec{{Nsec: unix.UTIME_NOW}, {Nsec: unix.UTIME_NOW}}
+	w.each("attrib", abs, func(p string) error {
+		return unix.UtimesNanoAt(unix.AT_FDCWD, p, now, unix.AT_SYMLINK_NOFOLLOW)
+	})
+}
+
+// removed removes the placeholder of abs, and its shadow with those of
+// the paths below it.
+func (w *watches) removed(abs string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, entry := w.find(abs); entry != "" {
+		w.check("remove", abs, os.Remove(entry))
+	}
+	w.drop(abs)
+}
+
+// drop removes the shadows of abs and the paths below it; w.mu must be
+// held.
+func (w *watches) drop(abs string) {
+	for k, p := range w.shadows {
+		if inDir(k, abs) {
+			w.check("remove", k, os.RemoveAll(p))
+			delete(w.shadows, k)
+		}
+	}
+}
+
+// renamed moves the placeholder of oldAbs to that of newAbs, a file of
+// type typ, and the shadow of oldAbs to a new path, the shadows of the
+// paths below oldAbs going with it.
+func (w *watches) renamed(oldAbs, newAbs string, typ fs.FileMode) {
+	if oldAbs == newAbs {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	self, from := w.find(oldAbs)
+	_, to := w.find(newAbs)
+	w.drop(newAbs)
+	switch {
+	case from != "" && to != "":
+		w.check("rename", oldAbs, os.Rename(from, to))
+	case from != "":
+		// Moved out of the watched directories, as the placeholder is
+		// moved out of the shadows.
+		if p, err := w.next(); err != nil {
+			w.check("rename", oldAbs, err)
+		} else if err := os.Rename(from, p); err != nil {
+			w.check("rename", oldAbs, err)
+		} else {
+			w.check("rename", oldAbs, os.RemoveAll(p))
+		}
+	case to != "":
+		p, err := w.next()
+		if err == nil {
+			if err = placeholder(p, typ); err == nil {
+				err = os.Rename(p, to)
+			}
+		}
+		w.check("rename", newAbs, err)
+	}
+	if self != "" {
+		p, err := w.next()
+		if err == nil {
+			err = os.Rename(self, p)
+		}
+		if err != nil {
+			w.check("rename", oldAbs, err)
+			p = self
+		}
+		w.shadows[oldAbs] = p
+	}
+	for k, p := range w.shadows {
+		if inDir(k, oldAbs) {
+			delete(w.shadows, k)
+			w.shadows[newAbs+strings.TrimPrefix(k, oldAbs)] = p
+		}
+	}
+}
+
+// watchedBackend carries the changes to the backend of the mount at dir
+// to the shadows of the watched paths.
+type watchedBackend struct {
+	w   *watches
+	dir string
+	b   vfs.Backend
+}
+
+// abs returns the absolute path of name.
+func (b *watchedBackend) abs(name string) string { return path.Join(b.dir, name) }
+
+// typ returns the type of the named file, or that of a regular file if it
+// cannot be told.
+func (b *watchedBackend) typ(name string) fs.FileMode {
+	fi, err := b.b.Lstat(name)
+	if err != nil {
+		return 0
+	}
+	return fi.Mode().Type()
+}
+
+func (b *watchedBackend) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	created := false
+	if flag&os.O_CREATE != 0 && b.w.active() {
+		_, err := b.b.Lstat(name)
+		created = errors.Is(err, fs.ErrNotExist)
+	}
+	f, err := b.b.Open(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	abs := b.abs(name)
+	if created {
+		b.w.created(abs, 0)
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, nil
+	}
+	if flag&os.O_TRUNC != 0 && !created {
+		b.w.modified(abs)
+	}
+	return &watchedFile{File: f, w: b.w, abs: abs}, nil
+}
+
+func (b *watchedBackend) Stat(name string) (fs.FileInfo, error)      { return b.b.Stat(name) }
+func (b *watchedBackend) Lstat(name string) (fs.FileInfo, error)     { return b.b.Lstat(name) }
+func (b *watchedBackend) ReadDir(name string) ([]fs.DirEntry, error) { return b.b.ReadDir(name) }
+func (b *watchedBackend) Readlink(name string) (string, error)       { return b.b.Readlink(name) }
+
+func (b *watchedBackend) Mkdir(name string, perm fs.FileMode) error {
+	if err := b.b.Mkdir(name, perm); err != nil {
+		return err
+	}
+	b.w.created(b.abs(name), fs.ModeDir)
+	return nil
+}
+
+func (b *watchedBackend) Unlink(name string) error {
+	if err := b.b.Unlink(name); err != nil {
+		return err
+	}
+	b.w.removed(b.abs(name))
+	return nil
+}
+
+func (b *watchedBackend) Rmdir(name string) error {
+	if err := b.b.Rmdir(name); err != nil {
+		return err
+	}
+	b.w.removed(b.abs(name))
+	return nil
+}
+
+func (b *watchedBackend) Rename(oldname, newname string) error {
+	if err := b.b.Rename(oldname, newname); err != nil {
+		return err
+	}
+	if b.w.active() {
+		b.w.renamed(b.abs(oldname), b.abs(newname), b.typ(newname))
+	}
+	return nil
+}
+
+func (b *watchedBackend) Link(oldname, newname string) error {
+	if err := b.b.Link(oldname, newname); err != nil {
+		return err
+	}
+	if b.w.active() {
+		b.w.changed(b.abs(oldname))
+		b.w.created(b.abs(newname), b.typ(newname))
+	}
+	return nil
+}
+
+func (b *watchedBackend) Symlink(target, newname string) error {
+	if err := b.b.Symlink(target, newname); err != nil {
+		return err
+	}
+	b.w.created(b.abs(newname), fs.ModeSymlink)
+	return nil
+}
+
+func (b *watchedBackend) Chmod(name string, mode fs.FileMode) error {
+	if err := b.b.Chmod(name, mode); err != nil {
+		return err
+	}
+	b.w.changed(b.abs(name))
+	return nil
+}
+
+func (b *watchedBackend) Chtimes(name string, atime, mtime time.Time) error {
+	if err := b.b.Chtimes(name, atime, mtime); err != nil {
+		return err
+	}
+	b.w.changed(b.abs(name))
+	return nil
+}
+
+func (b *watchedBackend) Getxattr(name, attr string) ([]byte, error) {
+	return vfs.Getxattr(b.b, name, attr)
+}
+
+func (b *watchedBackend) Setxattr(name, attr string, value []byte, flags int) error {
+	if err := vfs.Setxattr(b.b, name, attr, value, flags); err != nil {
+		return err
+	}
+	b.w.changed(b.abs(name))
+	return nil
+}
+
+func (b *watchedBackend) Listxattr(name string) ([]string, error) {
+	return vfs.Listxattr(b.b, name)
+}
+
+func (b *watchedBackend) Removexattr(name, attr string) error {
+	if err := vfs.Removexattr(b.b, name, attr); err != nil {
+		return err
+	}
+	b.w.changed(b.abs(name))
+	return nil
+}
+
+func (b *watchedBackend) StatFS(name string) (vfs.FSStat, error) { return vfs.StatFS(b.b, name) }
+
+func (b *watchedBackend) SocketPath(name string) (string, error) {
+	return vfs.SocketPath(b.b, name)
+}
+
+// watchedFile is a file opened for writing as abs, carrying its writes
+// and its close to the shadows.
+type watchedFile struct {
+	vfs.File
+	w   *watches
+	abs string
+}
+
+func (f *watchedFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if n > 0 {
+		f.w.modified(f.abs)
+	}
+	return n, err
+}
+
+func (f *watchedFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	if n > 0 {
+		f.w.modified(f.abs)
+	}
+	return n, err
+}
+
+func (f *watchedFile) Truncate(size int64) error {
+	if err := vfs.Truncate(f.File, size); err != nil {
+		return err
+	}
+	f.w.modified(f.abs)
+	return nil
+}
+
+func (f *watchedFile) PunchHole(off, n int64) error {
+	if err := vfs.PunchHole(f.File, off, n); err != nil {
+		return err
+	}
+	f.w.modified(f.abs)
+	return nil
+}
+
+func (f *watchedFile) Sync() error { return vfs.Sync(f.File) }
+
+func (f *watchedFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	f.w.closedWrite(f.abs)
+	return nil
+}
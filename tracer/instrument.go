@@ -0,0 +1,281 @@
+package tracer
+
+import (
+	"io/fs"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// An observer is told of each operation on a mount's backend: it is
+// called with the syscall the operation is for, the operation and the name
+// it is on as the operation begins, and the function it returns as it
+// ends, with the bytes it moved and its error.
+type observer func(at spanOp, op, name string) func(n int, err error)
+
+// instrumentBackends puts the backend of every mount behind one that tells
+// WithMetrics and WithTracerProvider of its operations, if either is set.
+func (t *Tracer) instrumentBackends() {
+	for i := range t.mounts {
+		m := &t.mounts[i]
+		var obs []observer
+		if t.metrics != nil {
+			obs = append(obs, t.metrics.observer(m.dir))
+		}
+		if t.spans != nil {
+			obs = append(obs, t.spanObserver(m.dir))
+		}
+		if obs != nil {
+			m.backend = &instrumentedBackend{t: t, dir: m.dir, b: m.backend, obs: obs}
+		}
+	}
+}
+
+// instrumentedBackend tells its observers of the operations on the backend
+// of the mount at dir.
+type instrumentedBackend struct {
+	t   *Tracer
+	dir string
+	b   vfs.Backend
+	obs []observer
+}
+
+// begin tells the observers that op on name, for the syscall at, begins,
+// and returns the function to call when it ends.
+func (b *instrumentedBackend) begin(at spanOp, op, name string) func(int, error) {
+	ends := make([]func(int, error), len(b.obs))
+	for i, o := range b.obs {
+		ends[i] = o(at, op, name)
+	}
+	return func(n int, err error) {
+		for _, end := range ends {
+			end(n, err)
+		}
+	}
+}
+
+func (b *instrumentedBackend) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	end := b.begin(b.t.op, "open", name)
+	f, err := b.b.Open(name, flag, perm)
+	end(0, err)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedFile{b: b, name: name, f: f}, nil
+}
+
+func (b *instrumentedBackend) Stat(name string) (fs.FileInfo, error) {
+	end := b.begin(b.t.op, "stat", name)
+	fi, err := b.b.Stat(name)
+	end(0, err)
+	return fi, err
+}
+
+func (b *instrumentedBackend) Lstat(name string) (fs.FileInfo, error) {
+	end := b.begin(b.t.op, "lstat", name)
+	fi, err := b.b.Lstat(name)
+	end(0, err)
+	return fi, err
+}
+
+func (b *instrumentedBackend) ReadDir(name string) ([]fs.DirEntry, error) {
+	end := b.begin(b.t.op, "readdir", name)
+	entries, err := b.b.ReadDir(name)
+	end(0, err)
+	return entries, err
+}
+
+func (b *instrumentedBackend) Mkdir(name string, perm fs.FileMode) error {
+	end := b.begin(b.t.op, "mkdir", name)
+	err := b.b.Mkdir(name, perm)
+	end(0, err)
+	return err
+}
+
+func (b *instrumentedBackend) Unlink(name string) error {
+	end := b.begin(b.t.op, "unlink", name)
+	err := b.b.Unlink(name)
+	end(0, err)
+	return err
+}
+
+func (b *instrumentedBackend) Rmdir(name string) error {
+	end := b.begin(b.t.op, "rmdir", name)
+	err := b.b.Rmdir(name)
+	end(0, err)
+	return err
+}
+
+func (b *instrumentedBackend) Rename(oldname, newname string) error {
+	end := b.begin(b.t.op, "rename", oldname)
+	err := b.b.Rename(oldname, newname)
+	end(0, err)
+	return err
+}
+
+func (b *instrumentedBackend) Link(oldname, newname string) error {
+	end := b.begin(b.t.op, "link", newname)
+	err := b.b.Link(oldname, newname)
+	end(0, err)
+	return err
+}
+
+func (b *instrumentedBackend) Symlink(target, newname string) error {
+	end := b.begin(b.t.op, "symlink", newname)
+	err := b.b.Symlink(target, newname)
+	end(0, err)
+	return err
+}
+
+func (b *instrumentedBackend) Readlink(name string) (string, error) {
+	end := b.begin(b.t.op, "readlink", name)
+	target, err := b.b.Readlink(name)
+	end(0, err)
+	return target, err
+}
+
+func (b *instrumentedBackend) Chmod(name string, mode fs.FileMode) error {
+	end := b.begin(b.t.op, "chmod", name)
+	err := b.b.Chmod(name, mode)
+	end(0, err)
+	return err
+}
+
+func (b *instrumentedBackend) Chtimes(name string, atime, mtime time.Time) error {
+	end := b.begin(b.t.op, "chtimes", name)
+	err := b.b.Chtimes(name, atime, mtime)
+	end(0, err)
+	return err
+}
+
+func (b *instrumentedBackend) Getxattr(name, attr string) ([]byte, error) {
+	end := b.begin(b.t.op, "getxattr", name)
+	v, err := vfs.Getxattr(b.b, name, attr)
+	end(0, err)
+	return v, err
+}
+
+func (b *instrumentedBackend) Setxattr(name, attr string, value []byte, flags int) error {
+	end := b.begin(b.t.op, "setxattr", name)
+	err := vfs.Setxattr(b.b, name, attr, value, flags)
+	end(0, err)
+	return err
+}
+
+func (b *instrumentedBackend) Listxattr(name string) ([]string, error) {
+	end := b.begin(b.t.op, "listxattr", name)
+	attrs, err := vfs.Listxattr(b.b, name)
+	end(0, err)
+	return attrs, err
+}
+
+func (b *instrumentedBackend) Removexattr(name, attr string) error {
+	end := b.begin(b.t.op, "removexattr", name)
+	err := vfs.Removexattr(b.b, name, attr)
+	end(0, err)
+	return err
+}
+
+func (b *instrumentedBackend) StatFS(name string) (vfs.FSStat, error) {
+	end := b.begin(b.t.op, "statfs", name)
+	st, err := vfs.StatFS(b.b, name)
+	end(0, err)
+	return st, err
+}
+
+func (b *instrumentedBackend) SocketPath(name string) (string, error) {
+	return vfs.SocketPath(b.b, name)
+}
+
+// instrumentedFile tells the observers of its backend of the operations
+// on a file opened as name, and of the bytes they move.
+type instrumentedFile struct {
+	b    *instrumentedBackend
+	name string
+	f    vfs.File
+	// at is the syscall a worker operates on the file for, while one does.
+	at *spanOp
+}
+
+// op returns the syscall the file is operated on for.
+func (f *instrumentedFile) op() spanOp {
+	if f.at != nil {
+		return *f.at
+	}
+	return f.b.t.op
+}
+
+// workingFor has the operations on f, if it is instrumented, told to be
+// for the syscall at, or, with nil, for the one the tracer is handling.
+func workingFor(f vfs.File, at *spanOp) {
+	if f, ok := f.(*instrumentedFile); ok {
+		f.at = at
+	}
+}
+
+func (f *instrumentedFile) Read(p []byte) (int, error) {
+	end := f.b.begin(f.op(), "read", f.name)
+	n, err := f.f.Read(p)
+	end(n, err)
+	return n, err
+}
+
+func (f *instrumentedFile) ReadAt(p []byte, off int64) (int, error) {
+	end := f.b.begin(f.op(), "read", f.name)
+	n, err := f.f.ReadAt(p, off)
+	end(n, err)
+	return n, err
+}
+
+func (f *instrumentedFile) Write(p []byte) (int, error) {
+	end := f.b.begin(f.op(), "write", f.name)
+	n, err := f.f.Write(p)
+	end(n, err)
+	return n, err
+}
+
+func (f *instrumentedFile) WriteAt(p []byte, off int64) (int, error) {
+	end := f.b.begin(f.op(), "write", f.name)
+	n, err := f.f.WriteAt(p, off)
+	end(n, err)
+	return n, err
+}
+
+func (f *instrumentedFile) Truncate(size int64) error {
+	end := f.b.begin(f.op(), "truncate", f.name)
+	err := vfs.Truncate(f.f, size)
+	end(0, err)
+	return err
+}
+
+func (f *instrumentedFile) PunchHole(off, n int64) error {
+	end := f.b.begin(f.op(), "punchhole", f.name)
+	err := vfs.PunchHole(f.f, off, n)
+	end(0, err)
+	return err
+}
+
+func (f *instrumentedFile) Sync() error {
+	end := f.b.begin(f.op(), "fsync", f.name)
+	err := vfs.Sync(f.f)
+	end(0, err)
+	return err
+}
+
+func (f *instrumentedFile) Seek(off int64, whence int) (int64, error) {
+	return f.f.Seek(off, whence)
+}
+
+func (f *instrumentedFile) Stat() (fs.FileInfo, error) {
+	end := f.b.begin(f.op(), "fstat", f.name)
+	fi, err := f.f.Stat()
+	end(0, err)
+	return fi, err
+}
+
+func (f *instrumentedFile) Close() error {
+	end := f.b.begin(f.op(), "close", f.name)
+	err := f.f.Close()
+	end(0, err)
+	return err
+}
@@ -0,0 +1,219 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"io"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// IoctlAction is what an IoctlRule does with the ioctls it matches on
+// virtual descriptors.
+type IoctlAction int
+
+const (
+	// IoctlEmulate answers the ioctl as the tracer's own table does. The
+	// table knows FIONREAD, FIONBIO, FIOCLEX, FIONCLEX and FIGETBSZ, and
+	// FS_IOC_GETFLAGS and FS_IOC_SETFLAGS for files with no flags to get
+	// or set. It fails the rest with ENOTTY, as the kernel does an ioctl a
+	// file has no use for, so that a terminal check such as TCGETS finds
+	// no terminal. An ioctl no rule matches is emulated.
+	IoctlEmulate IoctlAction = iota + 1
+	// IoctlDeny fails the ioctl with the rule's Errno.
+	IoctlDeny
+	// IoctlForward passes the ioctl to the file behind the descriptor: to
+	// its Ioctl method if it is a vfs.Ioctler, or to the host file itself
+	// if it is one, as it is from a vfs.Dir. Any other file fails it with
+	// ENOTTY.
+	IoctlForward
+)
+
+// IoctlRule decides what an ioctl on a virtual descriptor does, as part of
+// a table given to WithIoctls.
+type IoctlRule struct {
+	// Request is the ioctl request number, such as unix.TCGETS.
+	Request uint
+	Action  IoctlAction
+	// Errno is what IoctlDeny fails with. The default is ENOTTY.
+	Errno syscall.Errno
+	// Size is the size of the argument IoctlForward copies from the
+	// command's memory and back again, for a request that does not encode
+	// it in its number. The argument of a request with neither is passed
+	// as the number it is.
+	Size int
+}
+
+// WithIoctls decides what ioctls on virtual descriptors do, adding to any
+// rules given before. The first rule for a request decides; without one,
+// the ioctl is emulated, as IoctlEmulate says. ioctls on host descriptors
+// go to the kernel as ever. A forwarded argument is copied in both
+// directions when the request's number gives no direction.
+func WithIoctls(rules ...IoctlRule) Option {
+	return func(t *Tracer) { t.ioctls = append(t.ioctls, rules...) }
+}
+
+// ioctlSyscalls returns the syscalls ioctl emulation needs trapped, which
+// are none while no virtual file can be opened or rules are given.
+func (t *Tracer) ioctlSyscalls() []uint64 {
+	if t.ioctls == nil && t.random == nil && len(t.mounts) == 0 && len(t.remaps) == 0 {
+		return nil
+	}
+	return []uint64{unix.SYS_IOCTL}
+}
+
+// ioctls of the table IoctlEmulate answers from that package unix does not
+// define, with the numbers every architecture the tracer runs on gives them.
+const (
+	ioctlFIONREAD = 0x541b
+	ioctlFIONBIO  = 0x5421
+	ioctlFIONCLEX = 0x5450
+	ioctlFIOCLEX  = 0x5451
+	ioctlFIGETBSZ = 0x2
+)
+
+// Fields of an ioctl request number, as _IOC lays them out.
+const (
+	iocSizeShift = 16
+	iocSizeMask  = 1<<14 - 1
+	iocDirShift  = 30
+	iocWrite     = 1
+	iocRead      = 2
+)
+
+// ioctlRule returns the first rule for req, or one to emulate it.
+func (t *Tracer) ioctlRule(req uint) IoctlRule {
+	for _, r := range t.ioctls {
+		if r.Request == req {
+			return r
+		}
+	}
+	return IoctlRule{Request: req, Action: IoctlEmulate}
+}
+
+func (th *thread) sysIoctl(fd int, req uint, arg uint64) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	th.t.log.Printf("ioctl: fd=%d req=%#x (virtual)", fd, req)
+	r := th.t.ioctlRule(req)
+	switch r.Action {
+	case IoctlDeny:
+		errno := r.Errno
+		if errno == 0 {
+			errno = unix.ENOTTY
+		}
+		return -int64(errno), true
+	case IoctlForward:
+		return th.forwardIoctl(f, r, uintptr(arg)), true
+	}
+	return th.emulateIoctl(fd, f, req, uintptr(arg))
+}
+
+// emulateIoctl answers the ioctls the tracer's table knows for the virtual
+// file f, open as fd.
+func (th *thread) emulateIoctl(fd int, f *vfile, req uint, arg uintptr) (int64, bool) {
+	putInt := func(v int32) int64 {
+		if err := th.mem.writeBytes(arg, binary.LittleEndian.AppendUint32(nil, uint32(v))); err != nil {
+			return -int64(unix.EFAULT)
+		}
+		return 0
+	}
+	switch req {
+	case ioctlFIONREAD:
+		fi, err := f.file.Stat()
+		if err != nil {
+			return errnoRet(err), true
+		}
+		if !fi.Mode().IsRegular() {
+			return -int64(unix.ENOTTY), true
+		}
+		off, err := f.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return errnoRet(err), true
+		}
+		return putInt(int32(max(fi.Size()-off, 0))), true
+	case ioctlFIONBIO:
+		b, err := th.mem.readBytes(arg, 4)
+		if err != nil {
+			return -int64(unix.EFAULT), true
+		}
+		f.flags &^= unix.O_NONBLOCK
+		if binary.LittleEndian.Uint32(b) != 0 {
+			f.flags |= unix.O_NONBLOCK
+		}
+		return 0, true
+	case ioctlFIOCLEX, ioctlFIONCLEX:
+		th.fds.setCloexec(fd, req == ioctlFIOCLEX)
+		// As with F_SETFD, the placeholder of a low descriptor takes the
+		// flag too.
+		return 0, fd >= fdBase || th.t.engine == EngineUnotify
+	case ioctlFIGETBSZ:
+		return putInt(4096), true
+	case unix.FS_IOC_GETFLAGS:
+		return putInt(0), true
+	case unix.FS_IOC_SETFLAGS:
+		// A file with no flags can keep none.
+		b, err := th.mem.readBytes(arg, 4)
+		if err != nil {
+			return -int64(unix.EFAULT), true
+		}
+		if binary.LittleEndian.Uint32(b) != 0 {
+			return -int64(unix.EOPNOTSUPP), true
+		}
+		return 0, true
+	}
+	return -int64(unix.ENOTTY), true
+}
+
+// forwardIoctl passes the ioctl r matches, with its argument at arg, to
+// the file behind f, and returns its result or a negated errno.
+func (th *thread) forwardIoctl(f *vfile, r IoctlRule, arg uintptr) int64 {
+	dir := r.Request >> iocDirShift
+	size := int(r.Request >> iocSizeShift & iocSizeMask)
+	if size == 0 {
+		size, dir = r.Size, iocRead|iocWrite
+	}
+	var b []byte
+	if size > 0 {
+		var err error
+		if dir&iocWrite != 0 {
+			if b, err = th.mem.readBytes(arg, size); err != nil {
+				return -int64(unix.EFAULT)
+			}
+		} else {
+			b = make([]byte, size)
+		}
+	}
+	var n int
+	var err error
+	switch file := f.file.(type) {
+	case vfs.Ioctler:
+		n, err = file.Ioctl(r.Request, b)
+	case interface{ Fd() uintptr }:
+		p := arg
+		if b != nil {
+			p = uintptr(unsafe.Pointer(&b[0]))
+		}
+		r1, _, errno := unix.Syscall(unix.SYS_IOCTL, file.Fd(), uintptr(r.Request), p)
+		if errno != 0 {
+			err = errno
+		}
+		n = int(r1)
+	default:
+		return -int64(unix.ENOTTY)
+	}
+	if err != nil {
+		return errnoRet(err)
+	}
+	if b != nil && dir&iocRead != 0 {
+		if err := th.mem.writeBytes(arg, b); err != nil {
+			return -int64(unix.EFAULT)
+		}
+	}
+	return int64(n)
+}
@@ -0,0 +1,44 @@
+package tracer
+
+import "golang.org/x/sys/unix"
+
+// WithIOURing sets whether the command may use io_uring, which it may by
+// default. The kernel carries out the operations queued on a ring without
+// making the syscalls the tracer intercepts, so reads, writes and opens
+// through one reach the host, past mounts, path rules, read-only mode and
+// the egress firewall alike. Turned off, io_uring_setup fails with ENOSYS, as on a kernel
+// built without io_uring, which is what makes liburing users and runtimes
+// such as tokio fall back to plain syscalls. io_uring_enter and
+// io_uring_register fail the same way, in case the command inherited a ring.
+//
+// Left on, a command setting up a ring while anything is mounted is logged
+// as escaping the tracer.
+func WithIOURing(on bool) Option {
+	return func(t *Tracer) { t.noIOURing = !on }
+}
+
+// ioURingSyscalls returns the io_uring syscalls to trap: those to fail if
+// io_uring is off, or io_uring_setup to log if there is something for a
+// ring to get around.
+func (t *Tracer) ioURingSyscalls() []uint64 {
+	switch {
+	case t.noIOURing:
+		return []uint64{unix.SYS_IO_URING_SETUP, unix.SYS_IO_URING_ENTER, unix.SYS_IO_URING_REGISTER}
+	case t.mounts != nil || t.remaps != nil || t.egress != nil:
+		return []uint64{unix.SYS_IO_URING_SETUP}
+	}
+	return nil
+}
+
+// sysIOURing handles the io_uring syscall nr.
+func (th *thread) sysIOURing(nr uint64) (int64, bool) {
+	if !th.t.noIOURing {
+		if nr == unix.SYS_IO_URING_SETUP && (th.t.mounts != nil || th.t.remaps != nil || th.t.egress != nil) {
+			th.t.log.Printf("pid %d: io_uring_setup: operations on the ring bypass the tracer", th.pid)
+		}
+		return 0, false
+	}
+	th.t.log.Printf("syscall %d denied: io_uring is off", nr)
+	th.t.emit(&SyscallDenied{Pid: th.pid, Syscall: nr, Errno: unix.ENOSYS})
+	return -int64(unix.ENOSYS), true
+}
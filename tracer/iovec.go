@@ -0,0 +1,152 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+// iovMax is UIO_MAXIOV, the most buffers one vectored call may name.
+const iovMax = 1024
+
+type iovec struct {
+	base uintptr
+	len  int
+}
+
+// iovecs reads the array of cnt struct iovec at addr, in the layout of the
+// thread's current syscall ABI. It returns an errno on failure.
+func (th *thread) iovecs(addr uintptr, cnt int) ([]iovec, unix.Errno) {
+	if cnt < 0 || cnt > iovMax {
+		return nil, unix.EINVAL
+	}
+	size := 16
+	if th.arch == compatArch {
+		size = 8
+	}
+	b, err := th.mem.readBytes(addr, cnt*size)
+	if err != nil {
+		return nil, unix.EFAULT
+	}
+	iov := make([]iovec, cnt)
+	var total int64
+	for i := range iov {
+		rec := b[i*size:]
+		if size == 8 {
+			iov[i] = iovec{base: uintptr(binary.LittleEndian.Uint32(rec)), len: int(binary.LittleEndian.Uint32(rec[4:]))}
+		} else {
+			iov[i] = iovec{base: uintptr(binary.LittleEndian.Uint64(rec)), len: int(binary.LittleEndian.Uint64(rec[8:]))}
+		}
+		if total += int64(iov[i].len); iov[i].len < 0 || total < 0 {
+			return nil, unix.EINVAL
+		}
+	}
+	return iov, 0
+}
+
+// rwfSupported are the preadv2 and pwritev2 flags the tracer accepts. The
+// hints among them mean nothing to a virtual file.
+const rwfSupported = unix.RWF_HIPRI | unix.RWF_DSYNC | unix.RWF_SYNC | unix.RWF_NOWAIT | unix.RWF_APPEND
+
+// sysPreadv differs from sysPreadv2 in taking no -1 for the file offset,
+// which it passes on as some other invalid offset.
+func (th *thread) sysPreadv(fd int, iovAddr uintptr, cnt int, off int64) (int64, bool) {
+	if off == -1 {
+		off = -2
+	}
+	return th.sysPreadv2(fd, iovAddr, cnt, off, 0)
+}
+
+func (th *thread) sysPwritev(fd int, iovAddr uintptr, cnt int, off int64) (int64, bool) {
+	if off == -1 {
+		off = -2
+	}
+	return th.sysPwritev2(fd, iovAddr, cnt, off, 0)
+}
+
+// sysPreadv2 also handles readv. off is -1 to read at the file offset.
+func (th *thread) sysPreadv2(fd int, iovAddr uintptr, cnt int, off int64, flags int) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	th.t.log.Printf("preadv2: fd=%d off=%d (virtual)", fd, off)
+	if off < -1 {
+		return -int64(unix.EINVAL), true
+	}
+	if flags&^rwfSupported != 0 {
+		return -int64(unix.EOPNOTSUPP), true
+	}
+	iov, errno := th.iovecs(iovAddr, cnt)
+	if errno != 0 {
+		return -int64(errno), true
+	}
+	total := 0
+	for _, v := range iov {
+		total += v.len
+	}
+	b := make([]byte, min(total, maxBufferSize))
+	n, err := f.read(b, off)
+	if n == 0 && err != nil && err != io.EOF {
+		return errnoRet(err), true
+	}
+	// Scatter what was read across the buffers in order.
+	rest := b[:n]
+	for _, v := range iov {
+		if len(rest) == 0 {
+			break
+		}
+		k := min(v.len, len(rest))
+		if err := th.mem.writeBytes(v.base, rest[:k]); err != nil {
+			return -int64(unix.EFAULT), true
+		}
+		rest = rest[k:]
+	}
+	return int64(n), true
+}
+
+// sysPwritev2 also handles writev, like sysPreadv2.
+func (th *thread) sysPwritev2(fd int, iovAddr uintptr, cnt int, off int64, flags int) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	th.t.log.Printf("pwritev2: fd=%d off=%d (virtual)", fd, off)
+	if off < -1 {
+		return -int64(unix.EINVAL), true
+	}
+	if flags&^rwfSupported != 0 {
+		return -int64(unix.EOPNOTSUPP), true
+	}
+	iov, errno := th.iovecs(iovAddr, cnt)
+	if errno != 0 {
+		return -int64(errno), true
+	}
+	// Gather the buffers, up to the emulation limit, into a single write.
+	var b []byte
+	for _, v := range iov {
+		chunk, err := th.mem.readBytes(v.base, min(v.len, maxBufferSize-len(b)))
+		if err != nil {
+			if len(b) == 0 {
+				return -int64(unix.EFAULT), true
+			}
+			break
+		}
+		if b = append(b, chunk...); len(b) == maxBufferSize {
+			break
+		}
+	}
+	if flags&unix.RWF_APPEND != 0 {
+		if _, err := f.file.Seek(0, io.SeekEnd); err != nil {
+			return errnoRet(err), true
+		}
+		off = -1
+	}
+	n, err := f.write(b, off)
+	if n == 0 && err != nil && len(b) > 0 {
+		return errnoRet(err), true
+	}
+	th.wrote(fd, f, int64(n))
+	return int64(n), true
+}
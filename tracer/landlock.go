@@ -0,0 +1,154 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithLandlock controls the Landlock ruleset that backs WithReadOnly up,
+// which is on by default. With it, the kernel confines the command too:
+// before the command runs, it is given a ruleset that lets it change files
+// only at or below the writable directories, so that a write the tracer
+// does not see, such as one queued on an io_uring, still fails, with
+// EACCES. Making Unix domain sockets is left alone, as read-only mode
+// does. The ruleset is inherited by everything the command forks or
+// execs, and outlives the tracer, so processes Detach lets go stay
+// confined by it.
+//
+// The ruleset needs Landlock ABI 2, from Linux 5.19; on kernels without
+// it, and for a process given to Attach, read-only mode is the tracer's
+// alone. Path rules, which refuse paths below others a command may use,
+// are beyond what a ruleset of what is allowed can say, and are always
+// the tracer's alone.
+func WithLandlock(enabled bool) Option {
+	return func(t *Tracer) { t.noLandlock = !enabled }
+}
+
+// landlockRights returns the rights a ruleset of Landlock ABI abi takes
+// away outside the writable directories.
+func landlockRights(abi int) uint64 {
+	rights := uint64(unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM |
+		unix.LANDLOCK_ACCESS_FS_REFER)
+	if abi >= 3 {
+		rights |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	return rights
+}
+
+// landlockFileRights are the rights a rule for a file other than a
+// directory may grant.
+const landlockFileRights = unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+
+// restrictWrites applies the ruleset of WithLandlock to the thread, which
+// must be stopped right after exec, before any seccomp filter is
+// installed. There is nothing to do unless the Tracer is read-only.
+func (th *thread) restrictWrites() error {
+	t := th.t
+	if t.noLandlock || !t.readOnly || slices.Contains(t.writable, "/") {
+		return nil
+	}
+	// Without ABI 2 a ruleset would refuse moving files between
+	// directories even where they are writable.
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return fmt.Errorf("tracer: landlock: %w", errno)
+	}
+	if abi < 2 {
+		return fmt.Errorf("tracer: landlock: ABI %d", abi)
+	}
+	var regs unix.PtraceRegs
+	if err := getRegs(th.tid, &regs); err != nil {
+		return err
+	}
+	inject := func(nr uint64, args ...uint64) (int64, error) {
+		ret, err := th.injectSyscall(nr, args...)
+		if err == nil && ret < 0 {
+			err = unix.Errno(-ret)
+		}
+		return ret, err
+	}
+
+	// The ruleset's attributes, a rule and its directory's path go in
+	// unused stack below the red zone, as the seccomp filter does.
+	attr := (stackPointer(&regs) - 4096 - 16 - 16 - unix.PathMax) &^ 15
+	rule, name := attr+16, attr+32
+	rights := landlockRights(int(abi))
+	if err := th.mem.writeBytes(uintptr(attr), binary.LittleEndian.AppendUint64(nil, rights)); err != nil {
+		return err
+	}
+	ruleset, err := inject(unix.SYS_LANDLOCK_CREATE_RULESET, attr, 8, 0)
+	if err != nil {
+		return fmt.Errorf("tracer: landlock: %w", err)
+	}
+	defer func() { _, _ = inject(unix.SYS_CLOSE, uint64(ruleset)) }()
+	for _, dir := range t.writable {
+		if err := th.allowWrites(inject, uint64(ruleset), rule, name, dir, rights); err != nil {
+			// A directory that is not on the host, such as a mount's,
+			// is written by the tracer if at all.
+			t.log.Printf("landlock: %s: %v", dir, err)
+		}
+	}
+
+	restrict := func() error {
+		_, err := inject(unix.SYS_LANDLOCK_RESTRICT_SELF, uint64(ruleset), 0)
+		return err
+	}
+	err = restrict()
+	if errors.Is(err, unix.EPERM) {
+		// Unprivileged tracees need no_new_privs to restrict themselves.
+		if _, err = inject(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1); err == nil {
+			err = restrict()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("tracer: landlock: %w", err)
+	}
+	t.log.Printf("landlock: writes confined to %v", t.writable)
+	return nil
+}
+
+// allowWrites adds a rule granting rights at and below dir to the
+// thread's ruleset, a descriptor in its process, with the rule at rule and
+// dir's path at name.
+func (th *thread) allowWrites(inject func(uint64, ...uint64) (int64, error), ruleset, rule, name uint64, dir string, rights uint64) error {
+	if len(dir) >= unix.PathMax {
+		return unix.ENAMETOOLONG
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		rights &= landlockFileRights
+	}
+	if err := th.mem.writeBytes(uintptr(name), append([]byte(dir), 0)); err != nil {
+		return err
+	}
+	cwd := int64(unix.AT_FDCWD)
+	fd, err := inject(unix.SYS_OPENAT, uint64(cwd), name, unix.O_PATH|unix.O_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer func() { _, _ = inject(unix.SYS_CLOSE, uint64(fd)) }()
+	// struct landlock_path_beneath_attr is packed.
+	b := binary.LittleEndian.AppendUint64(nil, rights)
+	b = binary.LittleEndian.AppendUint32(b, uint32(fd))
+	if err := th.mem.writeBytes(uintptr(rule), b); err != nil {
+		return err
+	}
+	_, err = inject(unix.SYS_LANDLOCK_ADD_RULE, ruleset, unix.LANDLOCK_RULE_PATH_BENEATH, rule, 0)
+	return err
+}
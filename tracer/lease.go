@@ -0,0 +1,281 @@
+package tracer
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// WithLeases leases every regular file below a mount that the command
+// opens to it: the file is copied into a memfd of the open's own, and the
+// process is handed a real descriptor of that instead of a virtual one.
+// Its reads, writes, seeks and mmaps then go straight to the kernel, which
+// makes IO-heavy workloads much faster, at the cost of strictness.
+//
+// What the process writes reaches the backend only when the lease is
+// synced: when a descriptor of it is closed, fsynced or duplicated over,
+// when no traced process has it open any longer, and when the tracer
+// finishes. Then the whole file is written back. Until then other opens of
+// the file do not see the writes, and locks, WithLimits and events other
+// than FileOpened do not apply to the descriptor. fstat reports the
+// memfd's device and inode. Opens WithPassthrough serves are not leased,
+// and WithRecord and WithReplay turn leasing off.
+func WithLeases() Option {
+	return func(t *Tracer) { t.leases = &leases{byIno: make(map[uint64]*lease)} }
+}
+
+// leases holds the leases of the files the command has open, by the inode
+// of their memfds.
+type leases struct {
+	byIno map[uint64]*lease
+}
+
+// lease is a file leased to the command: name in m, whose absolute path is
+// abs, open in its backend as file and copied into memfd, whose inode is
+// ino. It is written back if writable.
+type lease struct {
+	m        *mount
+	name     string
+	abs      string
+	file     vfs.File
+	memfd    *os.File
+	ino      uint64
+	writable bool
+}
+
+// openLeased opens name in m, whose absolute path is abs, with flags and
+// mode, and has the open served from a lease of the file if it is a
+// regular one. It returns the open's result otherwise, as openVirtual.
+func (th *thread) openLeased(m *mount, name, abs string, flags int, mode uint32) (int64, bool) {
+	t := th.t
+	if t.record != nil || t.replay != nil || flags&(unix.O_DIRECTORY|unix.O_PATH|unix.O_TMPFILE) != 0 {
+		return th.openVirtual(m, name, abs, flags, mode), true
+	}
+	// The lease writes the file back at offsets of its own.
+	f, err := th.openBackend(m, name, flags&^unix.O_APPEND, mode)
+	if err != nil {
+		return errnoRet(err), true
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return th.addVirtual(m, name, abs, f, flags), true
+	}
+	l, err := t.newLease(m, name, abs, f, flags, fi)
+	if err != nil {
+		t.log.Printf("lease: %s: %v", abs, err)
+		return th.addVirtual(m, name, abs, f, flags), true
+	}
+	t.log.Printf("openat: %s (leased)", abs)
+	th.passing = &passOpen{f: l.memfd, m: m, name: name, abs: abs, flags: flags, mode: mode, lease: l}
+	return 0, false
+}
+
+// newLease copies f, opened as name in m with flags, into a new memfd and
+// leases it.
+func (t *Tracer) newLease(m *mount, name, abs string, f vfs.File, flags int, fi os.FileInfo) (*lease, error) {
+	fd, err := unix.MemfdCreate(memfdName, unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	memfd := os.NewFile(uintptr(fd), memfdName)
+	l := &lease{m: m, name: name, abs: abs, file: f, memfd: memfd, writable: flags&unix.O_ACCMODE != unix.O_RDONLY}
+	if err := l.fill(fi.Size(), flags&unix.O_ACCMODE == unix.O_WRONLY); err != nil {
+		memfd.Close()
+		return nil, err
+	}
+	if err := memfd.Chmod(fi.Mode().Perm()); err != nil {
+		memfd.Close()
+		return nil, err
+	}
+	st, err := memfd.Stat()
+	if err != nil {
+		memfd.Close()
+		return nil, err
+	}
+	l.ino = st.Sys().(*syscall.Stat_t).Ino
+	t.noteMemfd(memfd, abs)
+	t.leases.byIno[l.ino] = l
+	return l, nil
+}
+
+// fill copies the size bytes of the leased file into its memfd. A file
+// open only for writing, as wronly says, is read through a second open.
+func (l *lease) fill(size int64, wronly bool) error {
+	if size == 0 {
+		return nil
+	}
+	src := l.file
+	if wronly {
+		f, err := l.m.backend.Open(l.name, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	}
+	_, err := io.Copy(l.memfd, io.NewSectionReader(src, 0, math.MaxInt64))
+	return err
+}
+
+// syncLease writes the memfd of l back to the file, if the lease is
+// writable. The memfd's times are too coarse to tell whether it has
+// changed, so it is written back whole every time.
+func (t *Tracer) syncLease(l *lease) error {
+	if !l.writable {
+		return nil
+	}
+	st, err := l.memfd.Stat()
+	if err != nil {
+		return err
+	}
+	t.log.Printf("lease: syncing %s", l.abs)
+	if _, err := io.Copy(io.NewOffsetWriter(l.file, 0), io.NewSectionReader(l.memfd, 0, st.Size())); err != nil {
+		return err
+	}
+	if err := vfs.Truncate(l.file, st.Size()); err != nil {
+		return err
+	}
+	t.passthrough.drop(l.m, l.name)
+	return nil
+}
+
+// releaseLease syncs l and ends the lease.
+func (t *Tracer) releaseLease(l *lease) error {
+	err := t.syncLease(l)
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	l.memfd.Close()
+	delete(t.leases.byIno, l.ino)
+	return err
+}
+
+// leaseOf returns the lease the thread's descriptor fd is open on, if any.
+func (th *thread) leaseOf(fd int) (*lease, bool) {
+	if th.t.leases == nil || len(th.t.leases.byIno) == 0 {
+		return nil, false
+	}
+	ino, ok := memfdIno(fmt.Sprintf("/proc/%d/fd/%d", th.pid, fd), memfdName)
+	if !ok {
+		return nil, false
+	}
+	l, ok := th.t.leases.byIno[ino]
+	return l, ok
+}
+
+// memfdIno returns the inode of the memfd named name that the link in
+// /proc leads to, and false if it leads anywhere else.
+func memfdIno(link, name string) (uint64, bool) {
+	if target, err := os.Readlink(link); err != nil || !strings.HasPrefix(target, "/memfd:"+name) {
+		return 0, false
+	}
+	fi, err := os.Stat(link)
+	if err != nil {
+		return 0, false
+	}
+	return fi.Sys().(*syscall.Stat_t).Ino, true
+}
+
+// closeLease syncs the lease the thread's descriptor fd is open on, if
+// any, as the descriptor is closed, and ends the lease if no traced process
+// has it open otherwise.
+func (th *thread) closeLease(fd int) {
+	l, ok := th.leaseOf(fd)
+	if !ok {
+		return
+	}
+	th.t.log.Printf("close: fd=%d (leased)", fd)
+	held := th.t.leasesHeld(th.pid, fd)
+	var err error
+	if held[l.ino] {
+		err = th.t.syncLease(l)
+	} else {
+		err = th.t.releaseLease(l)
+	}
+	if err != nil {
+		th.t.log.Printf("lease: %s: %v", l.abs, err)
+	}
+}
+
+// fsyncLease syncs the lease fd is open on, if it is one, and fails as the
+// sync did.
+func (th *thread) fsyncLease(fd int) (int64, bool) {
+	l, ok := th.leaseOf(fd)
+	if !ok {
+		return 0, false
+	}
+	th.t.log.Printf("fsync: fd=%d (leased)", fd)
+	err := th.t.syncLease(l)
+	if err == nil {
+		err = vfs.Sync(l.file)
+	}
+	if err != nil {
+		th.t.log.Printf("lease: %s: %v", l.abs, err)
+		return errnoRet(err), true
+	}
+	return 0, true
+}
+
+// leasesHeld returns the inodes of the leases that traced processes have
+// open, leaving out the descriptor fd of pid.
+func (t *Tracer) leasesHeld(pid, fd int) map[uint64]bool {
+	pids := make(map[int]bool)
+	for _, th := range t.threads {
+		pids[th.pid] = true
+	}
+	for p := range t.procs {
+		pids[p] = true
+	}
+	held := make(map[uint64]bool)
+	for p := range pids {
+		entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", p))
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if p == pid && e.Name() == fmt.Sprint(fd) {
+				continue
+			}
+			if ino, ok := memfdIno(fmt.Sprintf("/proc/%d/fd/%s", p, e.Name()), memfdName); ok {
+				held[ino] = true
+			}
+		}
+	}
+	return held
+}
+
+// collectLeases ends the leases no traced process has open any longer,
+// once a process has exited.
+func (t *Tracer) collectLeases() {
+	if t.leases == nil || len(t.leases.byIno) == 0 {
+		return
+	}
+	held := t.leasesHeld(0, -1)
+	for ino, l := range t.leases.byIno {
+		if held[ino] {
+			continue
+		}
+		if err := t.releaseLease(l); err != nil {
+			t.log.Printf("lease: %s: %v", l.abs, err)
+		}
+	}
+}
+
+// endLeases ends every lease as the tracer finishes.
+func (t *Tracer) endLeases() {
+	if t.leases == nil {
+		return
+	}
+	for _, l := range t.leases.byIno {
+		if err := t.releaseLease(l); err != nil {
+			t.log.Printf("lease: %s: %v", l.abs, err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package tracer
+
+import (
+	"github.com/maxmcd/cfc-ptrace/vfs/quota"
+)
+
+// Limits bounds what a command can take of its virtual filesystem, so
+// that one that runs away fails its syscalls instead of exhausting the
+// memory or disk behind a backend. A zero field is no limit.
+type Limits struct {
+	// Bytes, FileSize and Inodes bound the growth of each mount, as
+	// quota.Limits describes: past Bytes or Inodes a syscall fails with
+	// ENOSPC, and past FileSize with EFBIG. The host is not bounded.
+	Bytes    int64
+	FileSize int64
+	Inodes   int64
+	// OpenFiles is the most virtual descriptors a process can have open,
+	// counted apart from its real ones. Past it, opening one, or
+	// duplicating one with fcntl, fails with EMFILE. dup2 and dup3 can
+	// still go past it, as the kernel bounds them by number rather than
+	// by count.
+	OpenFiles int
+}
+
+// WithLimits bounds the command's use of the virtual filesystem by l,
+// replacing any limits given before.
+func WithLimits(l Limits) Option {
+	return func(t *Tracer) { t.limits = l }
+}
+
+// limitBackends puts the backend of every mount behind a quota, if there
+// is one to enforce.
+func (t *Tracer) limitBackends() {
+	l := quota.Limits{Bytes: t.limits.Bytes, FileSize: t.limits.FileSize, Inodes: t.limits.Inodes}
+	if l == (quota.Limits{}) {
+		return
+	}
+	for i := range t.mounts {
+		t.mounts[i].backend = quota.New(t.mounts[i].backend, l)
+	}
+}
+
+// fdsFull reports whether the process has as many virtual descriptors
+// open as Limits allows.
+func (th *thread) fdsFull() bool {
+	return th.t.limits.OpenFiles > 0 && len(th.fds.fds) >= th.t.limits.OpenFiles
+}
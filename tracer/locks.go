@@ -0,0 +1,542 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Advisory locks on virtual files are kept by the tracer, in a table for
+// each mount, since the kernel never sees the files. They follow the
+// kernel's rules. A POSIX record lock, from F_SETLK, belongs to the process
+// and goes when the process closes any descriptor for the file; an open
+// file description lock, from F_OFD_SETLK, and a flock lock belong to the
+// open file and go when it is last closed. Record locks of both kinds
+// conflict with each other but not with flock locks. F_SETLKW fails with
+// EDEADLK where waiting would deadlock processes through POSIX locks on
+// the files of one mount.
+//
+// A thread that waits for a lock stays in its syscall until another
+// releases it. Under EnginePtrace the thread takes no signal but SIGKILL
+// while it waits; under EngineUnotify a signal interrupts the wait as the
+// kernel's would, and the syscall is restarted or fails with EINTR.
+
+// The i386 fcntl64 commands that take a struct flock64. F_GETLK and the
+// rest take the 32-bit struct flock from a compat task, and the native
+// struct otherwise.
+const (
+	compatGetlk64  = 12
+	compatSetlk64  = 13
+	compatSetlkw64 = 14
+)
+
+// lockTable holds the advisory locks on a mount's files, by inode number.
+type lockTable struct {
+	files map[uint64]*fileLocks
+}
+
+// lockTable returns the mount's lock table, making it on first use.
+func (m *mount) lockTable() *lockTable {
+	if m.locks == nil {
+		m.locks = &lockTable{files: make(map[uint64]*fileLocks)}
+	}
+	return m.locks
+}
+
+// fileLocks are the locks on one file, and the threads waiting to take
+// more. opens counts the open files that refer to it, which keep it in its
+// table.
+type fileLocks struct {
+	table   *lockTable
+	ino     uint64
+	records []recordLock
+	flocks  []flockLock
+	waiters []*lockWaiter
+	opens   int
+}
+
+// recordLock is a lock on the bytes of a file from start up to end, which
+// is math.MaxInt64 for a lock that runs to the end of the file however
+// far it grows. owner is the descriptor table of the process holding a
+// POSIX lock, whose pid is pid, or the open file holding an OFD lock.
+type recordLock struct {
+	owner      any
+	pid        int
+	write      bool
+	start, end int64
+}
+
+// flockLock is a flock lock held by the open file owner.
+type flockLock struct {
+	owner *vfile
+	write bool
+}
+
+// lockWaiter is a thread waiting to take a lock on a file, which it
+// retries with wake whenever the locks on the file change. The lock it
+// wants is a flock lock, or a record lock for owner.
+type lockWaiter struct {
+	locks      *fileLocks
+	owner      any
+	flock      bool
+	write      bool
+	start, end int64
+	wake       func()
+}
+
+// fileLocks returns the locks on the file f is open on, or nil if f is
+// not a file of a mount or its inode cannot be told.
+func (f *vfile) fileLocks() *fileLocks {
+	if f.locks != nil || f.mount == nil {
+		return f.locks
+	}
+	fi, err := f.file.Stat()
+	if err != nil {
+		return nil
+	}
+	st := f.mount.stat(f.path, fi)
+	t := f.mount.lockTable()
+	fl, ok := t.files[st.Ino]
+	if !ok {
+		fl = &fileLocks{table: t, ino: st.Ino}
+		t.files[st.Ino] = fl
+	}
+	fl.opens++
+	f.locks = fl
+	return fl
+}
+
+// closedBy releases the POSIX locks the process whose descriptor table is
+// owner holds on the file f is open on, as closing any of its descriptors
+// for the file does.
+func (f *vfile) closedBy(owner *fdTable) {
+	if f.mount == nil || f.mount.locks == nil || !f.mount.locks.holds(owner) {
+		return
+	}
+	if fl := f.fileLocks(); fl != nil {
+		fl.setRecord(owner, 0, unix.F_UNLCK, 0, math.MaxInt64)
+	}
+}
+
+// unlock releases the OFD and flock locks f holds, once it has been closed
+// for the last time.
+func (f *vfile) unlock() {
+	fl := f.locks
+	if fl == nil {
+		return
+	}
+	f.locks = nil
+	fl.setRecord(f, 0, unix.F_UNLCK, 0, math.MaxInt64)
+	fl.setFlock(f, unix.LOCK_UN)
+	if fl.opens--; fl.opens == 0 && len(fl.waiters) == 0 && len(fl.records) == 0 && len(fl.flocks) == 0 {
+		delete(fl.table.files, fl.ino)
+	}
+}
+
+// holds reports whether owner holds a record lock on any file in t.
+func (t *lockTable) holds(owner any) bool {
+	for _, fl := range t.files {
+		for _, l := range fl.records {
+			if l.owner == owner {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// conflicts returns the record locks of owners other than owner that keep
+// it from taking a lock on start to end.
+func (fl *fileLocks) conflicts(owner any, write bool, start, end int64) []recordLock {
+	var c []recordLock
+	for _, l := range fl.records {
+		if l.owner != owner && (write || l.write) && l.start < end && start < l.end {
+			c = append(c, l)
+		}
+	}
+	return c
+}
+
+// setRecord sets owner's lock on start to end to typ, which F_UNLCK
+// removes, splitting its locks that straddle the range and merging those
+// of the same type that it touches.
+func (fl *fileLocks) setRecord(owner any, pid, typ int, start, end int64) {
+	write := typ == unix.F_WRLCK
+	var records []recordLock
+	changed := false
+	for _, l := range fl.records {
+		touches := l.start <= end && start <= l.end
+		if l.owner != owner || !touches {
+			records = append(records, l)
+			continue
+		}
+		if typ != unix.F_UNLCK && l.write == write {
+			// Merge it into the new lock.
+			start, end = min(start, l.start), max(end, l.end)
+			continue
+		}
+		if l.start >= end || l.end <= start {
+			// Only adjacent, with a different type.
+			records = append(records, l)
+			continue
+		}
+		if l.start < start {
+			records = append(records, recordLock{owner: owner, pid: l.pid, write: l.write, start: l.start, end: start})
+		}
+		if l.end > end {
+			records = append(records, recordLock{owner: owner, pid: l.pid, write: l.write, start: end, end: l.end})
+		}
+		changed = true
+	}
+	if typ != unix.F_UNLCK {
+		records = append(records, recordLock{owner: owner, pid: pid, write: write, start: start, end: end})
+	}
+	fl.records = records
+	if changed || typ == unix.F_UNLCK {
+		fl.wake()
+	}
+}
+
+// flockConflicts reports whether another open file's flock lock keeps
+// owner from taking one.
+func (fl *fileLocks) flockConflicts(owner *vfile, write bool) bool {
+	for _, l := range fl.flocks {
+		if l.owner != owner && (write || l.write) {
+			return true
+		}
+	}
+	return false
+}
+
+// setFlock sets owner's flock lock to the LOCK_SH, LOCK_EX or LOCK_UN op.
+func (fl *fileLocks) setFlock(owner *vfile, op int) {
+	flocks := fl.flocks[:0]
+	held := false
+	for _, l := range fl.flocks {
+		if l.owner == owner {
+			held = true
+			continue
+		}
+		flocks = append(flocks, l)
+	}
+	if op != unix.LOCK_UN {
+		flocks = append(flocks, flockLock{owner: owner, write: op == unix.LOCK_EX})
+	}
+	fl.flocks = flocks
+	if held {
+		fl.wake()
+	}
+}
+
+// wait adds w to the threads waiting on fl.
+func (fl *fileLocks) wait(w *lockWaiter) {
+	w.locks = fl
+	fl.waiters = append(fl.waiters, w)
+}
+
+// wake has every thread waiting on fl retry, in the order they began to
+// wait. Those that still cannot take their lock wait again.
+func (fl *fileLocks) wake() {
+	waiters := fl.waiters
+	fl.waiters = nil
+	for _, w := range waiters {
+		if w.wake != nil {
+			w.wake()
+		}
+	}
+}
+
+// cancel stops w waiting.
+func (w *lockWaiter) cancel() {
+	fl := w.locks
+	for i, o := range fl.waiters {
+		if o == w {
+			fl.waiters = append(fl.waiters[:i], fl.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// deadlocks reports whether owner waiting for the POSIX locks in blockers
+// to go would deadlock, because one of their owners is waiting, directly
+// or through others, for a lock owner holds.
+func (t *lockTable) deadlocks(owner any, blockers []recordLock) bool {
+	seen := map[any]bool{}
+	var waitsFor func(o any) bool
+	waitsFor = func(o any) bool {
+		if o == owner {
+			return true
+		}
+		if _, ok := o.(*fdTable); !ok || seen[o] {
+			return false
+		}
+		seen[o] = true
+		for _, fl := range t.files {
+			for _, w := range fl.waiters {
+				if w.owner != o || w.flock {
+					continue
+				}
+				for _, l := range fl.conflicts(o, w.write, w.start, w.end) {
+					if waitsFor(l.owner) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	for _, l := range blockers {
+		if waitsFor(l.owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// block makes the thread wait for a lock, as w describes, instead of
+// finishing its syscall. The engine sets w.wake.
+func (th *thread) block(fl *fileLocks, w *lockWaiter) {
+	fl.wait(w)
+	th.lockWait = w
+}
+
+// relock retries the lock syscall c, which the thread has been waiting in
+// since its entry stop, and finishes it unless the thread has to wait on.
+func (th *thread) relock(c sysCall) {
+	th.lockWait = nil
+	n, _ := native(c)
+	n = canonical(n)
+	var ret int64
+	switch n.nr {
+	case unix.SYS_FCNTL:
+		ret, _ = th.sysFcntl(int(int32(n.args[0])), int(int32(n.args[1])), n.args[2])
+	case unix.SYS_FLOCK:
+		ret, _ = th.sysFlock(int(int32(n.args[0])), int(int32(n.args[1])))
+	}
+	if th.lockWait != nil {
+		th.lockWait.wake = func() { th.relock(c) }
+		return
+	}
+	regs := th.regs
+	if err := setSyscall(th.tid, &regs, ^uint64(0)); err != nil {
+		th.t.log.Printf("setregs: %v", err)
+	}
+	th.emulated, th.ret = true, ret
+	th.inSyscall = true
+	if err := th.t.resume(th, 0); err != nil {
+		th.t.log.Printf("lock: %v", err)
+	}
+}
+
+// unblock stops the thread waiting for a lock, once it has gone.
+func (th *thread) unblock() {
+	if th.lockWait != nil {
+		th.lockWait.cancel()
+		th.lockWait = nil
+	}
+}
+
+// fcntlLock serves the lock commands of fcntl on the virtual file f, whose
+// struct flock is at addr. It returns 0 with th.lockWait set if the thread
+// has to wait.
+func (th *thread) fcntlLock(f *vfile, cmd int, addr uintptr) int64 {
+	compat := th.arch == compatArch
+	layout64 := !compat
+	switch {
+	case compat && cmd >= compatGetlk64 && cmd <= compatSetlkw64:
+		cmd, layout64 = cmd-compatGetlk64+unix.F_GETLK, true
+	case compat && cmd >= unix.F_OFD_GETLK:
+		layout64 = true
+	}
+	lk, err := th.readFlock(addr, compat, layout64)
+	if err != nil {
+		return -int64(unix.EFAULT)
+	}
+	ofd := cmd >= unix.F_OFD_GETLK
+	if ofd && lk.Pid != 0 {
+		return -int64(unix.EINVAL)
+	}
+	start, end, errno := f.lockRange(lk)
+	if errno != 0 {
+		return -int64(errno)
+	}
+	typ := int(lk.Type)
+	if typ != unix.F_RDLCK && typ != unix.F_WRLCK && typ != unix.F_UNLCK {
+		return -int64(unix.EINVAL)
+	}
+	fl := f.fileLocks()
+	if fl == nil {
+		return -int64(unix.ENOLCK)
+	}
+	var owner any = th.fds
+	if ofd {
+		owner = f
+	}
+	write := typ == unix.F_WRLCK
+
+	if cmd == unix.F_GETLK || cmd == unix.F_OFD_GETLK {
+		if typ == unix.F_UNLCK {
+			return -int64(unix.EINVAL)
+		}
+		c := fl.conflicts(owner, write, start, end)
+		if len(c) == 0 {
+			lk.Type = unix.F_UNLCK
+		} else {
+			l := c[0]
+			lk = unix.Flock_t{Type: unix.F_RDLCK, Whence: io.SeekStart, Start: l.start, Pid: int32(l.pid)}
+			if l.write {
+				lk.Type = unix.F_WRLCK
+			}
+			if l.end != math.MaxInt64 {
+				lk.Len = l.end - l.start
+			}
+			if _, ok := l.owner.(*vfile); ok {
+				lk.Pid = -1
+			}
+		}
+		if err := th.mem.writeBytes(addr, encodeFlock(&lk, compat, layout64)); err != nil {
+			return -int64(unix.EFAULT)
+		}
+		return 0
+	}
+
+	acc := f.flags & unix.O_ACCMODE
+	if typ == unix.F_RDLCK && acc == unix.O_WRONLY || write && acc == unix.O_RDONLY {
+		return -int64(unix.EBADF)
+	}
+	if typ != unix.F_UNLCK {
+		if c := fl.conflicts(owner, write, start, end); len(c) > 0 {
+			if cmd != unix.F_SETLKW && cmd != unix.F_OFD_SETLKW {
+				return -int64(unix.EAGAIN)
+			}
+			if !ofd && fl.table.deadlocks(owner, c) {
+				return -int64(unix.EDEADLK)
+			}
+			th.block(fl, &lockWaiter{owner: owner, write: write, start: start, end: end})
+			return 0
+		}
+	}
+	fl.setRecord(owner, th.pid, typ, start, end)
+	return 0
+}
+
+// lockRange returns the bytes of f from start up to end that lk covers.
+func (f *vfile) lockRange(lk unix.Flock_t) (start, end int64, errno unix.Errno) {
+	var base int64
+	switch int(lk.Whence) {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		off, err := f.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, 0, errnoFor(err)
+		}
+		base = off
+	case io.SeekEnd:
+		fi, err := f.file.Stat()
+		if err != nil {
+			return 0, 0, errnoFor(err)
+		}
+		base = fi.Size()
+	default:
+		return 0, 0, unix.EINVAL
+	}
+	start = base + lk.Start
+	switch {
+	case lk.Len == 0:
+		end = math.MaxInt64
+	case lk.Len > 0:
+		end = start + lk.Len
+		if end < start {
+			return 0, 0, unix.EOVERFLOW
+		}
+	default:
+		start, end = start+lk.Len, start
+	}
+	if start < 0 {
+		return 0, 0, unix.EINVAL
+	}
+	return start, end, 0
+}
+
+// readFlock reads the struct flock at addr, in the layout of a compat
+// task's struct flock or flock64 if compat is set.
+func (th *thread) readFlock(addr uintptr, compat, layout64 bool) (unix.Flock_t, error) {
+	var lk unix.Flock_t
+	size := int(unsafe.Sizeof(lk))
+	switch {
+	case compat && layout64:
+		size = 24
+	case compat:
+		size = 16
+	}
+	b, err := th.mem.readBytes(addr, size)
+	if err != nil {
+		return lk, err
+	}
+	le := binary.LittleEndian
+	lk.Type, lk.Whence = int16(le.Uint16(b[0:])), int16(le.Uint16(b[2:]))
+	switch {
+	case compat && layout64:
+		lk.Start, lk.Len, lk.Pid = int64(le.Uint64(b[4:])), int64(le.Uint64(b[12:])), int32(le.Uint32(b[20:]))
+	case compat:
+		lk.Start, lk.Len, lk.Pid = int64(int32(le.Uint32(b[4:]))), int64(int32(le.Uint32(b[8:]))), int32(le.Uint32(b[12:]))
+	default:
+		lk.Start, lk.Len, lk.Pid = int64(le.Uint64(b[8:])), int64(le.Uint64(b[16:])), int32(le.Uint32(b[24:]))
+	}
+	return lk, nil
+}
+
+// encodeFlock encodes lk as readFlock reads it.
+func encodeFlock(lk *unix.Flock_t, compat, layout64 bool) []byte {
+	le := binary.LittleEndian
+	var b []byte
+	switch {
+	case compat && layout64:
+		b = make([]byte, 24)
+		le.PutUint64(b[4:], uint64(lk.Start))
+		le.PutUint64(b[12:], uint64(lk.Len))
+		le.PutUint32(b[20:], uint32(lk.Pid))
+	case compat:
+		b = make([]byte, 16)
+		le.PutUint32(b[4:], uint32(lk.Start))
+		le.PutUint32(b[8:], uint32(lk.Len))
+		le.PutUint32(b[12:], uint32(lk.Pid))
+	default:
+		b = make([]byte, unsafe.Sizeof(*lk))
+		le.PutUint64(b[8:], uint64(lk.Start))
+		le.PutUint64(b[16:], uint64(lk.Len))
+		le.PutUint32(b[24:], uint32(lk.Pid))
+	}
+	le.PutUint16(b[0:], uint16(lk.Type))
+	le.PutUint16(b[2:], uint16(lk.Whence))
+	return b
+}
+
+func (th *thread) sysFlock(fd, op int) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	th.t.log.Printf("flock: fd=%d op=%d (virtual)", fd, op)
+	how := op &^ unix.LOCK_NB
+	if how != unix.LOCK_SH && how != unix.LOCK_EX && how != unix.LOCK_UN {
+		return -int64(unix.EINVAL), true
+	}
+	fl := f.fileLocks()
+	if fl == nil {
+		return -int64(unix.ENOLCK), true
+	}
+	write := how == unix.LOCK_EX
+	if how != unix.LOCK_UN && fl.flockConflicts(f, write) {
+		if op&unix.LOCK_NB != 0 {
+			return -int64(unix.EWOULDBLOCK), true
+		}
+		th.block(fl, &lockWaiter{owner: f, flock: true, write: write})
+		return 0, true
+	}
+	fl.setFlock(f, how)
+	return 0, true
+}
@@ -0,0 +1,103 @@
+package tracer
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	maxStringLength = unix.PathMax
+	// maxBufferSize bounds how much data a single emulated read or write
+	// moves. Larger requests complete short, which callers must already
+	// handle.
+	maxBufferSize = 1 << 20
+)
+
+var (
+	errInvalidAddress = errors.New("tracer: invalid tracee address")
+	errStringTooLong  = errors.New("tracer: string exceeds maximum length")
+)
+
+// memory gives access to a tracee's address space.
+type memory interface {
+	// readString reads a NUL-terminated string at addr.
+	readString(addr uintptr) (string, error)
+	// readBytes copies n bytes at addr.
+	readBytes(addr uintptr, n int) ([]byte, error)
+	// writeBytes copies b to addr.
+	writeBytes(addr uintptr, b []byte) error
+}
+
+// ptraceMemory accesses the memory of a ptrace-stopped thread. Bulk access
+// goes through process_vm_readv and process_vm_writev, falling back to
+// PTRACE_PEEKDATA and PTRACE_POKEDATA a word at a time where those fail:
+// on kernels or sandboxes without them, and when writing to pages the
+// tracee cannot write itself, which ptrace may.
+type ptraceMemory int
+
+func (tid ptraceMemory) readString(addr uintptr) (string, error) {
+	s, err := vmMemory(tid).readString(addr)
+	if err == nil || err == errInvalidAddress || err == errStringTooLong {
+		return s, err
+	}
+	return tid.peekString(addr)
+}
+
+func (tid ptraceMemory) readBytes(addr uintptr, n int) ([]byte, error) {
+	b, err := vmMemory(tid).readBytes(addr, n)
+	if err == nil || err == errInvalidAddress {
+		return b, err
+	}
+	return tid.peekBytes(addr, n)
+}
+
+func (tid ptraceMemory) writeBytes(addr uintptr, b []byte) error {
+	err := vmMemory(tid).writeBytes(addr, b)
+	if err == nil || err == errInvalidAddress {
+		return err
+	}
+	return tid.pokeBytes(addr, b)
+}
+
+func (tid ptraceMemory) peekString(addr uintptr) (string, error) {
+	pid := int(tid)
+	if addr == 0 {
+		return "", errInvalidAddress
+	}
+	var (
+		buf  []byte
+		word [8]byte
+	)
+	for len(buf) < maxStringLength {
+		if _, err := unix.PtracePeekData(pid, addr, word[:]); err != nil {
+			return "", err
+		}
+		if i := bytes.IndexByte(word[:], 0); i >= 0 {
+			return string(append(buf, word[:i]...)), nil
+		}
+		buf = append(buf, word[:]...)
+		addr += uintptr(len(word))
+	}
+	return "", errStringTooLong
+}
+
+func (tid ptraceMemory) peekBytes(addr uintptr, n int) ([]byte, error) {
+	if addr == 0 {
+		return nil, errInvalidAddress
+	}
+	buf := make([]byte, n)
+	if _, err := unix.PtracePeekData(int(tid), addr, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (tid ptraceMemory) pokeBytes(addr uintptr, b []byte) error {
+	if addr == 0 {
+		return errInvalidAddress
+	}
+	_, err := unix.PtracePokeData(int(tid), addr, b)
+	return err
+}
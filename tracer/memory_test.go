@@ -0,0 +1,125 @@
+package tracer
+
+import (
+	"bytes"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// stoppedTracee starts a command that stops right after exec, traced by
+// the calling goroutine's thread, which it locks for the rest of the test.
+// It returns the tracee and its registers.
+func stoppedTracee(tb testing.TB) (ptraceMemory, unix.PtraceRegs) {
+	tb.Helper()
+	runtime.LockOSThread()
+	tb.Cleanup(runtime.UnlockOSThread)
+	cmd := exec.Command("/bin/sleep", "10")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Ptrace: true}
+	if err := cmd.Start(); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	var ws unix.WaitStatus
+	if _, err := unix.Wait4(cmd.Process.Pid, &ws, unix.WALL, nil); err != nil {
+		tb.Fatal(err)
+	}
+	var regs unix.PtraceRegs
+	if err := getRegs(cmd.Process.Pid, &regs); err != nil {
+		tb.Fatal(err)
+	}
+	return ptraceMemory(cmd.Process.Pid), regs
+}
+
+func TestMemory(t *testing.T) {
+	mem, regs := stoppedTracee(t)
+	// The stack below the pointer is mapped but unused this early. The
+	// string straddles a page boundary.
+	sp := uintptr(stackPointer(&regs))
+	addr := (sp-8192)&^(pageSize-1) - 5
+	want := strings.Repeat("straddle/", 20)
+	if err := mem.writeBytes(addr, append([]byte(want), 0)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := mem.readString(addr); err != nil || got != want {
+		t.Errorf("readString: %q, %v", got, err)
+	}
+	if got, err := mem.peekString(addr); err != nil || got != want {
+		t.Errorf("peekString: %q, %v", got, err)
+	}
+	if got, err := mem.readBytes(addr, len(want)); err != nil || string(got) != want {
+		t.Errorf("readBytes: %q, %v", got, err)
+	}
+
+	// Code is not writable by the tracee, so only the fallback can patch it.
+	pc := uintptr(instructionPointer(&regs))
+	insn := syscallInsn(&regs)
+	if err := mem.writeBytes(pc, insn); err != nil {
+		t.Fatalf("write to code: %v", err)
+	}
+	if got, err := mem.readBytes(pc, len(insn)); err != nil || !bytes.Equal(got, insn) {
+		t.Errorf("read back from code: %x, %v", got, err)
+	}
+
+	if _, err := mem.readString(0); err != errInvalidAddress {
+		t.Errorf("readString(0): %v", err)
+	}
+}
+
+// The benchmarks compare the word-at-a-time ptrace fallbacks with the
+// process_vm_* calls used first. Each sets up its own tracee, since only
+// the thread that attached may ptrace it.
+
+func benchString(b *testing.B, read func(ptraceMemory, uintptr) (string, error)) {
+	mem, regs := stoppedTracee(b)
+	addr := uintptr(stackPointer(&regs)) - 8192
+	if err := mem.writeBytes(addr, append(bytes.Repeat([]byte("p"), 255), 0)); err != nil {
+		b.Fatal(err)
+	}
+	for b.Loop() {
+		if _, err := read(mem, addr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPeekString(b *testing.B) { benchString(b, ptraceMemory.peekString) }
+func BenchmarkReadString(b *testing.B) { benchString(b, ptraceMemory.readString) }
+
+const benchSize = 16 << 10
+
+func benchBytes(b *testing.B, access func(mem ptraceMemory, addr uintptr, buf []byte) error) {
+	mem, regs := stoppedTracee(b)
+	addr := uintptr(stackPointer(&regs)) - 2*benchSize
+	buf := make([]byte, benchSize)
+	b.SetBytes(benchSize)
+	for b.Loop() {
+		if err := access(mem, addr, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPeekBytes(b *testing.B) {
+	benchBytes(b, func(mem ptraceMemory, addr uintptr, buf []byte) error {
+		_, err := mem.peekBytes(addr, len(buf))
+		return err
+	})
+}
+
+func BenchmarkReadBytes(b *testing.B) {
+	benchBytes(b, func(mem ptraceMemory, addr uintptr, buf []byte) error {
+		_, err := mem.readBytes(addr, len(buf))
+		return err
+	})
+}
+
+func BenchmarkPokeBytes(b *testing.B)  { benchBytes(b, ptraceMemory.pokeBytes) }
+func BenchmarkWriteBytes(b *testing.B) { benchBytes(b, ptraceMemory.writeBytes) }
@@ -0,0 +1,225 @@
+package tracer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics collects counts of what tracers given it WithMetrics do, for
+// monitoring a long-running command: the syscalls they intercept, by name,
+// with legacy syscalls counted as their *at forms; the stops of traced
+// threads they service, ptrace stops or seccomp notifications, whose rate
+// is the stops per second; how long each operation on a mount's backend
+// takes; the bytes read from and written to the files of each mount; and
+// the decisions about paths WithDecisionCache found kept and had to make,
+// whose ratio is its hit rate. The tracers' counts add up.
+//
+// A Metrics is an http.Handler serving them in the Prometheus text format,
+// as promhttp.Handler serves a registry, so it can be mounted at /metrics
+// for a Prometheus server to scrape. Its methods are safe for concurrent
+// use, and can be called while the command runs.
+type Metrics struct {
+	mu       sync.Mutex
+	syscalls map[string]uint64
+	stops    uint64
+	ops      map[metricsOp]*histogram
+	read     map[string]uint64
+	written  map[string]uint64
+
+	decisionHits, decisionMisses uint64
+}
+
+// metricsOp names an operation on the backend of the mount at dir.
+type metricsOp struct{ dir, op string }
+
+// NewMetrics returns a Metrics with nothing counted.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		syscalls: make(map[string]uint64),
+		ops:      make(map[metricsOp]*histogram),
+		read:     make(map[string]uint64),
+		written:  make(map[string]uint64),
+	}
+}
+
+// WithMetrics counts what the tracer does in m.
+func WithMetrics(m *Metrics) Option {
+	return func(t *Tracer) { t.metrics = m }
+}
+
+// durationBuckets are the upper bounds, in seconds, of the buckets of the
+// histograms of backend operations, from a lookup in memory to a slow
+// round trip.
+var durationBuckets = []float64{1e-5, 5e-5, 1e-4, 5e-4, 1e-3, 5e-3, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	n      uint64
+}
+
+func (m *Metrics) syscall(nr uint64) {
+	if m == nil {
+		return
+	}
+	name := syscallName(nr)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.syscalls[name]++
+}
+
+func (m *Metrics) stop() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stops++
+}
+
+func (m *Metrics) decision(hit bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if hit {
+		m.decisionHits++
+	} else {
+		m.decisionMisses++
+	}
+}
+
+// observer returns the observer that counts the operations on the
+// backend of the mount at dir.
+func (m *Metrics) observer(dir string) observer {
+	return func(_ spanOp, op, name string) func(int, error) {
+		start := time.Now()
+		return func(n int, err error) {
+			switch op {
+			case "read":
+				m.observe(dir, op, start, n, 0)
+			case "write":
+				m.observe(dir, op, start, 0, n)
+			default:
+				m.observe(dir, op, start, 0, 0)
+			}
+		}
+	}
+}
+
+// observe records that op on the mount at dir took the time since start,
+// and moved read and written bytes.
+func (m *Metrics) observe(dir, op string, start time.Time, read, written int) {
+	d := time.Since(start).Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.ops[metricsOp{dir, op}]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.ops[metricsOp{dir, op}] = h
+	}
+	for i, le := range durationBuckets {
+		if d <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += d
+	h.n++
+	if read > 0 {
+		m.read[dir] += uint64(read)
+	}
+	if written > 0 {
+		m.written[dir] += uint64(written)
+	}
+}
+
+// ServeHTTP writes the metrics as the Prometheus text format, version 0.0.4.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
+
+// WriteTo writes the metrics to w as the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	p := func(format string, args ...any) { fmt.Fprintf(cw, format, args...) }
+	header := func(name, typ, help string) {
+		p("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	header("cfc_ptrace_syscalls_total", "counter", "Syscalls the tracer intercepted, by name.")
+	for _, name := range slices.Sorted(maps.Keys(m.syscalls)) {
+		p("cfc_ptrace_syscalls_total{syscall=%s} %d\n", labelValue(name), m.syscalls[name])
+	}
+	header("cfc_ptrace_stops_total", "counter", "Stops of traced threads the tracer serviced.")
+	p("cfc_ptrace_stops_total %d\n", m.stops)
+	header("cfc_ptrace_decision_cache_hits_total", "counter", "Decisions about paths found in the decision cache.")
+	p("cfc_ptrace_decision_cache_hits_total %d\n", m.decisionHits)
+	header("cfc_ptrace_decision_cache_misses_total", "counter", "Decisions about paths the decision cache did not have.")
+	p("cfc_ptrace_decision_cache_misses_total %d\n", m.decisionMisses)
+
+	const op = "cfc_ptrace_backend_op_duration_seconds"
+	header(op, "histogram", "Time taken by operations on the backends of mounts.")
+	keys := slices.SortedFunc(maps.Keys(m.ops), func(a, b metricsOp) int {
+		return strings.Compare(a.dir+"\x00"+a.op, b.dir+"\x00"+b.op)
+	})
+	for _, k := range keys {
+		h := m.ops[k]
+		labels := fmt.Sprintf("mount=%s,op=%s", labelValue(k.dir), labelValue(k.op))
+		for i, le := range durationBuckets {
+			p("%s_bucket{%s,le=%q} %d\n", op, labels, strconv.FormatFloat(le, 'g', -1, 64), h.counts[i])
+		}
+		p("%s_bucket{%s,le=\"+Inf\"} %d\n", op, labels, h.n)
+		p("%s_sum{%s} %s\n", op, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		p("%s_count{%s} %d\n", op, labels, h.n)
+	}
+	for _, c := range []struct {
+		name, help string
+		bytes      map[string]uint64
+	}{
+		{"cfc_ptrace_mount_read_bytes_total", "Bytes read from the files of mounts.", m.read},
+		{"cfc_ptrace_mount_written_bytes_total", "Bytes written to the files of mounts.", m.written},
+	} {
+		header(c.name, "counter", c.help)
+		for _, dir := range slices.Sorted(maps.Keys(c.bytes)) {
+			p("%s{mount=%s} %d\n", c.name, labelValue(dir), c.bytes[dir])
+		}
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// labelValue returns s quoted as a label value of the text format, which
+// escapes only backslashes, double quotes and newlines.
+func labelValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
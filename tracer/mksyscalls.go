@@ -0,0 +1,479 @@
+//go:build ignore
+
+// Mksyscalls writes zsyscalls_GOARCH.go, the syscall tables of each
+// architecture the tracer supports, from syscalls.txt and the syscall
+// numbers golang.org/x/sys/unix generates from the kernel's headers, in
+// the version go.mod requires. Run it in the tracer's directory:
+//
+//	go run mksyscalls.go [-d dir]
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// arches are the architectures tables are written for, and the GOARCH of
+// the 32-bit ABI each translates, if any.
+var arches = []struct{ goarch, compat string }{
+	{"amd64", "386"},
+	{"arm64", ""},
+}
+
+// kinds maps the kinds of syscalls.txt to their argKinds.
+var kinds = map[string]string{
+	"int": "argInt", "hex": "argHex", "fd": "argFD", "dirfd": "argDirFD",
+	"path": "argPath", "str": "argStr", "bufin": "argBufIn", "bufout": "argBufOut",
+	"mode": "argMode", "openflags": "argOpenFlags", "openmode": "argOpenMode",
+	"atflags": "argAtFlags", "whence": "argWhence", "prot": "argProt",
+	"mapflags": "argMapFlags", "fcntlcmd": "argFcntlCmd", "flockop": "argFlockOp",
+	"fallocmode": "argFallocMode", "openhow": "argOpenHow",
+	"cloneflags": "argCloneFlags", "cloneargs": "argCloneArgs",
+}
+
+// syscall is a line of syscalls.txt.
+type syscall struct {
+	name   string
+	args   []string
+	hexRet bool
+	// trap, write and poll are whether enter handles the syscall, whether
+	// read-only mode checks it, and whether polls of virtual descriptors
+	// need it trapped.
+	trap, write, poll bool
+	// as is the *at syscall canonical rewrites this one as, if any, with
+	// the arguments asArgs gives it.
+	as     string
+	asArgs []string
+	// compat are the 32-bit syscalls translated to this one.
+	compat []compatSyscall
+	line   int
+}
+
+// compatSyscall is a 32-bit syscall translated to a native one, whose
+// arguments args says how to widen, if they are not just zero-extended.
+type compatSyscall struct {
+	name string
+	args []string
+}
+
+// fileArgs returns the positions of the arguments that name the file of
+// the syscall, as syscallSpec has them.
+func (s *syscall) fileArgs() (fd, path int) {
+	for i, k := range s.args {
+		if k != "path" {
+			continue
+		}
+		if i > 0 && s.args[i-1] == "dirfd" {
+			return i - 1, i
+		}
+		return -1, i
+	}
+	return slices.Index(s.args, "fd"), -1
+}
+
+// constName returns the name of the constant prefix makes of the syscall
+// name, as sysLlseek is of _llseek.
+func constName(prefix, name string) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+	for _, part := range strings.Split(name, "_") {
+		if part != "" {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("mksyscalls: ")
+	dir := flag.String("d", ".", "write the tables into `dir`")
+	flag.Parse()
+
+	syscalls, err := readSpecs("syscalls.txt")
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}} {{.Version}}", "golang.org/x/sys").Output()
+	if err != nil {
+		log.Fatalf("finding golang.org/x/sys: %v", err)
+	}
+	sysDir, version, _ := strings.Cut(strings.TrimSpace(string(out)), " ")
+	numbers := make(map[string]map[string]uint64)
+	for _, a := range arches {
+		for _, goarch := range []string{a.goarch, a.compat} {
+			if goarch == "" || numbers[goarch] != nil {
+				continue
+			}
+			if numbers[goarch], err = readNumbers(filepath.Join(sysDir, "unix", "zsysnum_linux_"+goarch+".go")); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	for _, a := range arches {
+		src, err := table(syscalls, numbers, a.goarch, a.compat, version)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(*dir, "zsyscalls_"+a.goarch+".go"), src, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+var (
+	specLine   = regexp.MustCompile(`^(\w+)\(([\w, ]*)\)((?: +\S+)*)$`)
+	callField  = regexp.MustCompile(`^(\w+)(?:\(([\w|:,]*)\))?$`)
+	compatList = regexp.MustCompile(`\w+(?:\([\w:,]*\))?`)
+	compatArg  = regexp.MustCompile(`^(?:\d|s\d|id\d|\d:\d)$`)
+	canonArg   = regexp.MustCompile(`^(?:\d|[A-Z_]+(?:\|[A-Z_]+)*)$`)
+)
+
+// splitArgs returns the arguments of a field's comma-separated list,
+// checking each against valid.
+func splitArgs(list string, valid *regexp.Regexp) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	args := strings.Split(list, ",")
+	for _, a := range args {
+		if !valid.MatchString(a) {
+			return nil, fmt.Errorf("bad argument %q", a)
+		}
+	}
+	return args, nil
+}
+
+// compatField parses the i386 syscalls of a field, named for the syscall
+// name itself unless it lists them after =.
+func compatField(f, name string) ([]compatSyscall, error) {
+	rest := strings.TrimPrefix(f, "i386")
+	var calls []string
+	switch {
+	case rest == "" || rest[0] == '(':
+		calls = []string{name + rest}
+	case rest[0] == '=':
+		rest = rest[1:]
+		calls = compatList.FindAllString(rest, -1)
+		if strings.Join(calls, ",") != rest {
+			return nil, fmt.Errorf("bad field %q", f)
+		}
+	default:
+		return nil, fmt.Errorf("unknown field %q", f)
+	}
+	var compat []compatSyscall
+	for _, call := range calls {
+		m := callField.FindStringSubmatch(call)
+		if m == nil {
+			return nil, fmt.Errorf("bad field %q", f)
+		}
+		args, err := splitArgs(m[2], compatArg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		compat = append(compat, compatSyscall{name: m[1], args: args})
+	}
+	return compat, nil
+}
+
+// readSpecs parses the syscalls of the file name.
+func readSpecs(name string) ([]*syscall, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		syscalls []*syscall
+		seen     = make(map[string]bool)
+	)
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := specLine.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("%s:%d: bad line %q", name, n, line)
+		}
+		s := &syscall{name: m[1], line: n}
+		if seen[s.name] {
+			return nil, fmt.Errorf("%s:%d: %s given twice", name, n, s.name)
+		}
+		seen[s.name] = true
+		if m[2] != "" {
+			for _, k := range strings.Split(m[2], ",") {
+				k = strings.TrimSpace(k)
+				if kinds[k] == "" {
+					return nil, fmt.Errorf("%s:%d: unknown kind %q", name, n, k)
+				}
+				s.args = append(s.args, k)
+			}
+		}
+		if len(s.args) > 6 {
+			return nil, fmt.Errorf("%s:%d: more than six arguments", name, n)
+		}
+		for _, f := range strings.Fields(m[3]) {
+			var err error
+			switch {
+			case f == "hex":
+				s.hexRet = true
+			case f == "trap":
+				s.trap = true
+			case f == "write":
+				s.write = true
+			case f == "poll":
+				s.poll = true
+			case strings.HasPrefix(f, "as="):
+				m := callField.FindStringSubmatch(strings.TrimPrefix(f, "as="))
+				if m == nil {
+					return nil, fmt.Errorf("%s:%d: bad field %q", name, n, f)
+				}
+				s.as = m[1]
+				if s.asArgs, err = splitArgs(m[2], canonArg); err != nil {
+					return nil, fmt.Errorf("%s:%d: %s: %v", name, n, f, err)
+				}
+			case strings.HasPrefix(f, "i386"):
+				if s.compat, err = compatField(f, s.name); err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", name, n, err)
+				}
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown field %q", name, n, f)
+			}
+		}
+		syscalls = append(syscalls, s)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for _, s := range syscalls {
+		if s.as != "" && !slices.ContainsFunc(syscalls, func(t *syscall) bool { return t.name == s.as }) {
+			return nil, fmt.Errorf("%s:%d: %s is rewritten as unknown %s", name, s.line, s.name, s.as)
+		}
+	}
+	return syscalls, nil
+}
+
+var sysnumLine = regexp.MustCompile(`^\tSYS_(\w+)\s*=\s*(\d+)$`)
+
+// readNumbers reads the syscall numbers of a zsysnum file of x/sys, by
+// the names the kernel gives them.
+func readNumbers(name string) (map[string]uint64, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	nrs := make(map[string]uint64)
+	for _, line := range strings.Split(string(b), "\n") {
+		if m := sysnumLine.FindStringSubmatch(line); m != nil {
+			nr, err := strconv.ParseUint(m[2], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			nrs[strings.ToLower(m[1])] = nr
+		}
+	}
+	if len(nrs) == 0 {
+		return nil, fmt.Errorf("%s: no syscall numbers", name)
+	}
+	return nrs, nil
+}
+
+// table returns the source of the tables of goarch.
+func table(syscalls []*syscall, numbers map[string]map[string]uint64, goarch, compat, version string) ([]byte, error) {
+	native := numbers[goarch]
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by mksyscalls.go from syscalls.txt and golang.org/x/sys %s. DO NOT EDIT.\n\n", version)
+	b.WriteString("package tracer\n\nimport \"golang.org/x/sys/unix\"\n\n")
+
+	// Syscalls some architecture lacks are numbered by constants, which
+	// stand in with numbers no syscall has where there is none.
+	nr := make(map[string]string)
+	var sentinels []string
+	for _, s := range syscalls {
+		if _, ok := native[s.name]; ok {
+			nr[s.name] = "unix.SYS_" + strings.ToUpper(s.name)
+		}
+		for _, a := range arches {
+			if _, ok := numbers[a.goarch][s.name]; !ok {
+				sentinels = append(sentinels, s.name)
+				break
+			}
+		}
+	}
+	b.WriteString("// The syscalls only some architectures have. Those this one lacks have\n// numbers no syscall has.\nconst (\n")
+	for i, name := range sentinels {
+		v, ok := nr[name]
+		if !ok {
+			v = fmt.Sprintf("^uint64(0) - %d", i+1)
+		}
+		fmt.Fprintf(&b, "\t%s = %s\n", constName("sys", name), v)
+		nr[name] = constName("sys", name)
+	}
+	b.WriteString(")\n\n")
+
+	type compatEntry struct {
+		nr       uint64
+		name, to string
+		args     []string
+	}
+	var compats []compatEntry
+	if compat != "" {
+		for _, s := range syscalls {
+			for _, c := range s.compat {
+				n, ok := numbers[compat][c.name]
+				if !ok {
+					return nil, fmt.Errorf("syscalls.txt:%d: %s has no %s syscall %s", s.line, s.name, compat, c.name)
+				}
+				compats = append(compats, compatEntry{nr: n, name: c.name, to: nr[s.name], args: c.args})
+			}
+		}
+		slices.SortFunc(compats, func(a, b compatEntry) int { return int(a.nr) - int(b.nr) })
+	}
+	// A syscall is in the tables if this architecture has it, or the
+	// 32-bit ABI it translates does.
+	known := func(s *syscall) bool {
+		_, ok := native[s.name]
+		return ok || slices.ContainsFunc(compats, func(c compatEntry) bool { return c.to == nr[s.name] })
+	}
+
+	b.WriteString("// syscallSpecs describes the syscalls the tracer knows, by native number.\nvar syscallSpecs = map[uint64]syscallSpec{\n")
+	for _, s := range syscalls {
+		if !known(s) {
+			continue
+		}
+		fmt.Fprintf(&b, "\t%s: {name: %q", nr[s.name], s.name)
+		if len(s.args) > 0 {
+			args := make([]string, len(s.args))
+			for i, k := range s.args {
+				args[i] = kinds[k]
+			}
+			fmt.Fprintf(&b, ", args: []argKind{%s}", strings.Join(args, ", "))
+		}
+		if s.hexRet {
+			b.WriteString(", hexRet: true")
+		}
+		fd, path := s.fileArgs()
+		fmt.Fprintf(&b, ", fd: %d, path: %d},\n", fd, path)
+	}
+	b.WriteString("}\n\n")
+
+	for _, l := range []struct {
+		doc, name string
+		in        func(*syscall) bool
+	}{
+		{"intercepted lists every syscall enter handles, all of which the seccomp\nfilter traps.", "intercepted", func(s *syscall) bool { return s.trap }},
+		{"writeSyscalls lists the syscalls, beyond those intercepted anyway, that\nread-only mode has to check.", "writeSyscalls", func(s *syscall) bool { return s.write }},
+		{"legacyWriteSyscalls are the legacy forms of writeSyscalls, which canonical\nrewrites as their *at forms.", "legacyWriteSyscalls", func(s *syscall) bool { return s.write && s.as != "" }},
+		{"polledSyscalls lists the syscalls, beyond those intercepted anyway, that\npolls of virtual descriptors need trapped.", "polledSyscalls", func(s *syscall) bool { return s.poll }},
+	} {
+		fmt.Fprintf(&b, "// %s\nvar %s = []uint64{\n", strings.ReplaceAll(l.doc, "\n", "\n// "), l.name)
+		for _, s := range syscalls {
+			if known(s) && l.in(s) {
+				fmt.Fprintf(&b, "\t%s,\n", nr[s.name])
+			}
+		}
+		b.WriteString("}\n\n")
+	}
+
+	// Rewrites and widenings that come out the same share a case.
+	type rewrite struct {
+		cases []string
+		body  string
+	}
+	add := func(rewrites []*rewrite, c, body string) []*rewrite {
+		for _, r := range rewrites {
+			if r.body == body {
+				r.cases = append(r.cases, c)
+				return rewrites
+			}
+		}
+		return append(rewrites, &rewrite{cases: []string{c}, body: body})
+	}
+	writeCases := func(rewrites []*rewrite) {
+		for _, r := range rewrites {
+			fmt.Fprintf(&b, "\tcase %s:\n\t\t%s\n", strings.Join(r.cases, ", "), r.body)
+		}
+	}
+
+	var canon []*rewrite
+	for _, s := range syscalls {
+		if s.as == "" || !known(s) {
+			continue
+		}
+		args := make([]string, len(s.asArgs))
+		for i, a := range s.asArgs {
+			switch {
+			case a[0] >= '0' && a[0] <= '9':
+				args[i] = "c.args[" + a + "]"
+			case a == "AT_FDCWD":
+				args[i] = "uint64(cwd)"
+			default:
+				args[i] = "unix." + strings.ReplaceAll(a, "|", " | unix.")
+			}
+		}
+		canon = add(canon, nr[s.name], fmt.Sprintf("return sysCall{arch: c.arch, nr: %s, args: [6]uint64{%s}}", nr[s.as], strings.Join(args, ", ")))
+	}
+	b.WriteString("// canonical rewrites a legacy syscall as its *at equivalent, so that enter\n// only has to handle the syscalls every architecture provides.\nfunc canonical(c sysCall) sysCall {\n")
+	if len(canon) > 0 {
+		b.WriteString("\tcwd := int64(unix.AT_FDCWD)\n\tswitch c.nr {\n")
+		writeCases(canon)
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("\treturn c\n}\n\n")
+
+	if compat == "" {
+		b.WriteString("var compatSyscalls map[uint64]uint64\n")
+	} else {
+		fmt.Fprintf(&b, "// compatSyscalls maps the %s numbers of the syscalls the tracer\n// translates to their native equivalents.\nvar compatSyscalls = map[uint64]uint64{\n", compat)
+		for _, c := range compats {
+			fmt.Fprintf(&b, "\t%s: %s,\n", constName("compat", c.name), c.to)
+		}
+		fmt.Fprintf(&b, "}\n\n// The %s numbers of the syscalls compatSyscalls translates.\nconst (\n", compat)
+		for _, c := range compats {
+			fmt.Fprintf(&b, "\t%s = %d\n", constName("compat", c.name), c.nr)
+		}
+		b.WriteString(")\n\n")
+
+		var widen []*rewrite
+		for _, c := range compats {
+			var lhs, rhs []string
+			for i, a := range c.args {
+				var e string
+				switch {
+				case strings.HasPrefix(a, "s"):
+					e = "uint64(int32(a[" + a[1:] + "]))"
+				case strings.HasPrefix(a, "id"):
+					e = "compatID(a[" + a[2:] + "])"
+				case strings.Contains(a, ":"):
+					lo, hi, _ := strings.Cut(a, ":")
+					e = "a[" + lo + "] | a[" + hi + "]<<32"
+				default:
+					e = "a[" + a + "]"
+				}
+				if e != fmt.Sprintf("a[%d]", i) {
+					lhs = append(lhs, fmt.Sprintf("a[%d]", i))
+					rhs = append(rhs, e)
+				}
+			}
+			if lhs != nil {
+				widen = add(widen, constName("compat", c.name), strings.Join(lhs, ", ")+" = "+strings.Join(rhs, ", "))
+			}
+		}
+		fmt.Fprintf(&b, "// compatArgs widens the arguments a of the %s syscall nr, each\n// zero-extended, to those of its native equivalent.\nfunc compatArgs(nr uint64, a *[6]uint64) {\n\tswitch nr {\n", compat)
+		writeCases(widen)
+		b.WriteString("\t}\n}\n")
+	}
+	return format.Source(b.Bytes())
+}
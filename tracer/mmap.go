@@ -0,0 +1,209 @@
+package tracer
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// mapping is a mmap of a virtual file in progress. The kernel cannot map a
+// virtual file, so a memfd holding a copy of its contents is mapped in its
+// place. Changes made through a MAP_SHARED mapping stay in the memfd and
+// never reach the backend.
+//
+// Under the ptrace engine the mmap becomes three syscalls in the thread:
+// memfd_create, the mmap itself with the memfd substituted, and a
+// close_range of the memfd. Each is started by winding the thread back
+// over its syscall instruction at the previous one's exit stop.
+type mapping struct {
+	file *vfile
+	fd   int
+	step int
+	// memfd is the memfd's descriptor number in the thread.
+	memfd int
+	// ret is the result of the mmap, to be returned once the memfd is
+	// closed.
+	ret int64
+	// scratch is where the memfd's name was written below the stack
+	// pointer, and saved holds the bytes it covered.
+	scratch uintptr
+	saved   []byte
+}
+
+const (
+	mapCreate = iota
+	mapMap
+	mapClose
+)
+
+// memfdName is the name the memfds backing mappings, and the files of
+// WithPassthrough, are created with.
+const memfdName = "cfc-mmap"
+
+func (th *thread) sysMmap(prot, flags, fd int) (int64, bool) {
+	if flags&unix.MAP_ANONYMOUS != 0 {
+		return 0, false
+	}
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	th.t.log.Printf("mmap: fd=%d (virtual)", fd)
+	fi, err := f.file.Stat()
+	if err != nil {
+		return errnoRet(err), true
+	}
+	if !fi.Mode().IsRegular() {
+		return -int64(unix.ENODEV), true
+	}
+	acc := f.flags & unix.O_ACCMODE
+	shared := flags&unix.MAP_TYPE != unix.MAP_PRIVATE
+	writable := shared && prot&unix.PROT_WRITE != 0
+	if acc == unix.O_WRONLY || writable && acc != unix.O_RDWR {
+		return -int64(unix.EACCES), true
+	}
+	if writable {
+		th.t.log.Printf("mmap: writes through a shared mapping of %s will not reach the backend", f.path)
+	}
+	th.mapping = &mapping{file: f, fd: fd}
+	return 0, false
+}
+
+// fill copies the whole of f into w.
+func (f *vfile) fill(w io.Writer) error {
+	_, err := io.Copy(w, io.NewSectionReader(f.file, 0, math.MaxInt64))
+	return err
+}
+
+// startMapping replaces the mmap the thread is entering with memfd_create.
+func (th *thread) startMapping() error {
+	m := th.mapping
+	name := append([]byte(memfdName), 0)
+	// The name goes below the stack pointer, past the amd64 red zone.
+	m.scratch = uintptr(stackPointer(&th.regs)-256) &^ 15
+	saved, err := th.mem.readBytes(m.scratch, len(name))
+	if err != nil {
+		return err
+	}
+	if err := th.mem.writeBytes(m.scratch, name); err != nil {
+		return err
+	}
+	m.saved = saved
+	regs := th.regs
+	return rewriteSyscall(th.tid, &regs, th.arch, unix.SYS_MEMFD_CREATE, uint64(m.scratch), unix.MFD_CLOEXEC)
+}
+
+// mappingExit runs at the exit stop of each step of a mapping and starts
+// the next one. Once the memfd is closed, the thread's registers are put
+// back as they were at the mmap and it returns the mmap's result.
+func (th *thread) mappingExit() {
+	m := th.mapping
+	var regs unix.PtraceRegs
+	if err := getRegs(th.tid, &regs); err != nil {
+		th.t.log.Printf("getregs: %v", err)
+		th.mapping = nil
+		return
+	}
+	ret := int64(returnValue(&regs))
+	regs = th.regs
+	var err error
+	switch m.step {
+	case mapCreate:
+		_ = th.mem.writeBytes(m.scratch, m.saved)
+		if ret < 0 {
+			th.finishMapping(ret)
+			return
+		}
+		m.memfd = int(ret)
+		if err := th.fillMemfd(m.memfd, m.file.file, m.file.path); err != nil {
+			th.t.log.Printf("mmap: %v", err)
+			m.ret = errnoRet(err)
+			m.step = mapClose
+			err = th.restart(&regs, unix.SYS_CLOSE_RANGE, uint64(m.memfd), uint64(m.memfd), 0)
+			break
+		}
+		// Repeat the mmap as made, with only the descriptor changed.
+		*argRegs(&regs, th.arch == compatArch)[4] = uint64(m.memfd)
+		rewind(&regs, syscallNo(&th.regs))
+		m.step = mapMap
+		err = setRegs(th.tid, &regs)
+	case mapMap:
+		m.ret = ret
+		m.step = mapClose
+		err = th.restart(&regs, unix.SYS_CLOSE_RANGE, uint64(m.memfd), uint64(m.memfd), 0)
+	case mapClose:
+		th.finishMapping(m.ret)
+		return
+	}
+	if err != nil {
+		th.t.log.Printf("setregs: %v", err)
+		th.mapping = nil
+	}
+}
+
+// restart makes the thread execute native syscall nr with args when it
+// resumes from the current exit stop. regs are the registers to start from.
+func (th *thread) restart(regs *unix.PtraceRegs, nr uint64, args ...uint64) error {
+	rewind(regs, loadSyscall(regs, th.arch, nr, args))
+	return setRegs(th.tid, regs)
+}
+
+func (th *thread) finishMapping(ret int64) {
+	th.mapping = nil
+	if th.hooked != nil {
+		ret, _ = th.hookExit(ret)
+	}
+	regs := th.regs
+	setReturn(&regs, uint64(ret))
+	if err := setRegs(th.tid, &regs); err != nil {
+		th.t.log.Printf("setregs: %v", err)
+	}
+}
+
+// fillMemfd copies the whole of file, the virtual file p, into the memfd the
+// thread has created as memfd.
+func (th *thread) fillMemfd(memfd int, file vfs.File, p string) error {
+	f, err := os.OpenFile(fmt.Sprintf("/proc/%d/fd/%d", th.tid, memfd), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	th.t.noteMemfd(f, p)
+	_, err = io.Copy(f, io.NewSectionReader(file, 0, math.MaxInt64))
+	return err
+}
+
+// addMapping serves a mapping under the unotify engine, where the syscall
+// cannot be rewritten: a memfd replaces the placeholder at the mapped
+// descriptor's number, so that the mmap goes through unchanged. This only
+// works below fdBase; virtual descriptors above it cannot be mapped. Like
+// the placeholder, the memfd is not close-on-exec.
+func (t *Tracer) addMapping(listener int, id uint64, th *thread) error {
+	m := th.mapping
+	if m.fd >= fdBase {
+		return unix.ENODEV
+	}
+	fd, err := unix.MemfdCreate(memfdName, unix.MFD_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), memfdName)
+	defer f.Close()
+	if err := m.file.fill(f); err != nil {
+		return err
+	}
+	t.noteMemfd(f, m.file.path)
+	addfd := seccompNotifAddfd{
+		ID:    id,
+		Flags: unix.SECCOMP_ADDFD_FLAG_SETFD,
+		Srcfd: uint32(fd),
+		Newfd: uint32(m.fd),
+	}
+	return notifIoctl(listener, unix.SECCOMP_IOCTL_NOTIF_ADDFD, unsafe.Pointer(&addfd))
+}
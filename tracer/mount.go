@@ -0,0 +1,165 @@
+package tracer
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// WithMount routes every path at or below dir to b. dir must be absolute;
+// it does not need to exist on the host. When mounts nest, the longest
+// matching dir wins.
+func WithMount(dir string, b vfs.Backend, opts ...MountOption) Option {
+	return func(t *Tracer) {
+		m := mount{dir: path.Clean(dir), backend: b}
+		m.changes, _ = b.(vfs.Changer)
+		for _, opt := range opts {
+			opt(&m)
+		}
+		t.mounts = append(t.mounts, m)
+	}
+}
+
+// MountOption configures a mount.
+type MountOption func(*mount)
+
+// Owner reports every file in the mount as owned by uid and gid, whatever
+// the backend says. Without it, ownership comes from the backend.
+func Owner(uid, gid uint32) MountOption {
+	return func(m *mount) { m.owner = &owner{uid: uid, gid: gid} }
+}
+
+// Perm reports the permission bits of every regular file in the mount as
+// file, and those of every directory as dir, whatever the backend says.
+// Only what stat reports changes; the backend still decides what access
+// is allowed.
+func Perm(file, dir fs.FileMode) MountOption {
+	return func(m *mount) { m.perm = &perm{file: file, dir: dir} }
+}
+
+type mount struct {
+	dir     string
+	backend vfs.Backend
+	owner   *owner
+	perm    *perm
+	// locks are the advisory locks on the mount's files.
+	locks *lockTable
+	// throttle limits the mount's IO, if Throttle was given.
+	throttle *throttle
+	// changes counts the changes others make to the backend, if it is a
+	// vfs.Changer.
+	changes vfs.Changer
+}
+
+type owner struct{ uid, gid uint32 }
+
+type perm struct{ file, dir fs.FileMode }
+
+// Remap redirects part of the tracee's view of the filesystem, like a bind
+// mount. From is an absolute path, and may be a path.Match pattern; paths
+// it matches, and everything below them, are replaced by To before mounts
+// are consulted. A path remapped into a mount is served by that mount's
+// backend. One remapped anywhere else is served from the host, by the
+// tracer itself and with the tracer's credentials.
+//
+// The paths of Unix domain sockets given to connect, bind and sendto are
+// remapped too. A socket in a mount is made where its backend keeps it, as
+// a vfs.Socketer says; connecting to one in a backend that keeps none
+// fails with ECONNREFUSED.
+//
+// Rules are tried in the order given, and only the first that matches is
+// applied. A malformed pattern never matches.
+type Remap struct {
+	From string
+	To   string
+}
+
+// WithRemap adds remapping rules, after any added before.
+func WithRemap(rules ...Remap) Option {
+	return func(t *Tracer) {
+		for _, r := range rules {
+			t.remaps = append(t.remaps, Remap{From: path.Clean(r.From), To: path.Clean(r.To)})
+		}
+	}
+}
+
+// apply returns p remapped by r and whether r matches it.
+func (r Remap) apply(p string) (string, bool) {
+	prefix, ok := matchPrefix(r.From, p)
+	if !ok {
+		return "", false
+	}
+	return path.Join(r.To, strings.TrimPrefix(p, prefix)), true
+}
+
+// matchPrefix returns the leading elements of the absolute path p that the
+// absolute pattern matches, and whether it matches any.
+func matchPrefix(pattern, p string) (string, bool) {
+	if pattern == "/" {
+		return "/", true
+	}
+	// A pattern element never matches a slash, so the part of p it can
+	// match has as many elements as the pattern.
+	n := strings.Count(pattern, "/")
+	elems := strings.SplitAfterN(p, "/", n+2)
+	if len(elems) <= n {
+		return "", false
+	}
+	prefix := strings.TrimSuffix(strings.Join(elems[:n+1], ""), "/")
+	if ok, _ := path.Match(pattern, prefix); !ok {
+		return "", false
+	}
+	return prefix, true
+}
+
+// lookup returns the mount that owns the absolute, clean path p and the
+// name of p within that mount's backend, once any remapping rule has been
+// applied. Paths remapped outside every mount belong to t.host. The files
+// of WithResolver come before either.
+func (t *Tracer) lookup(p string) (*mount, string, bool) {
+	if m, name, ok := t.resolverFile(p); ok {
+		return m, name, true
+	}
+	for _, r := range t.remaps {
+		if q, ok := r.apply(p); ok {
+			if m, name, ok := t.mountFor(q); ok {
+				return m, name, true
+			}
+			if q == "/" {
+				return &t.host, ".", true
+			}
+			return &t.host, q[1:], true
+		}
+	}
+	return t.mountFor(p)
+}
+
+// inDir reports whether the absolute, clean path p is dir or below it.
+func inDir(p, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// mountFor returns the mount p is under, without remapping.
+func (t *Tracer) mountFor(p string) (*mount, string, bool) {
+	var (
+		best *mount
+		name string
+	)
+	for i := range t.mounts {
+		m := &t.mounts[i]
+		if best != nil && len(m.dir) <= len(best.dir) {
+			continue
+		}
+		switch {
+		case p == m.dir:
+			best, name = m, "."
+		case m.dir == "/":
+			best, name = m, p[1:]
+		case strings.HasPrefix(p, m.dir+"/"):
+			best, name = m, p[len(m.dir)+1:]
+		}
+	}
+	return best, name, best != nil
+}
@@ -0,0 +1,364 @@
+package tracer
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// virtualPath reads the path argument at addr, resolves it against dirfd
+// and looks up the mount it falls under, as lookupArg does. It reports
+// false if the path is neither virtual nor served from the host, or cannot
+// be read, leaving the syscall to the kernel. A path that leads nowhere in
+// the virtual tree is reported with the negated errno the syscall fails
+// with as ret, and no mount.
+func (th *thread) virtualPath(dirfd int, addr uintptr) (abs string, m *mount, name string, ret int64, ok bool) {
+	p, err := th.mem.readString(addr)
+	if err != nil || p == "" {
+		return "", nil, "", 0, false
+	}
+	var through bool
+	if abs, through, err = th.resolveArg(dirfd, p); err != nil {
+		ret, ok = resolveFailed(err)
+		return "", nil, "", ret, ok
+	}
+	m, name, ok = th.lookupArg(abs, through)
+	return abs, m, name, 0, ok
+}
+
+// lookupArg is lookup for abs, where a path argument leads as resolveArg
+// has it. A host path the kernel would not find from the argument, as
+// through reports, is served from the host, as follow serves one that a
+// symlink leads to.
+func (th *thread) lookupArg(abs string, through bool) (*mount, string, bool) {
+	if m, name, ok := th.t.lookup(abs); ok || !through {
+		return m, name, ok
+	}
+	return &th.t.host, th.ownProc(path.Join(".", abs)), true
+}
+
+// virtualTarget is virtualPath for a syscall that follows a final symlink,
+// and returns where the path leads, as follow does.
+func (th *thread) virtualTarget(dirfd int, addr uintptr) (abs string, m *mount, name string, ret int64, ok bool) {
+	if abs, m, name, ret, ok = th.virtualPath(dirfd, addr); !ok || ret < 0 {
+		return abs, m, name, ret, ok
+	}
+	var err error
+	if abs, m, name, err = th.follow(abs); err != nil {
+		return "", nil, "", errnoRet(err), true
+	}
+	return abs, m, name, 0, true
+}
+
+func (th *thread) sysMkdirat(dirfd int, pathAddr uintptr, mode uint32) (int64, bool) {
+	abs, m, name, ret, ok := th.virtualPath(dirfd, pathAddr)
+	if !ok || ret < 0 {
+		return ret, ok
+	}
+	th.t.log.Printf("mkdirat: %s (virtual)", abs)
+	perm := fs.FileMode(mode &^ th.umask() & 0o777)
+	if mode&unix.S_ISVTX != 0 {
+		perm |= fs.ModeSticky
+	}
+	if err := m.backend.Mkdir(name, perm); err != nil {
+		return errnoRet(err), true
+	}
+	return 0, true
+}
+
+// sysUnlinkat also handles unlink and rmdir, which canonical turns into
+// unlinkat calls.
+func (th *thread) sysUnlinkat(dirfd int, pathAddr uintptr, flags int) (int64, bool) {
+	abs, m, name, ret, ok := th.virtualPath(dirfd, pathAddr)
+	if !ok || ret < 0 {
+		return ret, ok
+	}
+	th.t.log.Printf("unlinkat: %s (virtual)", abs)
+	var err error
+	switch flags {
+	case 0:
+		err = m.backend.Unlink(name)
+	case unix.AT_REMOVEDIR:
+		err = m.backend.Rmdir(name)
+	default:
+		return -int64(unix.EINVAL), true
+	}
+	if err != nil {
+		return errnoRet(err), true
+	}
+	return 0, true
+}
+
+// sysRenameat2 also handles rename and renameat. Neither path may lead out
+// of the mount the other is in.
+func (th *thread) sysRenameat2(olddirfd int, oldAddr uintptr, newdirfd int, newAddr uintptr, flags uint) (int64, bool) {
+	oldAbs, om, oldName, oldRet, oldOK := th.virtualPath(olddirfd, oldAddr)
+	newAbs, nm, newName, newRet, newOK := th.virtualPath(newdirfd, newAddr)
+	switch {
+	case !oldOK && !newOK:
+		return 0, false
+	case oldRet < 0:
+		return oldRet, true
+	case newRet < 0:
+		return newRet, true
+	}
+	th.t.log.Printf("renameat2: %s to %s (virtual)", oldAbs, newAbs)
+	switch {
+	case om != nm:
+		return -int64(unix.EXDEV), true
+	case flags&^unix.RENAME_NOREPLACE != 0:
+		// RENAME_EXCHANGE and RENAME_WHITEOUT have no backend support.
+		return -int64(unix.EINVAL), true
+	case flags&unix.RENAME_NOREPLACE != 0:
+		if _, err := nm.backend.Lstat(newName); err == nil {
+			return -int64(unix.EEXIST), true
+		}
+	}
+	if err := om.backend.Rename(oldName, newName); err != nil {
+		return errnoRet(err), true
+	}
+	return 0, true
+}
+
+// sysLinkat also handles link. Both paths must be in the same mount. An
+// open virtual file, named by AT_EMPTY_PATH or its link in /proc, is
+// linked by linkFile.
+func (th *thread) sysLinkat(olddirfd int, oldAddr uintptr, newdirfd int, newAddr uintptr, flags int) (int64, bool) {
+	if f, ok := th.linkSource(olddirfd, oldAddr, flags); ok {
+		return th.linkFile(f, newdirfd, newAddr, flags), true
+	}
+	oldAbs, om, oldName, oldRet, oldOK := th.virtualPath(olddirfd, oldAddr)
+	newAbs, nm, newName, newRet, newOK := th.virtualPath(newdirfd, newAddr)
+	switch {
+	case !oldOK && !newOK:
+		return 0, false
+	case oldRet < 0:
+		return oldRet, true
+	case newRet < 0:
+		return newRet, true
+	}
+	th.t.log.Printf("linkat: %s to %s (virtual)", oldAbs, newAbs)
+	if flags&^(unix.AT_SYMLINK_FOLLOW|unix.AT_EMPTY_PATH) != 0 {
+		return -int64(unix.EINVAL), true
+	}
+	if flags&unix.AT_SYMLINK_FOLLOW != 0 && oldOK {
+		var err error
+		if oldAbs, om, oldName, err = th.follow(oldAbs); err != nil {
+			return errnoRet(err), true
+		}
+	}
+	if om != nm {
+		return -int64(unix.EXDEV), true
+	}
+	if err := om.backend.Link(oldName, newName); err != nil {
+		return errnoRet(err), true
+	}
+	return 0, true
+}
+
+// walk resolves the path p, relative to the absolute directory dir, to an
+// absolute, clean path. Within the virtual tree it goes a name at a time
+// as the kernel does, following symlinks among the directories on the way,
+// so that ".." after a symlink leaves where the symlink leads rather than
+// where it is, and fails with a walkError where a directory on the way is
+// missing, is not a directory or is reached through too many symlinks. The
+// final name is left for the syscall to follow or not, and host paths for
+// the kernel to walk.
+func (t *Tracer) walk(dir, p string) (string, error) {
+	return t.walkIn("/", dir, p)
+}
+
+// walkIn is walk for a process whose root is the absolute, clean path
+// root, as chroot makes it: an absolute path or symlink starts there, and
+// ".." goes no higher. Below any root but the host's, host directories are
+// walked a name at a time too, so that their symlinks stay below it.
+func (t *Tracer) walkIn(root, dir, p string) (string, error) {
+	abs, _, err := t.walkThrough(root, dir, p)
+	return abs, err
+}
+
+// walkThrough is walkIn, and also reports whether the walk goes through a
+// directory in the virtual tree, or through a symlink there, on the way.
+// The kernel, which knows nothing of them, would not find a host path the
+// walk ends at from p.
+func (t *Tracer) walkThrough(root, dir, p string) (string, bool, error) {
+	cur := path.Clean(dir)
+	if path.IsAbs(p) {
+		cur = root
+	}
+	if root == "/" && len(t.mounts) == 0 && len(t.remaps) == 0 {
+		return path.Join(cur, p), false, nil
+	}
+	comps := strings.Split(p, "/")
+	links := 0
+	through := false
+	for len(comps) > 0 {
+		c := comps[0]
+		comps = comps[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if cur != root {
+				cur = path.Dir(cur)
+			}
+			continue
+		}
+		next := path.Join(cur, c)
+		m, name, ok := t.lookup(next)
+		if ok && !final(comps) {
+			through = true
+		}
+		if !ok && root != "/" {
+			m, name, ok = &t.host, next[1:], true
+		}
+		if !ok || final(comps) {
+			cur = next
+			continue
+		}
+		fi, err := m.backend.Lstat(name)
+		if err != nil {
+			return "", false, &walkError{errnoFor(err)}
+		}
+		switch {
+		case fi.Mode()&fs.ModeSymlink != 0:
+			if links++; links > vfs.MaxSymlinks {
+				return "", false, &walkError{unix.ELOOP}
+			}
+			target, err := m.backend.Readlink(name)
+			if err != nil {
+				return "", false, &walkError{errnoFor(err)}
+			}
+			if path.IsAbs(target) {
+				cur = root
+			}
+			comps = append(strings.Split(target, "/"), comps...)
+		case !fi.IsDir():
+			return "", false, &walkError{unix.ENOTDIR}
+		default:
+			cur = next
+		}
+	}
+	if _, _, ok := t.lookup(cur); !ok && root == "/" {
+		// A host path can lead into the virtual tree through a symlink.
+		if real := t.realPath(cur, false); real != cur {
+			if _, _, ok := t.lookup(real); ok {
+				abs, err := t.walk("/", real)
+				return abs, true, err
+			}
+		}
+	}
+	return cur, through, nil
+}
+
+// final reports whether the names left of a path, comps, name nothing
+// more, so that the name before them is the last.
+func final(comps []string) bool {
+	for _, c := range comps {
+		if c != "" && c != "." {
+			return false
+		}
+	}
+	return true
+}
+
+// follow resolves the virtual path abs through any chain of final
+// symlinks, as a syscall that follows them would, and returns where it
+// leads, with its mount and name there. As in the kernel, a target is a
+// path in the command's view of the filesystem, which can lead out of the
+// mount or out of the virtual tree; a host file is served from the host,
+// as if remapped. A chain that ends at a missing file ends there, for the
+// syscall to fail or to create it.
+func (t *Tracer) follow(abs string) (string, *mount, string, error) {
+	return t.followIn("/", abs)
+}
+
+// followIn is follow for a process whose root is root, as walkIn has it.
+// Below any root but the host's, host symlinks are followed too.
+func (t *Tracer) followIn(root, abs string) (string, *mount, string, error) {
+	for range vfs.MaxSymlinks {
+		m, name, ok := t.lookup(abs)
+		if !ok {
+			if root == "/" {
+				return abs, &t.host, path.Join(".", abs), nil
+			}
+			m, name = &t.host, path.Join(".", abs)
+		}
+		fi, err := m.backend.Lstat(name)
+		if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+			return abs, m, name, nil
+		}
+		target, err := m.backend.Readlink(name)
+		if err != nil {
+			return "", nil, "", err
+		}
+		if abs, err = t.walkIn(root, path.Dir(abs), target); err != nil {
+			return "", nil, "", err
+		}
+	}
+	return "", nil, "", unix.ELOOP
+}
+
+// follow is Tracer.follow for a syscall of th. The files of a process in
+// /proc that a symlink leads to are th's own: opened by the tracer, they
+// would be the tracer's.
+func (th *thread) follow(abs string) (string, *mount, string, error) {
+	abs, m, name, err := th.t.followIn(th.root(), abs)
+	if err == nil && m == &th.t.host {
+		name = th.ownProc(name)
+	}
+	return abs, m, name, err
+}
+
+// sysSymlinkat also handles symlink. The target is stored as given.
+func (th *thread) sysSymlinkat(targetAddr uintptr, newdirfd int, linkAddr uintptr) (int64, bool) {
+	abs, m, name, ret, ok := th.virtualPath(newdirfd, linkAddr)
+	if !ok || ret < 0 {
+		return ret, ok
+	}
+	target, err := th.mem.readString(targetAddr)
+	if err != nil {
+		return 0, false
+	}
+	th.t.log.Printf("symlinkat: %s (virtual)", abs)
+	if target == "" {
+		return -int64(unix.ENOENT), true
+	}
+	if err := m.backend.Symlink(target, name); err != nil {
+		return errnoRet(err), true
+	}
+	return 0, true
+}
+
+// sysReadlinkat also handles readlink. Like the kernel it truncates the
+// target to bufsiz bytes and does not terminate it.
+func (th *thread) sysReadlinkat(dirfd int, pathAddr, buf uintptr, bufsiz int) (int64, bool) {
+	abs, m, name, ret, ok := th.virtualPath(dirfd, pathAddr)
+	var target string
+	if !ok && ret == 0 && abs != "" {
+		if target, ok = th.procLink(abs); !ok {
+			return 0, false
+		}
+	} else if !ok || ret < 0 {
+		return ret, ok
+	}
+	th.t.log.Printf("readlinkat: %s (virtual)", abs)
+	if bufsiz <= 0 {
+		return -int64(unix.EINVAL), true
+	}
+	if m != nil {
+		var err error
+		if target, err = m.backend.Readlink(name); err != nil {
+			return errnoRet(err), true
+		}
+	}
+	b := []byte(target)[:min(len(target), bufsiz)]
+	if err := th.mem.writeBytes(buf, b); err != nil {
+		return -int64(unix.EFAULT), true
+	}
+	return int64(len(b)), true
+}
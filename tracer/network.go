@@ -0,0 +1,561 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// Redirect rewrites the address of the command's connects, binds and
+// sendtos, as part of the rules given to WithRedirects, to steer its
+// traffic without a firewall or privileges.
+//
+// From is the address to rewrite, as host:port. The host is an IP
+// address; 0.0.0.0 matches every IPv4 address, :: every IPv6 address and *
+// both. A port of 0 or * matches every port. To is the address to put in
+// its place: host:port, with an IP address for host, or unix: and the
+// absolute path of a Unix domain socket on the host.
+//
+// When To is of another family than the socket, the socket is replaced
+// by a new one of To's family and the same type before the call, so that
+// a client can be pointed at a proxy listening on a Unix socket, or a
+// server made to listen on one. Options set on the socket it replaces are
+// lost. Redirecting everything to a SOCKS proxy's address only works with
+// a proxy that accepts connections without the SOCKS handshake.
+type Redirect struct {
+	From string
+	To   string
+}
+
+// redirect is a Redirect parsed.
+type redirect struct {
+	rule Redirect
+	// host is the address From matches, unless any4 or any6 is set.
+	host       netip.Addr
+	any4, any6 bool
+	// port is the port From matches, or 0 for every port.
+	port uint16
+	to   unix.Sockaddr
+}
+
+// WithRedirects adds address rewriting rules, after any added before.
+// Rules are tried in the order given, and only the first that matches an
+// address is applied. A rule whose addresses are malformed never matches.
+//
+// Under EnginePtrace the thread makes the rewritten call itself. Under
+// EngineUnotify, which cannot change a syscall's arguments, the tracer
+// makes it on the thread's socket, and every other traced thread waits
+// for a blocking connect to complete.
+func WithRedirects(rules ...Redirect) Option {
+	return func(t *Tracer) {
+		for _, r := range rules {
+			if p, err := parseRedirect(r); err == nil {
+				t.redirects = append(t.redirects, p)
+			}
+		}
+	}
+}
+
+func parseRedirect(r Redirect) (redirect, error) {
+	p := redirect{rule: r}
+	host, port, err := net.SplitHostPort(r.From)
+	if err != nil {
+		return p, fmt.Errorf("redirect from %q: %w", r.From, err)
+	}
+	switch host {
+	case "*":
+		p.any4, p.any6 = true, true
+	case "0.0.0.0":
+		p.any4 = true
+	case "::":
+		p.any6 = true
+	default:
+		if p.host, err = netip.ParseAddr(host); err != nil {
+			return p, fmt.Errorf("redirect from %q: %w", r.From, err)
+		}
+		p.host = p.host.Unmap()
+	}
+	if port != "*" {
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return p, fmt.Errorf("redirect from %q: bad port %q", r.From, port)
+		}
+		p.port = uint16(n)
+	}
+	if path, ok := strings.CutPrefix(r.To, "unix:"); ok {
+		if !strings.HasPrefix(path, "/") || len(path) >= len(unix.RawSockaddrUnix{}.Path) {
+			return p, fmt.Errorf("redirect to %q: not an absolute socket path", r.To)
+		}
+		p.to = &unix.SockaddrUnix{Name: path}
+		return p, nil
+	}
+	to, err := netip.ParseAddrPort(r.To)
+	if err != nil || to.Port() == 0 {
+		return p, fmt.Errorf("redirect to %q: not an address and port", r.To)
+	}
+	if a := to.Addr().Unmap(); a.Is4() {
+		p.to = &unix.SockaddrInet4{Port: int(to.Port()), Addr: a.As4()}
+	} else {
+		p.to = &unix.SockaddrInet6{Port: int(to.Port()), Addr: a.As16()}
+	}
+	return p, nil
+}
+
+func (r *redirect) match(a netip.AddrPort) bool {
+	if r.port != 0 && a.Port() != r.port {
+		return false
+	}
+	switch {
+	case a.Addr().Is4() && r.any4, a.Addr().Is6() && r.any6:
+		return true
+	}
+	return a.Addr() == r.host
+}
+
+// netSyscalls returns the syscalls redirects, the remapping of Unix socket
+// paths and the egress firewall need trapped.
+func (t *Tracer) netSyscalls() []uint64 {
+	if len(t.redirects) == 0 && len(t.remaps) == 0 && len(t.mounts) == 0 && t.egress == nil {
+		return nil
+	}
+	return []uint64{unix.SYS_CONNECT, unix.SYS_BIND, unix.SYS_SENDTO}
+}
+
+// redirection is a connect, bind or sendto whose address a Redirect
+// rewrites. args are the syscall's arguments, the address being args[addr].
+//
+// Under the ptrace engine the rewritten address goes below the stack
+// pointer, and a socket of another family is swapped in first through
+// three syscalls in the thread: a socket, a dup3 of it over the old one,
+// and a close_range of the new descriptor. Each is started like a
+// mapping's, at the previous one's exit stop.
+type redirection struct {
+	nr   uint64
+	args [6]uint64
+	addr int
+	to   unix.Sockaddr
+	// swap is set if the socket is replaced by one of typ, which is
+	// close-on-exec if cloexec is set.
+	swap    bool
+	typ     int
+	cloexec bool
+	step    int
+	newfd   int
+	ret     int64
+	scratch uintptr
+	saved   []byte
+}
+
+const (
+	redirectSocket = iota
+	redirectDup
+	redirectClose
+	redirectCall
+)
+
+// sockaddrMax is the size of a sockaddr_storage, the longest address the
+// kernel takes.
+const sockaddrMax = 128
+
+// redirectAddr looks the address in args[i] of the connect, bind or sendto
+// nr up in the redirects, and has the call redirected if one matches. A
+// Unix socket path is remapped instead. A connect or sendto the egress
+// firewall refuses fails.
+func (th *thread) redirectAddr(nr uint64, args [6]uint64, i int) (int64, bool) {
+	if args[i] == 0 {
+		return 0, false
+	}
+	n := uint32(args[i+1])
+	if n < 2 || n > sockaddrMax {
+		return 0, false
+	}
+	b, err := th.mem.readBytes(uintptr(args[i]), int(n))
+	if err != nil {
+		return 0, false
+	}
+	if binary.NativeEndian.Uint16(b) == unix.AF_UNIX {
+		return th.remapSocket(nr, args, i, b[2:])
+	}
+	a, ok := decodeSockaddr(b)
+	if !ok {
+		return 0, false
+	}
+	var r *redirect
+	for j := range th.t.redirects {
+		if th.t.redirects[j].match(a) {
+			r = &th.t.redirects[j]
+			break
+		}
+	}
+	if nr != unix.SYS_BIND {
+		dest, ok := a, true
+		if r != nil {
+			dest, ok = sockaddrAddr(r.to)
+		}
+		if ok {
+			if ret, denied := th.egressDenied(nr, dest); denied {
+				return ret, true
+			}
+		}
+	}
+	if r == nil {
+		return 0, false
+	}
+	fd := int(int32(args[0]))
+	domain, typ, cloexec, err := th.socketOf(fd)
+	if err != nil {
+		// Not a socket, or gone: the kernel says which.
+		return 0, false
+	}
+	th.t.log.Printf("%s: %v redirected to %s", syscallSpecs[nr].name, a, r.rule.To)
+	x := &redirection{nr: nr, args: args, addr: i, to: r.to, typ: typ, cloexec: cloexec}
+	switch to := r.to.(type) {
+	case *unix.SockaddrInet4:
+		if domain == unix.AF_INET6 {
+			// A dual-stack socket reaches it through its mapped address.
+			x.to = &unix.SockaddrInet6{Port: to.Port, Addr: netip.AddrFrom4(to.Addr).As16()}
+		} else {
+			x.swap = domain != unix.AF_INET
+		}
+	case *unix.SockaddrInet6:
+		x.swap = domain != unix.AF_INET6
+	case *unix.SockaddrUnix:
+		x.swap = domain != unix.AF_UNIX
+	}
+	th.redirect = x
+	return 0, false
+}
+
+// remapSocket has the connect, bind or sendto nr of a Unix socket at the
+// path in sunPath made at the host path of the file it names, if that is
+// not the path itself: when it is remapped, or in a mount whose backend
+// keeps its files on the host. A path in any other mount cannot hold a
+// socket, and the call fails. Abstract and unnamed addresses are left
+// alone.
+func (th *thread) remapSocket(nr uint64, args [6]uint64, i int, sunPath []byte) (int64, bool) {
+	p, _, _ := strings.Cut(string(sunPath), "\x00")
+	if p == "" {
+		return 0, false
+	}
+	abs, through, err := th.resolveArg(unix.AT_FDCWD, p)
+	if err != nil {
+		return resolveFailed(err)
+	}
+	m, name, ok := th.lookupArg(abs, through)
+	if !ok {
+		// The kernel finds it as well as the tracer.
+		return 0, false
+	}
+	if nr != unix.SYS_BIND {
+		// The kernel follows a symlink to the socket, except to bind.
+		if _, m, name, err = th.follow(abs); err != nil {
+			return errnoRet(err), true
+		}
+	}
+	host := path.Join("/", name)
+	if m != &th.t.host {
+		if host, err = vfs.SocketPath(m.backend, name); err != nil {
+			th.t.log.Printf("%s: %s: %v", syscallSpecs[nr].name, abs, err)
+			if errors.Is(err, unix.EOPNOTSUPP) && nr != unix.SYS_BIND {
+				// As for a file that is not a socket.
+				return -int64(unix.ECONNREFUSED), true
+			}
+			return errnoRet(err), true
+		}
+	}
+	if host == p {
+		return 0, false
+	}
+	if len(host) >= len(unix.RawSockaddrUnix{}.Path) {
+		return -int64(unix.ENAMETOOLONG), true
+	}
+	th.t.log.Printf("%s: %s remapped to %s", syscallSpecs[nr].name, p, host)
+	th.redirect = &redirection{nr: nr, args: args, addr: i, to: &unix.SockaddrUnix{Name: host}}
+	return 0, false
+}
+
+// decodeSockaddr returns the IP address and port of the sockaddr b, and
+// false if it is of another family.
+func decodeSockaddr(b []byte) (netip.AddrPort, bool) {
+	port := func() uint16 { return binary.BigEndian.Uint16(b[2:4]) }
+	switch binary.NativeEndian.Uint16(b) {
+	case unix.AF_INET:
+		if len(b) < unix.SizeofSockaddrInet4 {
+			return netip.AddrPort{}, false
+		}
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[4:8])), port()), true
+	case unix.AF_INET6:
+		if len(b) < unix.SizeofSockaddrInet6 {
+			return netip.AddrPort{}, false
+		}
+		return netip.AddrPortFrom(netip.AddrFrom16([16]byte(b[8:24])).Unmap(), port()), true
+	}
+	return netip.AddrPort{}, false
+}
+
+// sockaddrAddr returns the IP address and port of sa, or false if it has
+// none.
+func sockaddrAddr(sa unix.Sockaddr) (netip.AddrPort, bool) {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), uint16(sa.Port)), true
+	case *unix.SockaddrInet6:
+		return netip.AddrPortFrom(netip.AddrFrom16(sa.Addr).Unmap(), uint16(sa.Port)), true
+	}
+	return netip.AddrPort{}, false
+}
+
+// encodeSockaddr returns sa as the kernel takes it.
+func encodeSockaddr(sa unix.Sockaddr) []byte {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		b := make([]byte, unix.SizeofSockaddrInet4)
+		binary.NativeEndian.PutUint16(b, unix.AF_INET)
+		binary.BigEndian.PutUint16(b[2:], uint16(sa.Port))
+		copy(b[4:], sa.Addr[:])
+		return b
+	case *unix.SockaddrInet6:
+		b := make([]byte, unix.SizeofSockaddrInet6)
+		binary.NativeEndian.PutUint16(b, unix.AF_INET6)
+		binary.BigEndian.PutUint16(b[2:], uint16(sa.Port))
+		copy(b[8:], sa.Addr[:])
+		return b
+	case *unix.SockaddrUnix:
+		b := binary.NativeEndian.AppendUint16(nil, unix.AF_UNIX)
+		return append(append(b, sa.Name...), 0)
+	}
+	panic("tracer: unknown sockaddr")
+}
+
+func sockaddrFamily(sa unix.Sockaddr) int {
+	switch sa.(type) {
+	case *unix.SockaddrInet4:
+		return unix.AF_INET
+	case *unix.SockaddrInet6:
+		return unix.AF_INET6
+	}
+	return unix.AF_UNIX
+}
+
+// socketOf returns the domain and the type, with SOCK_NONBLOCK if it is
+// set, of the socket open as the thread's fd, and whether the descriptor
+// is close-on-exec.
+func (th *thread) socketOf(fd int) (domain, typ int, cloexec bool, err error) {
+	sock, err := th.dupFD(fd)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer unix.Close(sock)
+	if domain, err = unix.GetsockoptInt(sock, unix.SOL_SOCKET, unix.SO_DOMAIN); err != nil {
+		return 0, 0, false, err
+	}
+	if typ, err = unix.GetsockoptInt(sock, unix.SOL_SOCKET, unix.SO_TYPE); err != nil {
+		return 0, 0, false, err
+	}
+	fl, err := unix.FcntlInt(uintptr(sock), unix.F_GETFL, 0)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if fl&unix.O_NONBLOCK != 0 {
+		typ |= unix.SOCK_NONBLOCK
+	}
+	info, err := os.ReadFile(fmt.Sprintf("/proc/%d/fdinfo/%d", th.tid, fd))
+	if err != nil {
+		return 0, 0, false, err
+	}
+	for _, line := range strings.Split(string(info), "\n") {
+		if v, ok := strings.CutPrefix(line, "flags:"); ok {
+			flags, err := strconv.ParseUint(strings.TrimSpace(v), 8, 64)
+			if err != nil {
+				return 0, 0, false, err
+			}
+			cloexec = flags&unix.O_CLOEXEC != 0
+		}
+	}
+	return domain, typ, cloexec, nil
+}
+
+// dupFD returns a copy in the tracer of the thread's descriptor fd.
+func (th *thread) dupFD(fd int) (int, error) {
+	pidfd, err := unix.PidfdOpen(th.pid, 0)
+	if err != nil {
+		return -1, err
+	}
+	defer unix.Close(pidfd)
+	return unix.PidfdGetfd(pidfd, fd, 0)
+}
+
+// startRedirect starts the redirection the thread is stopped entering.
+func (th *thread) startRedirect() error {
+	x := th.redirect
+	regs := th.regs
+	if !x.swap {
+		x.step = redirectCall
+		args, err := th.redirectArgs()
+		if err != nil {
+			return err
+		}
+		if err := rewriteSyscall(th.tid, &regs, th.arch, x.nr, args...); err != nil {
+			_ = th.mem.writeBytes(x.scratch, x.saved)
+			return err
+		}
+		return nil
+	}
+	x.step = redirectSocket
+	return rewriteSyscall(th.tid, &regs, th.arch, unix.SYS_SOCKET,
+		uint64(sockaddrFamily(x.to)), uint64(x.typ|unix.SOCK_CLOEXEC), 0)
+}
+
+// redirectArgs writes the rewritten address below the stack pointer and
+// returns the arguments of the call with it in place of the original.
+func (th *thread) redirectArgs() ([]uint64, error) {
+	x := th.redirect
+	b := encodeSockaddr(x.to)
+	// Like a mapping's memfd name, the address goes below the stack
+	// pointer, past the amd64 red zone.
+	x.scratch = uintptr(stackPointer(&th.regs)-256-sockaddrMax) &^ 15
+	saved, err := th.mem.readBytes(x.scratch, len(b))
+	if err != nil {
+		return nil, err
+	}
+	if err := th.mem.writeBytes(x.scratch, b); err != nil {
+		return nil, err
+	}
+	x.saved = saved
+	args := x.args
+	args[x.addr], args[x.addr+1] = uint64(x.scratch), uint64(len(b))
+	return args[:], nil
+}
+
+// redirectExit runs at the exit stop of each step of a redirection and
+// starts the next one. Once the call is made, the thread's registers are
+// put back as they were at its entry and it returns the call's result.
+func (th *thread) redirectExit() {
+	x := th.redirect
+	var regs unix.PtraceRegs
+	if err := getRegs(th.tid, &regs); err != nil {
+		th.t.log.Printf("getregs: %v", err)
+		th.redirect = nil
+		return
+	}
+	ret := int64(returnValue(&regs))
+	regs = th.regs
+	fd := uint64(int32(x.args[0]))
+	var err error
+	switch x.step {
+	case redirectSocket:
+		if ret < 0 {
+			th.finishRedirect(ret)
+			return
+		}
+		x.newfd = int(ret)
+		x.step = redirectDup
+		var flags uint64
+		if x.cloexec {
+			flags = unix.O_CLOEXEC
+		}
+		err = th.restart(&regs, unix.SYS_DUP3, uint64(x.newfd), fd, flags)
+	case redirectDup:
+		x.ret = min(ret, 0)
+		x.step = redirectClose
+		err = th.restart(&regs, unix.SYS_CLOSE_RANGE, uint64(x.newfd), uint64(x.newfd), 0)
+	case redirectClose:
+		if x.ret < 0 {
+			th.finishRedirect(x.ret)
+			return
+		}
+		x.step = redirectCall
+		var args []uint64
+		if args, err = th.redirectArgs(); err != nil {
+			th.t.log.Printf("%s: %v", syscallSpecs[x.nr].name, err)
+			th.finishRedirect(-int64(unix.EFAULT))
+			return
+		}
+		err = th.restart(&regs, x.nr, args...)
+	case redirectCall:
+		_ = th.mem.writeBytes(x.scratch, x.saved)
+		th.finishRedirect(ret)
+		return
+	}
+	if err != nil {
+		th.t.log.Printf("setregs: %v", err)
+		th.redirect = nil
+	}
+}
+
+func (th *thread) finishRedirect(ret int64) {
+	th.redirect = nil
+	if th.hooked != nil {
+		ret, _ = th.hookExit(ret)
+	}
+	regs := th.regs
+	setReturn(&regs, uint64(ret))
+	if err := setRegs(th.tid, &regs); err != nil {
+		th.t.log.Printf("setregs: %v", err)
+	}
+}
+
+// redirectNotified makes the redirection of the notification id under the
+// unotify engine, on the tracer's copy of the thread's socket, and returns
+// its result. A socket swapped in is installed in the thread first.
+func (t *Tracer) redirectNotified(listener int, id uint64, th *thread) int64 {
+	x := th.redirect
+	th.redirect = nil
+	fd := int(int32(x.args[0]))
+	sock, err := th.dupFD(fd)
+	if err != nil {
+		return errnoRet(err)
+	}
+	defer func() { _ = unix.Close(sock) }()
+	if x.swap {
+		s, err := unix.Socket(sockaddrFamily(x.to), x.typ|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return errnoRet(err)
+		}
+		_ = unix.Close(sock)
+		sock = s
+		addfd := seccompNotifAddfd{
+			ID:    id,
+			Flags: unix.SECCOMP_ADDFD_FLAG_SETFD,
+			Srcfd: uint32(sock),
+			Newfd: uint32(fd),
+		}
+		if x.cloexec {
+			addfd.NewfdFlags = unix.O_CLOEXEC
+		}
+		if err := notifIoctl(listener, unix.SECCOMP_IOCTL_NOTIF_ADDFD, unsafe.Pointer(&addfd)); err != nil {
+			return errnoRet(err)
+		}
+	}
+	switch x.nr {
+	case unix.SYS_CONNECT:
+		err = unix.Connect(sock, x.to)
+	case unix.SYS_BIND:
+		err = unix.Bind(sock, x.to)
+	case unix.SYS_SENDTO:
+		b, rerr := th.mem.readBytes(uintptr(x.args[1]), int(min(x.args[2], maxBufferSize)))
+		if rerr != nil {
+			return -int64(unix.EFAULT)
+		}
+		n, err := unix.SendmsgN(sock, b, nil, x.to, int(int32(x.args[3])))
+		if err != nil {
+			return errnoRet(err)
+		}
+		return int64(n)
+	}
+	if err != nil {
+		return errnoRet(err)
+	}
+	return 0
+}
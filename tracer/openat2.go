@@ -0,0 +1,130 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"path"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// openHowSize is the size of the first struct open_how, the least
+	// openat2 accepts.
+	openHowSize = 24
+	// maxOpenHowSize is the most of a struct open_how the kernel reads,
+	// a page.
+	maxOpenHowSize = 4096
+	// resolveCached is RESOLVE_CACHED, which x/sys/unix does not name.
+	resolveCached = 0x20
+	resolveFlags  = unix.RESOLVE_NO_XDEV | unix.RESOLVE_NO_MAGICLINKS | unix.RESOLVE_NO_SYMLINKS |
+		unix.RESOLVE_BENEATH | unix.RESOLVE_IN_ROOT | resolveCached
+)
+
+// openHow returns the canonical openat2 c with the struct open_how it
+// points to unpacked into its arguments, as (dirfd, path, flags, mode,
+// resolve), so that what checks the flags of an openat can check those of
+// an openat2 alike. It reports false if the struct cannot be read, or is
+// larger than the tracer knows and does not end in zeros, leaving the
+// kernel to fail the syscall.
+func (th *thread) openHow(c sysCall) (sysCall, bool) {
+	size := c.args[3]
+	if size < openHowSize || size > maxOpenHowSize {
+		return c, false
+	}
+	b, err := th.mem.readBytes(uintptr(c.args[2]), int(size))
+	if err != nil {
+		return c, false
+	}
+	for _, x := range b[openHowSize:] {
+		if x != 0 {
+			return c, false
+		}
+	}
+	for i := range 3 {
+		c.args[2+i] = binary.LittleEndian.Uint64(b[8*i:])
+	}
+	return c, true
+}
+
+// sysOpenat2 opens a file as sysOpenat does, within the bounds the
+// resolve flags set on the lookup. Files on the host are left to the
+// kernel, flags and all. A mount has no magic links to refuse, and
+// RESOLVE_CACHED only fails with EAGAIN where it always would. The other
+// restrictions are judged on the path as the command names it, and a final
+// symlink followed must not lead out from under dirfd either.
+func (th *thread) sysOpenat2(dirfd int, pathAddr uintptr, flags, mode, resolve uint64) (int64, bool) {
+	p, err := th.mem.readString(pathAddr)
+	if err != nil || p == "" {
+		return 0, false
+	}
+	start, abs, through := th.root(), "", false
+	if resolve&unix.RESOLVE_IN_ROOT != 0 || !path.IsAbs(p) {
+		start, through, err = th.resolveArg(dirfd, ".")
+	}
+	switch {
+	case err != nil:
+	case resolve&unix.RESOLVE_IN_ROOT != 0:
+		// dirfd is the root, that even ".." and absolute paths stay in.
+		abs = path.Join(start, path.Clean("/"+p))
+	default:
+		var via bool
+		abs, via, err = th.t.walkThrough(th.root(), start, p)
+		through = through && !path.IsAbs(p) || via
+	}
+	if err != nil {
+		return resolveFailed(err)
+	}
+	if ret, ok := th.openRandom(abs, int(flags), uint32(mode)); ok {
+		return ret, true
+	}
+	m, name, ok := th.lookupArg(abs, through)
+	if (!ok || m == &th.t.host) && resolve&unix.RESOLVE_NO_MAGICLINKS == 0 {
+		if ret, ok := th.openProc(abs, int(flags), uint32(mode)); ok {
+			return ret, true
+		}
+	}
+	if !ok {
+		th.t.log.Printf("openat2: %s", abs)
+		return 0, false
+	}
+	th.t.log.Printf("openat2: %s (virtual)", abs)
+	creates := flags&unix.O_CREAT != 0 || flags&unix.O_TMPFILE == unix.O_TMPFILE
+	switch {
+	case flags>>32 != 0, mode&^0o7777 != 0, mode != 0 && !creates, resolve&^resolveFlags != 0,
+		resolve&unix.RESOLVE_BENEATH != 0 && resolve&unix.RESOLVE_IN_ROOT != 0:
+		return -int64(unix.EINVAL), true
+	case resolve&resolveCached != 0 && (creates || flags&unix.O_TRUNC != 0):
+		return -int64(unix.EAGAIN), true
+	case resolve&unix.RESOLVE_BENEATH != 0 && (path.IsAbs(p) || !inDir(abs, start)):
+		return -int64(unix.EXDEV), true
+	}
+	if resolve&unix.RESOLVE_NO_XDEV != 0 {
+		if sm, _ := th.rootLookup(start); sm != m {
+			return -int64(unix.EXDEV), true
+		}
+	}
+	if resolve&unix.RESOLVE_NO_SYMLINKS != 0 && hasSymlink(m, name) {
+		return -int64(unix.ELOOP), true
+	}
+	if openFollows(int(flags)) {
+		if abs, m, name, err = th.follow(abs); err != nil {
+			return errnoRet(err), true
+		}
+		if resolve&(unix.RESOLVE_BENEATH|unix.RESOLVE_IN_ROOT) != 0 && !inDir(abs, start) {
+			return -int64(unix.EXDEV), true
+		}
+	}
+	return th.openVirtual(m, name, abs, int(flags), uint32(mode)), true
+}
+
+// hasSymlink reports whether name, or any directory on the way to it, is
+// a symlink in m.
+func hasSymlink(m *mount, name string) bool {
+	for p := name; p != "." && p != "/"; p = path.Dir(p) {
+		if fi, err := m.backend.Lstat(p); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
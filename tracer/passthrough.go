@@ -0,0 +1,239 @@
+package tracer
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithPassthrough serves reads of large files below mounts without
+// copying them through the tracer. A regular file of at least minSize
+// bytes opened read-only is handed to the process as a real descriptor,
+// open on a memfd that holds a copy of it. Its reads, seeks and mmaps then
+// go straight to the kernel and are not intercepted at all.
+//
+// The copy is made at the first such open and shared by later ones. It is
+// made again once the file's size or modification time in the backend has
+// changed, or the command has written to or truncated the file. A
+// descriptor already open keeps the copy it was opened on, as if the file
+// had been replaced. The descriptor is not a virtual one: fstat reports
+// the memfd's device and inode, with the file's size, mode and times, and
+// no FileClosed event is sent when it is closed. WithRecord and WithReplay
+// turn passthrough off, since they need every read to reach the backend.
+func WithPassthrough(minSize int64) Option {
+	return func(t *Tracer) {
+		t.passthrough = &passthrough{min: max(minSize, 0), files: make(map[passKey]*passFile)}
+	}
+}
+
+// passthrough holds the memfds that large virtual files are served from.
+type passthrough struct {
+	min   int64
+	files map[passKey]*passFile
+}
+
+// passKey names a file as name in the backend of m.
+type passKey struct {
+	m    *mount
+	name string
+}
+
+// passFile is a memfd holding a copy of a virtual file, as it was when its
+// size and modification time in the backend were size and mtime.
+type passFile struct {
+	f     *os.File
+	size  int64
+	mtime time.Time
+}
+
+// passOpen is an open of a virtual file that is served from the memfd f
+// instead. Under the ptrace engine the open is rewritten into one of the
+// memfd's link in the tracer's /proc/pid/fd, the path of which goes below
+// the stack pointer like the name of a mapping's memfd.
+type passOpen struct {
+	f     *os.File
+	m     *mount
+	name  string
+	abs   string
+	flags int
+	mode  uint32
+	// lease is set if the memfd is leased to the open.
+	lease *lease
+	// scratch is where the path was written, and saved holds the bytes it
+	// covered.
+	scratch uintptr
+	saved   []byte
+}
+
+// passThrough reports whether the open of name in m, whose absolute path
+// is abs, with flags, is served from a memfd, and if so sets th.passing.
+func (th *thread) passThrough(m *mount, name, abs string, flags int, mode uint32) bool {
+	t := th.t
+	p := t.passthrough
+	if p == nil || t.record != nil || t.replay != nil {
+		return false
+	}
+	if flags&unix.O_ACCMODE != unix.O_RDONLY || flags&(unix.O_CREAT|unix.O_TRUNC|unix.O_DIRECTORY|unix.O_PATH|unix.O_TMPFILE) != 0 {
+		return false
+	}
+	fi, err := m.backend.Lstat(name)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() < p.min {
+		return false
+	}
+	k := passKey{m, name}
+	pf := p.files[k]
+	if pf == nil || pf.size != fi.Size() || !pf.mtime.Equal(fi.ModTime()) {
+		p.drop(m, name)
+		if pf, err = t.fillPassFile(m, name, abs, fi.Mode().Perm(), fi.ModTime()); err != nil {
+			t.log.Printf("passthrough: %s: %v", abs, err)
+			return false
+		}
+		p.files[k] = pf
+	}
+	t.log.Printf("openat: %s (passthrough)", abs)
+	th.passing = &passOpen{f: pf.f, m: m, name: name, abs: abs, flags: flags, mode: mode}
+	return true
+}
+
+// fillPassFile copies name in m, whose absolute path is abs, into a new
+// memfd with perm and mtime.
+func (t *Tracer) fillPassFile(m *mount, name, abs string, perm os.FileMode, mtime time.Time) (*passFile, error) {
+	src, err := m.backend.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	fd, err := unix.MemfdCreate(memfdName, unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), memfdName)
+	n, err := io.Copy(f, io.NewSectionReader(src, 0, math.MaxInt64))
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = os.Chtimes(fmt.Sprintf("/proc/self/fd/%d", fd), time.Time{}, mtime)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	t.noteMemfd(f, abs)
+	return &passFile{f: f, size: n, mtime: mtime}, nil
+}
+
+// drop forgets the copy of name in m, if there is one, so that the next
+// open makes another: the command has changed the file.
+func (p *passthrough) drop(m *mount, name string) {
+	if p == nil {
+		return
+	}
+	if pf := p.files[passKey{m, name}]; pf != nil {
+		pf.f.Close()
+		delete(p.files, passKey{m, name})
+	}
+}
+
+// close closes every memfd. Descriptors the command still has open keep
+// theirs.
+func (p *passthrough) close() {
+	if p == nil {
+		return
+	}
+	for k, pf := range p.files {
+		pf.f.Close()
+		delete(p.files, k)
+	}
+}
+
+// openFlags returns the flags to open the memfd with for the open.
+func (p *passOpen) openFlags() int {
+	return p.flags & (unix.O_ACCMODE | unix.O_APPEND | unix.O_CLOEXEC | unix.O_NONBLOCK | unix.O_LARGEFILE)
+}
+
+// opened reports the memfd's opening as fd, or, if it failed, opens the
+// file as a virtual descriptor after all and returns that result.
+func (th *thread) opened(p *passOpen, fd int64) int64 {
+	if fd < 0 {
+		th.t.log.Printf("passthrough: %s: %v", p.abs, unix.Errno(-fd))
+		if l := p.lease; l != nil {
+			// The file stays open, for the virtual descriptor.
+			l.memfd.Close()
+			delete(th.t.leases.byIno, l.ino)
+			return th.addVirtual(p.m, p.name, p.abs, l.file, p.flags)
+		}
+		return th.openVirtual(p.m, p.name, p.abs, p.flags, p.mode)
+	}
+	th.t.emit(&FileOpened{Pid: th.pid, FD: int(fd), Path: p.abs, Flags: p.flags &^ unix.O_CLOEXEC})
+	return fd
+}
+
+// startPassthrough replaces the open the thread is entering with an open
+// of the memfd's link.
+func (th *thread) startPassthrough() error {
+	p := th.passing
+	link := append([]byte(fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), p.f.Fd())), 0)
+	// The path goes below the stack pointer, past the amd64 red zone.
+	p.scratch = uintptr(stackPointer(&th.regs)-256-uint64(len(link))) &^ 15
+	saved, err := th.mem.readBytes(p.scratch, len(link))
+	if err != nil {
+		return err
+	}
+	if err := th.mem.writeBytes(p.scratch, link); err != nil {
+		return err
+	}
+	p.saved = saved
+	regs := th.regs
+	dirfd := unix.AT_FDCWD
+	return rewriteSyscall(th.tid, &regs, th.arch, unix.SYS_OPENAT, uint64(dirfd), uint64(p.scratch), uint64(p.openFlags()), 0)
+}
+
+// passthroughExit runs at the exit stop of the rewritten open, and returns
+// its descriptor with the thread's registers put back as they were.
+func (th *thread) passthroughExit() {
+	p := th.passing
+	th.passing = nil
+	var regs unix.PtraceRegs
+	if err := getRegs(th.tid, &regs); err != nil {
+		th.t.log.Printf("getregs: %v", err)
+		return
+	}
+	_ = th.mem.writeBytes(p.scratch, p.saved)
+	ret := th.opened(p, int64(returnValue(&regs)))
+	if th.hooked != nil {
+		ret, _ = th.hookExit(ret)
+	}
+	regs = th.regs
+	setReturn(&regs, uint64(ret))
+	if err := setRegs(th.tid, &regs); err != nil {
+		th.t.log.Printf("setregs: %v", err)
+	}
+}
+
+// passNotified serves the open of th under the unotify engine, by adding a
+// new descriptor of the memfd to the notifying task, and returns its
+// result.
+func (t *Tracer) passNotified(listener int, id uint64, th *thread) int64 {
+	p := th.passing
+	th.passing = nil
+	src, err := unix.Open(fmt.Sprintf("/proc/self/fd/%d", p.f.Fd()), p.openFlags()|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return th.opened(p, errnoRet(err))
+	}
+	defer unix.Close(src)
+	addfd := seccompNotifAddfd{ID: id, Srcfd: uint32(src)}
+	if p.flags&unix.O_CLOEXEC != 0 {
+		addfd.NewfdFlags = unix.O_CLOEXEC
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(listener), unix.SECCOMP_IOCTL_NOTIF_ADDFD, uintptr(unsafe.Pointer(&addfd)))
+	if errno != 0 {
+		return th.opened(p, -int64(errno))
+	}
+	return th.opened(p, int64(fd))
+}
@@ -0,0 +1,215 @@
+package tracer
+
+import (
+	"path"
+
+	"golang.org/x/sys/unix"
+)
+
+// Access is what a PathRule lets a command do with the paths it matches.
+type Access int
+
+const (
+	// Hide makes the paths seem not to exist: syscalls naming them fail
+	// with ENOENT.
+	Hide Access = iota + 1
+	// ReadOnly lets the paths be read but not changed: syscalls that
+	// would create, remove, rename or write to them, or change their
+	// metadata, fail with EROFS.
+	ReadOnly
+	// Deny refuses every syscall naming the paths with EACCES.
+	Deny
+)
+
+// PathRule restricts what a command can do with part of the filesystem, as
+// part of a policy given to WithPathRules. Pattern is an absolute path,
+// and may be a path.Match pattern; paths it matches, and everything below
+// them, are subject to Access.
+type PathRule struct {
+	Pattern string
+	Access  Access
+}
+
+// WithPathRules restricts access to the paths the rules match, adding to
+// any rules given before, so that an untrusted command can be kept from
+// reading secrets such as /home/*/.ssh or from changing /etc. Rules are
+// tried in the order given, and only the first that matches a path
+// decides what the command can do with it. A malformed pattern never
+// matches.
+//
+// The rules are applied to paths as the command names them, before
+// remapping and before mounts or the kernel are consulted, and to host
+// paths also where they really lead, with symlinks resolved, so that a
+// symlink does not open a way around them; /proc/self and /dev/fd lead
+// into the command's process, not the tracer's. A syscall fails if any
+// path it names is refused. Like WithReadOnly, the check does not stand up
+// to a command that swaps symlinks while another of its threads makes the
+// syscall, and it does not cover descriptors the command inherits. A
+// hidden name still shows in the listing of its directory.
+func WithPathRules(rules ...PathRule) Option {
+	return func(t *Tracer) {
+		for _, r := range rules {
+			t.pathRules = append(t.pathRules, PathRule{Pattern: path.Clean(r.Pattern), Access: r.Access})
+		}
+	}
+}
+
+// pathSyscalls lists the syscalls, beyond those intercepted anyway, that
+// path rules have to check.
+var pathSyscalls = []uint64{
+	unix.SYS_EXECVE,
+	unix.SYS_EXECVEAT,
+}
+
+// pathRef is a file a syscall names: the path argument at addr, relative
+// to dirfd, or the file open as dirfd if fd is set. An empty path names
+// dirfd too if emptyPath is set.
+type pathRef struct {
+	dirfd     int
+	addr      uintptr
+	fd        bool
+	follow    bool
+	emptyPath bool
+}
+
+// callRefs returns the files the canonical syscall c names, and whether it
+// would change one of them.
+func callRefs(c sysCall) ([]pathRef, bool) {
+	arg := func(i int) uint64 { return c.args[i] }
+	dirfd := func(i int) int { return int(int32(arg(i))) }
+	at := func(i int, follow, emptyPath bool) pathRef {
+		return pathRef{dirfd: dirfd(i), addr: uintptr(arg(i + 1)), follow: follow, emptyPath: emptyPath}
+	}
+	cwd := func(i int, follow bool) pathRef {
+		return pathRef{dirfd: unix.AT_FDCWD, addr: uintptr(arg(i)), follow: follow}
+	}
+	fd := func(i int) pathRef { return pathRef{dirfd: dirfd(i), fd: true} }
+	flag := func(i int, f int32) bool { return int32(arg(i))&f != 0 }
+	switch c.nr {
+	case unix.SYS_OPENAT, unix.SYS_OPENAT2:
+		flags := int(arg(2))
+		return []pathRef{at(0, openFollows(flags), false)}, openWrites(flags)
+	case sysFstatat:
+		return []pathRef{at(0, !flag(3, unix.AT_SYMLINK_NOFOLLOW), flag(3, unix.AT_EMPTY_PATH))}, false
+	case unix.SYS_STATX:
+		return []pathRef{at(0, !flag(2, unix.AT_SYMLINK_NOFOLLOW), flag(2, unix.AT_EMPTY_PATH))}, false
+	case unix.SYS_FACCESSAT:
+		return []pathRef{at(0, true, false)}, false
+	case unix.SYS_FACCESSAT2:
+		return []pathRef{at(0, !flag(3, unix.AT_SYMLINK_NOFOLLOW), flag(3, unix.AT_EMPTY_PATH))}, false
+	case unix.SYS_EXECVEAT:
+		return []pathRef{at(0, !flag(4, unix.AT_SYMLINK_NOFOLLOW), flag(4, unix.AT_EMPTY_PATH))}, false
+	case unix.SYS_READLINKAT:
+		return []pathRef{at(0, false, true)}, false
+	case unix.SYS_MKDIRAT, unix.SYS_UNLINKAT, unix.SYS_MKNODAT:
+		return []pathRef{at(0, false, false)}, true
+	case unix.SYS_RENAMEAT, unix.SYS_RENAMEAT2:
+		return []pathRef{at(0, false, false), at(2, false, false)}, true
+	case unix.SYS_LINKAT:
+		return []pathRef{at(0, flag(4, unix.AT_SYMLINK_FOLLOW), flag(4, unix.AT_EMPTY_PATH)), at(2, false, false)}, true
+	case unix.SYS_SYMLINKAT:
+		return []pathRef{at(1, false, false)}, true
+	case unix.SYS_FCHMODAT:
+		return []pathRef{at(0, true, false)}, true
+	case unix.SYS_FCHMODAT2:
+		return []pathRef{at(0, !flag(3, unix.AT_SYMLINK_NOFOLLOW), flag(3, unix.AT_EMPTY_PATH))}, true
+	case unix.SYS_FCHOWNAT:
+		return []pathRef{at(0, !flag(4, unix.AT_SYMLINK_NOFOLLOW), flag(4, unix.AT_EMPTY_PATH))}, true
+	case unix.SYS_UTIMENSAT:
+		// A null path sets the times of dirfd itself.
+		if arg(1) == 0 {
+			return []pathRef{fd(0)}, true
+		}
+		return []pathRef{at(0, !flag(3, unix.AT_SYMLINK_NOFOLLOW), flag(3, unix.AT_EMPTY_PATH))}, true
+	case unix.SYS_EXECVE, unix.SYS_CHDIR, unix.SYS_STATFS, unix.SYS_GETXATTR, unix.SYS_LISTXATTR, sysAccess:
+		return []pathRef{cwd(0, true)}, false
+	case unix.SYS_LGETXATTR, unix.SYS_LLISTXATTR:
+		return []pathRef{cwd(0, false)}, false
+	case unix.SYS_TRUNCATE, unix.SYS_SETXATTR, unix.SYS_REMOVEXATTR:
+		return []pathRef{cwd(0, true)}, true
+	case unix.SYS_LSETXATTR, unix.SYS_LREMOVEXATTR:
+		return []pathRef{cwd(0, false)}, true
+	case unix.SYS_FCHMOD, unix.SYS_FCHOWN, unix.SYS_FSETXATTR, unix.SYS_FREMOVEXATTR:
+		return []pathRef{fd(0)}, true
+	}
+	return nil, false
+}
+
+// denyPath reports whether the canonical syscall c names a file the path
+// rules refuse it, in which case it must fail with the returned errno
+// instead of running.
+func (th *thread) denyPath(c sysCall) (int64, bool) {
+	refs, write := callRefs(c)
+	var hidden, denied, readOnly bool
+	for _, ref := range refs {
+		switch th.refAccess(ref) {
+		case Hide:
+			hidden = true
+		case Deny:
+			denied = true
+		case ReadOnly:
+			readOnly = readOnly || write
+		}
+	}
+	// A hidden file is not there to be refused, and one refused outright
+	// is not there to be found read-only.
+	var errno unix.Errno
+	switch {
+	case hidden:
+		errno = unix.ENOENT
+	case denied:
+		errno = unix.EACCES
+	case readOnly:
+		errno = unix.EROFS
+	default:
+		return 0, false
+	}
+	th.t.log.Printf("syscall %d denied by path rule: %v", c.nr, errno)
+	th.t.emit(&SyscallDenied{Pid: th.pid, Syscall: c.nr, Errno: errno})
+	return -int64(errno), true
+}
+
+// refAccess returns the Access of the first path rule matching the file
+// ref names, or 0 if none does. Paths that cannot be read or resolved are
+// let through for the kernel to fail.
+func (th *thread) refAccess(ref pathRef) Access {
+	if !ref.fd {
+		p, err := th.mem.readString(ref.addr)
+		if err != nil || p == "" && !ref.emptyPath {
+			return 0
+		}
+		if p != "" {
+			op := decideRule
+			if ref.follow {
+				op = decideRuleFollow
+			}
+			return th.decide(ref.dirfd, p, op, func() decision {
+				abs, err := th.resolve(ref.dirfd, p)
+				if err != nil {
+					return decision{}
+				}
+				return decision{access: th.t.ruleAccess(abs, th.realPath(abs, ref.follow))}
+			}).access
+		}
+	}
+	p, ok := th.fdPath(ref.dirfd)
+	if !ok || !path.IsAbs(p) {
+		// Pipes, sockets and the like have no path to protect.
+		return 0
+	}
+	return th.t.ruleAccess(p, p)
+}
+
+// ruleAccess returns the Access of the first path rule matching the
+// absolute path abs or real, where it leads.
+func (t *Tracer) ruleAccess(abs, real string) Access {
+	for _, r := range t.pathRules {
+		if _, ok := matchPrefix(r.Pattern, abs); ok {
+			return r.Access
+		}
+		if _, ok := matchPrefix(r.Pattern, real); ok {
+			return r.Access
+		}
+	}
+	return 0
+}
@@ -0,0 +1,188 @@
+package tracer
+
+import (
+	"errors"
+	"path"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithPinnedPaths closes the window between the tracer reading a syscall's
+// path and the kernel reading it. Without it, another thread of the
+// command can rewrite a path in memory once the tracer has checked it at
+// syscall entry, and so get past path rules and read-only mode, or reach
+// the host with a syscall the tracer judged to be on it. With it, the
+// paths of every syscall the tracer stops, and the struct open_how of an
+// openat2, are copied into memory the tracer maps read-only in the command,
+// and the syscall is pointed at the copies, so that the tracer and the
+// kernel read the same bytes. A path that cannot be read fails with EFAULT
+// rather than being left to the kernel.
+//
+// So that the copies stay as they were written, the command cannot
+// unmap, remap, madvise or change the protection of that memory, or map
+// over it, which fails with EACCES, nor open /proc/PID/mem for writing,
+// which would write through the protection. Symlinks a path leads through are not pinned along with
+// it. Processes given to Attach have no such memory, and their paths are
+// not pinned. Run fails under EngineUnotify, which cannot repoint a
+// syscall's arguments.
+func WithPinnedPaths() Option {
+	return func(t *Tracer) { t.pinPaths = true }
+}
+
+// pinSyscalls lists the syscalls, beyond those intercepted anyway, that
+// could undo the protection of the pinned copies.
+var pinSyscalls = []uint64{
+	unix.SYS_MUNMAP,
+	unix.SYS_MPROTECT,
+	unix.SYS_PKEY_MPROTECT,
+	unix.SYS_MREMAP,
+	unix.SYS_MADVISE,
+}
+
+// procMemPatterns match the files that write to a process's memory
+// whatever its protection.
+var procMemPatterns = []string{"/proc/*/mem", "/proc/*/task/*/mem"}
+
+// pin copies the paths of the syscall c the thread is stopped entering
+// into its scratch memory, and points c and the thread's registers at the
+// copies. It reports whether c must fail instead, with the returned errno.
+func (th *thread) pin(c *sysCall) (int64, bool) {
+	n, ok := native(*c)
+	if !ok || th.scratch == nil {
+		return 0, false
+	}
+	canon := canonical(n)
+	refs, _ := callRefs(canon)
+	var copies [][2]uintptr
+	for _, ref := range refs {
+		if ref.fd || ref.addr == 0 {
+			continue
+		}
+		p, err := th.mem.readString(ref.addr)
+		if errors.Is(err, errStringTooLong) {
+			return -int64(unix.ENAMETOOLONG), true
+		} else if err != nil {
+			return -int64(unix.EFAULT), true
+		}
+		addr, errno := th.pinBytes(append([]byte(p), 0))
+		if errno != 0 {
+			return -int64(errno), true
+		}
+		copies = append(copies, [2]uintptr{ref.addr, addr})
+	}
+	if canon.nr == unix.SYS_OPENAT2 && canon.args[3] >= openHowSize && canon.args[3] <= maxOpenHowSize {
+		b, err := th.mem.readBytes(uintptr(canon.args[2]), int(canon.args[3]))
+		if err != nil {
+			return -int64(unix.EFAULT), true
+		}
+		addr, errno := th.pinBytes(b)
+		if errno != 0 {
+			return -int64(errno), true
+		}
+		copies = append(copies, [2]uintptr{uintptr(canon.args[2]), addr})
+	}
+	return th.repoint(c, n, copies)
+}
+
+// repoint points the arguments of the syscall c, whose native form is n,
+// that hold the first address of one of copies at the second instead, in c
+// and in the thread's registers. It reports whether c must fail instead,
+// with the returned errno.
+func (th *thread) repoint(c *sysCall, n sysCall, copies [][2]uintptr) (int64, bool) {
+	if copies == nil {
+		return 0, false
+	}
+	// The canonical arguments have moved about, so the ones to repoint
+	// are found by value.
+	regs := argRegs(&th.regs, c.arch == compatArch)
+	for _, cp := range copies {
+		for i := range c.args {
+			if n.args[i] == uint64(cp[0]) {
+				c.args[i], *regs[i] = uint64(cp[1]), uint64(cp[1])
+			}
+		}
+	}
+	if err := setRegs(th.tid, &th.regs); err != nil {
+		th.t.log.Printf("repoint: setregs: %v", err)
+		return -int64(unix.EFAULT), true
+	}
+	return 0, false
+}
+
+// pinBytes copies b into scratch memory, to be released by unpin, and
+// returns its address, or the errno to fail the syscall with.
+func (th *thread) pinBytes(b []byte) (uintptr, unix.Errno) {
+	addr, err := th.scratch.alloc(len(b))
+	if err != nil {
+		th.t.log.Printf("pin: %v", err)
+		return 0, unix.ENOMEM
+	}
+	if err := th.mem.writeBytes(addr, b); err != nil {
+		th.scratch.free(addr)
+		th.t.log.Printf("pin: %v", err)
+		return 0, unix.EFAULT
+	}
+	th.pinned = append(th.pinned, addr)
+	return addr, 0
+}
+
+// unpin releases the copies pin and reroot made, once their syscall is
+// done with.
+func (th *thread) unpin() {
+	if th.scratch != nil {
+		for _, addr := range th.pinned {
+			th.scratch.free(addr)
+		}
+	}
+	th.pinned = nil
+}
+
+// guardPins reports whether the canonical syscall c would let the command
+// write to its scratch memory, where the pinned copies are, in which case
+// it must fail with the returned EACCES.
+func (th *thread) guardPins(c sysCall) (int64, bool) {
+	arg := func(i int) uint64 { return c.args[i] }
+	overlaps := func(addr, n uint64) bool {
+		s := th.scratch
+		return s != nil && addr < uint64(s.addr)+scratchSize && uint64(s.addr) < addr+n
+	}
+	var denied bool
+	switch c.nr {
+	case unix.SYS_MUNMAP, unix.SYS_MPROTECT, unix.SYS_PKEY_MPROTECT, unix.SYS_MADVISE:
+		// madvise can zero the pages, cutting a copy short.
+		denied = overlaps(arg(0), arg(1))
+	case unix.SYS_MREMAP:
+		denied = overlaps(arg(0), arg(1)) || arg(3)&unix.MREMAP_FIXED != 0 && overlaps(arg(4), arg(2))
+	case unix.SYS_MMAP:
+		denied = arg(3)&unix.MAP_FIXED != 0 && overlaps(arg(0), arg(1))
+	case unix.SYS_OPENAT, unix.SYS_OPENAT2:
+		denied = openWrites(int(arg(2))) && th.procMem(int(int32(arg(0))), uintptr(arg(1)))
+	}
+	if !denied {
+		return 0, false
+	}
+	th.t.log.Printf("syscall %d denied: it would unprotect pinned paths", c.nr)
+	th.t.emit(&SyscallDenied{Pid: th.pid, Syscall: c.nr, Errno: unix.EACCES})
+	return -int64(unix.EACCES), true
+}
+
+// procMem reports whether the path at addr, relative to dirfd, names the
+// memory file of a process, as given or with symlinks resolved.
+func (th *thread) procMem(dirfd int, addr uintptr) bool {
+	p, err := th.mem.readString(addr)
+	if err != nil {
+		return false
+	}
+	abs, err := th.resolve(dirfd, p)
+	if err != nil {
+		return false
+	}
+	for _, q := range []string{abs, th.realPath(abs, true)} {
+		for _, pattern := range procMemPatterns {
+			if ok, _ := path.Match(pattern, q); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
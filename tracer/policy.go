@@ -0,0 +1,174 @@
+package tracer
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Rule blocks a syscall, as part of a policy given to WithPolicy.
+type Rule struct {
+	// Syscall is the native number of the syscall to block, such as
+	// unix.SYS_MOUNT. A rule for execve covers execveat too.
+	Syscall uint64
+	// Paths, if set, limits a rule for execve to executables whose
+	// absolute path, as given or with symlinks resolved, matches one of
+	// these path.Match patterns.
+	Paths []string
+	// Errno is the error the blocked syscall fails with. The default is
+	// EPERM.
+	Errno syscall.Errno
+	// Kill kills the process that makes the syscall instead.
+	Kill bool
+}
+
+// WithPolicy blocks the syscalls the rules name, adding to any rules given
+// before. The first rule that matches a syscall decides what happens to it.
+//
+// In 32-bit x86 code rules only match syscalls the tracer knows the i386
+// numbers of, which include the mount, module, namespace, socket and
+// ptrace syscalls but not socketcall, through which older code reaches
+// connect and friends.
+func WithPolicy(rules ...Rule) Option {
+	return func(t *Tracer) { t.rules = append(t.rules, rules...) }
+}
+
+// SyscallNumber returns the native number of the syscall called name, as
+// in "mount" or "connect", or of the one a decimal name gives the number
+// of. It knows the syscalls the tracer intercepts or traces and those a
+// policy commonly blocks.
+func SyscallNumber(name string) (uint64, bool) {
+	for nr, spec := range syscallSpecs {
+		if spec.name == name {
+			return nr, true
+		}
+	}
+	nr, err := strconv.ParseUint(name, 10, 64)
+	return nr, err == nil
+}
+
+// syscalls returns the syscalls the seccomp filter must trap.
+func (t *Tracer) syscalls() []uint64 {
+	nrs := append(intercepted[:len(intercepted):len(intercepted)], t.ruleSyscalls()...)
+	nrs = append(nrs, t.hookSyscalls()...)
+	nrs = append(nrs, t.faultSyscalls()...)
+	nrs = append(nrs, t.delaySyscalls()...)
+	nrs = append(nrs, t.execSyscalls()...)
+	nrs = append(nrs, t.ioURingSyscalls()...)
+	nrs = append(nrs, t.randomSyscalls()...)
+	nrs = append(nrs, t.clockSyscalls()...)
+	nrs = append(nrs, t.netSyscalls()...)
+	nrs = append(nrs, t.egressSyscalls()...)
+	nrs = append(nrs, t.auditSyscalls()...)
+	nrs = append(nrs, t.syncSyscalls()...)
+	nrs = append(nrs, t.inotifySyscalls()...)
+	nrs = append(nrs, t.pollSyscalls()...)
+	nrs = append(nrs, t.chrootSyscalls()...)
+	nrs = append(nrs, t.fakeRootSyscalls()...)
+	nrs = append(nrs, t.ioctlSyscalls()...)
+	if t.readOnly || t.pathRules != nil {
+		nrs = append(nrs, writeSyscalls...)
+	}
+	if t.pathRules != nil {
+		nrs = append(nrs, pathSyscalls...)
+	}
+	if t.pinPaths {
+		nrs = append(nrs, pinSyscalls...)
+	}
+	return nrs
+}
+
+// ruleSyscalls returns the syscalls the rules need trapped.
+func (t *Tracer) ruleSyscalls() []uint64 {
+	var nrs []uint64
+	for _, r := range t.rules {
+		nrs = append(nrs, r.Syscall)
+		if r.Syscall == unix.SYS_EXECVE {
+			nrs = append(nrs, unix.SYS_EXECVEAT)
+		}
+	}
+	return nrs
+}
+
+// denyRule applies the first rule matching the canonical syscall c. It
+// reports whether c is blocked and, if so, the value it fails with.
+func (th *thread) denyRule(c sysCall) (int64, bool) {
+	for _, r := range th.t.rules {
+		if !th.matches(r, c) {
+			continue
+		}
+		if r.Kill {
+			th.t.log.Printf("syscall %d denied: killing %d", c.nr, th.tid)
+			// The signal takes down the whole thread group.
+			_ = unix.Kill(th.tid, unix.SIGKILL)
+			th.t.emit(&SyscallDenied{Pid: th.pid, Syscall: c.nr, Killed: true})
+			return -int64(unix.EPERM), true
+		}
+		errno := r.Errno
+		if errno == 0 {
+			errno = unix.EPERM
+		}
+		th.t.log.Printf("syscall %d denied: %v", c.nr, errno)
+		th.t.emit(&SyscallDenied{Pid: th.pid, Syscall: c.nr, Errno: errno})
+		return -int64(errno), true
+	}
+	return 0, false
+}
+
+func (th *thread) matches(r Rule, c sysCall) bool {
+	exec := r.Syscall == unix.SYS_EXECVE && c.nr == unix.SYS_EXECVEAT
+	if r.Syscall != c.nr && !exec {
+		return false
+	}
+	if len(r.Paths) == 0 || r.Syscall != unix.SYS_EXECVE {
+		return true
+	}
+	dirfd, addr := unix.AT_FDCWD, uintptr(c.args[0])
+	if c.nr == unix.SYS_EXECVEAT {
+		dirfd, addr = int(int32(c.args[0])), uintptr(c.args[1])
+	}
+	abs, ok := th.pathArg(dirfd, addr)
+	if !ok {
+		// An unreadable path cannot be checked; the kernel would fail
+		// it anyway.
+		return false
+	}
+	real := th.realPath(abs, true)
+	for _, pattern := range r.Paths {
+		if ok, _ := path.Match(pattern, abs); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, real); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pathArg returns the absolute path of the file named by the path argument
+// at addr, relative to dirfd. An empty path names dirfd itself, as
+// execveat and the other *at syscalls do with AT_EMPTY_PATH.
+func (th *thread) pathArg(dirfd int, addr uintptr) (string, bool) {
+	p, err := th.mem.readString(addr)
+	if err != nil {
+		return "", false
+	}
+	if p != "" {
+		abs, err := th.resolve(dirfd, p)
+		return abs, err == nil
+	}
+	return th.fdPath(dirfd)
+}
+
+// fdPath returns the absolute path of the file open as fd, if it has one.
+func (th *thread) fdPath(fd int) (string, bool) {
+	if f, ok := th.fds.get(fd); ok {
+		return f.path, true
+	}
+	p, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", th.tid, fd))
+	return p, err == nil && path.IsAbs(p)
+}
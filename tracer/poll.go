@@ -0,0 +1,385 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"strconv"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The kernel does not know the numbers of virtual descriptors, so it would
+// fail a poll, select or epoll_ctl naming one. Each virtual file
+// description is instead backed, in the tracer, by a real object standing
+// in for it: an eventfd that is always readable and writable, as a regular
+// file is. epoll_ctl on a virtual descriptor is carried out on the backing,
+// in the command's epoll instance, so epoll_wait reports it with the data
+// the command gave. The backing is closed, and its epoll entries go, once
+// the file description is; the descriptors of one description share its
+// backing, so the second of them added to an epoll fails with EEXIST.
+//
+// A poll or select naming a virtual descriptor is the tracer's to do. It
+// polls the backings and copies of the thread's real descriptors, and as a
+// virtual one is nearly always ready answers at once. Otherwise a worker
+// waits for the rest, if the tracer has workers; without them the wait
+// holds up the tracer. The signal mask of ppoll and pselect6 is not
+// applied meanwhile.
+
+// pollSyscalls returns the syscalls, beyond those intercepted anyway, that
+// polls of virtual descriptors need trapped. There are none without mounts.
+func (t *Tracer) pollSyscalls() []uint64 {
+	if len(t.mounts) == 0 && t.random == nil {
+		return nil
+	}
+	return polledSyscalls
+}
+
+// backing returns the tracer's descriptor of the eventfd backing f,
+// creating it if need be.
+func (f *vfile) backing() (int, error) {
+	if f.ready == nil {
+		fd, err := unix.Eventfd(1, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+		if err != nil {
+			return -1, err
+		}
+		f.ready = os.NewFile(uintptr(fd), "cfc-ready")
+	}
+	return int(f.ready.Fd()), nil
+}
+
+// pollVirtual reports whether any of fds is virtual in the thread.
+func (th *thread) pollVirtual(fds []unix.PollFd) bool {
+	for _, p := range fds {
+		if _, ok := th.fds.get(int(p.Fd)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pollWait is a poll the tracer makes for the thread's fds: polled holds
+// the backing of each virtual descriptor and a copy of each real one, or
+// -1 for one the thread does not have open, which is in nval.
+type pollWait struct {
+	fds    []unix.PollFd
+	polled []unix.PollFd
+	nval   []bool
+	copies []int
+}
+
+func (th *thread) newPollWait(fds []unix.PollFd) *pollWait {
+	w := &pollWait{fds: fds, polled: make([]unix.PollFd, len(fds)), nval: make([]bool, len(fds))}
+	for i, p := range fds {
+		w.polled[i] = unix.PollFd{Fd: -1, Events: p.Events}
+		if p.Fd < 0 {
+			continue
+		}
+		fd := -1
+		if f, ok := th.fds.get(int(p.Fd)); ok {
+			fd, _ = f.backing()
+		} else if c, err := th.dupFD(int(p.Fd)); err == nil {
+			fd = c
+			w.copies = append(w.copies, c)
+		}
+		w.polled[i].Fd = int32(fd)
+		w.nval[i] = fd < 0
+	}
+	return w
+}
+
+// poll polls for up to timeout, or forever if it is negative, and returns
+// the number of descriptors with events, which it stores in w.fds.
+func (w *pollWait) poll(timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		ms := -1
+		if timeout >= 0 {
+			left := time.Until(deadline)
+			ms = int(min((max(left, 0)+time.Millisecond-1)/time.Millisecond, math.MaxInt32))
+		}
+		_, err := unix.Poll(w.polled, ms)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		break
+	}
+	n := 0
+	for i := range w.fds {
+		w.fds[i].Revents = w.polled[i].Revents
+		if w.nval[i] {
+			w.fds[i].Revents = unix.POLLNVAL
+		}
+		if w.fds[i].Revents != 0 {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (w *pollWait) close() {
+	for _, fd := range w.copies {
+		unix.Close(fd)
+	}
+}
+
+// multiplex polls fds for the thread, for up to timeout or forever if it
+// is negative, and returns what done makes of the number of descriptors
+// with events: at once if there are any, and otherwise once the wait is
+// over. done is passed the time the wait took.
+func (th *thread) multiplex(fds []unix.PollFd, timeout time.Duration, done func(n int, err error, took time.Duration) int64) (int64, bool) {
+	w := th.newPollWait(fds)
+	start := time.Now()
+	then := func(n int, err error) int64 {
+		w.close()
+		return done(n, err, time.Since(start))
+	}
+	if n, err := w.poll(0); n > 0 || err != nil || timeout == 0 {
+		return then(n, err), true
+	}
+	wait := func() (int, error) { return w.poll(timeout) }
+	if th.offload(nil, wait, then) {
+		return 0, true
+	}
+	return then(wait()), true
+}
+
+// readTimeout reads the timespec, or with a unit of a microsecond the
+// timeval, at addr, and returns -1 for a null addr.
+func (th *thread) readTimeout(addr uintptr, unit time.Duration) (time.Duration, unix.Errno) {
+	if addr == 0 {
+		return -1, 0
+	}
+	b, err := th.mem.readBytes(addr, 16)
+	if err != nil {
+		return 0, unix.EFAULT
+	}
+	sec, frac := int64(binary.LittleEndian.Uint64(b)), int64(binary.LittleEndian.Uint64(b[8:]))
+	if sec < 0 || frac < 0 || frac >= int64(time.Second/unit) {
+		return 0, unix.EINVAL
+	}
+	if sec > math.MaxInt64/int64(time.Second)-1 {
+		return -1, 0
+	}
+	return time.Duration(sec)*time.Second + time.Duration(frac)*unit, 0
+}
+
+// leftTimeout writes what is left of timeout after took at addr, as the
+// kernel does for ppoll, select and pselect6, unless addr is null.
+func (th *thread) leftTimeout(addr uintptr, timeout, took time.Duration, unit time.Duration) int64 {
+	if addr == 0 || timeout < 0 {
+		return 0
+	}
+	return th.writeTime(addr, int64(max(timeout-took, 0)), unit)
+}
+
+// sysPoll is poll, whose timeout is in milliseconds.
+func (th *thread) sysPoll(fdsAddr uintptr, nfds int, timeout int) (int64, bool) {
+	d := time.Duration(-1)
+	if timeout >= 0 {
+		d = time.Duration(timeout) * time.Millisecond
+	}
+	return th.sysPpoll(fdsAddr, nfds, 0, d)
+}
+
+// sysPpoll polls the nfds pollfds at fdsAddr for the timeout whose
+// timespec is at tsAddr, or, if that is null, for timeout.
+func (th *thread) sysPpoll(fdsAddr uintptr, nfds int, tsAddr uintptr, timeout time.Duration) (int64, bool) {
+	if len(th.fds.fds) == 0 || nfds <= 0 || nfds > fdBase {
+		return 0, false
+	}
+	b, err := th.mem.readBytes(fdsAddr, nfds*8)
+	if err != nil {
+		return 0, false
+	}
+	fds := make([]unix.PollFd, nfds)
+	for i := range fds {
+		rec := b[i*8:]
+		fds[i] = unix.PollFd{Fd: int32(binary.LittleEndian.Uint32(rec)), Events: int16(binary.LittleEndian.Uint16(rec[4:]))}
+	}
+	if !th.pollVirtual(fds) {
+		return 0, false
+	}
+	th.t.log.Printf("poll: nfds=%d (virtual)", nfds)
+	if tsAddr != 0 {
+		var errno unix.Errno
+		if timeout, errno = th.readTimeout(tsAddr, time.Nanosecond); errno != 0 {
+			return -int64(errno), true
+		}
+	}
+	return th.multiplex(fds, timeout, func(n int, err error, took time.Duration) int64 {
+		if err != nil {
+			return errnoRet(err)
+		}
+		for i, p := range fds {
+			binary.LittleEndian.PutUint16(b[i*8+6:], uint16(p.Revents))
+		}
+		if err := th.mem.writeBytes(fdsAddr, b); err != nil {
+			return -int64(unix.EFAULT)
+		}
+		if ret := th.leftTimeout(tsAddr, timeout, took, time.Nanosecond); ret < 0 {
+			return ret
+		}
+		return int64(n)
+	})
+}
+
+// The poll events x/sys/unix leaves out, as on amd64 and arm64.
+const (
+	pollRdNorm = 0x40
+	pollRdBand = 0x80
+	pollWrNorm = 0x100
+	pollWrBand = 0x200
+)
+
+// selectSets are, for each of select's read, write and exception sets,
+// the event it polls for and the events that put a descriptor in it.
+var selectSets = [3]struct{ asks, counts int16 }{
+	{unix.POLLIN, unix.POLLIN | pollRdNorm | pollRdBand | unix.POLLHUP | unix.POLLERR},
+	{unix.POLLOUT, unix.POLLOUT | pollWrNorm | pollWrBand | unix.POLLERR},
+	{unix.POLLPRI, unix.POLLPRI},
+}
+
+// sysSelect is select, whose timeout is a timeval.
+func (th *thread) sysSelect(nfds int, sets [3]uintptr, tvAddr uintptr) (int64, bool) {
+	return th.sysPselect(nfds, sets, tvAddr, time.Microsecond)
+}
+
+// sysPselect6 is pselect6, whose timeout is a timespec.
+func (th *thread) sysPselect6(nfds int, sets [3]uintptr, tsAddr uintptr) (int64, bool) {
+	return th.sysPselect(nfds, sets, tsAddr, time.Nanosecond)
+}
+
+// sysPselect selects among the first nfds descriptors, which are in the
+// read, write and exception sets at sets, for the timeout at tAddr, in
+// unit.
+func (th *thread) sysPselect(nfds int, sets [3]uintptr, tAddr uintptr, unit time.Duration) (int64, bool) {
+	if len(th.fds.fds) == 0 || nfds <= 0 {
+		return 0, false
+	}
+	// As in the kernel, descriptors past the end of the table are left
+	// out, and virtual ones above it count as part of it.
+	limit := 0
+	if v, ok := statusField(th.tid, "FDSize"); ok {
+		limit, _ = strconv.Atoi(v)
+	}
+	for fd := range th.fds.fds {
+		limit = max(limit, fd+1)
+	}
+	nfds = min(nfds, limit)
+	size := (nfds + 63) / 64 * 8
+	var bits [3][]byte
+	for i, addr := range sets {
+		if addr == 0 {
+			continue
+		}
+		b, err := th.mem.readBytes(addr, size)
+		if err != nil {
+			return 0, false
+		}
+		bits[i] = b
+	}
+	set := func(i, fd int) bool { return bits[i] != nil && bits[i][fd/8]&(1<<(fd%8)) != 0 }
+	var fds []unix.PollFd
+	for fd := range nfds {
+		var events int16
+		for i, ss := range selectSets {
+			if set(i, fd) {
+				events |= ss.asks
+			}
+		}
+		if events != 0 {
+			fds = append(fds, unix.PollFd{Fd: int32(fd), Events: events})
+		}
+	}
+	if !th.pollVirtual(fds) {
+		return 0, false
+	}
+	timeout, errno := th.readTimeout(tAddr, unit)
+	if errno != 0 {
+		return -int64(errno), true
+	}
+	th.t.log.Printf("select: nfds=%d (virtual)", nfds)
+	return th.multiplex(fds, timeout, func(_ int, err error, took time.Duration) int64 {
+		if err != nil {
+			return errnoRet(err)
+		}
+		for i := range bits {
+			clear(bits[i])
+		}
+		n := 0
+		for _, p := range fds {
+			if p.Revents&unix.POLLNVAL != 0 {
+				return -int64(unix.EBADF)
+			}
+			fd := int(p.Fd)
+			for i, ss := range selectSets {
+				if p.Events&ss.asks != 0 && p.Revents&ss.counts != 0 {
+					bits[i][fd/8] |= 1 << (fd % 8)
+					n++
+				}
+			}
+		}
+		for i, addr := range sets {
+			if bits[i] == nil {
+				continue
+			}
+			if err := th.mem.writeBytes(addr, bits[i]); err != nil {
+				return -int64(unix.EFAULT)
+			}
+		}
+		if ret := th.leftTimeout(tAddr, timeout, took, unit); ret < 0 {
+			return ret
+		}
+		return int64(n)
+	})
+}
+
+// sysEpollCtl adds, changes or removes the virtual descriptor fd in the
+// thread's epoll instance epfd, through fd's backing.
+func (th *thread) sysEpollCtl(epfd, op, fd int, eventAddr uintptr) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	th.t.log.Printf("epoll_ctl: epfd=%d op=%d fd=%d (virtual)", epfd, op, fd)
+	if _, ok := th.fds.get(epfd); ok {
+		// A virtual file is never an epoll instance.
+		return -int64(unix.EINVAL), true
+	}
+	var ev unix.EpollEvent
+	if op != unix.EPOLL_CTL_DEL {
+		size := int(unsafe.Sizeof(ev))
+		b, err := th.mem.readBytes(eventAddr, size)
+		if err != nil {
+			return -int64(unix.EFAULT), true
+		}
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&ev)), size), b)
+	}
+	ep, err := th.dupFD(epfd)
+	if err != nil {
+		return -int64(unix.EBADF), true
+	}
+	defer unix.Close(ep)
+	backing, err := f.backing()
+	if err != nil {
+		return errnoRet(err), true
+	}
+	if err := unix.EpollCtl(ep, op, backing, &ev); err != nil {
+		return errnoRet(err), true
+	}
+	if op == unix.EPOLL_CTL_ADD {
+		th.undo = func() {
+			if ep, err := th.dupFD(epfd); err == nil {
+				_ = unix.EpollCtl(ep, unix.EPOLL_CTL_DEL, backing, nil)
+				unix.Close(ep)
+			}
+		}
+	}
+	return 0, true
+}
@@ -0,0 +1,139 @@
+package tracer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// resolve turns a path argument relative to dirfd into an absolute, clean
+// path using the tracee's view of the filesystem, walking it as walk does.
+// A virtual dirfd resolves relative to its virtual directory. Below a root
+// chroot gave the thread, the path returned is where the tracer finds the
+// file, with the root before it.
+func (th *thread) resolve(dirfd int, p string) (string, error) {
+	abs, _, err := th.resolveArg(dirfd, p)
+	return abs, err
+}
+
+// resolveArg is resolve, and also reports whether the kernel would not
+// find abs from p: where p is relative to a directory only the tracer
+// knows, or its walk goes through the virtual tree, as walkThrough has it.
+func (th *thread) resolveArg(dirfd int, p string) (abs string, through bool, err error) {
+	d := th.decide(dirfd, p, decideResolve, func() decision {
+		abs, through, err := th.walkArg(dirfd, p)
+		return decision{abs: abs, through: through, err: err}
+	})
+	return d.abs, d.through, d.err
+}
+
+// walkArg resolves p as resolveArg does, without the decision cache.
+func (th *thread) walkArg(dirfd int, p string) (string, bool, error) {
+	var (
+		dir     string
+		through bool
+		err     error
+	)
+	switch {
+	case path.IsAbs(p):
+		dir = th.root()
+	case dirfd == unix.AT_FDCWD && th.cwd.dir != "":
+		dir, through = th.cwd.dir, true
+	case dirfd == unix.AT_FDCWD:
+		dir, err = os.Readlink(fmt.Sprintf("/proc/%d/cwd", th.tid))
+	default:
+		f, ok := th.fds.get(dirfd)
+		if !ok {
+			dir, err = os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", th.tid, dirfd))
+			break
+		}
+		fi, err := f.file.Stat()
+		if err != nil {
+			return "", false, &walkError{errnoFor(err)}
+		}
+		if !fi.IsDir() {
+			return "", false, &walkError{unix.ENOTDIR}
+		}
+		dir, through = f.path, true
+	}
+	if err != nil {
+		return "", false, err
+	}
+	abs, via, err := th.t.walkThrough(th.root(), dir, p)
+	return abs, through || via, err
+}
+
+// walkError is what resolve fails with for a path that leads nowhere in
+// the virtual tree, which the syscall naming it is to fail with too.
+type walkError struct {
+	errno unix.Errno
+}
+
+func (e *walkError) Error() string { return e.errno.Error() }
+
+func (e *walkError) Unwrap() error { return e.errno }
+
+// resolveFailed returns what a syscall does whose path resolve failed on
+// with err: fail with the errno of a walkError, or else go to the kernel.
+func resolveFailed(err error) (int64, bool) {
+	if e, ok := err.(*walkError); ok {
+		return -int64(e.errno), true
+	}
+	return 0, false
+}
+
+// realFD reports whether the kernel has fd open in the thread.
+func (th *thread) realFD(fd int) bool {
+	_, err := os.Lstat(fmt.Sprintf("/proc/%d/fd/%d", th.tid, fd))
+	return err == nil
+}
+
+// placeholderSource returns a real descriptor of the thread, other than
+// the reserved one, to duplicate into th.reserve. It reports false if
+// nothing is reserved or there is no such descriptor.
+func (th *thread) placeholderSource() (int, bool) {
+	if th.reserve == nil {
+		return 0, false
+	}
+	entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", th.tid))
+	if err != nil {
+		return 0, false
+	}
+	for _, e := range entries {
+		if fd, err := strconv.Atoi(e.Name()); err == nil && fd != th.reserve.fd {
+			return fd, true
+		}
+	}
+	return 0, false
+}
+
+// umask returns the tracee's file mode creation mask.
+func (th *thread) umask() uint32 {
+	if v, ok := statusField(th.tid, "Umask"); ok {
+		if m, err := strconv.ParseUint(v, 8, 32); err == nil {
+			return uint32(m)
+		}
+	}
+	return 0o022
+}
+
+// statusField returns the value of key in /proc/tid/status.
+func statusField(tid int, key string) (string, bool) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", tid))
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if v, ok := strings.CutPrefix(s.Text(), key+":"); ok {
+			return strings.TrimSpace(v), true
+		}
+	}
+	return "", false
+}
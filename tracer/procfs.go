@@ -0,0 +1,335 @@
+package tracer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+)
+
+// procView is what the tracer knows of a traced process that its files in
+// /proc do not show: its virtual descriptors and working directory, and
+// the scratch memory the tracer keeps in it. tid is the task whose files
+// are to be read for the rest.
+type procView struct {
+	tid     int
+	fds     *fdTable
+	cwd     *workDir
+	scratch *scratch
+}
+
+// procEntry splits abs, a path in /proc naming a file of a traced process
+// or of one of its threads, into that process's view and the path within
+// its directory. /dev/fd stands for /proc/self/fd, as the symlink it is.
+// It reports false for any other path.
+func (th *thread) procEntry(abs string) (*procView, string, bool) {
+	rest, ok := strings.CutPrefix(abs, "/proc/")
+	if !ok {
+		if abs != "/dev/fd" && !strings.HasPrefix(abs, "/dev/fd/") {
+			return nil, "", false
+		}
+		rest = "self/fd" + abs[len("/dev/fd"):]
+	}
+	who, rest, _ := strings.Cut(rest, "/")
+	var v *procView
+	switch who {
+	case "self", "thread-self":
+		v = th.view(th.tid)
+	default:
+		n, err := strconv.Atoi(who)
+		if err != nil {
+			return nil, "", false
+		}
+		if v, ok = th.viewOf(n); !ok {
+			return nil, "", false
+		}
+	}
+	if task, ok := strings.CutPrefix(rest, "task/"); ok {
+		id, r, _ := strings.Cut(task, "/")
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, "", false
+		}
+		if v, ok = th.viewOf(n); !ok {
+			return nil, "", false
+		}
+		rest = r
+	}
+	return v, rest, true
+}
+
+func (th *thread) view(tid int) *procView {
+	return &procView{tid: tid, fds: th.fds, cwd: th.cwd, scratch: th.scratch}
+}
+
+// viewOf returns the view of the traced task or process id.
+func (th *thread) viewOf(id int) (*procView, bool) {
+	t := th.t
+	switch {
+	case id == th.pid || id == th.tid:
+		return th.view(id), true
+	case t.threads[id] != nil:
+		return t.threads[id].view(id), true
+	case t.procs[id] != nil:
+		p := t.procs[id]
+		return &procView{tid: id, fds: p.fds, cwd: p.cwd}, true
+	}
+	return nil, false
+}
+
+// procLink returns the target of a symlink in /proc as the process sees
+// it: a virtual descriptor's file, a virtual working directory, or the
+// virtual program or file an exec'd memfd, or one WithPassthrough or
+// WithLeases handed out, holds. It reports false for every other path, which the kernel
+// knows as well as the tracer.
+func (th *thread) procLink(abs string) (string, bool) {
+	v, rest, ok := th.procEntry(abs)
+	if !ok {
+		return "", false
+	}
+	switch {
+	case rest == "cwd" && v.cwd.dir != "":
+		return v.cwd.dir, true
+	case rest == "exe":
+		return th.t.memfdPath(fmt.Sprintf("/proc/%d/exe", v.tid), execName)
+	}
+	if f, ok := v.virtualFD(rest); ok {
+		return f.path, true
+	}
+	if strings.HasPrefix(rest, "fd/") {
+		// A descriptor WithPassthrough or WithLeases handed out.
+		return th.t.memfdPath(fmt.Sprintf("/proc/%d/%s", v.tid, rest), memfdName)
+	}
+	return "", false
+}
+
+// memfdPath returns the virtual file the memfd named name, which the link
+// in /proc leads to, holds a copy of. It reports false if the link leads
+// anywhere else.
+func (t *Tracer) memfdPath(link, name string) (string, bool) {
+	ino, ok := memfdIno(link, name)
+	if !ok {
+		return "", false
+	}
+	p, ok := t.memfds[ino]
+	return p, ok
+}
+
+// virtualFD returns the virtual file rest, a path in a process's /proc
+// directory, names, if it is one of the process's descriptors.
+func (v *procView) virtualFD(rest string) (*vfile, bool) {
+	s, ok := strings.CutPrefix(rest, "fd/")
+	if !ok {
+		return nil, false
+	}
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, false
+	}
+	return v.fds.get(fd)
+}
+
+// openProc opens the file abs in /proc, if it is one the tracer serves: a
+// virtual descriptor reopened through its fd link, a process's fd
+// directory with its virtual descriptors listed, or its maps, with the
+// memfds that stand in for virtual files named after them and the
+// tracer's scratch memory left out. The directory and the maps are
+// snapshots taken at the open.
+func (th *thread) openProc(abs string, flags int, mode uint32) (int64, bool) {
+	v, rest, ok := th.procEntry(abs)
+	if !ok {
+		return 0, false
+	}
+	if f, ok := v.virtualFD(rest); ok {
+		th.t.log.Printf("openat: %s (virtual)", abs)
+		if flags&(unix.O_NOFOLLOW|unix.O_PATH) == unix.O_NOFOLLOW {
+			return -int64(unix.ELOOP), true
+		}
+		return th.openVirtual(f.mount, f.name, f.path, flags, mode), true
+	}
+	if flags&unix.O_ACCMODE != unix.O_RDONLY || flags&unix.O_CREAT != 0 {
+		return 0, false
+	}
+	fs := memfs.New()
+	name := "."
+	var err error
+	switch rest {
+	case "fd":
+		err = th.t.fdLinks(fs, v)
+	case "maps":
+		var b []byte
+		if b, err = th.t.procMaps(v); err == nil {
+			name = "maps"
+			err = writeFile(fs, name, b)
+		}
+	default:
+		return 0, false
+	}
+	if err != nil {
+		th.t.log.Printf("%s: %v", abs, err)
+		return 0, false
+	}
+	th.t.log.Printf("openat: %s (virtual)", abs)
+	m := &mount{dir: abs, backend: fs}
+	if name != "." {
+		m.dir = path.Dir(abs)
+	}
+	return th.openVirtual(m, name, abs, flags, 0), true
+}
+
+// fdLinks fills fs with a symlink for each descriptor of the process v,
+// to the file it is open on, as /proc/PID/fd lists them.
+func (t *Tracer) fdLinks(fs *memfs.FS, v *procView) error {
+	dir := fmt.Sprintf("/proc/%d/fd", v.tid)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	links := make(map[int]string)
+	for _, e := range entries {
+		fd, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if target, err := os.Readlink(path.Join(dir, e.Name())); err == nil {
+			links[fd] = target
+		}
+	}
+	for fd, d := range v.fds.fds {
+		links[fd] = d.file.path
+	}
+	for _, fd := range slices.Sorted(maps.Keys(links)) {
+		if err := fs.Symlink(links[fd], strconv.Itoa(fd)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// procMaps returns the maps of the process v, with the names of the memfds the
+// tracer made for virtual files and programs replaced by theirs, and
+// without the scratch memory.
+func (t *Tracer) procMaps(v *procView) ([]byte, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/maps", v.tid))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := s.Text()
+		f := strings.Fields(line)
+		if len(f) < 5 {
+			out.WriteString(line + "\n")
+			continue
+		}
+		start, _, _ := strings.Cut(f[0], "-")
+		if addr, err := strconv.ParseUint(start, 16, 64); err == nil && v.scratch != nil && uintptr(addr) == v.scratch.addr {
+			continue
+		}
+		if len(f) >= 6 && (strings.HasPrefix(f[5], "/memfd:"+memfdName) || strings.HasPrefix(f[5], "/memfd:"+execName)) {
+			ino, _ := strconv.ParseUint(f[4], 10, 64)
+			if p, ok := t.memfds[ino]; ok {
+				line = line[:strings.Index(line, f[5])] + p
+			}
+		}
+		out.WriteString(line + "\n")
+	}
+	return out.Bytes(), s.Err()
+}
+
+// statProc stats the fd link abs in /proc of a virtual descriptor: the
+// file it is open on, or, with AT_SYMLINK_NOFOLLOW, the link itself,
+// whose permissions say how the file is open.
+func (th *thread) statProc(abs string, flags int) (unix.Stat_t, error, bool) {
+	v, rest, ok := th.procEntry(abs)
+	if !ok {
+		return unix.Stat_t{}, nil, false
+	}
+	f, ok := v.virtualFD(rest)
+	if !ok {
+		return unix.Stat_t{}, nil, false
+	}
+	th.t.log.Printf("stat: %s (virtual)", abs)
+	if flags&unix.AT_SYMLINK_NOFOLLOW == 0 {
+		fi, err := f.file.Stat()
+		if err != nil {
+			return unix.Stat_t{}, err, true
+		}
+		st := f.mount.stat(f.path, fi)
+		th.t.fakeStat(f.mount, f.name, &st)
+		return st, nil, true
+	}
+	var st unix.Stat_t
+	if err := unix.Lstat(fmt.Sprintf("/proc/%d/fd", v.tid), &st); err != nil {
+		return unix.Stat_t{}, err, true
+	}
+	perm := uint32(0o500)
+	switch f.flags & unix.O_ACCMODE {
+	case unix.O_WRONLY:
+		perm = 0o300
+	case unix.O_RDWR:
+		perm = 0o700
+	}
+	st.Mode, st.Nlink, st.Size, st.Blocks = unix.S_IFLNK|perm, 1, 64, 0
+	st.Ino = inodeNumber(abs, nil)
+	return st, nil, true
+}
+
+// ownProc returns name, a host path relative to the root, with the
+// directory of the process /proc/self, /proc/thread-self or /dev/fd stands
+// for made th's.
+func (th *thread) ownProc(name string) string {
+	for _, self := range []string{"proc/self", "proc/thread-self", "dev/fd"} {
+		if rest, ok := strings.CutPrefix(name, self); ok && (rest == "" || rest[0] == '/') {
+			if self == "dev/fd" {
+				rest = "/fd" + rest
+			}
+			return fmt.Sprintf("proc/%d", th.tid) + rest
+		}
+	}
+	return name
+}
+
+// ownPath is ownProc for the absolute path p, which th may be nil for.
+func (th *thread) ownPath(p string) string {
+	if th == nil {
+		return p
+	}
+	return "/" + th.ownProc(p[1:])
+}
+
+// noteMemfd records that the memfd open as f holds a copy of the virtual
+// file p, so that /proc shows p in its place.
+func (t *Tracer) noteMemfd(f *os.File, p string) {
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if t.memfds == nil {
+		t.memfds = make(map[uint64]string)
+	}
+	t.memfds[fi.Sys().(*syscall.Stat_t).Ino] = p
+}
+
+func writeFile(fs *memfs.FS, name string, b []byte) error {
+	f, err := fs.Open(name, os.O_WRONLY|os.O_CREATE, 0o444)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
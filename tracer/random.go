@@ -0,0 +1,75 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs/devfs"
+)
+
+// WithRandomSeed makes the command's randomness reproducible: getrandom,
+// and reads of /dev/random and /dev/urandom, whether on the host or in a
+// mount, are served from one ChaCha8 stream seeded with seed, so that a
+// run given the same seed draws the same bytes. Which process gets which
+// bytes depends on the order they ask in, which only a command without
+// concurrent draws keeps from one run to the next. The recordings of
+// WithRecord do not hold the bytes; replay a run with its seed. The
+// AT_RANDOM bytes the kernel gives each program it runs, and the vDSO's
+// getrandom once seeded, are left to the kernel.
+func WithRandomSeed(seed uint64) Option {
+	var key [32]byte
+	binary.LittleEndian.PutUint64(key[:], seed)
+	return func(t *Tracer) {
+		rng := rand.NewChaCha8(key)
+		t.random = &randomSource{rng: rng, dev: mount{dir: "/dev", backend: devfs.NewRand(rng)}}
+	}
+}
+
+// randomSource is the stream WithRandomSeed sets up, and dev the random
+// devices that read from it.
+type randomSource struct {
+	rng *rand.ChaCha8
+	dev mount
+}
+
+// maxRandom is the most bytes one getrandom returns, as before Linux 5.18.
+const maxRandom = 1<<25 - 1
+
+// randomSyscalls returns the syscalls a seeded stream needs trapped.
+func (t *Tracer) randomSyscalls() []uint64 {
+	if t.random == nil {
+		return nil
+	}
+	return []uint64{unix.SYS_GETRANDOM}
+}
+
+func (th *thread) sysGetrandom(buf uintptr, n uint64, flags int) (int64, bool) {
+	r := th.t.random
+	if r == nil {
+		return 0, false
+	}
+	th.t.log.Printf("getrandom: %d bytes (seeded)", n)
+	if flags&^(unix.GRND_NONBLOCK|unix.GRND_RANDOM|unix.GRND_INSECURE) != 0 ||
+		flags&(unix.GRND_RANDOM|unix.GRND_INSECURE) == unix.GRND_RANDOM|unix.GRND_INSECURE {
+		return -int64(unix.EINVAL), true
+	}
+	b := make([]byte, min(n, maxRandom))
+	_, _ = r.rng.Read(b)
+	if err := th.mem.writeBytes(buf, b); err != nil {
+		return -int64(unix.EFAULT), true
+	}
+	return int64(len(b)), true
+}
+
+// openRandom opens /dev/random or /dev/urandom, as named by abs, from the
+// seeded stream. It reports false for any other path, or without a seed.
+func (th *thread) openRandom(abs string, flags int, mode uint32) (int64, bool) {
+	r := th.t.random
+	if r == nil || abs != "/dev/random" && abs != "/dev/urandom" {
+		return 0, false
+	}
+	th.t.log.Printf("openat: %s (seeded)", abs)
+	return th.openVirtual(&r.dev, abs[len("/dev/"):], abs, flags, mode), true
+}
@@ -0,0 +1,233 @@
+package tracer
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// WithReadOnly makes the filesystem read-only to the command, except at or
+// below the given absolute directories. Syscalls that would create, remove,
+// rename or write to a file anywhere else, or change its metadata, fail
+// with EROFS before they reach the kernel or a backend. Mounts are covered
+// like the host: list a mount's directory to let the command write to it.
+//
+// Host paths are checked where they really lead, with symlinks resolved.
+// The check runs before the kernel looks the path up, so it does not stand
+// up to a command that swaps symlinks under a writable directory while
+// another of its threads makes the syscall. Descriptors the command
+// inherits open for writing stay writable.
+func WithReadOnly(writable ...string) Option {
+	return func(t *Tracer) {
+		t.readOnly = true
+		for _, dir := range writable {
+			dir = path.Clean(dir)
+			if real, err := filepath.EvalSymlinks(dir); err == nil {
+				dir = real
+			}
+			t.writable = append(t.writable, dir)
+		}
+	}
+}
+
+// denyWrite reports whether the canonical syscall c writes outside the
+// writable directories, in which case it must fail with the returned
+// EROFS instead of running.
+func (th *thread) denyWrite(c sysCall) (int64, bool) {
+	arg := func(i int) uint64 { return c.args[i] }
+	dirfd := func(i int) int { return int(int32(arg(i))) }
+	var ok bool
+	switch c.nr {
+	case unix.SYS_OPENAT, unix.SYS_OPENAT2:
+		flags := int(arg(2))
+		if !openWrites(flags) {
+			return 0, false
+		}
+		follow := flags&unix.O_NOFOLLOW == 0 && flags&(unix.O_CREAT|unix.O_EXCL) != unix.O_CREAT|unix.O_EXCL
+		ok = th.writablePath(dirfd(0), uintptr(arg(1)), follow, false)
+	case unix.SYS_MKDIRAT, unix.SYS_UNLINKAT, unix.SYS_MKNODAT:
+		ok = th.writablePath(dirfd(0), uintptr(arg(1)), false, false)
+	case unix.SYS_RENAMEAT, unix.SYS_RENAMEAT2:
+		ok = th.writablePath(dirfd(0), uintptr(arg(1)), false, false) &&
+			th.writablePath(dirfd(2), uintptr(arg(3)), false, false)
+	case unix.SYS_LINKAT:
+		// The new link would let the target be written through it.
+		ok = th.writablePath(dirfd(0), uintptr(arg(1)), int32(arg(4))&unix.AT_SYMLINK_FOLLOW != 0, false) &&
+			th.writablePath(dirfd(2), uintptr(arg(3)), false, false)
+	case unix.SYS_SYMLINKAT:
+		ok = th.writablePath(dirfd(1), uintptr(arg(2)), false, false)
+	case unix.SYS_FCHMODAT:
+		ok = th.writablePath(dirfd(0), uintptr(arg(1)), true, false)
+	case unix.SYS_FCHMODAT2:
+		ok = th.writablePath(dirfd(0), uintptr(arg(1)), int32(arg(3))&unix.AT_SYMLINK_NOFOLLOW == 0, int32(arg(3))&unix.AT_EMPTY_PATH != 0)
+	case unix.SYS_FCHOWNAT:
+		ok = th.writablePath(dirfd(0), uintptr(arg(1)), int32(arg(4))&unix.AT_SYMLINK_NOFOLLOW == 0, int32(arg(4))&unix.AT_EMPTY_PATH != 0)
+	case unix.SYS_UTIMENSAT:
+		// A null path sets the times of dirfd itself.
+		if arg(1) == 0 {
+			ok = th.writableFD(dirfd(0))
+			break
+		}
+		ok = th.writablePath(dirfd(0), uintptr(arg(1)), int32(arg(3))&unix.AT_SYMLINK_NOFOLLOW == 0, int32(arg(3))&unix.AT_EMPTY_PATH != 0)
+	case unix.SYS_TRUNCATE, unix.SYS_SETXATTR, unix.SYS_REMOVEXATTR:
+		ok = th.writablePath(unix.AT_FDCWD, uintptr(arg(0)), true, false)
+	case unix.SYS_LSETXATTR, unix.SYS_LREMOVEXATTR:
+		ok = th.writablePath(unix.AT_FDCWD, uintptr(arg(0)), false, false)
+	case unix.SYS_FCHMOD, unix.SYS_FCHOWN, unix.SYS_FSETXATTR, unix.SYS_FREMOVEXATTR:
+		ok = th.writableFD(dirfd(0))
+	default:
+		return 0, false
+	}
+	if ok {
+		return 0, false
+	}
+	th.t.log.Printf("syscall %d denied: read-only", c.nr)
+	th.t.emit(&SyscallDenied{Pid: th.pid, Syscall: c.nr, Errno: unix.EROFS})
+	return -int64(unix.EROFS), true
+}
+
+// openWrites reports whether an open with flags may change the file.
+func openWrites(flags int) bool {
+	return flags&unix.O_ACCMODE != unix.O_RDONLY || flags&(unix.O_CREAT|unix.O_TRUNC) != 0
+}
+
+// writablePath reports whether the path argument at addr, relative to
+// dirfd, may be written. An empty path names dirfd itself if emptyPath is
+// set. Paths that cannot be read or resolved are let through for the
+// kernel to fail.
+func (th *thread) writablePath(dirfd int, addr uintptr, follow, emptyPath bool) bool {
+	p, err := th.mem.readString(addr)
+	if err != nil {
+		return true
+	}
+	if p == "" {
+		return !emptyPath || th.writableFD(dirfd)
+	}
+	op := decideWritable
+	if follow {
+		op = decideWritableFollow
+	}
+	return th.decide(dirfd, p, op, func() decision {
+		abs, err := th.resolve(dirfd, p)
+		if err != nil {
+			return decision{writable: true}
+		}
+		return decision{writable: th.t.isWritable(th.realPath(abs, follow))}
+	}).writable
+}
+
+// writableFD reports whether the file open as fd may be written.
+func (th *thread) writableFD(fd int) bool {
+	if f, ok := th.fds.get(fd); ok {
+		return th.t.isWritable(f.path)
+	}
+	p, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", th.tid, fd))
+	if err != nil || !path.IsAbs(p) {
+		// Pipes, sockets and the like have no path to protect.
+		return true
+	}
+	return th.t.isWritable(p)
+}
+
+func (t *Tracer) isWritable(p string) bool {
+	for _, dir := range t.writable {
+		if inDir(p, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// realPath returns where the absolute path p leads, in the virtual tree
+// and on the host alike, with the symlinks in its parents resolved, and a
+// final one too if follow is set. Parts that do not exist are kept as they
+// are, and so are symlinks past the kernel's limit. Host directories are
+// walked by descriptor from "/", as readlinkAt opens them, so that one
+// swapped for a symlink on the way is not followed.
+func (t *Tracer) realPath(p string, follow bool) string {
+	return t.realPathOf(nil, p, follow)
+}
+
+// realPath is Tracer.realPath for a syscall of th, in which /proc/self,
+// /proc/thread-self and /dev/fd lead to th's directory in /proc: read by
+// the tracer, they would lead to its own, and a path through one of its
+// descriptors past the path rules.
+func (th *thread) realPath(p string, follow bool) string {
+	return th.t.realPathOf(th, p, follow)
+}
+
+// realPathOf is realPath for a syscall of th, or for none if th is nil.
+func (t *Tracer) realPathOf(th *thread, p string, follow bool) string {
+	root, err := t.hostFS.rootFD()
+	if err != nil {
+		root = -1
+	}
+	cur := "/"
+	// dirs holds the descriptors of cur and the directories above it, or
+	// -1 for those not on the host.
+	dirs := []int{root}
+	pop := func(n int) {
+		for _, fd := range dirs[n:] {
+			if fd >= 0 {
+				unix.Close(fd)
+			}
+		}
+		dirs = dirs[:n]
+	}
+	defer pop(1)
+	comps := strings.Split(p, "/")
+	for links := 0; len(comps) > 0; {
+		c := comps[0]
+		comps = comps[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(dirs) > 1 {
+				pop(len(dirs) - 1)
+			}
+			cur = path.Dir(cur)
+			continue
+		}
+		next := path.Join(cur, c)
+		target, fd, ok := "", -1, false
+		if own := th.ownPath(next); own != next {
+			target, ok = own, true
+		} else {
+			target, fd, ok = t.readlinkAt(dirs[len(dirs)-1], next, c)
+		}
+		if !ok || links == vfs.MaxSymlinks || !follow && final(comps) {
+			cur = next
+			dirs = append(dirs, fd)
+			continue
+		}
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+		links++
+		if path.IsAbs(target) {
+			cur = "/"
+			pop(1)
+		}
+		comps = append(strings.Split(target, "/"), comps...)
+	}
+	return cur
+}
+
+// readlink returns the target of p, which is a symlink if ok is set,
+// in the virtual tree or on the host.
+func (t *Tracer) readlink(p string) (target string, ok bool) {
+	var err error
+	if m, name, ok := t.lookup(p); ok {
+		target, err = m.backend.Readlink(name)
+	} else {
+		target, err = os.Readlink(p)
+	}
+	return target, err == nil
+}
@@ -0,0 +1,351 @@
+package tracer
+
+import (
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// WithRecord writes a recording of the run to w, for WithReplay to serve
+// back later. Every syscall the tracer emulates is served by the backends
+// of the mounts, or of the host for paths remapped outside every mount, so
+// the recording holds each call made to them while serving the command: its
+// inputs, such as names, flags, offsets and the data written, and its
+// results, such as the data read, file information and errors. Calls are
+// written as JSON lines as they return. Syscalls the kernel handles itself
+// are not recorded.
+func WithRecord(w io.Writer) Option {
+	return func(t *Tracer) { t.record = &recorder{enc: json.NewEncoder(w)} }
+}
+
+// recordEntry is one line of a recording: a call made to a backend, or to a
+// file opened from one, and what it returned. Backend calls are identified
+// by Mount, which is empty for the host, and file calls by File, the number
+// the recording gave the file when Open returned it.
+type recordEntry struct {
+	Mount string `json:"mount,omitempty"`
+	File  int    `json:"file,omitempty"`
+	Op    string `json:"op"`
+	// Name and NewName are the names the call was given; for symlink,
+	// Name is the target.
+	Name    string `json:"name,omitempty"`
+	NewName string `json:"newname,omitempty"`
+	// Attr is the name of an extended attribute.
+	Attr  string      `json:"attr,omitempty"`
+	Flag  int         `json:"flag,omitempty"`
+	Perm  fs.FileMode `json:"perm,omitempty"`
+	Times []time.Time `json:"times,omitempty"`
+	// Len is the size of the buffer read into or written from, or of the
+	// hole punched, and Off and Whence position the call; Off is the size
+	// a truncate gives.
+	Len    int   `json:"len,omitempty"`
+	Off    int64 `json:"off,omitempty"`
+	Whence int   `json:"whence,omitempty"`
+
+	// Data is the data read or written, or the value of an extended
+	// attribute.
+	Data []byte `json:"data,omitempty"`
+	// N is the number of bytes read or written, or the offset a seek
+	// moved to.
+	N       int64              `json:"n,omitempty"`
+	Target  string             `json:"target,omitempty"`
+	Info    *recordedInfo      `json:"info,omitempty"`
+	Entries []recordedDirEntry `json:"entries,omitempty"`
+	Attrs   []string           `json:"attrs,omitempty"`
+	FSStat  *vfs.FSStat        `json:"fsstat,omitempty"`
+	// Err is the name of the errno the call failed with, or EOF.
+	Err string `json:"err,omitempty"`
+}
+
+// key identifies the call e records by its inputs, which a replayed call
+// must repeat to be given e's results.
+func (e recordEntry) key() string {
+	if e.Op == "open" {
+		e.File = 0
+	}
+	e.Data, e.N, e.Target, e.Info, e.Entries, e.Attrs, e.FSStat, e.Err = nil, 0, "", nil, nil, nil, nil, ""
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+
+// recordedInfo is an fs.FileInfo in a recording, keeping the Sys values the
+// tracer understands.
+type recordedInfo struct {
+	Name    string          `json:"name"`
+	Size    int64           `json:"size"`
+	Mode    fs.FileMode     `json:"mode"`
+	ModTime time.Time       `json:"mtime"`
+	Stat    *syscall.Stat_t `json:"stat,omitempty"`
+	Attr    *vfs.Attr       `json:"attr,omitempty"`
+}
+
+func infoRecord(fi fs.FileInfo) *recordedInfo {
+	if fi == nil {
+		return nil
+	}
+	r := &recordedInfo{Name: fi.Name(), Size: fi.Size(), Mode: fi.Mode(), ModTime: fi.ModTime()}
+	switch sys := fi.Sys().(type) {
+	case *syscall.Stat_t:
+		r.Stat = sys
+	case *vfs.Attr:
+		r.Attr = sys
+	}
+	return r
+}
+
+type recordedDirEntry struct {
+	Name string        `json:"name"`
+	Type fs.FileMode   `json:"type"`
+	Info *recordedInfo `json:"info,omitempty"`
+}
+
+// errRecord returns the form err takes in a recording.
+func errRecord(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case err == io.EOF:
+		return "EOF"
+	}
+	return unix.ErrnoName(errnoFor(err))
+}
+
+// recorder writes the recording for WithRecord.
+type recorder struct {
+	enc *json.Encoder
+	log *log.Logger
+	// files counts the files opened so far.
+	files int
+}
+
+func (r *recorder) write(e *recordEntry) {
+	if err := r.enc.Encode(e); err != nil {
+		r.log.Printf("record: %v", err)
+	}
+}
+
+// recordingBackend records the calls made to the backend of the mount at
+// dir.
+type recordingBackend struct {
+	r   *recorder
+	dir string
+	b   vfs.Backend
+}
+
+func (b *recordingBackend) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	f, err := b.b.Open(name, flag, perm)
+	e := &recordEntry{Mount: b.dir, Op: "open", Name: name, Flag: flag, Perm: perm, Err: errRecord(err)}
+	if err == nil {
+		b.r.files++
+		e.File = b.r.files
+		f = &recordingFile{r: b.r, id: e.File, f: f}
+	}
+	b.r.write(e)
+	return f, err
+}
+
+func (b *recordingBackend) Stat(name string) (fs.FileInfo, error) {
+	fi, err := b.b.Stat(name)
+	b.r.write(&recordEntry{Mount: b.dir, Op: "stat", Name: name, Info: infoRecord(fi), Err: errRecord(err)})
+	return fi, err
+}
+
+func (b *recordingBackend) Lstat(name string) (fs.FileInfo, error) {
+	fi, err := b.b.Lstat(name)
+	b.r.write(&recordEntry{Mount: b.dir, Op: "lstat", Name: name, Info: infoRecord(fi), Err: errRecord(err)})
+	return fi, err
+}
+
+func (b *recordingBackend) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := b.b.ReadDir(name)
+	e := &recordEntry{Mount: b.dir, Op: "readdir", Name: name, Err: errRecord(err)}
+	for _, de := range entries {
+		info, _ := de.Info()
+		e.Entries = append(e.Entries, recordedDirEntry{Name: de.Name(), Type: de.Type(), Info: infoRecord(info)})
+	}
+	b.r.write(e)
+	return entries, err
+}
+
+func (b *recordingBackend) Mkdir(name string, perm fs.FileMode) error {
+	err := b.b.Mkdir(name, perm)
+	b.r.write(&recordEntry{Mount: b.dir, Op: "mkdir", Name: name, Perm: perm, Err: errRecord(err)})
+	return err
+}
+
+func (b *recordingBackend) Unlink(name string) error {
+	err := b.b.Unlink(name)
+	b.r.write(&recordEntry{Mount: b.dir, Op: "unlink", Name: name, Err: errRecord(err)})
+	return err
+}
+
+func (b *recordingBackend) Rmdir(name string) error {
+	err := b.b.Rmdir(name)
+	b.r.write(&recordEntry{Mount: b.dir, Op: "rmdir", Name: name, Err: errRecord(err)})
+	return err
+}
+
+func (b *recordingBackend) Rename(oldname, newname string) error {
+	err := b.b.Rename(oldname, newname)
+	b.r.write(&recordEntry{Mount: b.dir, Op: "rename", Name: oldname, NewName: newname, Err: errRecord(err)})
+	return err
+}
+
+func (b *recordingBackend) Link(oldname, newname string) error {
+	err := b.b.Link(oldname, newname)
+	b.r.write(&recordEntry{Mount: b.dir, Op: "link", Name: oldname, NewName: newname, Err: errRecord(err)})
+	return err
+}
+
+func (b *recordingBackend) Symlink(target, newname string) error {
+	err := b.b.Symlink(target, newname)
+	b.r.write(&recordEntry{Mount: b.dir, Op: "symlink", Name: target, NewName: newname, Err: errRecord(err)})
+	return err
+}
+
+func (b *recordingBackend) Readlink(name string) (string, error) {
+	target, err := b.b.Readlink(name)
+	b.r.write(&recordEntry{Mount: b.dir, Op: "readlink", Name: name, Target: target, Err: errRecord(err)})
+	return target, err
+}
+
+func (b *recordingBackend) Chmod(name string, mode fs.FileMode) error {
+	err := b.b.Chmod(name, mode)
+	b.r.write(&recordEntry{Mount: b.dir, Op: "chmod", Name: name, Perm: mode, Err: errRecord(err)})
+	return err
+}
+
+func (b *recordingBackend) Chtimes(name string, atime, mtime time.Time) error {
+	err := b.b.Chtimes(name, atime, mtime)
+	b.r.write(&recordEntry{Mount: b.dir, Op: "chtimes", Name: name, Times: []time.Time{atime, mtime}, Err: errRecord(err)})
+	return err
+}
+
+func (b *recordingBackend) Getxattr(name, attr string) ([]byte, error) {
+	v, err := vfs.Getxattr(b.b, name, attr)
+	b.r.write(&recordEntry{Mount: b.dir, Op: "getxattr", Name: name, Attr: attr, Data: v, Err: errRecord(err)})
+	return v, err
+}
+
+func (b *recordingBackend) Setxattr(name, attr string, value []byte, flags int) error {
+	err := vfs.Setxattr(b.b, name, attr, value, flags)
+	b.r.write(&recordEntry{Mount: b.dir, Op: "setxattr", Name: name, Attr: attr, Data: value, Flag: flags, Err: errRecord(err)})
+	return err
+}
+
+func (b *recordingBackend) Listxattr(name string) ([]string, error) {
+	attrs, err := vfs.Listxattr(b.b, name)
+	b.r.write(&recordEntry{Mount: b.dir, Op: "listxattr", Name: name, Attrs: attrs, Err: errRecord(err)})
+	return attrs, err
+}
+
+func (b *recordingBackend) Removexattr(name, attr string) error {
+	err := vfs.Removexattr(b.b, name, attr)
+	b.r.write(&recordEntry{Mount: b.dir, Op: "removexattr", Name: name, Attr: attr, Err: errRecord(err)})
+	return err
+}
+
+func (b *recordingBackend) StatFS(name string) (vfs.FSStat, error) {
+	st, err := vfs.StatFS(b.b, name)
+	b.r.write(&recordEntry{Mount: b.dir, Op: "statfs", Name: name, FSStat: &st, Err: errRecord(err)})
+	return st, err
+}
+
+// recordingFile records the calls made to a file opened through a
+// recordingBackend.
+type recordingFile struct {
+	r  *recorder
+	id int
+	f  vfs.File
+}
+
+func (f *recordingFile) Read(b []byte) (int, error) {
+	n, err := f.f.Read(b)
+	f.r.write(&recordEntry{File: f.id, Op: "read", Len: len(b), Data: b[:n], N: int64(n), Err: errRecord(err)})
+	return n, err
+}
+
+func (f *recordingFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.f.ReadAt(b, off)
+	f.r.write(&recordEntry{File: f.id, Op: "readat", Len: len(b), Off: off, Data: b[:n], N: int64(n), Err: errRecord(err)})
+	return n, err
+}
+
+func (f *recordingFile) Write(b []byte) (int, error) {
+	n, err := f.f.Write(b)
+	f.r.write(&recordEntry{File: f.id, Op: "write", Len: len(b), Data: b, N: int64(n), Err: errRecord(err)})
+	return n, err
+}
+
+func (f *recordingFile) WriteAt(b []byte, off int64) (int, error) {
+	n, err := f.f.WriteAt(b, off)
+	f.r.write(&recordEntry{File: f.id, Op: "writeat", Len: len(b), Off: off, Data: b, N: int64(n), Err: errRecord(err)})
+	return n, err
+}
+
+func (f *recordingFile) Truncate(size int64) error {
+	err := vfs.Truncate(f.f, size)
+	f.r.write(&recordEntry{File: f.id, Op: "truncate", Off: size, Err: errRecord(err)})
+	return err
+}
+
+func (f *recordingFile) PunchHole(off, n int64) error {
+	err := vfs.PunchHole(f.f, off, n)
+	f.r.write(&recordEntry{File: f.id, Op: "punchhole", Len: int(n), Off: off, Err: errRecord(err)})
+	return err
+}
+
+func (f *recordingFile) Sync() error {
+	err := vfs.Sync(f.f)
+	f.r.write(&recordEntry{File: f.id, Op: "sync", Err: errRecord(err)})
+	return err
+}
+
+func (f *recordingFile) Seek(off int64, whence int) (int64, error) {
+	pos, err := f.f.Seek(off, whence)
+	f.r.write(&recordEntry{File: f.id, Op: "seek", Off: off, Whence: whence, N: pos, Err: errRecord(err)})
+	return pos, err
+}
+
+func (f *recordingFile) Stat() (fs.FileInfo, error) {
+	fi, err := f.f.Stat()
+	f.r.write(&recordEntry{File: f.id, Op: "stat", Info: infoRecord(fi), Err: errRecord(err)})
+	return fi, err
+}
+
+func (f *recordingFile) Close() error {
+	err := f.f.Close()
+	f.r.write(&recordEntry{File: f.id, Op: "close", Err: errRecord(err)})
+	return err
+}
+
+// replaceBackends puts the replay and the recorder, if there are any, in
+// front of every mount. It runs once all options have been applied, so
+// mounts added after WithRecord or WithReplay are covered too.
+func (t *Tracer) replaceBackends() {
+	replace := func(m *mount, dir string) {
+		if t.replay != nil {
+			m.backend = &replayBackend{r: t.replay, dir: dir}
+		}
+		if t.record != nil {
+			m.backend = &recordingBackend{r: t.record, dir: dir, b: m.backend}
+		}
+	}
+	for i := range t.mounts {
+		replace(&t.mounts[i], t.mounts[i].dir)
+	}
+	replace(&t.host, "")
+	if t.replay != nil {
+		t.replay.log = t.log
+	}
+	if t.record != nil {
+		t.record.log = t.log
+	}
+}
@@ -0,0 +1,151 @@
+package tracer
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// getRegs and setRegs use PTRACE_GETREGS and PTRACE_SETREGS rather than
+// the regset requests behind unix.PtraceGetRegs, which use the tracee's
+// layout. That would hand back 32-bit registers for a compat process.
+func getRegs(tid int, r *unix.PtraceRegs) error {
+	return ptraceRegs(unix.PTRACE_GETREGS, tid, r)
+}
+
+func setRegs(tid int, r *unix.PtraceRegs) error {
+	return ptraceRegs(unix.PTRACE_SETREGS, tid, r)
+}
+
+func ptraceRegs(req, tid int, r *unix.PtraceRegs) error {
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, uintptr(req), uintptr(tid), 0, uintptr(unsafe.Pointer(r)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// syscallNo returns the number of the syscall the tracee is stopped in.
+func syscallNo(r *unix.PtraceRegs) uint64 { return r.Orig_rax }
+
+// syscallArg returns the i'th (zero-based) syscall argument.
+func syscallArg(r *unix.PtraceRegs, i int) uint64 {
+	switch i {
+	case 0:
+		return r.Rdi
+	case 1:
+		return r.Rsi
+	case 2:
+		return r.Rdx
+	case 3:
+		return r.R10
+	case 4:
+		return r.R8
+	case 5:
+		return r.R9
+	}
+	panic("tracer: syscall argument out of range")
+}
+
+// setSyscall writes r to the stopped thread, replacing the syscall it is
+// about to enter with nr. Setting it to -1 makes the kernel skip the
+// syscall.
+func setSyscall(tid int, r *unix.PtraceRegs, nr uint64) error {
+	r.Orig_rax = nr
+	return setRegs(tid, r)
+}
+
+// setReturn sets the value the syscall returns to the tracee.
+func setReturn(r *unix.PtraceRegs, v uint64) { r.Rax = v }
+
+// auditArch is the AUDIT_ARCH value seccomp reports for native syscalls.
+const auditArch = unix.AUDIT_ARCH_X86_64
+
+// compatCS is the code segment selector of 32-bit user code.
+const compatCS = 0x23
+
+// isCompat reports whether the thread is running 32-bit code, in which
+// case injected syscalls must use the i386 ABI.
+func isCompat(r *unix.PtraceRegs) bool { return r.Cs == compatCS }
+
+// syscallInsn returns the machine code for the syscall instruction: syscall
+// in 64-bit code and int $0x80 in 32-bit code.
+func syscallInsn(r *unix.PtraceRegs) []byte {
+	if isCompat(r) {
+		return []byte{0xcd, 0x80}
+	}
+	return []byte{0x0f, 0x05}
+}
+
+// compatNumbers maps the syscalls the tracer makes on a tracee's behalf,
+// by injecting them or by rewriting the tracee's own, to their i386
+// numbers.
+var compatNumbers = map[uint64]uint64{
+	unix.SYS_MMAP:         192,
+	unix.SYS_PRCTL:        172,
+	unix.SYS_DUP3:         330,
+	unix.SYS_MEMFD_CREATE: 356,
+	unix.SYS_SECCOMP:      354,
+	unix.SYS_CLOSE_RANGE:  436,
+	unix.SYS_NANOSLEEP:    162,
+	unix.SYS_MUNMAP:       91,
+	unix.SYS_EXECVEAT:     358,
+	unix.SYS_OPENAT:       295,
+	unix.SYS_CLOSE:        6,
+	unix.SYS_CHDIR:        12,
+
+	unix.SYS_LANDLOCK_CREATE_RULESET: 444,
+	unix.SYS_LANDLOCK_ADD_RULE:       445,
+	unix.SYS_LANDLOCK_RESTRICT_SELF:  446,
+}
+
+// argRegs returns the registers that carry syscall arguments, in order,
+// in the native or the i386 ABI.
+func argRegs(r *unix.PtraceRegs, compat bool) []*uint64 {
+	if compat {
+		return []*uint64{&r.Rbx, &r.Rcx, &r.Rdx, &r.Rsi, &r.Rdi, &r.Rbp}
+	}
+	return []*uint64{&r.Rdi, &r.Rsi, &r.Rdx, &r.R10, &r.R8, &r.R9}
+}
+
+// loadSyscall puts args in r for native syscall nr, to be made through the
+// ABI of arch, and returns the number nr has in that ABI.
+func loadSyscall(r *unix.PtraceRegs, arch uint32, nr uint64, args []uint64) uint64 {
+	compat := arch == compatArch
+	if compat {
+		nr = compatNumbers[nr]
+	}
+	setArgs(argRegs(r, compat), args)
+	return nr
+}
+
+// rewriteSyscall replaces the syscall the thread is stopped entering, which
+// was made through the ABI of arch, with native syscall nr and args.
+func rewriteSyscall(tid int, r *unix.PtraceRegs, arch uint32, nr uint64, args ...uint64) error {
+	return setSyscall(tid, r, loadSyscall(r, arch, nr, args))
+}
+
+// rewind moves r back over the syscall instruction, which is two bytes in
+// either ABI, and loads nr for it to execute again.
+func rewind(r *unix.PtraceRegs, nr uint64) {
+	r.Rip -= 2
+	r.Rax = nr
+}
+
+func instructionPointer(r *unix.PtraceRegs) uint64 { return r.Rip }
+func stackPointer(r *unix.PtraceRegs) uint64       { return r.Rsp }
+
+// returnValue returns the value a syscall left in the return register.
+func returnValue(r *unix.PtraceRegs) uint64 { return r.Rax }
+
+// prepareSyscall sets up r so that executing the syscall instruction at pc
+// performs native syscall nr with args.
+func prepareSyscall(r *unix.PtraceRegs, pc, nr uint64, args []uint64) {
+	if isCompat(r) {
+		nr = compatNumbers[nr]
+	}
+	r.Rip = pc
+	r.Rax = nr
+	r.Orig_rax = ^uint64(0)
+	setArgs(argRegs(r, isCompat(r)), args)
+}
@@ -0,0 +1,96 @@
+package tracer
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func getRegs(tid int, r *unix.PtraceRegs) error { return unix.PtraceGetRegs(tid, r) }
+func setRegs(tid int, r *unix.PtraceRegs) error { return unix.PtraceSetRegs(tid, r) }
+
+// syscallNo returns the number of the syscall the tracee is stopped in.
+func syscallNo(r *unix.PtraceRegs) uint64 { return r.Regs[8] }
+
+// syscallArg returns the i'th (zero-based) syscall argument. The kernel
+// overwrites x0 with the return value, so the first argument is only
+// available at syscall entry.
+func syscallArg(r *unix.PtraceRegs, i int) uint64 {
+	if i < 0 || i > 5 {
+		panic("tracer: syscall argument out of range")
+	}
+	return r.Regs[i]
+}
+
+// ntARMSystemCall is the NT_ARM_SYSTEM_CALL register set. arm64 keeps the
+// number of the syscall being entered outside the general registers, so
+// rewriting x8 at a syscall stop has no effect.
+const ntARMSystemCall = 0x404
+
+// setSyscall writes r to the stopped thread, replacing the syscall it is
+// about to enter with nr. Setting it to -1 makes the kernel skip the
+// syscall.
+func setSyscall(tid int, r *unix.PtraceRegs, nr uint64) error {
+	if err := setRegs(tid, r); err != nil {
+		return err
+	}
+	no := int32(nr)
+	iov := unix.Iovec{Base: (*byte)(unsafe.Pointer(&no))}
+	iov.SetLen(int(unsafe.Sizeof(no)))
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_SETREGSET, uintptr(tid),
+		ntARMSystemCall, uintptr(unsafe.Pointer(&iov)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// argRegs returns the registers that carry syscall arguments, in order.
+func argRegs(r *unix.PtraceRegs, compat bool) []*uint64 {
+	return []*uint64{&r.Regs[0], &r.Regs[1], &r.Regs[2], &r.Regs[3], &r.Regs[4], &r.Regs[5]}
+}
+
+func loadSyscall(r *unix.PtraceRegs, arch uint32, nr uint64, args []uint64) uint64 {
+	setArgs(argRegs(r, false), args)
+	return nr
+}
+
+// rewriteSyscall replaces the syscall the thread is stopped entering with
+// nr and args.
+func rewriteSyscall(tid int, r *unix.PtraceRegs, arch uint32, nr uint64, args ...uint64) error {
+	return setSyscall(tid, r, loadSyscall(r, arch, nr, args))
+}
+
+// rewind moves r back over svc #0 and loads nr for it to execute again.
+func rewind(r *unix.PtraceRegs, nr uint64) {
+	r.Pc -= 4
+	r.Regs[8] = nr
+}
+
+// setReturn sets the value the syscall returns to the tracee.
+func setReturn(r *unix.PtraceRegs, v uint64) { r.Regs[0] = v }
+
+// auditArch is the AUDIT_ARCH value seccomp reports for native syscalls.
+const auditArch = unix.AUDIT_ARCH_AARCH64
+
+// isCompat reports whether the thread is running 32-bit code. The tracer
+// does not support aarch32 tracees.
+func isCompat(r *unix.PtraceRegs) bool { return false }
+
+// syscallInsn returns the machine code for svc #0.
+func syscallInsn(r *unix.PtraceRegs) []byte { return []byte{0x01, 0x00, 0x00, 0xd4} }
+
+func instructionPointer(r *unix.PtraceRegs) uint64 { return r.Pc }
+func stackPointer(r *unix.PtraceRegs) uint64       { return r.Sp }
+
+// returnValue returns the value a syscall left in the return register.
+func returnValue(r *unix.PtraceRegs) uint64 { return r.Regs[0] }
+
+// prepareSyscall sets up r so that executing the syscall instruction at pc
+// performs syscall nr with args. Unlike amd64 there is no restart state to
+// clear: the kernel has already settled any restart before a signal stop.
+func prepareSyscall(r *unix.PtraceRegs, pc, nr uint64, args []uint64) {
+	r.Pc = pc
+	r.Regs[8] = nr
+	setArgs(argRegs(r, false), args)
+}
@@ -0,0 +1,321 @@
+package tracer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// WithReplay serves the command's virtual files from a recording that
+// WithRecord wrote to r, instead of from the mounts' backends, which are
+// never called. The tracer must be given the same mounts and remapping
+// rules as the recorded run. A call is given the results of the first
+// recorded call not yet replayed with the same inputs, so a command that
+// behaves the same as it did when recorded sees the same files, even if
+// its processes run in a different order. A call the recording has no
+// match for fails with EIO.
+//
+// Run fails if the recording cannot be read.
+func WithReplay(r io.Reader) Option {
+	return func(t *Tracer) { t.replay = &replayer{src: r} }
+}
+
+// errNotRecorded is returned for a call that a replay has no results for.
+var errNotRecorded = errors.New("call not in the recording")
+
+// replayer serves the calls of a recording for WithReplay.
+type replayer struct {
+	src io.Reader
+	log *log.Logger
+	// calls holds the entries not yet replayed, by key.
+	calls map[string][]*recordEntry
+}
+
+// load reads the recording.
+func (r *replayer) load() error {
+	r.calls = make(map[string][]*recordEntry)
+	dec := json.NewDecoder(r.src)
+	for {
+		e := new(recordEntry)
+		if err := dec.Decode(e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("tracer: replay: %w", err)
+		}
+		k := e.key()
+		r.calls[k] = append(r.calls[k], e)
+	}
+}
+
+// call returns the results recorded for the call e describes, which is
+// made on the file name, and the error it failed with. The results are
+// empty if the recording has none.
+func (r *replayer) call(e *recordEntry, name string) (*recordEntry, error) {
+	k := e.key()
+	calls := r.calls[k]
+	if len(calls) == 0 {
+		r.log.Printf("replay: %s", k)
+		return &recordEntry{}, &fs.PathError{Op: e.Op, Path: name, Err: errNotRecorded}
+	}
+	r.calls[k] = calls[1:]
+	return calls[0], calls[0].err(name)
+}
+
+// err returns the error the call recorded in e failed with.
+func (e *recordEntry) err(name string) error {
+	switch e.Err {
+	case "":
+		return nil
+	case "EOF":
+		return io.EOF
+	}
+	return &fs.PathError{Op: e.Op, Path: name, Err: errnoNamed(e.Err)}
+}
+
+// errnoNamed is the inverse of unix.ErrnoName, returning EIO for a name it
+// does not know.
+func errnoNamed(name string) unix.Errno {
+	for errno := unix.Errno(1); errno < 4096; errno++ {
+		if unix.ErrnoName(errno) == name {
+			return errno
+		}
+	}
+	return unix.EIO
+}
+
+// replayBackend serves the calls recorded for the backend of the mount at
+// dir.
+type replayBackend struct {
+	r   *replayer
+	dir string
+}
+
+func (b *replayBackend) call(e *recordEntry) (*recordEntry, error) {
+	e.Mount = b.dir
+	return b.r.call(e, e.Name)
+}
+
+func (b *replayBackend) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	rec, err := b.call(&recordEntry{Op: "open", Name: name, Flag: flag, Perm: perm})
+	if err != nil {
+		return nil, err
+	}
+	return &replayFile{r: b.r, id: rec.File, name: name}, nil
+}
+
+func (b *replayBackend) Stat(name string) (fs.FileInfo, error) {
+	rec, err := b.call(&recordEntry{Op: "stat", Name: name})
+	if err != nil {
+		return nil, err
+	}
+	return replayInfo{rec.Info}, nil
+}
+
+func (b *replayBackend) Lstat(name string) (fs.FileInfo, error) {
+	rec, err := b.call(&recordEntry{Op: "lstat", Name: name})
+	if err != nil {
+		return nil, err
+	}
+	return replayInfo{rec.Info}, nil
+}
+
+func (b *replayBackend) ReadDir(name string) ([]fs.DirEntry, error) {
+	rec, err := b.call(&recordEntry{Op: "readdir", Name: name})
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, len(rec.Entries))
+	for i := range rec.Entries {
+		entries[i] = replayDirEntry{&rec.Entries[i]}
+	}
+	return entries, nil
+}
+
+func (b *replayBackend) Mkdir(name string, perm fs.FileMode) error {
+	_, err := b.call(&recordEntry{Op: "mkdir", Name: name, Perm: perm})
+	return err
+}
+
+func (b *replayBackend) Unlink(name string) error {
+	_, err := b.call(&recordEntry{Op: "unlink", Name: name})
+	return err
+}
+
+func (b *replayBackend) Rmdir(name string) error {
+	_, err := b.call(&recordEntry{Op: "rmdir", Name: name})
+	return err
+}
+
+func (b *replayBackend) Rename(oldname, newname string) error {
+	_, err := b.call(&recordEntry{Op: "rename", Name: oldname, NewName: newname})
+	return err
+}
+
+func (b *replayBackend) Link(oldname, newname string) error {
+	_, err := b.call(&recordEntry{Op: "link", Name: oldname, NewName: newname})
+	return err
+}
+
+func (b *replayBackend) Symlink(target, newname string) error {
+	_, err := b.call(&recordEntry{Op: "symlink", Name: target, NewName: newname})
+	return err
+}
+
+func (b *replayBackend) Readlink(name string) (string, error) {
+	rec, err := b.call(&recordEntry{Op: "readlink", Name: name})
+	if err != nil {
+		return "", err
+	}
+	return rec.Target, nil
+}
+
+func (b *replayBackend) Chmod(name string, mode fs.FileMode) error {
+	_, err := b.call(&recordEntry{Op: "chmod", Name: name, Perm: mode})
+	return err
+}
+
+func (b *replayBackend) Chtimes(name string, atime, mtime time.Time) error {
+	_, err := b.call(&recordEntry{Op: "chtimes", Name: name, Times: []time.Time{atime, mtime}})
+	return err
+}
+
+func (b *replayBackend) Getxattr(name, attr string) ([]byte, error) {
+	rec, err := b.call(&recordEntry{Op: "getxattr", Name: name, Attr: attr})
+	if err != nil {
+		return nil, err
+	}
+	return rec.Data, nil
+}
+
+func (b *replayBackend) Setxattr(name, attr string, value []byte, flags int) error {
+	_, err := b.call(&recordEntry{Op: "setxattr", Name: name, Attr: attr, Flag: flags})
+	return err
+}
+
+func (b *replayBackend) Listxattr(name string) ([]string, error) {
+	rec, err := b.call(&recordEntry{Op: "listxattr", Name: name})
+	if err != nil {
+		return nil, err
+	}
+	return rec.Attrs, nil
+}
+
+func (b *replayBackend) Removexattr(name, attr string) error {
+	_, err := b.call(&recordEntry{Op: "removexattr", Name: name, Attr: attr})
+	return err
+}
+
+func (b *replayBackend) StatFS(name string) (vfs.FSStat, error) {
+	rec, err := b.call(&recordEntry{Op: "statfs", Name: name})
+	if err != nil || rec.FSStat == nil {
+		return vfs.FSStat{}, err
+	}
+	return *rec.FSStat, nil
+}
+
+// replayFile serves the calls recorded for a file opened through a
+// replayBackend.
+type replayFile struct {
+	r    *replayer
+	id   int
+	name string
+}
+
+func (f *replayFile) call(e *recordEntry) (*recordEntry, error) {
+	e.File = f.id
+	return f.r.call(e, f.name)
+}
+
+func (f *replayFile) Read(b []byte) (int, error) {
+	rec, err := f.call(&recordEntry{Op: "read", Len: len(b)})
+	return copy(b, rec.Data), err
+}
+
+func (f *replayFile) ReadAt(b []byte, off int64) (int, error) {
+	rec, err := f.call(&recordEntry{Op: "readat", Len: len(b), Off: off})
+	return copy(b, rec.Data), err
+}
+
+func (f *replayFile) Write(b []byte) (int, error) {
+	rec, err := f.call(&recordEntry{Op: "write", Len: len(b)})
+	return int(rec.N), err
+}
+
+func (f *replayFile) WriteAt(b []byte, off int64) (int, error) {
+	rec, err := f.call(&recordEntry{Op: "writeat", Len: len(b), Off: off})
+	return int(rec.N), err
+}
+
+func (f *replayFile) Truncate(size int64) error {
+	_, err := f.call(&recordEntry{Op: "truncate", Off: size})
+	return err
+}
+
+func (f *replayFile) PunchHole(off, n int64) error {
+	_, err := f.call(&recordEntry{Op: "punchhole", Len: int(n), Off: off})
+	return err
+}
+
+func (f *replayFile) Sync() error {
+	_, err := f.call(&recordEntry{Op: "sync"})
+	return err
+}
+
+func (f *replayFile) Seek(off int64, whence int) (int64, error) {
+	rec, err := f.call(&recordEntry{Op: "seek", Off: off, Whence: whence})
+	return rec.N, err
+}
+
+func (f *replayFile) Stat() (fs.FileInfo, error) {
+	rec, err := f.call(&recordEntry{Op: "stat"})
+	if err != nil {
+		return nil, err
+	}
+	return replayInfo{rec.Info}, nil
+}
+
+func (f *replayFile) Close() error {
+	_, err := f.call(&recordEntry{Op: "close"})
+	return err
+}
+
+// replayInfo is the fs.FileInfo a recording holds.
+type replayInfo struct{ r *recordedInfo }
+
+func (fi replayInfo) Name() string       { return fi.r.Name }
+func (fi replayInfo) Size() int64        { return fi.r.Size }
+func (fi replayInfo) Mode() fs.FileMode  { return fi.r.Mode }
+func (fi replayInfo) ModTime() time.Time { return fi.r.ModTime }
+func (fi replayInfo) IsDir() bool        { return fi.r.Mode.IsDir() }
+
+func (fi replayInfo) Sys() any {
+	switch {
+	case fi.r.Stat != nil:
+		return fi.r.Stat
+	case fi.r.Attr != nil:
+		return fi.r.Attr
+	}
+	return nil
+}
+
+// replayDirEntry is the fs.DirEntry a recording holds.
+type replayDirEntry struct{ r *recordedDirEntry }
+
+func (de replayDirEntry) Name() string      { return de.r.Name }
+func (de replayDirEntry) IsDir() bool       { return de.r.Type.IsDir() }
+func (de replayDirEntry) Type() fs.FileMode { return de.r.Type }
+
+func (de replayDirEntry) Info() (fs.FileInfo, error) {
+	if de.r.Info == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: de.r.Name, Err: fs.ErrNotExist}
+	}
+	return replayInfo{de.r.Info}, nil
+}
@@ -0,0 +1,108 @@
+package tracer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+)
+
+// Resolver is the name resolution a command traced WithResolver sees.
+type Resolver struct {
+	// Hosts maps host names to the IP address each resolves to, ahead of
+	// DNS. A name whose address does not parse is left out.
+	Hosts map[string]string
+	// Nameservers are the IP addresses of the DNS servers to ask, and
+	// Search the domains to try short names in. When both are empty the
+	// host's resolv.conf is left in place.
+	Nameservers []string
+	Search      []string
+}
+
+// WithResolver points the command's name resolution at r, without touching
+// the host's configuration: /etc/hosts, /etc/resolv.conf and
+// /etc/nsswitch.conf are served as files of their own, whatever mounts or
+// remapping rules say of /etc. The hosts file holds the names of r, and
+// localhost; the nsswitch.conf is the host's with its hosts line made
+// "files dns", so that the names are tried first. Libraries that do not
+// read the files, such as a resolver that talks to systemd-resolved over
+// D-Bus, are not redirected.
+func WithResolver(r Resolver) Option {
+	return func(t *Tracer) {
+		fs := memfs.New()
+		files := map[string][]byte{"hosts": r.hosts(), "nsswitch.conf": nsswitch()}
+		if len(r.Nameservers) > 0 || len(r.Search) > 0 {
+			files["resolv.conf"] = r.resolvConf()
+		}
+		for name, b := range files {
+			// Writes to a fresh memfs do not fail.
+			_ = writeFile(fs, name, b)
+		}
+		t.resolver = &mount{dir: "/etc", backend: fs}
+	}
+}
+
+func (r Resolver) hosts() []byte {
+	var b bytes.Buffer
+	b.WriteString("127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n")
+	for _, name := range slices.Sorted(maps.Keys(r.Hosts)) {
+		addr, err := netip.ParseAddr(r.Hosts[name])
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&b, "%s\t%s\n", addr, name)
+	}
+	return b.Bytes()
+}
+
+func (r Resolver) resolvConf() []byte {
+	var b bytes.Buffer
+	if len(r.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(r.Search, " "))
+	}
+	for _, ns := range r.Nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	return b.Bytes()
+}
+
+// nsswitch returns the host's nsswitch.conf with hosts looked up in the
+// hosts file and then DNS.
+func nsswitch() []byte {
+	const hosts = "hosts: files dns\n"
+	host, err := os.ReadFile("/etc/nsswitch.conf")
+	if err != nil {
+		return []byte(hosts)
+	}
+	var b bytes.Buffer
+	s := bufio.NewScanner(bytes.NewReader(host))
+	for s.Scan() {
+		if f := strings.Fields(s.Text()); len(f) > 0 && f[0] == "hosts:" {
+			continue
+		}
+		b.WriteString(s.Text() + "\n")
+	}
+	b.WriteString(hosts)
+	return b.Bytes()
+}
+
+// resolverFile returns the file of WithResolver p names, if it names one.
+func (t *Tracer) resolverFile(p string) (*mount, string, bool) {
+	if t.resolver == nil {
+		return nil, "", false
+	}
+	name, ok := strings.CutPrefix(p, "/etc/")
+	if !ok {
+		return nil, "", false
+	}
+	if _, err := t.resolver.backend.Lstat(name); err != nil {
+		return nil, "", false
+	}
+	return t.resolver, name, true
+}
@@ -0,0 +1,131 @@
+package tracer
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"golang.org/x/sys/unix"
+)
+
+// scratchSize is the size of the memory mapped into each traced process
+// for hooks and pinned paths to be written into.
+const scratchSize = 64 << 10
+
+// errScratchFull is returned when a process's scratch memory has no room
+// left for a write.
+var errScratchFull = errors.New("tracer: scratch memory exhausted")
+
+// scratch is an anonymous mapping in a tracee that the tracer hands out
+// space in, shared like the memory it lives in: threads and vfork children
+// use their parent's, while forked processes get a copy at the same
+// address.
+type scratch struct {
+	addr uintptr
+	// used holds the offset and length of each allocation, by offset.
+	used [][2]int
+}
+
+// alloc reserves n bytes and returns their address in the tracee.
+func (s *scratch) alloc(n int) (uintptr, error) {
+	n = (n + 15) &^ 15
+	off := 0
+	for i, u := range s.used {
+		if u[0]-off >= n {
+			s.used = slices.Insert(s.used, i, [2]int{off, n})
+			return s.addr + uintptr(off), nil
+		}
+		off = u[0] + u[1]
+	}
+	if scratchSize-off < n {
+		return 0, errScratchFull
+	}
+	s.used = append(s.used, [2]int{off, n})
+	return s.addr + uintptr(off), nil
+}
+
+// free releases the allocation at addr, if there is one.
+func (s *scratch) free(addr uintptr) {
+	s.used = slices.DeleteFunc(s.used, func(u [2]int) bool { return s.addr+uintptr(u[0]) == addr })
+}
+
+func (s *scratch) clone() *scratch {
+	if s == nil {
+		return nil
+	}
+	return &scratch{addr: s.addr, used: slices.Clone(s.used)}
+}
+
+// allocScratch maps scratch memory into the stopped thread's process,
+// which must be in a signal- or event-stop. Only hooks, pinned paths and
+// chroot use it, so it is skipped when there are none of them. Pinned paths must not be
+// written by the command, so then the memory is read-only to it, and the
+// tracer writes to it through ptrace.
+func (th *thread) allocScratch() {
+	if !th.t.wantsScratch() {
+		return
+	}
+	prot := uint64(unix.PROT_READ | unix.PROT_WRITE)
+	if th.t.pinPaths {
+		prot = unix.PROT_READ
+	}
+	ret, err := th.injectSyscall(unix.SYS_MMAP, 0, scratchSize, prot, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS, ^uint64(0), 0)
+	if err == nil && ret < 0 && ret > -4096 {
+		err = unix.Errno(-ret)
+	}
+	if err != nil {
+		th.t.log.Printf("tid %d: no scratch memory: %v", th.tid, err)
+		return
+	}
+	th.scratch = &scratch{addr: uintptr(ret)}
+}
+
+// rescratch arranges for a process that has just exec'd, and so lost its
+// scratch memory, to get more. The thread is in the exec event stop, which
+// sits inside execve where a syscall cannot be injected, so it is sent a
+// SIGSTOP to stop it again once execve is done.
+func (th *thread) rescratch() {
+	th.scratch, th.pinned = nil, nil
+	if !th.t.wantsScratch() {
+		return
+	}
+	if err := unix.Tgkill(th.tid, th.tid, unix.SIGSTOP); err != nil {
+		th.t.log.Printf("tid %d: no scratch memory: %v", th.tid, err)
+		return
+	}
+	th.scratching = true
+}
+
+// wantsScratch reports whether traced processes need scratch memory.
+func (t *Tracer) wantsScratch() bool { return len(t.enterHooks) > 0 || t.pinPaths || t.chroot }
+
+// WriteScratchString writes str, followed by a NUL, to memory the tracer
+// set aside in the command, and returns its address for the hook to pass
+// as an argument with SetArg. Unlike the stack, the space is not the
+// command's to use, and stays reserved until Free is called; an exit hook
+// for the same syscall is a good place for that. It fails with
+// errors.ErrUnsupported under EngineUnotify, which cannot map the memory.
+func (s *Syscall) WriteScratchString(str string) (uintptr, error) {
+	if s.th.scratch == nil {
+		return 0, errors.ErrUnsupported
+	}
+	b := append([]byte(str), 0)
+	addr, err := s.th.scratch.alloc(len(b))
+	if err != nil {
+		return 0, err
+	}
+	if err := s.th.mem.writeBytes(addr, b); err != nil {
+		s.th.scratch.free(addr)
+		return 0, fmt.Errorf("tracer: write scratch: %w", err)
+	}
+	return addr, nil
+}
+
+// Free releases scratch memory returned by WriteScratchString. Freeing an
+// address twice, or one that did not come from WriteScratchString, does
+// nothing.
+func (s *Syscall) Free(addr uintptr) {
+	if s.th.scratch != nil {
+		s.th.scratch.free(addr)
+	}
+}
@@ -0,0 +1,177 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithSeccomp controls the seccomp fast path, which is on by default. With
+// it, a filter installed in the tracee makes only the syscalls the tracer
+// intercepts stop; everything else runs at native speed. Without it, or if
+// the filter cannot be installed, every syscall entry and exit stops.
+func WithSeccomp(enabled bool) Option {
+	return func(t *Tracer) { t.useSeccomp = enabled }
+}
+
+// seccompFilter returns a BPF program that applies action to the given
+// native syscalls, and to their compat equivalents, and allows everything
+// else. Syscalls from an ABI the tracer does not translate always get
+// action rather than risk letting them bypass interception. If fixedAnon
+// is set, anonymous mappings at a fixed address get action too.
+func seccompFilter(nrs []uint64, action uint32, fixedAnon bool) []unix.SockFilter {
+	stmt := func(code uint16, k uint32) unix.SockFilter { return unix.SockFilter{Code: code, K: k} }
+	jump := func(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	const (
+		ld   = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+		ret  = unix.BPF_RET | unix.BPF_K
+		jeq  = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jge  = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+		jset = unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K
+		ja   = unix.BPF_JMP | unix.BPF_JA
+		// Offsets into struct seccomp_data.
+		offNr   = 0
+		offArch = 4
+		offArgs = 16
+	)
+	// check applies action to the listed syscalls and allows the rest,
+	// once the syscall number has been loaded. Only file mappings concern
+	// the tracer, and anonymous ones are far too common to stop for, so
+	// mmap is let through when its flags have MAP_ANONYMOUS, unless they
+	// have MAP_FIXED and fixedAnon is set.
+	check := func(nrs []uint64, mmap uint64) []unix.SockFilter {
+		var c []unix.SockFilter
+		for _, nr := range nrs {
+			if nr == mmap {
+				anon := []unix.SockFilter{
+					stmt(ld, offArgs+3*8),
+					jump(jset, unix.MAP_ANONYMOUS, 1, 0),
+					stmt(ret, action),
+				}
+				if fixedAnon {
+					anon = append(anon, jump(jset, unix.MAP_FIXED, 0, 1), stmt(ret, action))
+				}
+				anon = append(anon, stmt(ret, unix.SECCOMP_RET_ALLOW))
+				c = append(c, jump(jeq, uint32(nr), 0, uint8(len(anon))))
+				c = append(c, anon...)
+				continue
+			}
+			c = append(c, jump(jeq, uint32(nr), 0, 1), stmt(ret, action))
+		}
+		return append(c, stmt(ret, unix.SECCOMP_RET_ALLOW))
+	}
+	// x32 calls share the native arch; they are trapped wholesale.
+	native := append([]unix.SockFilter{
+		stmt(ld, offNr),
+		jump(jge, x32Bit, 0, 1),
+		stmt(ret, action),
+	}, check(nrs, unix.SYS_MMAP)...)
+
+	var compatNrs []uint64
+	compatMmap := ^uint64(0)
+	for c, n := range compatSyscalls {
+		if slices.Contains(nrs, n) {
+			compatNrs = append(compatNrs, c)
+		}
+		if n == unix.SYS_MMAP {
+			compatMmap = c
+		}
+	}
+	slices.Sort(compatNrs)
+	compat := append([]unix.SockFilter{stmt(ld, offNr)}, check(compatNrs, compatMmap)...)
+
+	// The dispatch jumps use BPF_JA, whose offset is not limited to
+	// eight bits like a conditional jump's.
+	prog := []unix.SockFilter{stmt(ld, offArch), jump(jeq, auditArch, 0, 1), {}}
+	if compatArch != 0 {
+		prog = append(prog, jump(jeq, compatArch, 0, 1), unix.SockFilter{})
+	}
+	prog = append(prog, stmt(ret, action))
+	prog[2] = stmt(ja, uint32(len(prog)-3))
+	if compatArch != 0 {
+		prog[4] = stmt(ja, uint32(len(prog)+len(native)-5))
+	}
+	prog = append(prog, native...)
+	if compatArch != 0 {
+		prog = append(prog, compat...)
+	}
+	return prog
+}
+
+// trapAllFilter returns a BPF program that applies action to every syscall,
+// for hooks that want them all. Under notifications close_range is let
+// through, since the tracer has to make it in the tracee before anything
+// reads them; its number is the same in every ABI.
+func trapAllFilter(action uint32) []unix.SockFilter {
+	prog := []unix.SockFilter{{Code: unix.BPF_RET | unix.BPF_K, K: action}}
+	if action != unix.SECCOMP_RET_USER_NOTIF {
+		return prog
+	}
+	return append([]unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: unix.SYS_CLOSE_RANGE, Jt: 0, Jf: 1},
+		{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ALLOW},
+	}, prog...)
+}
+
+// x32Bit is set in the number of syscalls made through the x32 ABI.
+const x32Bit = 0x40000000
+
+// installFilter loads a seccomp filter applying action to the syscalls the
+// tracer needs to see into the thread, which must be stopped right after exec. The
+// filter is inherited by everything the tracee forks or execs. It returns
+// the value of the seccomp call, which is a descriptor in the tracee when
+// flags asks for a notification listener.
+func (th *thread) installFilter(action uint32, flags uint64) (int, error) {
+	var regs unix.PtraceRegs
+	if err := getRegs(th.tid, &regs); err != nil {
+		return 0, err
+	}
+	prog := seccompFilter(th.t.syscalls(), action, th.t.pinPaths)
+	if th.t.hookAll() {
+		prog = trapAllFilter(action)
+	}
+	insns := unsafe.Slice((*byte)(unsafe.Pointer(&prog[0])), len(prog)*int(unsafe.Sizeof(prog[0])))
+
+	// struct sock_fprog and the program go in unused stack below the
+	// red zone; nothing else is running in the tracee yet. A 32-bit
+	// tracee passes the compat layout, with a 4-byte filter pointer.
+	fprogSize := 16
+	if isCompat(&regs) {
+		fprogSize = 8
+	}
+	addr := (stackPointer(&regs) - 4096 - uint64(fprogSize+len(insns))) &^ 15
+	fprog := make([]byte, fprogSize, fprogSize+len(insns))
+	binary.LittleEndian.PutUint16(fprog[0:], uint16(len(prog)))
+	if isCompat(&regs) {
+		binary.LittleEndian.PutUint32(fprog[4:], uint32(addr)+uint32(fprogSize))
+	} else {
+		binary.LittleEndian.PutUint64(fprog[8:], addr+uint64(fprogSize))
+	}
+	if err := th.mem.writeBytes(uintptr(addr), append(fprog, insns...)); err != nil {
+		return 0, err
+	}
+
+	seccomp := func() (int64, error) {
+		return th.injectSyscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, flags, addr)
+	}
+	ret, err := seccomp()
+	if err == nil && ret == -int64(unix.EACCES) {
+		// Unprivileged tracees need no_new_privs to install a filter.
+		if ret, err = th.injectSyscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1); err == nil && ret == 0 {
+			ret, err = seccomp()
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if ret < 0 {
+		return 0, fmt.Errorf("tracer: seccomp: %w", unix.Errno(-ret))
+	}
+	return int(ret), nil
+}
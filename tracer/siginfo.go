@@ -0,0 +1,20 @@
+package tracer
+
+// siginfo is the prefix of siginfo_t that waitid fills in for SIGCHLD.
+type siginfo struct {
+	Signo  int32
+	Errno  int32
+	Code   int32
+	_      int32
+	Pid    int32
+	Uid    uint32
+	Status int32
+	_      [100]byte
+}
+
+// si_code values for SIGCHLD, from <asm-generic/siginfo.h>.
+const (
+	cldExited = 1
+	cldKilled = 2
+	cldDumped = 3
+)
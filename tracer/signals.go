@@ -0,0 +1,112 @@
+package tracer
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Every tracee is attached with PTRACE_SEIZE semantics, which is what lets
+// the tracer tell a group-stop from a stopping signal being delivered. The
+// first is left in place with PTRACE_LISTEN, so that job control works as
+// it would untraced: a tracee stopped by Ctrl-Z stays stopped until it is
+// sent SIGCONT, and its parent sees it stop and continue.
+
+// reseize swaps the PTRACE_TRACEME attachment the command starts with for a
+// PTRACE_SEIZE one with the given options. The leader must be stopped at
+// the SIGTRAP that follows its exec, and is left stopped, with nothing for
+// the command to see.
+func (t *Tracer) reseize(options int) error {
+	// The SIGSTOP replaces the SIGTRAP, and stops the leader before it
+	// runs an instruction, until it is seized again.
+	if err := ptraceDetach(t.leader, unix.SIGSTOP); err != nil {
+		return err
+	}
+	var ws unix.WaitStatus
+	if _, err := unix.Wait4(t.leader, &ws, waitFlags|unix.WUNTRACED, nil); err != nil {
+		return fmt.Errorf("tracer: wait: %w", err)
+	}
+	if err := seize(t.leader, options); err != nil {
+		return fmt.Errorf("tracer: seize: %w", err)
+	}
+	// That the leader was stopped makes the seize report a group-stop.
+	// Ending it with a SIGCONT the leader never gets keeps the stop from
+	// being reported in place of the interruptions the tracer asks for
+	// later.
+	if err := unix.Kill(t.leader, unix.SIGCONT); err != nil {
+		return fmt.Errorf("tracer: continue: %w", err)
+	}
+	for {
+		if _, err := unix.Wait4(t.leader, &ws, waitFlags, nil); err != nil {
+			return fmt.Errorf("tracer: wait: %w", err)
+		}
+		if !ws.Stopped() {
+			return fmt.Errorf("tracer: leader exited while being seized")
+		}
+		if eventStop(ws) < 0 && ws.StopSignal() == unix.SIGCONT {
+			// Resuming the leader from here discards the signal.
+			return nil
+		}
+		if err := unix.PtraceCont(t.leader, 0); err != nil {
+			return fmt.Errorf("tracer: resume: %w", err)
+		}
+	}
+}
+
+// eventStop returns the PTRACE_EVENT a stop reports, or -1 if it is a
+// signal-delivery-stop. Unlike ws.TrapCause it reports group-stops, which
+// are PTRACE_EVENT_STOP stops with the stopping signal.
+func eventStop(ws unix.WaitStatus) int {
+	if !ws.Stopped() || ws>>16 == 0 {
+		return -1
+	}
+	return int(ws >> 16)
+}
+
+// groupStop reports whether ws is a tracee entering or remaining in a
+// group-stop, as opposed to the PTRACE_EVENT_STOP an interruption or a new
+// tracee's first stop reports.
+func groupStop(ws unix.WaitStatus) bool {
+	if eventStop(ws) != unix.PTRACE_EVENT_STOP {
+		return false
+	}
+	switch ws.StopSignal() {
+	case unix.SIGSTOP, unix.SIGTSTP, unix.SIGTTIN, unix.SIGTTOU:
+		return true
+	}
+	return false
+}
+
+// listen keeps the thread in the group-stop it has reported while letting
+// the kernel wake it for SIGCONT, after which it reports another stop.
+func (t *Tracer) listen(th *thread) error {
+	if t.detaching {
+		// Detached, the thread stays stopped as it is.
+		return t.detach(th, 0)
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_LISTEN, uintptr(th.tid), 0, 0, 0, 0)
+	if errno != 0 && errno != unix.ESRCH {
+		return fmt.Errorf("tracer: listen: %w", errno)
+	}
+	return nil
+}
+
+// ptraceDetach detaches from the stopped task tid, delivering sig if it is
+// non-zero.
+func ptraceDetach(tid int, sig unix.Signal) error {
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_DETACH, uintptr(tid), 0, uintptr(sig), 0, 0)
+	if errno != 0 && errno != unix.ESRCH {
+		return fmt.Errorf("tracer: detach: %w", errno)
+	}
+	return nil
+}
+
+// seize attaches to the task tid with the given options, without stopping
+// it.
+func seize(tid, options int) error {
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_SEIZE, uintptr(tid), 0, uintptr(options), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
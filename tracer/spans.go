@@ -0,0 +1,62 @@
+package tracer
+
+import (
+	"io"
+	"path"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sys/unix"
+)
+
+// WithTracerProvider has the tracer make an OpenTelemetry span, with a
+// tracer from tp, for each operation on the backend of a mount, so that the
+// command's file I/O shows in the same distributed traces as the service
+// that launched it. The spans are children of the span in the context
+// given to Run or Start.
+//
+// A span is named for the operation, as in vfs.open or vfs.read, and says
+// the path of the file, the pid of the process and the syscall the
+// operation was made for, if it was made for one, and vfs.result: ok, or
+// the name of the errno the operation failed with. Those of reads and
+// writes also say how many bytes moved. The tracer does not end a span
+// until its operation is over, so a backend that is slow to answer shows
+// as a long span.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(t *Tracer) { t.spans = tp.Tracer("github.com/maxmcd/cfc-ptrace/tracer") }
+}
+
+// spanOp is the syscall the tracer is handling, by the process pid, for
+// which it operates on backends.
+type spanOp struct {
+	pid int
+	nr  uint64
+}
+
+// spanObserver returns the observer that makes spans of the operations on
+// the backend of the mount at dir.
+func (t *Tracer) spanObserver(dir string) observer {
+	return func(at spanOp, op, name string) func(int, error) {
+		attrs := []attribute.KeyValue{
+			attribute.String("vfs.mount", dir),
+			attribute.String("vfs.path", path.Join(dir, name)),
+		}
+		if at.pid != 0 {
+			attrs = append(attrs, attribute.Int("process.pid", at.pid), attribute.String("syscall.name", syscallName(at.nr)))
+		}
+		_, span := t.spans.Start(t.spanCtx, "vfs."+op, trace.WithAttributes(attrs...))
+		return func(n int, err error) {
+			result := "ok"
+			if err != nil && err != io.EOF {
+				result = unix.ErrnoName(errnoFor(err))
+				span.SetStatus(codes.Error, err.Error())
+			}
+			span.SetAttributes(attribute.String("vfs.result", result))
+			if op == "read" || op == "write" {
+				span.SetAttributes(attribute.Int("vfs.bytes", n))
+			}
+			span.End()
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package tracer
+
+import (
+	"io/fs"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// statFromInfo builds the struct stat the kernel would report for fi.
+func statFromInfo(fi fs.FileInfo) unix.Stat_t {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return *(*unix.Stat_t)(unsafe.Pointer(st))
+	}
+	mtime := unix.NsecToTimespec(fi.ModTime().UnixNano())
+	st := unix.Stat_t{
+		Mode:    unixMode(fi.Mode()),
+		Nlink:   1,
+		Size:    fi.Size(),
+		Blksize: 4096,
+		Blocks:  (fi.Size() + 511) / 512,
+		Atim:    mtime,
+		Mtim:    mtime,
+		Ctim:    mtime,
+	}
+	if fi.IsDir() {
+		st.Nlink = 2
+	}
+	if attr, ok := fi.Sys().(*vfs.Attr); ok {
+		st.Ino = attr.Ino
+		// st_nlink is 32 bits on arm64.
+		setInt(&st.Nlink, attr.Nlink)
+		st.Uid, st.Gid = attr.Uid, attr.Gid
+		st.Rdev = attr.Rdev
+		st.Atim = unix.NsecToTimespec(attr.Atime.UnixNano())
+		st.Ctim = unix.NsecToTimespec(attr.Ctime.UnixNano())
+	}
+	return st
+}
+
+func setInt[T ~uint32 | ~uint64](p *T, v uint64) { *p = T(v) }
+
+// unixMode converts an fs.FileMode to st_mode bits.
+func unixMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	switch {
+	case m.IsDir():
+		mode |= unix.S_IFDIR
+	case m&fs.ModeSymlink != 0:
+		mode |= unix.S_IFLNK
+	case m&fs.ModeNamedPipe != 0:
+		mode |= unix.S_IFIFO
+	case m&fs.ModeSocket != 0:
+		mode |= unix.S_IFSOCK
+	case m&fs.ModeCharDevice != 0:
+		mode |= unix.S_IFCHR
+	case m&fs.ModeDevice != 0:
+		mode |= unix.S_IFBLK
+	default:
+		mode |= unix.S_IFREG
+	}
+	if m&fs.ModeSetuid != 0 {
+		mode |= unix.S_ISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= unix.S_ISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= unix.S_ISVTX
+	}
+	return mode
+}
+
+func statBytes(st *unix.Stat_t) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(st)), unsafe.Sizeof(*st))
+}
+
+// statxFromStat converts st to the struct statx reporting the same
+// attributes. Birth times are not known, so STATX_BTIME is left out of the
+// mask.
+func statxFromStat(st *unix.Stat_t) unix.Statx_t {
+	ts := func(t unix.Timespec) unix.StatxTimestamp {
+		return unix.StatxTimestamp{Sec: t.Sec, Nsec: uint32(t.Nsec)}
+	}
+	return unix.Statx_t{
+		Mask:       unix.STATX_BASIC_STATS,
+		Blksize:    uint32(st.Blksize),
+		Nlink:      uint32(st.Nlink),
+		Uid:        st.Uid,
+		Gid:        st.Gid,
+		Mode:       uint16(st.Mode),
+		Ino:        st.Ino,
+		Size:       uint64(st.Size),
+		Blocks:     uint64(st.Blocks),
+		Atime:      ts(st.Atim),
+		Ctime:      ts(st.Ctim),
+		Mtime:      ts(st.Mtim),
+		Rdev_major: unix.Major(st.Rdev),
+		Rdev_minor: unix.Minor(st.Rdev),
+		Dev_major:  unix.Major(st.Dev),
+		Dev_minor:  unix.Minor(st.Dev),
+	}
+}
+
+func statxBytes(stx *unix.Statx_t) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(stx)), unsafe.Sizeof(*stx))
+}
+
+// stat builds the struct stat reported for the file at p, which fi
+// describes, applying the mount's ownership and permission overrides.
+func (m *mount) stat(p string, fi fs.FileInfo) unix.Stat_t {
+	st := statFromInfo(fi)
+	if st.Ino == 0 {
+		st.Ino = inodeNumber(p, fi)
+	}
+	if m.owner != nil {
+		st.Uid, st.Gid = m.owner.uid, m.owner.gid
+	}
+	if m.perm != nil && (fi.Mode().IsRegular() || fi.IsDir()) {
+		perm := m.perm.file
+		if fi.IsDir() {
+			perm = m.perm.dir
+		}
+		st.Mode = st.Mode&unix.S_IFMT | unixMode(perm)&^unix.S_IFMT
+	}
+	return st
+}
@@ -0,0 +1,91 @@
+package tracer
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// What statfs reports of a mount whose backend does not say: a filesystem
+// served from user space, with a terabyte and a billion inodes to spare.
+const (
+	statfsType   = unix.FUSE_SUPER_MAGIC
+	statfsBlock  = 4096
+	statfsSize   = 1 << 40
+	statfsInodes = 1 << 30
+)
+
+// stValid is the ST_VALID flag the kernel sets in f_flags, which package
+// unix does not define.
+const stValid = 0x20
+
+func (th *thread) sysStatfs(pathAddr, buf uintptr) (int64, bool) {
+	abs, m, name, ret, ok := th.virtualTarget(unix.AT_FDCWD, pathAddr)
+	if !ok || ret < 0 {
+		return ret, ok
+	}
+	th.t.log.Printf("statfs: %s (virtual)", abs)
+	if _, err := m.backend.Stat(name); err != nil {
+		return errnoRet(err), true
+	}
+	return th.statfs(m, abs, name, buf)
+}
+
+func (th *thread) sysFstatfs(fd int, buf uintptr) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	th.t.log.Printf("fstatfs: fd=%d (virtual)", fd)
+	return th.statfs(f.mount, f.path, f.name, buf)
+}
+
+// statfs writes the struct statfs of the file abs, which is name in m, to
+// buf. The sizes come from the backend, such as the limits of a quota,
+// and where it does not know them from the defaults above; the flags
+// report a file read-only mode does not let the command write as being on
+// a read-only filesystem.
+func (th *thread) statfs(m *mount, abs, name string, buf uintptr) (int64, bool) {
+	fst, err := vfs.StatFS(m.backend, name)
+	if err != nil {
+		return errnoRet(err), true
+	}
+	if fst.Type == 0 {
+		fst.Type = statfsType
+	}
+	if fst.Bytes == 0 {
+		fst.Bytes, fst.BytesFree = statfsSize, statfsSize
+	}
+	if fst.Inodes == 0 {
+		fst.Inodes, fst.InodesFree = statfsInodes, statfsInodes
+	}
+	st := unix.Statfs_t{
+		Type:    fst.Type,
+		Bsize:   statfsBlock,
+		Blocks:  uint64(fst.Bytes / statfsBlock),
+		Bfree:   uint64(fst.BytesFree / statfsBlock),
+		Bavail:  uint64(fst.BytesFree / statfsBlock),
+		Files:   uint64(fst.Inodes),
+		Ffree:   uint64(fst.InodesFree),
+		Namelen: 255,
+		Frsize:  statfsBlock,
+		Flags:   stValid,
+	}
+	if th.t.readOnly && !th.t.isWritable(abs) {
+		st.Flags |= unix.ST_RDONLY
+	}
+	b, errno := encodeStatfs(th.arch, &st)
+	if errno != 0 {
+		return -int64(errno), true
+	}
+	if err := th.mem.writeBytes(buf, b); err != nil {
+		return -int64(unix.EFAULT), true
+	}
+	return 0, true
+}
+
+func statfsBytes(st *unix.Statfs_t) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(st)), unsafe.Sizeof(*st))
+}
@@ -0,0 +1,277 @@
+package tracer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithStdio connects the command's standard input, output and error to
+// stdin, stdout and stderr, in place of the Stdin, Stdout and Stderr of its
+// exec.Cmd; a nil one leaves the Cmd's own. As exec.Cmd does, the tracer
+// copies a reader or writer that is not an *os.File through a pipe, so a
+// writer slow to take the command's output holds the command up once the
+// pipe is full, rather than the output piling up in memory, and Run returns
+// only once everything has been copied. It has no effect on Attach.
+func WithStdio(stdin io.Reader, stdout, stderr io.Writer) Option {
+	return func(t *Tracer) {
+		if t.cmd == nil {
+			return
+		}
+		if stdin != nil {
+			t.cmd.Stdin = stdin
+		}
+		if stdout != nil {
+			t.cmd.Stdout = stdout
+		}
+		if stderr != nil {
+			t.cmd.Stderr = stderr
+		}
+	}
+}
+
+// WithPTY runs the command on a new pseudo-terminal of rows by cols, as the
+// controlling terminal of a session the command leads, so that it behaves
+// as it would in an interactive shell. Its standard input, output and error
+// are all the terminal. What is read from the Cmd's Stdin, which WithStdio
+// can set, is typed at the terminal, followed by an end-of-file character
+// once it is exhausted; what the command writes to the terminal goes to
+// the Cmd's Stdout, through the terminal's line discipline, which echoes
+// what is typed and ends lines with "\r\n". The Cmd's Stderr is not used.
+//
+// The output is copied as it is written, so a Stdout slow to take it holds
+// the command up once the terminal's buffer is full. Run returns once all
+// of it has been copied, and Resize changes the terminal's size. Processes
+// Detach lets go keep the terminal, and the copying goes on for them.
+func WithPTY(rows, cols int) Option {
+	return func(t *Tracer) {
+		t.pty = &pty{size: unix.Winsize{Row: uint16(rows), Col: uint16(cols)}}
+	}
+}
+
+// WithTerminal runs the command on a new pseudo-terminal as WithPTY does,
+// standing in for the terminal term the tracer itself runs on, usually
+// os.Stdin, so that shells, REPLs and editors work under the tracer. The
+// new terminal starts with term's size and modes, and follows its size
+// whenever the tracer gets a SIGWINCH. What is typed at term goes to the
+// command, and its output to the Cmd's Stdout, or to term if that is nil.
+// term is put in raw mode while the command runs, so that Ctrl-C and the
+// like reach the command's terminal to be handled there, and its modes
+// are put back once the tracer finishes.
+func WithTerminal(term *os.File) Option {
+	return func(t *Tracer) {
+		t.pty = &pty{size: unix.Winsize{Row: 24, Col: 80}, term: term}
+	}
+}
+
+// pty is the pseudo-terminal of WithPTY. Once it is open, master and
+// slave are its ends, and stdin and stdout are the Cmd's own streams, which
+// are copied to and from master. output is closed once the command's
+// output has all been copied.
+//
+// With WithTerminal, term is the terminal stood in for and modes what its
+// modes were. winch gets the tracer's SIGWINCHes until stop is closed, and
+// resized is closed once they are no longer forwarded.
+type pty struct {
+	size   unix.Winsize
+	master *os.File
+	slave  *os.File
+	stdin  io.Reader
+	stdout io.Writer
+	output chan struct{}
+
+	term    *os.File
+	modes   *unix.Termios
+	winch   chan os.Signal
+	stop    chan struct{}
+	resized chan struct{}
+}
+
+// openPTY opens the pseudo-terminal for the command and makes it the
+// command's standard streams and controlling terminal.
+func (t *Tracer) openPTY() error {
+	p := t.pty
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("tracer: pty: %w", err)
+	}
+	master := os.NewFile(uintptr(fd), "/dev/ptmx")
+	slave, err := openSlave(fd)
+	if err == nil && p.term != nil {
+		if ws, err := unix.IoctlGetWinsize(int(p.term.Fd()), unix.TIOCGWINSZ); err == nil {
+			p.size = *ws
+		}
+	}
+	if err == nil {
+		err = unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, &p.size)
+	}
+	if err != nil {
+		master.Close()
+		if slave != nil {
+			slave.Close()
+		}
+		return fmt.Errorf("tracer: pty: %w", err)
+	}
+	p.master, p.slave = master, slave
+	p.stdin, p.stdout = t.cmd.Stdin, t.cmd.Stdout
+	if p.term != nil {
+		if err := p.standIn(); err != nil {
+			master.Close()
+			slave.Close()
+			return fmt.Errorf("tracer: pty: %w", err)
+		}
+	}
+	t.cmd.Stdin, t.cmd.Stdout, t.cmd.Stderr = slave, slave, slave
+	if t.cmd.SysProcAttr == nil {
+		t.cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	// The terminal is the child's descriptor 0.
+	t.cmd.SysProcAttr.Setsid, t.cmd.SysProcAttr.Setctty, t.cmd.SysProcAttr.Ctty = true, true, 0
+	return nil
+}
+
+// openSlave unlocks the terminal whose master is open as fd, and opens its
+// slave end.
+func openSlave(fd int) (*os.File, error) {
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		return nil, err
+	}
+	n, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("/dev/pts/%d", n)
+	sfd, err := unix.Open(name, unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(sfd), name), nil
+}
+
+// standIn gives the terminal the modes of the one it stands in for, which
+// it takes input from, and output goes to unless the Cmd has a Stdout.
+func (p *pty) standIn() error {
+	modes, err := unix.IoctlGetTermios(int(p.term.Fd()), unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlSetTermios(int(p.slave.Fd()), unix.TCSETS, modes); err != nil {
+		return err
+	}
+	p.modes, p.stdin = modes, p.term
+	if p.stdout == nil {
+		p.stdout = p.term
+	}
+	return nil
+}
+
+// makeRaw puts the terminal stood in for in raw mode, as cfmakeraw would,
+// and has its size followed.
+func (p *pty) makeRaw() {
+	raw := *p.modes
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN], raw.Cc[unix.VTIME] = 1, 0
+	if err := unix.IoctlSetTermios(int(p.term.Fd()), unix.TCSETS, &raw); err != nil {
+		p.modes = nil
+	}
+	p.winch, p.stop, p.resized = make(chan os.Signal, 1), make(chan struct{}), make(chan struct{})
+	signal.Notify(p.winch, unix.SIGWINCH)
+	go func() {
+		defer close(p.resized)
+		for {
+			select {
+			case <-p.winch:
+				if ws, err := unix.IoctlGetWinsize(int(p.term.Fd()), unix.TIOCGWINSZ); err == nil {
+					_ = unix.IoctlSetWinsize(int(p.master.Fd()), unix.TIOCSWINSZ, ws)
+				}
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// start starts copying to and from the terminal once the command has
+// started on it, or closes it if the command failed to start, as err says.
+func (p *pty) start(err error) {
+	if p == nil {
+		return
+	}
+	p.slave.Close()
+	if err != nil {
+		p.master.Close()
+		p.master = nil
+		return
+	}
+	if p.term != nil {
+		p.makeRaw()
+	}
+	p.output = make(chan struct{})
+	go func() {
+		defer close(p.output)
+		out := p.stdout
+		if out == nil {
+			out = io.Discard
+		}
+		// The read that fails with EIO, once no process has the terminal
+		// open any longer, ends the copy.
+		_, _ = io.Copy(out, p.master)
+	}()
+	if p.stdin != nil {
+		go func() {
+			if _, err := io.Copy(p.master, p.stdin); err != nil {
+				return
+			}
+			eof := byte(4)
+			if tio, err := unix.IoctlGetTermios(int(p.master.Fd()), unix.TCGETS); err == nil {
+				eof = tio.Cc[unix.VEOF]
+			}
+			_, _ = p.master.Write([]byte{eof})
+		}()
+	}
+}
+
+// finish waits for the command's output to have been copied and closes
+// the terminal, unless detached says processes let go still have it. The
+// terminal stood in for gets its modes back either way.
+func (p *pty) finish(detached bool) {
+	if p == nil || p.master == nil {
+		return
+	}
+	if !detached {
+		<-p.output
+	}
+	if p.term != nil {
+		signal.Stop(p.winch)
+		close(p.stop)
+		<-p.resized
+		if p.modes != nil {
+			_ = unix.IoctlSetTermios(int(p.term.Fd()), unix.TCSETS, p.modes)
+		}
+	}
+	if !detached {
+		p.master.Close()
+	}
+}
+
+// Resize changes the size of the terminal of WithPTY to rows by cols,
+// which sends the command's foreground process group a SIGWINCH.
+func (t *Tracer) Resize(rows, cols int) error {
+	if t.pty == nil {
+		return errors.New("tracer: no pty")
+	}
+	if t.pty.master == nil {
+		return errors.New("tracer: not started")
+	}
+	ws := unix.Winsize{Row: uint16(rows), Col: uint16(cols)}
+	return unix.IoctlSetWinsize(int(t.pty.master.Fd()), unix.TIOCSWINSZ, &ws)
+}
@@ -0,0 +1,86 @@
+package tracer
+
+import (
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithWriteStreaming lets an emulated write or pwrite64 to a virtual file
+// move all it is given, rather than the 1 MiB at most that one moves
+// otherwise, without holding all of it in the tracer's memory. A write
+// larger than chunk bytes is read from the command's memory a chunk at a
+// time, and each chunk handed to the backend while the next is read. At
+// most window chunks wait for the backend besides the one it is writing,
+// so a backend slower than the command's memory holds up reading instead
+// of piling the write up: a multi-gigabyte write takes at most
+// (window+2)*chunk bytes. A chunk larger than 1 MiB is taken as 1 MiB, and
+// a window less than 1 as 1.
+//
+// The chunks are written in order, as one write would be. A backend that
+// fails or writes a chunk short ends the write there, which returns what
+// was written before, or the error if nothing was; so does a chunk that
+// cannot be read. With WithWorkers, a worker does the whole write. A chunk
+// of 0 turns streaming off.
+func WithWriteStreaming(chunk, window int) Option {
+	return func(t *Tracer) {
+		t.streamChunk = min(max(chunk, 0), maxBufferSize)
+		t.streamWindow = max(window, 1)
+	}
+}
+
+// streamWrite writes count bytes from the tracee's memory at buf to f, at
+// off or, if off is -1, at the file offset, a chunk at a time as
+// WithWriteStreaming says. It returns the bytes written, and the error
+// that ended the write early, if any.
+func (th *thread) streamWrite(f *vfile, buf uintptr, count int, off int64) (int, error) {
+	chunk := th.t.streamChunk
+	chunks := make(chan []byte, th.t.streamWindow)
+	// stopped is closed once the backend has stopped taking chunks.
+	stopped := make(chan struct{})
+	var (
+		written int
+		werr    error
+	)
+	go func() {
+		defer close(stopped)
+		for b := range chunks {
+			n, err := f.write(b, off)
+			written += n
+			if off != -1 {
+				off += int64(n)
+			}
+			if err == nil && n < len(b) {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				werr = err
+				return
+			}
+		}
+	}()
+	var rerr error
+read:
+	for done := 0; done < count; {
+		b, err := th.mem.readBytes(buf+uintptr(done), min(chunk, count-done))
+		if err != nil {
+			rerr = unix.EFAULT
+			break
+		}
+		select {
+		case chunks <- b:
+		case <-stopped:
+			break read
+		}
+		done += len(b)
+	}
+	close(chunks)
+	<-stopped
+	if werr == io.ErrShortWrite {
+		return written, nil
+	}
+	if werr == nil {
+		werr = rerr
+	}
+	return written, werr
+}
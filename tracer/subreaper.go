@@ -0,0 +1,236 @@
+package tracer
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithSubreaper makes the tracer wait for the processes the command leaves
+// behind, rather than killing them once the command exits, and reap them
+// as they exit. A daemon the command forks, or a child it does not wait
+// for, runs to its end, atexit handlers and the writes they flush
+// included, and Run returns once the last of them has gone. Cancelling
+// Run's context still kills them all.
+//
+// The program running the tracer is made a child subreaper, with
+// PR_SET_CHILD_SUBREAPER, so that a process orphaned by the command comes
+// to it instead of to init, and can be reaped there rather than lingering
+// as a zombie in a program that runs commands for a long time. The
+// setting is the whole program's, and stays once Run returns: processes
+// the program started itself, and that their children orphan, come to it
+// too, and are its to reap.
+//
+// Under EngineUnotify, the tracer only knows of the processes that have
+// made a syscall it intercepts, and does not wait for the others. The
+// option does nothing for processes given to Attach.
+func WithSubreaper() Option {
+	return func(t *Tracer) { t.reaper = &reaper{pidfds: make(map[int]int)} }
+}
+
+// reaper holds the exited processes of the command that WithSubreaper
+// waits to see reaped, by pidfd.
+type reaper struct {
+	pidfds map[int]int
+	// held is the leader's thread while the ptrace engine keeps it
+	// stopped at its exit event, until the processes it leaves behind
+	// have gone.
+	held *thread
+	// mu guards wake, which wakes the tracer's thread while the command
+	// has exited and other processes remain, so that a cancelled context
+	// kills them.
+	mu   sync.Mutex
+	wake func()
+}
+
+// becomeSubreaper makes the program a child subreaper if WithSubreaper was
+// given.
+func (r *reaper) becomeSubreaper() error {
+	if r == nil {
+		return nil
+	}
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("tracer: PR_SET_CHILD_SUBREAPER: %w", err)
+	}
+	return nil
+}
+
+// watch adds the process pid, which is stopped at its exit event, to those
+// waited for.
+func (r *reaper) watch(pid int) {
+	if r == nil {
+		return
+	}
+	if _, ok := r.pidfds[pid]; ok {
+		return
+	}
+	if fd, err := unix.PidfdOpen(pid, 0); err == nil {
+		r.pidfds[pid] = fd
+	}
+}
+
+// adopt adds the process pidfd refers to on its exit, as watch does.
+func (r *reaper) adopt(pid, pidfd int) {
+	if r == nil {
+		return
+	}
+	if fd, err := unix.Dup(pidfd); err == nil {
+		r.pidfds[pid] = fd
+	}
+}
+
+// reap reaps the watched processes that have exited and been orphaned to
+// the program, and forgets those their parents have reaped. A process
+// still traced is left to the loop that services it.
+func (r *reaper) reap(traced map[int]*thread) {
+	if r == nil {
+		return
+	}
+	for pid, fd := range r.pidfds {
+		if traced[pid] != nil {
+			continue
+		}
+		var info siginfo
+		_, _, errno := unix.Syscall6(unix.SYS_WAITID, unix.P_PIDFD, uintptr(fd),
+			uintptr(unsafe.Pointer(&info)), unix.WEXITED|unix.WNOHANG|unix.WALL, 0, 0)
+		switch {
+		case errno == 0 && info.Pid != 0:
+		case errno == unix.ECHILD && unix.PidfdSendSignal(fd, 0, nil, 0) == unix.ESRCH:
+		default:
+			// Still running, or a zombie its parent has yet to reap.
+			continue
+		}
+		_ = unix.Close(fd)
+		delete(r.pidfds, pid)
+	}
+}
+
+// close forgets the processes left, once the tracer is done.
+func (r *reaper) close() {
+	if r == nil {
+		return
+	}
+	for pid, fd := range r.pidfds {
+		_ = unix.Close(fd)
+		delete(r.pidfds, pid)
+	}
+}
+
+// setWake sets what cancelled runs to wake the tracer's thread, or clears
+// it for nil.
+func (r *reaper) setWake(wake func()) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.wake = wake
+	r.mu.Unlock()
+}
+
+// cancelled kills the command once Run's context is cancelled and, while
+// the tracer is waiting for the processes it left behind, wakes the
+// tracer to kill those too.
+func (t *Tracer) cancelled() {
+	_ = t.cmd.Process.Kill()
+	if r := t.reaper; r != nil {
+		r.mu.Lock()
+		if r.wake != nil {
+			r.wake()
+		}
+		r.mu.Unlock()
+	}
+}
+
+// survivor returns the pid of a traced process other than the command,
+// or 0 if none is left.
+func (t *Tracer) survivor() int {
+	for _, th := range t.threads {
+		if th.pid != t.leader {
+			return th.pid
+		}
+	}
+	return 0
+}
+
+// holdExit reports whether the leader, stopped at its exit event, is to
+// be kept there because WithSubreaper waits for the processes it leaves
+// behind. Letting it exit would have its wait status collected by
+// cmd.Wait while the loop still services the others.
+func (t *Tracer) holdExit(th *thread) bool {
+	r := t.reaper
+	if r == nil || th.tid != t.leader || t.attached != 0 || t.detaching {
+		return false
+	}
+	pid := t.survivor()
+	if pid == 0 {
+		return false
+	}
+	t.log.Printf("pid %d: exiting, waiting for the processes it leaves", th.pid)
+	r.held = th
+	// A signal stops a traced process, which wakes peek. The one that is
+	// signalled can exit first; its pid is then no longer its, so the
+	// target is picked again as processes exit.
+	r.setWake(func() { _ = unix.Kill(pid, unix.SIGURG) })
+	return true
+}
+
+// reaped is called once a process of the command has exited under the
+// ptrace engine. It reaps what has been orphaned and lets the leader exit
+// once it is the last process left.
+func (t *Tracer) reaped() error {
+	r := t.reaper
+	if r == nil {
+		return nil
+	}
+	r.reap(t.threads)
+	if r.held == nil {
+		return nil
+	}
+	survivor := t.survivor()
+	if survivor != 0 {
+		r.setWake(func() { _ = unix.Kill(survivor, unix.SIGURG) })
+		return nil
+	}
+	return t.releaseExit()
+}
+
+// releaseExit lets the held leader exit.
+func (t *Tracer) releaseExit() error {
+	r := t.reaper
+	th := r.held
+	r.held = nil
+	r.setWake(nil)
+	return t.resume(th, 0)
+}
+
+// awaitKilled waits for the processes whose pidfds fds poll, which have
+// been sent SIGKILL, to exit, for a few seconds at most.
+func awaitKilled(fds []unix.PollFd) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(fds) > 0 {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return
+		}
+		n, err := unix.Poll(fds, int(left.Milliseconds())+1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil || n == 0 {
+			return
+		}
+		fds = slices.DeleteFunc(fds, func(fd unix.PollFd) bool { return fd.Revents != 0 })
+	}
+}
+
+// unotifyWake returns a function that wakes the unotify engine's thread,
+// which is the calling one, from its ppoll.
+func unotifyWake() func() {
+	pid, tid := os.Getpid(), unix.Gettid()
+	return func() { _ = unix.Tgkill(pid, tid, unix.SIGURG) }
+}
@@ -0,0 +1,225 @@
+package tracer
+
+import (
+	"context"
+	"runtime"
+	"slices"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Supervisor services the commands of many Tracers from one OS thread, so
+// that sandboxing many small jobs side by side does not take a thread, and
+// a loop, for each. Every Tracer keeps its own mounts, policy and events;
+// given WithSupervisor, its Start hands the command to the Supervisor,
+// whose loop waits for the next stop of any of the commands' tracees and
+// services it for the Tracer it belongs to. The loop's thread starts with
+// the first command and goes once the last has ended.
+//
+// The Tracers take turns: one whose backend is slow to answer, or whose
+// Events nobody reads, holds up the others. Only commands the ptrace engine
+// runs share the loop; a Tracer WithEngine(EngineUnotify), or one returned
+// by Attach, runs on a thread of its own as if it had no Supervisor.
+//
+// The zero Supervisor is ready to use. Its methods are safe for concurrent
+// use.
+type Supervisor struct {
+	mu      sync.Mutex
+	pending []*supervised
+	running bool
+	// wake is the leader of a command the loop is servicing, which a
+	// SIGURG stops to wake the loop for new commands.
+	wake int
+}
+
+// WithSupervisor has s service the command, along with those of the other
+// Tracers given it.
+func WithSupervisor(s *Supervisor) Option {
+	return func(t *Tracer) { t.supervisor = s }
+}
+
+// supervised is a Tracer the loop of a Supervisor services, started with
+// ctx.
+type supervised struct {
+	t   *Tracer
+	ctx context.Context
+	// stops undoes the context.AfterFunc calls made for the command.
+	stops []func() bool
+}
+
+// add hands t, started with ctx, to the loop, starting the loop if need
+// be.
+func (s *Supervisor) add(ctx context.Context, t *Tracer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, &supervised{t: t, ctx: ctx})
+	if !s.running {
+		s.running = true
+		go s.loop()
+		return
+	}
+	if s.wake != 0 {
+		// As for an idle attached process, a SIGURG does the tracee no
+		// harm.
+		_ = unix.Kill(s.wake, unix.SIGURG)
+	}
+}
+
+// loop services the commands handed to the Supervisor until none is left.
+func (s *Supervisor) loop() {
+	// Like the thread of a lone Tracer, this one is never unlocked.
+	runtime.LockOSThread()
+	var live []*supervised
+	ended := false
+	defer func() {
+		if ended {
+			return
+		}
+		// A backend ended the goroutine with runtime.Goexit, and the
+		// commands left have nothing to service them.
+		s.mu.Lock()
+		pending := s.pending
+		s.pending, s.running, s.wake = nil, false, 0
+		s.mu.Unlock()
+		for _, p := range append(live, pending...) {
+			err := p.t.crash
+			if err == nil {
+				err = &InternalError{}
+			}
+			p.abandon()
+			p.end(err)
+		}
+	}()
+	// orphans holds new children that reported their initial stop before
+	// their parents' fork events, for whichever Tracer they turn out to
+	// belong to.
+	orphans := make(map[int]bool)
+	for {
+		s.mu.Lock()
+		pending := s.pending
+		s.pending = nil
+		if len(pending) == 0 && len(live) == 0 {
+			s.running = false
+			s.mu.Unlock()
+			ended = true
+			return
+		}
+		s.mu.Unlock()
+		for _, p := range pending {
+			p.t.orphans = orphans
+			if err := p.t.guard(p.launch); err != nil {
+				p.abandon()
+				p.end(err)
+				continue
+			}
+			live = append(live, p)
+		}
+		live = slices.DeleteFunc(live, func(p *supervised) bool {
+			done, err := p.t.settle(p.ctx)
+			if done {
+				p.end(err)
+			}
+			return done
+		})
+		s.setWake(live)
+		if len(live) == 0 {
+			continue
+		}
+
+		pid, exiting, err := peek()
+		if err != nil {
+			for _, p := range live {
+				p.abandon()
+				p.end(err)
+			}
+			live = nil
+			continue
+		}
+		i := slices.IndexFunc(live, func(p *supervised) bool { return pid == p.t.leader || p.t.threads[pid] != nil })
+		if i < 0 {
+			// A new child not yet claimed by its parent's Tracer, or a
+			// tracee of one that has given up.
+			var ws unix.WaitStatus
+			if _, err := unix.Wait4(pid, &ws, unix.WALL, nil); err == nil {
+				if ws.Stopped() {
+					orphans[pid] = true
+				} else {
+					delete(orphans, pid)
+				}
+			}
+			continue
+		}
+		p := live[i]
+		if exiting && pid == p.t.leader {
+			// The leader is about to be reaped, and its pid freed.
+			s.mu.Lock()
+			if s.wake == pid {
+				s.wake = 0
+			}
+			s.mu.Unlock()
+		}
+		var done bool
+		if err := p.t.guard(func() (err error) { done, err = p.t.step(pid, exiting); return err }); done || err != nil {
+			p.abandon()
+			p.end(err)
+			live = slices.Delete(live, i, i+1)
+		}
+	}
+}
+
+// setWake picks the command a SIGURG wakes the loop through.
+func (s *Supervisor) setWake(live []*supervised) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wake = 0
+	for _, p := range live {
+		if p.t.cmd.ProcessState == nil && p.t.threads[p.t.leader] != nil {
+			s.wake = p.t.leader
+			return
+		}
+	}
+}
+
+// launch starts the command of p and sets it up, as run does for a lone
+// Tracer.
+func (p *supervised) launch() error {
+	t := p.t
+	if t.replay != nil {
+		if err := t.replay.load(); err != nil {
+			return err
+		}
+	}
+	if err := t.startCommand(p.ctx); err != nil {
+		return err
+	}
+	p.stops = append(p.stops,
+		context.AfterFunc(p.ctx, t.cancelled),
+		context.AfterFunc(t.detachCtx, func() { _ = unix.Kill(t.leader, unix.SIGURG) }))
+	leader, options, err := t.seizeCommand()
+	if err != nil {
+		return err
+	}
+	return t.traceCommand(leader, options)
+}
+
+// abandon kills what is left of a command whose Tracer failed, which a lone
+// Tracer's thread would have taken down with it by exiting.
+func (p *supervised) abandon() {
+	t := p.t
+	if t.cmd.Process == nil || t.cmd.ProcessState != nil {
+		return
+	}
+	for pid := range t.threads {
+		_ = unix.Kill(pid, unix.SIGKILL)
+	}
+	_ = t.cmd.Process.Kill()
+}
+
+// end finishes the Tracer of p with err.
+func (p *supervised) end(err error) {
+	for _, stop := range p.stops {
+		stop()
+	}
+	p.t.finish(err)
+}
@@ -0,0 +1,43 @@
+package tracer
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const ptraceGetSyscallInfo = 0x420e
+
+// Values of ptraceSyscallInfo.Op.
+const (
+	syscallInfoEntry   = 1
+	syscallInfoSeccomp = 3
+)
+
+// ptraceSyscallInfo is struct ptrace_syscall_info with the entry and
+// seccomp members of its union laid over each other.
+type ptraceSyscallInfo struct {
+	Op      uint8
+	_       [3]uint8
+	Arch    uint32
+	IP      uint64
+	SP      uint64
+	Nr      uint64
+	Args    [6]uint64
+	RetData uint32
+	_       uint32
+}
+
+// stoppedCall returns the syscall the thread is stopped entering, as
+// reported by PTRACE_GET_SYSCALL_INFO. Unlike the registers, that says
+// which ABI the syscall was made through. Kernels before 5.3 lack it, in
+// which case the registers are read as a native syscall.
+func (th *thread) stoppedCall() sysCall {
+	var info ptraceSyscallInfo
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, ptraceGetSyscallInfo, uintptr(th.tid),
+		unsafe.Sizeof(info), uintptr(unsafe.Pointer(&info)), 0, 0)
+	if errno != 0 || (info.Op != syscallInfoEntry && info.Op != syscallInfoSeccomp) {
+		return callFromRegs(&th.regs)
+	}
+	return sysCall{arch: info.Arch, nr: info.Nr, args: info.Args}
+}
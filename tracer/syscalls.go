@@ -0,0 +1,870 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"math"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// syscallEnter runs at a syscall-entry stop. If the syscall targets a
+// virtual file it is emulated: the kernel is told to skip it and the result
+// is filled in at the matching exit stop.
+func (th *thread) syscallEnter() {
+	if th.restarting() {
+		// This is one of the syscalls a mapping or an execution
+		// restarted the thread with, and it must run as set up.
+		return
+	}
+	if err := getRegs(th.tid, &th.regs); err != nil {
+		th.t.log.Printf("getregs: %v", err)
+		return
+	}
+	c := th.stoppedCall()
+	if th.slept {
+		th.slept = false
+	} else {
+		// A sleep on the virtual clock goes on only in the syscall
+		// remade after its nanosleep.
+		th.nap = nil
+		if d := th.delayFor(c); d > 0 {
+			err := th.startSleep(c, d)
+			if err == nil {
+				return
+			}
+			th.t.log.Printf("delay: %v", err)
+		}
+	}
+	var ret int64
+	emulate := false
+	if len(th.t.enterHooks) > 0 {
+		var argsSet bool
+		ret, emulate, argsSet = th.hookEnter(&c, &th.regs)
+		if argsSet && !emulate {
+			if err := setRegs(th.tid, &th.regs); err != nil {
+				th.t.log.Printf("setregs: %v", err)
+			}
+		}
+	}
+	th.hooked = nil
+	if th.t.wantsExit(c) {
+		th.hooked, th.hookedAt = &c, time.Now()
+	}
+	th.unpin()
+	if !emulate && th.t.pinPaths {
+		ret, emulate = th.pin(&c)
+	}
+	if !emulate {
+		ret, emulate = th.enter(c)
+	}
+	if th.nap != nil {
+		err := th.startSleep(c, th.nap.real)
+		if err == nil {
+			return
+		}
+		th.t.log.Printf("clock: %v", err)
+		th.nap = nil
+	}
+	if w := th.lockWait; w != nil {
+		// The thread stays stopped until the lock is free.
+		w.wake = func() { th.relock(c) }
+		return
+	}
+	if th.mapping != nil {
+		if err := th.startMapping(); err != nil {
+			th.t.log.Printf("mmap: %v", err)
+			th.mapping = nil
+		}
+		return
+	}
+	if th.redirect != nil {
+		if err := th.startRedirect(); err != nil {
+			th.t.log.Printf("%s: %v", syscallSpecs[th.redirect.nr].name, err)
+			th.redirect = nil
+		}
+		return
+	}
+	if th.exec != nil {
+		if err := th.startExec(); err != nil {
+			th.t.log.Printf("exec: %v", err)
+			th.dropExec()
+		}
+		return
+	}
+	if p := th.passing; p != nil {
+		err := th.startPassthrough()
+		if err == nil {
+			return
+		}
+		th.t.log.Printf("passthrough: %v", err)
+		th.passing = nil
+		ret, emulate = th.openVirtual(p.m, p.name, p.abs, p.flags, p.mode), true
+	}
+	if !emulate && th.cwd.root != "" {
+		ret, emulate = th.reroot(&c)
+	}
+	if !emulate {
+		return
+	}
+	if th.job != nil {
+		err := th.park()
+		if err == nil {
+			th.emulated = true
+			return
+		}
+		th.t.log.Printf("workers: %v", err)
+		j := th.job
+		th.job = nil
+		ret = j.then(j.do())
+	}
+	// The syscall is skipped, unless the kernel must hold a placeholder
+	// descriptor: then it duplicates another of the thread's descriptors
+	// into place instead. A chdir to a host directory is made a chdir the
+	// kernel can make.
+	regs := th.regs
+	var err error
+	if src, ok := th.placeholderSource(); ok {
+		flags := 0
+		if th.reserve.cloexec {
+			flags = unix.O_CLOEXEC
+		}
+		err = rewriteSyscall(th.tid, &regs, th.arch, unix.SYS_DUP3, uint64(src), uint64(th.reserve.fd), uint64(flags))
+	} else if th.chdirTo != 0 {
+		err = rewriteSyscall(th.tid, &regs, th.arch, unix.SYS_CHDIR, uint64(th.chdirTo))
+	} else {
+		err = setSyscall(th.tid, &regs, ^uint64(0))
+	}
+	if err != nil {
+		th.t.log.Printf("setregs: %v", err)
+		return
+	}
+	th.emulated, th.ret = true, ret
+}
+
+// syscallExit runs at a syscall-exit stop and stores the result of an
+// emulated syscall. The registers saved at entry are restored wholesale, so
+// anything the kernel's skipped-syscall path clobbered is put back.
+func (th *thread) syscallExit() {
+	if th.sleep != nil {
+		th.endSleep()
+		return
+	}
+	if th.mapping != nil {
+		th.mappingExit()
+		return
+	}
+	if th.exec != nil {
+		th.execExit()
+		return
+	}
+	if th.redirect != nil {
+		th.redirectExit()
+		return
+	}
+	if th.passing != nil {
+		th.passthroughExit()
+		return
+	}
+	if !th.emulated {
+		if th.hooked != nil {
+			th.hookRealExit()
+		}
+		return
+	}
+	th.emulated = false
+	ret := th.ret
+	if th.job != nil {
+		ret = th.finishJob()
+	}
+	if th.chdirTo != 0 {
+		ret = th.chdirExit()
+	}
+	if th.hooked != nil {
+		ret, _ = th.hookExit(ret)
+	}
+	regs := th.regs
+	setReturn(&regs, uint64(ret))
+	if err := setRegs(th.tid, &regs); err != nil {
+		th.t.log.Printf("setregs: %v", err)
+	}
+}
+
+// hookRealExit runs the exit hooks for a syscall the kernel has handled.
+func (th *thread) hookRealExit() {
+	var regs unix.PtraceRegs
+	if err := getRegs(th.tid, &regs); err != nil {
+		th.t.log.Printf("getregs: %v", err)
+		th.hooked = nil
+		return
+	}
+	ret, ok := th.hookExit(int64(returnValue(&regs)))
+	if !ok {
+		return
+	}
+	setReturn(&regs, uint64(ret))
+	if err := setRegs(th.tid, &regs); err != nil {
+		th.t.log.Printf("setregs: %v", err)
+	}
+}
+
+// returnsFD reports whether c returns a new descriptor when it succeeds.
+func returnsFD(c sysCall) bool {
+	c, ok := native(c)
+	if !ok {
+		return false
+	}
+	nr := canonical(c).nr
+	return nr == unix.SYS_OPENAT || nr == unix.SYS_OPENAT2
+}
+
+// sysCall is a syscall as the tracee issued it. arch is the AUDIT_ARCH
+// value of the ABI it was made through, which determines how nr and args
+// are to be read.
+type sysCall struct {
+	arch uint32
+	nr   uint64
+	args [6]uint64
+}
+
+// callFromRegs reads a native syscall from r.
+func callFromRegs(r *unix.PtraceRegs) sysCall {
+	c := sysCall{arch: auditArch, nr: syscallNo(r)}
+	for i := range c.args {
+		c.args[i] = syscallArg(r, i)
+	}
+	return c
+}
+
+// setArgs loads syscall arguments into regs, as returned by argRegs,
+// zeroing those beyond args.
+func setArgs(regs []*uint64, args []uint64) {
+	for i, p := range regs {
+		*p = 0
+		if i < len(args) {
+			*p = args[i]
+		}
+	}
+}
+
+// enter dispatches a syscall entry. It reports the value to return and
+// whether the syscall was emulated.
+func (th *thread) enter(c sysCall) (int64, bool) {
+	x32 := c.arch == auditArch && c.nr&x32Bit != 0
+	c, ok := native(c)
+	if !ok {
+		return 0, false
+	}
+	legacy := c.nr
+	c = canonical(c)
+	th.arch, th.x32, th.reserve, th.mapping, th.redirect, th.passing, th.undo = c.arch, x32, nil, nil, nil, nil, nil
+	th.chdirTo = 0
+	th.t.metrics.syscall(c.nr)
+	th.t.decisions.enter(th.tid, th.pid, c)
+	th.t.op = spanOp{pid: th.pid, nr: c.nr}
+	if ret, denied := th.denyRule(c); denied {
+		th.audit(c, ret)
+		return ret, true
+	}
+	if c.nr == unix.SYS_OPENAT2 {
+		if c, ok = th.openHow(c); !ok {
+			return 0, false
+		}
+	}
+	if th.t.pinPaths {
+		if ret, denied := th.guardPins(c); denied {
+			th.audit(c, ret)
+			return ret, true
+		}
+	}
+	if th.t.pathRules != nil {
+		if ret, denied := th.denyPath(c); denied {
+			th.audit(c, ret)
+			return ret, true
+		}
+	}
+	if th.t.readOnly {
+		if ret, denied := th.denyWrite(c); denied {
+			th.audit(c, ret)
+			return ret, true
+		}
+	}
+	th.audit(c, 0)
+	if ret, failed := th.injectFault(c); failed {
+		return ret, true
+	}
+	arg := func(i int) uint64 { return c.args[i] }
+	switch c.nr {
+	case unix.SYS_EXECVE:
+		return th.sysExecveat(unix.AT_FDCWD, uintptr(arg(0)), uintptr(arg(1)), uintptr(arg(2)), 0)
+	case unix.SYS_EXECVEAT:
+		return th.sysExecveat(int(int32(arg(0))), uintptr(arg(1)), uintptr(arg(2)), uintptr(arg(3)), int(arg(4)))
+	case unix.SYS_OPENAT:
+		return th.sysOpenat(int(int32(arg(0))), uintptr(arg(1)), int(arg(2)), uint32(arg(3)))
+	case unix.SYS_IO_URING_SETUP, unix.SYS_IO_URING_ENTER, unix.SYS_IO_URING_REGISTER:
+		return th.sysIOURing(c.nr)
+	case unix.SYS_OPENAT2:
+		return th.sysOpenat2(int(int32(arg(0))), uintptr(arg(1)), arg(2), arg(3), arg(4))
+	case unix.SYS_READ:
+		return th.sysRead(int(int32(arg(0))), uintptr(arg(1)), int(arg(2)))
+	case unix.SYS_WRITE:
+		return th.sysWrite(int(int32(arg(0))), uintptr(arg(1)), int(arg(2)))
+	case unix.SYS_PREAD64:
+		return th.sysPread64(int(int32(arg(0))), uintptr(arg(1)), int(arg(2)), int64(arg(3)))
+	case unix.SYS_PWRITE64:
+		return th.sysPwrite64(int(int32(arg(0))), uintptr(arg(1)), int(arg(2)), int64(arg(3)))
+	case unix.SYS_READV:
+		return th.sysPreadv2(int(int32(arg(0))), uintptr(arg(1)), int(int32(arg(2))), -1, 0)
+	case unix.SYS_WRITEV:
+		return th.sysPwritev2(int(int32(arg(0))), uintptr(arg(1)), int(int32(arg(2))), -1, 0)
+	case unix.SYS_PREADV:
+		return th.sysPreadv(int(int32(arg(0))), uintptr(arg(1)), int(int32(arg(2))), int64(arg(3)))
+	case unix.SYS_PWRITEV:
+		return th.sysPwritev(int(int32(arg(0))), uintptr(arg(1)), int(int32(arg(2))), int64(arg(3)))
+	case unix.SYS_PREADV2:
+		return th.sysPreadv2(int(int32(arg(0))), uintptr(arg(1)), int(int32(arg(2))), int64(arg(3)), int(int32(arg(5))))
+	case unix.SYS_PWRITEV2:
+		return th.sysPwritev2(int(int32(arg(0))), uintptr(arg(1)), int(int32(arg(2))), int64(arg(3)), int(int32(arg(5))))
+	case sysPoll:
+		return th.sysPoll(uintptr(arg(0)), int(arg(1)), int(int32(arg(2))))
+	case unix.SYS_PPOLL:
+		return th.sysPpoll(uintptr(arg(0)), int(arg(1)), uintptr(arg(2)), -1)
+	case sysSelect:
+		return th.sysSelect(int(int32(arg(0))), [3]uintptr{uintptr(arg(1)), uintptr(arg(2)), uintptr(arg(3))}, uintptr(arg(4)))
+	case unix.SYS_PSELECT6:
+		return th.sysPselect6(int(int32(arg(0))), [3]uintptr{uintptr(arg(1)), uintptr(arg(2)), uintptr(arg(3))}, uintptr(arg(4)))
+	case unix.SYS_EPOLL_CTL:
+		return th.sysEpollCtl(int(int32(arg(0))), int(int32(arg(1))), int(int32(arg(2))), uintptr(arg(3)))
+	case unix.SYS_SENDFILE:
+		return th.sysSendfile(int(int32(arg(0))), int(int32(arg(1))), uintptr(arg(2)), int(arg(3)))
+	case unix.SYS_SPLICE:
+		return th.sysSplice(int(int32(arg(0))), uintptr(arg(1)), int(int32(arg(2))), uintptr(arg(3)), int(arg(4)), int(arg(5)))
+	case unix.SYS_COPY_FILE_RANGE:
+		return th.sysCopyFileRange(int(int32(arg(0))), uintptr(arg(1)), int(int32(arg(2))), uintptr(arg(3)), int(arg(4)), uint(arg(5)))
+	case unix.SYS_MMAP:
+		return th.sysMmap(int(int32(arg(2))), int(int32(arg(3))), int(int32(arg(4))))
+	case unix.SYS_LSEEK:
+		return th.sysLseek(int(int32(arg(0))), int64(arg(1)), int(int32(arg(2))))
+	case sysLlseek:
+		return th.sysLlseek(int(int32(arg(0))), int64(arg(1)<<32|arg(2)), uintptr(arg(3)), int(int32(arg(4))))
+	case unix.SYS_CLOSE:
+		return th.sysClose(int(int32(arg(0))))
+	case unix.SYS_FSYNC, unix.SYS_FDATASYNC:
+		return th.sysFsync(int(int32(arg(0))))
+	case unix.SYS_INOTIFY_ADD_WATCH:
+		return th.sysInotifyAddWatch(int(int32(arg(0))), uintptr(arg(1)), uint32(arg(2)))
+	case unix.SYS_DUP:
+		return th.sysFcntl(int(int32(arg(0))), unix.F_DUPFD, 0)
+	case sysDup2:
+		return th.sysDup2(int(int32(arg(0))), int(int32(arg(1))))
+	case unix.SYS_DUP3:
+		return th.sysDup3(int(int32(arg(0))), int(int32(arg(1))), int(arg(2)))
+	case unix.SYS_FCNTL:
+		return th.sysFcntl(int(int32(arg(0))), int(int32(arg(1))), arg(2))
+	case unix.SYS_FLOCK:
+		return th.sysFlock(int(int32(arg(0))), int(int32(arg(1))))
+	case unix.SYS_FSTAT:
+		return th.sysFstat(int(int32(arg(0))), uintptr(arg(1)))
+	case unix.SYS_GETDENTS64:
+		return th.sysGetdents64(int(int32(arg(0))), uintptr(arg(1)), int(uint32(arg(2))))
+	case sysFstatat:
+		return th.sysNewfstatat(int(int32(arg(0))), uintptr(arg(1)), uintptr(arg(2)), int(arg(3)))
+	case unix.SYS_STATX:
+		return th.sysStatx(int(int32(arg(0))), uintptr(arg(1)), int(arg(2)), uintptr(arg(4)))
+	case unix.SYS_MKDIRAT:
+		return th.sysMkdirat(int(int32(arg(0))), uintptr(arg(1)), uint32(arg(2)))
+	case unix.SYS_UNLINKAT:
+		return th.sysUnlinkat(int(int32(arg(0))), uintptr(arg(1)), int(int32(arg(2))))
+	case unix.SYS_RENAMEAT:
+		return th.sysRenameat2(int(int32(arg(0))), uintptr(arg(1)), int(int32(arg(2))), uintptr(arg(3)), 0)
+	case unix.SYS_RENAMEAT2:
+		return th.sysRenameat2(int(int32(arg(0))), uintptr(arg(1)), int(int32(arg(2))), uintptr(arg(3)), uint(uint32(arg(4))))
+	case unix.SYS_LINKAT:
+		return th.sysLinkat(int(int32(arg(0))), uintptr(arg(1)), int(int32(arg(2))), uintptr(arg(3)), int(int32(arg(4))))
+	case unix.SYS_SYMLINKAT:
+		return th.sysSymlinkat(uintptr(arg(0)), int(int32(arg(1))), uintptr(arg(2)))
+	case unix.SYS_READLINKAT:
+		return th.sysReadlinkat(int(int32(arg(0))), uintptr(arg(1)), uintptr(arg(2)), int(int32(arg(3))))
+	case unix.SYS_TRUNCATE:
+		return th.sysTruncate(uintptr(arg(0)), int64(arg(1)))
+	case unix.SYS_FTRUNCATE:
+		return th.sysFtruncate(int(int32(arg(0))), int64(arg(1)))
+	case unix.SYS_FALLOCATE:
+		return th.sysFallocate(int(int32(arg(0))), int(int32(arg(1))), int64(arg(2)), int64(arg(3)))
+	case unix.SYS_GETXATTR, unix.SYS_LGETXATTR:
+		return th.sysGetxattr(-1, uintptr(arg(0)), c.nr == unix.SYS_GETXATTR, uintptr(arg(1)), uintptr(arg(2)), arg(3))
+	case unix.SYS_FGETXATTR:
+		return th.sysGetxattr(int(int32(arg(0))), 0, true, uintptr(arg(1)), uintptr(arg(2)), arg(3))
+	case unix.SYS_SETXATTR, unix.SYS_LSETXATTR:
+		return th.sysSetxattr(-1, uintptr(arg(0)), c.nr == unix.SYS_SETXATTR, uintptr(arg(1)), uintptr(arg(2)), arg(3), int(int32(arg(4))))
+	case unix.SYS_FSETXATTR:
+		return th.sysSetxattr(int(int32(arg(0))), 0, true, uintptr(arg(1)), uintptr(arg(2)), arg(3), int(int32(arg(4))))
+	case unix.SYS_LISTXATTR, unix.SYS_LLISTXATTR:
+		return th.sysListxattr(-1, uintptr(arg(0)), c.nr == unix.SYS_LISTXATTR, uintptr(arg(1)), arg(2))
+	case unix.SYS_FLISTXATTR:
+		return th.sysListxattr(int(int32(arg(0))), 0, true, uintptr(arg(1)), arg(2))
+	case unix.SYS_REMOVEXATTR, unix.SYS_LREMOVEXATTR:
+		return th.sysRemovexattr(-1, uintptr(arg(0)), c.nr == unix.SYS_REMOVEXATTR, uintptr(arg(1)))
+	case unix.SYS_FREMOVEXATTR:
+		return th.sysRemovexattr(int(int32(arg(0))), 0, true, uintptr(arg(1)))
+	case unix.SYS_STATFS:
+		return th.sysStatfs(uintptr(arg(0)), uintptr(arg(1)))
+	case unix.SYS_FSTATFS:
+		return th.sysFstatfs(int(int32(arg(0))), uintptr(arg(1)))
+	case sysAccess:
+		return th.sysFaccessat2(unix.AT_FDCWD, uintptr(arg(0)), uint32(arg(1)), 0)
+	case unix.SYS_FACCESSAT:
+		return th.sysFaccessat2(int(int32(arg(0))), uintptr(arg(1)), uint32(arg(2)), 0)
+	case unix.SYS_FACCESSAT2:
+		return th.sysFaccessat2(int(int32(arg(0))), uintptr(arg(1)), uint32(arg(2)), int(int32(arg(3))))
+	case unix.SYS_UTIMENSAT:
+		return th.sysUtimensat(int(int32(arg(0))), uintptr(arg(1)), uintptr(arg(2)), int(int32(arg(3))), utimesLayout(c.arch, legacy))
+	case unix.SYS_FCHMOD:
+		return th.sysFchmodat(int(int32(arg(0))), 0, uint32(arg(1)), 0)
+	case unix.SYS_FCHMODAT:
+		return th.sysFchmodat(int(int32(arg(0))), uintptr(arg(1)), uint32(arg(2)), 0)
+	case unix.SYS_FCHMODAT2:
+		return th.sysFchmodat(int(int32(arg(0))), uintptr(arg(1)), uint32(arg(2)), int(int32(arg(3))))
+	case unix.SYS_FCHOWN:
+		return th.sysFchownat(int(int32(arg(0))), 0, uint32(arg(1)), uint32(arg(2)), 0)
+	case unix.SYS_FCHOWNAT:
+		return th.sysFchownat(int(int32(arg(0))), uintptr(arg(1)), uint32(arg(2)), uint32(arg(3)), int(int32(arg(4))))
+	case unix.SYS_CHDIR:
+		return th.sysChdir(uintptr(arg(0)))
+	case unix.SYS_FCHDIR:
+		return th.sysFchdir(int(int32(arg(0))))
+	case unix.SYS_GETCWD:
+		return th.sysGetcwd(uintptr(arg(0)), arg(1))
+	case unix.SYS_IOCTL:
+		return th.sysIoctl(int(int32(arg(0))), uint(uint32(arg(1))), arg(2))
+	case unix.SYS_MKNODAT:
+		return th.sysMknodat(int(int32(arg(0))), uintptr(arg(1)), uint32(arg(2)), arg(3))
+	case unix.SYS_CAPGET, unix.SYS_CAPSET,
+		unix.SYS_GETUID, unix.SYS_GETEUID, unix.SYS_GETGID, unix.SYS_GETEGID,
+		unix.SYS_GETRESUID, unix.SYS_GETRESGID,
+		unix.SYS_SETUID, unix.SYS_SETGID, unix.SYS_SETREUID, unix.SYS_SETREGID,
+		unix.SYS_SETRESUID, unix.SYS_SETRESGID, unix.SYS_SETFSUID, unix.SYS_SETFSGID,
+		unix.SYS_SETGROUPS:
+		return th.fakeRootCall(c)
+	case unix.SYS_CHROOT:
+		return th.sysChroot(uintptr(arg(0)))
+	case unix.SYS_PIVOT_ROOT:
+		return th.sysPivotRoot(uintptr(arg(0)), uintptr(arg(1)))
+	case unix.SYS_UMOUNT2:
+		return th.sysUmount2(uintptr(arg(0)))
+	case unix.SYS_GETRANDOM:
+		return th.sysGetrandom(uintptr(arg(0)), arg(1), int(uint32(arg(2))))
+	case unix.SYS_CONNECT, unix.SYS_BIND:
+		return th.redirectAddr(c.nr, c.args, 1)
+	case unix.SYS_SENDTO:
+		return th.redirectAddr(c.nr, c.args, 4)
+	case unix.SYS_SENDMSG:
+		return th.sysSendmsg(c.nr, uintptr(arg(1)), 1)
+	case unix.SYS_SENDMMSG:
+		return th.sysSendmsg(c.nr, uintptr(arg(1)), int(uint32(arg(2))))
+	case unix.SYS_CLOCK_GETTIME:
+		return th.sysClockGettime(int32(arg(0)), uintptr(arg(1)))
+	case unix.SYS_GETTIMEOFDAY:
+		return th.sysGettimeofday(uintptr(arg(0)), uintptr(arg(1)))
+	case sysTime:
+		return th.sysTime(uintptr(arg(0)))
+	case unix.SYS_NANOSLEEP:
+		return th.sysClockNanosleep(unix.CLOCK_MONOTONIC, 0, uintptr(arg(0)))
+	case unix.SYS_CLOCK_NANOSLEEP:
+		return th.sysClockNanosleep(int32(arg(0)), int(arg(1)), uintptr(arg(2)))
+	}
+	return 0, false
+}
+
+func errnoRet(err error) int64 { return -int64(errnoFor(err)) }
+
+func (th *thread) sysOpenat(dirfd int, pathAddr uintptr, flags int, mode uint32) (int64, bool) {
+	p, err := th.mem.readString(pathAddr)
+	if err != nil {
+		// Let the kernel report EFAULT or ENAMETOOLONG itself.
+		return 0, false
+	}
+	abs, through, err := th.resolveArg(dirfd, p)
+	if err != nil {
+		return resolveFailed(err)
+	}
+	if ret, ok := th.openRandom(abs, flags, mode); ok {
+		return ret, true
+	}
+	m, name, ok := th.lookupArg(abs, through)
+	if !ok || m == &th.t.host {
+		if ret, ok := th.openProc(abs, flags, mode); ok {
+			return ret, true
+		}
+	}
+	if !ok {
+		th.t.log.Printf("openat: %s", abs)
+		return 0, false
+	}
+	th.t.log.Printf("openat: %s (virtual)", abs)
+	if openFollows(flags) {
+		if abs, m, name, err = th.follow(abs); err != nil {
+			return errnoRet(err), true
+		}
+		if m == &th.t.host {
+			if ret, ok := th.openProc(abs, flags, mode); ok {
+				return ret, true
+			}
+		}
+	}
+	if th.passThrough(m, name, abs, flags, mode) {
+		return 0, false
+	}
+	if th.t.leases != nil {
+		return th.openLeased(m, name, abs, flags, mode)
+	}
+	return th.openVirtual(m, name, abs, flags, mode), true
+}
+
+// openFollows reports whether an open with flags follows a final symlink.
+// One that must create the file it names does not.
+func openFollows(flags int) bool {
+	return flags&unix.O_NOFOLLOW == 0 && flags&(unix.O_CREAT|unix.O_EXCL) != unix.O_CREAT|unix.O_EXCL
+}
+
+// openVirtual opens name in m, whose absolute path is abs, as a new
+// virtual descriptor, and returns the descriptor or a negated errno.
+func (th *thread) openVirtual(m *mount, name, abs string, flags int, mode uint32) int64 {
+	if flags&unix.O_TMPFILE == unix.O_TMPFILE {
+		return th.openTmpfile(m, name, abs, flags, mode)
+	}
+	if th.fdsFull() {
+		return -int64(unix.EMFILE)
+	}
+	f, err := th.openBackend(m, name, flags, mode)
+	if err != nil {
+		return errnoRet(err)
+	}
+	return th.addVirtual(m, name, abs, f, flags)
+}
+
+// openBackend opens name in the backend of m with the flags and mode of an
+// open.
+func (th *thread) openBackend(m *mount, name string, flags int, mode uint32) (vfs.File, error) {
+	perm := fs.FileMode(mode &^ th.umask() & 0o777)
+	f, err := m.backend.Open(name, flags&^unix.O_CLOEXEC, perm)
+	if err == nil && flags&unix.O_TRUNC != 0 {
+		th.t.passthrough.drop(m, name)
+	}
+	return f, err
+}
+
+// addVirtual adds f, opened as name in m with flags, as a new virtual
+// descriptor for abs, and returns the descriptor.
+func (th *thread) addVirtual(m *mount, name, abs string, f vfs.File, flags int) int64 {
+	cloexec := flags&unix.O_CLOEXEC != 0
+	flags &^= unix.O_CLOEXEC
+	vf := &vfile{file: f, path: abs, flags: flags, mount: m, name: name}
+	t, pid := th.t, th.pid
+	vf.closed = func() { t.emit(&FileClosed{Pid: pid, Path: abs}) }
+	fd := th.fds.add(vf, fdBase, cloexec)
+	th.t.emit(&FileOpened{Pid: th.pid, FD: fd, Path: abs, Flags: flags})
+	return int64(fd)
+}
+
+func (th *thread) sysRead(fd int, buf uintptr, count int) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	th.t.log.Printf("read: fd=%d (virtual)", fd)
+	return th.readInto(f, buf, count, -1)
+}
+
+// readInto reads up to count bytes from f into the tracee's memory at buf,
+// starting at off or, if off is -1, at the file offset.
+func (th *thread) readInto(f *vfile, buf uintptr, count int, off int64) (int64, bool) {
+	b := make([]byte, min(count, maxBufferSize))
+	read := func() (int, error) { return f.read(b, off) }
+	done := func(n int, err error) int64 {
+		if n == 0 && err != nil && err != io.EOF {
+			return errnoRet(err)
+		}
+		if err := th.mem.writeBytes(buf, b[:n]); err != nil {
+			return -int64(unix.EFAULT)
+		}
+		return int64(n)
+	}
+	if th.offload(f, read, done) {
+		return 0, true
+	}
+	return done(read()), true
+}
+
+func (th *thread) sysWrite(fd int, buf uintptr, count int) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	th.t.log.Printf("write: fd=%d (virtual)", fd)
+	ret, ok := th.writeFrom(f, buf, count, -1)
+	th.wrote(fd, f, ret)
+	return ret, ok
+}
+
+// writeFrom writes up to count bytes from the tracee's memory at buf to f,
+// like readInto.
+func (th *thread) writeFrom(f *vfile, buf uintptr, count int, off int64) (int64, bool) {
+	var write func() (int, error)
+	if chunk := th.t.streamChunk; chunk > 0 && count > chunk {
+		write = func() (int, error) { return th.streamWrite(f, buf, count, off) }
+	} else {
+		b, err := th.mem.readBytes(buf, min(count, maxBufferSize))
+		if err != nil {
+			return -int64(unix.EFAULT), true
+		}
+		write = func() (int, error) { return f.write(b, off) }
+	}
+	done := func(n int, err error) int64 {
+		if n > 0 {
+			th.t.passthrough.drop(f.mount, f.name)
+		}
+		if n == 0 && err != nil {
+			return errnoRet(err)
+		}
+		return int64(n)
+	}
+	if th.offload(f, write, done) {
+		return 0, true
+	}
+	return done(write()), true
+}
+
+func (th *thread) sysPread64(fd int, buf uintptr, count int, off int64) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	th.t.log.Printf("pread64: fd=%d off=%d (virtual)", fd, off)
+	if off < 0 {
+		return -int64(unix.EINVAL), true
+	}
+	return th.readInto(f, buf, count, off)
+}
+
+func (th *thread) sysPwrite64(fd int, buf uintptr, count int, off int64) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	th.t.log.Printf("pwrite64: fd=%d off=%d (virtual)", fd, off)
+	if off < 0 {
+		return -int64(unix.EINVAL), true
+	}
+	ret, ok := th.writeFrom(f, buf, count, off)
+	th.wrote(fd, f, ret)
+	return ret, ok
+}
+
+// wrote reports a write to the virtual descriptor fd that returned ret.
+func (th *thread) wrote(fd int, f *vfile, ret int64) {
+	if j := th.job; j != nil {
+		// The write is reported once a worker has done it.
+		then := j.then
+		j.then = func(n int, err error) int64 {
+			ret := then(n, err)
+			th.wrote(fd, f, ret)
+			return ret
+		}
+		return
+	}
+	if ret > 0 {
+		th.t.emit(&FileWritten{Pid: th.pid, FD: fd, Path: f.path, N: int(ret)})
+	}
+}
+
+func (th *thread) sysLseek(fd int, off int64, whence int) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	pos, err := th.seek(fd, f, off, whence)
+	if err != nil {
+		return errnoRet(err), true
+	}
+	if th.arch == compatArch && pos > math.MaxInt32 {
+		// The i386 lseek returns a 32-bit off_t; _llseek has no limit.
+		return -int64(unix.EOVERFLOW), true
+	}
+	return pos, true
+}
+
+// sysLlseek is the i386 _llseek, which stores the new offset at result.
+func (th *thread) sysLlseek(fd int, off int64, result uintptr, whence int) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	pos, err := th.seek(fd, f, off, whence)
+	if err != nil {
+		return errnoRet(err), true
+	}
+	if err := th.mem.writeBytes(result, binary.LittleEndian.AppendUint64(nil, uint64(pos))); err != nil {
+		return -int64(unix.EFAULT), true
+	}
+	return 0, true
+}
+
+// seek moves the offset of f, which is shared by every descriptor that
+// refers to it. A directory's offset is its position in the listing, as
+// reported in d_off, and seeking back to the start takes a fresh listing.
+func (th *thread) seek(fd int, f *vfile, off int64, whence int) (int64, error) {
+	th.t.log.Printf("lseek: fd=%d off=%d whence=%d (virtual)", fd, off, whence)
+	fi, err := f.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !fi.IsDir() {
+		return f.file.Seek(off, whence)
+	}
+	var pos int64
+	if f.dir != nil {
+		pos = int64(f.dir.pos)
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		off += pos
+	default:
+		return 0, unix.EINVAL
+	}
+	switch {
+	case off < 0:
+		return 0, unix.EINVAL
+	case off == 0:
+		f.dir = nil
+		return 0, nil
+	}
+	d, err := th.t.dirList(f)
+	if err != nil {
+		return 0, err
+	}
+	d.pos = int(min(off, int64(len(d.entries))))
+	return off, nil
+}
+
+func (th *thread) sysClose(fd int) (int64, bool) {
+	f, ok := th.fds.remove(fd)
+	if !ok {
+		th.closeLease(fd)
+		return 0, false
+	}
+	th.t.log.Printf("close: fd=%d (virtual)", fd)
+	err := f.decref()
+	if fd < fdBase {
+		// Let the kernel close the placeholder too.
+		return 0, false
+	}
+	if err != nil {
+		return errnoRet(err), true
+	}
+	return 0, true
+}
+
+func (th *thread) sysFstat(fd int, statbuf uintptr) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	fi, err := f.file.Stat()
+	if err != nil {
+		return errnoRet(err), true
+	}
+	st := f.mount.stat(f.path, fi)
+	th.t.fakeStat(f.mount, f.name, &st)
+	if err := th.mem.writeBytes(statbuf, encodeStat(th.arch, &st)); err != nil {
+		return -int64(unix.EFAULT), true
+	}
+	return 0, true
+}
+
+// sysNewfstatat also handles stat and lstat, which canonical turns into
+// fstatat calls.
+func (th *thread) sysNewfstatat(dirfd int, pathAddr, statbuf uintptr, flags int) (int64, bool) {
+	st, err, ok := th.statat(dirfd, pathAddr, flags)
+	if !ok {
+		return 0, false
+	}
+	if err != nil {
+		return errnoRet(err), true
+	}
+	if err := th.mem.writeBytes(statbuf, encodeStat(th.arch, &st)); err != nil {
+		return -int64(unix.EFAULT), true
+	}
+	return 0, true
+}
+
+func (th *thread) sysStatx(dirfd int, pathAddr uintptr, flags int, buf uintptr) (int64, bool) {
+	st, err, ok := th.statat(dirfd, pathAddr, flags)
+	if !ok {
+		return 0, false
+	}
+	if err != nil {
+		return errnoRet(err), true
+	}
+	stx := statxFromStat(&st)
+	if err := th.mem.writeBytes(buf, statxBytes(&stx)); err != nil {
+		return -int64(unix.EFAULT), true
+	}
+	return 0, true
+}
+
+// statat stats the virtual file named by a dirfd, path and AT_* flags, as
+// taken by fstatat and statx. It reports false if the file is not virtual.
+func (th *thread) statat(dirfd int, pathAddr uintptr, flags int) (unix.Stat_t, error, bool) {
+	var p string
+	if pathAddr != 0 || flags&unix.AT_EMPTY_PATH == 0 {
+		var err error
+		if p, err = th.mem.readString(pathAddr); err != nil {
+			return unix.Stat_t{}, nil, false
+		}
+	}
+	if p == "" && flags&unix.AT_EMPTY_PATH != 0 {
+		f, ok := th.fds.get(dirfd)
+		if !ok {
+			return unix.Stat_t{}, nil, false
+		}
+		fi, err := f.file.Stat()
+		if err != nil {
+			return unix.Stat_t{}, err, true
+		}
+		st := f.mount.stat(f.path, fi)
+		th.t.fakeStat(f.mount, f.name, &st)
+		return st, nil, true
+	}
+	abs, through, err := th.resolveArg(dirfd, p)
+	if err != nil {
+		if e, ok := err.(*walkError); ok {
+			return unix.Stat_t{}, e.errno, true
+		}
+		return unix.Stat_t{}, nil, false
+	}
+	m, name, ok := th.lookupArg(abs, through)
+	if !ok {
+		return th.statProc(abs, flags)
+	}
+	th.t.log.Printf("stat: %s (virtual)", abs)
+	stat := m.backend.Lstat
+	if flags&unix.AT_SYMLINK_NOFOLLOW == 0 {
+		if abs, m, name, err = th.follow(abs); err != nil {
+			return unix.Stat_t{}, err, true
+		}
+		stat = m.backend.Stat
+	}
+	fi, err := stat(name)
+	if err != nil {
+		return unix.Stat_t{}, err, true
+	}
+	st := m.stat(abs, fi)
+	th.t.fakeStat(m, name, &st)
+	return st, nil, true
+}
@@ -0,0 +1,132 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// sysFstatat is fstatat, which amd64 calls newfstatat.
+const sysFstatat = unix.SYS_NEWFSTATAT
+
+// utimesLayout returns how the syscall nr, made through the ABI arch,
+// lays out the times it sets, nr being the number native gives it before
+// canonical turns it into utimensat.
+func utimesLayout(arch uint32, nr uint64) timesLayout {
+	l := timespecLayout
+	if arch == compatArch {
+		l.word = 4
+	}
+	switch nr {
+	case unix.SYS_UTIME:
+		l.frac = 0
+	case unix.SYS_UTIMES, unix.SYS_FUTIMESAT:
+		l.frac = time.Microsecond
+	}
+	return l
+}
+
+// compatArch is the AUDIT_ARCH value of the i386 ABI, which a process
+// reaches by running 32-bit code or executing int 0x80.
+const compatArch = unix.AUDIT_ARCH_I386
+
+// native translates c into the native syscall table. It reports false if
+// the ABI or the syscall is not one the tracer understands.
+func native(c sysCall) (sysCall, bool) {
+	switch c.arch {
+	case auditArch:
+		if c.nr&x32Bit != 0 {
+			// x32 reuses the native numbers below 512, with native
+			// struct layouts, for every syscall the tracer handles
+			// but those of x32Syscalls.
+			c.nr &^= x32Bit
+			if nr, ok := x32Syscalls[c.nr]; ok {
+				c.nr = nr
+			}
+			return c, c.nr < 512
+		}
+		return c, true
+	case compatArch:
+		nr, ok := compatSyscalls[c.nr]
+		if !ok {
+			return c, false
+		}
+		for i := range c.args {
+			c.args[i] = uint64(uint32(c.args[i]))
+		}
+		compatArgs(c.nr, &c.args)
+		c.nr = nr
+		return c, true
+	}
+	return c, false
+}
+
+// x32Syscalls are the numbers x32 gives the syscalls the tracer handles
+// that take the i386 ABI's structs, and the native numbers they have.
+var x32Syscalls = map[uint64]uint64{
+	518: unix.SYS_SENDMSG,
+	538: unix.SYS_SENDMMSG,
+}
+
+// compatID widens the 16-bit user or group ID v, which leaves the owner
+// or group unchanged at -1, as the 32-bit -1 does.
+func compatID(v uint64) uint64 {
+	if v == 0xffff {
+		return 0xffffffff
+	}
+	return v
+}
+
+// encodeStat lays out st the way the ABI of a syscall expects it.
+func encodeStat(arch uint32, st *unix.Stat_t) []byte {
+	if arch == compatArch {
+		return compatStat(st)
+	}
+	return statBytes(st)
+}
+
+// compatStat encodes st as the i386 struct stat64.
+func compatStat(st *unix.Stat_t) []byte {
+	b := make([]byte, 96)
+	le := binary.LittleEndian
+	le.PutUint64(b[0:], st.Dev)
+	le.PutUint32(b[12:], uint32(st.Ino))
+	le.PutUint32(b[16:], st.Mode)
+	le.PutUint32(b[20:], uint32(st.Nlink))
+	le.PutUint32(b[24:], st.Uid)
+	le.PutUint32(b[28:], st.Gid)
+	le.PutUint64(b[32:], st.Rdev)
+	le.PutUint64(b[44:], uint64(st.Size))
+	le.PutUint32(b[52:], uint32(st.Blksize))
+	le.PutUint64(b[56:], uint64(st.Blocks))
+	for i, ts := range []unix.Timespec{st.Atim, st.Mtim, st.Ctim} {
+		le.PutUint32(b[64+8*i:], uint32(ts.Sec))
+		le.PutUint32(b[68+8*i:], uint32(ts.Nsec))
+	}
+	le.PutUint64(b[88:], st.Ino)
+	return b
+}
+
+// encodeStatfs lays out st the way the ABI of a statfs call expects it,
+// failing with EOVERFLOW, as the kernel does, if the counts do not fit in
+// the 32-bit fields of the i386 struct statfs.
+func encodeStatfs(arch uint32, st *unix.Statfs_t) ([]byte, unix.Errno) {
+	if arch != compatArch {
+		return statfsBytes(st), 0
+	}
+	if (st.Blocks|st.Bfree|st.Bavail|st.Files|st.Ffree)>>32 != 0 {
+		return nil, unix.EOVERFLOW
+	}
+	b := make([]byte, 64)
+	le := binary.LittleEndian
+	for i, v := range []uint64{uint64(st.Type), uint64(st.Bsize), st.Blocks, st.Bfree, st.Bavail, st.Files, st.Ffree} {
+		le.PutUint32(b[4*i:], uint32(v))
+	}
+	le.PutUint32(b[28:], uint32(st.Fsid.Val[0]))
+	le.PutUint32(b[32:], uint32(st.Fsid.Val[1]))
+	le.PutUint32(b[36:], uint32(st.Namelen))
+	le.PutUint32(b[40:], uint32(st.Frsize))
+	le.PutUint32(b[44:], uint32(st.Flags))
+	return b, 0
+}
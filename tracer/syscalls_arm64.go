@@ -0,0 +1,17 @@
+package tracer
+
+import "golang.org/x/sys/unix"
+
+const sysFstatat = unix.SYS_FSTATAT
+
+func utimesLayout(arch uint32, nr uint64) timesLayout { return timespecLayout }
+
+// The tracer does not translate the aarch32 ABI. Its syscalls are trapped
+// by the seccomp filter but never emulated.
+const compatArch = 0
+
+func native(c sysCall) (sysCall, bool) { return c, c.arch == auditArch }
+
+func encodeStat(arch uint32, st *unix.Stat_t) []byte { return statBytes(st) }
+
+func encodeStatfs(arch uint32, st *unix.Statfs_t) ([]byte, unix.Errno) { return statfsBytes(st), 0 }
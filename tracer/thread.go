@@ -0,0 +1,141 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// thread is the tracer's bookkeeping for one traced task. Syscall-stop
+// state is per thread, since every thread of a tracee can be stopped in a
+// different syscall at once; resources such as the descriptor table are
+// shared according to the clone flags that created the thread.
+type thread struct {
+	t   *Tracer
+	tid int
+	// pid is the thread's process, its thread group leader.
+	pid       int
+	mem       memory
+	fds       *fdTable
+	cwd       *workDir
+	inSyscall bool
+	// regs holds the registers as they were at the most recent syscall
+	// entry. The exit stop reports results against these rather than
+	// whatever the kernel left behind after a skipped syscall.
+	regs unix.PtraceRegs
+	// arch is the ABI of the syscall being handled, and x32 is set if it
+	// was made through amd64's x32 ABI, which shares its arch.
+	arch uint32
+	x32  bool
+	// emulated is set between the entry and exit stops of a syscall the
+	// tracer is handling itself; ret is the value to return from it.
+	emulated bool
+	ret      int64
+	// reserve is set by an emulated syscall that needs a placeholder.
+	reserve *reservation
+	// mapping is set while a mmap of a virtual file is being served, exec
+	// while an exec is being rewritten, and redirect while a socket call
+	// is being redirected.
+	mapping  *mapping
+	exec     *execution
+	redirect *redirection
+	// passing is set by an open served from a memfd.
+	passing *passOpen
+	// chdirTo is set by a chdir or fchdir to a host directory, to the
+	// address of a copy of its path that the kernel changes to instead.
+	chdirTo uintptr
+	// undo is set by an emulated syscall whose effect must be reverted
+	// if its notification turns out no longer to be awaited: a signal
+	// restarts the syscall, which would otherwise take effect twice.
+	undo func()
+	// hooked is the syscall exit hooks are waiting for, between its entry
+	// and exit stops, which began at hookedAt.
+	hooked   *sysCall
+	hookedAt time.Time
+	// scratch is the process's scratch memory, if it has any, and pinned
+	// the copies in it of the paths of the syscall being made.
+	scratch *scratch
+	pinned  []uintptr
+	// scratching is set while a SIGSTOP sent by rescratch is pending.
+	scratching bool
+	// sleep is set while a delayed syscall is held in a nanosleep, and
+	// slept once it has been, so that the syscall then runs undelayed.
+	sleep *sleep
+	slept bool
+	// nap is the sleep on the virtual clock the thread is in, if any.
+	nap *clockSleep
+	// lockWait is set while the thread waits for an advisory lock.
+	lockWait *lockWaiter
+	// job is the read or write a worker does for the syscall the thread
+	// is in, if any; parked is set once the thread waits for it in a
+	// ppoll, until the SIGSTOP that wakes it has arrived.
+	job    *job
+	parked bool
+}
+
+// cloneFlags returns the clone flags of the fork, vfork or clone the
+// thread is stopped in at a ptrace event, which decide what the new task
+// shares with it. The registers are read afresh, since a clone the seccomp
+// filter does not trap has no entry stop to save them, and clone3 keeps its
+// flags in the struct clone_args it is passed. A plain fork or vfork, or a
+// clone whose flags cannot be read, is taken to have the flags the event
+// implies: none for a fork, and those of a thread for a clone, which is
+// what clone events almost always are.
+func (th *thread) cloneFlags(event int) uint64 {
+	var flags uint64
+	switch event {
+	case unix.PTRACE_EVENT_VFORK:
+		flags = unix.CLONE_VM | unix.CLONE_VFORK
+	case unix.PTRACE_EVENT_CLONE:
+		flags = unix.CLONE_VM | unix.CLONE_FS | unix.CLONE_FILES | unix.CLONE_SIGHAND | unix.CLONE_THREAD
+	}
+	var regs unix.PtraceRegs
+	if err := getRegs(th.tid, &regs); err != nil {
+		return flags
+	}
+	c := sysCall{arch: auditArch, nr: syscallNo(&regs)}
+	if isCompat(&regs) {
+		c.arch = compatArch
+	}
+	for i, r := range argRegs(&regs, c.arch == compatArch) {
+		c.args[i] = *r
+	}
+	c, ok := native(c)
+	if !ok {
+		return flags
+	}
+	switch c.nr {
+	case unix.SYS_CLONE:
+		// The low byte is the exit signal.
+		return c.args[0] &^ 0xff
+	case unix.SYS_CLONE3:
+		if c.args[1] < 8 {
+			return flags
+		}
+		b, err := th.mem.readBytes(uintptr(c.args[0]), 8)
+		if err != nil {
+			return flags
+		}
+		return binary.LittleEndian.Uint64(b)
+	}
+	return flags
+}
+
+// restarting reports whether the thread is running syscalls the tracer
+// restarted it with, for a mapping, an execution or a redirection.
+func (th *thread) restarting() bool {
+	return th.mapping != nil || th.exec != nil || th.redirect != nil
+}
+
+// exit releases everything the thread held once it has terminated.
+func (th *thread) exit() {
+	th.t.log.Printf("tid %d exited", th.tid)
+	th.traceUnfinished()
+	th.dropExec()
+	th.unpin()
+	th.unblock()
+	th.fds.release()
+	th.t.decisions.exited(th.tid, th.pid)
+	th.t.collectLeases()
+}
@@ -0,0 +1,158 @@
+package tracer
+
+import (
+	"math"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Rate bounds the IO the command may do on a mount, as given to Throttle.
+// A zero limit is no limit.
+type Rate struct {
+	// BytesPerSec bounds the bytes read from and written to the mount's
+	// files each second, and OpsPerSec the syscalls on its files and
+	// paths.
+	BytesPerSec, OpsPerSec float64
+	// BytesBurst and OpsBurst are how much may be done at once after a
+	// quiet while, before the rate holds syscalls up. The default is a
+	// second's worth.
+	BytesBurst, OpsBurst float64
+}
+
+// Throttle limits the IO the command does on the mount to r, so that a
+// noisy job cannot saturate the remote backend, or the local disk behind
+// an overlay, that jobs share. Each limit is a token bucket: a syscall on
+// the mount's files takes an op, and a read or write the bytes it asks to
+// move, and one that finds the bucket empty is held, as a Delay holds it,
+// until it would have filled. Only the thread making it waits.
+//
+// A syscall is charged as it starts, so one that moves less than it asked,
+// as a read at the end of a file does, is charged what it asked for; one
+// that asks more than a burst is let through once it is paid for, rather
+// than never. A syscall a Delay matches as well is held for the longer of
+// the two.
+func Throttle(r Rate) MountOption {
+	return func(m *mount) {
+		m.throttle = &throttle{
+			bytes: newBucket(r.BytesPerSec, r.BytesBurst),
+			ops:   newBucket(r.OpsPerSec, r.OpsBurst),
+		}
+	}
+}
+
+// throttle holds the buckets of a mount's Rate.
+type throttle struct {
+	bytes, ops *bucket
+}
+
+// bucket is a token bucket, filled at rate tokens a second up to burst. Its
+// tokens go below zero for what has been taken ahead of time.
+type bucket struct {
+	rate, burst, tokens float64
+	at                  time.Time
+}
+
+// newBucket returns a full bucket, or nil for a rate that is no limit.
+func newBucket(rate, burst float64) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &bucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// take takes n tokens at now, and returns how long their taker must wait
+// until the bucket would have held them.
+func (b *bucket) take(now time.Time, n float64) time.Duration {
+	if b == nil || n <= 0 {
+		return 0
+	}
+	if !b.at.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.at).Seconds()*b.rate)
+	}
+	b.at = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttleFor charges the native syscall c to the throttle of the mount it
+// is made on, if any, and returns how long it must be held.
+func (th *thread) throttleFor(c sysCall) time.Duration {
+	m := th.callMount(c)
+	if m == nil || m.throttle == nil {
+		return 0
+	}
+	now := time.Now()
+	d := m.throttle.ops.take(now, 1)
+	if n := th.callBytes(c); n > 0 {
+		d = max(d, m.throttle.bytes.take(now, float64(n)))
+	}
+	if d > 0 {
+		th.t.log.Printf("throttle: %s for %v", m.dir, d)
+	}
+	return d
+}
+
+// callMount returns the mount whose file or path the syscall c is made on,
+// or nil for a host one.
+func (th *thread) callMount(c sysCall) *mount {
+	switch c.nr {
+	case unix.SYS_READ, unix.SYS_WRITE, unix.SYS_PREAD64, unix.SYS_PWRITE64,
+		unix.SYS_READV, unix.SYS_WRITEV, unix.SYS_PREADV, unix.SYS_PWRITEV,
+		unix.SYS_PREADV2, unix.SYS_PWRITEV2, unix.SYS_SENDFILE:
+		fd := int(int32(c.args[0]))
+		if c.nr == unix.SYS_SENDFILE {
+			// The file is read from, and its bytes are what count.
+			fd = int(int32(c.args[1]))
+		}
+		if f, ok := th.fds.get(fd); ok {
+			return f.mount
+		}
+		return nil
+	}
+	p, ok := th.callPath(c)
+	if !ok {
+		return nil
+	}
+	m, _, ok := th.t.lookup(p)
+	if !ok {
+		return nil
+	}
+	return m
+}
+
+// callBytes returns how many bytes the syscall c asks to move, as much of
+// it as one emulated syscall moves at once.
+func (th *thread) callBytes(c sysCall) int {
+	limit := maxBufferSize
+	switch c.nr {
+	case unix.SYS_WRITE, unix.SYS_PWRITE64:
+		if th.t.streamChunk > 0 {
+			// The whole buffer is streamed.
+			limit = math.MaxInt
+		}
+		fallthrough
+	case unix.SYS_READ, unix.SYS_PREAD64:
+		return int(min(c.args[2], uint64(limit)))
+	case unix.SYS_SENDFILE:
+		return int(min(c.args[3], uint64(limit)))
+	case unix.SYS_READV, unix.SYS_WRITEV, unix.SYS_PREADV, unix.SYS_PWRITEV,
+		unix.SYS_PREADV2, unix.SYS_PWRITEV2:
+		iov, errno := th.iovecs(uintptr(c.args[1]), int(int32(c.args[2])))
+		if errno != 0 {
+			return 0
+		}
+		n := 0
+		for _, v := range iov {
+			n += v.len
+		}
+		return min(n, limit)
+	}
+	return 0
+}
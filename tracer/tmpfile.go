@@ -0,0 +1,154 @@
+package tracer
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+)
+
+// tmpfile is an unnamed file opened with O_TMPFILE. Until linkat gives it
+// a name in dir, the mount of the directory it was opened in, it is kept
+// in a memfs of its own, which the vfile's mount serves, so that it never
+// shows in the backend's listings. A file opened with O_EXCL as well can
+// never be linked.
+type tmpfile struct {
+	dir      *mount
+	linkable bool
+}
+
+// tmpfileName is the name of the file in a tmpfile's memfs.
+const tmpfileName = "file"
+
+// openTmpfile opens an unnamed file in the directory name of m, whose
+// absolute path is abs, as open does with O_TMPFILE, and returns the
+// descriptor or a negated errno.
+func (th *thread) openTmpfile(m *mount, name, abs string, flags int, mode uint32) int64 {
+	fi, err := m.backend.Stat(name)
+	switch {
+	case err != nil:
+		return errnoRet(err)
+	case !fi.IsDir():
+		return -int64(unix.ENOTDIR)
+	case flags&unix.O_ACCMODE == unix.O_RDONLY:
+		return -int64(unix.EINVAL)
+	case th.fdsFull():
+		return -int64(unix.EMFILE)
+	}
+	tmp := &mount{dir: abs, backend: memfs.New(), owner: m.owner, perm: m.perm}
+	f, err := tmp.backend.Open(tmpfileName, os.O_RDWR|os.O_CREATE, fs.FileMode(mode&^th.umask()&0o777))
+	if err != nil {
+		return errnoRet(err)
+	}
+	th.t.tmpfiles++
+	p := path.Join(abs, fmt.Sprintf("#%d (deleted)", th.t.tmpfiles))
+	fd := th.addVirtual(tmp, tmpfileName, p, f, flags&^unix.O_TMPFILE)
+	v, _ := th.fds.get(int(fd))
+	v.tmp = &tmpfile{dir: m, linkable: flags&unix.O_EXCL == 0}
+	return fd
+}
+
+// linkSource returns the open virtual file a linkat links, if its old
+// path names one: an empty path with AT_EMPTY_PATH, for olddirfd itself,
+// or a descriptor's link in /proc followed with AT_SYMLINK_FOLLOW.
+func (th *thread) linkSource(olddirfd int, oldAddr uintptr, flags int) (*vfile, bool) {
+	p, err := th.mem.readString(oldAddr)
+	if err != nil {
+		return nil, false
+	}
+	if p == "" {
+		if flags&unix.AT_EMPTY_PATH == 0 {
+			return nil, false
+		}
+		return th.fds.get(olddirfd)
+	}
+	if flags&unix.AT_SYMLINK_FOLLOW == 0 {
+		return nil, false
+	}
+	abs, err := th.resolve(olddirfd, p)
+	if err != nil {
+		return nil, false
+	}
+	v, rest, ok := th.procEntry(abs)
+	if !ok {
+		return nil, false
+	}
+	return v.virtualFD(rest)
+}
+
+// linkFile gives the virtual file f the new name newAddr, from newdirfd,
+// for linkat. An unnamed file is copied into the backend of the directory
+// it was opened in, and f goes on as the file it now names.
+func (th *thread) linkFile(f *vfile, newdirfd int, newAddr uintptr, flags int) int64 {
+	th.t.log.Printf("linkat: %s (virtual)", f.path)
+	if flags&^(unix.AT_SYMLINK_FOLLOW|unix.AT_EMPTY_PATH) != 0 {
+		return -int64(unix.EINVAL)
+	}
+	newAbs, nm, newName, ret, ok := th.virtualPath(newdirfd, newAddr)
+	switch {
+	case ret < 0:
+		return ret
+	case f.tmp != nil && !f.tmp.linkable:
+		return -int64(unix.ENOENT)
+	case !ok || (f.tmp == nil && nm != f.mount) || (f.tmp != nil && nm != f.tmp.dir):
+		return -int64(unix.EXDEV)
+	case f.tmp == nil:
+		if err := nm.backend.Link(f.name, newName); err != nil {
+			return errnoRet(err)
+		}
+		return 0
+	}
+	if _, err := nm.backend.Lstat(newName); err == nil {
+		return -int64(unix.EEXIST)
+	}
+	named, err := th.nameTmpfile(f, nm, newName)
+	if err != nil {
+		return errnoRet(err)
+	}
+	_ = f.file.Close()
+	f.file, f.mount, f.name, f.path, f.tmp = named, nm, newName, newAbs, nil
+	return 0
+}
+
+// nameTmpfile copies the unnamed file f to name in m, and returns the copy
+// opened as f is, at f's offset.
+func (th *thread) nameTmpfile(f *vfile, m *mount, name string) (file vfs.File, err error) {
+	fi, err := f.mount.backend.Lstat(f.name)
+	if err != nil {
+		return nil, err
+	}
+	perm := fi.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	w, err := m.backend.Open(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm.Perm())
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(w, io.NewSectionReader(f.file, 0, fi.Size()))
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = m.backend.Chmod(name, perm)
+	}
+	if err != nil {
+		_ = m.backend.Unlink(name)
+		return nil, err
+	}
+	off, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if file, err = m.backend.Open(name, f.flags&unix.O_ACCMODE, 0); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(off, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
@@ -0,0 +1,111 @@
+package tracer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TraceFormat selects how WithTraceWriter writes syscalls.
+type TraceFormat int
+
+const (
+	// TraceText writes one line per syscall in the style of strace -f -tt
+	// -T:
+	//
+	//	[pid  4242] 15:04:05.000000 openat(AT_FDCWD, "/etc/hostname", O_RDONLY) = 3 <0.000012>
+	TraceText TraceFormat = iota
+	// TraceJSON writes one JSON object per line, with the fields of
+	// TraceRecord.
+	TraceJSON
+)
+
+// TraceRecord is the form a syscall takes in TraceJSON output.
+type TraceRecord struct {
+	Time time.Time `json:"time"`
+	Pid  int       `json:"pid"`
+	// Syscall is the syscall's name, or syscall_N for one the tracer
+	// cannot name.
+	Syscall string `json:"syscall"`
+	// Args are the decoded arguments, as they appear in TraceText.
+	Args []string `json:"args"`
+	// Ret is the value returned to the command, which is -1 if Errno is
+	// set, or null if the tracer did not see the syscall return.
+	Ret   *int64 `json:"ret"`
+	Errno string `json:"errno,omitempty"`
+	// Duration is the time the syscall took, in seconds.
+	Duration float64 `json:"duration"`
+}
+
+// WithTraceWriter writes a decoded log of the syscalls the command makes to
+// w in the given format. Every syscall the tracer stops at is logged with
+// the arguments and result the command sees, after hooks have had their
+// say; with seccomp those are the syscalls it intercepts, and without it
+// every syscall. Syscalls that never return, such as exit_group, are logged
+// with an unknown result when their thread exits.
+//
+// Under EngineUnotify the tracer only learns the result of syscalls it
+// emulates; the others are logged with an unknown result as they start.
+func WithTraceWriter(w io.Writer, format TraceFormat) Option {
+	return func(t *Tracer) { t.trace = &traceLog{w: w, format: format} }
+}
+
+type traceLog struct {
+	w      io.Writer
+	format TraceFormat
+}
+
+// traceSyscall logs the syscall c the thread made, which started at start
+// and returned ret if done is set.
+func (th *thread) traceSyscall(c sysCall, ret int64, done bool, start time.Time) {
+	name, args, hexRet := th.decode(c, ret, done)
+	rec := TraceRecord{Time: start, Pid: th.tid, Syscall: name, Args: args, Duration: time.Since(start).Seconds()}
+	result := "?"
+	if done {
+		r := ret
+		switch {
+		case ret < 0 && ret > -4096:
+			errno := syscall.Errno(-ret)
+			rec.Errno, r = unix.ErrnoName(errno), -1
+			msg := errno.Error()
+			result = fmt.Sprintf("-1 %s (%s)", rec.Errno, strings.ToUpper(msg[:1])+msg[1:])
+		case hexRet:
+			result = fmt.Sprintf("%#x", uint64(ret))
+		default:
+			result = strconv.FormatInt(ret, 10)
+		}
+		rec.Ret = &r
+	}
+	var line []byte
+	switch th.t.trace.format {
+	case TraceJSON:
+		var err error
+		if line, err = json.Marshal(rec); err != nil {
+			th.t.log.Printf("trace: %v", err)
+			return
+		}
+		line = append(line, '\n')
+	default:
+		line = fmt.Appendf(nil, "[pid %5d] %s %s(%s) = %s <%.6f>\n", rec.Pid,
+			start.Format("15:04:05.000000"), name, strings.Join(args, ", "), result, rec.Duration)
+	}
+	// One write per syscall keeps lines whole on a shared pipe.
+	if _, err := th.t.trace.w.Write(line); err != nil {
+		th.t.log.Printf("trace: %v", err)
+	}
+}
+
+// traceUnfinished logs the syscall an exiting thread was in, such as
+// exit_group, which never returns.
+func (th *thread) traceUnfinished() {
+	if th != nil && th.hooked != nil && th.t.trace != nil {
+		th.traceSyscall(*th.hooked, 0, false, th.hookedAt)
+		th.hooked = nil
+	}
+}
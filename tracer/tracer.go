@@ -0,0 +1,743 @@
+// Package tracer runs a command under ptrace and intercepts the filesystem
+// syscalls it makes. Paths below a mount (see WithMount) are served from a
+// vfs.Backend instead of the host filesystem.
+//
+// All ptrace requests for a tracee must come from the thread that attached
+// to it, so Run locks the servicing goroutine to its OS thread for the
+// lifetime of the command.
+package tracer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sys/unix"
+)
+
+// Option configures a Tracer.
+type Option func(*Tracer)
+
+// WithLogger directs debug output about intercepted syscalls to l. By
+// default nothing is logged.
+func WithLogger(l *log.Logger) Option {
+	return func(t *Tracer) { t.log = l }
+}
+
+// Tracer supervises a command and every process and thread it creates,
+// stopping them at each syscall.
+type Tracer struct {
+	cmd    *exec.Cmd
+	log    *log.Logger
+	mounts []mount
+	remaps []Remap
+	// redirects are the rules added by WithRedirects.
+	redirects []redirect
+	// egress are the rules of WithEgress, which is on if they are not nil.
+	egress []egressRule
+	// egressErr is the error of the first rule WithEgress could not
+	// parse, which Start returns.
+	egressErr error
+	// host serves paths remapped outside every mount, from hostFS.
+	host   mount
+	hostFS *hostFS
+	// readOnly denies writes outside the writable directories.
+	readOnly bool
+	writable []string
+	// noLandlock leaves read-only mode to the tracer alone.
+	noLandlock bool
+	// userns, if set, has the command started in new namespaces.
+	userns *UserNamespace
+	// noIOURing fails the io_uring syscalls.
+	noIOURing bool
+	// pinPaths copies path arguments into scratch memory.
+	pinPaths bool
+	// chroot emulates chroot and pivot_root, and reroots the paths of
+	// the processes that use them.
+	chroot bool
+	// fakeRoot has the command believe it runs as root.
+	fakeRoot bool
+	// ioctls decide what ioctls on virtual descriptors do.
+	ioctls []IoctlRule
+	// rules is the syscall policy.
+	rules []Rule
+	// pathRules restrict access to parts of the filesystem.
+	pathRules []PathRule
+	// creds are who access checks on virtual files are made as.
+	creds Credentials
+	// execs rewrite the command's execs.
+	execs []func(*Exec)
+	// limits is what WithLimits allows.
+	limits Limits
+	// faults are the faults added by WithFaults, and delays the delays
+	// added by WithDelays.
+	faults []*fault
+	delays []Delay
+	// enterHooks and exitHooks are the hooks added by OnSyscallEnter and
+	// OnSyscallExit.
+	enterHooks, exitHooks []hook
+	// trace is where WithTraceWriter logs syscalls, if anywhere.
+	trace *traceLog
+	// random is the stream set up by WithRandomSeed, if any.
+	random *randomSource
+	// resolver serves the files of WithResolver, if given.
+	resolver *mount
+	// clock is the virtual clock set by WithClock, if any.
+	clock *Clock
+	// record and replay are set by WithRecord and WithReplay.
+	record *recorder
+	replay *replayer
+	// events is the channel returned by Events, if it has been called.
+	// done is closed once Run's context is cancelled.
+	events chan Event
+	done   <-chan struct{}
+	// useSeccomp asks for the seccomp fast path; seccomp records whether
+	// the filter was actually installed.
+	useSeccomp bool
+	seccomp    bool
+	// engine is the interception engine in use. It reverts to
+	// EnginePtrace if notifications turn out to be unavailable.
+	engine Engine
+
+	// leader is the pid of the command itself, or of the process given
+	// to Attach. attached is that pid too if there is no command, and
+	// detaching is set once the tracer is letting its tracees go.
+	leader    int
+	attached  int
+	detaching bool
+	// detachable is set if nothing stops Detach from letting the tracees
+	// go. requestDetach cancels detachCtx once Detach has been called,
+	// and finished is closed, with saved holding the tracees' state, once
+	// Run returns.
+	detachable    bool
+	detachCtx     context.Context
+	requestDetach context.CancelFunc
+	finished      chan struct{}
+	saved         *stateSaver
+	// started is closed by Start once the command is running. err is
+	// what Run returns, and exit how the command ended, once finished is
+	// closed.
+	started chan struct{}
+	err     error
+	exit    *ExitState
+	// restore is the state Reattach restores.
+	restore *restorer
+	// threads holds every traced task by tid. Processes are not tracked
+	// separately: a process is the set of threads sharing its resources.
+	threads map[int]*thread
+	// orphans holds new children that reported their initial stop before
+	// their parent's fork event told us who they belong to.
+	orphans map[int]bool
+	// procs holds every process seen by the unotify engine, by pid.
+	procs map[int]*process
+	// tmpfiles counts the virtual files opened with O_TMPFILE, to number
+	// them.
+	tmpfiles int
+	// memfds holds the virtual file each memfd made for a mapping, an exec
+	// or WithPassthrough holds a copy of, by inode.
+	memfds map[uint64]string
+	// devNull is the unotify engine's source for placeholder descriptors.
+	devNull int
+	// held holds the notifications the unotify engine is delaying.
+	held []heldNotification
+	// stops counts the ptrace stops or seccomp notifications serviced.
+	stops int
+	// serving is the thread whose stop or notification is being serviced,
+	// and servingCall the syscall of its notification, for an
+	// InternalError; crash is the error servicing crashed with, if it has.
+	serving     *thread
+	servingCall sysCall
+	crash       *InternalError
+	// metrics is where WithMetrics counts, if anywhere.
+	metrics *Metrics
+	// spans makes the spans of WithTracerProvider, if given, as children
+	// of the span in spanCtx, for the syscall op.
+	spans   trace.Tracer
+	spanCtx context.Context
+	op      spanOp
+	// decisions are the decisions WithDecisionCache keeps, if any.
+	decisions *decisionCache
+	// audit is where WithAuditLog records decisions on files, if anywhere.
+	audit *AuditLog
+	// supervisor services the command on its thread, if given.
+	supervisor *Supervisor
+	// workers holds a token for each job being done, up to the number
+	// WithWorkers allows at once.
+	workers chan struct{}
+	// streamChunk and streamWindow are the chunk size and window of
+	// WithWriteStreaming, with a chunk of 0 without it.
+	streamChunk, streamWindow int
+	// parked holds the notifications the unotify engine answers once
+	// their jobs are done, which write to jobWake.
+	parked  []parkedNotification
+	jobWake int
+	// passthrough holds the memfds of WithPassthrough, if given.
+	passthrough *passthrough
+	// leases holds the files of WithLeases leased to the command, if given.
+	leases *leases
+	// watches holds the shadows of the virtual paths the command watches.
+	watches *watches
+	// pty is the terminal of WithPTY, if given.
+	pty *pty
+	// reaper waits for the processes the command leaves behind, if
+	// WithSubreaper was given.
+	reaper *reaper
+}
+
+// New returns a Tracer that will run cmd. The command must not have been
+// started; Run starts it.
+func New(cmd *exec.Cmd, opts ...Option) *Tracer {
+	return newTracer(cmd, opts)
+}
+
+func newTracer(cmd *exec.Cmd, opts []Option) *Tracer {
+	t := &Tracer{
+		cmd:        cmd,
+		log:        log.New(io.Discard, "", 0),
+		useSeccomp: true,
+		threads:    make(map[int]*thread),
+		orphans:    make(map[int]bool),
+		procs:      make(map[int]*process),
+		hostFS:     &hostFS{},
+		finished:   make(chan struct{}),
+		saved:      newStateSaver(),
+		spanCtx:    context.Background(),
+	}
+	t.host = mount{dir: "/", backend: t.hostFS}
+	t.detachCtx, t.requestDetach = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(t)
+	}
+	// A seccomp filter outlives the tracer, and would fail the syscalls
+	// it traps once the tracer had gone.
+	t.detachable = !t.useSeccomp && t.engine != EngineUnotify
+	t.limitBackends()
+	t.watchBackends()
+	t.instrumentBackends()
+	t.replaceBackends()
+	return t
+}
+
+// Run starts the command and services its syscalls, and those of all its
+// descendants, until it exits. Descendants still running when the command
+// exits are killed, so nothing escapes supervision. If ctx is cancelled the
+// command is killed. The returned error is the one
+// reported by the command's Wait, so a non-zero exit surfaces as an
+// *exec.ExitError. A Tracer returned by Attach runs as Attach describes.
+// Run returns nil once Detach has let everything go.
+func (t *Tracer) Run(ctx context.Context) error {
+	if err := t.Start(ctx); err != nil {
+		return err
+	}
+	_, err := t.Wait()
+	return err
+}
+
+// Start starts the command, or attaches to the process given to Attach,
+// and services it in the background, as Run does, until Wait returns.
+func (t *Tracer) Start(ctx context.Context) error {
+	if t.started != nil {
+		return errors.New("tracer: already started")
+	}
+	if t.egressErr != nil {
+		return t.egressErr
+	}
+	t.started = make(chan struct{})
+	t.spanCtx = ctx
+	if t.engine == EngineAuto {
+		t.engine = t.chooseEngine()
+	}
+	if t.decisions != nil && t.userns != nil && t.userns.Mount {
+		t.log.Printf("decision cache off: the command mounts in its own namespace unseen")
+		t.decisions = nil
+	}
+	if t.supervisor != nil && t.cmd != nil && t.engine == EnginePtrace {
+		t.supervisor.add(ctx, t)
+	} else {
+		go func() {
+			// The thread is deliberately never unlocked: once the tracee is
+			// gone the goroutine exits and takes the thread with it.
+			runtime.LockOSThread()
+			var err error
+			ran := false
+			defer func() {
+				if !ran {
+					// A backend ended the goroutine with runtime.Goexit,
+					// and guard has recorded it.
+					err = t.crash
+				}
+				t.finish(err)
+			}()
+			err = t.guard(func() error { return t.run(ctx) })
+			ran = true
+		}()
+	}
+	select {
+	case <-t.started:
+		return nil
+	case <-t.finished:
+		return t.err
+	}
+}
+
+// finish ends the Tracer with err, for Wait to return.
+func (t *Tracer) finish(err error) {
+	t.err = err
+	t.endLeases()
+	t.passthrough.close()
+	t.watches.close()
+	t.hostFS.close()
+	t.pty.finish(t.detaching)
+	t.reaper.close()
+	if t.events != nil {
+		close(t.events)
+	}
+	close(t.finished)
+}
+
+// Wait waits for the Tracer started by Start to finish. It returns how the
+// command, or the process given to Attach, ended, which is nil if it did
+// not, and the error Run would have returned.
+func (t *Tracer) Wait() (*ExitState, error) {
+	if t.started == nil {
+		return nil, errors.New("tracer: not started")
+	}
+	<-t.finished
+	return t.exit, t.err
+}
+
+func (t *Tracer) run(ctx context.Context) error {
+	if t.replay != nil {
+		if err := t.replay.load(); err != nil {
+			return err
+		}
+	}
+	if t.cmd == nil {
+		return t.runAttached(ctx)
+	}
+	if err := t.startCommand(ctx); err != nil {
+		return err
+	}
+	defer context.AfterFunc(ctx, t.cancelled)()
+	leader, options, err := t.seizeCommand()
+	if err != nil {
+		return err
+	}
+	if t.engine == EngineUnotify {
+		fd, err := leader.installFilter(unix.SECCOMP_RET_USER_NOTIF, unix.SECCOMP_FILTER_FLAG_NEW_LISTENER)
+		if err == nil {
+			return t.runUnotify(ctx, leader, fd)
+		}
+		t.log.Printf("seccomp notifications unavailable, using ptrace: %v", err)
+		t.engine = EnginePtrace
+	}
+	if err := t.traceCommand(leader, options); err != nil {
+		return err
+	}
+	return t.loop(ctx)
+}
+
+// startCommand starts the command as a tracee of the calling thread.
+func (t *Tracer) startCommand(ctx context.Context) error {
+	if t.cmd.Process != nil {
+		return errors.New("tracer: command already started")
+	}
+	if t.pinPaths && t.engine == EngineUnotify {
+		return errors.New("tracer: pinned paths need EnginePtrace")
+	}
+	if t.chroot && t.engine == EngineUnotify {
+		return errors.New("tracer: chroot needs EnginePtrace")
+	}
+	if t.cmd.SysProcAttr == nil {
+		t.cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	t.cmd.SysProcAttr.Ptrace = true
+	if t.userns != nil {
+		t.userns.apply(t.cmd.SysProcAttr)
+	}
+	if t.pty != nil {
+		if err := t.openPTY(); err != nil {
+			return err
+		}
+	}
+	if err := t.reaper.becomeSubreaper(); err != nil {
+		return err
+	}
+	err := t.cmd.Start()
+	t.pty.start(err)
+	if err != nil {
+		return t.startError(err)
+	}
+	close(t.started)
+	t.leader = t.cmd.Process.Pid
+	t.done = ctx.Done()
+	return nil
+}
+
+// seizeCommand waits for the command started by startCommand to stop at
+// its exec, and returns its thread and the ptrace options set on it.
+func (t *Tracer) seizeCommand() (*thread, int, error) {
+	// The child stops with SIGTRAP once execve has succeeded.
+	var ws unix.WaitStatus
+	if _, err := unix.Wait4(t.leader, &ws, unix.WALL, nil); err != nil {
+		_ = t.cmd.Process.Kill()
+		_ = t.cmd.Wait()
+		return nil, 0, fmt.Errorf("tracer: initial wait: %w", err)
+	}
+	options := ptraceOptions
+	if t.useSeccomp {
+		options |= unix.PTRACE_O_TRACESECCOMP
+	}
+	if err := unix.PtraceSetOptions(t.leader, options); err != nil {
+		_ = t.cmd.Process.Kill()
+		_ = t.cmd.Wait()
+		return nil, 0, fmt.Errorf("tracer: setoptions: %w", err)
+	}
+	leader := &thread{t: t, tid: t.leader, pid: t.leader, mem: ptraceMemory(t.leader), fds: newFDTable(), cwd: &workDir{}}
+	t.threads[t.leader] = leader
+	if t.clock != nil {
+		if err := leader.hideVDSO(); err != nil {
+			t.log.Printf("vdso: %v", err)
+		}
+	}
+	if err := leader.restrictWrites(); err != nil {
+		t.log.Printf("landlock unavailable, leaving read-only mode to the tracer: %v", err)
+	}
+	return leader, options, nil
+}
+
+// traceCommand sets the command seized by seizeCommand up for the ptrace
+// engine, and lets it run.
+func (t *Tracer) traceCommand(leader *thread, options int) error {
+	if err := t.reseize(options); err != nil {
+		_ = t.cmd.Process.Kill()
+		_ = t.cmd.Wait()
+		return err
+	}
+	leader.allocScratch()
+	if t.useSeccomp {
+		if _, err := leader.installFilter(unix.SECCOMP_RET_TRACE, 0); err != nil {
+			t.log.Printf("seccomp filter unavailable, tracing every syscall: %v", err)
+		} else {
+			t.seccomp = true
+		}
+	}
+	return t.resume(leader, 0)
+}
+
+// loop services the tracees' stops until the command exits or, for an
+// attached process, every tracee has been detached.
+func (t *Tracer) loop(ctx context.Context) error {
+	// The SIGURG wakes the loop if the tracees are idle; see runAttached.
+	defer context.AfterFunc(t.detachCtx, func() { _ = unix.Kill(t.leader, unix.SIGURG) })()
+	for {
+		if done, err := t.settle(ctx); done {
+			return err
+		}
+		pid, exiting, err := peek()
+		if err != nil {
+			return err
+		}
+		var done bool
+		if err := t.guard(func() (err error) { done, err = t.step(pid, exiting); return err }); done || err != nil {
+			return err
+		}
+	}
+}
+
+// settle starts detaching everything if it is time to, and reports
+// whether the loop is over, with the error it ends with, because all
+// has been detached.
+func (t *Tracer) settle(ctx context.Context) (bool, error) {
+	if !t.detaching && (t.detachCtx.Err() != nil ||
+		t.attached != 0 && (ctx.Err() != nil || t.threads[t.leader] == nil)) {
+		t.detachAll()
+	}
+	if r := t.reaper; r != nil && r.held != nil && ctx.Err() != nil {
+		t.killRemaining()
+		if err := t.releaseExit(); err != nil {
+			return true, err
+		}
+	}
+	if t.detaching && len(t.threads) == 0 {
+		return true, ctx.Err()
+	}
+	return false, nil
+}
+
+// step services the state change peek found pending for the tracee pid,
+// and reports whether the loop is over, with the error it ends with,
+// because the command has exited or servicing failed.
+func (t *Tracer) step(pid int, exiting bool) (bool, error) {
+	if pid == t.leader && exiting && t.attached == 0 && !t.detaching {
+		t.threads[t.leader].traceUnfinished()
+		t.killRemaining()
+		// Leave reaping to Wait so that cmd.ProcessState and the
+		// command's stdio goroutines are handled as usual.
+		err := t.waitLeader()
+		t.reaper.reap(nil)
+		return true, err
+	}
+	var ws unix.WaitStatus
+	if _, err := unix.Wait4(pid, &ws, unix.WALL, nil); err != nil {
+		return true, fmt.Errorf("tracer: wait: %w", err)
+	}
+	if err := t.handleStop(pid, ws); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// waitLeader reaps the command once it has exited.
+func (t *Tracer) waitLeader() error {
+	err := t.cmd.Wait()
+	if t.cmd.ProcessState != nil {
+		t.exit = exitState(t.leader, unix.WaitStatus(t.cmd.ProcessState.Sys().(syscall.WaitStatus)))
+		t.emit(&ProcessExited{Pid: t.leader, ExitCode: t.cmd.ProcessState.ExitCode()})
+	}
+	return err
+}
+
+// ptraceOptions are set on the command and inherited by every tracee
+// attached through a fork event.
+const ptraceOptions = unix.PTRACE_O_TRACESYSGOOD | unix.PTRACE_O_TRACEEXEC |
+	unix.PTRACE_O_EXITKILL | unix.PTRACE_O_TRACEFORK |
+	unix.PTRACE_O_TRACEVFORK | unix.PTRACE_O_TRACECLONE | unix.PTRACE_O_TRACEEXIT
+
+// waitFlags restricts waits to children of the tracing thread, so a Tracer
+// never reaps processes the embedding program started elsewhere.
+const waitFlags = unix.WALL | unix.WNOTHREAD
+
+// peek blocks until some tracee has a state change pending and returns its
+// pid and whether that change is its termination, without consuming it.
+func peek() (pid int, exiting bool, err error) {
+	for {
+		var info siginfo
+		_, _, errno := unix.Syscall6(unix.SYS_WAITID, unix.P_ALL, 0,
+			uintptr(unsafe.Pointer(&info)), unix.WEXITED|unix.WSTOPPED|unix.WNOWAIT|waitFlags, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return 0, false, fmt.Errorf("tracer: waitid: %w", errno)
+		}
+		switch info.Code {
+		case cldExited, cldKilled, cldDumped:
+			return int(info.Pid), true, nil
+		}
+		return int(info.Pid), false, nil
+	}
+}
+
+// killRemaining kills and reaps every tracee other than the leader.
+func (t *Tracer) killRemaining() {
+	for pid, th := range t.threads {
+		if pid != t.leader {
+			if th.tid == th.pid {
+				t.reaper.watch(pid)
+			}
+			_ = unix.Kill(pid, unix.SIGKILL)
+		}
+	}
+	for pid, th := range t.threads {
+		if pid == t.leader {
+			continue
+		}
+		var ws unix.WaitStatus
+		for {
+			if _, err := unix.Wait4(pid, &ws, waitFlags, nil); err != nil || ws.Exited() || ws.Signaled() {
+				break
+			}
+			// A stop that beat the SIGKILL, such as an exit event,
+			// must be let go of.
+			_ = unix.PtraceCont(pid, 0)
+		}
+		th.exit()
+		if th.tid == th.pid {
+			t.emit(&ProcessExited{Pid: th.pid, ExitCode: exitCode(ws)})
+		}
+	}
+	t.threads = map[int]*thread{t.leader: t.threads[t.leader]}
+}
+
+func (t *Tracer) handleStop(pid int, ws unix.WaitStatus) error {
+	th, ok := t.threads[pid]
+	t.serving = th
+	if !ok {
+		// A new child's initial stop can arrive before the fork
+		// event in its parent. Hold it until the parent reports.
+		if ws.Stopped() {
+			t.orphans[pid] = true
+		}
+		return nil
+	}
+	if ws.Exited() || ws.Signaled() {
+		th.exit()
+		delete(t.threads, pid)
+		if th.tid == th.pid {
+			if th.pid == t.leader {
+				t.exit = exitState(th.pid, ws)
+			}
+			t.emit(&ProcessExited{Pid: th.pid, ExitCode: exitCode(ws)})
+		}
+		return t.reaped()
+	}
+	if !ws.Stopped() {
+		return nil
+	}
+
+	t.stops++
+	t.metrics.stop()
+	t.op = spanOp{}
+	var sig unix.Signal
+	switch stop := ws.StopSignal(); {
+	case stop == unix.SIGTRAP|0x80:
+		if th.inSyscall {
+			th.syscallExit()
+		} else {
+			th.syscallEnter()
+		}
+		th.inSyscall = !th.inSyscall
+	case stop == unix.SIGTRAP && ws.TrapCause() != 0:
+		switch ws.TrapCause() {
+		case unix.PTRACE_EVENT_SECCOMP:
+			// The filter stops before syscall entry. Only syscalls the
+			// tracer emulates, or that exit hooks wait for, need to be
+			// caught again on the way out.
+			// A restarted mmap or exec has already had its entry stop.
+			if th.restarting() {
+				break
+			}
+			th.syscallEnter()
+			th.inSyscall = th.emulated || th.restarting() || th.hooked != nil || th.sleep != nil
+		case unix.PTRACE_EVENT_EXEC:
+			th = t.execed(th)
+			if t.clock != nil {
+				if err := th.hideVDSO(); err != nil {
+					t.log.Printf("vdso: %v", err)
+				}
+			}
+		case unix.PTRACE_EVENT_EXIT:
+			if t.exiting(th) {
+				// Left stopped until releaseExit lets it go.
+				return nil
+			}
+		case unix.PTRACE_EVENT_FORK, unix.PTRACE_EVENT_VFORK, unix.PTRACE_EVENT_CLONE:
+			if err := t.attachChild(th, ws.TrapCause()); err != nil {
+				return err
+			}
+		}
+	case groupStop(ws):
+		return t.listen(th)
+	case stop == unix.SIGSTOP && th.parked:
+		// Sent by a worker to wake the thread from its ppoll.
+		th.parked = false
+	case stop == unix.SIGSTOP && th.scratching:
+		// Sent by rescratch rather than by anyone the command should
+		// hear from.
+		th.scratching = false
+		th.allocScratch()
+	default:
+		sig = stop
+		if sig != unix.SIGURG {
+			t.log.Printf("pid %d stopped by signal %v", pid, sig)
+		}
+	}
+	if th.lockWait != nil {
+		// Left stopped until relock lets it go.
+		return nil
+	}
+	return t.resume(th, sig)
+}
+
+// resume restarts a stopped thread, delivering sig if it is non-zero. In
+// seccomp mode the thread runs freely until the filter or an event stops it
+// again, unless it is inside a syscall whose exit must be observed or in
+// the middle of a mapping or an execution. While the tracer is detaching, a thread outside
+// any such syscall is let go instead.
+func (t *Tracer) resume(th *thread, sig unix.Signal) error {
+	if t.detaching && !th.inSyscall && !th.restarting() {
+		return t.detach(th, sig)
+	}
+	var err error
+	if t.seccomp && !th.inSyscall && !th.restarting() {
+		err = unix.PtraceCont(th.tid, int(sig))
+	} else {
+		err = unix.PtraceSyscall(th.tid, int(sig))
+	}
+	if err != nil && err != unix.ESRCH {
+		return fmt.Errorf("tracer: resume: %w", err)
+	}
+	return nil
+}
+
+// execed handles an exec event, which arrives between the entry and exit
+// stops of execve. The exec'ing thread loses its close-on-exec virtual
+// descriptors. When a non-leader thread execs, the kernel destroys the
+// other threads and the exec'ing thread takes over the leader's tid; its
+// state moves with it so the pending execve exit stop is not mistaken for
+// an entry.
+func (t *Tracer) execed(th *thread) *thread {
+	msg, err := unix.PtraceGetEventMsg(th.tid)
+	former, ok := t.threads[int(msg)]
+	if err != nil || int(msg) == th.tid || !ok {
+		th.fds = th.fds.exec()
+		th.rescratch()
+		return th
+	}
+	t.log.Printf("tid %d exec'd from thread %d", th.tid, former.tid)
+	delete(t.threads, former.tid)
+	th.fds.release()
+	former.tid, former.mem = th.tid, th.mem
+	former.fds = former.fds.exec()
+	former.rescratch()
+	t.threads[th.tid] = former
+	return former
+}
+
+// attachChild starts tracking the child reported by a fork, vfork or clone
+// event in parent.
+func (t *Tracer) attachChild(parent *thread, event int) error {
+	msg, err := unix.PtraceGetEventMsg(parent.tid)
+	if err != nil {
+		return fmt.Errorf("tracer: geteventmsg: %w", err)
+	}
+	pid := int(msg)
+	flags := parent.cloneFlags(event)
+	child := &thread{t: t, tid: pid, pid: parent.pid, mem: ptraceMemory(pid)}
+	if flags&unix.CLONE_THREAD == 0 {
+		child.pid = pid
+	}
+	if flags&unix.CLONE_FILES != 0 {
+		child.fds = parent.fds.share()
+	} else {
+		child.fds = parent.fds.clone()
+	}
+	if flags&unix.CLONE_FS != 0 {
+		child.cwd = parent.cwd
+	} else {
+		child.cwd = parent.cwd.clone()
+	}
+	if flags&unix.CLONE_VM != 0 {
+		child.scratch = parent.scratch
+	} else {
+		child.scratch = parent.scratch.clone()
+	}
+	t.threads[pid] = child
+	t.log.Printf("pid %d: new child %d", parent.tid, pid)
+	if child.pid == pid {
+		t.emit(&ProcessForked{Pid: parent.pid, Child: pid})
+	}
+	if t.orphans[pid] {
+		delete(t.orphans, pid)
+		return t.resume(child, 0)
+	}
+	return nil
+}
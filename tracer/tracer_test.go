@@ -0,0 +1,4040 @@
+package tracer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/overlay"
+	"github.com/maxmcd/cfc-ptrace/vfs/shared"
+)
+
+func TestRunLogsOpenat(t *testing.T) {
+	var logs, stdout bytes.Buffer
+	cmd := exec.Command("/bin/cat", "/etc/hostname")
+	cmd.Stdout = &stdout
+	tr := New(cmd, WithLogger(log.New(&logs, "", 0)))
+	if err := tr.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "openat: /etc/hostname") {
+		t.Errorf("expected openat to be logged, got:\n%s", logs.String())
+	}
+	if stdout.Len() == 0 {
+		t.Error("expected the command to produce output")
+	}
+	if cmd.ProcessState == nil || !cmd.ProcessState.Success() {
+		t.Errorf("unexpected process state %v", cmd.ProcessState)
+	}
+}
+
+func TestRunExitError(t *testing.T) {
+	err := New(exec.Command("/bin/sh", "-c", "exit 3")).Run(context.Background())
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("expected exit status 3, got %v", err)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.Command("/bin/sleep", "10")
+	errc := make(chan error, 1)
+	go func() { errc <- New(cmd).Run(ctx) }()
+	cancel()
+	if err := <-errc; err == nil {
+		t.Fatal("expected the killed command to report an error")
+	}
+}
+
+func TestRunStartError(t *testing.T) {
+	if err := New(exec.Command("/does/not/exist")).Run(context.Background()); err == nil {
+		t.Fatal("expected an error starting a missing binary")
+	}
+}
+
+func TestMountRead(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello from the backend\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("/bin/cat", "/virtual/hello.txt")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := New(cmd, WithMount("/virtual", vfs.Dir(dir))).Run(context.Background()); err != nil {
+		t.Fatalf("%v: %s", err, stderr.String())
+	}
+	if got := stdout.String(); got != "hello from the backend\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestMountWrite(t *testing.T) {
+	dir := t.TempDir()
+	cmd := exec.Command("/usr/bin/tee", "/virtual/out.txt")
+	cmd.Stdin = strings.NewReader("written through the tracer\n")
+	if err := New(cmd, WithMount("/virtual", vfs.Dir(dir))).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "written through the tracer\n" {
+		t.Errorf("got %q", b)
+	}
+	if _, err := os.Stat("/virtual"); err == nil {
+		t.Error("the mount point should not exist on the host")
+	}
+}
+
+func TestMountMissingFile(t *testing.T) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("/bin/cat", "/virtual/missing.txt")
+	cmd.Stderr = &stderr
+	err := New(cmd, WithMount("/virtual", vfs.Dir(t.TempDir()))).Run(context.Background())
+	if err == nil {
+		t.Fatal("expected cat to fail")
+	}
+	if !strings.Contains(stderr.String(), "No such file or directory") {
+		t.Errorf("unexpected stderr %q", stderr.String())
+	}
+}
+
+func TestMountMemfs(t *testing.T) {
+	m := memfs.New()
+	write := exec.Command("/usr/bin/tee", "/mem/note.txt")
+	write.Stdin = strings.NewReader("kept in memory\n")
+	if err := New(write, WithMount("/mem", m)).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	read := exec.Command("/bin/cat", "/mem/note.txt")
+	read.Stdout = &stdout
+	if err := New(read, WithMount("/mem", m)).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != "kept in memory\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestMountOverlay(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{"a": "lower\n", "b": "b\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o := overlay.New(vfs.Dir(dir), memfs.New())
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", "echo upper >>/work/a && rm /work/b && echo c >/work/c && cat /work/a && ls /work")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := New(cmd, WithMount("/work", o)).Run(context.Background()); err != nil {
+		t.Fatalf("%v: %s", err, stderr.String())
+	}
+	if got, want := stdout.String(), "lower\nupper\na\nc\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "a")); string(b) != "lower\n" {
+		t.Errorf("host file changed to %q", b)
+	}
+	changes, err := o.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []overlay.Change{{Name: "a", Kind: overlay.Modified}, {Name: "b", Kind: overlay.Deleted}, {Name: "c", Kind: overlay.Added}}
+	if !slices.Equal(changes, want) {
+		t.Errorf("diff: got %v, want %v", changes, want)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	tr := New(nil, WithMount("/a", vfs.Dir("x")), WithMount("/a/b/", vfs.Dir("y")))
+	for _, tt := range []struct {
+		path, dir, name string
+		ok              bool
+	}{
+		{"/a", "/a", ".", true},
+		{"/a/c", "/a", "c", true},
+		{"/a/b/c/d", "/a/b", "c/d", true},
+		{"/ab", "", "", false},
+		{"/", "", "", false},
+	} {
+		m, name, ok := tr.lookup(tt.path)
+		if ok != tt.ok || (ok && (m.dir != tt.dir || name != tt.name)) {
+			t.Errorf("lookup(%q) = %v, %q, %v", tt.path, m, name, ok)
+		}
+	}
+}
+
+func TestRemapLookup(t *testing.T) {
+	tr := New(nil, WithMount("/a", vfs.Dir("x")), WithRemap(
+		Remap{From: "/etc/conf", To: "/a/conf"},
+		Remap{From: "/srv/*/logs", To: "/var/log"},
+		Remap{From: "/srv", To: "/a/srv"},
+	))
+	for _, tt := range []struct {
+		path, dir, name string
+		ok              bool
+	}{
+		{"/etc/conf", "/a", "conf", true},
+		{"/etc/conf/x", "/a", "conf/x", true},
+		{"/etc/config", "", "", false},
+		{"/srv/web/logs/access", "/", "var/log/access", true},
+		{"/srv/web/data", "/a", "srv/web/data", true},
+		{"/a/c", "/a", "c", true},
+	} {
+		m, name, ok := tr.lookup(tt.path)
+		if ok != tt.ok || (ok && (m.dir != tt.dir || name != tt.name)) {
+			t.Errorf("lookup(%q) = %v, %q, %v", tt.path, m, name, ok)
+		}
+	}
+}
+
+func TestRemap(t *testing.T) {
+	m := memfs.New()
+	f, _ := m.Open("conf", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Write([]byte("remapped\n"))
+	f.Close()
+	logs := t.TempDir()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", "cat /etc/cfc-test.conf && echo logged >/nonexistent/app/logs/out")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	tr := New(cmd, WithMount("/mem", m), WithRemap(
+		Remap{From: "/etc/cfc-test.conf", To: "/mem/conf"},
+		Remap{From: "/nonexistent/*/logs", To: logs},
+	))
+	if err := tr.Run(context.Background()); err != nil {
+		t.Fatalf("%v: %s", err, stderr.String())
+	}
+	if got := stdout.String(); got != "remapped\n" {
+		t.Errorf("got %q", got)
+	}
+	if b, _ := os.ReadFile(filepath.Join(logs, "out")); string(b) != "logged\n" {
+		t.Errorf("host file has %q", b)
+	}
+}
+
+func TestFollowForks(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "in.txt"), []byte("forked\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", "cat /virtual/in.txt | tee /virtual/out.txt && (cat /virtual/out.txt)")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := New(cmd, WithMount("/virtual", vfs.Dir(dir))).Run(context.Background()); err != nil {
+		t.Fatalf("%v: %s", err, stderr.String())
+	}
+	if got := stdout.String(); got != "forked\nforked\n" {
+		t.Errorf("got %q", got)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "out.txt")); string(b) != "forked\n" {
+		t.Errorf("backend has %q", b)
+	}
+}
+
+func TestClone3(t *testing.T) {
+	m := memfs.New()
+	f, _ := m.Open("f", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Close()
+	for _, seccomp := range []bool{true, false} {
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "clone3", "/mem/f")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		tr := New(cmd, WithMount("/mem", m), WithSeccomp(seccomp))
+		var forks int
+		events := tr.Events()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for ev := range events {
+				if _, ok := ev.(*ProcessForked); ok {
+					forks++
+				}
+			}
+		}()
+		if err := tr.Run(context.Background()); err != nil {
+			t.Fatalf("%v: %s", err, stderr.String())
+		}
+		<-done
+		// Only the child sharing the descriptor table closes the
+		// descriptor in the parent.
+		if got, want := stdout.String(), "<nil>\nbad file descriptor\n"; got != want {
+			t.Errorf("seccomp %v: got %q, want %q", seccomp, got, want)
+		}
+		if forks != 2 {
+			t.Errorf("seccomp %v: %d processes forked, want 2", seccomp, forks)
+		}
+	}
+}
+
+func TestOrphansKilled(t *testing.T) {
+	start := time.Now()
+	cmd := exec.Command("/bin/sh", "-c", "sleep 30 & exit 0")
+	if err := New(cmd).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Run waited %v for a background child", d)
+	}
+}
+
+func TestForkSharesFileTable(t *testing.T) {
+	parent := newFDTable()
+	f := &vfile{file: nopFile{}}
+	fd := parent.add(f, fdBase, false)
+	child := parent.clone()
+	thread := parent.share()
+	if _, ok := child.get(fd); !ok || f.refs != 2 {
+		t.Fatalf("clone should reference the open file, refs=%d", f.refs)
+	}
+	child.release()
+	if f.refs != 1 {
+		t.Errorf("refs after child exit = %d", f.refs)
+	}
+	thread.release()
+	if _, ok := parent.get(fd); !ok {
+		t.Error("a thread exiting must not close the shared table")
+	}
+	parent.release()
+	if f.refs != 0 {
+		t.Errorf("refs after last user = %d", f.refs)
+	}
+}
+
+func TestExecDropsCloexec(t *testing.T) {
+	table := newFDTable()
+	kept, dropped := &vfile{file: nopFile{}}, &vfile{file: nopFile{}}
+	keep := table.add(kept, fdBase, false)
+	drop := table.add(dropped, fdBase, true)
+	if drop != keep+1 {
+		t.Fatalf("fds %d and %d are not consecutive", keep, drop)
+	}
+	sibling := table.share()
+	execed := table.exec()
+	if _, ok := execed.get(drop); ok || dropped.refs != 1 {
+		t.Errorf("close-on-exec fd survived exec, refs=%d", dropped.refs)
+	}
+	if _, ok := execed.get(keep); !ok || kept.refs != 2 {
+		t.Errorf("fd lost at exec, refs=%d", kept.refs)
+	}
+	if _, ok := sibling.get(drop); !ok {
+		t.Error("exec changed a table it no longer shares")
+	}
+	if fd := execed.add(kept, fdBase, false); fd != drop {
+		t.Errorf("add after exec = %d, want %d", fd, drop)
+	}
+}
+
+type nopFile struct{ vfs.File }
+
+func (nopFile) Close() error { return nil }
+
+func TestExec(t *testing.T) {
+	echo, err := os.ReadFile("/bin/echo")
+	if err != nil {
+		t.Skip(err)
+	}
+	const script = `/mem/bin/echo from memfs
+/mem/bin/script one two
+/opt/echo remapped
+/usr/bin/fake rewritten
+printenv SECRET || echo no secret
+printenv KEEP
+/mem/bin/plain || echo not executable`
+	for name, opts := range map[string][]Option{
+		"seccomp":    {WithSeccomp(true)},
+		"no seccomp": {WithSeccomp(false)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mem := memfs.New()
+			mem.Mkdir("bin", 0o755)
+			for name, data := range map[string][]byte{
+				"bin/echo":   echo,
+				"bin/script": []byte("#!/bin/sh\necho script \"$0\" \"$@\"\n"),
+				"bin/plain":  []byte("#!/bin/sh\n"),
+			} {
+				perm := fs.FileMode(0o755)
+				if name == "bin/plain" {
+					perm = 0o644
+				}
+				f, _ := mem.Open(name, os.O_WRONLY|os.O_CREATE, perm)
+				f.Write(data)
+				f.Close()
+			}
+			var stdout bytes.Buffer
+			cmd := exec.Command("/bin/sh", "-c", script)
+			cmd.Env = append(os.Environ(), "SECRET=hunter2", "KEEP=kept")
+			cmd.Stdout = &stdout
+			opts := append(opts, WithMount("/mem", mem),
+				WithRemap(Remap{From: "/opt/echo", To: "/mem/bin/echo"}),
+				WithExec(func(e *Exec) {
+					if e.Path == "/usr/bin/fake" {
+						e.Path = "/bin/echo"
+						e.Argv = append(e.Argv, "and extended")
+					}
+					e.Env = slices.DeleteFunc(e.Env, func(kv string) bool { return strings.HasPrefix(kv, "SECRET=") })
+				}))
+			if err := New(cmd, opts...).Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			want := "from memfs\nscript /mem/bin/script one two\nremapped\nrewritten and extended\nno secret\nkept\nnot executable\n"
+			if got := stdout.String(); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+	t.Run("unotify", func(t *testing.T) {
+		mem := memfs.New()
+		f, _ := mem.Open("echo", os.O_WRONLY|os.O_CREATE, 0o755)
+		f.Write(echo)
+		f.Close()
+		var stdout bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", "/mem/echo virtual 2>/dev/null || echo failed; /bin/echo real")
+		cmd.Stdout = &stdout
+		if err := New(cmd, WithEngine(EngineUnotify), WithMount("/mem", mem)).Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := stdout.String(), "failed\nreal\n"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+}
+
+func TestThreads(t *testing.T) {
+	m := memfs.New()
+	f, _ := m.Open("data", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Write([]byte("threaded"))
+	f.Close()
+
+	var stdout, stderr bytes.Buffer
+	cmd := helperCommand(t, "threads", "/mem/data")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := New(cmd, WithMount("/mem", m)).Run(context.Background()); err != nil {
+		t.Fatalf("%v: %s", err, stderr.String())
+	}
+	if got, want := stdout.String(), strings.Repeat("threaded\n", 4); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExecFromThread(t *testing.T) {
+	m := memfs.New()
+	f, _ := m.Open("data", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Write([]byte("after exec"))
+	f.Close()
+
+	var stdout, stderr bytes.Buffer
+	cmd := helperCommand(t, "execThread", "/bin/cat", "/mem/data")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := New(cmd, WithMount("/mem", m)).Run(context.Background()); err != nil {
+		t.Fatalf("%v: %s", err, stderr.String())
+	}
+	if got := stdout.String(); got != "after exec" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSeccompFastPath(t *testing.T) {
+	stops := map[bool]int{}
+	for _, enabled := range []bool{true, false} {
+		tr := New(helperCommand(t, "getpid"), WithSeccomp(enabled))
+		if err := tr.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if tr.seccomp != enabled {
+			t.Fatalf("WithSeccomp(%v): filter installed = %v", enabled, tr.seccomp)
+		}
+		stops[enabled] = tr.stops
+	}
+	if stops[false] < 2000 {
+		t.Errorf("expected every getpid to stop without seccomp, got %d stops", stops[false])
+	}
+	if stops[true] > stops[false]/4 {
+		t.Errorf("seccomp: %d stops, without: %d", stops[true], stops[false])
+	}
+}
+
+func TestWithoutSeccomp(t *testing.T) {
+	m := memfs.New()
+	cmd := exec.Command("/usr/bin/tee", "/mem/out")
+	cmd.Stdin = strings.NewReader("slow path")
+	if err := New(cmd, WithMount("/mem", m), WithSeccomp(false)).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := m.Stat("out")
+	if err != nil || fi.Size() != int64(len("slow path")) {
+		t.Errorf("stat: %v, %v", fi, err)
+	}
+}
+
+func TestSeccompFilter(t *testing.T) {
+	prog := seccompFilter([]uint64{unix.SYS_READ, unix.SYS_MMAP, unix.SYS_OPENAT}, unix.SECCOMP_RET_TRACE, false)
+	for _, tt := range []struct {
+		arch uint32
+		nr   uint32
+		want uint32
+		// flags is the fourth argument, which holds mmap's flags.
+		flags uint32
+	}{
+		{auditArch, unix.SYS_READ, unix.SECCOMP_RET_TRACE, 0},
+		{auditArch, unix.SYS_OPENAT, unix.SECCOMP_RET_TRACE, 0},
+		{auditArch, unix.SYS_GETPID, unix.SECCOMP_RET_ALLOW, 0},
+		{auditArch, unix.SYS_MMAP, unix.SECCOMP_RET_TRACE, unix.MAP_PRIVATE},
+		{auditArch, unix.SYS_MMAP, unix.SECCOMP_RET_ALLOW, unix.MAP_PRIVATE | unix.MAP_ANONYMOUS},
+		{auditArch, x32Bit | unix.SYS_GETPID, unix.SECCOMP_RET_TRACE, 0},
+		{unix.AUDIT_ARCH_I386, 3, unix.SECCOMP_RET_TRACE, 0},                                      // read
+		{unix.AUDIT_ARCH_I386, 295, unix.SECCOMP_RET_TRACE, 0},                                    // openat
+		{unix.AUDIT_ARCH_I386, 20, unix.SECCOMP_RET_ALLOW, 0},                                     // getpid
+		{unix.AUDIT_ARCH_I386, 192, unix.SECCOMP_RET_TRACE, unix.MAP_SHARED},                      // mmap2
+		{unix.AUDIT_ARCH_I386, 192, unix.SECCOMP_RET_ALLOW, unix.MAP_SHARED | unix.MAP_ANONYMOUS}, // mmap2
+		{unix.AUDIT_ARCH_PPC64, unix.SYS_GETPID, unix.SECCOMP_RET_TRACE, 0},
+	} {
+		if compatArch == 0 && tt.arch == unix.AUDIT_ARCH_I386 {
+			continue
+		}
+		if got := runFilter(t, prog, tt.arch, tt.nr, tt.flags); got != tt.want {
+			t.Errorf("arch %#x nr %d: got %#x, want %#x", tt.arch, tt.nr, got, tt.want)
+		}
+	}
+
+	// Pinning paths also traps anonymous mappings at fixed addresses.
+	prog = seccompFilter([]uint64{unix.SYS_MMAP}, unix.SECCOMP_RET_TRACE, true)
+	for flags, want := range map[uint32]uint32{
+		unix.MAP_PRIVATE | unix.MAP_ANONYMOUS:                  unix.SECCOMP_RET_ALLOW,
+		unix.MAP_PRIVATE | unix.MAP_ANONYMOUS | unix.MAP_FIXED: unix.SECCOMP_RET_TRACE,
+		unix.MAP_PRIVATE | unix.MAP_FIXED:                      unix.SECCOMP_RET_TRACE,
+	} {
+		if got := runFilter(t, prog, auditArch, unix.SYS_MMAP, flags); got != want {
+			t.Errorf("mmap flags %#x: got %#x, want %#x", flags, got, want)
+		}
+	}
+}
+
+// runFilter interprets the subset of classic BPF that seccompFilter emits.
+func runFilter(t *testing.T, prog []unix.SockFilter, arch, nr, arg3 uint32) uint32 {
+	var acc uint32
+	for pc := 0; pc < len(prog); pc++ {
+		ins := prog[pc]
+		switch ins.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			acc = map[uint32]uint32{0: nr, 4: arch, 16 + 3*8: arg3}[ins.K]
+		case unix.BPF_JMP | unix.BPF_JA:
+			pc += int(ins.K)
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K,
+			unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K:
+			jump := acc == ins.K
+			switch ins.Code &^ (unix.BPF_JMP | unix.BPF_K) {
+			case unix.BPF_JGE:
+				jump = acc >= ins.K
+			case unix.BPF_JSET:
+				jump = acc&ins.K != 0
+			}
+			if jump {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case unix.BPF_RET | unix.BPF_K:
+			return ins.K
+		default:
+			t.Fatalf("unexpected instruction %+v", ins)
+		}
+	}
+	t.Fatal("program fell off the end")
+	return 0
+}
+
+func TestCompat32(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("i386 compat is only translated on amd64")
+	}
+	m := memfs.New()
+	f, _ := m.Open("data", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Write([]byte("compat\n"))
+	f.Close()
+
+	for name, opts := range map[string][]Option{
+		"seccomp":  nil,
+		"nofilter": {WithSeccomp(false)},
+		"unotify":  {WithEngine(EngineUnotify)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			cmd := exec.Command("testdata/compat32", "/mem/data")
+			cmd.Stdout = &stdout
+			tr := New(cmd, append(opts, WithMount("/mem", m))...)
+			err := tr.Run(context.Background())
+			// The program exits with the size fstat64 reported.
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) || exitErr.ExitCode() != len("compat\n") {
+				t.Fatalf("got %v, want exit status %d", err, len("compat\n"))
+			}
+			if got := stdout.String(); got != "compat\npat\nompat\n" {
+				t.Errorf("got %q", got)
+			}
+			if name == "seccomp" && !tr.seccomp {
+				t.Error("filter not installed in a 32-bit tracee")
+			}
+			if name == "unotify" && tr.engine != EngineUnotify {
+				t.Error("fell back to ptrace for a 32-bit tracee")
+			}
+		})
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	c := Capabilities()
+	if c.Ptrace != nil || c.Seccomp != nil {
+		t.Fatalf("ptrace: %v; seccomp: %v", c.Ptrace, c.Seccomp)
+	}
+	best := EngineUnotify
+	if c.SeccompNotify != nil || c.ProcessVM != nil {
+		best = EnginePtrace
+	}
+	for _, r := range []struct {
+		opts []Option
+		want Engine
+	}{
+		{nil, best},
+		{[]Option{WithPinnedPaths()}, EnginePtrace},
+		{[]Option{WithSeccomp(false)}, EnginePtrace},
+	} {
+		tr := New(exec.Command("/bin/true"), append(r.opts, WithEngine(EngineAuto))...)
+		if err := tr.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if tr.engine != r.want {
+			t.Errorf("EngineAuto with %d options chose engine %d, want %d", len(r.opts), tr.engine, r.want)
+		}
+	}
+
+	// A tracer that cannot trace says so.
+	var stdout bytes.Buffer
+	cmd := helperCommand(t, "nested")
+	cmd.Stdout = &stdout
+	if err := New(cmd, WithPolicy(Rule{Syscall: unix.SYS_PTRACE})).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != "ptrace\n" {
+		t.Errorf("nested tracer failed with %q", got)
+	}
+}
+
+func TestSeccompUnprivileged(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to start a tracee as another user")
+	}
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/cat", "/etc/hostname")
+	cmd.Stdout = &stdout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+	tr := New(cmd)
+	if err := tr.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !tr.seccomp || stdout.Len() == 0 {
+		t.Errorf("seccomp = %v, output %q", tr.seccomp, stdout.String())
+	}
+}
+
+func TestUnotify(t *testing.T) {
+	m := memfs.New()
+	write := exec.Command("/usr/bin/tee", "/mem/note.txt")
+	write.Stdin = strings.NewReader("via notifications\n")
+	tr := New(write, WithMount("/mem", m), WithEngine(EngineUnotify))
+	if err := tr.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if tr.engine != EngineUnotify {
+		t.Fatal("fell back to ptrace")
+	}
+	if tr.stops == 0 {
+		t.Error("no notifications serviced")
+	}
+	var stdout bytes.Buffer
+	read := exec.Command("/bin/sh", "-c", "cat /mem/note.txt; cat /mem/note.txt")
+	read.Stdout = &stdout
+	if err := New(read, WithMount("/mem", m), WithEngine(EngineUnotify)).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), strings.Repeat("via notifications\n", 2); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	const script = `echo hi >/mem/out; cat </mem/out
+exec 3>>/mem/out; echo more >&3; exec 4<&3 3>&-; echo again >&4
+cat /mem/out`
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		t.Run(name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			cmd := exec.Command("/bin/sh", "-c", script)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			if err := New(cmd, WithMount("/mem", memfs.New()), WithEngine(engine)).Run(context.Background()); err != nil {
+				t.Fatalf("%v: %s", err, stderr.String())
+			}
+			if got, want := stdout.String(), "hi\nhi\nmore\nagain\n"; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestMutations(t *testing.T) {
+	const script = `set -e
+mkdir /mem/d
+echo data >/mem/d/a
+mv /mem/d/a /mem/d/b
+ln /mem/d/b /mem/d/hard
+ln -s b /mem/d/soft
+readlink /mem/d/soft
+cat /mem/d/soft
+rm /mem/d/b
+ls /mem/d
+if ln /mem/d/hard /tmp/cross 2>/dev/null; then echo crossed; fi
+rm /mem/d/hard /mem/d/soft
+rmdir /mem/d`
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		t.Run(name, func(t *testing.T) {
+			m := memfs.New()
+			var stdout, stderr bytes.Buffer
+			cmd := exec.Command("/bin/sh", "-c", script)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			if err := New(cmd, WithMount("/mem", m), WithEngine(engine)).Run(context.Background()); err != nil {
+				t.Fatalf("%v: %s", err, stderr.String())
+			}
+			if got, want := stdout.String(), "b\ndata\nhard\nsoft\n"; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			if entries, err := m.ReadDir("."); err != nil || len(entries) != 0 {
+				t.Errorf("backend left with %v, %v", entries, err)
+			}
+		})
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	const script = `ro=$1 rw=$2
+echo a >$rw/a && echo wrote
+echo b >$ro/b || echo denied create
+rm $ro/keep || echo denied rm
+chmod 600 $ro/keep || echo denied chmod
+ln -s $ro/keep $rw/link && { echo b >$rw/link || echo denied link; }
+mv $ro/keep $rw/keep || echo denied mv
+echo c >/mem/c || echo denied mount`
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		t.Run(name, func(t *testing.T) {
+			ro, rw := t.TempDir(), t.TempDir()
+			keep := filepath.Join(ro, "keep")
+			if err := os.WriteFile(keep, []byte("kept\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var stdout bytes.Buffer
+			cmd := exec.Command("/bin/sh", "-c", script, "sh", ro, rw)
+			cmd.Stdout = &stdout
+			tr := New(cmd, WithEngine(engine), WithMount("/mem", memfs.New()), WithReadOnly(rw))
+			if err := tr.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			want := "wrote\ndenied create\ndenied rm\ndenied chmod\ndenied link\ndenied mv\ndenied mount\n"
+			if got := stdout.String(); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			if fi, err := os.Stat(keep); err != nil || fi.Mode().Perm() != 0o644 {
+				t.Errorf("protected file: %v, %v", fi, err)
+			}
+			if b, _ := os.ReadFile(keep); string(b) != "kept\n" {
+				t.Errorf("protected file has %q", b)
+			}
+			if _, err := os.Stat(filepath.Join(ro, "b")); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("file created in a read-only directory: %v", err)
+			}
+		})
+	}
+}
+
+func TestLandlock(t *testing.T) {
+	if abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION); errno != 0 || abi < 2 {
+		t.Skip("no Landlock ABI 2")
+	}
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		for _, on := range []bool{true, false} {
+			ro, rw := t.TempDir(), t.TempDir()
+			run := func(file string) string {
+				var stdout, stderr bytes.Buffer
+				cmd := helperCommand(t, "uringcreate", file)
+				cmd.Stdout, cmd.Stderr = &stdout, &stderr
+				tr := New(cmd, WithEngine(engine), WithReadOnly(rw), WithLandlock(on))
+				if err := tr.Run(context.Background()); err != nil {
+					t.Fatalf("%v: %s", err, stderr.String())
+				}
+				return stdout.String()
+			}
+			if got := run(filepath.Join(rw, "a")); got != "created\n" {
+				t.Errorf("%s, landlock %v: writable directory: got %q", name, on, got)
+			}
+			// The tracer never sees the ring's openat.
+			want := "created\n"
+			if on {
+				want = "permission denied\n"
+			}
+			if got := run(filepath.Join(ro, "b")); got != want {
+				t.Errorf("%s, landlock %v: read-only directory: got %q, want %q", name, on, got, want)
+			}
+		}
+	}
+}
+
+func TestPathRules(t *testing.T) {
+	const script = `home=$1 etc=$2
+cat $home/u/.ssh/id || echo hidden
+ls $home/u/.ssh/ >/dev/null 2>&1 || echo hidden dir
+cd $home/u && { cat .ssh/id || echo hidden relative; }
+cat $home/u/notes
+cat $etc/conf
+echo x >>$etc/conf || echo read-only
+rm $etc/conf || echo read-only rm
+cat $etc/secret || echo denied
+ln -s $etc/secret $home/u/link && { cat $home/u/link || echo denied link; }
+cat /mem/key || echo hidden mount
+cat /mem/open`
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		t.Run(name, func(t *testing.T) {
+			home, etc := t.TempDir(), t.TempDir()
+			ssh := filepath.Join(home, "u", ".ssh")
+			os.MkdirAll(ssh, 0o755)
+			os.WriteFile(filepath.Join(ssh, "id"), []byte("private\n"), 0o600)
+			os.WriteFile(filepath.Join(home, "u", "notes"), []byte("notes\n"), 0o644)
+			os.WriteFile(filepath.Join(etc, "conf"), []byte("conf\n"), 0o644)
+			os.WriteFile(filepath.Join(etc, "secret"), []byte("secret\n"), 0o644)
+			mem := memfs.New()
+			for _, name := range []string{"key", "open"} {
+				f, _ := mem.Open(name, os.O_WRONLY|os.O_CREATE, 0o644)
+				f.Write([]byte(name + "\n"))
+				f.Close()
+			}
+			var stdout bytes.Buffer
+			cmd := exec.Command("/bin/sh", "-c", script, "sh", home, etc)
+			cmd.Stdout = &stdout
+			tr := New(cmd, WithEngine(engine), WithMount("/mem", mem), WithPathRules(
+				PathRule{Pattern: home + "/*/.ssh", Access: Hide},
+				PathRule{Pattern: etc + "/secret", Access: Deny},
+				PathRule{Pattern: etc, Access: ReadOnly},
+				PathRule{Pattern: "/mem/key", Access: Hide},
+			))
+			if err := tr.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			want := "hidden\nhidden dir\nhidden relative\nnotes\nconf\nread-only\nread-only rm\ndenied\ndenied link\nhidden mount\nopen\n"
+			if got := stdout.String(); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			if b, _ := os.ReadFile(filepath.Join(etc, "conf")); string(b) != "conf\n" {
+				t.Errorf("read-only file has %q", b)
+			}
+		})
+	}
+}
+
+// TestPathRulesProcFD checks that a path through a descriptor's link in
+// /proc is matched where it leads in the command, not in the tracer.
+func TestPathRulesProcFD(t *testing.T) {
+	const script = `exec 3<$1
+cat /proc/self/fd/3/.ssh/id || echo hidden self
+cat /proc/thread-self/fd/3/.ssh/id || echo hidden thread-self
+cat /dev/fd/3/.ssh/id || echo hidden dev
+cat /proc/$$/fd/3/.ssh/id || echo hidden pid
+stat /proc/self/fd/3/.ssh/id >/dev/null 2>&1 || echo hidden stat`
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		t.Run(name, func(t *testing.T) {
+			home := t.TempDir()
+			os.Mkdir(filepath.Join(home, ".ssh"), 0o755)
+			os.WriteFile(filepath.Join(home, ".ssh", "id"), []byte("private\n"), 0o600)
+			var stdout bytes.Buffer
+			cmd := exec.Command("/bin/sh", "-c", script, "sh", home)
+			cmd.Stdout = &stdout
+			tr := New(cmd, WithEngine(engine), WithPathRules(PathRule{Pattern: home + "/.ssh", Access: Hide}))
+			if err := tr.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			want := "hidden self\nhidden thread-self\nhidden dev\nhidden pid\nhidden stat\n"
+			if got := stdout.String(); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestIOURing(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		for _, on := range []bool{true, false} {
+			var stdout, stderr bytes.Buffer
+			cmd := helperCommand(t, "iouring")
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			tr := New(cmd, WithEngine(engine), WithMount("/mem", memfs.New()), WithIOURing(on))
+			events := tr.Events()
+			done := make(chan []uint64)
+			go func() {
+				var denied []uint64
+				for e := range events {
+					if e, ok := e.(*SyscallDenied); ok {
+						denied = append(denied, e.Syscall)
+					}
+				}
+				done <- denied
+			}()
+			if err := tr.Run(context.Background()); err != nil {
+				t.Fatalf("%v: %s", err, stderr.String())
+			}
+			denied := <-done
+			if on {
+				// Whether the ring is set up is up to the kernel.
+				if len(denied) != 0 {
+					t.Errorf("%s: denied %v with io_uring on", name, denied)
+				}
+				continue
+			}
+			if got, want := stdout.String(), "function not implemented\n"; got != want {
+				t.Errorf("%s: got %q, want %q", name, got, want)
+			}
+			if !slices.Equal(denied, []uint64{unix.SYS_IO_URING_SETUP}) {
+				t.Errorf("%s: denied %v", name, denied)
+			}
+		}
+	}
+}
+
+func TestLocks(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		m := memfs.New()
+		f, _ := m.Open("db", os.O_WRONLY|os.O_CREATE, 0o644)
+		f.Write([]byte("0123456789abcdef"))
+		f.Close()
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "locks", "/mem/db")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, WithEngine(engine), WithMount("/mem", m)).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		want := "resource temporarily unavailable\ntrue 0 10 true\n<nil>\nresource temporarily unavailable\nclosing\n<nil>\n<nil>\n"
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestDecisionCache(t *testing.T) {
+	// What a path leads to changes as the command links and renames, or
+	// reopens a descriptor, and the shell's decisions made before are not
+	// used after.
+	const script = `dir=$1
+[ -r $dir/public ] && [ -r $dir/public ] && echo public
+[ -e $dir/link ] || echo no link
+ln -s $dir/secret $dir/link
+[ -r $dir/link ] || echo denied link
+rm $dir/link && ln -s $dir/public $dir/link
+[ -r $dir/link ] && echo public link
+cd /mem && [ -e open ] && [ -e open ] && echo open
+mv open moved
+[ -e open ] || echo moved
+exec 3<$dir/d
+[ -r /proc/self/fd/3/f ] && [ -r /proc/self/fd/3/f ] && echo fd
+exec 3<$dir/d/secret
+[ -r /proc/self/fd/3/f ] || echo denied fd`
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			os.WriteFile(filepath.Join(dir, "public"), []byte("public\n"), 0o644)
+			os.WriteFile(filepath.Join(dir, "secret"), []byte("secret\n"), 0o644)
+			os.MkdirAll(filepath.Join(dir, "d", "secret"), 0o755)
+			os.WriteFile(filepath.Join(dir, "d", "f"), nil, 0o644)
+			os.WriteFile(filepath.Join(dir, "d", "secret", "f"), nil, 0o644)
+			mem := memfs.New()
+			writeFile(mem, "open", []byte("open\n"))
+			var stdout bytes.Buffer
+			cmd := exec.Command("/bin/sh", "-c", script, "sh", dir)
+			cmd.Stdout = &stdout
+			m := NewMetrics()
+			tr := New(cmd, WithEngine(engine), WithMount("/mem", mem), WithDecisionCache(64), WithMetrics(m),
+				WithPathRules(PathRule{Pattern: filepath.Join(dir, "secret"), Access: Deny},
+					PathRule{Pattern: filepath.Join(dir, "d", "secret", "f"), Access: Deny}))
+			if err := tr.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			want := "public\nno link\ndenied link\npublic link\nopen\nmoved\nfd\ndenied fd\n"
+			if got := stdout.String(); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			var body strings.Builder
+			m.WriteTo(&body)
+			if strings.Contains(body.String(), "cfc_ptrace_decision_cache_hits_total 0\n") {
+				t.Errorf("no hits in\n%s", body.String())
+			}
+		})
+	}
+}
+
+func TestDecisionCacheShared(t *testing.T) {
+	// Another writer points a symlink in the shared tree elsewhere while
+	// the shell waits, and the shell's decisions of where it led go.
+	const script = `cd /mem
+[ -e link/a ] && [ -e link/a ] && echo a
+read x
+[ -e link/a ] || echo moved`
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		t.Run(name, func(t *testing.T) {
+			mem := memfs.New()
+			mem.Mkdir("a", 0o755)
+			mem.Mkdir("b", 0o755)
+			writeFile(mem, "a/a", nil)
+			mem.Symlink("a", "link")
+			s := shared.New(mem)
+			stdin, toStdin, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			fromStdout, stdout, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stdin.Close()
+			defer toStdin.Close()
+			defer fromStdout.Close()
+			cmd := exec.Command("/bin/sh", "-c", script)
+			cmd.Stdin, cmd.Stdout = stdin, stdout
+			tr := New(cmd, WithEngine(engine), WithMount("/mem", s), WithDecisionCache(64))
+			errc := make(chan error, 1)
+			go func() { errc <- tr.Run(context.Background()); stdout.Close() }()
+
+			b := make([]byte, len("a\n"))
+			if _, err := io.ReadFull(fromStdout, b); err != nil || string(b) != "a\n" {
+				t.Fatalf("read %q, %v", b, err)
+			}
+			if err := s.Unlink("link"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Symlink("b", "link"); err != nil {
+				t.Fatal(err)
+			}
+			toStdin.Write([]byte("\n"))
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			if rest, _ := io.ReadAll(fromStdout); string(rest) != "moved\n" {
+				t.Errorf("got %q after the link moved, want %q", rest, "moved\n")
+			}
+		})
+	}
+}
+
+func TestPinnedPaths(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "public"), []byte("public\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "secret"), []byte("secret\n"), 0o644)
+	os.Symlink("/proc/self", filepath.Join(dir, "self"))
+	rule := WithPathRules(PathRule{Pattern: filepath.Join(dir, "secret"), Access: Deny})
+
+	var stdout, stderr bytes.Buffer
+	cmd := helperCommand(t, "pinned")
+	cmd.Dir, cmd.Stdout, cmd.Stderr = dir, &stdout, &stderr
+	if err := New(cmd, rule, WithPinnedPaths()).Run(context.Background()); err != nil {
+		t.Fatalf("%v: %s", err, stderr.String())
+	}
+	want := "0\npermission denied\nopen /proc/self/mem: permission denied\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	cmd = helperCommand(t, "pinned")
+	if err := New(cmd, WithPinnedPaths(), WithEngine(EngineUnotify)).Run(context.Background()); err == nil {
+		t.Error("pinned paths ran under EngineUnotify")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	const script = `ls / >/dev/null 2>&1 || echo ls $?
+ln -s a $1/link 2>/dev/null || echo ln $?
+mkdir $1/d
+echo mkdir $?`
+	rules := []Rule{
+		{Syscall: unix.SYS_EXECVE, Paths: []string{"/usr/bin/ls", "/bin/ls"}, Errno: unix.EACCES},
+		{Syscall: unix.SYS_SYMLINKAT, Errno: unix.ENOSYS},
+		{Syscall: unix.SYS_MKDIRAT, Kill: true},
+	}
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			var stdout bytes.Buffer
+			cmd := exec.Command("/bin/sh", "-c", script, "sh", dir)
+			cmd.Stdout = &stdout
+			if err := New(cmd, WithEngine(engine), WithPolicy(rules...)).Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := stdout.String(), "ls 126\nln 1\nmkdir 137\n"; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("blocked syscalls left %v", entries)
+			}
+		})
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	os.Mkdir(src, 0o755)
+	os.WriteFile(filepath.Join(src, "hosts"), []byte("from config\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "secret"), []byte("secret\n"), 0o644)
+	config := filepath.Join(dir, "cfc.toml")
+	os.WriteFile(config, []byte(`seccomp = true
+io_uring = false
+pin_paths = true
+credentials = "1000:1000"
+read_only = true
+writable = ["/data", "/dev"]
+egress = []
+limits = { inodes = 100, open_files = 64 }
+resolver.hosts = ["10.1.2.3 api.internal"]
+
+[[mount]]
+path = "/data"
+backend = "overlay:src"
+uid = 1234
+gid = 1234
+ops_per_sec = 100000
+
+[[remap]]
+from = "/etc/cfc-hosts"
+to = "/data/hosts"
+
+[[path]]
+pattern = "`+dir+`/secret"
+access = "hide"
+
+[[deny]]
+syscall = "symlinkat"
+errno = "ENOSYS"
+`), 0o644)
+	opt, err := FromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `cat /etc/cfc-hosts
+grep -h api.internal /etc/hosts
+stat -c %u /data/hosts
+test -w /data/hosts || echo not writable
+echo new >/data/new && cat /data/new
+ln -s a /data/link 2>/dev/null || echo ln $?
+echo 2>/dev/null >`+dir+`/outside || echo read-only
+cat `+dir+`/secret 2>/dev/null || echo hidden
+`+os.Args[0]+` 2>&1`)
+	cmd.Stdout = &stdout
+	cmd.Env = append(os.Environ(), helperEnv+"=iouring")
+	if err := New(cmd, opt).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "from config\n10.1.2.3\tapi.internal\n1234\nnot writable\nnew\nln 1\nread-only\nhidden\nfunction not implemented\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(src, "new")); err == nil {
+		t.Error("write reached the overlay's lower layer")
+	}
+
+	for _, bad := range []string{
+		"engine = \"dtrace\"",
+		"io_uring = \"off\"",
+		"pin_paths = 1",
+		"credentials = \"nobody\"",
+		"colour = true",
+		"writable = [\"/tmp\"]",
+		"[[mount]]\nbackend = \"mem\"",
+		"[[mount]]\npath = \"/m\"\nbackend = \"tape\"",
+		"[[mount]]\npath = \"/m\"\nuid = 1",
+		"[[mount]]\npath = \"/m\"\nbytes_per_sec = -1",
+		"[mount]\npath = \"/m\"",
+		"[[deny]]\nsyscall = \"nosuchcall\"",
+		"[[deny]]\nsyscall = \"mount\"\nerrno = \"ENOTANERRNO\"",
+		"[[deny]]\nsyscall = \"mount\"\npaths = [\"/bin/sh\"]",
+		"[[deny]]\nsyscall = \"mount\"\nerrno = \"EPERM\"\nkill = true",
+		"limits = 1",
+		"[limits]\nbytes = -1",
+		"[limits]\nopen_files = \"many\"",
+		"[limits]\nfiles = 1",
+		"[[path]]\naccess = \"hide\"",
+		"[[path]]\npattern = \"/etc\"\naccess = \"write\"",
+		"[[path]]\npattern = \"etc\"\naccess = \"deny\"",
+		"[[redirect]]\nfrom = \"localhost:80\"\nto = \"unix:/s\"",
+		"[[redirect]]\nfrom = \"*:80\"\nto = \"unix:s\"",
+		"[[redirect]]\nfrom = \"*:80\"",
+		"[resolver]\nhosts = [\"api.internal\"]",
+		"[resolver]\nhosts = [\"host 1.2.3.4\"]",
+		"[resolver]\nnameservers = [\"ns.example\"]",
+		"[resolver]\nttl = 60",
+		"egress = [\"10.0.0.0/8\"]",
+		"egress = [\"10.0.0.0/8:99999\"]",
+		"egress = \"*:*\"",
+		"random_seed = 010",
+		"random_seed = 1.5",
+	} {
+		os.WriteFile(config, []byte(bad), 0o644)
+		if _, err := FromConfig(config); err == nil {
+			t.Errorf("%q loaded", bad)
+		}
+	}
+	if _, err := FromConfig(filepath.Join(dir, "missing.toml")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	var out bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `
+		dd if=/dev/zero of=/mem/a bs=500 count=1 2>/dev/null && echo a
+		dd if=/dev/zero of=/mem/big bs=700 count=1 2>&1 | grep -o 'File too large'
+		dd if=/dev/zero of=/mem/b bs=300 count=2 2>&1 | grep -o 'No space left on device'
+		mkdir /mem/d 2>&1 | grep -o 'No space left on device'
+		rm /mem/b && mkdir /mem/d && echo d
+		(exec 3</mem/a 4</mem/a 5</mem/a) 2>&1 | grep -o 'Too many open files'
+		rm /mem/a /mem/big && head -c 600 /dev/zero >/mem/d/full && echo full`)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := New(cmd, WithMount("/mem", memfs.New()), WithLimits(Limits{
+		Bytes: 1000, FileSize: 600, Inodes: 3, OpenFiles: 2,
+	})).Run(context.Background())
+	if err != nil {
+		t.Fatalf("%v: %s", err, out.String())
+	}
+	want := "a\nFile too large\nNo space left on device\nNo space left on device\nd\nToo many open files\nfull\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			m := memfs.New()
+			f, _ := m.Open("big", os.O_WRONLY|os.O_CREATE, 0o644)
+			f.Write([]byte("big\n"))
+			f.Close()
+			var out bytes.Buffer
+			cmd := exec.Command("/bin/sh", "-c", `
+				for i in 1 2 3 4 5; do echo $i >>$0/a.log || echo failed $i; done
+				echo 6 >$0/other
+				cat $0/a.log /mem/big /mem/big`, dir)
+			cmd.Stdout, cmd.Stderr = &out, &out
+			err := New(cmd, WithEngine(engine), WithMount("/mem", m), WithFaults(
+				Fault{Syscall: unix.SYS_WRITE, Path: "*.log", Errno: unix.ENOSPC, Every: 2},
+				Fault{Syscall: unix.SYS_OPENAT, Path: "/mem/big", Limit: 1},
+			)).Run(context.Background())
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("%v: %s", err, out.String())
+			}
+			for _, want := range []string{"failed 2\n", "failed 4\n", "1\n3\n5\n", "/mem/big: Input/output error", "big\n"} {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("output lacks %q:\n%s", want, out.String())
+				}
+			}
+			if b, err := os.ReadFile(dir + "/other"); err != nil || string(b) != "6\n" {
+				t.Errorf("other file: %q, %v", b, err)
+			}
+		})
+	}
+}
+
+func TestDelays(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		t.Run(name, func(t *testing.T) {
+			m := memfs.New()
+			for _, name := range []string{"slow", "fast"} {
+				f, _ := m.Open(name, os.O_WRONLY|os.O_CREATE, 0o644)
+				f.Write([]byte(name + "\n"))
+				f.Close()
+			}
+			const delay = 300 * time.Millisecond
+			var out bytes.Buffer
+			cmd := exec.Command("/bin/sh", "-c", `cat /mem/slow & cat /mem/fast; wait`)
+			cmd.Stdout, cmd.Stderr = &out, &out
+			start := time.Now()
+			err := New(cmd, WithEngine(engine), WithMount("/mem", m), WithDelays(
+				Delay{Syscall: unix.SYS_OPENAT, Path: "slow", Sample: func() time.Duration { return delay }},
+			)).Run(context.Background())
+			if err != nil {
+				t.Fatalf("%v: %s", err, out.String())
+			}
+			// The held cat must not hold up the other one.
+			if out.String() != "fast\nslow\n" {
+				t.Errorf("output %q", out.String())
+			}
+			if elapsed := time.Since(start); elapsed < delay {
+				t.Errorf("ran in %v, want at least %v", elapsed, delay)
+			}
+		})
+	}
+}
+
+func TestHooks(t *testing.T) {
+	const script = `echo hello
+cat /nonexistent/mem/data
+cat /etc/hostname 2>/dev/null || echo hidden`
+	for name, seccomp := range map[string]bool{"seccomp": true, "noseccomp": false} {
+		t.Run(name, func(t *testing.T) {
+			m := memfs.New()
+			f, _ := m.Open("data", os.O_WRONLY|os.O_CREATE, 0o644)
+			f.Write([]byte("virtual\n"))
+			f.Close()
+
+			var virtualFD int64
+			shout := func(s *Syscall) {
+				if b, err := s.ReadMemory(uintptr(s.Args[1]), 5); err == nil && string(b) == "hello" {
+					if err := s.WriteMemory(uintptr(s.Args[1]), []byte("HELLO")); err != nil {
+						t.Errorf("WriteMemory: %v", err)
+					}
+				}
+			}
+			redirect := func(s *Syscall) {
+				// Point the path at its own suffix, /mem/data.
+				if p, _ := s.ReadString(uintptr(s.Args[1])); p == "/nonexistent/mem/data" {
+					if err := s.SetArg(1, s.Args[1]+uint64(len("/nonexistent"))); err != nil {
+						t.Errorf("SetArg: %v", err)
+					}
+				}
+			}
+			result := func(s *Syscall) {
+				switch p, _ := s.ReadString(uintptr(s.Args[1])); p {
+				case "/etc/hostname":
+					s.SetReturn(-int64(unix.ENOENT))
+				case "/mem/data":
+					virtualFD = s.Ret
+				}
+			}
+			var stdout, stderr bytes.Buffer
+			cmd := exec.Command("/bin/sh", "-c", script)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			tr := New(cmd, WithSeccomp(seccomp), WithMount("/mem", m),
+				OnSyscallEnter(shout, unix.SYS_WRITE),
+				OnSyscallEnter(redirect, unix.SYS_OPENAT),
+				OnSyscallExit(result, unix.SYS_OPENAT))
+			if err := tr.Run(context.Background()); err != nil {
+				t.Fatalf("%v: %s", err, stderr.String())
+			}
+			if got, want := stdout.String(), "HELLO\nvirtual\nhidden\n"; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			if virtualFD < fdBase {
+				t.Errorf("exit hook saw %d for a virtual open", virtualFD)
+			}
+		})
+	}
+}
+
+func TestScratch(t *testing.T) {
+	long := "/mem/" + strings.Repeat("d", 200)
+	for name, seccomp := range map[string]bool{"seccomp": true, "noseccomp": false} {
+		t.Run(name, func(t *testing.T) {
+			m := memfs.New()
+			f, _ := m.Open(long[len("/mem/"):], os.O_WRONLY|os.O_CREATE, 0o644)
+			f.Write([]byte("long\n"))
+			f.Close()
+
+			var used []uintptr
+			lengthen := func(s *Syscall) {
+				if p, _ := s.ReadString(uintptr(s.Args[1])); p != "/x" {
+					return
+				}
+				addr, err := s.WriteScratchString(long)
+				if err != nil {
+					t.Errorf("WriteScratchString: %v", err)
+					return
+				}
+				used = append(used, addr)
+				s.SetArg(1, uint64(addr))
+			}
+			free := func(s *Syscall) {
+				if i := slices.Index(used, uintptr(s.Args[1])); i >= 0 {
+					s.Free(used[i])
+				}
+			}
+			var stdout, stderr bytes.Buffer
+			// The second cat runs after two more execs, each of which
+			// must map fresh scratch memory.
+			cmd := exec.Command("/bin/sh", "-c", `cat /x; /bin/sh -c "cat /x"`)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			tr := New(cmd, WithSeccomp(seccomp), WithMount("/mem", m),
+				OnSyscallEnter(lengthen, unix.SYS_OPENAT),
+				OnSyscallExit(free, unix.SYS_OPENAT))
+			if err := tr.Run(context.Background()); err != nil {
+				t.Fatalf("%v: %s", err, stderr.String())
+			}
+			if got := stdout.String(); got != "long\nlong\n" {
+				t.Errorf("got %q: %s", got, stderr.String())
+			}
+		})
+	}
+}
+
+func TestTrace(t *testing.T) {
+	m := memfs.New()
+	f, _ := m.Open("data", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Write([]byte("virtual\n"))
+	f.Close()
+	run := func(t *testing.T, format TraceFormat, opts ...Option) string {
+		var trace, stderr bytes.Buffer
+		cmd := exec.Command("/bin/cat", "/mem/data", "/mem/missing")
+		cmd.Stderr = &stderr
+		opts = append(opts, WithMount("/mem", m), WithTraceWriter(&trace, format))
+		var exitErr *exec.ExitError
+		if err := New(cmd, opts...).Run(context.Background()); !errors.As(err, &exitErr) {
+			t.Fatalf("%v: %s", err, stderr.String())
+		}
+		return trace.String()
+	}
+
+	t.Run("text", func(t *testing.T) {
+		trace := run(t, TraceText)
+		for _, want := range []string{
+			fmt.Sprintf(`openat(AT_FDCWD, "/mem/data", O_RDONLY) = %d <`, fdBase),
+			fmt.Sprintf(`read(%d, "virtual\n", 131072) = 8 <`, fdBase),
+			`openat(AT_FDCWD, "/mem/missing", O_RDONLY) = -1 ENOENT (No such file or directory) <`,
+		} {
+			if !strings.Contains(trace, want) {
+				t.Errorf("trace lacks %q:\n%s", want, trace)
+			}
+		}
+	})
+
+	t.Run("unotify", func(t *testing.T) {
+		var opened, written bool
+		for _, line := range strings.Split(strings.TrimSpace(run(t, TraceJSON, WithEngine(EngineUnotify))), "\n") {
+			var rec TraceRecord
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatalf("%q: %v", line, err)
+			}
+			switch {
+			case rec.Syscall == "openat" && rec.Args[1] == `"/mem/data"`:
+				// The engine's descriptors are placed low, for the
+				// kernel to map.
+				opened = rec.Ret != nil && *rec.Ret == 3
+			case rec.Syscall == "write" && rec.Args[0] == "1":
+				// The kernel handles the write, so the tracer never
+				// learns its result.
+				written = rec.Ret == nil && rec.Args[1] == `"virtual\n"`
+			}
+		}
+		if !opened || !written {
+			t.Errorf("opened %v, written %v", opened, written)
+		}
+	})
+}
+
+func TestEvents(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		t.Run(name, func(t *testing.T) {
+			cmd := exec.Command("/bin/sh", "-c", `echo hi >/mem/f; /bin/sh -c "exit 3"; mkdir /mem/d`)
+			tr := New(cmd, WithEngine(engine), WithMount("/mem", memfs.New()),
+				WithPolicy(Rule{Syscall: unix.SYS_MKDIRAT}))
+			events := tr.Events()
+			done := make(chan []Event)
+			go func() {
+				var all []Event
+				for e := range events {
+					all = append(all, e)
+				}
+				done <- all
+			}()
+			var exitErr *exec.ExitError
+			if err := tr.Run(context.Background()); !errors.As(err, &exitErr) {
+				t.Fatal(err)
+			}
+			all := <-done
+
+			leader := cmd.Process.Pid
+			var children []int
+			for _, e := range all {
+				if e, ok := e.(*ProcessForked); ok {
+					children = append(children, e.Child)
+				}
+			}
+			if len(children) != 2 {
+				t.Fatalf("forked %v", children)
+			}
+			sub, mkdir := children[0], children[1]
+			want := []Event{
+				&FileOpened{Pid: leader, FD: fdBase, Path: "/mem/f", Flags: os.O_WRONLY | os.O_CREATE | os.O_TRUNC},
+				&FileWritten{Pid: leader, FD: 1, Path: "/mem/f", N: 3},
+				&FileClosed{Pid: leader, Path: "/mem/f"},
+				&ProcessForked{Pid: leader, Child: sub},
+				&ProcessExited{Pid: sub, ExitCode: 3},
+				&ProcessForked{Pid: leader, Child: mkdir},
+				&SyscallDenied{Pid: mkdir, Syscall: unix.SYS_MKDIRAT, Errno: unix.EPERM},
+				&ProcessExited{Pid: mkdir, ExitCode: 1},
+				&ProcessExited{Pid: leader, ExitCode: 1},
+			}
+			// Without ptrace, the exits of processes other than the
+			// command are noticed at no particular point.
+			unordered := func(e Event) bool {
+				exited, ok := e.(*ProcessExited)
+				return ok && engine == EngineUnotify && exited.Pid != leader
+			}
+			got := slices.DeleteFunc(all, unordered)
+			want = slices.DeleteFunc(want, unordered)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got:")
+				for _, e := range got {
+					t.Errorf("\t%#v", e)
+				}
+			}
+			if tr.Events() != events {
+				t.Error("Events after Run returned another channel")
+			}
+
+			// Called only once the tracer has started, Events has nothing
+			// to send.
+			tr = New(exec.Command("/bin/true"), WithEngine(engine))
+			if err := tr.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := <-tr.Events(); ok {
+				t.Error("Events after Start sent an event")
+			}
+			tr.Wait()
+		})
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		t.Run(name, func(t *testing.T) {
+			run := func(t *testing.T, m *memfs.FS, opts ...Option) string {
+				var out bytes.Buffer
+				cmd := exec.Command("/bin/sh", "-c", `echo hi >/mem/f; cat /mem/f /mem/seeded; ls /mem; cat /mem/missing`)
+				cmd.Stdout, cmd.Stderr = &out, &out
+				opts = append(opts, WithEngine(engine), WithMount("/mem", m))
+				var exitErr *exec.ExitError
+				if err := New(cmd, opts...).Run(context.Background()); !errors.As(err, &exitErr) {
+					t.Fatalf("%v: %s", err, out.String())
+				}
+				return out.String()
+			}
+			m := memfs.New()
+			f, _ := m.Open("seeded", os.O_WRONLY|os.O_CREATE, 0o644)
+			f.Write([]byte("seeded\n"))
+			f.Close()
+			var recording bytes.Buffer
+			want := run(t, m, WithRecord(&recording))
+			if !strings.Contains(want, "hi\nseeded\nf\nseeded\n") {
+				t.Fatalf("recorded run printed %q", want)
+			}
+			// The replay is given an empty backend, which it must
+			// never consult.
+			if got := run(t, memfs.New(), WithReplay(&recording)); got != want {
+				t.Errorf("replay printed %q, want %q", got, want)
+			}
+		})
+	}
+	if err := New(exec.Command("/bin/true"), WithReplay(strings.NewReader("{"))).Run(context.Background()); err == nil {
+		t.Error("Run succeeded with a malformed recording")
+	}
+}
+
+func TestUnotifyHooks(t *testing.T) {
+	var setArg, scratch error
+	skip := func(s *Syscall) {
+		if b, err := s.ReadMemory(uintptr(s.Args[1]), 6); err == nil && string(b) == "hidden" {
+			setArg = s.SetArg(2, 0)
+			_, scratch = s.WriteScratchString("")
+			s.Skip(int64(s.Args[2]))
+		}
+	}
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", "echo hidden; echo shown")
+	cmd.Stdout = &stdout
+	tr := New(cmd, WithEngine(EngineUnotify), OnSyscallEnter(skip, unix.SYS_WRITE))
+	if err := tr.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != "shown\n" {
+		t.Errorf("got %q", got)
+	}
+	if !errors.Is(setArg, errors.ErrUnsupported) {
+		t.Errorf("SetArg under unotify: got %v", setArg)
+	}
+	if !errors.Is(scratch, errors.ErrUnsupported) {
+		t.Errorf("WriteScratchString under unotify: got %v", scratch)
+	}
+}
+
+func TestUnotifyExitError(t *testing.T) {
+	err := New(exec.Command("/bin/sh", "-c", "exit 3"), WithEngine(EngineUnotify)).Run(context.Background())
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("got %v, want exit status 3", err)
+	}
+}
+
+func TestUnotifyThreads(t *testing.T) {
+	m := memfs.New()
+	f, _ := m.Open("data", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Write([]byte("threaded"))
+	f.Close()
+
+	var stdout, stderr bytes.Buffer
+	cmd := helperCommand(t, "threads", "/mem/data")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := New(cmd, WithMount("/mem", m), WithEngine(EngineUnotify)).Run(context.Background()); err != nil {
+		t.Fatalf("%v: %s", err, stderr.String())
+	}
+	if got, want := stdout.String(), strings.Repeat("threaded\n", 4); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestUnotifyCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := New(exec.Command("/bin/sleep", "10"), WithEngine(EngineUnotify)).Run(ctx); err == nil {
+		t.Fatal("expected the killed command to report an error")
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	m := memfs.New()
+	m.Mkdir("dir", 0o755)
+	var want []string
+	// Enough entries to take several getdents64 calls.
+	for i := range 300 {
+		name := fmt.Sprintf("file%03d", i)
+		f, _ := m.Open(name, os.O_WRONLY|os.O_CREATE, 0o644)
+		f.Close()
+		want = append(want, name)
+	}
+	want = append(want, "dir/", "sub/")
+	slices.Sort(want)
+
+	for _, engine := range []Engine{EnginePtrace, EngineUnotify} {
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "readdir", "/mem")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		// A nested mount shows up in its parent's listing.
+		tr := New(cmd, WithMount("/mem", m), WithMount("/mem/sub", memfs.New()), WithEngine(engine))
+		if err := tr.Run(context.Background()); err != nil {
+			t.Fatalf("%v: %s%s", err, stdout.String(), stderr.String())
+		}
+		if got := strings.Fields(stdout.String()); !slices.Equal(got, want) {
+			t.Errorf("engine %d: got %v", engine, got)
+		}
+	}
+}
+
+func TestDirListRead(t *testing.T) {
+	d := &dirList{entries: []dirent{{ino: 1, typ: unix.DT_DIR, name: "."}, {ino: 2, typ: unix.DT_REG, name: "a"}}}
+	if b := d.read(23); len(b) != 0 {
+		t.Fatalf("a 24-byte record should not fit in 23 bytes, got %d", len(b))
+	}
+	b := d.read(100)
+	if len(b) != 48 || d.pos != 2 {
+		t.Fatalf("got %d bytes, pos %d", len(b), d.pos)
+	}
+	if reclen := binary.LittleEndian.Uint16(b[16:]); reclen != 24 || b[24+18] != unix.DT_REG || string(b[24+19:24+20]) != "a" {
+		t.Errorf("bad encoding %x", b)
+	}
+}
+
+func TestPositionedIO(t *testing.T) {
+	m := memfs.New()
+	f, _ := m.Open("data", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Write([]byte("0123456789"))
+	f.Close()
+	m.Mkdir("dir", 0o755)
+	for _, name := range []string{"a", "b", "c"} {
+		f, _ := m.Open("dir/"+name, os.O_WRONLY|os.O_CREATE, 0o644)
+		f.Close()
+	}
+
+	for _, engine := range []Engine{EnginePtrace, EngineUnotify} {
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "positioned", "/mem/data", "/mem/dir")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, WithMount("/mem", m), WithEngine(engine)).Run(context.Background()); err != nil {
+			t.Fatalf("%v: %s", err, stderr.String())
+		}
+		if got, want := stdout.String(), "1XY4 10 9\n3 3\n"; got != want {
+			t.Errorf("engine %d: got %q, want %q", engine, got, want)
+		}
+	}
+	f, _ = m.Open("data", os.O_RDONLY, 0)
+	defer f.Close()
+	if b, _ := io.ReadAll(f); string(b) != "01XY456789" {
+		t.Errorf("backend has %q", b)
+	}
+}
+
+func TestVectoredIO(t *testing.T) {
+	for _, engine := range []Engine{EnginePtrace, EngineUnotify} {
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "vectored", "/mem/data")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, WithMount("/mem", memfs.New()), WithEngine(engine)).Run(context.Background()); err != nil {
+			t.Fatalf("%v: %s", err, stderr.String())
+		}
+		if got, want := stdout.String(), "15 sca|tter Gather!\nGat\n"; got != want {
+			t.Errorf("engine %d: got %q, want %q", engine, got, want)
+		}
+	}
+}
+
+func TestOpenat2(t *testing.T) {
+	m := memfs.New()
+	f, _ := m.Open("f", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Write([]byte("virtual"))
+	f.Close()
+	m.Symlink("f", "link")
+	want := `"virtual"
+invalid cross-device link
+too many levels of symbolic links
+"virtual"
+invalid cross-device link
+"virtual"
+invalid argument
+""
+`
+	for _, engine := range []Engine{EnginePtrace, EngineUnotify} {
+		m.Unlink("new")
+		var stdout, stderr, trace bytes.Buffer
+		cmd := helperCommand(t, "openat2", "/mem")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, WithMount("/mem", m), WithEngine(engine), WithTraceWriter(&trace, TraceText)).Run(context.Background()); err != nil {
+			t.Fatalf("%v: %s", err, stderr.String())
+		}
+		if got := stdout.String(); got != want {
+			t.Errorf("engine %d: got %q, want %q", engine, got, want)
+		}
+		if _, err := m.Stat("new"); err != nil {
+			t.Errorf("engine %d: %v", engine, err)
+		}
+		for _, want := range []string{
+			`openat2(AT_FDCWD, "/mem/f", {flags=O_RDONLY|O_CLOEXEC}, 24) = `,
+			`openat2(AT_FDCWD, "/mem/new", {flags=O_RDWR|O_CREAT, mode=0644}, 24) = `,
+			`resolve=RESOLVE_IN_ROOT}, 24) = `,
+		} {
+			if !strings.Contains(trace.String(), want) {
+				t.Errorf("engine %d: trace lacks %q:\n%s", engine, want, trace.String())
+			}
+		}
+	}
+}
+
+func TestMmap(t *testing.T) {
+	m := memfs.New()
+	f, _ := m.Open("data", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Write([]byte("mapped"))
+	f.Close()
+
+	for _, tt := range []struct {
+		name string
+		opts []Option
+		low  bool
+		want string
+	}{
+		{"seccomp", nil, false, "mapped true\n"},
+		{"nofilter", []Option{WithSeccomp(false)}, false, "mapped true\n"},
+		{"unotify", []Option{WithEngine(EngineUnotify)}, false, "mapped true\n"},
+		{"unotify-low", []Option{WithEngine(EngineUnotify)}, true, "mapped true\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			args := []string{"/mem/data"}
+			if tt.low {
+				args = append(args, "low")
+			}
+			cmd := helperCommand(t, "mmap", args...)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			err := New(cmd, append(tt.opts, WithMount("/mem", m))...).Run(context.Background())
+			if got := stdout.String(); got != tt.want {
+				t.Errorf("got %q, want %q (%v: %s)", got, tt.want, err, stderr.String())
+			}
+		})
+	}
+}
+
+func TestStat(t *testing.T) {
+	m := memfs.New()
+	f, _ := m.Open("f", os.O_WRONLY|os.O_CREATE, 0o640)
+	f.Write([]byte("hello"))
+	f.Close()
+	m.Mkdir("d", 0o750)
+	m.Symlink("f", "l")
+
+	want := strings.Join([]string{
+		"5 -rw-r----- 0 0",
+		"0 drwxr-x--- 0 0",
+		"1 Lrwxrwxrwx 0 0",
+		"5 -rw-r----- 0 0",
+		"stat /mem/missing: no such file or directory",
+	}, "\n") + "\n"
+	for _, engine := range []Engine{EnginePtrace, EngineUnotify} {
+		var stdout bytes.Buffer
+		cmd := helperCommand(t, "stat", "/mem/f", "/mem/d", "l:/mem/l", "/mem/l", "/mem/missing")
+		cmd.Stdout = &stdout
+		if err := New(cmd, WithMount("/mem", m), WithEngine(engine)).Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := stdout.String(); got != want {
+			t.Errorf("engine %d: got\n%s\nwant\n%s", engine, got, want)
+		}
+	}
+}
+
+func TestStatOverrides(t *testing.T) {
+	m := memfs.New()
+	f, _ := m.Open("f", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Close()
+	m.Mkdir("d", 0o755)
+
+	var stdout bytes.Buffer
+	cmd := helperCommand(t, "stat", "/mem/f", "/mem/d")
+	cmd.Stdout = &stdout
+	mnt := WithMount("/mem", m, Owner(1000, 1001), Perm(0o600, 0o700))
+	if err := New(cmd, mnt).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "0 -rw------- 1000 1001\n0 drwx------ 1000 1001\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// ls uses statx.
+	stdout.Reset()
+	cmd = exec.Command("ls", "-ln", "/mem")
+	cmd.Stdout = &stdout
+	if err := New(cmd, mnt).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); !strings.Contains(got, "drwx------ 2 1000 1001") || !strings.Contains(got, "-rw------- 1 1000 1001") {
+		t.Errorf("ls -ln:\n%s", got)
+	}
+}
+
+func TestAttach(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	cmd := exec.Command("/bin/sh", "-c", `while :; do cat /mem/f 2>&1; sleep 0.05; done >`+out)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	// waitFor waits for the command to print s after the first n bytes of
+	// its output, and returns how much output there is by then.
+	waitFor := func(s string, n int) int {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			b, _ := os.ReadFile(out)
+			if i := bytes.Index(b[min(n, len(b)):], []byte(s)); i >= 0 {
+				return len(b)
+			}
+		}
+		t.Fatalf("no %q in the output", s)
+		return 0
+	}
+	n := waitFor("No such file", 0)
+
+	m := memfs.New()
+	f, _ := m.Open("f", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Write([]byte("attached\n"))
+	f.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- Attach(cmd.Process.Pid, WithMount("/mem", m)).Run(ctx) }()
+	n = waitFor("attached\n", n)
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run returned %v, want context.Canceled", err)
+	}
+	// Detached, the command carries on without the mount.
+	waitFor("No such file", n)
+}
+
+func TestDetachReattach(t *testing.T) {
+	if _, err := New(exec.Command("/bin/true")).Detach(); err == nil {
+		t.Error("Detach succeeded under a seccomp filter")
+	}
+
+	dir := t.TempDir()
+	out, err := os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	m := memfs.New()
+	f, _ := m.Open("lines", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Write([]byte("one\ntwo\n"))
+	f.Close()
+	// The script reads a line, waits to be let go on, and reads the next
+	// through the same descriptor.
+	cmd := exec.Command("/bin/sh", "-c", `exec 3</mem/lines
+read -r l <&3; echo $l
+while [ ! -e `+dir+`/go ]; do sleep 0.01; done
+read -r l <&3; echo $l`)
+	cmd.Stdout, cmd.Stderr = out, out
+	tr := New(cmd, WithSeccomp(false), WithMount("/mem", m))
+	errc := make(chan error, 1)
+	go func() { errc <- tr.Run(context.Background()) }()
+	waitOutput := func(want string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if b, _ := os.ReadFile(out.Name()); string(b) == want {
+				return
+			}
+		}
+		b, _ := os.ReadFile(out.Name())
+		t.Fatalf("output %q, want %q", b, want)
+	}
+	waitOutput("one\n")
+
+	state, err := tr.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Run returned %v after Detach", err)
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state = new(State)
+	if err := json.Unmarshal(b, state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Processes) == 0 || state.Processes[0].Pid != cmd.Process.Pid || len(state.Files) != 1 {
+		t.Fatalf("state %s", b)
+	}
+
+	go func() { errc <- Reattach(state, WithMount("/mem", m)).Run(context.Background()) }()
+	for tracerPid(t, cmd.Process.Pid) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("reattached Run: %v", err)
+	}
+	waitOutput("one\ntwo\n")
+}
+
+func TestHandoff(t *testing.T) {
+	dir := t.TempDir()
+	out, err := os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	files := filepath.Join(dir, "files")
+	if err := os.Mkdir(files, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(files, "lines"), []byte("one\ntwo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("/bin/sh", "-c", `exec 3</dir/lines
+read -r l <&3; echo $l
+while [ ! -e `+dir+`/go ]; do sleep 0.01; done
+read -r l <&3; echo $l; mkdir /dir/sub 2>/dev/null || echo refused`)
+	cmd.Stdout, cmd.Stderr = out, out
+	tr := New(cmd, WithSeccomp(false), WithMount("/dir", vfs.Dir(files)),
+		WithPolicy(Rule{Syscall: unix.SYS_MKDIRAT}))
+	errc := make(chan error, 1)
+	go func() { errc <- tr.Run(context.Background()) }()
+	waitOutput := func(want string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if b, _ := os.ReadFile(out.Name()); string(b) == want {
+				return
+			}
+		}
+		b, _ := os.ReadFile(out.Name())
+		t.Fatalf("output %q, want %q", b, want)
+	}
+	waitOutput("one\n")
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "handoff")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns[i] = c.(*net.UnixConn)
+	}
+	handoff := make(chan error, 1)
+	go func() { handoff <- tr.Handoff(conns[0]) }()
+	state, err := ReceiveState(conns[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-handoff; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Run returned %v after Handoff", err)
+	}
+	if len(state.Files) != 1 || !state.Files[0].HostFile || len(state.Rules) != 1 {
+		t.Fatalf("state %+v", state)
+	}
+	// The file the new supervisor serves is the one that was open, not
+	// whatever has the name now.
+	if err := os.Remove(filepath.Join(files, "lines")); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() { errc <- Reattach(state, WithMount("/dir", vfs.Dir(files))).Run(context.Background()) }()
+	for tracerPid(t, cmd.Process.Pid) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("reattached Run: %v", err)
+	}
+	waitOutput("one\ntwo\nrefused\n")
+
+	// A peer cannot have the receiver allocate any length it claims.
+	if _, err := conns[0].Write(binary.LittleEndian.AppendUint64(nil, 1<<62)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReceiveState(conns[1]); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("ReceiveState of an overlong state: %v", err)
+	}
+}
+
+// tracerPid returns the pid of the process tracing pid, or 0 if none is.
+func tracerPid(t *testing.T, pid int) int {
+	t.Helper()
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if v, ok := strings.CutPrefix(line, "TracerPid:"); ok {
+			n, _ := strconv.Atoi(strings.TrimSpace(v))
+			return n
+		}
+	}
+	return 0
+}
+
+func TestJobControl(t *testing.T) {
+	for name, seccomp := range map[string]bool{"seccomp": true, "noseccomp": false} {
+		t.Run(name, func(t *testing.T) {
+			out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+			cmd := exec.Command("/bin/sh", "-c", `trap 'echo int' INT; while :; do echo tick; sleep 0.01; done`)
+			cmd.Stdout = out
+			// The kernel discards SIGTSTP sent to an orphaned process
+			// group, which the test's may be.
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			// Start returns once the command has started, and with it
+			// cmd.Process.
+			tr := New(cmd, WithSeccomp(seccomp))
+			if err := tr.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			size := func() int64 {
+				fi, _ := out.Stat()
+				return fi.Size()
+			}
+			waitGrowth := func() {
+				t.Helper()
+				n := size()
+				for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+					if size() > n {
+						return
+					}
+				}
+				t.Fatal("the command is not running")
+			}
+			waitGrowth()
+
+			// Stopped, as by Ctrl-Z, it must stay stopped until continued.
+			if err := cmd.Process.Signal(syscall.SIGTSTP); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(100 * time.Millisecond)
+			n := size()
+			time.Sleep(200 * time.Millisecond)
+			if size() != n {
+				t.Fatal("the command kept running after SIGTSTP")
+			}
+			if err := cmd.Process.Signal(syscall.SIGCONT); err != nil {
+				t.Fatal(err)
+			}
+			waitGrowth()
+
+			if err := cmd.Process.Signal(syscall.SIGINT); err != nil {
+				t.Fatal(err)
+			}
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+				if b, _ := os.ReadFile(out.Name()); bytes.Contains(b, []byte("int\n")) {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("SIGINT did not reach the command")
+				}
+			}
+			cmd.Process.Kill()
+			if _, err := tr.Wait(); err == nil {
+				t.Fatal("expected the killed command to report an error")
+			}
+		})
+	}
+}
+
+func TestWait(t *testing.T) {
+	for _, tc := range []struct {
+		script string
+		want   ExitState
+		code   int
+	}{
+		{"exit 3", ExitState{Code: 3}, 3},
+		{"kill -KILL $$", ExitState{Signal: syscall.SIGKILL}, 137},
+		{"kill -TERM $$", ExitState{Signal: syscall.SIGTERM}, 143},
+	} {
+		t.Run(tc.script, func(t *testing.T) {
+			for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+				cmd := exec.Command("/bin/sh", "-c", tc.script)
+				tr := New(cmd, WithEngine(engine))
+				if err := tr.Start(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				exit, err := tr.Wait()
+				if err == nil {
+					t.Errorf("%s: Wait reported no error", name)
+				}
+				want := tc.want
+				want.Pid = cmd.Process.Pid
+				if exit == nil || *exit != want || exit.ExitCode() != tc.code {
+					t.Errorf("%s: exit state %+v, want %+v", name, exit, want)
+				}
+			}
+
+			// A supervisor exits the same way.
+			sup := helperCommand(t, "supervise", tc.script)
+			err := sup.Run()
+			got := exitState(0, unix.WaitStatus(sup.ProcessState.Sys().(syscall.WaitStatus)))
+			if got.Signal != tc.want.Signal || got.Code != tc.want.Code {
+				t.Errorf("supervisor ended with %v", err)
+			}
+		})
+	}
+
+	tr := New(exec.Command("/bin/true"))
+	if _, err := tr.Wait(); err == nil {
+		t.Error("Wait succeeded before Start")
+	}
+	if err := tr.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Start(context.Background()); err == nil {
+		t.Error("a Tracer started twice")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		m := memfs.New()
+		f, _ := m.Open("log", os.O_WRONLY|os.O_CREATE, 0o644)
+		f.Write([]byte("0123456789"))
+		f.Close()
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "truncate", "/mem/log")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, WithEngine(engine), WithMount("/mem", m)).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		want := `<nil>
+"0123"
+<nil>
+"0123\x00\x00\x007"
+<nil>
+"0\x00\x003\x00\x00\x007"
+operation not supported
+<nil>
+<nil>
+"0\x00\x003\x00\x00\x007\x00\x00"
+invalid argument
+`
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestXattr(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		m := memfs.New()
+		f, _ := m.Open("file", os.O_WRONLY|os.O_CREATE, 0o644)
+		f.Close()
+		m.Symlink("file", "link")
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "xattr", "/mem/file", "/mem/link")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, WithEngine(engine), WithMount("/mem", m)).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		want := `<nil>
+<nil>
+file exists
+no data available
+3 <nil>
+-1 numerical result out of range
+"two" <nil>
+"user.a\x00user.b\x00" <nil>
+0 <nil>
+operation not permitted
+<nil>
+-1 no data available
+no data available
+operation not supported
+`
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+		if v, err := m.Getxattr("file", "user.b"); string(v) != "two" || err != nil {
+			t.Errorf("%s: user.b = %q, %v", name, v, err)
+		}
+	}
+}
+
+func TestUtimes(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		m := memfs.New()
+		f, _ := m.Open("file", os.O_WRONLY|os.O_CREATE, 0o644)
+		f.Close()
+		m.Symlink("file", "link")
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "utimes", "/mem/file", "/mem/link")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, WithEngine(engine), WithMount("/mem", m)).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		want := `<nil>
+1 500 2 123456789
+errno 0
+1 500 3 7
+<nil>
+true 3 7
+<nil>
+invalid argument
+<nil>
+7 1 8 2
+`
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestChmod(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		m := memfs.New()
+		f, _ := m.Open("file", os.O_WRONLY|os.O_CREATE, 0o644)
+		f.Close()
+		m.Symlink("file", "link")
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "chmod", "/mem/file", "/mem/link")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, WithEngine(engine), WithMount("/mem", m)).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		want := `<nil>
+4750
+<nil>
+600
+operation not supported
+<nil>
+<nil>
+<nil>
+operation not permitted
+`
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+		if fi, err := m.Stat("file"); err != nil || fi.Mode() != 0o600 {
+			t.Errorf("%s: mode %v, %v", name, fi.Mode(), err)
+		}
+	}
+}
+
+func TestTmpfile(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		m := memfs.New()
+		m.Mkdir("dir", 0o755)
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "tmpfile", "/mem/dir")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, WithEngine(engine), WithMount("/mem", m)).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		want := `true true
+0 <nil>
+<nil>
+<nil>
+2 <nil>
+invalid argument
+no such file or directory
+file exists
+not a directory
+<nil>
+operation not permitted
+invalid cross-device link
+`
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+		for _, p := range []string{"dir/a", "dir/b"} {
+			f, err := m.Open(p, os.O_RDONLY, 0)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			b, _ := io.ReadAll(f)
+			f.Close()
+			fi, _ := m.Stat(p)
+			if string(b) != "hello\nmore\n" || fi.Mode().Perm()&0o700 != 0o600 {
+				t.Errorf("%s: %s holds %q with mode %v", name, p, b, fi.Mode())
+			}
+		}
+	}
+}
+
+func TestFakeRoot(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		host := t.TempDir()
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "fakeroot", "/mem", host)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, WithEngine(engine), WithFakeRoot(), WithMount("/mem", memfs.New())).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		// Run as root, the tracer really gives the host file its owner.
+		uid, gid := os.Getuid(), os.Getgid()
+		if uid == 0 {
+			uid, gid = 123, 789
+		}
+		want := fmt.Sprintf(`0 0 0 0
+<nil> <nil> 0
+<nil> true 511
+<nil>
+<nil> <nil>
+<nil>
+file <nil> 123:789 100000 0,0
+null <nil> 0:0 20000 1,3
+0 <nil>
+<nil> <nil>
+<nil>
+file <nil> %d:%d 100000 0,0
+null <nil> %d:%d 100000 0,0
+0 <nil>
+`, uid, gid, os.Getuid(), os.Getgid())
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestChroot(t *testing.T) {
+	host := t.TempDir()
+	os.Mkdir(filepath.Join(host, "etc"), 0o755)
+	os.WriteFile(filepath.Join(host, "etc/hostname"), []byte("inside\n"), 0o644)
+	os.Symlink("/etc/hostname", filepath.Join(host, "link"))
+	m := memfs.New()
+	m.Mkdir("root", 0o755)
+	m.Mkdir("root/etc", 0o755)
+	f, _ := m.Open("root/etc/hostname", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Write([]byte("inside\n"))
+	f.Close()
+	m.Symlink("/etc/hostname", "root/link")
+	for name, root := range map[string]string{"host": host, "virtual": "/mem/root"} {
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "chroot", root)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, WithChroot(), WithMount("/mem", m)).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		want := `<nil>
+/ <nil>
+"inside\n" <nil>
+"inside\n" <nil>
+<nil>
+<nil>
+<nil> <nil>
+/ <nil>
+"inside\n" <nil>
+`
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(host, "made")); err != nil {
+		t.Error(err)
+	}
+	if _, err := m.Stat("root/made"); err != nil {
+		t.Error(err)
+	}
+	cmd := helperCommand(t, "chroot", host)
+	if err := New(cmd, WithChroot(), WithEngine(EngineUnotify)).Run(context.Background()); err == nil {
+		t.Error("chroot ran under EngineUnotify")
+	}
+}
+
+func TestAccess(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		m := memfs.New()
+		for _, p := range []string{"file", "private/file"} {
+			m.Mkdir(filepath.Dir(p), 0o755)
+			f, _ := m.Open(p, os.O_WRONLY|os.O_CREATE, 0o644)
+			f.Close()
+		}
+		m.Chmod("private", 0o700)
+		args := []string{"/mem/file:0", "/mem/file:4", "/mem/file:2", "/mem/file:1", "/mem/private/file:4", "/mem/missing:0", "/mem/file:8"}
+		for _, tc := range []struct {
+			creds Credentials
+			opts  []MountOption
+			want  string
+		}{
+			{nil, nil, `/mem/file:0 <nil>
+/mem/file:4 <nil>
+/mem/file:2 <nil>
+/mem/file:1 permission denied
+/mem/private/file:4 <nil>
+/mem/missing:0 no such file or directory
+/mem/file:8 invalid argument
+`},
+			{FixedCredentials(1000, 1000), nil, `/mem/file:0 <nil>
+/mem/file:4 <nil>
+/mem/file:2 permission denied
+/mem/file:1 permission denied
+/mem/private/file:4 permission denied
+/mem/missing:0 no such file or directory
+/mem/file:8 invalid argument
+`},
+			{FixedCredentials(1000, 1000), []MountOption{Owner(1000, 1000)}, `/mem/file:0 <nil>
+/mem/file:4 <nil>
+/mem/file:2 <nil>
+/mem/file:1 permission denied
+/mem/private/file:4 <nil>
+/mem/missing:0 no such file or directory
+/mem/file:8 invalid argument
+`},
+		} {
+			var stdout, stderr bytes.Buffer
+			cmd := helperCommand(t, "access", args...)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			opts := []Option{WithEngine(engine), WithMount("/mem", m, tc.opts...)}
+			if tc.creds != nil {
+				opts = append(opts, WithCredentials(tc.creds))
+			}
+			if err := New(cmd, opts...).Run(context.Background()); err != nil {
+				t.Fatalf("%s: %v: %s", name, err, stderr.String())
+			}
+			if got := stdout.String(); got != tc.want {
+				t.Errorf("%s: got %q, want %q", name, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestStatfs(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		for _, tc := range []struct {
+			opts []Option
+			want string
+		}{
+			{nil, `0x65735546 4096 268435456 268435456 1073741824 1073741824 false
+0x65735546 4096 268435456 268435456 1073741824 1073741824 false
+no such file or directory
+`},
+			{[]Option{WithLimits(Limits{Bytes: 1 << 20, Inodes: 100}), WithReadOnly("/mem/page")}, `0x65735546 4096 256 256 100 100 true
+0x65735546 4096 256 255 100 99 false
+no such file or directory
+`},
+		} {
+			var stdout, stderr bytes.Buffer
+			cmd := helperCommand(t, "statfs", "/mem")
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			opts := append([]Option{WithEngine(engine), WithMount("/mem", memfs.New())}, tc.opts...)
+			if err := New(cmd, opts...).Run(context.Background()); err != nil {
+				t.Fatalf("%s: %v: %s", name, err, stderr.String())
+			}
+			if got := stdout.String(); got != tc.want {
+				t.Errorf("%s: got %q, want %q", name, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestChdir(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "chdir", "/mem/d", t.TempDir())
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, WithEngine(engine), WithMount("/mem", memfs.New())).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		want := `<nil>
+<nil>
+/mem/d <nil>
+<nil>
+<nil>
+<nil>
+/mem/d/sub <nil>
+"hi" <nil>
+not a directory
+no such file or directory
+<nil>
+/mem/d <nil>
+numerical result out of range
+<nil>
+host <nil>
+<nil>
+/mem/d/sub <nil>
+<nil>
+ no such file or directory
+<nil>
+host <nil>
+<nil>
+`
+		// The kernel is moved to a host directory reached through the
+		// virtual tree, which EngineUnotify cannot do.
+		if engine == EnginePtrace {
+			want += "<nil>\nhost <nil>\n<nil>\n<nil>\n/ <nil>\n"
+		} else {
+			want += "operation not supported\nhost <nil>\n<nil>\noperation not supported\n/mem/d <nil>\n"
+		}
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestDotDot(t *testing.T) {
+	// ".." out of a mount leads to the host directory above it, which the
+	// kernel would not find from the path, nor from a virtual cwd.
+	const script = `dir=$1
+cat $dir/v/../f
+cat $dir/v/d/../../f
+[ -d $dir/v/.. ] && echo dir
+ls $dir/v/d/../..
+cd $dir/v/d && cat ../../f && ls ../..`
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := filepath.EvalSymlinks(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			os.WriteFile(filepath.Join(dir, "f"), []byte("host\n"), 0o644)
+			mem := memfs.New()
+			mem.Mkdir("d", 0o755)
+			var stdout, stderr bytes.Buffer
+			cmd := exec.Command("/bin/sh", "-c", script, "sh", dir)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			if err := New(cmd, WithEngine(engine), WithMount(filepath.Join(dir, "v"), mem)).Run(context.Background()); err != nil {
+				t.Fatalf("%v: %s", err, stderr.String())
+			}
+			if got, want := stdout.String(), "host\nhost\ndir\nf\nv\nhost\nf\nv\n"; got != want {
+				t.Errorf("got %q, want %q: %s", got, want, stderr.String())
+			}
+		})
+	}
+}
+
+func TestDirfd(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "dirfd", "/mem")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, WithEngine(engine), WithMount("/mem", memfs.New())).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		want := `f "hi" <nil>
+../d/f "hi" <nil>
+sub true <nil>
+/mem/l/../f false <nil>
+f/x false not a directory
+f/.. false not a directory
+missing/../f false no such file or directory
+/mem/loop/x false too many levels of symbolic links
+<nil>
+/mem/l/new true <nil>
+<nil>
+x not a directory
+<nil>
+/mem/d/f false no such file or directory
+`
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		host := t.TempDir()
+		if err := os.WriteFile(filepath.Join(host, "h"), []byte("host"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("/mem/d", filepath.Join(host, "tovirt")); err != nil {
+			t.Fatal(err)
+		}
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "symlinks", "/mem", host)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, WithEngine(engine), WithMount("/mem", memfs.New())).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		want := `/mem/abs "virt" <nil>
+/mem/tohost "host" <nil>
+/tovirt/f "virt" <nil>
+/mem/abs "" too many levels of symbolic links
+/mem/loop "" too many levels of symbolic links
+/mem/dangling "" <nil>
+<nil> 4 false
+<nil> true
+<nil> 0
+<nil> 4
+`
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSymlinkToHostDir(t *testing.T) {
+	// A symlink in a mount to a host directory leads to the host files
+	// below it, whether its target is absolute or relative.
+	const script = `dir=$1
+ln -s $dir/h $dir/v/abs && cat $dir/v/abs/f
+ln -s ../h $dir/v/rel && cat $dir/v/rel/f
+[ -f $dir/v/abs/f ] && echo file
+ls $dir/v/abs/`
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := filepath.EvalSymlinks(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			os.Mkdir(filepath.Join(dir, "h"), 0o755)
+			os.WriteFile(filepath.Join(dir, "h", "f"), []byte("host\n"), 0o644)
+			var stdout, stderr bytes.Buffer
+			cmd := exec.Command("/bin/sh", "-c", script, "sh", dir)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			if err := New(cmd, WithEngine(engine), WithMount(filepath.Join(dir, "v"), memfs.New())).Run(context.Background()); err != nil {
+				t.Fatalf("%v: %s", err, stderr.String())
+			}
+			if got, want := stdout.String(), "host\nhost\nfile\nf\n"; got != want {
+				t.Errorf("got %q, want %q: %s", got, want, stderr.String())
+			}
+		})
+	}
+}
+
+func TestHostFS(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "d", "f"), []byte("host"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("d", filepath.Join(dir, "l")); err != nil {
+		t.Fatal(err)
+	}
+	tr := New(exec.Command("true"))
+	defer tr.hostFS.close()
+	name := strings.TrimPrefix(dir, "/")
+	for _, p := range []string{"l", "l/f"} {
+		if _, err := tr.hostFS.Open(name+"/"+p, os.O_RDONLY, 0); !errors.Is(err, syscall.ELOOP) {
+			t.Errorf("open %s: got %v, want ELOOP", p, err)
+		}
+	}
+	if fi, err := tr.hostFS.Stat(name + "/l"); err != nil || fi.Mode()&fs.ModeSymlink == 0 || fi.Name() != "l" {
+		t.Errorf("stat l: got %v, %v", fi, err)
+	}
+	if target, err := tr.hostFS.Readlink(name + "/l"); err != nil || target != "d" {
+		t.Errorf("readlink l: got %q, %v", target, err)
+	}
+	f, err := tr.hostFS.Open(name+"/d/f", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(f)
+	f.Close()
+	if string(b) != "host" {
+		t.Errorf("read d/f: got %q", b)
+	}
+	entries, err := tr.hostFS.ReadDir(name)
+	if err != nil || len(entries) != 2 || entries[0].Name() != "d" || entries[1].Type() != fs.ModeSymlink {
+		t.Errorf("readdir: got %v, %v", entries, err)
+	}
+	if got, want := tr.realPath(dir+"/l/f", true), dir+"/d/f"; got != want {
+		t.Errorf("realPath: got %q, want %q", got, want)
+	}
+	if got, want := tr.realPath(dir+"/l/../l", false), dir+"/l"; got != want {
+		t.Errorf("realPath: got %q, want %q", got, want)
+	}
+}
+
+func TestProc(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "proc", "/mem")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, WithEngine(engine), WithMount("/mem", memfs.New())).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		want := `/mem/f <nil>
+/mem/f <nil>
+<nil> 2 true
+<nil> 120700
+"hi" <nil>
+false /mem/f <nil>
+true /mem/f <nil>
+true false <nil>
+/mem <nil>
+/mem <nil>
+`
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestRandomSeed(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		run := func(opts ...Option) string {
+			var stdout, stderr bytes.Buffer
+			cmd := helperCommand(t, "random")
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			if err := New(cmd, append(opts, WithEngine(engine))...).Run(context.Background()); err != nil {
+				t.Fatalf("%s: %v: %s", name, err, stderr.String())
+			}
+			return stdout.String()
+		}
+		first, again := run(WithRandomSeed(1)), run(WithRandomSeed(1))
+		if first != again {
+			t.Errorf("%s: runs with one seed differ: %q and %q", name, first, again)
+		}
+		if lines := strings.Split(first, "\n"); len(lines) != 4 || lines[0][:16] == lines[1][:16] || lines[2] != "0 invalid argument" {
+			t.Errorf("%s: got %q", name, first)
+		}
+		if other := run(WithRandomSeed(2)); other[:16] == first[:16] {
+			t.Errorf("%s: runs with different seeds both got %q", name, first)
+		}
+		if unseeded := run(); unseeded[:16] == first[:16] {
+			t.Errorf("%s: an unseeded run got %q", name, unseeded)
+		}
+	}
+}
+
+func TestClock(t *testing.T) {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		run := func(clock *Clock, args ...string) string {
+			var stdout, stderr bytes.Buffer
+			cmd := exec.Command(args[0], args[1:]...)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			if err := New(cmd, WithEngine(engine), WithClock(clock), WithMount("/v", memfs.New())).Run(context.Background()); err != nil {
+				t.Fatalf("%s: %v: %s", name, err, stderr.String())
+			}
+			return stdout.String()
+		}
+		clock := NewClock(start)
+		clock.Freeze()
+		began := time.Now()
+		// date is the program the tracer starts, which has no vDSO
+		// under either engine.
+		if got, want := run(clock, "date", "-u", "+%FT%T"), "2000-01-01T00:00:00\n"; got != want {
+			t.Errorf("%s: frozen clock: got %q, want %q", name, got, want)
+		}
+		// Only ptrace stops at the exec of a program the command runs.
+		if got, want := run(clock, "/bin/sh", "-c", "date -u +%FT%T"), "2000-01-01T00:00:00\n"; engine == EnginePtrace && got != want {
+			t.Errorf("%s: frozen clock in a child: got %q, want %q", name, got, want)
+		}
+		if got, want := run(clock, "/bin/sh", "-c", "sleep 90 && touch /v/f && stat -c %Y /v/f"), "946684890\n"; got != want {
+			t.Errorf("%s: frozen clock after a sleep: got %q, want %q", name, got, want)
+		}
+		if d := time.Since(began); d > 10*time.Second {
+			t.Errorf("%s: a frozen sleep took %v", name, d)
+		}
+		if now := clock.Now().Truncate(time.Second); !now.Equal(start.Add(90 * time.Second)) {
+			t.Errorf("%s: the clock reads %v", name, now)
+		}
+
+		clock = NewClock(start)
+		clock.Scale(20)
+		began = time.Now()
+		run(clock, "sleep", "2")
+		if d := time.Since(began); d > 1500*time.Millisecond {
+			t.Errorf("%s: a sleep at 20x took %v", name, d)
+		}
+		if now := clock.Now(); now.Before(start.Add(2*time.Second)) || now.After(start.Add(time.Minute)) {
+			t.Errorf("%s: scaled clock reads %v", name, now)
+		}
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		dir := t.TempDir()
+		run := func(redirects []Redirect, args ...string) string {
+			var stdout, stderr bytes.Buffer
+			cmd := helperCommand(t, "net", args...)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			if err := New(cmd, WithEngine(engine), WithRedirects(redirects...)).Run(context.Background()); err != nil {
+				t.Fatalf("%s: %v: %s%s", name, err, stdout.String(), stderr.String())
+			}
+			return stdout.String()
+		}
+		serve := func(l net.Listener) {
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				b := make([]byte, 64)
+				n, _ := conn.Read(b)
+				fmt.Fprintf(conn, "pong from %s to %s", l.Addr().Network(), b[:n])
+			}()
+		}
+
+		// A TCP client is pointed at a Unix socket, which takes a new
+		// socket, and at another TCP address, which does not.
+		ul, err := net.Listen("unix", filepath.Join(dir, "s"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ul.Close()
+		serve(ul)
+		if got, want := run([]Redirect{{From: "0.0.0.0:5432", To: "unix:" + ul.Addr().String()}}, "connect", "192.0.2.1:5432"), "pong from unix to ping\n"; got != want {
+			t.Errorf("%s: connect to unix: got %q, want %q", name, got, want)
+		}
+		tl, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tl.Close()
+		serve(tl)
+		redirects := []Redirect{{From: "192.0.2.1:*", To: tl.Addr().String()}, {From: "*:*", To: "unix:/nonexistent"}}
+		if got, want := run(redirects, "connect", "192.0.2.1:80"), "pong from tcp to ping\n"; got != want {
+			t.Errorf("%s: connect to tcp: got %q, want %q", name, got, want)
+		}
+
+		udp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer udp.Close()
+		if got, want := run([]Redirect{{From: "192.0.2.1:53", To: udp.LocalAddr().String()}}, "sendto", "192.0.2.1:53"), "<nil>\n"; got != want {
+			t.Errorf("%s: sendto: got %q, want %q", name, got, want)
+		}
+		b := make([]byte, 64)
+		_ = udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, _, err := udp.ReadFrom(b); string(b[:n]) != "ping" || err != nil {
+			t.Errorf("%s: sendto delivered %q, %v", name, b[:n], err)
+		}
+
+		// A server is made to listen on a Unix socket.
+		sock := filepath.Join(dir, "bound")
+		done := make(chan string)
+		go func() { done <- run([]Redirect{{From: "0.0.0.0:5432", To: "unix:" + sock}}, "bind", "0.0.0.0:5432") }()
+		var conn net.Conn
+		for i := 0; conn == nil && i < 200; i++ {
+			if conn, err = net.Dial("unix", sock); err != nil {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		if conn == nil {
+			t.Fatalf("%s: dial: %v", name, err)
+		}
+		_, _ = conn.Write([]byte("hello"))
+		reply, _ := io.ReadAll(conn)
+		conn.Close()
+		if got := <-done; got != "echoed hello\n" || string(reply) != "echo hello" {
+			t.Errorf("%s: bind: got %q, reply %q", name, got, reply)
+		}
+	}
+}
+
+func TestSocketRemap(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		dir, mounted := t.TempDir(), t.TempDir()
+		opts := []Option{
+			WithEngine(engine),
+			WithRemap(Remap{From: "/run/cfc-test", To: dir}),
+			WithMount("/sockets", vfs.Dir(mounted)),
+			WithMount("/mem", memfs.New()),
+		}
+		run := func(args ...string) (string, error) {
+			var stdout, stderr bytes.Buffer
+			cmd := helperCommand(t, "net", args...)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			err := New(cmd, opts...).Run(context.Background())
+			return stdout.String() + stderr.String(), err
+		}
+
+		l, err := net.Listen("unix", filepath.Join(dir, "s"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			b := make([]byte, 64)
+			n, _ := conn.Read(b)
+			fmt.Fprintf(conn, "pong to %s", b[:n])
+		}()
+		if got, err := run("connect", "/run/cfc-test/s"); got != "pong to ping\n" || err != nil {
+			t.Errorf("%s: connect to a remapped socket: %q, %v", name, got, err)
+		}
+
+		// A server binds its socket where the mount keeps its files.
+		done := make(chan string)
+		go func() {
+			out, _ := run("bind", "/sockets/b")
+			done <- out
+		}()
+		var conn net.Conn
+		for i := 0; conn == nil && i < 200; i++ {
+			if conn, err = net.Dial("unix", filepath.Join(mounted, "b")); err != nil {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		if conn == nil {
+			t.Fatalf("%s: dial: %v", name, err)
+		}
+		_, _ = conn.Write([]byte("hello"))
+		reply, _ := io.ReadAll(conn)
+		conn.Close()
+		if got := <-done; got != "echoed hello\n" || string(reply) != "echo hello" {
+			t.Errorf("%s: bind in a mount: got %q, reply %q", name, got, reply)
+		}
+
+		if got, err := run("connect", "/mem/s"); got != "connection refused\n" || err == nil {
+			t.Errorf("%s: connect into memfs: %q, %v", name, got, err)
+		}
+	}
+}
+
+func TestResolver(t *testing.T) {
+	r := Resolver{
+		Hosts:       map[string]string{"api.internal": "10.1.2.3", "db.internal": "fd00::5", "bad.internal": "nowhere"},
+		Nameservers: []string{"127.0.0.1"},
+		Search:      []string{"corp.example"},
+	}
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		var stdout bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", `getent hosts api.internal db.internal
+grep -q bad.internal /etc/hosts || echo no bad.internal
+cat /etc/resolv.conf
+grep -c '^hosts: *files dns$' /etc/nsswitch.conf
+test -s /etc/passwd && echo passwd from the host`)
+		cmd.Stdout = &stdout
+		if err := New(cmd, WithEngine(engine), WithResolver(r)).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		want := "10.1.2.3        api.internal\nfd00::5         db.internal\nno bad.internal\n" +
+			"search corp.example\nnameserver 127.0.0.1\n1\npasswd from the host\n"
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+
+		stdout.Reset()
+		cmd = helperCommand(t, "resolve", "api.internal")
+		cmd.Stdout = &stdout
+		if err := New(cmd, WithEngine(engine), WithResolver(r)).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := stdout.String(); got != "[10.1.2.3] <nil>\n" {
+			t.Errorf("%s: Go resolver: %q", name, got)
+		}
+	}
+}
+
+func TestEgress(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b := make([]byte, 64)
+			n, _ := conn.Read(b)
+			fmt.Fprintf(conn, "pong to %s", b[:n])
+			conn.Close()
+		}
+	}()
+	addr := l.Addr().String()
+	if err := New(exec.Command("true"), WithEgress(addr, "not a rule")).Run(context.Background()); err == nil || !strings.Contains(err.Error(), `"not a rule"`) {
+		t.Errorf("a malformed rule: %v", err)
+	}
+	// x32's sendmsg and sendmmsg take the i386 msghdr.
+	if compatArch != 0 {
+		for nr, want := range map[uint64]uint64{518: unix.SYS_SENDMSG, 538: unix.SYS_SENDMMSG} {
+			if c, ok := native(sysCall{arch: auditArch, nr: x32Bit | nr}); !ok || c.nr != want {
+				t.Errorf("x32 syscall %d: %d, %v", nr, c.nr, ok)
+			}
+		}
+	}
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		var denied []uint64
+		run := func(args ...string) string {
+			var stdout bytes.Buffer
+			cmd := helperCommand(t, "net", args...)
+			cmd.Stdout = &stdout
+			tr := New(cmd, WithEngine(engine),
+				WithEgress(addr, "[fd00::/8]:*", "127.0.0.0/8:53-54"),
+				WithRedirects(Redirect{From: "192.0.2.1:80", To: addr}))
+			events := tr.Events()
+			// The helper exits 1 when its connect fails.
+			_ = tr.Run(context.Background())
+			for e := range events {
+				if e, ok := e.(*SyscallDenied); ok && e.Errno == unix.ECONNREFUSED {
+					denied = append(denied, e.Syscall)
+				}
+			}
+			return stdout.String()
+		}
+		for _, tc := range []struct{ args, want string }{
+			{"connect " + addr, "pong to ping\n"},
+			{"connect 192.0.2.1:80", "pong to ping\n"},
+			{"connect 127.0.0.2:1", "connection refused\n"},
+			{"sendto 127.0.0.3:53", "<nil>\n"},
+			{"sendto 127.0.0.3:55", "connection refused\n"},
+			{"sendmsg 192.0.2.2:53", "connection refused\n"},
+		} {
+			if got := run(strings.Fields(tc.args)...); got != tc.want {
+				t.Errorf("%s: %s: got %q, want %q", name, tc.args, got, tc.want)
+			}
+		}
+		if want := []uint64{unix.SYS_CONNECT, unix.SYS_SENDTO, unix.SYS_SENDMSG}; !slices.Equal(denied, want) {
+			t.Errorf("%s: denied %v, want %v", name, denied, want)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		cmd := exec.Command("/bin/sh", "-c", "echo hello >/data/f && cat /data/f >/dev/null")
+		if err := New(cmd, WithEngine(engine), WithMount("/data", memfs.New()), WithMetrics(m)).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE cfc_ptrace_syscalls_total counter\n",
+		`cfc_ptrace_syscalls_total{syscall="openat"} `,
+		`cfc_ptrace_backend_op_duration_seconds_bucket{mount="/data",op="open",le="+Inf"} `,
+		`cfc_ptrace_backend_op_duration_seconds_count{mount="/data",op="write"} `,
+		`cfc_ptrace_mount_read_bytes_total{mount="/data"} 12` + "\n",
+		`cfc_ptrace_mount_written_bytes_total{mount="/data"} 12` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("no %q in\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "cfc_ptrace_stops_total 0\n") {
+		t.Error("no stops counted")
+	}
+}
+
+func TestTracerProvider(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		sr := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+		ctx, launch := tp.Tracer("test").Start(context.Background(), "launch")
+		cmd := exec.Command("/bin/sh", "-c", "echo hello >/data/f; cat /data/missing 2>/dev/null; true")
+		if err := New(cmd, WithEngine(engine), WithMount("/data", memfs.New()), WithTracerProvider(tp)).Run(ctx); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		launch.End()
+
+		var got []string
+		for _, s := range sr.Ended() {
+			if s.Name() == "launch" {
+				continue
+			}
+			if s.Parent().SpanID() != launch.SpanContext().SpanID() {
+				t.Errorf("%s: %s is not a child of the launching span", name, s.Name())
+			}
+			attrs := make(map[attribute.Key]string)
+			for _, kv := range s.Attributes() {
+				attrs[kv.Key] = kv.Value.Emit()
+			}
+			switch s.Name() {
+			case "vfs.open", "vfs.write":
+				got = append(got, fmt.Sprintf("%s %s %s %s %s", s.Name(), attrs["vfs.path"], attrs["syscall.name"], attrs["vfs.result"], attrs["vfs.bytes"]))
+				if s.Name() == "vfs.write" && attrs["process.pid"] != strconv.Itoa(cmd.Process.Pid) {
+					t.Errorf("%s: write by pid %s, want %d", name, attrs["process.pid"], cmd.Process.Pid)
+				}
+			}
+			if attrs["vfs.result"] == "ENOENT" && s.Status().Code != codes.Error {
+				t.Errorf("%s: failed %s has status %v", name, s.Name(), s.Status())
+			}
+		}
+		want := []string{
+			"vfs.open /data/f openat ok ",
+			"vfs.write /data/f write ok 6",
+			"vfs.open /data/missing openat ENOENT ",
+		}
+		for _, w := range want {
+			if !slices.Contains(got, w) {
+				t.Errorf("%s: no span %q in %q", name, w, got)
+			}
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "y"), []byte("remapped\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	logFile := filepath.Join(dir, "audit.jsonl")
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		// Each run appends to the chain of the last.
+		a, err := OpenAuditLog(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := memfs.New()
+		if err := writeFile(m, "f", []byte("mounted\n")); err != nil {
+			t.Fatal(err)
+		}
+		var stdout bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", "cat /data/f /cfc-test-old/y; cat /cfc-test-secret/x 2>/dev/null; true")
+		cmd.Stdout = &stdout
+		tr := New(cmd, WithEngine(engine), WithAuditLog(a),
+			WithMount("/data", m),
+			WithRemap(Remap{From: "/cfc-test-old", To: dir}),
+			WithPathRules(PathRule{Pattern: "/cfc-test-secret", Access: Deny}))
+		if err := tr.Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := stdout.String(), "mounted\nremapped\n"; got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+
+	b, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := VerifyAuditLog(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if n != len(lines) {
+		t.Errorf("verified %d entries of %d", n, len(lines))
+	}
+	seen := make(map[string]int)
+	for _, l := range lines {
+		var e AuditEntry
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Syscall != "openat" {
+			continue
+		}
+		switch e.Path {
+		case "/data/f":
+			if e.Decision == "allowed" && e.Mount == "/data" {
+				seen[e.Path]++
+			}
+		case "/cfc-test-old/y":
+			if e.Decision == "remapped" && e.Target == filepath.Join(dir, "y") {
+				seen[e.Path]++
+			}
+		case "/cfc-test-secret/x":
+			if e.Decision == "denied" && e.Errno == "EACCES" {
+				seen[e.Path]++
+			}
+		}
+	}
+	for _, p := range []string{"/data/f", "/cfc-test-old/y", "/cfc-test-secret/x"} {
+		if seen[p] != 2 {
+			t.Errorf("%s: %d entries as expected, want 2", p, seen[p])
+		}
+	}
+
+	// Changing, removing or reordering entries breaks the chain.
+	changed := strings.Replace(string(b), `"decision":"denied"`, `"decision":"allowed"`, 1)
+	removed := strings.Join(slices.Delete(slices.Clone(lines), 1, 2), "\n")
+	swapped := slices.Clone(lines)
+	swapped[1], swapped[2] = swapped[2], swapped[1]
+	for name, log := range map[string]string{
+		"changed": changed,
+		"removed": removed,
+		"swapped": strings.Join(swapped, "\n"),
+	} {
+		if _, err := VerifyAuditLog(strings.NewReader(log)); err == nil {
+			t.Errorf("%s: log verified", name)
+		}
+	}
+	if err := os.WriteFile(logFile, []byte(changed), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenAuditLog(logFile); err == nil {
+		t.Error("OpenAuditLog of a changed log succeeded")
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	var s Supervisor
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type job struct {
+		tr     *Tracer
+		stdout *bytes.Buffer
+	}
+	var jobs []job
+	for i := range 4 {
+		m := memfs.New()
+		if err := writeFile(m, "f", fmt.Appendf(nil, "job %d\n", i)); err != nil {
+			t.Fatal(err)
+		}
+		var stdout bytes.Buffer
+		// The jobs overlap, and each says which thread traces it.
+		cmd := exec.Command("/bin/sh", "-c", "sleep 0.1; cat /data/f; grep TracerPid /proc/self/status")
+		cmd.Stdout = &stdout
+		tr := New(cmd, WithSupervisor(&s), WithMount("/data", m))
+		if err := tr.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job{tr, &stdout})
+	}
+	// A command killed, or one that fails to start, ends only its own
+	// Tracer.
+	killed := New(exec.Command("/bin/sleep", "10"), WithSupervisor(&s))
+	if err := killed.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	missing := New(exec.Command("/nonexistent"), WithSupervisor(&s))
+	if err := missing.Start(context.Background()); err == nil {
+		t.Error("started a missing command")
+	}
+	cancel()
+	if exit, _ := killed.Wait(); exit == nil || exit.Signal != unix.SIGKILL {
+		t.Errorf("killed command ended with %v", exit)
+	}
+
+	tracers := make(map[string]bool)
+	for i, j := range jobs {
+		if _, err := j.tr.Wait(); err != nil {
+			t.Fatalf("job %d: %v", i, err)
+		}
+		lines := strings.SplitN(j.stdout.String(), "\n", 2)
+		if want := fmt.Sprintf("job %d", i); lines[0] != want {
+			t.Errorf("job %d: got %q, want %q", i, j.stdout.String(), want)
+		}
+		if len(lines) == 2 {
+			tracers[lines[1]] = true
+		}
+	}
+	if len(tracers) != 1 {
+		t.Errorf("jobs traced by %d threads: %v", len(tracers), tracers)
+	}
+
+	// The loop goes when it runs out of work, and starts again for more.
+	cmd := exec.Command("/bin/sh", "-c", "cat /data/f")
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	m := memfs.New()
+	if err := writeFile(m, "f", []byte("again\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := New(cmd, WithSupervisor(&s), WithMount("/data", m)).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != "again\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+// gatedBackend serves a file, gated, whose first read waits until open
+// exists in the backend, or a second has passed, and says which it was.
+type gatedBackend struct {
+	vfs.Backend
+	gated, open string
+}
+
+func (b gatedBackend) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	f, err := b.Backend.Open(name, flag, perm)
+	if err != nil || name != b.gated {
+		return f, err
+	}
+	return &gatedFile{File: f, b: b}, nil
+}
+
+type gatedFile struct {
+	vfs.File
+	b    gatedBackend
+	read bool
+}
+
+func (f *gatedFile) Read(p []byte) (int, error) {
+	if f.read {
+		return 0, io.EOF
+	}
+	f.read = true
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if _, err := f.b.Stat(f.b.open); err == nil {
+			return copy(p, "opened\n"), nil
+		}
+		if time.Now().After(deadline) {
+			return copy(p, "timed out\n"), nil
+		}
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		for _, workers := range []int{0, 2} {
+			m := memfs.New()
+			if err := writeFile(m, "f", nil); err != nil {
+				t.Fatal(err)
+			}
+			var stdout bytes.Buffer
+			// The read of f waits for g, which only a write serviced
+			// meanwhile makes. The subshell outlives the write, so that
+			// no SIGCHLD cuts the shell's syscalls short.
+			cmd := exec.Command("/bin/sh", "-c", "(cat /data/f; sleep 0.2) & sleep 0.05; echo fast >/data/g; wait; cat /data/g")
+			cmd.Stdout = &stdout
+			tr := New(cmd, WithEngine(engine), WithWorkers(workers), WithMount("/data", gatedBackend{m, "f", "g"}))
+			if err := tr.Run(context.Background()); err != nil {
+				t.Fatalf("%s with %d workers: %v", name, workers, err)
+			}
+			want := "timed out\nfast\n"
+			if workers > 0 {
+				want = "opened\nfast\n"
+			}
+			if got := stdout.String(); got != want {
+				t.Errorf("%s with %d workers: got %q, want %q", name, workers, got, want)
+			}
+		}
+	}
+}
+
+// crashingBackend serves a file, boom, whose reads panic, or call
+// runtime.Goexit if exit is set.
+type crashingBackend struct {
+	vfs.Backend
+	exit bool
+}
+
+func (b crashingBackend) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	f, err := b.Backend.Open(name, flag, perm)
+	if err != nil || name != "boom" {
+		return f, err
+	}
+	return crashingFile{f, b.exit}, nil
+}
+
+type crashingFile struct {
+	vfs.File
+	exit bool
+}
+
+func (f crashingFile) Read(p []byte) (int, error) {
+	if f.exit {
+		runtime.Goexit()
+	}
+	panic("boom")
+}
+
+func TestInternalError(t *testing.T) {
+	type run struct {
+		engine  Engine
+		workers int
+		exit    bool
+		super   bool
+	}
+	var runs []run
+	for _, engine := range []Engine{EnginePtrace, EngineUnotify} {
+		for _, workers := range []int{0, 2} {
+			for _, exit := range []bool{false, true} {
+				runs = append(runs, run{engine: engine, workers: workers, exit: exit})
+			}
+		}
+	}
+	runs = append(runs, run{engine: EnginePtrace, super: true}, run{engine: EnginePtrace, exit: true, super: true})
+	for _, r := range runs {
+		name := fmt.Sprintf("engine %d with %d workers, exit %v, supervisor %v", r.engine, r.workers, r.exit, r.super)
+		m := memfs.New()
+		if err := writeFile(m, "boom", []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		var stdout bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", "sleep 30 & echo $! >/mem/pid; cat /mem/boom; echo survived")
+		cmd.Stdout = &stdout
+		opts := []Option{WithEngine(r.engine), WithWorkers(r.workers), WithMount("/mem", crashingBackend{m, r.exit})}
+		if r.super {
+			opts = append(opts, WithSupervisor(&Supervisor{}))
+		}
+		err := New(cmd, opts...).Run(context.Background())
+		var crash *InternalError
+		if !errors.As(err, &crash) {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if r.exit != (crash.Value == nil) {
+			t.Errorf("%s: value %v", name, crash.Value)
+		}
+		if !r.exit && !bytes.Contains(crash.Stack, []byte("crashingFile.Read")) {
+			t.Errorf("%s: stack\n%s", name, crash.Stack)
+		}
+		if crash.Tid == 0 || !strings.HasPrefix(crash.Syscall, "read(") {
+			t.Errorf("%s: tid %d in %q", name, crash.Tid, crash.Syscall)
+		}
+		if (r.engine == EnginePtrace) != strings.Contains(crash.Dump, "stack pointer") {
+			t.Errorf("%s: dump\n%s", name, crash.Dump)
+		}
+		if strings.Contains(stdout.String(), "survived") {
+			t.Errorf("%s: command went on", name)
+		}
+		// The shell's child is killed too.
+		var pid int
+		if f, err := m.Open("pid", os.O_RDONLY, 0); err == nil {
+			b, _ := io.ReadAll(f)
+			f.Close()
+			pid, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+		}
+		for deadline := time.Now().Add(5 * time.Second); pid > 0; time.Sleep(10 * time.Millisecond) {
+			stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+			if err != nil || bytes.Contains(stat, []byte(") Z ")) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("%s: sleep %d left running", name, pid)
+				break
+			}
+		}
+	}
+}
+
+func TestSubreaper(t *testing.T) {
+	// The leader exits first, leaving a child writing late and the
+	// orphan of a shell that did not wait for it.
+	const script = `sh -c 'sleep 0.1; echo $$ >/mem/orphan' &
+(echo ready >/mem/ready; sleep 0.3; echo late >/mem/late) &
+until [ -e /mem/ready ]; do :; done`
+	readPid := func(m *memfs.FS, name string) int {
+		f, err := m.Open(name, os.O_RDONLY, 0)
+		if err != nil {
+			return 0
+		}
+		defer f.Close()
+		b, _ := io.ReadAll(f)
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+		return pid
+	}
+	gone := func(pid int) bool { return unix.Kill(pid, 0) == unix.ESRCH }
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		m := memfs.New()
+		cmd := exec.Command("/bin/sh", "-c", script)
+		if err := New(cmd, WithEngine(engine), WithSubreaper(), WithMount("/mem", m)).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if f, err := m.Open("late", os.O_RDONLY, 0); err != nil {
+			t.Errorf("%s: late write lost: %v", name, err)
+		} else {
+			f.Close()
+		}
+		if pid := readPid(m, "orphan"); pid == 0 || !gone(pid) {
+			t.Errorf("%s: orphan %d not reaped", name, pid)
+		}
+
+		// A cancelled context kills what is left.
+		m = memfs.New()
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		cmd = exec.Command("/bin/sh", "-c", `(echo ready >/mem/ready; exec sleep 30) &
+until [ -e /mem/ready ]; do :; done; echo $! >/mem/pid`)
+		start := time.Now()
+		// The command itself exited with status 0.
+		if err := New(cmd, WithEngine(engine), WithSubreaper(), WithMount("/mem", m)).Run(ctx); err != nil {
+			t.Errorf("%s: cancelled run: %v", name, err)
+		}
+		cancel()
+		if d := time.Since(start); d > 10*time.Second {
+			t.Errorf("%s: cancelled run took %v", name, d)
+		}
+		if pid := readPid(m, "pid"); pid == 0 || !gone(pid) {
+			t.Errorf("%s: sleep %d not reaped", name, pid)
+		}
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		m := memfs.New()
+		if err := writeFile(m, "big", bytes.Repeat([]byte("a"), 64<<10)); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(m, "small", []byte("abc\n")); err != nil {
+			t.Fatal(err)
+		}
+		metrics := NewMetrics()
+		var stdout bytes.Buffer
+		// big is copied once for both cats and readlink, and again once
+		// it has changed; small is read through the tracer.
+		cmd := exec.Command("/bin/sh", "-c", "cat /data/big /data/big /data/small | wc -c; readlink /proc/self/fd/3 3</data/big; echo x >>/data/big; wc -c </data/big")
+		cmd.Stdout = &stdout
+		tr := New(cmd, WithEngine(engine), WithPassthrough(4096), WithMount("/data", m), WithMetrics(metrics))
+		if err := tr.Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got, want := stdout.String(), "131076\n/data/big\n65538\n"; got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+		var body strings.Builder
+		if _, err := metrics.WriteTo(&body); err != nil {
+			t.Fatal(err)
+		}
+		if want := `cfc_ptrace_mount_read_bytes_total{mount="/data"} 131078` + "\n"; !strings.Contains(body.String(), want) {
+			t.Errorf("%s: no %q in\n%s", name, want, body.String())
+		}
+	}
+}
+
+func TestLeases(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		m := memfs.New()
+		if err := writeFile(m, "f", []byte("hello\n")); err != nil {
+			t.Fatal(err)
+		}
+		var stdout bytes.Buffer
+		// Writes reach the backend as the descriptor is closed or
+		// fsynced, or the process holding it exits, and not before.
+		cmd := exec.Command("/bin/sh", "-c", `echo more >>/data/f; cat /data/f; "$0" /data/f /data/g; cat /data/g`, os.Args[0])
+		cmd.Env = append(os.Environ(), helperEnv+"=lease")
+		cmd.Stdout = &stdout
+		tr := New(cmd, WithEngine(engine), WithLeases(), WithMount("/data", m))
+		if err := tr.Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		want := "hello\nmore\n" + `"hello\nmore\n"` + "\n<nil>\n" + `"J\nllo\nmore\n"` + "\nbye\n"
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		m := memfs.New()
+		if err := writeFile(m, "f", []byte("hello world\n")); err != nil {
+			t.Fatal(err)
+		}
+		real := filepath.Join(t.TempDir(), "real")
+		var stdout bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", `"$0" /data/f "$1" /data/g; cat "$1"; echo; cat /data/g`, os.Args[0], real)
+		cmd.Env = append(os.Environ(), helperEnv+"=transfer")
+		cmd.Stdout = &stdout
+		tr := New(cmd, WithEngine(engine), WithMount("/data", m))
+		if err := tr.Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		want := "hello world\n12 <nil>\nworld5 <nil> 11\n5 <nil> 5\n5 <nil>\n7 <nil>\n" +
+			"5 <nil> \"hello\"\ninvalid argument\nhello\nhello piped\n"
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestPollVirtual(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		m := memfs.New()
+		if err := writeFile(m, "f", []byte("hello\n")); err != nil {
+			t.Fatal(err)
+		}
+		cmd := helperCommand(t, "poll", "/data/f")
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		tr := New(cmd, WithEngine(engine), WithMount("/data", m))
+		if err := tr.Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		want := "1 <nil> 5 0\n0 <nil> 0 0\n2 <nil> true false true\n<nil>\n1 <nil> 42 true\n0 <nil>\n"
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestStdio(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		m := memfs.New()
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", "cat >/data/f; cat /data/f; echo oops >&2")
+		tr := New(cmd, WithEngine(engine), WithMount("/data", m), WithStdio(strings.NewReader("in\n"), &stdout, &stderr))
+		if err := tr.Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if stdout.String() != "in\n" || stderr.String() != "oops\n" {
+			t.Errorf("%s: got %q and %q", name, stdout.String(), stderr.String())
+		}
+	}
+}
+
+func TestPTY(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		var out bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", `test -t 0 && test -t 2 && echo tty; stty size; read x; echo "got $x"; cat | wc -l`)
+		// cat ends at the end-of-file character typed after the input.
+		tr := New(cmd, WithEngine(engine), WithPTY(24, 100), WithStdio(strings.NewReader("hi\nmore\n"), &out, nil))
+		if err := tr.Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, want := range []string{"tty\r\n", "24 100\r\n", "got hi\r\n", "1\r\n"} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("%s: got %q, want it to hold %q", name, out.String(), want)
+			}
+		}
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		// The tracer stands in for the slave end of a terminal of the
+		// test's own, at which the test types through the master.
+		fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			t.Skip(err)
+		}
+		master := os.NewFile(uintptr(fd), "/dev/ptmx")
+		defer master.Close()
+		term, err := openSlave(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer term.Close()
+		if err := unix.IoctlSetWinsize(int(term.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: 30, Col: 120}); err != nil {
+			t.Fatal(err)
+		}
+		modes, err := unix.IoctlGetTermios(int(term.Fd()), unix.TCGETS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modes.Lflag &^= unix.ECHO
+		if err := unix.IoctlSetTermios(int(term.Fd()), unix.TCSETS, modes); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", `stty size; stty -a | tr ' ;' '\n\n' | grep -x -- -echo; read x; echo "got $x"`)
+		cmd.Stdout = &out
+		tr := New(cmd, WithEngine(engine), WithTerminal(term))
+		if err := tr.Start(context.Background()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		master.Write([]byte("typed\n"))
+		if _, err := tr.Wait(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if want := "30 120\r\n-echo\r\ngot typed\r\n"; out.String() != want {
+			t.Errorf("%s: got %q, want %q", name, out.String(), want)
+		}
+		after, err := unix.IoctlGetTermios(int(term.Fd()), unix.TCGETS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *after != *modes {
+			t.Errorf("%s: the terminal's modes were left as %+v", name, after)
+		}
+	}
+}
+
+func TestUserNamespace(t *testing.T) {
+	const script = `id -u; id -g; echo $$
+cat /mem/f
+(cat /mem/f)
+mount -t tmpfs none "$1" && echo x >"$1/f" && echo mounted`
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		dir := t.TempDir()
+		mem := memfs.New()
+		f, _ := mem.Open("f", os.O_WRONLY|os.O_CREATE, 0o644)
+		f.Write([]byte("virtual\n"))
+		f.Close()
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", script, "sh", dir)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		tr := New(cmd, WithEngine(engine), WithMount("/mem", mem), WithUserNamespace(UserNamespace{Mount: true, PID: true}))
+		if err := tr.Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		if got, want := stdout.String(), "0\n0\n1\nvirtual\nvirtual\nmounted\n"; got != want {
+			t.Errorf("%s: got %q, want %q; stderr %q", name, got, want, stderr.String())
+		}
+		if _, err := os.Stat(filepath.Join(dir, "f")); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: the command's mount reached the host: %v", name, err)
+		}
+	}
+}
+
+func TestInotify(t *testing.T) {
+	// The events are those of a host directory, but for IN_OPEN coming
+	// with IN_CLOSE_WRITE.
+	host, err := helperCommand(t, "inotify", t.TempDir()).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(string(host), "dir OPEN f\ndir MODIFY f\n", "dir MODIFY f\ndir OPEN f\n", 1)
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		cmd := helperCommand(t, "inotify", "/data")
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		tr := New(cmd, WithEngine(engine), WithMount("/data", memfs.New()))
+		if err := tr.Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", name, got, want)
+		}
+	}
+}
+
+func TestGoRuntime(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		m := memfs.New()
+		f, _ := m.Open("f", os.O_WRONLY|os.O_CREATE, 0o644)
+		f.Write([]byte("served"))
+		f.Close()
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "goruntime", "/mem")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, WithEngine(engine), WithMount("/mem", m)).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		want := "user defined signal 1\n" + strings.Repeat("200 served <nil>\n", 8) + "true true\n"
+		if got := stdout.String(); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+// goCommand returns a go command with the given arguments, skipping the
+// test where there is no go to run.
+func goCommand(t *testing.T, args ...string) *exec.Cmd {
+	t.Helper()
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command")
+	}
+	cmd := exec.Command(gobin, args...)
+	cmd.Env = append(os.Environ(), "GOTOOLCHAIN=local", "GOFLAGS=", "GOWORK=off", "CGO_ENABLED=0")
+	return cmd
+}
+
+func TestGoProgram(t *testing.T) {
+	dir := t.TempDir()
+	build := goCommand(t, "build", "-o", filepath.Join(dir, "testprog"), "../testprog")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		var stderr bytes.Buffer
+		cmd := exec.Command(filepath.Join(dir, "testprog"))
+		cmd.Dir, cmd.Stderr = dir, &stderr
+		if err := New(cmd, WithEngine(engine), WithMount(filepath.Join(dir, "fs"), memfs.New())).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		if _, err := os.Stat(filepath.Join(dir, "fs")); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: the program wrote to the host: %v", name, err)
+		}
+	}
+}
+
+// TestSyscallTables checks that the syscall tables are those syscalls.txt
+// makes, so that a change to it is not left unregenerated.
+func TestSyscallTables(t *testing.T) {
+	dir := t.TempDir()
+	if out, err := goCommand(t, "run", "mksyscalls.go", "-d", dir).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "zsyscalls_*.go"))
+	if len(files) == 0 {
+		t.Fatal("mksyscalls wrote no tables")
+	}
+	for _, f := range files {
+		want, _ := os.ReadFile(f)
+		if got, err := os.ReadFile(filepath.Base(f)); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s is out of date: run go generate", filepath.Base(f))
+		}
+	}
+}
+
+func TestGoBuild(t *testing.T) {
+	// The host's build cache is mounted too, for the go command, the
+	// compiler and the linker to map their inputs from, and the program
+	// is changed each time so that it is compiled again.
+	out, err := goCommand(t, "env", "GOCACHE").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := vfs.Dir(strings.TrimSpace(string(out)))
+	src, err := os.ReadFile("../testprog/main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		m := memfs.New()
+		m.Mkdir("src", 0o755)
+		for file, data := range map[string]string{
+			"src/go.mod":  "module testprog\n\ngo 1.21\n",
+			"src/main.go": fmt.Sprintf("%s\n// Built under the %s engine at %d.\n", src, name, time.Now().UnixNano()),
+		} {
+			f, _ := m.Open(file, os.O_WRONLY|os.O_CREATE, 0o644)
+			f.Write([]byte(data))
+			f.Close()
+		}
+		var stderr bytes.Buffer
+		cmd := goCommand(t, "build", "-C", "/mem/src", "-o", "/mem/testprog", ".")
+		cmd.Env = append(cmd.Env, "GOCACHE=/cache")
+		cmd.Stderr = &stderr
+		if err := New(cmd, WithEngine(engine), WithMount("/mem", m), WithMount("/cache", cache)).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		f, err := m.Open("testprog", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		magic := make([]byte, 4)
+		f.ReadAt(magic, 0)
+		f.Close()
+		if string(magic) != "\x7fELF" {
+			t.Errorf("%s: built %q", name, magic)
+		}
+	}
+}
+
+func TestIoctl(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0o644)
+	m := memfs.New()
+	f, _ := m.Open("file", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Write([]byte("hello"))
+	f.Close()
+	run := func(opts ...Option) string {
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "ioctl", "/mem/file", "/dir/file")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		opts = append(opts, WithMount("/mem", m), WithMount("/dir", vfs.Dir(dir)))
+		if err := New(cmd, opts...).Run(context.Background()); err != nil {
+			t.Fatalf("%v: %s", err, stderr.String())
+		}
+		return stdout.String()
+	}
+	emulated := `3 <nil>
+inappropriate ioctl for device
+errno 0 1
+0 <nil>
+4096 <nil>
+`
+	if got := run(); got != emulated+emulated {
+		t.Errorf("emulated: got %q, want %q", got, emulated+emulated)
+	}
+	// FIONREAD is forwarded, which the host file answers and memfs's
+	// cannot, and FIGETBSZ denied.
+	got := run(WithIoctls(
+		IoctlRule{Request: 0x2, Action: IoctlDeny, Errno: syscall.EPERM},
+		IoctlRule{Request: 0x541b, Action: IoctlForward, Size: 4},
+	))
+	want := `0 inappropriate ioctl for device
+inappropriate ioctl for device
+errno 0 1
+0 <nil>
+0 operation not permitted
+3 <nil>
+inappropriate ioctl for device
+errno 0 1
+0 <nil>
+0 operation not permitted
+`
+	if got != want {
+		t.Errorf("rules: got %q, want %q", got, want)
+	}
+}
+
+func TestWriteStreaming(t *testing.T) {
+	const size = 5<<20 + 123
+	want := make([]byte, size)
+	for i := range want {
+		want[i] = byte(i % 251)
+	}
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		out  string
+	}{
+		{"off", nil, "1048576 <nil>\n1048576 <nil>\n"},
+		{"streaming", []Option{WithWriteStreaming(64<<10, 4)}, fmt.Sprintf("%d <nil>\n%[1]d <nil>\n", size)},
+		{"workers", []Option{WithWriteStreaming(1<<20, 1), WithWorkers(2)}, fmt.Sprintf("%d <nil>\n%[1]d <nil>\n", size)},
+	} {
+		m := memfs.New()
+		var stdout, stderr bytes.Buffer
+		cmd := helperCommand(t, "bigwrite", "/mem/file", strconv.Itoa(size))
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := New(cmd, append(tc.opts, WithMount("/mem", m))...).Run(context.Background()); err != nil {
+			t.Fatalf("%s: %v: %s", tc.name, err, stderr.String())
+		}
+		if got := stdout.String(); got != tc.out {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.out)
+		}
+		if tc.opts == nil {
+			continue
+		}
+		f, err := m.Open("file", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(f)
+		f.Close()
+		if !bytes.Equal(got, append(want, want...)) {
+			t.Errorf("%s: file holds %d bytes, not the %d written", tc.name, len(got), 2*size)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rate Rate
+		size int
+		min  time.Duration
+	}{
+		// The open, write and pwrite64 take an op each, two of them late.
+		{"ops", Rate{OpsPerSec: 10, OpsBurst: 1}, 10, 200 * time.Millisecond},
+		// 512 KiB, 64 KiB of them at once, at 1 MiB a second.
+		{"bytes", Rate{BytesPerSec: 1 << 20, BytesBurst: 64 << 10}, 256 << 10, 400 * time.Millisecond},
+	} {
+		for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+			var stdout, stderr bytes.Buffer
+			cmd := helperCommand(t, "bigwrite", "/mem/file", strconv.Itoa(tc.size))
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			start := time.Now()
+			err := New(cmd, WithEngine(engine), WithMount("/mem", memfs.New(), Throttle(tc.rate))).Run(context.Background())
+			if err != nil {
+				t.Fatalf("%s %s: %v: %s", tc.name, name, err, stderr.String())
+			}
+			if d := time.Since(start); d < tc.min {
+				t.Errorf("%s %s: took %v, want at least %v", tc.name, name, d, tc.min)
+			}
+			if want := fmt.Sprintf("%d <nil>\n%[1]d <nil>\n", tc.size); stdout.String() != want {
+				t.Errorf("%s %s: got %q, want %q", tc.name, name, stdout.String(), want)
+			}
+		}
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	for name, engine := range map[string]Engine{"ptrace": EnginePtrace, "unotify": EngineUnotify} {
+		var pauses []string
+		pause := func(s *Syscall) DebugAction {
+			p, _ := s.Path()
+			fds := s.FDs()
+			pauses = append(pauses, fmt.Sprintf("%s %s %d", s.Name(), p, len(fds)))
+			if len(pauses) == 1 {
+				if len(fds) != 1 || fds[0].Path != "/mem/file" || fds[0].Offset != 4 {
+					t.Errorf("%s: fds %+v", name, fds)
+				}
+				if _, err := s.Registers(); (err == nil) != (engine == EnginePtrace) {
+					t.Errorf("%s: registers: %v", name, err)
+				}
+				return DebugStep
+			}
+			if s.Nr == unix.SYS_PWRITE64 && s.String() != `pwrite64(1048576, "\x00\x01\x02\x03", 4, 4) = 4` {
+				t.Errorf("%s: stepped to %q", name, s.String())
+			}
+			return DebugContinue
+		}
+		var stderr bytes.Buffer
+		cmd := helperCommand(t, "bigwrite", "/mem/file", "4")
+		cmd.Stderr = &stderr
+		err := New(cmd, WithEngine(engine), WithMount("/mem", memfs.New()),
+			WithDebugger(pause, Breakpoint{Syscall: unix.SYS_PWRITE64, Path: "/mem/*"})).Run(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %v: %s", name, err, stderr.String())
+		}
+		// Under unotify, the step goes on to the next syscall.
+		if len(pauses) != 2 || pauses[0] != "pwrite64 /mem/file 1" || engine == EnginePtrace && pauses[1] != pauses[0] {
+			t.Errorf("%s: paused at %q", name, pauses)
+		}
+	}
+}
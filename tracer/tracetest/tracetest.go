@@ -0,0 +1,289 @@
+// Package tracetest provides utilities for testing programs under the
+// tracer, as net/http/httptest does for HTTP handlers. Func and Command
+// run a closure or a command under a Tracer inside go test and record
+// what it wrote and the events it caused; Seed fills a backend to mount
+// beforehand and CheckFS compares what the command left in one with what
+// a test expects.
+package tracetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+)
+
+// funcEnv names the Func call a copy of the test binary started by Func
+// is to run, as the test's name and the number of the call in it.
+const funcEnv = "CFC_TRACETEST_FUNC"
+
+// ErrNotRun is the error of the Result of a Func call that a copy of the
+// test binary running another call's function reaches and skips.
+var ErrNotRun = errors.New("tracetest: run in another call's process")
+
+// Result is how a traced command went.
+type Result struct {
+	// Stdout and Stderr hold what the command wrote to them, unless the
+	// command was given writers of its own.
+	Stdout, Stderr string
+	// Events are the events the tracer sent, in order.
+	Events []tracer.Event
+	// Exit is how the command ended, or nil if it never started.
+	Exit *tracer.ExitState
+	// Err is the error Tracer.Run returned, which is an *exec.ExitError if
+	// the command exited with a nonzero status.
+	Err error
+}
+
+// Events returns the events of r of type E, in order.
+func Events[E tracer.Event](r *Result) []E {
+	var es []E
+	for _, e := range r.Events {
+		if e, ok := e.(E); ok {
+			es = append(es, e)
+		}
+	}
+	return es
+}
+
+// Command runs cmd under a Tracer set up with opts until it exits, or
+// until t's context is cancelled, and returns how it went.
+func Command(t testing.TB, cmd *exec.Cmd, opts ...tracer.Option) *Result {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	if cmd.Stdout == nil {
+		cmd.Stdout = &stdout
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = &stderr
+	}
+	tr := tracer.New(cmd, opts...)
+	r := new(Result)
+	events := tr.Events()
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		for e := range events {
+			r.Events = append(r.Events, e)
+		}
+	}()
+	if r.Err = tr.Start(t.Context()); r.Err == nil {
+		r.Exit, r.Err = tr.Wait()
+	}
+	<-received
+	r.Stdout, r.Stderr = stdout.String(), stderr.String()
+	return r
+}
+
+// calls counts the Func calls each test has made in this process.
+var calls = struct {
+	sync.Mutex
+	n map[string]int
+}{n: make(map[string]int)}
+
+// Func runs f in a copy of the test binary under a Tracer set up with
+// opts, as Command does, and returns how it went. The process exits with
+// status 0 once f returns, unless f exits or panics first.
+//
+// The copy runs the calling test again, up to the call, and runs f there,
+// so f can use what the test set up, and the test must come to the call
+// the same way each time. The Func calls the copy comes to before it, in
+// the test and the tests that contain it, return a Result with ErrNotRun
+// rather than starting copies of their own; a test with several calls and
+// checks on each that stop it, as t.Fatal does, is better split into
+// subtests.
+func Func(t testing.TB, f func(), opts ...tracer.Option) *Result {
+	t.Helper()
+	calls.Lock()
+	n := calls.n[t.Name()]
+	calls.n[t.Name()]++
+	calls.Unlock()
+	call := t.Name() + "#" + strconv.Itoa(n)
+	switch os.Getenv(funcEnv) {
+	case call:
+		f()
+		os.Exit(0)
+	case "":
+	default:
+		return &Result{Err: ErrNotRun}
+	}
+	var run []string
+	for _, name := range strings.Split(t.Name(), "/") {
+		run = append(run, "^"+regexp.QuoteMeta(name)+"$")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run="+strings.Join(run, "/"))
+	cmd.Env = append(os.Environ(), funcEnv+"="+call)
+	return Command(t, cmd, opts...)
+}
+
+// Seed writes files into b: each regular file with its data, each symlink
+// to the target its data holds and each directory, with the parent
+// directories of every entry. A file or directory with no permission bits
+// gets 0o644 or 0o755. Seed fails t if b does.
+func Seed(t testing.TB, b vfs.Backend, files fstest.MapFS) {
+	t.Helper()
+	if err := seed(b, files); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func seed(b vfs.Backend, files fstest.MapFS) error {
+	mkdir := func(name string, perm fs.FileMode) error {
+		err := b.Mkdir(name, perm)
+		if errors.Is(err, fs.ErrExist) {
+			if fi, serr := b.Lstat(name); serr == nil && fi.IsDir() {
+				return b.Chmod(name, perm)
+			}
+		}
+		return err
+	}
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		f := files[name]
+		if !fs.ValidPath(name) {
+			return fmt.Errorf("seed: bad name %q", name)
+		}
+		if dir := path.Dir(name); dir != "." {
+			parts := strings.Split(dir, "/")
+			for i := range parts {
+				p := strings.Join(parts[:i+1], "/")
+				if _, err := b.Lstat(p); err == nil {
+					continue
+				}
+				if err := b.Mkdir(p, 0o755); err != nil {
+					return err
+				}
+			}
+		}
+		perm := f.Mode &^ fs.ModeType
+		switch {
+		case f.Mode.IsDir():
+			if perm.Perm() == 0 {
+				perm |= 0o755
+			}
+			if err := mkdir(name, perm); err != nil {
+				return err
+			}
+		case f.Mode&fs.ModeSymlink != 0:
+			if err := b.Symlink(string(f.Data), name); err != nil {
+				return err
+			}
+			continue
+		default:
+			if perm.Perm() == 0 {
+				perm |= 0o644
+			}
+			w, err := b.Open(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(f.Data)
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+			if err == nil {
+				// The mode given to open is only for a file that is new.
+				err = b.Chmod(name, perm)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if !f.ModTime.IsZero() {
+			if err := b.Chtimes(name, f.ModTime, f.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MemFS returns a memfs.FS that Seed has written files into.
+func MemFS(t testing.TB, files fstest.MapFS) *memfs.FS {
+	t.Helper()
+	m := memfs.New()
+	Seed(t, m, files)
+	return m
+}
+
+// CheckFS reports as errors of t how the tree b holds differs from
+// the one Seed would write from want, as vfs.Diff compares them: data,
+// symlink targets, types and permission bits, and no times or owners.
+func CheckFS(t testing.TB, b vfs.Backend, want fstest.MapFS) {
+	t.Helper()
+	w := MemFS(t, want)
+	changes, err := vfs.Diff(w, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range changes {
+		switch c.Kind {
+		case vfs.Created:
+			t.Errorf("%s: not wanted", c.Name)
+		case vfs.Deleted:
+			t.Errorf("%s: missing", c.Name)
+		default:
+			t.Errorf("%s: %s, want %s", c.Name, describe(b, c.Name), describe(w, c.Name))
+		}
+	}
+}
+
+// describe says what the entry name of b is, for CheckFS.
+func describe(b vfs.Backend, name string) string {
+	fi, err := b.Lstat(name)
+	if err != nil {
+		return err.Error()
+	}
+	switch {
+	case fi.Mode().IsRegular():
+		f, err := b.Open(name, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err.Error()
+		}
+		defer f.Close()
+		data, err := io.ReadAll(io.LimitReader(f, 256))
+		if err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("%v %q", fi.Mode(), data)
+	case fi.Mode()&fs.ModeSymlink != 0:
+		target, err := b.Readlink(name)
+		if err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("symlink to %q", target)
+	}
+	return fi.Mode().String()
+}
+
+// ReadFile returns the data of the file name in b, failing t if it cannot
+// be read.
+func ReadFile(t testing.TB, b vfs.Backend, name string) string {
+	t.Helper()
+	f, err := b.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,130 @@
+package tracetest_test
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/tracer/tracetest"
+)
+
+func TestFunc(t *testing.T) {
+	for name, engine := range map[string]tracer.Engine{"ptrace": tracer.EnginePtrace, "unotify": tracer.EngineUnotify} {
+		t.Run(name, func(t *testing.T) {
+			m := tracetest.MemFS(t, fstest.MapFS{
+				"in":  {Data: []byte("hello")},
+				"out": {Mode: fs.ModeDir | 0o700},
+			})
+			r := tracetest.Func(t, func() {
+				b, err := os.ReadFile("/mem/in")
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				os.WriteFile("/mem/out/up", []byte(strings.ToUpper(string(b))), 0o600)
+				fmt.Println("read", len(b))
+			}, tracer.WithEngine(engine), tracer.WithMount("/mem", m))
+			if r.Err != nil {
+				t.Fatalf("%v: %s", r.Err, r.Stderr)
+			}
+			if r.Stdout != "read 5\n" {
+				t.Errorf("stdout %q", r.Stdout)
+			}
+			tracetest.CheckFS(t, m, fstest.MapFS{
+				"in":     {Data: []byte("hello")},
+				"out":    {Mode: fs.ModeDir | 0o700},
+				"out/up": {Data: []byte("HELLO"), Mode: 0o600},
+			})
+			var written []string
+			for _, e := range tracetest.Events[*tracer.FileWritten](r) {
+				written = append(written, fmt.Sprint(e.Path, " ", e.N))
+			}
+			if got := strings.Join(written, ","); got != "/mem/out/up 5" {
+				t.Errorf("written %q", got)
+			}
+		})
+	}
+}
+
+func TestFuncCalls(t *testing.T) {
+	// Each call runs its own function, and gets ErrNotRun in the copy
+	// running the other's.
+	first := tracetest.Func(t, func() { fmt.Print("first") })
+	second := tracetest.Func(t, func() { fmt.Print("second") })
+	if os.Getenv("CFC_TRACETEST_FUNC") != "" {
+		if !errors.Is(first.Err, tracetest.ErrNotRun) {
+			t.Errorf("first: %v", first.Err)
+		}
+		return
+	}
+	for _, r := range []*tracetest.Result{first, second} {
+		if r.Err != nil {
+			t.Fatalf("%v: %s", r.Err, r.Stderr)
+		}
+	}
+	if first.Stdout != "first" || second.Stdout != "second" {
+		t.Errorf("got %q and %q", first.Stdout, second.Stdout)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	m := tracetest.MemFS(t, nil)
+	r := tracetest.Command(t, exec.Command("/bin/sh", "-c", "echo hi >/mem/f; ln -s f /mem/l; echo oops >&2; exit 3"), tracer.WithMount("/mem", m))
+	var exit *exec.ExitError
+	if !errors.As(r.Err, &exit) || r.Exit == nil || r.Exit.Code != 3 {
+		t.Fatalf("exit %+v, %v", r.Exit, r.Err)
+	}
+	if r.Stderr != "oops\n" {
+		t.Errorf("stderr %q", r.Stderr)
+	}
+	if got := tracetest.ReadFile(t, m, "f"); got != "hi\n" {
+		t.Errorf("f = %q", got)
+	}
+	tracetest.CheckFS(t, m, fstest.MapFS{
+		"f": {Data: []byte("hi\n")},
+		"l": {Data: []byte("f"), Mode: fs.ModeSymlink},
+	})
+}
+
+// recorder is a testing.TB that keeps the errors reported to it.
+type recorder struct {
+	testing.TB
+	errs []string
+}
+
+func (r *recorder) Errorf(format string, args ...any) {
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+}
+
+func TestCheckFS(t *testing.T) {
+	m := tracetest.MemFS(t, fstest.MapFS{
+		"a":       {Data: []byte("one")},
+		"dir/b":   {Data: []byte("two"), Mode: 0o755},
+		"link":    {Data: []byte("a"), Mode: fs.ModeSymlink},
+		"extra/c": {},
+	})
+	r := &recorder{TB: t}
+	tracetest.CheckFS(r, m, fstest.MapFS{
+		"a":       {Data: []byte("uno")},
+		"dir/b":   {Data: []byte("two")},
+		"link":    {Data: []byte("dir"), Mode: fs.ModeSymlink},
+		"missing": {},
+	})
+	want := []string{
+		`a: -rw-r--r-- "one", want -rw-r--r-- "uno"`,
+		`dir/b: -rwxr-xr-x "two", want -rw-r--r-- "two"`,
+		"extra: not wanted",
+		"extra/c: not wanted",
+		`link: symlink to "a", want symlink to "dir"`,
+		"missing: missing",
+	}
+	if got := strings.Join(r.errs, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", got, strings.Join(want, "\n"))
+	}
+}
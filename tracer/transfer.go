@@ -0,0 +1,344 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+// A transfer is a sendfile, splice or copy_file_range with a virtual file
+// on at least one side. The kernel cannot see the virtual file, so the
+// tracer copies the bytes itself, with a read of one side and a write of
+// the other, through a copy of the descriptor of the side that is real.
+// Like the kernel's, a transfer may move fewer bytes than it was asked
+// to, and the command calls it again for the rest.
+
+// transferEnd is one side of a transfer: the virtual file f, or, if f is
+// nil, fd, the tracer's copy of a real descriptor of the thread. off is
+// where the side is read or written, or -1 for its file offset; offPtr is
+// where the thread keeps off, if it passed one.
+type transferEnd struct {
+	f      *vfile
+	fd     int
+	off    int64
+	offPtr uintptr
+}
+
+// transferEnd returns the side of a transfer that is the thread's
+// descriptor fd, with the offset at offPtr if it is not 0. It returns an
+// errno on failure, and the end must be closed otherwise.
+func (th *thread) transferEnd(fd int, offPtr uintptr) (*transferEnd, unix.Errno) {
+	e := &transferEnd{fd: -1, off: -1, offPtr: offPtr}
+	if f, ok := th.fds.get(fd); ok {
+		e.f = f
+	} else {
+		dup, err := th.dupFD(fd)
+		if err != nil {
+			return nil, unix.EBADF
+		}
+		e.fd = dup
+	}
+	if offPtr != 0 {
+		b, err := th.mem.readBytes(offPtr, 8)
+		if err != nil {
+			e.close()
+			return nil, unix.EFAULT
+		}
+		if e.off = int64(binary.LittleEndian.Uint64(b)); e.off < 0 {
+			e.close()
+			return nil, unix.EINVAL
+		}
+	}
+	return e, 0
+}
+
+func (e *transferEnd) close() {
+	if e.f == nil {
+		unix.Close(e.fd)
+	}
+}
+
+// accmode returns the access mode the side was opened with.
+func (e *transferEnd) accmode() (int, error) {
+	if e.f != nil {
+		return e.f.flags & unix.O_ACCMODE, nil
+	}
+	flags, err := unix.FcntlInt(uintptr(e.fd), unix.F_GETFL, 0)
+	return flags & unix.O_ACCMODE, err
+}
+
+// appending reports whether the side was opened with O_APPEND.
+func (e *transferEnd) appending() bool {
+	if e.f != nil {
+		return e.f.flags&unix.O_APPEND != 0
+	}
+	flags, err := unix.FcntlInt(uintptr(e.fd), unix.F_GETFL, 0)
+	return err == nil && flags&unix.O_APPEND != 0
+}
+
+// fileType returns the S_IFMT bits of the side's mode.
+func (e *transferEnd) fileType() (uint32, error) {
+	if e.f != nil {
+		fi, err := e.f.file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case fi.IsDir():
+			return unix.S_IFDIR, nil
+		case fi.Mode().IsRegular():
+			return unix.S_IFREG, nil
+		}
+		return 0, nil
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(e.fd, &st); err != nil {
+		return 0, err
+	}
+	return st.Mode & unix.S_IFMT, nil
+}
+
+func (e *transferEnd) read(b []byte) (int, error) {
+	if e.f != nil {
+		return e.f.read(b, e.off)
+	}
+	if e.off == -1 {
+		return unix.Read(e.fd, b)
+	}
+	return unix.Pread(e.fd, b, e.off)
+}
+
+func (e *transferEnd) write(b []byte) (int, error) {
+	if e.f != nil {
+		return e.f.write(b, e.off)
+	}
+	if e.off == -1 {
+		return unix.Write(e.fd, b)
+	}
+	return unix.Pwrite(e.fd, b, e.off)
+}
+
+// unread moves the file offset of the side back by n bytes it read but
+// the other side did not take, if the side has one.
+func (e *transferEnd) unread(n int) {
+	if n == 0 || e.off != -1 {
+		return
+	}
+	if e.f != nil {
+		_, _ = e.f.file.Seek(-int64(n), io.SeekCurrent)
+		return
+	}
+	_, _ = unix.Seek(e.fd, -int64(n), io.SeekCurrent)
+}
+
+// transfer copies up to count bytes from in to out for the thread's
+// syscall, and closes both once it is done. A worker does the copy if one
+// side is real, since a pipe or socket there may keep it waiting.
+func (th *thread) transfer(in, out *transferEnd, count int) (int64, bool) {
+	if count == 0 {
+		in.close()
+		out.close()
+		return 0, true
+	}
+	b := make([]byte, min(count, maxBufferSize))
+	var werr error
+	do := func() (int, error) {
+		n, err := in.read(b)
+		if n <= 0 {
+			if err == io.EOF {
+				err = nil
+			}
+			return 0, err
+		}
+		w, err := out.write(b[:n])
+		w = max(w, 0)
+		in.unread(n - w)
+		werr = err
+		return w, err
+	}
+	then := func(n int, err error) int64 {
+		defer in.close()
+		defer out.close()
+		if werr == unix.EPIPE && out.f == nil {
+			// The kernel sends SIGPIPE to whoever writes to a broken
+			// pipe, which here the thread would have been.
+			_ = unix.Tgkill(th.pid, th.tid, unix.SIGPIPE)
+		}
+		if n == 0 && err != nil {
+			return errnoRet(err)
+		}
+		if out.f != nil && n > 0 {
+			th.t.passthrough.drop(out.f.mount, out.f.name)
+		}
+		for _, e := range []*transferEnd{in, out} {
+			if e.offPtr == 0 {
+				continue
+			}
+			if err := th.mem.writeBytes(e.offPtr, binary.LittleEndian.AppendUint64(nil, uint64(e.off+int64(n)))); err != nil {
+				return -int64(unix.EFAULT)
+			}
+		}
+		return int64(n)
+	}
+	if in.f == nil || out.f == nil {
+		f := in.f
+		if f == nil {
+			f = out.f
+		}
+		if th.offload(f, do, then) {
+			return 0, true
+		}
+	}
+	return then(do()), true
+}
+
+// transferring reports whether either descriptor is virtual, so that a
+// transfer between them is the tracer's to do.
+func (th *thread) transferring(in, out int) bool {
+	_, vin := th.fds.get(in)
+	_, vout := th.fds.get(out)
+	return vin || vout
+}
+
+// transferEnds returns the sides of a transfer from in to out, with the
+// offsets at inOff and outOff, checking that each was opened for the
+// direction it is used in. It returns an errno on failure.
+func (th *thread) transferEnds(in int, inOff uintptr, out int, outOff uintptr) (*transferEnd, *transferEnd, unix.Errno) {
+	src, errno := th.transferEnd(in, inOff)
+	if errno != 0 {
+		return nil, nil, errno
+	}
+	dst, errno := th.transferEnd(out, outOff)
+	if errno != 0 {
+		src.close()
+		return nil, nil, errno
+	}
+	if mode, err := src.accmode(); err != nil || mode == unix.O_WRONLY {
+		errno = unix.EBADF
+	} else if mode, err := dst.accmode(); err != nil || mode == unix.O_RDONLY {
+		errno = unix.EBADF
+	}
+	if errno != 0 {
+		src.close()
+		dst.close()
+		return nil, nil, errno
+	}
+	return src, dst, 0
+}
+
+// sysSendfile copies from the file in to out, which may be anything, at
+// *offPtr, which it advances, or if offPtr is 0 at in's file offset.
+func (th *thread) sysSendfile(out, in int, offPtr uintptr, count int) (int64, bool) {
+	if !th.transferring(in, out) {
+		return 0, false
+	}
+	th.t.log.Printf("sendfile: out=%d in=%d count=%d (virtual)", out, in, count)
+	if count < 0 {
+		return -int64(unix.EINVAL), true
+	}
+	src, dst, errno := th.transferEnds(in, offPtr, out, 0)
+	if errno != 0 {
+		return -int64(errno), true
+	}
+	if typ, err := src.fileType(); err != nil || typ != unix.S_IFREG || dst.appending() {
+		// in must be something that could be mapped.
+		src.close()
+		dst.close()
+		return -int64(unix.EINVAL), true
+	}
+	ret, ok := th.transfer(src, dst, count)
+	if dst.f != nil {
+		th.wrote(out, dst.f, ret)
+	}
+	return ret, ok
+}
+
+// sysCopyFileRange copies between two regular files, each at the offset
+// its pointer gives, or if that is 0 at its file offset.
+func (th *thread) sysCopyFileRange(in int, inOff uintptr, out int, outOff uintptr, count int, flags uint) (int64, bool) {
+	if !th.transferring(in, out) {
+		return 0, false
+	}
+	th.t.log.Printf("copy_file_range: in=%d out=%d count=%d (virtual)", in, out, count)
+	if flags != 0 || count < 0 {
+		return -int64(unix.EINVAL), true
+	}
+	src, dst, errno := th.transferEnds(in, inOff, out, outOff)
+	if errno != 0 {
+		return -int64(errno), true
+	}
+	fail := func(errno unix.Errno) (int64, bool) {
+		src.close()
+		dst.close()
+		return -int64(errno), true
+	}
+	if dst.appending() {
+		return fail(unix.EBADF)
+	}
+	for _, e := range []*transferEnd{src, dst} {
+		switch typ, err := e.fileType(); {
+		case err != nil:
+			return fail(errnoFor(err))
+		case typ == unix.S_IFDIR:
+			return fail(unix.EISDIR)
+		case typ != unix.S_IFREG:
+			return fail(unix.EINVAL)
+		}
+	}
+	if src.f != nil && src.f == dst.f {
+		// The ranges might overlap, which the kernel refuses.
+		return fail(unix.EINVAL)
+	}
+	ret, ok := th.transfer(src, dst, count)
+	if dst.f != nil {
+		th.wrote(out, dst.f, ret)
+	}
+	return ret, ok
+}
+
+// sysSplice copies between a virtual file and a pipe, the only splice the
+// tracer has to do: one side must be a pipe, and a virtual file never is.
+func (th *thread) sysSplice(in int, inOff uintptr, out int, outOff uintptr, count int, flags int) (int64, bool) {
+	if !th.transferring(in, out) {
+		return 0, false
+	}
+	th.t.log.Printf("splice: in=%d out=%d count=%d (virtual)", in, out, count)
+	if count < 0 {
+		return -int64(unix.EINVAL), true
+	}
+	src, dst, errno := th.transferEnds(in, inOff, out, outOff)
+	if errno != 0 {
+		return -int64(errno), true
+	}
+	fail := func(errno unix.Errno) (int64, bool) {
+		src.close()
+		dst.close()
+		return -int64(errno), true
+	}
+	pipe, events := src, int16(unix.POLLIN)
+	if src.f != nil {
+		pipe, events = dst, unix.POLLOUT
+	}
+	if pipe.f != nil {
+		return fail(unix.EINVAL)
+	}
+	if typ, err := pipe.fileType(); err != nil || typ != unix.S_IFIFO {
+		return fail(unix.EINVAL)
+	}
+	if pipe.offPtr != 0 {
+		return fail(unix.ESPIPE)
+	}
+	if flags&unix.SPLICE_F_NONBLOCK != 0 {
+		// The pipe's own descriptor may block, so it is polled instead.
+		fds := []unix.PollFd{{Fd: int32(pipe.fd), Events: events}}
+		if n, _ := unix.Poll(fds, 0); n == 0 {
+			return fail(unix.EAGAIN)
+		}
+	}
+	ret, ok := th.transfer(src, dst, count)
+	if dst.f != nil {
+		th.wrote(out, dst.f, ret)
+	}
+	return ret, ok
+}
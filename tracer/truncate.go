@@ -0,0 +1,107 @@
+package tracer
+
+import (
+	"math"
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// sysTruncate also handles truncate64, which native turns into truncate.
+// The file is opened for writing through its backend to be truncated.
+func (th *thread) sysTruncate(pathAddr uintptr, size int64) (int64, bool) {
+	abs, m, name, ret, ok := th.virtualTarget(unix.AT_FDCWD, pathAddr)
+	if !ok || ret < 0 {
+		return ret, ok
+	}
+	th.t.log.Printf("truncate: %s size=%d (virtual)", abs, size)
+	if size < 0 {
+		return -int64(unix.EINVAL), true
+	}
+	f, err := m.backend.Open(name, os.O_WRONLY, 0)
+	if err != nil {
+		return errnoRet(err), true
+	}
+	err = vfs.Truncate(f, size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	th.t.passthrough.drop(m, name)
+	if err != nil {
+		return errnoRet(err), true
+	}
+	return 0, true
+}
+
+func (th *thread) sysFtruncate(fd int, size int64) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	th.t.log.Printf("ftruncate: fd=%d size=%d (virtual)", fd, size)
+	// The kernel refuses a descriptor not open for writing with EINVAL
+	// rather than EBADF.
+	if size < 0 || f.flags&unix.O_ACCMODE == unix.O_RDONLY {
+		return -int64(unix.EINVAL), true
+	}
+	th.t.passthrough.drop(f.mount, f.name)
+	if err := vfs.Truncate(f.file, size); err != nil {
+		return errnoRet(err), true
+	}
+	return 0, true
+}
+
+// sysFallocate allocates nothing, as backends keep no record of what of a
+// file is allocated: a range is allocated by growing the file over it, and
+// FALLOC_FL_ZERO_RANGE punches a hole where a filesystem would write
+// zeros. Ranges cannot be collapsed or inserted.
+func (th *thread) sysFallocate(fd, mode int, off, n int64) (int64, bool) {
+	f, ok := th.fds.get(fd)
+	if !ok {
+		return 0, false
+	}
+	th.t.log.Printf("fallocate: fd=%d mode=%#x off=%d len=%d (virtual)", fd, mode, off, n)
+	keep := mode&unix.FALLOC_FL_KEEP_SIZE != 0
+	switch {
+	case off < 0 || n <= 0:
+		return -int64(unix.EINVAL), true
+	case f.flags&unix.O_ACCMODE == unix.O_RDONLY:
+		return -int64(unix.EBADF), true
+	case n > math.MaxInt64-off:
+		return -int64(unix.EFBIG), true
+	}
+	var err error
+	switch mode &^ unix.FALLOC_FL_KEEP_SIZE {
+	case 0:
+		if !keep {
+			err = grow(f.file, off+n)
+		}
+	case unix.FALLOC_FL_PUNCH_HOLE:
+		if !keep {
+			return -int64(unix.EOPNOTSUPP), true
+		}
+		err = vfs.PunchHole(f.file, off, n)
+	case unix.FALLOC_FL_ZERO_RANGE:
+		if err = vfs.PunchHole(f.file, off, n); err == nil && !keep {
+			err = grow(f.file, off+n)
+		}
+	default:
+		return -int64(unix.EOPNOTSUPP), true
+	}
+	th.t.passthrough.drop(f.mount, f.name)
+	if err != nil {
+		return errnoRet(err), true
+	}
+	return 0, true
+}
+
+// grow makes f at least size bytes long.
+func grow(f vfs.File, size int64) error {
+	fi, err := f.Stat()
+	if err != nil || fi.Size() >= size {
+		return err
+	}
+	return vfs.Truncate(f, size)
+}
@@ -0,0 +1,455 @@
+package tracer
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Engine selects how intercepted syscalls reach the tracer.
+type Engine int
+
+const (
+	// EnginePtrace stops the tracee with ptrace at every intercepted
+	// syscall. It is the default.
+	EnginePtrace Engine = iota
+	// EngineUnotify delivers intercepted syscalls through a seccomp
+	// user-notification listener. The tracee is only ptraced while the
+	// filter is installed, so each syscall costs a single round trip and
+	// a debugger can attach to the command.
+	//
+	// The tracer learns about a process only when it first makes an
+	// intercepted syscall. A process inherits a copy of its parent's
+	// virtual descriptors as they are at that point rather than at fork,
+	// and a descendant that never makes an intercepted syscall is not
+	// killed when the command exits. Close-on-exec virtual descriptors
+	// survive exec, since the tracer does not see it. A chdir or fchdir to
+	// a host directory reached through the virtual tree fails with
+	// EOPNOTSUPP. Descriptors opened virtually take the lowest free
+	// number, holding a placeholder there, so that the kernel can map
+	// them; those made by dup and F_DUPFD live from 1<<20 up and cannot be
+	// mapped.
+	EngineUnotify
+	// EngineAuto chooses EngineUnotify where Capabilities finds the host
+	// has what it needs, unless the tracer is given an option that needs
+	// EnginePtrace: WithSeccomp(false), WithPinnedPaths, WithChroot, an
+	// exit hook, as WithDebugger adds, or a Supervisor. Otherwise it
+	// chooses EnginePtrace.
+	EngineAuto
+)
+
+// WithEngine selects the interception engine. If seccomp notifications are
+// not available, EngineUnotify falls back to EnginePtrace.
+func WithEngine(e Engine) Option {
+	return func(t *Tracer) { t.engine = e }
+}
+
+// seccompNotif is struct seccomp_notif.
+type seccompNotif struct {
+	ID    uint64
+	Pid   uint32
+	Flags uint32
+	Nr    int32
+	Arch  uint32
+	IP    uint64
+	Args  [6]uint64
+}
+
+// seccompNotifResp is struct seccomp_notif_resp.
+type seccompNotifResp struct {
+	ID    uint64
+	Val   int64
+	Error int32
+	Flags uint32
+}
+
+// seccompNotifAddfd is struct seccomp_notif_addfd.
+type seccompNotifAddfd struct {
+	ID         uint64
+	Flags      uint32
+	Srcfd      uint32
+	Newfd      uint32
+	NewfdFlags uint32
+}
+
+// process is the unotify engine's bookkeeping for one process. Without
+// ptrace there are no fork or exit events, so each process is tracked
+// through a pidfd that becomes readable when it exits.
+type process struct {
+	pid   int
+	pidfd int
+	fds   *fdTable
+	cwd   *workDir
+}
+
+func (p *process) exit() {
+	_ = unix.Close(p.pidfd)
+	p.fds.release()
+}
+
+// runUnotify takes over from ptrace once the leader has installed a filter
+// whose listener is descriptor remoteFD in the tracee. It detaches from the
+// leader and services notifications until the command exits.
+func (t *Tracer) runUnotify(ctx context.Context, leader *thread, remoteFD int) error {
+	defer t.closeProcs()
+	fail := func(err error) error {
+		_ = t.cmd.Process.Kill()
+		_ = t.cmd.Wait()
+		return err
+	}
+	pidfd, err := unix.PidfdOpen(t.leader, 0)
+	if err != nil {
+		return fail(fmt.Errorf("tracer: pidfd_open: %w", err))
+	}
+	t.procs[t.leader] = &process{pid: t.leader, pidfd: pidfd, fds: leader.fds, cwd: leader.cwd}
+	listener, err := unix.PidfdGetfd(pidfd, remoteFD, 0)
+	if err != nil {
+		return fail(fmt.Errorf("tracer: pidfd_getfd: %w", err))
+	}
+	defer unix.Close(listener)
+	// Placeholder descriptors are copies of /dev/null placed in the tracee.
+	if t.devNull, err = unix.Open("/dev/null", unix.O_RDONLY|unix.O_CLOEXEC, 0); err != nil {
+		return fail(fmt.Errorf("tracer: open /dev/null: %w", err))
+	}
+	defer unix.Close(t.devNull)
+	if t.workers != nil {
+		if t.jobWake, err = unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK); err != nil {
+			return fail(fmt.Errorf("tracer: eventfd: %w", err))
+		}
+		defer unix.Close(t.jobWake)
+		// The workers must be done before the descriptor they wake the
+		// engine with is closed.
+		defer t.drainParked()
+	}
+
+	// close is intercepted, so closing the tracee's copy with it would
+	// block on a notification nobody is reading yet.
+	ret, err := leader.injectSyscall(unix.SYS_CLOSE_RANGE, uint64(remoteFD), uint64(remoteFD), 0)
+	if err != nil {
+		return fail(err)
+	}
+	if ret < 0 {
+		t.log.Printf("listener left open in tracee: close_range: %v", unix.Errno(-ret))
+	}
+	delete(t.threads, t.leader)
+	if err := unix.PtraceDetach(t.leader); err != nil {
+		return fail(fmt.Errorf("tracer: detach: %w", err))
+	}
+
+	// outlived is set once the leader has exited and WithSubreaper waits
+	// for the processes it left behind.
+	outlived := false
+	for {
+		if outlived && (len(t.procs) == 1 || ctx.Err() != nil) {
+			t.reaper.setWake(nil)
+			t.killProcs()
+			err := t.waitLeader()
+			t.reaper.reap(nil)
+			return err
+		}
+		pids := make([]int, 0, len(t.procs))
+		fds := []unix.PollFd{{Fd: int32(listener), Events: unix.POLLIN}}
+		for pid, p := range t.procs {
+			if outlived && pid == t.leader {
+				continue
+			}
+			pids = append(pids, pid)
+			fds = append(fds, unix.PollFd{Fd: int32(p.pidfd), Events: unix.POLLIN})
+		}
+		if t.workers != nil {
+			fds = append(fds, unix.PollFd{Fd: int32(t.jobWake), Events: unix.POLLIN})
+		}
+		if _, err := unix.Ppoll(fds, t.holdTimeout(), nil); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return fail(fmt.Errorf("tracer: poll: %w", err))
+		}
+		// Retire exited processes first so a recycled pid is never
+		// matched to a stale descriptor table.
+		for i, pid := range pids {
+			if fds[i+1].Revents == 0 {
+				continue
+			}
+			if pid == t.leader {
+				if t.reaper == nil || len(t.procs) == 1 || ctx.Err() != nil {
+					t.killProcs()
+					err := t.waitLeader()
+					t.reaper.reap(nil)
+					return err
+				}
+				t.log.Printf("pid %d exited, waiting for the processes it leaves", pid)
+				outlived = true
+				t.reaper.setWake(unotifyWake())
+				continue
+			}
+			t.log.Printf("pid %d exited", pid)
+			t.reaper.adopt(pid, t.procs[pid].pidfd)
+			t.procs[pid].exit()
+			delete(t.procs, pid)
+			t.decisions.exited(pid, pid)
+			t.reaper.reap(nil)
+			t.collectLeases()
+			t.emit(&ProcessExited{Pid: pid, ExitCode: -1})
+		}
+		if fds[0].Revents&unix.POLLIN != 0 {
+			if err := t.guard(func() error { return t.notification(listener) }); err != nil {
+				return fail(err)
+			}
+		}
+		if t.workers != nil && fds[len(fds)-1].Revents&unix.POLLIN != 0 {
+			if err := t.guard(func() error { return t.answerParked(listener) }); err != nil {
+				return fail(err)
+			}
+		}
+		if err := t.guard(func() error { return t.answerHeld(listener) }); err != nil {
+			return fail(err)
+		}
+	}
+}
+
+// notification receives one seccomp notification and answers it, unless a
+// delay holds it.
+func (t *Tracer) notification(listener int) error {
+	var req seccompNotif
+	if err := notifIoctl(listener, unix.SECCOMP_IOCTL_NOTIF_RECV, unsafe.Pointer(&req)); err != nil {
+		if err == unix.ENOENT || err == unix.EINTR {
+			// The task died before its notification was read.
+			return nil
+		}
+		return fmt.Errorf("tracer: notif_recv: %w", err)
+	}
+	t.stops++
+	t.metrics.stop()
+	t.op = spanOp{}
+	call := sysCall{arch: req.Arch, nr: uint64(uint32(req.Nr)), args: req.Args}
+	if th := t.notifiedThread(int(req.Pid)); th != nil {
+		if d := th.delayFor(call); d > 0 {
+			t.held = append(t.held, heldNotification{until: time.Now().Add(d), req: req})
+			return nil
+		}
+	}
+	return t.answer(listener, &req, nil)
+}
+
+// answer answers the notification req, of a thread in the sleep nap on
+// the virtual clock if that is set. Syscalls the tracer does not emulate
+// are let through to the kernel unchanged.
+func (t *Tracer) answer(listener int, req *seccompNotif, nap *clockSleep) error {
+	start := time.Now()
+	call := sysCall{arch: req.Arch, nr: uint64(uint32(req.Nr)), args: req.Args}
+	resp := seccompNotifResp{ID: req.ID, Flags: unix.SECCOMP_USER_NOTIF_FLAG_CONTINUE}
+	var (
+		th       *thread
+		ret      int64
+		emulated bool
+	)
+	busy := false
+	if th = t.notifiedThread(int(req.Pid)); th != nil {
+		t.serving, t.servingCall = th, call
+		if busy = th.job != nil; busy && t.restarted(th, req) {
+			return nil
+		}
+		th.nap = nap
+		ret, emulated, _ = th.hookEnter(&call, nil)
+		if !emulated {
+			ret, emulated = th.enter(call)
+		}
+	}
+	if th != nil && th.job != nil && !busy {
+		// The notification is answered once a worker has done the job.
+		t.parkNotification(req, th, call, start)
+		return nil
+	}
+	if th != nil && th.nap != nil {
+		// The thread sleeps on until the clock is next due, and
+		// is then answered again.
+		t.held = append(t.held, heldNotification{until: time.Now().Add(th.nap.real), req: *req, nap: th.nap})
+		return nil
+	}
+	if th != nil && th.lockWait != nil {
+		// The notification is answered once the lock is free, by
+		// asking again, unless a signal has cut the wait short.
+		held := heldNotification{req: *req}
+		th.lockWait.wake = func() {
+			if notifIoctl(listener, unix.SECCOMP_IOCTL_NOTIF_ID_VALID, unsafe.Pointer(&held.req.ID)) == nil {
+				held.until = time.Now()
+				t.held = append(t.held, held)
+			}
+		}
+		return nil
+	}
+	if th != nil && th.redirect != nil {
+		ret, emulated = t.redirectNotified(listener, req.ID, th), true
+	}
+	if th != nil && th.passing != nil {
+		ret, emulated = t.passNotified(listener, req.ID, th), true
+	}
+	if th != nil && th.mapping != nil {
+		if err := t.addMapping(listener, req.ID, th); err != nil {
+			t.log.Printf("mmap: %v", err)
+			ret, emulated = -int64(unix.ENODEV), true
+		}
+	}
+	if emulated && ret >= fdBase && th.reserve == nil && returnsFD(call) {
+		ret = int64(t.lowerFD(listener, req.ID, th, int(ret)))
+	}
+	if th != nil && t.trace != nil {
+		th.traceSyscall(call, ret, emulated, start)
+	}
+	if emulated && ret >= 0 && th.reserve != nil {
+		if err := t.addPlaceholder(listener, req.ID, th.reserve); err == nil {
+			return nil
+		} else if err == unix.ENOENT {
+			if f, ok := th.fds.remove(int(ret)); ok {
+				_ = f.decref()
+			}
+			return nil
+		}
+	}
+	if emulated {
+		resp.Flags = 0
+		if ret < 0 {
+			resp.Error = int32(ret)
+		} else {
+			resp.Val = ret
+		}
+	}
+	if err := notifIoctl(listener, unix.SECCOMP_IOCTL_NOTIF_SEND, unsafe.Pointer(&resp)); err != nil {
+		if err != unix.ENOENT {
+			return fmt.Errorf("tracer: notif_send: %w", err)
+		}
+		// The task was killed, or a signal interrupted its syscall,
+		// while the syscall was handled. A virtual descriptor it never
+		// saw must not stay open, nor must anything else the syscall
+		// did, as a restarted one would do it again.
+		if emulated && ret >= 0 && returnsFD(call) {
+			if f, ok := th.fds.remove(int(ret)); ok {
+				_ = f.decref()
+			}
+		}
+		if emulated && th.undo != nil {
+			th.undo()
+		}
+	}
+	if th != nil {
+		th.undo = nil
+	}
+	return nil
+}
+
+// addPlaceholder installs the placeholder r asks for in the notifying task
+// and completes its syscall, which then returns r.fd. The placeholder is
+// not close-on-exec, even for a descriptor that is: the engine does not see
+// an exec, after which the virtual descriptor lives on, and its number must
+// stay taken.
+func (t *Tracer) addPlaceholder(listener int, id uint64, r *reservation) error {
+	addfd := seccompNotifAddfd{
+		ID:    id,
+		Flags: unix.SECCOMP_ADDFD_FLAG_SETFD | unix.SECCOMP_ADDFD_FLAG_SEND,
+		Srcfd: uint32(t.devNull),
+		Newfd: uint32(r.fd),
+	}
+	err := notifIoctl(listener, unix.SECCOMP_IOCTL_NOTIF_ADDFD, unsafe.Pointer(&addfd))
+	if err != nil && err != unix.ENOENT {
+		t.log.Printf("seccomp addfd: %v", err)
+	}
+	return err
+}
+
+// lowerFD moves the virtual descriptor fd, which the notifying task of th
+// has just opened, to a placeholder the kernel installs at the lowest
+// number the task has free, as if dup2 had put it there, and returns that
+// number. Only descriptors below fdBase can be mapped, by addMapping, and
+// many programs map the files they open; Go's compiler maps its inputs. fd
+// stays where it is if the task has no number free. The placeholder is not
+// close-on-exec, as addPlaceholder's are not.
+func (t *Tracer) lowerFD(listener int, id uint64, th *thread, fd int) int {
+	addfd := seccompNotifAddfd{ID: id, Srcfd: uint32(t.devNull)}
+	n, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(listener), unix.SECCOMP_IOCTL_NOTIF_ADDFD, uintptr(unsafe.Pointer(&addfd)))
+	if errno != 0 {
+		if errno != unix.ENOENT {
+			t.log.Printf("seccomp addfd: %v", errno)
+		}
+		return fd
+	}
+	th.fds.move(fd, int(n))
+	return int(n)
+}
+
+// notifiedThread returns a thread for the task that raised a notification,
+// tracking its process if it has not been seen before. It returns nil if
+// the task has already gone.
+func (t *Tracer) notifiedThread(tid int) *thread {
+	p, ok := t.procs[tid]
+	if !ok {
+		tgid, ok := statusPid(tid, "Tgid")
+		if !ok {
+			return nil
+		}
+		if p, ok = t.procs[tgid]; !ok {
+			ppid, _ := statusPid(tid, "PPid")
+			pidfd, err := unix.PidfdOpen(tgid, 0)
+			if err != nil {
+				return nil
+			}
+			p = &process{pid: tgid, pidfd: pidfd}
+			if parent, ok := t.procs[ppid]; ok {
+				p.fds, p.cwd = parent.fds.clone(), parent.cwd.clone()
+			} else {
+				p.fds, p.cwd = newFDTable(), &workDir{}
+			}
+			t.procs[tgid] = p
+			t.log.Printf("pid %d: new child %d", ppid, tgid)
+			if _, ok := t.procs[ppid]; ok {
+				t.emit(&ProcessForked{Pid: ppid, Child: tgid})
+			}
+		}
+	}
+	return &thread{t: t, tid: tid, pid: p.pid, mem: vmMemory(tid), fds: p.fds, cwd: p.cwd}
+}
+
+func statusPid(tid int, key string) (int, bool) {
+	v, ok := statusField(tid, key)
+	if !ok {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(v)
+	return pid, err == nil
+}
+
+// killProcs kills every known process other than the leader. Under
+// WithSubreaper it waits for them to exit too, so that they can be reaped
+// once the leader has been.
+func (t *Tracer) killProcs() {
+	var killed []unix.PollFd
+	for pid, p := range t.procs {
+		if pid != t.leader {
+			_ = unix.PidfdSendSignal(p.pidfd, unix.SIGKILL, nil, 0)
+			if t.reaper != nil {
+				t.reaper.adopt(pid, p.pidfd)
+				killed = append(killed, unix.PollFd{Fd: int32(p.pidfd), Events: unix.POLLIN})
+			}
+		}
+	}
+	awaitKilled(killed)
+}
+
+func (t *Tracer) closeProcs() {
+	for pid, p := range t.procs {
+		p.exit()
+		delete(t.procs, pid)
+	}
+}
+
+func notifIoctl(fd int, req uint, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package tracer
+
+import (
+	"os"
+	"syscall"
+)
+
+// IDMap maps Size user or group IDs from Inside, in a user namespace, to
+// those from Outside, in the tracer's, as a line of /proc/PID/uid_map
+// does.
+type IDMap struct {
+	Inside, Outside, Size uint32
+}
+
+// UserNamespace describes the namespaces WithUserNamespace runs the command
+// in.
+type UserNamespace struct {
+	// UIDs and GIDs map the user and group IDs of the namespace. Each
+	// defaults to mapping root to the tracer's own ID, which without
+	// privilege is the only ID that can be mapped.
+	UIDs, GIDs []IDMap
+	// Mount gives the command a mount namespace of its own too, in which
+	// it can mount and unmount without the host seeing.
+	Mount bool
+	// PID gives the command a PID namespace of its own too, in which it
+	// is process 1.
+	PID bool
+}
+
+// WithUserNamespace starts the command in a new user namespace, and
+// optionally new mount and PID namespaces, as ns says. With the default
+// maps the command is root in there, without any privilege on the host: it
+// can chown and mount what the namespace owns, and sees host files of IDs
+// the maps leave out as owned by the overflow ID, 65534. Only a privileged
+// tracer can map more than its own IDs, and only it lets the command call
+// setgroups.
+//
+// Mounts, remapping and the rest of the tracer work as without namespaces.
+// The IDs stat reports for virtual files are the backend's, taken as IDs in
+// the namespace. Pids everywhere in the API, as in events, are those the
+// tracer sees, and so are the numbered directories of /proc, unless the
+// command mounts a /proc of its own. It has no effect on Attach.
+func WithUserNamespace(ns UserNamespace) Option {
+	return func(t *Tracer) { t.userns = &ns }
+}
+
+// apply has the command started in the namespaces.
+func (ns *UserNamespace) apply(attr *syscall.SysProcAttr) {
+	attr.Cloneflags |= syscall.CLONE_NEWUSER
+	if ns.Mount {
+		attr.Cloneflags |= syscall.CLONE_NEWNS
+	}
+	if ns.PID {
+		attr.Cloneflags |= syscall.CLONE_NEWPID
+	}
+	attr.UidMappings = idMappings(ns.UIDs, os.Getuid())
+	attr.GidMappings = idMappings(ns.GIDs, os.Getgid())
+	// The kernel refuses an unprivileged gid_map unless setgroups is
+	// denied.
+	attr.GidMappingsEnableSetgroups = os.Geteuid() == 0
+}
+
+// idMappings returns maps as exec.Cmd takes them, or a map of root to own
+// if there are none.
+func idMappings(maps []IDMap, own int) []syscall.SysProcIDMap {
+	if len(maps) == 0 {
+		return []syscall.SysProcIDMap{{ContainerID: 0, HostID: own, Size: 1}}
+	}
+	m := make([]syscall.SysProcIDMap, len(maps))
+	for i, im := range maps {
+		m[i] = syscall.SysProcIDMap{ContainerID: int(im.Inside), HostID: int(im.Outside), Size: int(im.Size)}
+	}
+	return m
+}
@@ -0,0 +1,134 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// timesLayout is how a syscall that sets file times lays out the access
+// and modification times it is given.
+type timesLayout struct {
+	// word is the size of each field of a time.
+	word int
+	// frac is the unit of the field that follows the seconds of each
+	// time, or 0 if there is none.
+	frac time.Duration
+}
+
+// timespecLayout is the struct timespec[2] of a native utimensat.
+var timespecLayout = timesLayout{word: 8, frac: time.Nanosecond}
+
+// sysUtimensat also handles futimens, which is utimensat with a null path,
+// and utime, utimes and futimesat, which canonical turns into utimensat
+// calls whose times are laid out as l says.
+func (th *thread) sysUtimensat(dirfd int, pathAddr, timesAddr uintptr, flags int, l timesLayout) (int64, bool) {
+	var p string
+	if pathAddr != 0 {
+		var err error
+		if p, err = th.mem.readString(pathAddr); err != nil {
+			return 0, false
+		}
+	}
+	var m *mount
+	var name string
+	if p == "" {
+		f, ok := th.fds.get(dirfd)
+		if !ok || (pathAddr != 0 && flags&unix.AT_EMPTY_PATH == 0) {
+			return 0, false
+		}
+		th.t.log.Printf("utimensat: fd=%d (virtual)", dirfd)
+		// A null path takes no flags at all.
+		if pathAddr == 0 && flags != 0 {
+			return -int64(unix.EINVAL), true
+		}
+		m, name = f.mount, f.name
+	} else {
+		abs, through, err := th.resolveArg(dirfd, p)
+		if err != nil {
+			return resolveFailed(err)
+		}
+		var ok bool
+		if m, name, ok = th.lookupArg(abs, through); !ok {
+			return 0, false
+		}
+		th.t.log.Printf("utimensat: %s (virtual)", abs)
+		if flags&unix.AT_SYMLINK_NOFOLLOW == 0 {
+			if _, m, name, err = th.follow(abs); err != nil {
+				return errnoRet(err), true
+			}
+		}
+	}
+	if flags&^(unix.AT_SYMLINK_NOFOLLOW|unix.AT_EMPTY_PATH) != 0 {
+		return -int64(unix.EINVAL), true
+	}
+	atime, mtime, errno := th.readTimes(timesAddr, l)
+	if errno != 0 {
+		return -int64(errno), true
+	}
+	if atime.IsZero() && mtime.IsZero() {
+		return 0, true
+	}
+	// Backends can only change the times of what a symlink leads to. Those
+	// of a symlink itself are left alone rather than failing, so that tar
+	// and cp -a can extract and copy trees holding symlinks.
+	if p != "" && flags&unix.AT_SYMLINK_NOFOLLOW != 0 {
+		fi, err := m.backend.Lstat(name)
+		if err != nil {
+			return errnoRet(err), true
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return 0, true
+		}
+	}
+	if err := m.backend.Chtimes(name, atime, mtime); err != nil {
+		return errnoRet(err), true
+	}
+	return 0, true
+}
+
+// readTimes reads the access and modification times at addr, laid out as
+// l says, as the zero time.Time for UTIME_OMIT, which Backend.Chtimes
+// takes to leave a time unchanged. A null addr, like UTIME_NOW, stands for
+// the current time.
+func (th *thread) readTimes(addr uintptr, l timesLayout) (atime, mtime time.Time, errno unix.Errno) {
+	now := th.t.now()
+	if addr == 0 {
+		return now, now, 0
+	}
+	fields := 1
+	if l.frac != 0 {
+		fields = 2
+	}
+	b, err := th.mem.readBytes(addr, 2*fields*l.word)
+	if err != nil {
+		return time.Time{}, time.Time{}, unix.EFAULT
+	}
+	field := func(i int) int64 {
+		if l.word == 4 {
+			return int64(int32(binary.LittleEndian.Uint32(b[4*i:])))
+		}
+		return int64(binary.LittleEndian.Uint64(b[8*i:]))
+	}
+	var times [2]time.Time
+	for i := range times {
+		sec := field(fields * i)
+		if l.frac == 0 {
+			times[i] = time.Unix(sec, 0)
+			continue
+		}
+		frac := field(fields*i + 1)
+		switch {
+		case l.frac == time.Nanosecond && frac == unix.UTIME_NOW:
+			times[i] = now
+		case l.frac == time.Nanosecond && frac == unix.UTIME_OMIT:
+		case frac < 0 || frac >= int64(time.Second/l.frac):
+			return time.Time{}, time.Time{}, unix.EINVAL
+		default:
+			times[i] = time.Unix(sec, frac*int64(l.frac))
+		}
+	}
+	return times[0], times[1], 0
+}
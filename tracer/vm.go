@@ -0,0 +1,83 @@
+package tracer
+
+import (
+	"bytes"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var pageSize = uintptr(os.Getpagesize())
+
+// vmMemory accesses a process's memory with process_vm_readv and
+// process_vm_writev. Unlike ptraceMemory it does not need the thread to be
+// in a ptrace-stop, so it works for tasks that are merely blocked in a
+// seccomp notification.
+type vmMemory int
+
+func (pid vmMemory) read(addr uintptr, b []byte) (int, error) {
+	return unix.ProcessVMReadv(int(pid),
+		[]unix.Iovec{{Base: &b[0], Len: uint64(len(b))}},
+		[]unix.RemoteIovec{{Base: addr, Len: len(b)}}, 0)
+}
+
+func (pid vmMemory) readString(addr uintptr) (string, error) {
+	if addr == 0 {
+		return "", errInvalidAddress
+	}
+	var (
+		buf   []byte
+		chunk = make([]byte, pageSize)
+	)
+	for len(buf) < maxStringLength {
+		// Never read past the end of the current page: the next one may
+		// be unmapped even though the string ends before it.
+		n, err := pid.read(addr, chunk[:pageSize-addr%pageSize])
+		if err != nil {
+			return "", err
+		}
+		if i := bytes.IndexByte(chunk[:n], 0); i >= 0 {
+			return string(append(buf, chunk[:i]...)), nil
+		}
+		buf = append(buf, chunk[:n]...)
+		addr += uintptr(n)
+	}
+	return "", errStringTooLong
+}
+
+func (pid vmMemory) readBytes(addr uintptr, n int) ([]byte, error) {
+	if addr == 0 {
+		return nil, errInvalidAddress
+	}
+	buf := make([]byte, n)
+	if n == 0 {
+		return buf, nil
+	}
+	got, err := pid.read(addr, buf)
+	if err != nil {
+		return nil, err
+	}
+	if got < n {
+		return nil, unix.EFAULT
+	}
+	return buf, nil
+}
+
+func (pid vmMemory) writeBytes(addr uintptr, b []byte) error {
+	if addr == 0 {
+		return errInvalidAddress
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	n, err := unix.ProcessVMWritev(int(pid),
+		[]unix.Iovec{{Base: &b[0], Len: uint64(len(b))}},
+		[]unix.RemoteIovec{{Base: addr, Len: len(b)}}, 0)
+	if err != nil {
+		return err
+	}
+	if n < len(b) {
+		return unix.EFAULT
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// WithWorkers services the reads and writes of virtual files on a pool of
+// n goroutines, so that a backend slow to answer, such as one across the
+// network, or a large write holds up only the thread that made the
+// syscall: the tracer goes on servicing the command's other threads, and
+// the commands sharing its Supervisor, meanwhile. read, write, pread64 and
+// pwrite64 are serviced by the workers, as are sendfile, splice and
+// copy_file_range between a virtual file and a real descriptor, whose pipe
+// or socket may be slow too; other syscalls, and any syscall on a file a
+// worker has, wait their turn on the tracer's thread.
+//
+// Under EnginePtrace the thread is parked in a ppoll while its syscall is
+// serviced, and stopped with a SIGSTOP the command never sees to be woken;
+// under EngineUnotify its notification is answered once the syscall is
+// done. A signal the thread is sent meanwhile is handled once the syscall
+// is done. An n of 0 keeps everything on the tracer's thread, as do
+// WithRecord and WithReplay, which need the operations in order.
+func WithWorkers(n int) Option {
+	return func(t *Tracer) {
+		t.workers = nil
+		if n > 0 {
+			t.workers = make(chan struct{}, n)
+		}
+	}
+}
+
+// job is a read or write of f a worker does for a thread, or with a nil f
+// a wait for a poll. then turns its result into the syscall's once it is
+// done, back on the tracer's thread.
+type job struct {
+	f    *vfile
+	at   spanOp
+	do   func() (int, error)
+	then func(n int, err error) int64
+	n    int
+	err  error
+	// panicked is set if do panicked.
+	panicked *panicked
+	done     chan struct{}
+	// wake tells the tracer the job is done.
+	wake func()
+}
+
+// offload has a worker do the syscall of the thread, with do and then as
+// for a job, if the tracer has workers, and reports whether it will.
+func (th *thread) offload(f *vfile, do func() (int, error), then func(n int, err error) int64) bool {
+	t := th.t
+	if t.workers == nil || t.record != nil || t.replay != nil || th.job != nil {
+		return false
+	}
+	if t.engine == EnginePtrace && (th.arch != auditArch || th.hooked != nil) {
+		// A compat thread has no ppoll to park in, and exit hooks want
+		// the syscall's registers at its exit stop.
+		return false
+	}
+	th.job = &job{f: f, at: t.op, do: do, then: then, done: make(chan struct{})}
+	return true
+}
+
+// submit hands j to a worker, which calls wake once it is done. The job
+// waits for one to be free without holding up the tracer.
+func (t *Tracer) submit(j *job, wake func()) {
+	j.wake = wake
+	if j.f != nil {
+		j.f.pending = j.done
+		workingFor(j.f.file, &j.at)
+	}
+	go func() {
+		t.workers <- struct{}{}
+		defer func() {
+			<-t.workers
+			close(j.done)
+			j.wake()
+		}()
+		// A backend that panics takes the tracer down with it once the
+		// job is finished, rather than the program. One that calls
+		// runtime.Goexit leaves the first panicked, with no value.
+		j.panicked = &panicked{}
+		j.panicked = catch(func() { j.n, j.err = j.do() })
+	}()
+}
+
+// finishJob waits for the thread's job to be done and returns the result
+// of its syscall.
+func (th *thread) finishJob() int64 {
+	j := th.job
+	th.job = nil
+	if j.f != nil {
+		j.f.wait()
+	} else {
+		<-j.done
+	}
+	if j.panicked != nil {
+		panic(j.panicked)
+	}
+	return j.then(j.n, j.err)
+}
+
+// wait waits for the job a worker has on f, if any, to be done.
+func (f *vfile) wait() {
+	if f.pending == nil {
+		return
+	}
+	<-f.pending
+	f.pending = nil
+	workingFor(f.file, nil)
+}
+
+// park rewrites the syscall the thread is stopped entering into a ppoll on
+// nothing, without a timeout, for it to wait in until its job is done.
+func (th *thread) park() error {
+	regs := th.regs
+	if err := rewriteSyscall(th.tid, &regs, th.arch, unix.SYS_PPOLL, 0, 0, 0, 0, 0); err != nil {
+		return err
+	}
+	th.parked = true
+	pid, tid := th.pid, th.tid
+	th.t.submit(th.job, func() { _ = unix.Tgkill(pid, tid, unix.SIGSTOP) })
+	return nil
+}
+
+// parkedNotification is a notification the unotify engine answers once the
+// job of its thread is done.
+type parkedNotification struct {
+	req   seccompNotif
+	th    *thread
+	call  sysCall
+	start time.Time
+}
+
+// parkNotification holds the notification req of th, for call, until its
+// job is done, at which jobWake is written to.
+func (t *Tracer) parkNotification(req *seccompNotif, th *thread, call sysCall, start time.Time) {
+	t.parked = append(t.parked, parkedNotification{req: *req, th: th, call: call, start: start})
+	fd := t.jobWake
+	one := binary.NativeEndian.AppendUint64(nil, 1)
+	t.submit(th.job, func() { _, _ = unix.Write(fd, one) })
+}
+
+// restarted reports whether req is for the syscall of a parked
+// notification of th, which a signal cut short and the kernel restarted
+// once the thread had handled it. The job goes on, and answers req in place
+// of the notification it was for.
+func (t *Tracer) restarted(th *thread, req *seccompNotif) bool {
+	for i := range t.parked {
+		p := &t.parked[i]
+		if p.th == th && p.req.Nr == req.Nr && p.req.Args == req.Args {
+			p.req = *req
+			return true
+		}
+	}
+	return false
+}
+
+// answerParked answers the parked notifications whose jobs are done.
+func (t *Tracer) answerParked(listener int) error {
+	var b [8]byte
+	_, _ = unix.Read(t.jobWake, b[:])
+	parked := t.parked[:0]
+	for _, p := range t.parked {
+		select {
+		case <-p.th.job.done:
+		default:
+			parked = append(parked, p)
+			continue
+		}
+		t.serving, t.servingCall = p.th, p.call
+		ret := p.th.finishJob()
+		if ret >= fdBase && returnsFD(p.call) {
+			ret = int64(t.lowerFD(listener, p.req.ID, p.th, int(ret)))
+		}
+		if t.trace != nil {
+			p.th.traceSyscall(p.call, ret, true, p.start)
+		}
+		resp := seccompNotifResp{ID: p.req.ID}
+		if ret < 0 {
+			resp.Error = int32(ret)
+		} else {
+			resp.Val = ret
+		}
+		if err := notifIoctl(listener, unix.SECCOMP_IOCTL_NOTIF_SEND, unsafe.Pointer(&resp)); err != nil && err != unix.ENOENT {
+			return fmt.Errorf("tracer: notif_send: %w", err)
+		}
+	}
+	t.parked = parked
+	return nil
+}
+
+// drainParked waits for the jobs of the parked notifications, which the
+// workers may still be doing, so that nothing is woken once the engine has
+// gone.
+func (t *Tracer) drainParked() {
+	for _, p := range t.parked {
+		<-p.th.job.done
+	}
+	t.parked = nil
+}
@@ -0,0 +1,182 @@
+package tracer
+
+import (
+	"io/fs"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// Limits the kernel puts on extended attributes.
+const (
+	xattrNameMax = 255
+	xattrSizeMax = 64 << 10
+	xattrListMax = 64 << 10
+)
+
+// xattrTarget returns the mount and name of the file an xattr syscall
+// names: the virtual file open as fd if pathAddr is 0, or else the path
+// at pathAddr. It reports false if the file is not virtual. The l
+// variants, which do not follow a final symlink, fail on a symlink with
+// errno, or find no attributes on it if errno is 0, since like Linux the
+// tracer keeps no user attributes on symlinks. m is nil whenever the
+// syscall is not to go to the backend.
+func (th *thread) xattrTarget(fd int, pathAddr uintptr, follow bool, errno unix.Errno) (m *mount, name string, ret int64, ok bool) {
+	if pathAddr == 0 {
+		f, ok := th.fds.get(fd)
+		if !ok {
+			return nil, "", 0, false
+		}
+		th.t.log.Printf("xattr: fd=%d (virtual)", fd)
+		return f.mount, f.name, 0, true
+	}
+	lookup := th.virtualPath
+	if follow {
+		lookup = th.virtualTarget
+	}
+	var abs string
+	if abs, m, name, ret, ok = lookup(unix.AT_FDCWD, pathAddr); !ok || ret < 0 {
+		return nil, "", ret, ok
+	}
+	th.t.log.Printf("xattr: %s (virtual)", abs)
+	if !follow {
+		fi, err := m.backend.Lstat(name)
+		if err != nil {
+			return nil, "", errnoRet(err), true
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return nil, "", -int64(errno), true
+		}
+	}
+	return m, name, 0, true
+}
+
+// xattrName reads the attribute name at addr, failing as the kernel does
+// with one that is too long or outside the namespaces it knows.
+func (th *thread) xattrName(addr uintptr) (string, int64) {
+	attr, err := th.mem.readString(addr)
+	switch {
+	case err != nil:
+		return "", -int64(unix.EFAULT)
+	case attr == "" || len(attr) > xattrNameMax:
+		return "", -int64(unix.ERANGE)
+	}
+	for _, ns := range []string{"user.", "trusted.", "security.", "system."} {
+		if rest, ok := strings.CutPrefix(attr, ns); ok {
+			if rest == "" {
+				return "", -int64(unix.EINVAL)
+			}
+			return attr, 0
+		}
+	}
+	return "", -int64(unix.EOPNOTSUPP)
+}
+
+// sysGetxattr handles getxattr, lgetxattr and, with a pathAddr of 0,
+// fgetxattr.
+func (th *thread) sysGetxattr(fd int, pathAddr uintptr, follow bool, nameAddr, value uintptr, size uint64) (int64, bool) {
+	m, name, ret, ok := th.xattrTarget(fd, pathAddr, follow, unix.ENODATA)
+	if !ok || ret < 0 {
+		return ret, ok
+	}
+	attr, ret := th.xattrName(nameAddr)
+	if ret < 0 {
+		return ret, true
+	}
+	v, err := vfs.Getxattr(m.backend, name, attr)
+	if err != nil {
+		return errnoRet(err), true
+	}
+	return th.xattrOut(value, size, v)
+}
+
+// sysSetxattr handles setxattr, lsetxattr and, with a pathAddr of 0,
+// fsetxattr.
+func (th *thread) sysSetxattr(fd int, pathAddr uintptr, follow bool, nameAddr, value uintptr, size uint64, flags int) (int64, bool) {
+	m, name, ret, ok := th.xattrTarget(fd, pathAddr, follow, unix.EPERM)
+	if !ok || ret < 0 {
+		return ret, ok
+	}
+	switch {
+	case flags&^(vfs.XattrCreate|vfs.XattrReplace) != 0:
+		return -int64(unix.EINVAL), true
+	case size > xattrSizeMax:
+		return -int64(unix.E2BIG), true
+	}
+	attr, ret := th.xattrName(nameAddr)
+	if ret < 0 {
+		return ret, true
+	}
+	v := []byte{}
+	if size > 0 {
+		var err error
+		if v, err = th.mem.readBytes(value, int(size)); err != nil {
+			return -int64(unix.EFAULT), true
+		}
+	}
+	if err := vfs.Setxattr(m.backend, name, attr, v, flags); err != nil {
+		return errnoRet(err), true
+	}
+	return 0, true
+}
+
+// sysListxattr handles listxattr, llistxattr and, with a pathAddr of 0,
+// flistxattr.
+func (th *thread) sysListxattr(fd int, pathAddr uintptr, follow bool, list uintptr, size uint64) (int64, bool) {
+	m, name, ret, ok := th.xattrTarget(fd, pathAddr, follow, 0)
+	if !ok || ret < 0 {
+		return ret, ok
+	}
+	var attrs []string
+	if m != nil {
+		var err error
+		if attrs, err = vfs.Listxattr(m.backend, name); err != nil {
+			return errnoRet(err), true
+		}
+	}
+	var b []byte
+	for _, a := range attrs {
+		if a == fakeRootXattr {
+			continue
+		}
+		b = append(append(b, a...), 0)
+	}
+	if len(b) > xattrListMax {
+		return -int64(unix.E2BIG), true
+	}
+	return th.xattrOut(list, size, b)
+}
+
+// sysRemovexattr handles removexattr, lremovexattr and, with a pathAddr
+// of 0, fremovexattr.
+func (th *thread) sysRemovexattr(fd int, pathAddr uintptr, follow bool, nameAddr uintptr) (int64, bool) {
+	m, name, ret, ok := th.xattrTarget(fd, pathAddr, follow, unix.EPERM)
+	if !ok || ret < 0 {
+		return ret, ok
+	}
+	attr, ret := th.xattrName(nameAddr)
+	if ret < 0 {
+		return ret, true
+	}
+	if err := vfs.Removexattr(m.backend, name, attr); err != nil {
+		return errnoRet(err), true
+	}
+	return 0, true
+}
+
+// xattrOut copies b out to the buffer of size bytes at addr, or with a
+// size of 0 only reports how big a buffer b needs.
+func (th *thread) xattrOut(addr uintptr, size uint64, b []byte) (int64, bool) {
+	switch {
+	case size == 0:
+		return int64(len(b)), true
+	case uint64(len(b)) > size:
+		return -int64(unix.ERANGE), true
+	}
+	if err := th.mem.writeBytes(addr, b); err != nil {
+		return -int64(unix.EFAULT), true
+	}
+	return int64(len(b)), true
+}
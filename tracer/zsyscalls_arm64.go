@@ -0,0 +1,282 @@
+// Code generated by mksyscalls.go from syscalls.txt and golang.org/x/sys v0.33.0. DO NOT EDIT.
+
+package tracer
+
+import "golang.org/x/sys/unix"
+
+// The syscalls only some architectures have. Those this one lacks have
+// numbers no syscall has.
+const (
+	sysOpen      = ^uint64(0) - 1
+	sysCreat     = ^uint64(0) - 2
+	sysStat      = ^uint64(0) - 3
+	sysLstat     = ^uint64(0) - 4
+	sysDup2      = ^uint64(0) - 5
+	sysLlseek    = ^uint64(0) - 6
+	sysMkdir     = ^uint64(0) - 7
+	sysRmdir     = ^uint64(0) - 8
+	sysUnlink    = ^uint64(0) - 9
+	sysRename    = ^uint64(0) - 10
+	sysLink      = ^uint64(0) - 11
+	sysSymlink   = ^uint64(0) - 12
+	sysReadlink  = ^uint64(0) - 13
+	sysChmod     = ^uint64(0) - 14
+	sysChown     = ^uint64(0) - 15
+	sysLchown    = ^uint64(0) - 16
+	sysFutimesat = ^uint64(0) - 17
+	sysUtime     = ^uint64(0) - 18
+	sysUtimes    = ^uint64(0) - 19
+	sysMknod     = ^uint64(0) - 20
+	sysAccess    = ^uint64(0) - 21
+	sysPoll      = ^uint64(0) - 22
+	sysSelect    = ^uint64(0) - 23
+	sysTime      = ^uint64(0) - 24
+)
+
+// syscallSpecs describes the syscalls the tracer knows, by native number.
+var syscallSpecs = map[uint64]syscallSpec{
+	unix.SYS_OPENAT:            {name: "openat", args: []argKind{argDirFD, argPath, argOpenFlags, argOpenMode}, fd: 0, path: 1},
+	unix.SYS_OPENAT2:           {name: "openat2", args: []argKind{argDirFD, argPath, argOpenHow, argInt}, fd: 0, path: 1},
+	unix.SYS_READ:              {name: "read", args: []argKind{argFD, argBufOut, argInt}, fd: 0, path: -1},
+	unix.SYS_WRITE:             {name: "write", args: []argKind{argFD, argBufIn, argInt}, fd: 0, path: -1},
+	unix.SYS_CLOSE:             {name: "close", args: []argKind{argFD}, fd: 0, path: -1},
+	unix.SYS_FSTAT:             {name: "fstat", args: []argKind{argFD, argHex}, fd: 0, path: -1},
+	unix.SYS_NEWFSTATAT:        {name: "newfstatat", args: []argKind{argDirFD, argPath, argHex, argAtFlags}, fd: 0, path: 1},
+	unix.SYS_STATX:             {name: "statx", args: []argKind{argDirFD, argPath, argAtFlags, argHex, argHex}, fd: 0, path: 1},
+	unix.SYS_GETDENTS64:        {name: "getdents64", args: []argKind{argFD, argHex, argInt}, fd: 0, path: -1},
+	unix.SYS_DUP:               {name: "dup", args: []argKind{argFD}, fd: 0, path: -1},
+	unix.SYS_DUP3:              {name: "dup3", args: []argKind{argFD, argFD, argOpenFlags}, fd: 0, path: -1},
+	unix.SYS_FCNTL:             {name: "fcntl", args: []argKind{argFD, argFcntlCmd, argHex}, fd: 0, path: -1},
+	unix.SYS_FLOCK:             {name: "flock", args: []argKind{argFD, argFlockOp}, fd: 0, path: -1},
+	unix.SYS_PREAD64:           {name: "pread64", args: []argKind{argFD, argBufOut, argInt, argInt}, fd: 0, path: -1},
+	unix.SYS_PWRITE64:          {name: "pwrite64", args: []argKind{argFD, argBufIn, argInt, argInt}, fd: 0, path: -1},
+	unix.SYS_LSEEK:             {name: "lseek", args: []argKind{argFD, argInt, argWhence}, fd: 0, path: -1},
+	unix.SYS_READV:             {name: "readv", args: []argKind{argFD, argHex, argInt}, fd: 0, path: -1},
+	unix.SYS_WRITEV:            {name: "writev", args: []argKind{argFD, argHex, argInt}, fd: 0, path: -1},
+	unix.SYS_PREADV:            {name: "preadv", args: []argKind{argFD, argHex, argInt, argInt}, fd: 0, path: -1},
+	unix.SYS_PWRITEV:           {name: "pwritev", args: []argKind{argFD, argHex, argInt, argInt}, fd: 0, path: -1},
+	unix.SYS_PREADV2:           {name: "preadv2", args: []argKind{argFD, argHex, argInt, argInt, argHex}, fd: 0, path: -1},
+	unix.SYS_PWRITEV2:          {name: "pwritev2", args: []argKind{argFD, argHex, argInt, argInt, argHex}, fd: 0, path: -1},
+	unix.SYS_SENDFILE:          {name: "sendfile", args: []argKind{argFD, argFD, argHex, argInt}, fd: 0, path: -1},
+	unix.SYS_SPLICE:            {name: "splice", args: []argKind{argFD, argHex, argFD, argHex, argInt, argHex}, fd: 0, path: -1},
+	unix.SYS_COPY_FILE_RANGE:   {name: "copy_file_range", args: []argKind{argFD, argHex, argFD, argHex, argInt, argHex}, fd: 0, path: -1},
+	unix.SYS_FSYNC:             {name: "fsync", args: []argKind{argFD}, fd: 0, path: -1},
+	unix.SYS_FDATASYNC:         {name: "fdatasync", args: []argKind{argFD}, fd: 0, path: -1},
+	unix.SYS_MKDIRAT:           {name: "mkdirat", args: []argKind{argDirFD, argPath, argMode}, fd: 0, path: 1},
+	unix.SYS_UNLINKAT:          {name: "unlinkat", args: []argKind{argDirFD, argPath, argAtFlags}, fd: 0, path: 1},
+	unix.SYS_RENAMEAT:          {name: "renameat", args: []argKind{argDirFD, argPath, argDirFD, argPath}, fd: 0, path: 1},
+	unix.SYS_RENAMEAT2:         {name: "renameat2", args: []argKind{argDirFD, argPath, argDirFD, argPath, argHex}, fd: 0, path: 1},
+	unix.SYS_LINKAT:            {name: "linkat", args: []argKind{argDirFD, argPath, argDirFD, argPath, argAtFlags}, fd: 0, path: 1},
+	unix.SYS_SYMLINKAT:         {name: "symlinkat", args: []argKind{argStr, argDirFD, argPath}, fd: 1, path: 2},
+	unix.SYS_READLINKAT:        {name: "readlinkat", args: []argKind{argDirFD, argPath, argBufOut, argInt}, fd: 0, path: 1},
+	unix.SYS_FCHMOD:            {name: "fchmod", args: []argKind{argFD, argMode}, fd: 0, path: -1},
+	unix.SYS_FCHMODAT:          {name: "fchmodat", args: []argKind{argDirFD, argPath, argMode}, fd: 0, path: 1},
+	unix.SYS_FCHMODAT2:         {name: "fchmodat2", args: []argKind{argDirFD, argPath, argMode, argAtFlags}, fd: 0, path: 1},
+	unix.SYS_FCHOWN:            {name: "fchown", args: []argKind{argFD, argInt, argInt}, fd: 0, path: -1},
+	unix.SYS_FCHOWNAT:          {name: "fchownat", args: []argKind{argDirFD, argPath, argInt, argInt, argAtFlags}, fd: 0, path: 1},
+	unix.SYS_TRUNCATE:          {name: "truncate", args: []argKind{argPath, argInt}, fd: -1, path: 0},
+	unix.SYS_FTRUNCATE:         {name: "ftruncate", args: []argKind{argFD, argInt}, fd: 0, path: -1},
+	unix.SYS_FALLOCATE:         {name: "fallocate", args: []argKind{argFD, argFallocMode, argInt, argInt}, fd: 0, path: -1},
+	unix.SYS_STATFS:            {name: "statfs", args: []argKind{argPath, argHex}, fd: -1, path: 0},
+	unix.SYS_FSTATFS:           {name: "fstatfs", args: []argKind{argFD, argHex}, fd: 0, path: -1},
+	unix.SYS_UTIMENSAT:         {name: "utimensat", args: []argKind{argDirFD, argPath, argHex, argAtFlags}, fd: 0, path: 1},
+	unix.SYS_MKNODAT:           {name: "mknodat", args: []argKind{argDirFD, argPath, argMode, argHex}, fd: 0, path: 1},
+	unix.SYS_FACCESSAT:         {name: "faccessat", args: []argKind{argDirFD, argPath, argMode}, fd: 0, path: 1},
+	unix.SYS_FACCESSAT2:        {name: "faccessat2", args: []argKind{argDirFD, argPath, argMode, argAtFlags}, fd: 0, path: 1},
+	unix.SYS_GETXATTR:          {name: "getxattr", args: []argKind{argPath, argStr, argHex, argInt}, fd: -1, path: 0},
+	unix.SYS_LGETXATTR:         {name: "lgetxattr", args: []argKind{argPath, argStr, argHex, argInt}, fd: -1, path: 0},
+	unix.SYS_FGETXATTR:         {name: "fgetxattr", args: []argKind{argFD, argStr, argHex, argInt}, fd: 0, path: -1},
+	unix.SYS_SETXATTR:          {name: "setxattr", args: []argKind{argPath, argStr, argHex, argInt, argHex}, fd: -1, path: 0},
+	unix.SYS_LSETXATTR:         {name: "lsetxattr", args: []argKind{argPath, argStr, argHex, argInt, argHex}, fd: -1, path: 0},
+	unix.SYS_FSETXATTR:         {name: "fsetxattr", args: []argKind{argFD, argStr, argHex, argInt, argHex}, fd: 0, path: -1},
+	unix.SYS_LISTXATTR:         {name: "listxattr", args: []argKind{argPath, argHex, argInt}, fd: -1, path: 0},
+	unix.SYS_LLISTXATTR:        {name: "llistxattr", args: []argKind{argPath, argHex, argInt}, fd: -1, path: 0},
+	unix.SYS_FLISTXATTR:        {name: "flistxattr", args: []argKind{argFD, argHex, argInt}, fd: 0, path: -1},
+	unix.SYS_REMOVEXATTR:       {name: "removexattr", args: []argKind{argPath, argStr}, fd: -1, path: 0},
+	unix.SYS_LREMOVEXATTR:      {name: "lremovexattr", args: []argKind{argPath, argStr}, fd: -1, path: 0},
+	unix.SYS_FREMOVEXATTR:      {name: "fremovexattr", args: []argKind{argFD, argStr}, fd: 0, path: -1},
+	unix.SYS_PPOLL:             {name: "ppoll", args: []argKind{argHex, argInt, argHex, argHex, argInt}, fd: -1, path: -1},
+	unix.SYS_PSELECT6:          {name: "pselect6", args: []argKind{argInt, argHex, argHex, argHex, argHex, argHex}, fd: -1, path: -1},
+	unix.SYS_EPOLL_CTL:         {name: "epoll_ctl", args: []argKind{argFD, argInt, argFD, argHex}, fd: 0, path: -1},
+	unix.SYS_INOTIFY_ADD_WATCH: {name: "inotify_add_watch", args: []argKind{argFD, argPath, argHex}, fd: -1, path: 1},
+	unix.SYS_IO_URING_SETUP:    {name: "io_uring_setup", args: []argKind{argInt, argHex}, fd: -1, path: -1},
+	unix.SYS_IO_URING_ENTER:    {name: "io_uring_enter", args: []argKind{argFD, argInt, argInt, argHex, argHex, argInt}, fd: 0, path: -1},
+	unix.SYS_IO_URING_REGISTER: {name: "io_uring_register", args: []argKind{argFD, argInt, argHex, argInt}, fd: 0, path: -1},
+	unix.SYS_MMAP:              {name: "mmap", args: []argKind{argHex, argInt, argProt, argMapFlags, argFD, argHex}, hexRet: true, fd: 4, path: -1},
+	unix.SYS_MUNMAP:            {name: "munmap", args: []argKind{argHex, argInt}, fd: -1, path: -1},
+	unix.SYS_MPROTECT:          {name: "mprotect", args: []argKind{argHex, argInt, argProt}, fd: -1, path: -1},
+	unix.SYS_PKEY_MPROTECT:     {name: "pkey_mprotect", args: []argKind{argHex, argInt, argProt, argInt}, fd: -1, path: -1},
+	unix.SYS_MREMAP:            {name: "mremap", args: []argKind{argHex, argInt, argInt, argHex, argHex}, hexRet: true, fd: -1, path: -1},
+	unix.SYS_MADVISE:           {name: "madvise", args: []argKind{argHex, argInt, argInt}, fd: -1, path: -1},
+	unix.SYS_BRK:               {name: "brk", args: []argKind{argHex}, hexRet: true, fd: -1, path: -1},
+	unix.SYS_MEMFD_CREATE:      {name: "memfd_create", args: []argKind{argStr, argHex}, fd: -1, path: -1},
+	unix.SYS_EXECVE:            {name: "execve", args: []argKind{argPath, argHex, argHex}, fd: -1, path: 0},
+	unix.SYS_EXECVEAT:          {name: "execveat", args: []argKind{argDirFD, argPath, argHex, argHex, argAtFlags}, fd: 0, path: 1},
+	unix.SYS_CLONE:             {name: "clone", args: []argKind{argCloneFlags, argHex, argHex, argHex, argHex}, fd: -1, path: -1},
+	unix.SYS_CLONE3:            {name: "clone3", args: []argKind{argCloneArgs, argInt}, fd: -1, path: -1},
+	unix.SYS_EXIT:              {name: "exit", args: []argKind{argInt}, fd: -1, path: -1},
+	unix.SYS_EXIT_GROUP:        {name: "exit_group", args: []argKind{argInt}, fd: -1, path: -1},
+	unix.SYS_CHDIR:             {name: "chdir", args: []argKind{argPath}, fd: -1, path: 0},
+	unix.SYS_FCHDIR:            {name: "fchdir", args: []argKind{argFD}, fd: 0, path: -1},
+	unix.SYS_GETCWD:            {name: "getcwd", args: []argKind{argHex, argInt}, fd: -1, path: -1},
+	unix.SYS_CLOSE_RANGE:       {name: "close_range", args: []argKind{argFD, argFD, argHex}, fd: 0, path: -1},
+	unix.SYS_GETPID:            {name: "getpid", fd: -1, path: -1},
+	unix.SYS_GETTID:            {name: "gettid", fd: -1, path: -1},
+	unix.SYS_KILL:              {name: "kill", args: []argKind{argInt, argInt}, fd: -1, path: -1},
+	unix.SYS_TGKILL:            {name: "tgkill", args: []argKind{argInt, argInt, argInt}, fd: -1, path: -1},
+	unix.SYS_PTRACE:            {name: "ptrace", args: []argKind{argInt, argInt, argHex, argHex}, fd: -1, path: -1},
+	unix.SYS_PROCESS_VM_READV:  {name: "process_vm_readv", args: []argKind{argInt, argHex, argInt, argHex, argInt, argHex}, fd: -1, path: -1},
+	unix.SYS_PROCESS_VM_WRITEV: {name: "process_vm_writev", args: []argKind{argInt, argHex, argInt, argHex, argInt, argHex}, fd: -1, path: -1},
+	unix.SYS_IOCTL:             {name: "ioctl", args: []argKind{argFD, argHex, argHex}, fd: 0, path: -1},
+	unix.SYS_PRCTL:             {name: "prctl", args: []argKind{argInt, argHex, argHex, argHex, argHex}, fd: -1, path: -1},
+	unix.SYS_PERSONALITY:       {name: "personality", args: []argKind{argHex}, fd: -1, path: -1},
+	unix.SYS_SECCOMP:           {name: "seccomp", args: []argKind{argInt, argHex, argHex}, fd: -1, path: -1},
+	unix.SYS_SET_TID_ADDRESS:   {name: "set_tid_address", args: []argKind{argHex}, fd: -1, path: -1},
+	unix.SYS_PERF_EVENT_OPEN:   {name: "perf_event_open", args: []argKind{argHex, argInt, argInt, argFD, argHex}, fd: 3, path: -1},
+	unix.SYS_GETRANDOM:         {name: "getrandom", args: []argKind{argHex, argInt, argHex}, fd: -1, path: -1},
+	unix.SYS_CLOCK_GETTIME:     {name: "clock_gettime", args: []argKind{argInt, argHex}, fd: -1, path: -1},
+	unix.SYS_GETTIMEOFDAY:      {name: "gettimeofday", args: []argKind{argHex, argHex}, fd: -1, path: -1},
+	unix.SYS_NANOSLEEP:         {name: "nanosleep", args: []argKind{argHex, argHex}, fd: -1, path: -1},
+	unix.SYS_CLOCK_NANOSLEEP:   {name: "clock_nanosleep", args: []argKind{argInt, argHex, argHex, argHex}, fd: -1, path: -1},
+	unix.SYS_GETUID:            {name: "getuid", fd: -1, path: -1},
+	unix.SYS_GETGID:            {name: "getgid", fd: -1, path: -1},
+	unix.SYS_GETEUID:           {name: "geteuid", fd: -1, path: -1},
+	unix.SYS_GETEGID:           {name: "getegid", fd: -1, path: -1},
+	unix.SYS_SETUID:            {name: "setuid", args: []argKind{argInt}, fd: -1, path: -1},
+	unix.SYS_SETGID:            {name: "setgid", args: []argKind{argInt}, fd: -1, path: -1},
+	unix.SYS_SETREUID:          {name: "setreuid", args: []argKind{argInt, argInt}, fd: -1, path: -1},
+	unix.SYS_SETREGID:          {name: "setregid", args: []argKind{argInt, argInt}, fd: -1, path: -1},
+	unix.SYS_SETRESUID:         {name: "setresuid", args: []argKind{argInt, argInt, argInt}, fd: -1, path: -1},
+	unix.SYS_SETRESGID:         {name: "setresgid", args: []argKind{argInt, argInt, argInt}, fd: -1, path: -1},
+	unix.SYS_GETRESUID:         {name: "getresuid", args: []argKind{argHex, argHex, argHex}, fd: -1, path: -1},
+	unix.SYS_GETRESGID:         {name: "getresgid", args: []argKind{argHex, argHex, argHex}, fd: -1, path: -1},
+	unix.SYS_SETFSUID:          {name: "setfsuid", args: []argKind{argInt}, fd: -1, path: -1},
+	unix.SYS_SETFSGID:          {name: "setfsgid", args: []argKind{argInt}, fd: -1, path: -1},
+	unix.SYS_SETGROUPS:         {name: "setgroups", args: []argKind{argInt, argHex}, fd: -1, path: -1},
+	unix.SYS_CAPGET:            {name: "capget", args: []argKind{argHex, argHex}, fd: -1, path: -1},
+	unix.SYS_CAPSET:            {name: "capset", args: []argKind{argHex, argHex}, fd: -1, path: -1},
+	unix.SYS_SOCKET:            {name: "socket", args: []argKind{argInt, argInt, argInt}, fd: -1, path: -1},
+	unix.SYS_CONNECT:           {name: "connect", args: []argKind{argFD, argHex, argInt}, fd: 0, path: -1},
+	unix.SYS_BIND:              {name: "bind", args: []argKind{argFD, argHex, argInt}, fd: 0, path: -1},
+	unix.SYS_LISTEN:            {name: "listen", args: []argKind{argFD, argInt}, fd: 0, path: -1},
+	unix.SYS_ACCEPT:            {name: "accept", args: []argKind{argFD, argHex, argHex}, fd: 0, path: -1},
+	unix.SYS_ACCEPT4:           {name: "accept4", args: []argKind{argFD, argHex, argHex, argHex}, fd: 0, path: -1},
+	unix.SYS_SENDTO:            {name: "sendto", args: []argKind{argFD, argHex, argInt, argHex, argHex, argInt}, fd: 0, path: -1},
+	unix.SYS_SENDMSG:           {name: "sendmsg", args: []argKind{argFD, argHex, argHex}, fd: 0, path: -1},
+	unix.SYS_SENDMMSG:          {name: "sendmmsg", args: []argKind{argFD, argHex, argInt, argHex}, fd: 0, path: -1},
+	unix.SYS_MOUNT:             {name: "mount", args: []argKind{argStr, argPath, argStr, argHex, argHex}, fd: -1, path: 1},
+	unix.SYS_UMOUNT2:           {name: "umount2", args: []argKind{argPath, argHex}, fd: -1, path: 0},
+	unix.SYS_PIVOT_ROOT:        {name: "pivot_root", args: []argKind{argPath, argPath}, fd: -1, path: 0},
+	unix.SYS_CHROOT:            {name: "chroot", args: []argKind{argPath}, fd: -1, path: 0},
+	unix.SYS_OPEN_TREE:         {name: "open_tree", args: []argKind{argDirFD, argPath, argHex}, fd: 0, path: 1},
+	unix.SYS_MOVE_MOUNT:        {name: "move_mount", args: []argKind{argDirFD, argPath, argDirFD, argPath, argHex}, fd: 0, path: 1},
+	unix.SYS_FSOPEN:            {name: "fsopen", args: []argKind{argStr, argHex}, fd: -1, path: -1},
+	unix.SYS_FSCONFIG:          {name: "fsconfig", args: []argKind{argFD, argInt, argStr, argHex, argInt}, fd: 0, path: -1},
+	unix.SYS_FSMOUNT:           {name: "fsmount", args: []argKind{argFD, argHex, argHex}, fd: 0, path: -1},
+	unix.SYS_FSPICK:            {name: "fspick", args: []argKind{argDirFD, argPath, argHex}, fd: 0, path: 1},
+	unix.SYS_MOUNT_SETATTR:     {name: "mount_setattr", args: []argKind{argDirFD, argPath, argAtFlags, argHex, argInt}, fd: 0, path: 1},
+	unix.SYS_SWAPON:            {name: "swapon", args: []argKind{argPath, argHex}, fd: -1, path: 0},
+	unix.SYS_SWAPOFF:           {name: "swapoff", args: []argKind{argPath}, fd: -1, path: 0},
+	unix.SYS_INIT_MODULE:       {name: "init_module", args: []argKind{argHex, argInt, argStr}, fd: -1, path: -1},
+	unix.SYS_FINIT_MODULE:      {name: "finit_module", args: []argKind{argFD, argStr, argHex}, fd: 0, path: -1},
+	unix.SYS_DELETE_MODULE:     {name: "delete_module", args: []argKind{argStr, argHex}, fd: -1, path: -1},
+	unix.SYS_KEXEC_LOAD:        {name: "kexec_load", args: []argKind{argHex, argInt, argHex, argHex}, fd: -1, path: -1},
+	unix.SYS_BPF:               {name: "bpf", args: []argKind{argInt, argHex, argInt}, fd: -1, path: -1},
+	unix.SYS_UNSHARE:           {name: "unshare", args: []argKind{argHex}, fd: -1, path: -1},
+	unix.SYS_SETNS:             {name: "setns", args: []argKind{argFD, argHex}, fd: 0, path: -1},
+	unix.SYS_REBOOT:            {name: "reboot", args: []argKind{argHex, argHex, argHex, argHex}, fd: -1, path: -1},
+	unix.SYS_SETHOSTNAME:       {name: "sethostname", args: []argKind{argBufIn, argInt}, fd: -1, path: -1},
+	unix.SYS_SETDOMAINNAME:     {name: "setdomainname", args: []argKind{argBufIn, argInt}, fd: -1, path: -1},
+}
+
+// intercepted lists every syscall enter handles, all of which the seccomp
+// filter traps.
+var intercepted = []uint64{
+	unix.SYS_OPENAT,
+	unix.SYS_OPENAT2,
+	unix.SYS_READ,
+	unix.SYS_WRITE,
+	unix.SYS_CLOSE,
+	unix.SYS_FSTAT,
+	unix.SYS_NEWFSTATAT,
+	unix.SYS_STATX,
+	unix.SYS_GETDENTS64,
+	unix.SYS_DUP,
+	unix.SYS_DUP3,
+	unix.SYS_FCNTL,
+	unix.SYS_FLOCK,
+	unix.SYS_PREAD64,
+	unix.SYS_PWRITE64,
+	unix.SYS_LSEEK,
+	unix.SYS_READV,
+	unix.SYS_WRITEV,
+	unix.SYS_PREADV,
+	unix.SYS_PWRITEV,
+	unix.SYS_PREADV2,
+	unix.SYS_PWRITEV2,
+	unix.SYS_SENDFILE,
+	unix.SYS_SPLICE,
+	unix.SYS_COPY_FILE_RANGE,
+	unix.SYS_MKDIRAT,
+	unix.SYS_UNLINKAT,
+	unix.SYS_RENAMEAT,
+	unix.SYS_RENAMEAT2,
+	unix.SYS_LINKAT,
+	unix.SYS_SYMLINKAT,
+	unix.SYS_READLINKAT,
+	unix.SYS_FCHMOD,
+	unix.SYS_FCHMODAT,
+	unix.SYS_FCHMODAT2,
+	unix.SYS_FCHOWN,
+	unix.SYS_FCHOWNAT,
+	unix.SYS_TRUNCATE,
+	unix.SYS_FTRUNCATE,
+	unix.SYS_FALLOCATE,
+	unix.SYS_STATFS,
+	unix.SYS_FSTATFS,
+	unix.SYS_UTIMENSAT,
+	unix.SYS_FACCESSAT,
+	unix.SYS_FACCESSAT2,
+	unix.SYS_GETXATTR,
+	unix.SYS_LGETXATTR,
+	unix.SYS_FGETXATTR,
+	unix.SYS_SETXATTR,
+	unix.SYS_LSETXATTR,
+	unix.SYS_FSETXATTR,
+	unix.SYS_LISTXATTR,
+	unix.SYS_LLISTXATTR,
+	unix.SYS_FLISTXATTR,
+	unix.SYS_REMOVEXATTR,
+	unix.SYS_LREMOVEXATTR,
+	unix.SYS_FREMOVEXATTR,
+	unix.SYS_MMAP,
+	unix.SYS_CHDIR,
+	unix.SYS_FCHDIR,
+	unix.SYS_GETCWD,
+}
+
+// writeSyscalls lists the syscalls, beyond those intercepted anyway, that
+// read-only mode has to check.
+var writeSyscalls = []uint64{
+	unix.SYS_MKNODAT,
+}
+
+// legacyWriteSyscalls are the legacy forms of writeSyscalls, which canonical
+// rewrites as their *at forms.
+var legacyWriteSyscalls = []uint64{}
+
+// polledSyscalls lists the syscalls, beyond those intercepted anyway, that
+// polls of virtual descriptors need trapped.
+var polledSyscalls = []uint64{
+	unix.SYS_PPOLL,
+	unix.SYS_PSELECT6,
+	unix.SYS_EPOLL_CTL,
+}
+
+// canonical rewrites a legacy syscall as its *at equivalent, so that enter
+// only has to handle the syscalls every architecture provides.
+func canonical(c sysCall) sysCall {
+	return c
+}
+
+var compatSyscalls map[uint64]uint64
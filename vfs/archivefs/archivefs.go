@@ -0,0 +1,292 @@
+// Package archivefs implements a read-only vfs.Backend serving the tree
+// of a tar or zip archive in place, without extracting it, so that a
+// command can be run against a fixture archive as it is checked in.
+//
+// The format is told from the archive's first bytes: a zip archive, a tar
+// archive, or a tar archive compressed with gzip. The index of the
+// archive's entries is built the first time a lookup needs it, from a zip
+// archive's central directory or by reading through a tar archive once.
+// The contents of a file stored uncompressed, in a tar archive or a zip
+// archive's stored entries, are read straight from the archive at their
+// offsets; those of one compressed are decompressed as they are read, from
+// the start of the entry again when a read goes back.
+//
+// As in a tar archive's extraction, an entry replaces an earlier one of
+// the same name, and a hard link is the entry it names. Absolute symlink
+// targets are resolved against the root. Operations that would change a
+// file fail with EROFS; overlay.New with a writable upper layer, such as
+// a memfs.FS, gives the command a copy-on-write tree over the archive
+// instead. All methods, and the methods of the files an FS opens, are
+// safe for concurrent use.
+package archivefs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// FS is the tree of an archive.
+type FS struct {
+	vfs.ReadOnly
+
+	r    io.ReaderAt
+	size int64
+	c    io.Closer
+
+	once    sync.Once
+	err     error
+	entries map[string]*entry
+	inos    uint64
+}
+
+var (
+	_ vfs.Backend  = (*FS)(nil)
+	_ vfs.StatFSer = (*FS)(nil)
+)
+
+// New returns an FS for the archive of size bytes r reads.
+func New(r io.ReaderAt, size int64) *FS {
+	a := &FS{r: r, size: size}
+	a.ReadOnly = func(op, name string) error {
+		_, err := a.walk(op, name, false)
+		return err
+	}
+	return a
+}
+
+// Open returns an FS for the archive in the host file name. Close closes
+// the file.
+func Open(name string) (*FS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a := New(f, fi.Size())
+	a.c = f
+	return a, nil
+}
+
+// Close closes the archive's file, if Open opened it.
+func (a *FS) Close() error {
+	if a.c == nil {
+		return nil
+	}
+	return a.c.Close()
+}
+
+// entry is a file of the archive. A regular file's contents are read
+// through open, or straight from the archive at off if it is stored
+// uncompressed there, in which case open is nil.
+type entry struct {
+	name     string
+	mode     fs.FileMode
+	size     int64
+	off      int64
+	open     func() (io.ReadCloser, error)
+	target   string
+	uid, gid uint32
+	rdev     uint64
+	ino      uint64
+	nlink    uint64
+	mtime    time.Time
+	atime    time.Time
+	ctime    time.Time
+	children []string
+}
+
+// index builds the index of the archive, once.
+func (a *FS) index() error {
+	a.once.Do(func() {
+		a.entries = map[string]*entry{}
+		a.add(".", &entry{mode: fs.ModeDir | 0o755})
+		var magic [4]byte
+		n, _ := a.r.ReadAt(magic[:], 0)
+		switch m := magic[:n]; {
+		case bytes.HasPrefix(m, []byte("PK\x03\x04")), bytes.HasPrefix(m, []byte("PK\x05\x06")):
+			a.err = a.indexZip()
+		case bytes.HasPrefix(m, []byte{0x1f, 0x8b}):
+			a.err = a.indexTar(true)
+		default:
+			a.err = a.indexTar(false)
+		}
+	})
+	return a.err
+}
+
+// add records e in the index as name, in place of any entry of that name,
+// and with the directories it is in. A hard link adds an entry again, as
+// another name.
+func (a *FS) add(name string, e *entry) {
+	if e.name == "" {
+		e.name = name
+	}
+	old, ok := a.entries[name]
+	switch {
+	case !ok && name != ".":
+		dir := path.Dir(name)
+		a.implicitDir(dir)
+		d := a.entries[dir]
+		d.children = append(d.children, path.Base(name))
+	case ok && old.mode.IsDir() && e.mode.IsDir():
+		// A directory named again keeps what is in it.
+		e.children, e.ino = old.children, old.ino
+	case ok:
+		old.nlink--
+	}
+	if e.ino == 0 {
+		a.inos++
+		e.ino = a.inos
+	}
+	e.nlink++
+	a.entries[name] = e
+}
+
+// implicitDir records dir as a directory of the archive, if the archive
+// only has files below it, or in place of a non-directory there.
+func (a *FS) implicitDir(dir string) {
+	if e, ok := a.entries[dir]; ok && e.mode.IsDir() {
+		return
+	}
+	a.add(dir, &entry{mode: fs.ModeDir | 0o755})
+}
+
+// cleanName returns the name of an archive entry as the FS has it, with
+// what would climb out of the root dropped.
+func cleanName(name string) string {
+	name = path.Clean("/" + name)[1:]
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func pathErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// underlying returns the error a *fs.PathError wraps.
+func underlying(err error) error {
+	if pe, ok := err.(*fs.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
+
+// walk resolves name to an entry. Symlinks in intermediate components are
+// always followed; a final symlink is followed only if follow is set.
+// Absolute targets are resolved against the root of the archive.
+func (a *FS) walk(op, name string, follow bool) (*entry, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathErr(op, name, syscall.EINVAL)
+	}
+	if err := a.index(); err != nil {
+		return nil, pathErr(op, name, err)
+	}
+	e, err := vfs.Walk(name, a.entries["."], follow, func(dir *entry, c string, _ bool) (*entry, fs.FileMode, string, error) {
+		e, ok := a.entries[path.Join(dir.name, c)]
+		if !ok {
+			return nil, 0, "", syscall.ENOENT
+		}
+		return e, e.mode, e.target, nil
+	})
+	if err != nil {
+		return nil, pathErr(op, name, err)
+	}
+	return e, nil
+}
+
+func (a *FS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	e, err := a.walk("open", name, flag&syscall.O_NOFOLLOW == 0)
+	switch {
+	case err != nil:
+		if flag&os.O_CREATE != 0 && underlying(err) == syscall.ENOENT {
+			return nil, pathErr("open", name, syscall.EROFS)
+		}
+		return nil, err
+	case e.mode&fs.ModeSymlink != 0:
+		return nil, pathErr("open", name, syscall.ELOOP)
+	case flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathErr("open", name, syscall.EEXIST)
+	case flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0:
+		if e.mode.IsDir() {
+			return nil, pathErr("open", name, syscall.EISDIR)
+		}
+		return nil, pathErr("open", name, syscall.EROFS)
+	case e.mode.IsDir():
+		return &vfs.DirFile{Info: e.info(path.Base(name))}, nil
+	case flag&syscall.O_DIRECTORY != 0:
+		return nil, pathErr("open", name, syscall.ENOTDIR)
+	}
+	f := &file{name: name, info: e.info(path.Base(name))}
+	if e.open == nil {
+		f.r = io.NewSectionReader(a.r, e.off, e.size)
+	} else {
+		f.s = &stream{open: e.open}
+		f.r = io.NewSectionReader(f.s, 0, e.size)
+	}
+	return f, nil
+}
+
+func (a *FS) Stat(name string) (fs.FileInfo, error) {
+	e, err := a.walk("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return e.info(path.Base(name)), nil
+}
+
+func (a *FS) Lstat(name string) (fs.FileInfo, error) {
+	e, err := a.walk("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return e.info(path.Base(name)), nil
+}
+
+func (a *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	d, err := a.walk("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !d.mode.IsDir() {
+		return nil, pathErr("readdir", name, syscall.ENOTDIR)
+	}
+	entries := make([]fs.DirEntry, 0, len(d.children))
+	for _, c := range d.children {
+		entries = append(entries, &dirEntry{name: c, e: a.entries[path.Join(d.name, c)]})
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+// StatFS reports the archive as full: it has no room for anything more.
+func (a *FS) StatFS(name string) (vfs.FSStat, error) {
+	if _, err := a.walk("statfs", name, true); err != nil {
+		return vfs.FSStat{}, err
+	}
+	return vfs.FSStat{}, nil
+}
+
+func (a *FS) Readlink(name string) (string, error) {
+	e, err := a.walk("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if e.mode&fs.ModeSymlink == 0 {
+		return "", pathErr("readlink", name, syscall.EINVAL)
+	}
+	return e.target, nil
+}
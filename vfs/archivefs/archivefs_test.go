@@ -0,0 +1,288 @@
+package archivefs_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/archivefs"
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/overlay"
+)
+
+var big = strings.Repeat("0123456789", 10000)
+
+func tarball(t *testing.T, compress bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	zw := gzip.NewWriter(&buf)
+	if compress {
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	for _, hdr := range []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "etc/config", Typeflag: tar.TypeReg, Mode: 0o640, Size: 5, Uid: 1000, Gid: 100},
+		{Name: "data/big", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(big))},
+		{Name: "data/link", Typeflag: tar.TypeLink, Linkname: "data/big"},
+		{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 0o755, Size: 3},
+		{Name: "current", Typeflag: tar.TypeSymlink, Linkname: "/data"},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0o666, Devmajor: 1, Devminor: 3},
+		{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 0o755, Size: 3},
+		{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0o644, Size: 1},
+	} {
+		hdr.ModTime = time.Unix(1e9, 0)
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		var data string
+		switch hdr.Name {
+		case "etc/config":
+			data = "a=b\n\n"
+		case "data/big":
+			data = big
+		case "bin/tool":
+			data = "new"
+		case "../escape":
+			data = "x"
+		}
+		if _, err := io.WriteString(tw, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	zw.Close()
+	return buf.Bytes()
+}
+
+func zipfile(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range []struct {
+		name, data string
+		method     uint16
+		mode       fs.FileMode
+	}{
+		{"etc/config", "a=b\n\n", zip.Store, 0o640},
+		{"data/", "", zip.Store, fs.ModeDir | 0o755},
+		{"data/big", big, zip.Deflate, 0o644},
+		{"bin/tool", "new", zip.Deflate, 0o755},
+		{"current", "/data", zip.Store, fs.ModeSymlink | 0o777},
+		{"escape", "x", zip.Store, 0o644},
+	} {
+		hdr := &zip.FileHeader{Name: f.name, Method: f.method, Modified: time.Unix(1e9, 0)}
+		hdr.SetMode(f.mode)
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, f.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// check checks what the test archives have in common, and that the root
+// lists as root.
+func check(t *testing.T, a *archivefs.FS, root string) {
+	t.Helper()
+	for name, want := range map[string]string{
+		"etc/config":  "a=b\n\n",
+		"data/big":    big,
+		"bin/tool":    "new",
+		"current/big": big,
+		"escape":      "x",
+	} {
+		f, err := a.Open(name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Errorf("open %s: %v", name, err)
+			continue
+		}
+		b, err := io.ReadAll(f)
+		if err != nil || string(b) != want {
+			t.Errorf("%s: got %d bytes, %v, want %d", name, len(b), err, len(want))
+		}
+		f.Close()
+	}
+	f, err := a.Open("data/big", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// Reads go forward and back.
+	for _, off := range []int64{50000, 10, 99995, 0} {
+		b := make([]byte, 10)
+		n, err := f.ReadAt(b, off)
+		if want := big[off:min(off+10, int64(len(big)))]; string(b[:n]) != want || n < 10 && err != io.EOF {
+			t.Errorf("read at %d: %q, %v, want %q", off, b[:n], err, want)
+		}
+	}
+	if _, err := f.Seek(-4, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(f); string(b) != "6789" {
+		t.Errorf("read from the end: %q", b)
+	}
+	for dir, want := range map[string]string{
+		".":   root,
+		"bin": "tool",
+	} {
+		entries, err := a.ReadDir(dir)
+		if err != nil {
+			t.Errorf("readdir %s: %v", dir, err)
+		} else if got := names(t, entries); got != want {
+			t.Errorf("readdir %s: got %q, want %q", dir, got, want)
+		}
+	}
+	if target, err := a.Readlink("current"); err != nil || target != "/data" {
+		t.Errorf("readlink: %q, %v", target, err)
+	}
+	if fi, err := a.Stat("bin/tool"); err != nil || fi.Mode() != 0o755 || fi.Size() != 3 || !fi.ModTime().Equal(time.Unix(1e9, 0)) {
+		t.Errorf("stat bin/tool: %v, %v", fi, err)
+	}
+	if fi, err := a.Stat("current"); err != nil || !fi.IsDir() {
+		t.Errorf("stat through a symlink: %v, %v", fi, err)
+	}
+	if _, err := a.Stat("etc/config/x"); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("stat below a file: %v", err)
+	}
+	if _, err := a.Stat("missing"); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("stat of a missing file: %v", err)
+	}
+}
+
+func TestTar(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		b := tarball(t, compress)
+		a := archivefs.New(bytes.NewReader(b), int64(len(b)))
+		check(t, a, "bin/ current data/ dev/ escape etc/")
+		entries, _ := a.ReadDir("data")
+		if got := names(t, entries); got != "big link" {
+			t.Errorf("readdir data: %q", got)
+		}
+		big, _ := a.Stat("data/big")
+		link, _ := a.Stat("data/link")
+		if ba, la := big.Sys().(*vfs.Attr), link.Sys().(*vfs.Attr); ba.Ino != la.Ino || la.Nlink != 2 {
+			t.Errorf("hard link: %+v, %+v", ba, la)
+		}
+		fi, err := a.Lstat("dev/null")
+		if err != nil || fi.Mode()&fs.ModeCharDevice == 0 || fi.Sys().(*vfs.Attr).Rdev != 0x103 {
+			t.Errorf("dev/null: %v, %v", fi, err)
+		}
+		if attr := func() *vfs.Attr { fi, _ := a.Stat("etc/config"); return fi.Sys().(*vfs.Attr) }(); attr.Uid != 1000 || attr.Gid != 100 {
+			t.Errorf("owner of etc/config: %d:%d", attr.Uid, attr.Gid)
+		}
+	}
+}
+
+func TestZip(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "fixture.zip")
+	if err := os.WriteFile(name, zipfile(t), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := archivefs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	check(t, a, "bin/ current data/ escape etc/")
+	if fi, err := a.Stat("etc/config"); err != nil || fi.Mode() != 0o640 {
+		t.Errorf("stat etc/config: %v, %v", fi, err)
+	}
+}
+
+func TestBadArchive(t *testing.T) {
+	b := []byte("PK\x03\x04 not really a zip archive")
+	a := archivefs.New(bytes.NewReader(b), int64(len(b)))
+	if _, err := a.Stat("x"); err == nil || errors.Is(err, syscall.ENOENT) {
+		t.Errorf("stat in a bad archive: %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	b := tarball(t, false)
+	a := archivefs.New(bytes.NewReader(b), int64(len(b)))
+	for name, err := range map[string]error{
+		"open for writing":  func() error { _, err := a.Open("etc/config", os.O_RDWR, 0); return err }(),
+		"create":            func() error { _, err := a.Open("etc/new", os.O_CREATE|os.O_WRONLY, 0o644); return err }(),
+		"mkdir":             a.Mkdir("d", 0o755),
+		"unlink":            a.Unlink("etc/config"),
+		"rmdir":             a.Rmdir("etc"),
+		"rename":            a.Rename("etc/config", "etc/c"),
+		"chmod":             a.Chmod("etc/config", 0o600),
+		"symlink":           a.Symlink("etc/config", "l"),
+		"link":              a.Link("etc/config", "l"),
+		"chtimes":           a.Chtimes("etc/config", time.Now(), time.Now()),
+		"remove of nothing": a.Unlink("etc/missing"),
+	} {
+		if !errors.Is(err, syscall.EROFS) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	f, _ := a.Open("etc/config", os.O_RDONLY, 0)
+	if _, err := f.Write([]byte("x")); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("write: %v", err)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "fixture.tar.gz")
+	if err := os.WriteFile(name, tarball(t, true), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := archivefs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `cat /ro/etc/config
+echo x >/ro/etc/config || echo refused
+echo changed >/rw/etc/config && cat /rw/etc/config
+wc -c </rw/data/link
+ls /rw/bin`)
+	cmd.Stdout = &stdout
+	err = tracer.New(cmd,
+		tracer.WithMount("/ro", a),
+		tracer.WithMount("/rw", overlay.New(a, memfs.New())),
+	).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "a=b\n\nrefused\nchanged\n100000\ntool\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func names(t *testing.T, entries []fs.DirEntry) string {
+	var s []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		} else if _, err := e.Info(); err != nil {
+			t.Errorf("info of %s: %v", name, err)
+		}
+		s = append(s, name)
+	}
+	return strings.Join(s, " ")
+}
@@ -0,0 +1,118 @@
+package archivefs
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// tarReader returns a reader of the tar entries sr reads, decompressing
+// them if compressed is set, and what closes it.
+func tarReader(sr *io.SectionReader, compressed bool) (*tar.Reader, io.Closer, error) {
+	if !compressed {
+		return tar.NewReader(sr), io.NopCloser(sr), nil
+	}
+	zr, err := gzip.NewReader(sr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("archivefs: %w", err)
+	}
+	return tar.NewReader(zr), zr, nil
+}
+
+// indexTar indexes a tar archive, by reading through it. Where the archive
+// is not compressed, a file's contents are where the reader is once it has
+// read the file's header.
+func (a *FS) indexTar(compressed bool) error {
+	sr := io.NewSectionReader(a.r, 0, a.size)
+	tr, c, err := tarReader(sr, compressed)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("archivefs: %w", err)
+		}
+		name := cleanName(hdr.Name)
+		e := &entry{
+			mode:  hdr.FileInfo().Mode(),
+			uid:   uint32(hdr.Uid),
+			gid:   uint32(hdr.Gid),
+			mtime: hdr.ModTime,
+			atime: hdr.AccessTime,
+			ctime: hdr.ChangeTime,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeGNUSparse:
+			e.size = hdr.Size
+			if compressed || sparse(hdr) {
+				e.open = a.tarEntry(compressed, i)
+			} else if e.off, err = sr.Seek(0, io.SeekCurrent); err != nil {
+				return fmt.Errorf("archivefs: %w", err)
+			}
+		case tar.TypeLink:
+			if t, ok := a.entries[cleanName(hdr.Linkname)]; ok && !t.mode.IsDir() && t.name != name {
+				a.add(name, t)
+			}
+			continue
+		case tar.TypeSymlink:
+			e.target, e.size = hdr.Linkname, int64(len(hdr.Linkname))
+		case tar.TypeChar, tar.TypeBlock:
+			e.rdev = mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		case tar.TypeDir, tar.TypeFifo:
+		default:
+			// Other kinds, such as extended headers the reader does not
+			// know, have nothing to serve.
+			continue
+		}
+		a.add(name, e)
+	}
+}
+
+// sparse reports whether the file hdr describes is sparse, and so is not
+// stored in the archive as it reads.
+func sparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// tarEntry returns what opens the contents of the ith entry of the
+// archive, by reading through the archive up to it.
+func (a *FS) tarEntry(compressed bool, i int) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		tr, c, err := tarReader(io.NewSectionReader(a.r, 0, a.size), compressed)
+		if err != nil {
+			return nil, err
+		}
+		for range i + 1 {
+			if _, err := tr.Next(); err != nil {
+				c.Close()
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, fmt.Errorf("archivefs: %w", err)
+			}
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{tr, c}, nil
+	}
+}
+
+func mkdev(major, minor uint32) uint64 {
+	return uint64(minor&0xff) | uint64(major)<<8 | uint64(minor&^0xff)<<12
+}
@@ -0,0 +1,50 @@
+package archivefs
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// maxTarget bounds the length of a symlink's target read from a zip
+// archive, where it is stored as the symlink's contents.
+const maxTarget = 4096
+
+// indexZip indexes a zip archive, from its central directory. The contents
+// of a stored file are at its data offset.
+func (a *FS) indexZip() error {
+	zr, err := zip.NewReader(a.r, a.size)
+	if err != nil {
+		return fmt.Errorf("archivefs: %w", err)
+	}
+	for _, f := range zr.File {
+		e := &entry{mode: f.Mode(), mtime: f.Modified, size: int64(f.UncompressedSize64)}
+		switch {
+		case e.mode.IsDir():
+			e.size = 0
+		case e.mode&fs.ModeSymlink != 0:
+			rc, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("archivefs: %s: %w", f.Name, err)
+			}
+			b, err := io.ReadAll(io.LimitReader(rc, maxTarget))
+			rc.Close()
+			if err != nil {
+				return fmt.Errorf("archivefs: %s: %w", f.Name, err)
+			}
+			e.target, e.size = string(b), int64(len(b))
+		case !e.mode.IsRegular():
+			// Devices and the like have nothing to read.
+			e.size = 0
+		case f.Method == zip.Store:
+			if e.off, err = f.DataOffset(); err != nil {
+				return fmt.Errorf("archivefs: %s: %w", f.Name, err)
+			}
+		default:
+			e.open = f.Open
+		}
+		a.add(cleanName(f.Name), e)
+	}
+	return nil
+}
@@ -0,0 +1,844 @@
+// Package boltfs implements a vfs.Backend that keeps the whole tree in a
+// single bbolt database file, so that the files a command leaves behind
+// survive it and can be handed on as one artifact.
+//
+// Every call that changes the tree is one transaction, synced to disk
+// before the call returns, so after a crash the database holds the tree as
+// of the last call that completed. The contents of a file are stored in
+// chunks of 64 KiB, so a write rewrites only the chunks it touches, and
+// extended attributes are stored alongside the inode.
+//
+// As in memfs, absolute symlink targets are resolved against the root,
+// and permission bits are recorded but not enforced. Reads do not update
+// access times, as if the tree were mounted noatime, so that reading never
+// writes to the database. A file unlinked while open stays readable
+// through the open files until they are closed; one left over by a crash
+// is removed the next time the database is opened. A database can be open
+// in only one process at a time. All methods, and the methods of the files
+// an FS opens, are safe for concurrent use.
+package boltfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// chunkSize is the size of the chunks file contents are stored in.
+const chunkSize = 64 << 10
+
+// rootIno is the inode number of the root directory.
+const rootIno = 1
+
+// The buckets of the database. inodes maps an inode number to its record,
+// entries maps a directory's inode number and an entry's name to the
+// entry's inode number, chunks maps an inode number and an index to a
+// chunk of the file's contents, and xattrs maps an inode number and an
+// attribute name to the attribute's value. Keys start with the inode number in big
+// endian, so that the entries of a directory, and the chunks and the
+// attributes of a file, sort together and in order.
+var (
+	bucketInodes  = []byte("inodes")
+	bucketEntries = []byte("entries")
+	bucketChunks  = []byte("chunks")
+	bucketXattrs  = []byte("xattrs")
+)
+
+// FS is a filesystem tree in a database file.
+type FS struct {
+	db  *bbolt.DB
+	now func() time.Time
+
+	mu   sync.Mutex
+	open map[uint64]int // the number of open files of each inode
+
+	// pin is held for writing by the calls that can remove an inode, and
+	// for reading by the opens that only read, which count the inode as
+	// open outside any transaction that would keep it from being removed.
+	pin sync.RWMutex
+}
+
+var (
+	_ vfs.Backend  = (*FS)(nil)
+	_ vfs.Xattrer  = (*FS)(nil)
+	_ vfs.StatFSer = (*FS)(nil)
+)
+
+// New opens the database at path, creating it with an empty root
+// directory if it does not exist. It fails if another process has the
+// database open.
+func New(path string) (*FS, error) {
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("boltfs: open %s: %w", path, err)
+	}
+	f := &FS{db: db, now: time.Now, open: make(map[uint64]int)}
+	if err := f.init(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("boltfs: open %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// init creates the buckets and the root of a new database, and removes
+// the inodes a crash left unlinked in an old one.
+func (f *FS) init() error {
+	return f.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{bucketInodes, bucketEntries, bucketChunks, bucketXattrs} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		t := f.txn(tx)
+		if t.inodes.Get(inoKey(rootIno)) == nil {
+			root, err := t.newInode(fs.ModeDir | 0o755)
+			if err != nil {
+				return err
+			}
+			if root.ino != rootIno {
+				return fmt.Errorf("database has no root")
+			}
+			root.nlink, root.parent = 2, rootIno
+			return t.put(root)
+		}
+		var orphans []*inode
+		err := t.inodes.ForEach(func(k, v []byte) error {
+			n, err := decodeInode(binary.BigEndian.Uint64(k), v)
+			if err == nil && n.nlink == 0 {
+				orphans = append(orphans, n)
+			}
+			return err
+		})
+		for _, n := range orphans {
+			if err == nil {
+				err = t.remove(n)
+			}
+		}
+		return err
+	})
+}
+
+// Close closes the database. Files still open fail afterwards.
+func (f *FS) Close() error {
+	return f.db.Close()
+}
+
+func pathErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// view and update run fn in a read-only or a read-write transaction.
+func (f *FS) view(fn func(*txn) error) error {
+	return f.db.View(func(tx *bbolt.Tx) error { return fn(f.txn(tx)) })
+}
+
+func (f *FS) update(fn func(*txn) error) error {
+	return f.db.Update(func(tx *bbolt.Tx) error { return fn(f.txn(tx)) })
+}
+
+// removing is update for the calls that can remove an inode.
+func (f *FS) removing(fn func(*txn) error) error {
+	f.pin.Lock()
+	defer f.pin.Unlock()
+	return f.update(fn)
+}
+
+// txn is a transaction on the tree.
+type txn struct {
+	fs      *FS
+	inodes  *bbolt.Bucket
+	entries *bbolt.Bucket
+	chunks  *bbolt.Bucket
+	xattrs  *bbolt.Bucket
+}
+
+func (f *FS) txn(tx *bbolt.Tx) *txn {
+	return &txn{
+		fs:      f,
+		inodes:  tx.Bucket(bucketInodes),
+		entries: tx.Bucket(bucketEntries),
+		chunks:  tx.Bucket(bucketChunks),
+		xattrs:  tx.Bucket(bucketXattrs),
+	}
+}
+
+func inoKey(ino uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, ino)
+}
+
+func entryKey(dir uint64, name string) []byte {
+	return append(inoKey(dir), name...)
+}
+
+func chunkKey(ino uint64, i int64) []byte {
+	return binary.BigEndian.AppendUint64(inoKey(ino), uint64(i))
+}
+
+// get returns the inode numbered ino. A missing inode means the database
+// is corrupt, which is EIO.
+func (t *txn) get(ino uint64) (*inode, error) {
+	v := t.inodes.Get(inoKey(ino))
+	if v == nil {
+		return nil, syscall.EIO
+	}
+	return decodeInode(ino, v)
+}
+
+func (t *txn) put(n *inode) error {
+	return t.inodes.Put(inoKey(n.ino), n.encode())
+}
+
+func (t *txn) newInode(mode fs.FileMode) (*inode, error) {
+	ino, err := t.inodes.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	now := t.fs.now()
+	return &inode{ino: ino, mode: mode, nlink: 1, atime: now, mtime: now, ctime: now}, nil
+}
+
+// child returns the entry of dir named name, or nil if there is none.
+func (t *txn) child(dir *inode, name string) (*inode, error) {
+	v := t.entries.Get(entryKey(dir.ino, name))
+	if v == nil {
+		return nil, nil
+	}
+	return t.get(binary.BigEndian.Uint64(v))
+}
+
+// hasEntries reports whether the directory dir has any entries.
+func (t *txn) hasEntries(dir *inode) bool {
+	k, _ := t.entries.Cursor().Seek(inoKey(dir.ino))
+	return k != nil && bytes.HasPrefix(k, inoKey(dir.ino))
+}
+
+// walk resolves name to an inode. Symlinks in intermediate components are
+// always followed; a final symlink is followed only if follow is set.
+func (t *txn) walk(name string, follow bool) (*inode, error) {
+	root, err := t.get(rootIno)
+	if err != nil {
+		return nil, err
+	}
+	return vfs.Walk(name, root, follow, func(dir *inode, c string, _ bool) (*inode, fs.FileMode, string, error) {
+		child, err := t.child(dir, c)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		if child == nil {
+			return nil, 0, "", syscall.ENOENT
+		}
+		return child, child.mode, child.target, nil
+	})
+}
+
+// parent resolves the directory containing name and returns it with the
+// final path element. name must not be ".".
+func (t *txn) parent(op, name string) (*inode, string, error) {
+	if !fs.ValidPath(name) {
+		return nil, "", pathErr(op, name, syscall.EINVAL)
+	}
+	if name == "." {
+		return nil, "", pathErr(op, name, syscall.EBUSY)
+	}
+	dir, base := path.Split(name)
+	d, err := t.walk(strings.TrimSuffix(dir, "/"), true)
+	if err != nil {
+		return nil, "", pathErr(op, name, err)
+	}
+	if !d.mode.IsDir() {
+		return nil, "", pathErr(op, name, syscall.ENOTDIR)
+	}
+	return d, base, nil
+}
+
+func (t *txn) lookup(op, name string, follow bool) (*inode, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathErr(op, name, syscall.EINVAL)
+	}
+	n, err := t.walk(name, follow)
+	if err != nil {
+		return nil, pathErr(op, name, err)
+	}
+	return n, nil
+}
+
+// link inserts n into dir under base and updates the directory's times,
+// storing both.
+func (t *txn) link(dir *inode, base string, n *inode) error {
+	if err := t.entries.Put(entryKey(dir.ino, base), inoKey(n.ino)); err != nil {
+		return err
+	}
+	if n.mode.IsDir() {
+		n.parent = dir.ino
+		dir.nlink++
+	}
+	now := t.fs.now()
+	dir.mtime, dir.ctime = now, now
+	if err := t.put(dir); err != nil {
+		return err
+	}
+	return t.put(n)
+}
+
+// unlink removes the entry base, for n, from dir, and removes n once
+// nothing links to it or has it open.
+func (t *txn) unlink(dir *inode, base string, n *inode) error {
+	if err := t.entries.Delete(entryKey(dir.ino, base)); err != nil {
+		return err
+	}
+	if n.mode.IsDir() {
+		dir.nlink--
+		n.nlink = 0
+	} else {
+		n.nlink--
+	}
+	now := t.fs.now()
+	dir.mtime, dir.ctime = now, now
+	n.ctime = now
+	if err := t.put(dir); err != nil {
+		return err
+	}
+	return t.release(n)
+}
+
+// release stores n, or removes it if nothing links to it or has it open.
+func (t *txn) release(n *inode) error {
+	t.fs.mu.Lock()
+	open := t.fs.open[n.ino]
+	t.fs.mu.Unlock()
+	if n.nlink == 0 && open == 0 {
+		return t.remove(n)
+	}
+	return t.put(n)
+}
+
+// remove deletes n, its contents and its attributes.
+func (t *txn) remove(n *inode) error {
+	if err := t.dropChunks(n.ino); err != nil {
+		return err
+	}
+	if err := dropPrefix(t.xattrs, inoKey(n.ino)); err != nil {
+		return err
+	}
+	return t.inodes.Delete(inoKey(n.ino))
+}
+
+// dropChunks deletes the contents of the file numbered ino.
+func (t *txn) dropChunks(ino uint64) error {
+	return dropPrefix(t.chunks, inoKey(ino))
+}
+
+// dropPrefix deletes the keys of b that start with prefix.
+func dropPrefix(b *bbolt.Bucket, prefix []byte) error {
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zeroChunks clears the bytes of the file numbered ino from off to end,
+// deleting the chunks wholly inside the range so that they become holes.
+func (t *txn) zeroChunks(ino uint64, off, end int64) error {
+	prefix := inoKey(ino)
+	var keys [][]byte
+	c := t.chunks.Cursor()
+	for k, _ := c.Seek(chunkKey(ino, off/chunkSize)); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if int64(binary.BigEndian.Uint64(k[len(prefix):]))*chunkSize >= end {
+			break
+		}
+		keys = append(keys, bytes.Clone(k))
+	}
+	for _, k := range keys {
+		start := int64(binary.BigEndian.Uint64(k[len(prefix):])) * chunkSize
+		from, to := max(off, start)-start, min(end, start+chunkSize)-start
+		old := t.chunks.Get(k)
+		if from == 0 && to >= int64(len(old)) {
+			if err := t.chunks.Delete(k); err != nil {
+				return err
+			}
+			continue
+		}
+		if from >= int64(len(old)) {
+			continue
+		}
+		chunk := bytes.Clone(old)
+		if to >= int64(len(chunk)) {
+			chunk = chunk[:from]
+		} else {
+			clear(chunk[from:to])
+		}
+		if err := t.chunks.Put(k, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	var file *file
+	open := func(t *txn) error {
+		var n *inode
+		var err error
+		if name == "." {
+			if n, err = t.get(rootIno); err != nil {
+				return pathErr("open", name, err)
+			}
+		} else {
+			dir, base, err := t.parent("open", name)
+			if err != nil {
+				return err
+			}
+			if n, err = t.child(dir, base); err != nil {
+				return pathErr("open", name, err)
+			}
+			switch {
+			case n == nil && flag&os.O_CREATE != 0:
+				if n, err = t.newInode(perm.Perm()); err != nil {
+					return pathErr("open", name, err)
+				}
+				if err := t.link(dir, base, n); err != nil {
+					return pathErr("open", name, err)
+				}
+			case n == nil:
+				return pathErr("open", name, syscall.ENOENT)
+			case flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+				return pathErr("open", name, syscall.EEXIST)
+			case n.mode&fs.ModeSymlink != 0 && flag&syscall.O_NOFOLLOW != 0:
+				return pathErr("open", name, syscall.ELOOP)
+			case n.mode&fs.ModeSymlink != 0:
+				if n, err = t.walk(name, true); err != nil {
+					return pathErr("open", name, err)
+				}
+			}
+		}
+
+		acc := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+		if n.mode.IsDir() && (acc != os.O_RDONLY || flag&os.O_CREATE != 0) {
+			return pathErr("open", name, syscall.EISDIR)
+		}
+		if !n.mode.IsDir() && flag&syscall.O_DIRECTORY != 0 {
+			return pathErr("open", name, syscall.ENOTDIR)
+		}
+		if flag&os.O_TRUNC != 0 && acc != os.O_RDONLY && n.mode.IsRegular() && n.size > 0 {
+			if err := t.dropChunks(n.ino); err != nil {
+				return pathErr("open", name, err)
+			}
+			now := f.now()
+			n.size, n.mtime, n.ctime = 0, now, now
+			if err := t.put(n); err != nil {
+				return pathErr("open", name, err)
+			}
+		}
+		file = newFile(f, n, path.Base(name), flag)
+		return nil
+	}
+	var err error
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		err = f.update(open)
+	} else {
+		// Opening only reads, which takes no write transaction.
+		f.pin.RLock()
+		err = f.view(open)
+		f.pin.RUnlock()
+	}
+	if err != nil {
+		if file != nil {
+			// The transaction failed to commit after the file was
+			// counted as open.
+			file.Close()
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *FS) stat(op, name string, follow bool) (fs.FileInfo, error) {
+	var fi fs.FileInfo
+	err := f.view(func(t *txn) error {
+		n, err := t.lookup(op, name, follow)
+		if err != nil {
+			return err
+		}
+		fi = n.info(path.Base(name))
+		return nil
+	})
+	return fi, err
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error)  { return f.stat("stat", name, true) }
+func (f *FS) Lstat(name string) (fs.FileInfo, error) { return f.stat("lstat", name, false) }
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	err := f.view(func(t *txn) error {
+		n, err := t.lookup("readdir", name, true)
+		if err != nil {
+			return err
+		}
+		if !n.mode.IsDir() {
+			return pathErr("readdir", name, syscall.ENOTDIR)
+		}
+		prefix := inoKey(n.ino)
+		c := t.entries.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			kid, err := t.get(binary.BigEndian.Uint64(v))
+			if err != nil {
+				return pathErr("readdir", name, err)
+			}
+			entries = append(entries, fs.FileInfoToDirEntry(kid.info(string(k[len(prefix):]))))
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (f *FS) Mkdir(name string, perm fs.FileMode) error {
+	return f.update(func(t *txn) error {
+		dir, base, err := t.parent("mkdir", name)
+		if err != nil {
+			if name == "." {
+				return pathErr("mkdir", name, syscall.EEXIST)
+			}
+			return err
+		}
+		if t.entries.Get(entryKey(dir.ino, base)) != nil {
+			return pathErr("mkdir", name, syscall.EEXIST)
+		}
+		n, err := t.newInode(fs.ModeDir | perm.Perm())
+		if err != nil {
+			return pathErr("mkdir", name, err)
+		}
+		n.nlink = 2
+		if err := t.link(dir, base, n); err != nil {
+			return pathErr("mkdir", name, err)
+		}
+		return nil
+	})
+}
+
+func (f *FS) Unlink(name string) error {
+	return f.removing(func(t *txn) error {
+		dir, base, err := t.parent("unlink", name)
+		if err != nil {
+			return err
+		}
+		n, err := t.child(dir, base)
+		switch {
+		case err != nil:
+			return pathErr("unlink", name, err)
+		case n == nil:
+			return pathErr("unlink", name, syscall.ENOENT)
+		case n.mode.IsDir():
+			return pathErr("unlink", name, syscall.EISDIR)
+		}
+		if err := t.unlink(dir, base, n); err != nil {
+			return pathErr("unlink", name, err)
+		}
+		return nil
+	})
+}
+
+func (f *FS) Rmdir(name string) error {
+	return f.removing(func(t *txn) error {
+		dir, base, err := t.parent("rmdir", name)
+		if err != nil {
+			return err
+		}
+		n, err := t.child(dir, base)
+		switch {
+		case err != nil:
+			return pathErr("rmdir", name, err)
+		case n == nil:
+			return pathErr("rmdir", name, syscall.ENOENT)
+		case !n.mode.IsDir():
+			return pathErr("rmdir", name, syscall.ENOTDIR)
+		case t.hasEntries(n):
+			return pathErr("rmdir", name, syscall.ENOTEMPTY)
+		}
+		if err := t.unlink(dir, base, n); err != nil {
+			return pathErr("rmdir", name, err)
+		}
+		return nil
+	})
+}
+
+func (f *FS) Rename(oldname, newname string) error {
+	return f.removing(func(t *txn) error {
+		odir, obase, err := t.parent("rename", oldname)
+		if err != nil {
+			return err
+		}
+		ndir, nbase, err := t.parent("rename", newname)
+		if err != nil {
+			return err
+		}
+		if ndir.ino == odir.ino {
+			// One record, so that the changes to it are all stored.
+			ndir = odir
+		}
+		src, err := t.child(odir, obase)
+		if err != nil {
+			return pathErr("rename", oldname, err)
+		}
+		if src == nil {
+			return pathErr("rename", oldname, syscall.ENOENT)
+		}
+		dst, err := t.child(ndir, nbase)
+		if err != nil {
+			return pathErr("rename", newname, err)
+		}
+		if dst != nil && dst.ino == src.ino {
+			return nil
+		}
+		if src.mode.IsDir() {
+			for d := ndir; ; {
+				if d.ino == src.ino {
+					return pathErr("rename", newname, syscall.EINVAL)
+				}
+				if d.ino == rootIno {
+					break
+				}
+				if d, err = t.get(d.parent); err != nil {
+					return pathErr("rename", newname, err)
+				}
+			}
+		}
+		if dst != nil {
+			switch {
+			case src.mode.IsDir() && !dst.mode.IsDir():
+				return pathErr("rename", newname, syscall.ENOTDIR)
+			case !src.mode.IsDir() && dst.mode.IsDir():
+				return pathErr("rename", newname, syscall.EISDIR)
+			case dst.mode.IsDir() && t.hasEntries(dst):
+				return pathErr("rename", newname, syscall.ENOTEMPTY)
+			}
+			if err := t.unlink(ndir, nbase, dst); err != nil {
+				return pathErr("rename", newname, err)
+			}
+		}
+		if err := t.entries.Delete(entryKey(odir.ino, obase)); err != nil {
+			return pathErr("rename", oldname, err)
+		}
+		if src.mode.IsDir() {
+			odir.nlink--
+		}
+		now := f.now()
+		odir.mtime, odir.ctime = now, now
+		src.ctime = now
+		if err := t.put(odir); err != nil {
+			return pathErr("rename", oldname, err)
+		}
+		if err := t.link(ndir, nbase, src); err != nil {
+			return pathErr("rename", newname, err)
+		}
+		return nil
+	})
+}
+
+func (f *FS) Link(oldname, newname string) error {
+	return f.update(func(t *txn) error {
+		odir, obase, err := t.parent("link", oldname)
+		if err != nil {
+			return err
+		}
+		ndir, nbase, err := t.parent("link", newname)
+		if err != nil {
+			return err
+		}
+		src, err := t.child(odir, obase)
+		switch {
+		case err != nil:
+			return pathErr("link", oldname, err)
+		case src == nil:
+			return pathErr("link", oldname, syscall.ENOENT)
+		case src.mode.IsDir():
+			return pathErr("link", oldname, syscall.EPERM)
+		}
+		if t.entries.Get(entryKey(ndir.ino, nbase)) != nil {
+			return pathErr("link", newname, syscall.EEXIST)
+		}
+		src.nlink++
+		src.ctime = f.now()
+		if err := t.link(ndir, nbase, src); err != nil {
+			return pathErr("link", newname, err)
+		}
+		return nil
+	})
+}
+
+func (f *FS) Symlink(target, newname string) error {
+	return f.update(func(t *txn) error {
+		dir, base, err := t.parent("symlink", newname)
+		if err != nil {
+			return err
+		}
+		if t.entries.Get(entryKey(dir.ino, base)) != nil {
+			return pathErr("symlink", newname, syscall.EEXIST)
+		}
+		n, err := t.newInode(fs.ModeSymlink | 0o777)
+		if err != nil {
+			return pathErr("symlink", newname, err)
+		}
+		n.target = target
+		n.size = int64(len(target))
+		if err := t.link(dir, base, n); err != nil {
+			return pathErr("symlink", newname, err)
+		}
+		return nil
+	})
+}
+
+func (f *FS) Readlink(name string) (string, error) {
+	var target string
+	err := f.view(func(t *txn) error {
+		n, err := t.lookup("readlink", name, false)
+		if err != nil {
+			return err
+		}
+		if n.mode&fs.ModeSymlink == 0 {
+			return pathErr("readlink", name, syscall.EINVAL)
+		}
+		target = n.target
+		return nil
+	})
+	return target, err
+}
+
+func (f *FS) Chmod(name string, mode fs.FileMode) error {
+	return f.update(func(t *txn) error {
+		n, err := t.lookup("chmod", name, true)
+		if err != nil {
+			return err
+		}
+		const settable = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+		n.mode = n.mode&^settable | mode&settable
+		n.ctime = f.now()
+		if err := t.put(n); err != nil {
+			return pathErr("chmod", name, err)
+		}
+		return nil
+	})
+}
+
+func (f *FS) Chtimes(name string, atime, mtime time.Time) error {
+	return f.update(func(t *txn) error {
+		n, err := t.lookup("chtimes", name, true)
+		if err != nil {
+			return err
+		}
+		if !atime.IsZero() {
+			n.atime = atime
+		}
+		if !mtime.IsZero() {
+			n.mtime = mtime
+		}
+		n.ctime = f.now()
+		if err := t.put(n); err != nil {
+			return pathErr("chtimes", name, err)
+		}
+		return nil
+	})
+}
+
+func (f *FS) Getxattr(name, attr string) ([]byte, error) {
+	var v []byte
+	err := f.view(func(t *txn) error {
+		n, err := t.lookup("getxattr", name, true)
+		if err != nil {
+			return err
+		}
+		if v = bytes.Clone(t.xattrs.Get(entryKey(n.ino, attr))); v == nil {
+			return pathErr("getxattr", name, syscall.ENODATA)
+		}
+		return nil
+	})
+	return v, err
+}
+
+func (f *FS) Setxattr(name, attr string, value []byte, flags int) error {
+	return f.update(func(t *txn) error {
+		n, err := t.lookup("setxattr", name, true)
+		if err != nil {
+			return err
+		}
+		k := entryKey(n.ino, attr)
+		set := t.xattrs.Get(k) != nil
+		switch {
+		case set && flags&vfs.XattrCreate != 0:
+			return pathErr("setxattr", name, syscall.EEXIST)
+		case !set && flags&vfs.XattrReplace != 0:
+			return pathErr("setxattr", name, syscall.ENODATA)
+		}
+		// A nil value would read back as no attribute.
+		if err := t.xattrs.Put(k, append([]byte{}, value...)); err != nil {
+			return pathErr("setxattr", name, err)
+		}
+		n.ctime = f.now()
+		if err := t.put(n); err != nil {
+			return pathErr("setxattr", name, err)
+		}
+		return nil
+	})
+}
+
+func (f *FS) Listxattr(name string) ([]string, error) {
+	var attrs []string
+	err := f.view(func(t *txn) error {
+		n, err := t.lookup("listxattr", name, true)
+		if err != nil {
+			return err
+		}
+		prefix := inoKey(n.ino)
+		c := t.xattrs.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			attrs = append(attrs, string(k[len(prefix):]))
+		}
+		return nil
+	})
+	return attrs, err
+}
+
+func (f *FS) Removexattr(name, attr string) error {
+	return f.update(func(t *txn) error {
+		n, err := t.lookup("removexattr", name, true)
+		if err != nil {
+			return err
+		}
+		k := entryKey(n.ino, attr)
+		if t.xattrs.Get(k) == nil {
+			return pathErr("removexattr", name, syscall.ENODATA)
+		}
+		if err := t.xattrs.Delete(k); err != nil {
+			return pathErr("removexattr", name, err)
+		}
+		n.ctime = f.now()
+		if err := t.put(n); err != nil {
+			return pathErr("removexattr", name, err)
+		}
+		return nil
+	})
+}
+
+// StatFS describes the bytes of the host filesystem the database is on.
+// Inodes take no host inodes, so their number is left unknown.
+func (f *FS) StatFS(name string) (vfs.FSStat, error) {
+	if _, err := f.Stat(name); err != nil {
+		return vfs.FSStat{}, err
+	}
+	st, err := vfs.HostStatFS(f.db.Path())
+	return vfs.FSStat{Bytes: st.Bytes, BytesFree: st.BytesFree}, err
+}
@@ -0,0 +1,433 @@
+package boltfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+func newFS(t *testing.T, path string) *FS {
+	t.Helper()
+	b, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func writeFile(t *testing.T, b *FS, name, data string) {
+	t.Helper()
+	f, err := b.Open(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, b *FS, name string) string {
+	t.Helper()
+	f, err := b.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestReadWrite(t *testing.T) {
+	b := newFS(t, filepath.Join(t.TempDir(), "db"))
+	writeFile(t, b, "a.txt", "hello")
+	f, err := b.Open("a.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(f, " world")
+	if _, err := f.Read(make([]byte, 1)); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("read on a write-only file: got %v", err)
+	}
+	f.Close()
+
+	f, _ = b.Open("a.txt", os.O_RDWR, 0)
+	f.WriteAt([]byte("J"), 8)
+	f.Seek(-5, io.SeekEnd)
+	buf := make([]byte, 5)
+	n, _ := f.Read(buf)
+	if string(buf[:n]) != "woJld" {
+		t.Errorf("got %q", buf[:n])
+	}
+	f.Close()
+	if _, err := f.Read(buf); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("read after close: got %v", err)
+	}
+
+	writeFile(t, b, "a.txt", "short")
+	if got := readFile(t, b, "a.txt"); got != "short" {
+		t.Errorf("after truncating: got %q", got)
+	}
+	if _, err := b.Open("a.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("O_EXCL on existing file: got %v", err)
+	}
+	if _, err := b.Open("missing", os.O_RDONLY, 0); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("open missing: got %v", err)
+	}
+}
+
+func TestChunks(t *testing.T) {
+	b := newFS(t, filepath.Join(t.TempDir(), "db"))
+	data := bytes.Repeat([]byte("0123456789abcdef"), chunkSize/16*3)
+	writeFile(t, b, "big", string(data))
+	if got := readFile(t, b, "big"); got != string(data) {
+		t.Fatalf("read %d bytes back, want %d", len(got), len(data))
+	}
+	f, _ := b.Open("big", os.O_RDWR, 0)
+	f.WriteAt([]byte("XY"), chunkSize-1)
+	buf := make([]byte, 4)
+	if n, err := f.ReadAt(buf, chunkSize-2); n != 4 || err != nil || string(buf) != "eXY1" {
+		t.Errorf("read across a chunk boundary: %q, %v", buf[:n], err)
+	}
+	f.Close()
+
+	// A write past the end leaves a hole that reads as zeros.
+	f, _ = b.Open("sparse", os.O_RDWR|os.O_CREATE, 0o644)
+	f.WriteAt([]byte("end"), 2*chunkSize+10)
+	f.WriteAt([]byte("start"), 0)
+	got, _ := io.ReadAll(f)
+	want := make([]byte, 2*chunkSize+13)
+	copy(want, "start")
+	copy(want[2*chunkSize+10:], "end")
+	if !bytes.Equal(got, want) {
+		t.Errorf("sparse file reads %d bytes, not as written", len(got))
+	}
+	f.Close()
+}
+
+func TestTruncate(t *testing.T) {
+	b := newFS(t, filepath.Join(t.TempDir(), "db"))
+	data := bytes.Repeat([]byte("x"), 3*chunkSize)
+	writeFile(t, b, "f", string(data))
+	f, _ := b.Open("f", os.O_RDWR, 0)
+	defer f.Close()
+	fi, _ := f.Stat()
+	ino := fi.Sys().(*vfs.Attr).Ino
+	has := func(i int64) bool {
+		var ok bool
+		b.view(func(t *txn) error {
+			ok = t.chunks.Get(chunkKey(ino, i)) != nil
+			return nil
+		})
+		return ok
+	}
+
+	// A hole frees the chunks it covers and zeroes those it only touches.
+	if err := f.(vfs.HolePuncher).PunchHole(chunkSize-1, chunkSize+2); err != nil {
+		t.Fatal(err)
+	}
+	if !has(0) || has(1) || !has(2) {
+		t.Errorf("chunks kept after punching a hole: %v %v %v", has(0), has(1), has(2))
+	}
+	clear(data[chunkSize-1 : 2*chunkSize+1])
+	if got := readFile(t, b, "f"); got != string(data) {
+		t.Error("file with a hole does not read back as zeros")
+	}
+
+	// Shrinking cuts chunks off, so that growing again reads zeros.
+	if err := f.(vfs.Truncater).Truncate(chunkSize + 1); err != nil {
+		t.Fatal(err)
+	}
+	if has(2) {
+		t.Error("chunk kept past the end of a truncated file")
+	}
+	f.(vfs.Truncater).Truncate(2 * chunkSize)
+	want := append(data[:chunkSize:chunkSize], make([]byte, chunkSize)...)
+	if got := readFile(t, b, "f"); got != string(want) {
+		t.Error("grown file does not read back as zeros")
+	}
+	if fi, _ := f.Stat(); fi.Size() != 2*chunkSize {
+		t.Errorf("size %d after growing, want %d", fi.Size(), 2*chunkSize)
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	b := newFS(t, filepath.Join(t.TempDir(), "db"))
+	if err := b.Mkdir("d", 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Mkdir("d", 0o750); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("mkdir of existing dir: got %v", err)
+	}
+	writeFile(t, b, "d/b", "")
+	writeFile(t, b, "d/a", "")
+	entries, err := b.ReadDir("d")
+	if err != nil || len(entries) != 2 || entries[0].Name() != "a" || entries[1].Name() != "b" {
+		t.Fatalf("readdir: %v, %v", entries, err)
+	}
+	if fi, _ := b.Stat("d"); !fi.IsDir() || fi.Mode().Perm() != 0o750 || fi.Sys().(*vfs.Attr).Nlink != 2 {
+		t.Errorf("unexpected directory %v", fi)
+	}
+	if err := b.Rmdir("d"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("rmdir of non-empty dir: got %v", err)
+	}
+	if err := b.Unlink("d"); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("unlink of dir: got %v", err)
+	}
+	if _, err := b.Open("d", os.O_WRONLY, 0); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("open dir for writing: got %v", err)
+	}
+	if _, err := b.Stat("d/a/x"); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("stat through a file: got %v", err)
+	}
+	b.Unlink("d/a")
+	b.Unlink("d/b")
+	if err := b.Rmdir("d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Rmdir("."); !errors.Is(err, syscall.EBUSY) {
+		t.Errorf("rmdir of root: got %v", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	b := newFS(t, filepath.Join(t.TempDir(), "db"))
+	b.Mkdir("a", 0o755)
+	b.Mkdir("a/b", 0o755)
+	b.Mkdir("c", 0o755)
+	writeFile(t, b, "a/f", "data")
+	writeFile(t, b, "c/g", "old")
+
+	if err := b.Rename("a/f", "c/g"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, b, "c/g"); got != "data" {
+		t.Errorf("got %q", got)
+	}
+	if err := b.Rename("a", "a/b/x"); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("rename into own subtree: got %v", err)
+	}
+	if err := b.Rename("c/g", "a"); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("rename file over dir: got %v", err)
+	}
+	if err := b.Rename("a", "z"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat("z/b"); err != nil {
+		t.Errorf("renamed dir lost its children: %v", err)
+	}
+	// Replacing a directory in the same parent keeps the parent's count
+	// of subdirectories.
+	b.Mkdir("empty", 0o755)
+	if err := b.Rename("z", "empty"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := b.Stat("."); fi.Sys().(*vfs.Attr).Nlink != 4 {
+		t.Errorf("root nlink = %d, want 4", fi.Sys().(*vfs.Attr).Nlink)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	b := newFS(t, filepath.Join(t.TempDir(), "db"))
+	b.Mkdir("dir", 0o755)
+	writeFile(t, b, "dir/file", "contents")
+	if err := b.Link("dir/file", "hard"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Link("dir", "e"); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("link to a directory: got %v", err)
+	}
+	b.Symlink("dir/file", "rel")
+	b.Symlink("/dir", "abs")
+	b.Symlink("../dir/file", "dir/up")
+	for _, name := range []string{"hard", "rel", "abs/file", "dir/up"} {
+		if got := readFile(t, b, name); got != "contents" {
+			t.Errorf("%s: got %q", name, got)
+		}
+	}
+	if fi, err := b.Lstat("rel"); err != nil || fi.Mode()&fs.ModeSymlink == 0 || fi.Size() != int64(len("dir/file")) {
+		t.Errorf("lstat: %v, %v", fi, err)
+	}
+	if target, err := b.Readlink("abs"); err != nil || target != "/dir" {
+		t.Errorf("readlink: %q, %v", target, err)
+	}
+	if _, err := b.Open("rel", os.O_RDONLY|syscall.O_NOFOLLOW, 0); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("O_NOFOLLOW: got %v", err)
+	}
+	b.Symlink("loop", "loop")
+	if _, err := b.Stat("loop"); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("symlink loop: got %v", err)
+	}
+	b.Unlink("dir/file")
+	if fi, err := b.Stat("hard"); err != nil || fi.Sys().(*vfs.Attr).Nlink != 1 {
+		t.Errorf("stat after unlinking one name: %v, %v", fi, err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	b := newFS(t, filepath.Join(t.TempDir(), "db"))
+	clock := time.Unix(1000, 0)
+	b.now = func() time.Time { return clock }
+	writeFile(t, b, "f", "x")
+	if err := b.Chmod("f", 0o600|fs.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	atime, mtime := time.Unix(10, 0), time.Unix(20, 0)
+	b.Chtimes("f", atime, time.Time{})
+	b.Chtimes("f", time.Time{}, mtime)
+	fi, _ := b.Stat("f")
+	attr := fi.Sys().(*vfs.Attr)
+	if fi.Mode() != 0o600|fs.ModeSetuid || !fi.ModTime().Equal(mtime) || !attr.Atime.Equal(atime) {
+		t.Errorf("unexpected metadata %v %v %v", fi.Mode(), fi.ModTime(), attr.Atime)
+	}
+	if attr.Ino == rootIno || attr.Nlink != 1 || !attr.Ctime.Equal(clock) {
+		t.Errorf("unexpected attr %+v", attr)
+	}
+}
+
+func TestXattr(t *testing.T) {
+	b := newFS(t, filepath.Join(t.TempDir(), "db"))
+	writeFile(t, b, "f", "x")
+	if err := b.Setxattr("f", "user.a", []byte("one"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Setxattr("f", "user.empty", nil, vfs.XattrCreate); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Setxattr("f", "user.a", nil, vfs.XattrCreate); !errors.Is(err, syscall.EEXIST) {
+		t.Errorf("create over user.a: %v", err)
+	}
+	if err := b.Setxattr("f", "user.b", nil, vfs.XattrReplace); !errors.Is(err, syscall.ENODATA) {
+		t.Errorf("replace missing user.b: %v", err)
+	}
+	if v, err := b.Getxattr("f", "user.empty"); err != nil || v == nil || len(v) != 0 {
+		t.Errorf("user.empty = %q, %v", v, err)
+	}
+	attrs, err := b.Listxattr("f")
+	if err != nil || len(attrs) != 2 || attrs[0] != "user.a" || attrs[1] != "user.empty" {
+		t.Errorf("listxattr = %v, %v", attrs, err)
+	}
+	if err := b.Removexattr("f", "user.a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Getxattr("f", "user.a"); !errors.Is(err, syscall.ENODATA) {
+		t.Errorf("getxattr after remove: %v", err)
+	}
+	if err := b.Unlink("f"); err != nil {
+		t.Fatal(err)
+	}
+	b.view(func(tx *txn) error {
+		if k, _ := tx.xattrs.Cursor().First(); k != nil {
+			t.Errorf("xattr %x outlived its inode", k)
+		}
+		return nil
+	})
+}
+
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	b, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Mkdir("d", 0o700)
+	writeFile(t, b, "d/f", "kept")
+	b.Symlink("d/f", "link")
+	before, _ := b.Stat("d/f")
+	writeFile(t, b, "orphan", "unlinked while open")
+	open, _ := b.Open("orphan", os.O_RDONLY, 0)
+	b.Unlink("orphan")
+	if got, err := io.ReadAll(open); err != nil || string(got) != "unlinked while open" {
+		t.Errorf("read of an unlinked open file: %q, %v", got, err)
+	}
+	if _, err := New(path); err == nil {
+		t.Error("second New of an open database succeeded")
+	}
+	// Closing the database without closing the file leaves the orphan
+	// behind, as a crash would.
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b = newFS(t, path)
+	if got := readFile(t, b, "link"); got != "kept" {
+		t.Errorf("after reopening: got %q", got)
+	}
+	after, _ := b.Stat("d/f")
+	if after.Sys().(*vfs.Attr).Ino != before.Sys().(*vfs.Attr).Ino || !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("metadata changed across reopening: %+v, %+v", before.Sys(), after.Sys())
+	}
+	orphans := 0
+	b.view(func(t *txn) error {
+		return t.inodes.ForEach(func(k, v []byte) error {
+			if n, _ := decodeInode(0, v); n.nlink == 0 {
+				orphans++
+			}
+			return nil
+		})
+	})
+	if orphans != 0 {
+		t.Errorf("%d orphans left after reopening", orphans)
+	}
+}
+
+func TestUnlinkOpen(t *testing.T) {
+	b := newFS(t, filepath.Join(t.TempDir(), "db"))
+	writeFile(t, b, "f", "data")
+	f, _ := b.Open("f", os.O_RDWR, 0)
+	b.Unlink("f")
+	f.WriteAt([]byte("D"), 0)
+	fi, err := f.Stat()
+	if err != nil || fi.Sys().(*vfs.Attr).Nlink != 0 || fi.Size() != 4 {
+		t.Fatalf("stat of an unlinked open file: %v, %v", fi, err)
+	}
+	ino := fi.Sys().(*vfs.Attr).Ino
+	f.Close()
+	if err := b.view(func(t *txn) error {
+		if t.inodes.Get(inoKey(ino)) != nil || t.chunks.Get(chunkKey(ino, 0)) != nil {
+			return errors.New("kept")
+		}
+		return nil
+	}); err != nil {
+		t.Error("inode kept after its last open file closed")
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	b := newFS(t, filepath.Join(t.TempDir(), "db"))
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := b.Open("shared", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer f.Close()
+			for range 25 {
+				f.Write([]byte{byte('a' + i)})
+			}
+		}()
+	}
+	wg.Wait()
+	if got := len(readFile(t, b, "shared")); got != 100 {
+		t.Errorf("expected 100 bytes, got %d", got)
+	}
+}
@@ -0,0 +1,325 @@
+package boltfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// file is an open handle on an inode. Each read and write is a
+// transaction of its own. An open file keeps its inode in the database
+// after it is unlinked, until it is closed.
+type file struct {
+	fs   *FS
+	ino  uint64
+	dir  bool
+	name string
+	flag int
+
+	mu     sync.Mutex
+	off    int64
+	closed bool
+}
+
+// newFile returns a file for n, counting n as open.
+func newFile(f *FS, n *inode, name string, flag int) *file {
+	f.mu.Lock()
+	f.open[n.ino]++
+	f.mu.Unlock()
+	return &file{fs: f, ino: n.ino, dir: n.mode.IsDir(), name: name, flag: flag}
+}
+
+// check validates f for an operation; f.mu must be held.
+func (f *file) check(op string, write bool) error {
+	if err := vfs.CheckFile(op, f.name, f.flag, f.closed, write); err != nil {
+		return err
+	}
+	if f.dir {
+		return pathErr(op, f.name, syscall.EISDIR)
+	}
+	return nil
+}
+
+// readAt reads from the chunks of the file, with zeros for those a sparse
+// file lacks.
+func (f *file) readAt(b []byte, off int64) (int, error) {
+	var n int
+	err := f.fs.view(func(t *txn) error {
+		node, err := t.get(f.ino)
+		if err != nil {
+			return err
+		}
+		if off >= node.size {
+			return nil
+		}
+		b = b[:min(int64(len(b)), node.size-off)]
+		for n < len(b) {
+			pos := off + int64(n)
+			chunk := t.chunks.Get(chunkKey(f.ino, pos/chunkSize))
+			within := pos % chunkSize
+			want := min(len(b)-n, int(chunkSize-within))
+			got := 0
+			if within < int64(len(chunk)) {
+				got = copy(b[n:n+want], chunk[within:])
+			}
+			clear(b[n+got : n+want])
+			n += want
+		}
+		return nil
+	})
+	if err != nil {
+		return n, pathErr("read", f.name, err)
+	}
+	return n, nil
+}
+
+// writeAt writes b at off, or at the end of the file if appending, and
+// returns the offset written at.
+func (f *file) writeAt(b []byte, off int64, appending bool) (int64, error) {
+	err := f.fs.update(func(t *txn) error {
+		node, err := t.get(f.ino)
+		if err != nil {
+			return err
+		}
+		if appending {
+			off = node.size
+		}
+		for n := 0; n < len(b); {
+			pos := off + int64(n)
+			k := chunkKey(f.ino, pos/chunkSize)
+			within := int(pos % chunkSize)
+			want := min(len(b)-n, chunkSize-within)
+			// Values the database returns are only good for the
+			// transaction and are not to be changed, so the chunk is
+			// copied.
+			old := t.chunks.Get(k)
+			chunk := make([]byte, max(len(old), within+want))
+			copy(chunk, old)
+			copy(chunk[within:], b[n:n+want])
+			if err := t.chunks.Put(k, chunk); err != nil {
+				return err
+			}
+			n += want
+		}
+		node.size = max(node.size, off+int64(len(b)))
+		now := f.fs.now()
+		node.mtime, node.ctime = now, now
+		return t.put(node)
+	})
+	if err != nil {
+		return off, pathErr("write", f.name, err)
+	}
+	return off, nil
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	n, err := f.readAt(b, f.off)
+	f.off += int64(n)
+	if err == nil && n == 0 && len(b) > 0 {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	err := f.check("read", false)
+	f.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, pathErr("read", f.name, syscall.EINVAL)
+	}
+	n, err := f.readAt(b, off)
+	if err == nil && n < len(b) {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+func (f *file) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	off, err := f.writeAt(b, f.off, f.flag&os.O_APPEND != 0)
+	if err != nil {
+		return 0, err
+	}
+	f.off = off + int64(len(b))
+	return len(b), nil
+}
+
+func (f *file) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	err := f.check("write", true)
+	f.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, pathErr("write", f.name, syscall.EINVAL)
+	}
+	if _, err := f.writeAt(b, off, false); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// resize runs fn on the inode of f in a transaction of its own, for
+// Truncate and PunchHole.
+func (f *file) resize(op string, fn func(t *txn, n *inode) error) error {
+	f.mu.Lock()
+	err := f.check(op, true)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = f.fs.update(func(t *txn) error {
+		n, err := t.get(f.ino)
+		if err != nil {
+			return err
+		}
+		if err := fn(t, n); err != nil {
+			return err
+		}
+		now := f.fs.now()
+		n.mtime, n.ctime = now, now
+		return t.put(n)
+	})
+	if err != nil {
+		return pathErr(op, f.name, err)
+	}
+	return nil
+}
+
+// Truncate changes the size of the file. Growing it adds a hole, which
+// takes no chunks.
+func (f *file) Truncate(size int64) error {
+	if size < 0 {
+		return pathErr("truncate", f.name, syscall.EINVAL)
+	}
+	return f.resize("truncate", func(t *txn, n *inode) error {
+		if size < n.size {
+			if err := t.zeroChunks(f.ino, size, n.size); err != nil {
+				return err
+			}
+		}
+		n.size = size
+		return nil
+	})
+}
+
+// PunchHole deletes the chunks inside the range and zeroes the parts of
+// those it only partly covers.
+func (f *file) PunchHole(off, n int64) error {
+	if off < 0 || n <= 0 {
+		return pathErr("fallocate", f.name, syscall.EINVAL)
+	}
+	return f.resize("fallocate", func(t *txn, node *inode) error {
+		return t.zeroChunks(f.ino, off, min(off+n, node.size))
+	})
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		fi, err := f.stat()
+		if err != nil {
+			return 0, pathErr("seek", f.name, err)
+		}
+		offset += fi.size
+	default:
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	if offset < 0 {
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) stat() (*fileInfo, error) {
+	var fi *fileInfo
+	err := f.fs.view(func(t *txn) error {
+		n, err := t.get(f.ino)
+		if err != nil {
+			return err
+		}
+		fi = n.info(f.name)
+		return nil
+	})
+	return fi, err
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	fi, err := f.stat()
+	if err != nil {
+		return nil, pathErr("stat", f.name, err)
+	}
+	return fi, nil
+}
+
+// Close releases the inode, removing it if it was the last open file of
+// an inode already unlinked.
+func (f *file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	f.fs.mu.Lock()
+	f.fs.open[f.ino]--
+	last := f.fs.open[f.ino] == 0
+	if last {
+		delete(f.fs.open, f.ino)
+	}
+	f.fs.mu.Unlock()
+	if !last {
+		return nil
+	}
+	var orphan bool
+	err := f.fs.view(func(t *txn) error {
+		n, err := t.get(f.ino)
+		orphan = err == nil && n.nlink == 0
+		return err
+	})
+	if err == nil && orphan {
+		err = f.fs.removing(func(t *txn) error {
+			n, err := t.get(f.ino)
+			if err != nil {
+				return err
+			}
+			return t.release(n)
+		})
+	}
+	if err != nil {
+		return pathErr("close", f.name, err)
+	}
+	return nil
+}
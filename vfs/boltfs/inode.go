@@ -0,0 +1,83 @@
+package boltfs
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// inode is the record of a file. It is a copy of what the database holds,
+// stored back with txn.put.
+type inode struct {
+	ino    uint64
+	mode   fs.FileMode
+	nlink  uint64
+	size   int64  // regular files and symlinks
+	parent uint64 // directories
+	target string // symlinks
+
+	atime, mtime, ctime time.Time
+}
+
+// recordSize is the size of an encoded inode, less the symlink target that
+// ends it.
+const recordSize = 4 + 8 + 8 + 8 + 3*8
+
+func (n *inode) encode() []byte {
+	b := make([]byte, 0, recordSize+len(n.target))
+	b = binary.BigEndian.AppendUint32(b, uint32(n.mode))
+	b = binary.BigEndian.AppendUint64(b, n.nlink)
+	b = binary.BigEndian.AppendUint64(b, uint64(n.size))
+	b = binary.BigEndian.AppendUint64(b, n.parent)
+	for _, t := range []time.Time{n.atime, n.mtime, n.ctime} {
+		b = binary.BigEndian.AppendUint64(b, uint64(t.UnixNano()))
+	}
+	return append(b, n.target...)
+}
+
+func decodeInode(ino uint64, b []byte) (*inode, error) {
+	if len(b) < recordSize {
+		return nil, syscall.EIO
+	}
+	n := &inode{
+		ino:    ino,
+		mode:   fs.FileMode(binary.BigEndian.Uint32(b)),
+		nlink:  binary.BigEndian.Uint64(b[4:]),
+		size:   int64(binary.BigEndian.Uint64(b[12:])),
+		parent: binary.BigEndian.Uint64(b[20:]),
+		target: string(b[recordSize:]),
+	}
+	for i, t := range []*time.Time{&n.atime, &n.mtime, &n.ctime} {
+		*t = time.Unix(0, int64(binary.BigEndian.Uint64(b[28+8*i:])))
+	}
+	return n, nil
+}
+
+// fileInfo is a snapshot of an inode's metadata.
+type fileInfo struct {
+	name  string
+	size  int64
+	mode  fs.FileMode
+	mtime time.Time
+	attr  vfs.Attr
+}
+
+func (n *inode) info(name string) *fileInfo {
+	return &fileInfo{
+		name:  name,
+		size:  n.size,
+		mode:  n.mode,
+		mtime: n.mtime,
+		attr:  vfs.Attr{Ino: n.ino, Nlink: n.nlink, Atime: n.atime, Ctime: n.ctime},
+	}
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() any           { return &fi.attr }
@@ -0,0 +1,38 @@
+package boltfs_test
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs/boltfs"
+)
+
+// TestTracer runs two commands on one database, the second finding what
+// the first left.
+func TestTracer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	for _, run := range []struct{ script, want string }{
+		{`mkdir /db/out && echo first run >/db/out/log`, ""},
+		{`echo second run >>/db/out/log && cat /db/out/log && ls /db`, "first run\nsecond run\nout\n"},
+	} {
+		b, err := boltfs.New(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stdout bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", run.script)
+		cmd.Stdout = &stdout
+		err = tracer.New(cmd, tracer.WithMount("/db", b)).Run(context.Background())
+		b.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stdout.String(); got != run.want {
+			t.Errorf("%s: got %q, want %q", run.script, got, run.want)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+// Package cache implements a vfs.Backend that keeps the contents of the
+// regular files of another backend in memory or on local disk, so that
+// reads of a remote backend such as a remote.Client, an s3.FS or a p9.FS
+// make a round trip only the first time.
+//
+// Contents are cached in blocks, each read from the backend whole. Writes
+// go to the cache and reach the backend when the file written is closed,
+// or sooner once the blocks written and not yet written back fill the
+// cache. Clean blocks past the size LRU gives are evicted least recently
+// used first; Stats reports how often reads were served from the cache.
+//
+// The cache checks what it holds the way NFS does, on open: if the size or
+// modification time the backend gives a file is not what they were when
+// its blocks were cached or last written back, the blocks are dropped.
+// Changes made to the backend by others are therefore seen by files opened
+// after them, but not by files already open. Writes not yet written back
+// show through Stat and in reads of the same file, but not in the backend.
+//
+// Directories and other files that are not regular are not cached, and
+// all other operations go straight to the backend. All methods, and the
+// methods of the files an FS opens, are safe for concurrent use.
+package cache
+
+import (
+	"container/list"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// blockSize is the unit in which files are read and cached.
+const blockSize = 64 << 10
+
+// Option configures an FS.
+type Option func(*FS)
+
+// LRU holds up to size bytes of file contents in the cache, evicting the
+// least recently read blocks past it. The default is 64 MiB.
+func LRU(size int64) Option {
+	return func(c *FS) {
+		if size > 0 {
+			c.size = size
+		}
+	}
+}
+
+// Disk keeps the cached blocks in files in the directory dir rather than
+// in memory, so that the cache can be larger than memory would allow. The
+// directory must exist. Files are removed as their blocks are evicted, but
+// those left when the FS is no longer used are for the caller to remove.
+func Disk(dir string) Option {
+	return func(c *FS) { c.dir = dir }
+}
+
+// Stats counts what a cache has done.
+type Stats struct {
+	// Hits and Misses count the blocks read from the cache and from the
+	// backend.
+	Hits, Misses uint64
+	// Evictions counts the blocks dropped to make room for others.
+	Evictions uint64
+	// WriteBacks counts the blocks written to the backend.
+	WriteBacks uint64
+	// Bytes is the size of the blocks held now, Dirty that of the ones
+	// not yet written back.
+	Bytes, Dirty int64
+}
+
+// HitRate returns the fraction of the blocks read that came from the
+// cache, or 0 if none have been read.
+func (s Stats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// FS caches the contents of the files of a backend.
+type FS struct {
+	b    vfs.Backend
+	size int64
+	dir  string
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	lru     *list.List // of clean *block, the most recently read at the front
+	nextID  uint64     // of the next file of a block kept on disk
+	stats   Stats
+}
+
+var (
+	_ vfs.Backend  = (*FS)(nil)
+	_ vfs.Xattrer  = (*FS)(nil)
+	_ vfs.StatFSer = (*FS)(nil)
+	_ vfs.Socketer = (*FS)(nil)
+)
+
+// New returns an FS caching the files of b.
+func New(b vfs.Backend, opts ...Option) *FS {
+	c := &FS{b: b, size: 64 << 20, entries: make(map[string]*entry), lru: list.New()}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Stats returns the counts of what c has done so far.
+func (c *FS) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// entry is the cached state of a regular file of the backend. Its fields
+// other than mu are guarded by FS.mu.
+type entry struct {
+	// mu serializes reads and writes of the file, so that blocks fetched
+	// and written back do not cross writes.
+	mu   sync.Mutex
+	name string
+	// size is the size of the file with the writes not yet written back,
+	// and bsize and mtime what the backend gave when the blocks were
+	// last known to match it.
+	size   int64
+	bsize  int64
+	mtime  time.Time
+	blocks map[int64]*block
+	dirty  int // blocks not yet written back
+	open   int // files open on the entry
+}
+
+// block is a blockSize piece of a file, or the last piece of it.
+type block struct {
+	e    *entry
+	n    int64
+	len  int
+	data []byte        // in memory, or nil with Disk
+	id   uint64        // the file it is kept in with Disk
+	elem *list.Element // in FS.lru, or nil if dirty
+}
+
+func pathErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// path returns the name of the file a block is kept in with Disk.
+func (c *FS) path(b *block) string {
+	return filepath.Join(c.dir, strconv.FormatUint(b.id, 10))
+}
+
+// load returns the contents of b; c.mu must be held.
+func (c *FS) load(b *block) ([]byte, error) {
+	if c.dir == "" {
+		return b.data, nil
+	}
+	return os.ReadFile(c.path(b))
+}
+
+// put caches data as block n of e, clean or dirty, replacing what e held
+// there; c.mu must be held.
+func (c *FS) put(e *entry, n int64, data []byte, dirty bool) error {
+	b := e.blocks[n]
+	if b == nil {
+		b = &block{e: e, n: n}
+		if c.dir != "" {
+			c.nextID++
+			b.id = c.nextID
+		}
+		e.blocks[n] = b
+	} else {
+		c.unlist(b)
+		c.stats.Bytes -= int64(b.len)
+	}
+	if c.dir == "" {
+		b.data = data
+	} else if err := os.WriteFile(c.path(b), data, 0o600); err != nil {
+		delete(e.blocks, n)
+		return err
+	}
+	b.len = len(data)
+	c.stats.Bytes += int64(b.len)
+	if dirty {
+		e.dirty++
+		c.stats.Dirty += int64(b.len)
+	} else {
+		b.elem = c.lru.PushFront(b)
+	}
+	c.evict()
+	return nil
+}
+
+// unlist takes b off the LRU list, or out of the dirty count; c.mu must
+// be held.
+func (c *FS) unlist(b *block) {
+	if b.elem != nil {
+		c.lru.Remove(b.elem)
+		b.elem = nil
+	} else {
+		b.e.dirty--
+		c.stats.Dirty -= int64(b.len)
+	}
+}
+
+// clean marks the dirty block b written back; c.mu must be held.
+func (c *FS) clean(b *block) {
+	c.unlist(b)
+	b.elem = c.lru.PushFront(b)
+	c.stats.WriteBacks++
+}
+
+// free drops b from the cache; c.mu must be held.
+func (c *FS) free(b *block) {
+	c.unlist(b)
+	c.stats.Bytes -= int64(b.len)
+	delete(b.e.blocks, b.n)
+	if c.dir != "" {
+		os.Remove(c.path(b))
+	}
+}
+
+// drop drops all the blocks of e; c.mu must be held.
+func (c *FS) drop(e *entry) {
+	for _, b := range e.blocks {
+		c.free(b)
+	}
+}
+
+// evict drops the least recently read clean blocks past the cache size;
+// c.mu must be held.
+func (c *FS) evict() {
+	for c.stats.Bytes > c.size && c.lru.Len() > 0 {
+		b := c.lru.Back().Value.(*block)
+		c.free(b)
+		c.stats.Evictions++
+		if len(b.e.blocks) == 0 && b.e.open == 0 && c.entries[b.e.name] == b.e {
+			delete(c.entries, b.e.name)
+		}
+	}
+}
+
+// forget drops the entries of name and of everything under it, which no
+// longer name what they did; c.mu must be held. The blocks of entries
+// still open stay until these are closed.
+func (c *FS) forget(name string) {
+	for n, e := range c.entries {
+		if n == name || strings.HasPrefix(n, name+"/") {
+			delete(c.entries, n)
+			if e.open == 0 {
+				c.drop(e)
+			}
+		}
+	}
+}
+
+func (c *FS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	// Files append through the cache, since one opened with O_APPEND
+	// cannot be written at an offset, as writing back does.
+	f, err := c.b.Open(name, flag&^os.O_APPEND, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return f, nil
+	}
+	c.mu.Lock()
+	e := c.entries[name]
+	switch {
+	case e == nil:
+		e = &entry{name: name, blocks: make(map[int64]*block)}
+		c.entries[name] = e
+		e.size = fi.Size()
+	case flag&os.O_TRUNC != 0:
+		c.drop(e)
+		e.size = fi.Size()
+	case e.dirty == 0 && (fi.Size() != e.bsize || !fi.ModTime().Equal(e.mtime)):
+		c.drop(e)
+		e.size = fi.Size()
+	}
+	if e.dirty == 0 {
+		e.bsize, e.mtime = fi.Size(), fi.ModTime()
+	}
+	e.open++
+	c.mu.Unlock()
+	return &file{fs: c, e: e, f: f, name: name, flag: flag}, nil
+}
+
+func (c *FS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := c.b.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.pending(name, fi), nil
+}
+
+func (c *FS) Lstat(name string) (fs.FileInfo, error) {
+	fi, err := c.b.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.pending(name, fi), nil
+}
+
+// pending returns fi, with the size writes to name not yet written back
+// give it.
+func (c *FS) pending(name string, fi fs.FileInfo) fs.FileInfo {
+	if !fi.Mode().IsRegular() {
+		return fi
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.entries[name]; e != nil && e.dirty > 0 {
+		return sizedInfo{fi, e.size}
+	}
+	return fi
+}
+
+// sizedInfo is a FileInfo with the size of the file changed.
+type sizedInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (fi sizedInfo) Size() int64 { return fi.size }
+
+func (c *FS) ReadDir(name string) ([]fs.DirEntry, error) { return c.b.ReadDir(name) }
+
+func (c *FS) Mkdir(name string, perm fs.FileMode) error { return c.b.Mkdir(name, perm) }
+
+func (c *FS) Unlink(name string) error {
+	err := c.b.Unlink(name)
+	c.mu.Lock()
+	c.forget(name)
+	c.mu.Unlock()
+	return err
+}
+
+func (c *FS) Rmdir(name string) error {
+	err := c.b.Rmdir(name)
+	c.mu.Lock()
+	c.forget(name)
+	c.mu.Unlock()
+	return err
+}
+
+func (c *FS) Rename(oldname, newname string) error {
+	err := c.b.Rename(oldname, newname)
+	c.mu.Lock()
+	c.forget(oldname)
+	c.forget(newname)
+	c.mu.Unlock()
+	return err
+}
+
+func (c *FS) Link(oldname, newname string) error { return c.b.Link(oldname, newname) }
+
+func (c *FS) Symlink(target, newname string) error { return c.b.Symlink(target, newname) }
+
+func (c *FS) Readlink(name string) (string, error) { return c.b.Readlink(name) }
+
+func (c *FS) Chmod(name string, mode fs.FileMode) error { return c.b.Chmod(name, mode) }
+
+func (c *FS) Chtimes(name string, atime, mtime time.Time) error {
+	return c.b.Chtimes(name, atime, mtime)
+}
+
+func (c *FS) Getxattr(name, attr string) ([]byte, error) {
+	return vfs.Getxattr(c.b, name, attr)
+}
+
+func (c *FS) Setxattr(name, attr string, value []byte, flags int) error {
+	return vfs.Setxattr(c.b, name, attr, value, flags)
+}
+
+func (c *FS) Listxattr(name string) ([]string, error) { return vfs.Listxattr(c.b, name) }
+
+func (c *FS) Removexattr(name, attr string) error {
+	return vfs.Removexattr(c.b, name, attr)
+}
+
+func (c *FS) StatFS(name string) (vfs.FSStat, error) {
+	return vfs.StatFS(c.b, name)
+}
+
+// SocketPath returns the backend's host path for name. Sockets hold no
+// data for the cache to keep.
+func (c *FS) SocketPath(name string) (string, error) {
+	return vfs.SocketPath(c.b, name)
+}
+
+// errno returns the errno inside err, or EIO.
+func errno(err error) error {
+	if pe, ok := err.(*fs.PathError); ok {
+		err = pe.Err
+	}
+	if _, ok := err.(syscall.Errno); ok {
+		return err
+	}
+	return syscall.EIO
+}
@@ -0,0 +1,331 @@
+package cache_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/cache"
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+)
+
+// counting is a backend that counts the reads and writes that reach the
+// files it opens.
+type counting struct {
+	vfs.Backend
+	mu            sync.Mutex
+	reads, writes int
+}
+
+func (c *counting) Open(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	f, err := c.Backend.Open(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &countingFile{File: f, c: c}, nil
+}
+
+func (c *counting) counts() (reads, writes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reads, c.writes
+}
+
+type countingFile struct {
+	vfs.File
+	c *counting
+}
+
+func (f *countingFile) ReadAt(b []byte, off int64) (int, error) {
+	f.c.mu.Lock()
+	f.c.reads++
+	f.c.mu.Unlock()
+	return f.File.ReadAt(b, off)
+}
+
+func (f *countingFile) WriteAt(b []byte, off int64) (int, error) {
+	f.c.mu.Lock()
+	f.c.writes++
+	f.c.mu.Unlock()
+	return f.File.WriteAt(b, off)
+}
+
+func writeFile(t *testing.T, b vfs.Backend, name, data string) {
+	t.Helper()
+	f, err := b.Open(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, b vfs.Backend, name string) string {
+	t.Helper()
+	f, err := b.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRead(t *testing.T) {
+	mem := memfs.New()
+	big := strings.Repeat("0123456789", 20000)
+	writeFile(t, mem, "big", big)
+	back := &counting{Backend: mem}
+	c := cache.New(back)
+
+	if got := readFile(t, c, "big"); got != big {
+		t.Fatalf("read %d bytes", len(got))
+	}
+	reads, _ := back.counts()
+	if reads != 4 {
+		t.Errorf("first read made %d reads of the backend, want one a block", reads)
+	}
+	if got := readFile(t, c, "big"); got != big {
+		t.Fatalf("read %d bytes", len(got))
+	}
+	if again, _ := back.counts(); again != reads {
+		t.Errorf("second read made %d reads of the backend", again-reads)
+	}
+	st := c.Stats()
+	if st.Misses != 4 || st.Hits == 0 || st.HitRate() < 0.5 || st.Bytes != 200000 {
+		t.Errorf("stats %+v, hit rate %v", st, st.HitRate())
+	}
+
+	// A change made behind the cache's back is seen on the next open.
+	writeFile(t, mem, "big", "changed")
+	if got := readFile(t, c, "big"); got != "changed" {
+		t.Errorf("read %q after the backend changed", got)
+	}
+}
+
+func TestWriteBack(t *testing.T) {
+	mem := memfs.New()
+	writeFile(t, mem, "f", strings.Repeat("x", 100000))
+	back := &counting{Backend: mem}
+	c := cache.New(back)
+
+	f, err := c.Open("f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 10 {
+		if _, err := f.WriteAt([]byte("y"), int64(70000+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("end")); err != nil {
+		t.Fatal(err)
+	}
+	if _, writes := back.counts(); writes != 0 {
+		t.Errorf("writes reached the backend before close: %d", writes)
+	}
+	if fi, err := c.Stat("f"); err != nil || fi.Size() != 100003 {
+		t.Errorf("stat before write-back: %v, %v", fi, err)
+	}
+	if fi, _ := mem.Stat("f"); fi.Size() != 100000 {
+		t.Errorf("backend has size %d before write-back", fi.Size())
+	}
+	b := make([]byte, 12)
+	if _, err := f.ReadAt(b, 69999); err != nil || string(b) != "xyyyyyyyyyyx" {
+		t.Errorf("read back %q, %v", b, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, writes := back.counts(); writes != 1 {
+		t.Errorf("close made %d writes, want one for the one block written", writes)
+	}
+	want := strings.Repeat("x", 70000) + strings.Repeat("y", 10) + strings.Repeat("x", 29990) + "end"
+	if got := readFile(t, mem, "f"); got != want {
+		t.Errorf("backend holds %d bytes, not what was written", len(got))
+	}
+	if st := c.Stats(); st.WriteBacks != 1 || st.Dirty != 0 {
+		t.Errorf("stats %+v", st)
+	}
+	// The block written back is still good, so reading the file again
+	// reads only the first block from the backend.
+	reads, _ := back.counts()
+	if got := readFile(t, c, "f"); got != want {
+		t.Errorf("read %d bytes, not what was written", len(got))
+	}
+	if again, _ := back.counts(); again != reads+1 {
+		t.Errorf("read after write-back made %d reads of the backend", again-reads)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	mem := memfs.New()
+	c := cache.New(mem)
+	writeFile(t, c, "log", "one\n")
+	f, err := c.Open("log", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(f, "two\n")
+	io.WriteString(f, "three\n")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, mem, "log"); got != "one\ntwo\nthree\n" {
+		t.Errorf("log holds %q", got)
+	}
+
+	// A file opened only for writing cannot read the rest of a block it
+	// does not have, and writes straight through.
+	writeFile(t, mem, "log", "0123456789")
+	f, err = c.Open("log", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("ab"), 4)
+	f.Close()
+	if got := readFile(t, c, "log"); got != "0123ab6789" {
+		t.Errorf("log holds %q", got)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	for _, disk := range []bool{false, true} {
+		mem := memfs.New()
+		data := strings.Repeat("a", 64<<10) + strings.Repeat("b", 64<<10) + strings.Repeat("c", 64<<10)
+		writeFile(t, mem, "f", data)
+		opts := []cache.Option{cache.LRU(128 << 10)}
+		dir := t.TempDir()
+		if disk {
+			opts = append(opts, cache.Disk(dir))
+		}
+		c := cache.New(mem, opts...)
+		if got := readFile(t, c, "f"); got != data {
+			t.Fatalf("disk %v: read %d bytes", disk, len(got))
+		}
+		st := c.Stats()
+		if st.Evictions != 1 || st.Bytes != 128<<10 {
+			t.Errorf("disk %v: stats %+v", disk, st)
+		}
+		entries, _ := os.ReadDir(dir)
+		if disk && len(entries) != 2 || !disk && len(entries) != 0 {
+			t.Errorf("disk %v: %d files in the directory", disk, len(entries))
+		}
+		// The first block was the one evicted.
+		f, err := c.Open("f", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 1)
+		for _, off := range []int64{128 << 10, 64 << 10, 0} {
+			f.ReadAt(b, off)
+		}
+		f.Close()
+		if got := c.Stats(); got.Hits != st.Hits+2 || got.Misses != st.Misses+1 {
+			t.Errorf("disk %v: %d hits, %d misses", disk, got.Hits-st.Hits, got.Misses-st.Misses)
+		}
+	}
+}
+
+func TestDirtyLimit(t *testing.T) {
+	mem := memfs.New()
+	back := &counting{Backend: mem}
+	c := cache.New(back, cache.LRU(128<<10))
+	f, err := c.Open("big", os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := bytes.Repeat([]byte("z"), 64<<10)
+	for range 5 {
+		f.Write(chunk)
+	}
+	// Three blocks filled the cache and were written back.
+	if _, writes := back.counts(); writes != 3 {
+		t.Errorf("%d writes before close", writes)
+	}
+	f.Close()
+	if fi, _ := mem.Stat("big"); fi.Size() != 5*64<<10 {
+		t.Errorf("backend has size %d", fi.Size())
+	}
+	if st := c.Stats(); st.Bytes > 128<<10 || st.WriteBacks != 5 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestRenameUnlink(t *testing.T) {
+	mem := memfs.New()
+	c := cache.New(mem)
+	writeFile(t, c, "a", "was a")
+	writeFile(t, c, "b", "was b")
+	readFile(t, c, "a")
+	readFile(t, c, "b")
+	if err := c.Rename("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, c, "b"); got != "was a" {
+		t.Errorf("b holds %q after rename", got)
+	}
+	f, err := c.Open("b", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Unlink("b"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, c, "b", "new b")
+	// The file open before the unlink still reads what it opened.
+	if got, _ := io.ReadAll(f); string(got) != "was a" {
+		t.Errorf("unlinked file reads %q", got)
+	}
+	f.Close()
+	if got := readFile(t, c, "b"); got != "new b" {
+		t.Errorf("b holds %q", got)
+	}
+	if st := c.Stats(); st.Bytes != int64(len("new b")) {
+		t.Errorf("%d bytes held after the unlinked file closed", st.Bytes)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	mem := memfs.New()
+	mem.Mkdir("data", 0o755)
+	writeFile(t, mem, "data/hello.txt", "from the backend\n")
+	mem.Chtimes("data/hello.txt", time.Time{}, time.Unix(1e9, 0))
+	c := cache.New(mem)
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `cat /mnt/data/hello.txt /mnt/data/hello.txt
+echo written >/mnt/data/new
+cat /mnt/data/new`)
+	cmd.Stdout = &stdout
+	if err := tracer.New(cmd, tracer.WithMount("/mnt", c)).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := "from the backend\nfrom the backend\nwritten\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := readFile(t, mem, "data/new"); got != "written\n" {
+		t.Errorf("backend holds %q", got)
+	}
+	if st := c.Stats(); st.Hits == 0 {
+		t.Errorf("no reads were served from the cache: %+v", st)
+	}
+}
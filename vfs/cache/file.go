@@ -0,0 +1,403 @@
+package cache
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// file is an open regular file, read and written through the cache of its
+// FS.
+type file struct {
+	fs   *FS
+	e    *entry
+	f    vfs.File // the file of the backend
+	name string
+	flag int
+
+	mu     sync.Mutex
+	off    int64
+	closed bool
+	// wrote is set once the file has written to the backend or the
+	// cache, so that closing it writes back and notes what the backend
+	// then holds.
+	wrote bool
+}
+
+func (f *file) readable() bool { return f.flag&(os.O_WRONLY|os.O_RDWR) != os.O_WRONLY }
+
+// check validates f for an operation; f.mu must be held.
+func (f *file) check(op string, write bool) error {
+	return vfs.CheckFile(op, f.name, f.flag, f.closed, write)
+}
+
+// block returns the contents of block n, from the cache or else from the
+// backend; f.e.mu must be held.
+func (f *file) block(n int64) ([]byte, error) {
+	c := f.fs
+	c.mu.Lock()
+	if b := f.e.blocks[n]; b != nil {
+		if b.elem != nil {
+			c.lru.MoveToFront(b.elem)
+		}
+		c.stats.Hits++
+		data, err := c.load(b)
+		c.mu.Unlock()
+		return data, err
+	}
+	c.stats.Misses++
+	c.mu.Unlock()
+	data := make([]byte, blockSize)
+	m, err := f.f.ReadAt(data, n*blockSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	data = data[:m]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.put(f.e, n, data, false); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readAt reads the file at off.
+func (f *file) readAt(b []byte, off int64) (int, error) {
+	f.e.mu.Lock()
+	defer f.e.mu.Unlock()
+	f.fs.mu.Lock()
+	size := f.e.size
+	f.fs.mu.Unlock()
+	if off >= size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(b)), size)
+	n := int64(0)
+	for off+n < end {
+		pos := off + n
+		data, err := f.block(pos / blockSize)
+		if err != nil {
+			return int(n), pathErr("read", f.name, errno(err))
+		}
+		within := pos % blockSize
+		want := min(end-pos, blockSize-within)
+		got := int64(0)
+		if within < int64(len(data)) {
+			got = int64(copy(b[n:n+want], data[within:]))
+		}
+		// What a block lacks before the end of the file is a hole, or
+		// was written beyond it and not yet written back.
+		clear(b[n+got : n+want])
+		n += want
+	}
+	if n < int64(len(b)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+// writeAt writes b at off, or at the end of the file if appending, and
+// returns the offset written at.
+func (f *file) writeAt(b []byte, off int64, appending bool) (int64, error) {
+	c := f.fs
+	f.e.mu.Lock()
+	defer f.e.mu.Unlock()
+	f.wrote = true
+	c.mu.Lock()
+	size := f.e.size
+	c.mu.Unlock()
+	if appending {
+		off = size
+	}
+	for n := 0; n < len(b); {
+		pos := off + int64(n)
+		i := pos / blockSize
+		within := int(pos % blockSize)
+		want := min(len(b)-n, blockSize-within)
+		// The block is read first unless what is written covers all of
+		// it the file has.
+		var old []byte
+		c.mu.Lock()
+		cached := f.e.blocks[i] != nil
+		c.mu.Unlock()
+		start, have := i*blockSize, min((i+1)*blockSize, size)
+		if cached || start < have && (pos > start || pos+int64(want) < have) {
+			if !cached && !f.readable() {
+				// A file opened only for writing cannot read the rest of
+				// the block, so it writes straight to the backend.
+				if _, err := f.f.WriteAt(b[n:n+want], pos); err != nil {
+					return off, pathErr("write", f.name, errno(err))
+				}
+				size = max(size, pos+int64(want))
+				c.mu.Lock()
+				f.e.size = size
+				c.mu.Unlock()
+				n += want
+				continue
+			}
+			var err error
+			if old, err = f.block(i); err != nil {
+				return off, pathErr("write", f.name, errno(err))
+			}
+		}
+		data := make([]byte, max(len(old), within+want))
+		copy(data, old)
+		copy(data[within:], b[n:n+want])
+		size = max(size, pos+int64(want))
+		c.mu.Lock()
+		err := c.put(f.e, i, data, true)
+		f.e.size = size
+		full := c.stats.Dirty > c.size
+		c.mu.Unlock()
+		if err != nil {
+			return off, pathErr("write", f.name, errno(err))
+		}
+		if full {
+			if err := f.writeBack(); err != nil {
+				return off, pathErr("write", f.name, errno(err))
+			}
+		}
+		n += want
+	}
+	return off, nil
+}
+
+// writeBack writes the dirty blocks of the file to the backend, in order,
+// and notes the size and modification time the backend then gives it;
+// f.e.mu must be held.
+func (f *file) writeBack() error {
+	c := f.fs
+	c.mu.Lock()
+	var dirty []*block
+	for _, b := range f.e.blocks {
+		if b.elem == nil {
+			dirty = append(dirty, b)
+		}
+	}
+	c.mu.Unlock()
+	slices.SortFunc(dirty, func(x, y *block) int { return int(x.n - y.n) })
+	for _, b := range dirty {
+		c.mu.Lock()
+		data, err := c.load(b)
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if _, err := f.f.WriteAt(data, b.n*blockSize); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.clean(b)
+		c.evict()
+		c.mu.Unlock()
+	}
+	fi, err := f.f.Stat()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if f.e.dirty == 0 {
+		f.e.bsize, f.e.mtime = fi.Size(), fi.ModTime()
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, err := f.readAt(b, f.off)
+	f.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	err := f.check("read", false)
+	f.mu.Unlock()
+	switch {
+	case err != nil:
+		return 0, err
+	case off < 0:
+		return 0, pathErr("read", f.name, syscall.EINVAL)
+	case len(b) == 0:
+		return 0, nil
+	}
+	return f.readAt(b, off)
+}
+
+func (f *file) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	off, err := f.writeAt(b, f.off, f.flag&os.O_APPEND != 0)
+	if err != nil {
+		return 0, err
+	}
+	f.off = off + int64(len(b))
+	return len(b), nil
+}
+
+func (f *file) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	err := f.check("write", true)
+	f.mu.Unlock()
+	switch {
+	case err != nil:
+		return 0, err
+	case off < 0:
+		return 0, pathErr("write", f.name, syscall.EINVAL)
+	}
+	if _, err := f.writeAt(b, off, false); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// change writes back what f wrote and applies fn to the file of the
+// backend, dropping the blocks cached for f, which fn may change.
+func (f *file) change(op string, fn func(vfs.File) error) error {
+	f.mu.Lock()
+	err := f.check(op, true)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	c := f.fs
+	f.e.mu.Lock()
+	defer f.e.mu.Unlock()
+	if err := f.writeBack(); err != nil {
+		return pathErr(op, f.name, errno(err))
+	}
+	c.mu.Lock()
+	c.drop(f.e)
+	c.mu.Unlock()
+	if err := fn(f.f); err != nil {
+		return pathErr(op, f.name, errno(err))
+	}
+	fi, err := f.f.Stat()
+	if err != nil {
+		return pathErr(op, f.name, errno(err))
+	}
+	c.mu.Lock()
+	f.e.size, f.e.bsize, f.e.mtime = fi.Size(), fi.Size(), fi.ModTime()
+	c.mu.Unlock()
+	return nil
+}
+
+// Truncate truncates the file of the backend.
+func (f *file) Truncate(size int64) error {
+	return f.change("truncate", func(b vfs.File) error { return vfs.Truncate(b, size) })
+}
+
+// PunchHole punches the hole in the file of the backend.
+func (f *file) PunchHole(off, n int64) error {
+	return f.change("fallocate", func(b vfs.File) error { return vfs.PunchHole(b, off, n) })
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, pathErr("seek", f.name, fs.ErrClosed)
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		f.fs.mu.Lock()
+		offset += f.e.size
+		f.fs.mu.Unlock()
+	default:
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	if offset < 0 {
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, pathErr("stat", f.name, fs.ErrClosed)
+	}
+	fi, err := f.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.e.dirty > 0 {
+		return sizedInfo{fi, f.e.size}, nil
+	}
+	return fi, nil
+}
+
+// Sync writes back what the file wrote and syncs the file of the backend.
+func (f *file) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return pathErr("fsync", f.name, fs.ErrClosed)
+	}
+	if f.wrote {
+		f.e.mu.Lock()
+		err := f.writeBack()
+		f.e.mu.Unlock()
+		if err != nil {
+			return pathErr("fsync", f.name, errno(err))
+		}
+	}
+	return vfs.Sync(f.f)
+}
+
+// Close writes back what the file wrote and closes the file of the
+// backend. The blocks of a file no longer named by what it was opened as
+// are dropped once its last file is closed.
+func (f *file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return pathErr("close", f.name, fs.ErrClosed)
+	}
+	f.closed = true
+	var err error
+	if f.wrote {
+		f.e.mu.Lock()
+		if err = f.writeBack(); err != nil {
+			err = pathErr("close", f.name, errno(err))
+		}
+		f.e.mu.Unlock()
+	}
+	if cerr := f.f.Close(); err == nil {
+		err = cerr
+	}
+	c := f.fs
+	c.mu.Lock()
+	f.e.open--
+	if f.e.open == 0 && c.entries[f.e.name] != f.e {
+		c.drop(f.e)
+	}
+	c.mu.Unlock()
+	return err
+}
@@ -0,0 +1,416 @@
+// Package cas implements a read-only vfs.Backend over a tree kept in a
+// content-addressed store, in the layout of the Bazel Remote Execution
+// API: every file is a blob named by the SHA-256 digest of its contents,
+// and every directory is a blob holding a build.bazel.remote.execution.v2
+// Directory message, which names the digests of its files, symlinks and
+// subdirectories. The FS is given the digest of the root directory.
+//
+// Nothing is fetched until it is needed. A directory is fetched when a
+// lookup first passes through it, and kept; a file is fetched when it is
+// first read, not when it is opened or statted, into Config.Cache if it is
+// set and a temporary file otherwise. Every blob is checked against its
+// digest as it is fetched, and one that does not match fails the read
+// with EIO, so a corrupt or truncated store cannot hand the command wrong
+// contents. Blobs already in Config.Cache are trusted.
+//
+// Files have mode 0444, or 0555 if they are executable, and directories
+// 0555, unless the tree records a mode for them. Absolute symlink targets
+// are resolved against the root of the FS. Operations that would change
+// the tree fail with EROFS. All methods, and the methods of the files an
+// FS opens, are safe for concurrent use.
+package cas
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// Digest names a blob by the SHA-256 of its contents, in lowercase hex,
+// and its size.
+type Digest struct {
+	Hash string
+	Size int64
+}
+
+// DigestOf returns the digest of b.
+func DigestOf(b []byte) Digest {
+	sum := sha256.Sum256(b)
+	return Digest{Hash: hex.EncodeToString(sum[:]), Size: int64(len(b))}
+}
+
+// ParseDigest parses a digest in the form String returns.
+func ParseDigest(s string) (Digest, error) {
+	hash, size, ok := strings.Cut(s, "/")
+	n, err := strconv.ParseInt(size, 10, 64)
+	if !ok || err != nil || n < 0 || !validHash(hash) {
+		return Digest{}, fmt.Errorf("cas: bad digest %q", s)
+	}
+	return Digest{Hash: hash, Size: n}, nil
+}
+
+// String returns the digest as "hash/size", as REAPI resource names have
+// it.
+func (d Digest) String() string { return d.Hash + "/" + strconv.FormatInt(d.Size, 10) }
+
+func validHash(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !('0' <= s[i] && s[i] <= '9' || 'a' <= s[i] && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// emptyDigest is the digest of no bytes, which stores need not hold.
+var emptyDigest = DigestOf(nil)
+
+// Store is a content-addressed store of blobs.
+type Store interface {
+	// Get returns the contents of the blob with digest d. The FS checks
+	// them against d, so the store need not.
+	Get(d Digest) (io.ReadCloser, error)
+}
+
+// Dir is a Store kept in a host directory in the layout of Bazel's
+// --disk_cache, each blob in the file cas/HH/HASH, where HH are the first
+// two characters of its hash.
+type Dir string
+
+// blob returns the file the blob with digest d is kept in.
+func (d Dir) blob(dg Digest) string {
+	return filepath.Join(string(d), "cas", dg.Hash[:2], dg.Hash)
+}
+
+func (d Dir) Get(dg Digest) (io.ReadCloser, error) {
+	return os.Open(d.blob(dg))
+}
+
+// HTTP is a Store served over the HTTP protocol of Bazel's remote cache,
+// which has each blob at URL/cas/HASH, as bazel-remote and other caches
+// serve it.
+type HTTP struct {
+	URL string
+	// Header is added to every request, to carry credentials for one.
+	Header http.Header
+	// Client makes the requests. The default is http.DefaultClient.
+	Client *http.Client
+}
+
+func (h *HTTP) Get(d Digest) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(h.URL, "/")+"/cas/"+d.Hash, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range h.Header {
+		req.Header[k] = vs
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%s: %w", req.URL, fs.ErrNotExist)
+		}
+		return nil, fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Config describes a tree in a store.
+type Config struct {
+	// Store holds the blobs of the tree.
+	Store Store
+	// Root is the digest of the Directory message of the root.
+	Root Digest
+	// Cache, if set, is a directory that keeps the files fetched, in the
+	// layout of a Dir, so that they are fetched once. It can be shared by
+	// FSes, and by Bazel as its disk cache.
+	Cache string
+	// TempDir holds the files fetched without a Cache. The default is
+	// os.TempDir().
+	TempDir string
+}
+
+// FS is a tree in a content-addressed store, seen as a read-only
+// filesystem.
+type FS struct {
+	vfs.ReadOnly
+
+	cfg  Config
+	root *node
+
+	mu   sync.Mutex
+	dirs map[Digest]*directory
+}
+
+var _ vfs.Backend = (*FS)(nil)
+
+// New returns an FS for the tree cfg describes. It fetches the root
+// directory, so that a tree the store does not have fails here.
+func New(cfg Config) (*FS, error) {
+	if cfg.Store == nil {
+		return nil, fmt.Errorf("cas: no store")
+	}
+	if !validHash(cfg.Root.Hash) {
+		return nil, fmt.Errorf("cas: bad root digest %v", cfg.Root)
+	}
+	c := &FS{cfg: cfg, dirs: make(map[Digest]*directory)}
+	if _, err := c.directory(cfg.Root); err != nil {
+		return nil, err
+	}
+	c.root = &node{name: ".", mode: fs.ModeDir | 0o555, digest: cfg.Root}
+	c.ReadOnly = func(op, name string) error {
+		_, err := c.walk(op, name, false)
+		return err
+	}
+	return c, nil
+}
+
+func pathErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// fetch copies the blob with digest d to w, failing unless its contents
+// match d.
+func (c *FS) fetch(d Digest, w io.Writer) error {
+	if d == emptyDigest {
+		return nil
+	}
+	r, err := c.cfg.Store.Get(d)
+	if err != nil {
+		return fmt.Errorf("cas: blob %v: %v", d, err)
+	}
+	defer r.Close()
+	h := sha256.New()
+	// Read one byte past the size, to tell a blob that is too long.
+	n, err := io.Copy(io.MultiWriter(w, h), io.LimitReader(r, d.Size+1))
+	if err != nil {
+		return fmt.Errorf("cas: blob %v: %v", d, err)
+	}
+	if n != d.Size || hex.EncodeToString(h.Sum(nil)) != d.Hash {
+		return fmt.Errorf("cas: blob %v does not match its digest", d)
+	}
+	return nil
+}
+
+// directory returns the directory with digest d, fetching it the first
+// time.
+func (c *FS) directory(d Digest) (*directory, error) {
+	c.mu.Lock()
+	dir, ok := c.dirs[d]
+	c.mu.Unlock()
+	if ok {
+		return dir, nil
+	}
+	var b bytes.Buffer
+	if err := c.fetch(d, &b); err != nil {
+		return nil, err
+	}
+	dir, err := parseDirectory(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("cas: directory %v: %v", d, err)
+	}
+	c.mu.Lock()
+	c.dirs[d] = dir
+	c.mu.Unlock()
+	return dir, nil
+}
+
+// walk resolves name to a node. Symlinks in intermediate components are
+// always followed; a final symlink is followed only if follow is set.
+func (c *FS) walk(op, name string, follow bool) (*node, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathErr(op, name, syscall.EINVAL)
+	}
+	n, err := vfs.Walk(name, c.root, follow, func(cur *node, comp string, _ bool) (*node, fs.FileMode, string, error) {
+		dir, err := c.directory(cur.digest)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		child, ok := dir.nodes[comp]
+		if !ok {
+			return nil, 0, "", syscall.ENOENT
+		}
+		return child, child.mode, child.target, nil
+	})
+	if err != nil {
+		return nil, pathErr(op, name, err)
+	}
+	return n, nil
+}
+
+func (c *FS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	n, err := c.walk("open", name, false)
+	switch {
+	case err != nil:
+		if flag&os.O_CREATE != 0 && errorIs(err, syscall.ENOENT) {
+			return nil, pathErr("open", name, syscall.EROFS)
+		}
+		return nil, err
+	case n.mode&fs.ModeSymlink != 0 && flag&syscall.O_NOFOLLOW != 0:
+		return nil, pathErr("open", name, syscall.ELOOP)
+	case n.mode&fs.ModeSymlink != 0:
+		if n, err = c.walk("open", name, true); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathErr("open", name, syscall.EEXIST)
+	case n.mode.IsDir() && (flag&(os.O_WRONLY|os.O_RDWR) != 0 || flag&os.O_CREATE != 0):
+		return nil, pathErr("open", name, syscall.EISDIR)
+	case flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0:
+		return nil, pathErr("open", name, syscall.EROFS)
+	case n.mode.IsDir():
+		fi, err := c.stat("open", name, n)
+		if err != nil {
+			return nil, err
+		}
+		return &vfs.DirFile{Info: fi}, nil
+	case flag&syscall.O_DIRECTORY != 0:
+		return nil, pathErr("open", name, syscall.ENOTDIR)
+	}
+	return &file{fs: c, node: n, name: name}, nil
+}
+
+func errorIs(err error, errno syscall.Errno) bool {
+	pe, ok := err.(*fs.PathError)
+	return ok && pe.Err == errno
+}
+
+// materialize returns a local file holding the contents of the file n,
+// fetching them unless the cache has them.
+func (c *FS) materialize(n *node) (*os.File, error) {
+	if c.cfg.Cache != "" {
+		if f, err := os.Open(Dir(c.cfg.Cache).blob(n.digest)); err == nil {
+			return f, nil
+		}
+	}
+	tmpDir := c.cfg.TempDir
+	if c.cfg.Cache != "" {
+		tmpDir = filepath.Dir(Dir(c.cfg.Cache).blob(n.digest))
+		if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.CreateTemp(tmpDir, "cas-")
+	if err != nil {
+		return nil, err
+	}
+	if err := c.fetch(n.digest, f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if c.cfg.Cache != "" {
+		// Renamed rather than written in place, so that a blob in the
+		// cache is whole.
+		err = os.Rename(f.Name(), Dir(c.cfg.Cache).blob(n.digest))
+	} else {
+		err = os.Remove(f.Name())
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// stat returns the information for the node n at name, which for a
+// directory comes from its Directory message.
+func (c *FS) stat(op, name string, n *node) (*info, error) {
+	fi := n.info()
+	if n.mode.IsDir() {
+		dir, err := c.directory(n.digest)
+		if err != nil {
+			return nil, pathErr(op, name, err)
+		}
+		dir.props.apply(&fi.mode, &fi.mtime)
+	}
+	return fi, nil
+}
+
+func (c *FS) Stat(name string) (fs.FileInfo, error) {
+	n, err := c.walk("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return c.stat("stat", name, n)
+}
+
+func (c *FS) Lstat(name string) (fs.FileInfo, error) {
+	n, err := c.walk("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return c.stat("lstat", name, n)
+}
+
+func (c *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := c.walk("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !n.mode.IsDir() {
+		return nil, pathErr("readdir", name, syscall.ENOTDIR)
+	}
+	dir, err := c.directory(n.digest)
+	if err != nil {
+		return nil, pathErr("readdir", name, err)
+	}
+	entries := make([]fs.DirEntry, 0, len(dir.nodes))
+	for _, child := range dir.nodes {
+		entries = append(entries, &dirEntry{fs: c, name: path.Join(name, child.name), node: child})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// dirEntry is an entry of a directory, whose information for a
+// subdirectory takes fetching it to get.
+type dirEntry struct {
+	fs   *FS
+	name string
+	node *node
+}
+
+func (e *dirEntry) Name() string      { return e.node.name }
+func (e *dirEntry) IsDir() bool       { return e.node.mode.IsDir() }
+func (e *dirEntry) Type() fs.FileMode { return e.node.mode.Type() }
+
+func (e *dirEntry) Info() (fs.FileInfo, error) { return e.fs.stat("readdir", e.name, e.node) }
+
+func (c *FS) Readlink(name string) (string, error) {
+	n, err := c.walk("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if n.mode&fs.ModeSymlink == 0 {
+		return "", pathErr("readlink", name, syscall.EINVAL)
+	}
+	return n.target, nil
+}
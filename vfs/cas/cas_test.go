@@ -0,0 +1,323 @@
+package cas
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+)
+
+// A tree describes a directory to encode: a string is a file, exe an
+// executable file, link a symlink and tree a subdirectory.
+type (
+	tree map[string]any
+	exe  string
+	link string
+)
+
+// memStore is a Store in memory, counting the blobs fetched from it.
+type memStore struct {
+	mu    sync.Mutex
+	blobs map[Digest][]byte
+	gets  map[Digest]int
+}
+
+func (s *memStore) Get(d Digest) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.blobs[d]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	s.gets[d]++
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *memStore) count(d Digest) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets[d]
+}
+
+func (s *memStore) put(b []byte) Digest {
+	d := DigestOf(b)
+	s.blobs[d] = b
+	return d
+}
+
+// encode stores t and returns the digest of its Directory message.
+func (s *memStore) encode(t tree) Digest {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var msg []byte
+	for _, name := range names {
+		var node []byte
+		node = protowire.AppendTag(node, nodeName, protowire.BytesType)
+		node = protowire.AppendString(node, name)
+		field := protowire.Number(directoryFiles)
+		switch v := t[name].(type) {
+		case string:
+			node = appendDigest(node, s.put([]byte(v)))
+		case exe:
+			node = appendDigest(node, s.put([]byte(v)))
+			node = protowire.AppendTag(node, fileIsExecutable, protowire.VarintType)
+			node = protowire.AppendVarint(node, 1)
+		case link:
+			field = directorySymlinks
+			node = protowire.AppendTag(node, symlinkTarget, protowire.BytesType)
+			node = protowire.AppendString(node, string(v))
+		case tree:
+			field = directoryDirectories
+			node = appendDigest(node, s.encode(v))
+		}
+		msg = protowire.AppendTag(msg, field, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, node)
+	}
+	return s.put(msg)
+}
+
+func appendDigest(b []byte, d Digest) []byte {
+	var m []byte
+	m = protowire.AppendTag(m, digestHash, protowire.BytesType)
+	m = protowire.AppendString(m, d.Hash)
+	m = protowire.AppendTag(m, digestSizeBytes, protowire.VarintType)
+	m = protowire.AppendVarint(m, uint64(d.Size))
+	b = protowire.AppendTag(b, nodeDigest, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+func newStore() *memStore {
+	return &memStore{blobs: make(map[Digest][]byte), gets: make(map[Digest]int)}
+}
+
+var testTree = tree{
+	"bin":  tree{"tool": exe("#!/bin/sh\necho tool\n")},
+	"src":  tree{"main.c": "int main() {}\n", "empty": "", "sub": tree{}},
+	"link": link("src/main.c"),
+	"abs":  link("/src"),
+}
+
+func newFS(t *testing.T, s *memStore, cfg Config) *FS {
+	t.Helper()
+	cfg.Store = s
+	cfg.Root = s.encode(testTree)
+	cfg.TempDir = t.TempDir()
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTree(t *testing.T) {
+	c := newFS(t, newStore(), Config{})
+	for name, want := range map[string]fs.FileMode{
+		".":          fs.ModeDir | 0o555,
+		"bin/tool":   0o555,
+		"src/main.c": 0o444,
+		"src/sub":    fs.ModeDir | 0o555,
+		"link":       0o444,
+		"abs/empty":  0o444,
+	} {
+		if fi, err := c.Stat(name); err != nil || fi.Mode() != want {
+			t.Errorf("stat %s: %v, %v, want mode %v", name, fi, err, want)
+		}
+	}
+	if fi, err := c.Lstat("link"); err != nil || fi.Mode() != fs.ModeSymlink|0o777 || fi.Size() != 10 {
+		t.Errorf("lstat of a symlink: %v, %v", fi, err)
+	}
+	if target, err := c.Readlink("abs"); err != nil || target != "/src" {
+		t.Errorf("readlink: %q, %v", target, err)
+	}
+	entries, err := c.ReadDir("abs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if _, err := e.Info(); err != nil {
+			t.Errorf("info of %s: %v", e.Name(), err)
+		}
+		names = append(names, e.Name())
+	}
+	if got := strings.Join(names, " "); got != "empty main.c sub" {
+		t.Errorf("src holds %s", got)
+	}
+	for name, want := range map[string]error{
+		"missing":         syscall.ENOENT,
+		"src/main.c/x":    syscall.ENOTDIR,
+		"src/sub/missing": syscall.ENOENT,
+	} {
+		if _, err := c.Stat(name); !errors.Is(err, want) {
+			t.Errorf("stat %s: %v, want %v", name, err, want)
+		}
+	}
+	if _, err := c.ReadDir("link"); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("readdir of a file: %v", err)
+	}
+}
+
+func TestRead(t *testing.T) {
+	s := newStore()
+	cache := t.TempDir()
+	c := newFS(t, s, Config{Cache: cache})
+	main := DigestOf([]byte("int main() {}\n"))
+	f, err := c.Open("link", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != main.Size || s.count(main) != 0 {
+		t.Errorf("stat of an open file: %v, %v, after %d fetches", fi, err, s.count(main))
+	}
+	if got, err := io.ReadAll(f); err != nil || string(got) != "int main() {}\n" {
+		t.Errorf("read: %q, %v", got, err)
+	}
+	f.Close()
+	if _, err := os.Stat(Dir(cache).blob(main)); err != nil {
+		t.Errorf("blob not cached: %v", err)
+	}
+
+	c = newFS(t, s, Config{Cache: cache})
+	f, _ = c.Open("src/main.c", os.O_RDONLY, 0)
+	b := make([]byte, 4)
+	if n, err := f.ReadAt(b, 4); n != 4 || err != nil || string(b) != "main" || s.count(main) != 1 {
+		t.Errorf("read of a cached blob: %q, %v, after %d fetches", b, err, s.count(main))
+	}
+	f.Close()
+
+	f, _ = c.Open("src/empty", os.O_RDONLY, 0)
+	if got, err := io.ReadAll(f); err != nil || len(got) != 0 {
+		t.Errorf("read of the empty file: %q, %v", got, err)
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	s := newStore()
+	cache := t.TempDir()
+	c := newFS(t, s, Config{Cache: cache})
+	main := DigestOf([]byte("int main() {}\n"))
+	s.blobs[main] = []byte("int main() {}\n\x00")
+	f, _ := c.Open("src/main.c", os.O_RDONLY, 0)
+	if _, err := f.Read(make([]byte, 100)); err == nil || errors.Is(err, syscall.ENOENT) {
+		t.Errorf("read of a corrupt blob: %v", err)
+	}
+	if _, err := os.Stat(Dir(cache).blob(main)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("corrupt blob cached: %v", err)
+	}
+	if _, err := New(Config{Store: s, Root: DigestOf([]byte("missing"))}); err == nil {
+		t.Error("New of a missing root succeeded")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	c := newFS(t, newStore(), Config{})
+	for name, err := range map[string]error{
+		"open for writing": func() error { _, err := c.Open("src/main.c", os.O_RDWR, 0); return err }(),
+		"create":           func() error { _, err := c.Open("src/new", os.O_CREATE|os.O_WRONLY, 0o644); return err }(),
+		"mkdir":            c.Mkdir("d", 0o755),
+		"unlink":           c.Unlink("src/main.c"),
+		"rename":           c.Rename("src/main.c", "x"),
+		"chmod":            c.Chmod("src", 0o700),
+		"chtimes":          c.Chtimes("src", time.Now(), time.Now()),
+	} {
+		if !errors.Is(err, syscall.EROFS) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := c.Open("src", os.O_RDWR, 0); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("open of a directory for writing: %v", err)
+	}
+	if _, err := c.Open("link", os.O_RDONLY|syscall.O_NOFOLLOW, 0); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("open of a symlink with O_NOFOLLOW: %v", err)
+	}
+}
+
+func TestStores(t *testing.T) {
+	s := newStore()
+	root := s.encode(testTree)
+	dir := t.TempDir()
+	for d, b := range s.blobs {
+		os.MkdirAll(filepath.Dir(Dir(dir).blob(d)), 0o755)
+		if err := os.WriteFile(Dir(dir).blob(d), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hash, _ := strings.CutPrefix(r.URL.Path, "/cache/cas/")
+		if !validHash(hash) {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, Dir(dir).blob(Digest{Hash: hash}))
+	}))
+	defer srv.Close()
+	for name, store := range map[string]Store{
+		"dir":  Dir(dir),
+		"http": &HTTP{URL: srv.URL + "/cache"},
+	} {
+		c, err := New(Config{Store: store, Root: root, TempDir: t.TempDir()})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		f, err := c.Open("bin/tool", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got, err := io.ReadAll(f); err != nil || string(got) != "#!/bin/sh\necho tool\n" {
+			t.Errorf("%s: read %q, %v", name, got, err)
+		}
+		f.Close()
+		if _, err := store.Get(DigestOf([]byte("missing"))); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: get of a missing blob: %v", name, err)
+		}
+	}
+}
+
+func TestParseDigest(t *testing.T) {
+	d := DigestOf([]byte("x"))
+	if got, err := ParseDigest(d.String()); err != nil || got != d {
+		t.Errorf("round trip of %v: %v, %v", d, got, err)
+	}
+	for _, s := range []string{"", "abc/1", d.Hash, d.Hash + "/-1", strings.ToUpper(d.Hash) + "/1"} {
+		if _, err := ParseDigest(s); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	s := newStore()
+	c := newFS(t, s, Config{})
+	s.blobs[DigestOf([]byte("int main() {}\n"))] = []byte("tampered\n")
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `ls /cas/src
+cat /cas/bin/tool
+cat /cas/src/main.c || echo refused`)
+	cmd.Stdout = &stdout
+	if err := tracer.New(cmd, tracer.WithMount("/cas", c)).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := "empty\nmain.c\nsub\n#!/bin/sh\necho tool\nrefused\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,245 @@
+package cas
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// directory is a decoded Directory message.
+type directory struct {
+	nodes map[string]*node
+	props properties
+}
+
+// node is a file, directory or symlink of a directory.
+type node struct {
+	name   string
+	mode   fs.FileMode
+	digest Digest // of the contents of a file, or the Directory of a directory
+	target string // of a symlink
+	mtime  time.Time
+}
+
+func (n *node) info() *info {
+	fi := &info{name: n.name, mode: n.mode, mtime: n.mtime}
+	if n.mode.IsRegular() {
+		fi.size = n.digest.Size
+	}
+	if n.mode&fs.ModeSymlink != 0 {
+		fi.size = int64(len(n.target))
+	}
+	return fi
+}
+
+// info describes a node.
+type info struct {
+	name  string
+	size  int64
+	mode  fs.FileMode
+	mtime time.Time
+}
+
+func (fi *info) Name() string       { return fi.name }
+func (fi *info) Size() int64        { return fi.size }
+func (fi *info) Mode() fs.FileMode  { return fi.mode }
+func (fi *info) ModTime() time.Time { return fi.mtime }
+func (fi *info) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *info) Sys() any           { return nil }
+
+// properties are the NodeProperties of a node this package uses.
+type properties struct {
+	mtime   time.Time
+	mode    fs.FileMode
+	hasMode bool
+}
+
+// apply sets the permission bits and modification time the properties
+// give.
+func (p properties) apply(mode *fs.FileMode, mtime *time.Time) {
+	if p.hasMode {
+		*mode = *mode&fs.ModeType | p.mode
+	}
+	*mtime = p.mtime
+}
+
+// The field numbers of the messages of
+// build/bazel/remote/execution/v2/remote_execution.proto that are decoded.
+const (
+	directoryFiles       = 1
+	directoryDirectories = 2
+	directorySymlinks    = 3
+	directoryProperties  = 5
+
+	nodeName           = 1
+	nodeDigest         = 2 // of FileNode and DirectoryNode
+	symlinkTarget      = 2
+	fileIsExecutable   = 4
+	symlinkProperties  = 4
+	fileProperties     = 6
+	digestHash         = 1
+	digestSizeBytes    = 2
+	propertiesMtime    = 2
+	propertiesUnixMode = 3
+	timestampSeconds   = 1
+	timestampNanos     = 2
+	uint32ValueValue   = 1
+)
+
+var errBadMessage = errors.New("bad message")
+
+// fields calls fn for each field of the protobuf message b, with its
+// contents if it is length-delimited or its value if it is a varint.
+// Fields of other types are skipped.
+func fields(b []byte, fn func(num protowire.Number, data []byte, v uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errBadMessage
+		}
+		b = b[n:]
+		var data []byte
+		var v uint64
+		switch typ {
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return errBadMessage
+		}
+		b = b[n:]
+		if typ == protowire.BytesType || typ == protowire.VarintType {
+			if err := fn(num, data, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseDirectory decodes a Directory message.
+func parseDirectory(b []byte) (*directory, error) {
+	dir := &directory{nodes: make(map[string]*node)}
+	err := fields(b, func(num protowire.Number, data []byte, _ uint64) error {
+		var n *node
+		var err error
+		switch num {
+		case directoryFiles:
+			n, err = parseNode(data, 0o444)
+		case directoryDirectories:
+			n, err = parseNode(data, fs.ModeDir|0o555)
+		case directorySymlinks:
+			n, err = parseNode(data, fs.ModeSymlink|0o777)
+		case directoryProperties:
+			dir.props, err = parseProperties(data)
+			return err
+		default:
+			return nil
+		}
+		switch {
+		case err != nil:
+			return err
+		case n.name == "" || n.name == "." || n.name == ".." || strings.Contains(n.name, "/"):
+			return fmt.Errorf("bad name %q", n.name)
+		case dir.nodes[n.name] != nil:
+			return fmt.Errorf("%q given twice", n.name)
+		case n.mode.IsRegular() || n.mode.IsDir():
+			if !validHash(n.digest.Hash) || n.digest.Size < 0 {
+				return fmt.Errorf("%q has a bad digest", n.name)
+			}
+		}
+		dir.nodes[n.name] = n
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dir, nil
+}
+
+// parseNode decodes a FileNode, DirectoryNode or SymlinkNode, as mode
+// tells.
+func parseNode(b []byte, mode fs.FileMode) (*node, error) {
+	n := &node{mode: mode}
+	var props properties
+	err := fields(b, func(num protowire.Number, data []byte, v uint64) error {
+		var err error
+		switch {
+		case num == nodeName:
+			n.name = string(data)
+		case num == nodeDigest && !isSymlink(mode):
+			n.digest, err = parseDigest(data)
+		case num == symlinkTarget && isSymlink(mode):
+			n.target = string(data)
+		case num == fileIsExecutable && mode.IsRegular():
+			if v != 0 {
+				n.mode |= 0o111
+			}
+		case num == fileProperties && mode.IsRegular(), num == symlinkProperties && isSymlink(mode):
+			props, err = parseProperties(data)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	props.apply(&n.mode, &n.mtime)
+	return n, nil
+}
+
+func isSymlink(mode fs.FileMode) bool { return mode&fs.ModeSymlink != 0 }
+
+func parseDigest(b []byte) (Digest, error) {
+	var d Digest
+	err := fields(b, func(num protowire.Number, data []byte, v uint64) error {
+		switch num {
+		case digestHash:
+			d.Hash = string(data)
+		case digestSizeBytes:
+			d.Size = int64(v)
+		}
+		return nil
+	})
+	return d, err
+}
+
+// parseProperties decodes the mtime and unix_mode of a NodeProperties
+// message.
+func parseProperties(b []byte) (properties, error) {
+	var p properties
+	err := fields(b, func(num protowire.Number, data []byte, _ uint64) error {
+		switch num {
+		case propertiesMtime:
+			var sec, nsec uint64
+			err := fields(data, func(num protowire.Number, _ []byte, v uint64) error {
+				switch num {
+				case timestampSeconds:
+					sec = v
+				case timestampNanos:
+					nsec = v
+				}
+				return nil
+			})
+			p.mtime = time.Unix(int64(sec), int64(int32(nsec)))
+			return err
+		case propertiesUnixMode:
+			p.hasMode = true
+			return fields(data, func(num protowire.Number, _ []byte, v uint64) error {
+				if num == uint32ValueValue {
+					p.mode = fs.FileMode(v) & fs.ModePerm
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return p, err
+}
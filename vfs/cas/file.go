@@ -0,0 +1,117 @@
+package cas
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// file is an open file, whose contents are fetched when it is first read.
+type file struct {
+	fs   *FS
+	node *node
+	name string
+
+	mu     sync.Mutex
+	off    int64
+	local  *os.File
+	closed bool
+}
+
+// contents returns the local file holding the contents of f, fetching them
+// the first time; f.mu must be held.
+func (f *file) contents(op string) (*os.File, error) {
+	if f.closed {
+		return nil, pathErr(op, f.name, fs.ErrClosed)
+	}
+	if f.local == nil {
+		local, err := f.fs.materialize(f.node)
+		if err != nil {
+			return nil, pathErr(op, f.name, err)
+		}
+		f.local = local
+	}
+	return f.local, nil
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	local, err := f.contents("read")
+	if err != nil {
+		return 0, err
+	}
+	n, err := local.ReadAt(b, f.off)
+	f.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off < 0 {
+		return 0, pathErr("read", f.name, syscall.EINVAL)
+	}
+	local, err := f.contents("read")
+	if err != nil {
+		return 0, err
+	}
+	return local.ReadAt(b, off)
+}
+
+func (f *file) Write([]byte) (int, error) {
+	return 0, pathErr("write", f.name, syscall.EBADF)
+}
+
+func (f *file) WriteAt([]byte, int64) (int, error) {
+	return 0, pathErr("write", f.name, syscall.EBADF)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, pathErr("seek", f.name, fs.ErrClosed)
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.node.digest.Size
+	default:
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	if offset < 0 {
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, pathErr("stat", f.name, fs.ErrClosed)
+	}
+	return f.node.info(), nil
+}
+
+func (f *file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return pathErr("close", f.name, fs.ErrClosed)
+	}
+	f.closed = true
+	if f.local != nil {
+		return f.local.Close()
+	}
+	return nil
+}
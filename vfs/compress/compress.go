@@ -0,0 +1,298 @@
+// Package compress implements a vfs.Backend that compresses the contents
+// of the regular files it keeps in another backend with zstd, so that
+// large virtual files take less memory, disk or bucket space.
+//
+// A file is compressed in chunks, 128 KiB by default, each an independent
+// zstd frame, followed by an index of where the frames are and a footer.
+// A read decompresses only the chunks it covers, so a pread deep into a
+// large file costs one chunk rather than the whole file; the last chunk
+// decompressed is kept for the reads that follow it. A chunk of zeros is
+// not stored at all.
+//
+// Writes are held, decompressed, until the file that made them is closed,
+// or until more than 64 chunks of the file are held, and are then written
+// as new frames after those already in the file, with a new index. Frames
+// written over are left in place until they are more than half the file,
+// when the frames still in use are moved down over them. A file is
+// changed in place, so a crash while it is written can leave it
+// unreadable.
+//
+// Stat, and the Info of a listing's entries, read a file's footer for
+// its size, which costs an open and a read of the backend for each. Files
+// in the backend that are not in the format fail to open with EIO, unless
+// opened with O_TRUNC, and Stat gives them the size the backend does.
+// Directories, symlinks and other calls go straight to the backend. All
+// methods, and the methods of the files an FS opens, are safe for
+// concurrent use.
+package compress
+
+import (
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// Option configures an FS.
+type Option func(*FS)
+
+// Level compresses with the zstd level, from 1, the fastest, to 22. The
+// levels are mapped to the closest of the encoder's four; the default is
+// 3.
+func Level(level int) Option {
+	return func(c *FS) { c.level = zstd.EncoderLevelFromZstd(level) }
+}
+
+// ChunkSize compresses new files in chunks of size bytes, which must be
+// from 4 KiB to 16 MiB. Larger chunks compress better, smaller ones cost
+// less to read at an offset. Files already in the backend keep the
+// chunk size they were written with.
+func ChunkSize(size int) Option {
+	return func(c *FS) {
+		if size >= 4<<10 && size <= 16<<20 {
+			c.chunkSize = size
+		}
+	}
+}
+
+// FS is a backend compressing the files it keeps in another.
+type FS struct {
+	b         vfs.Backend
+	level     zstd.EncoderLevel
+	chunkSize int
+	enc       *zstd.Encoder
+	dec       *zstd.Decoder
+
+	mu sync.Mutex
+	// entries are the files open, by name, with the number open of each.
+	entries map[string]*entry
+}
+
+var (
+	_ vfs.Backend  = (*FS)(nil)
+	_ vfs.Xattrer  = (*FS)(nil)
+	_ vfs.StatFSer = (*FS)(nil)
+	_ vfs.Socketer = (*FS)(nil)
+)
+
+// New returns an FS compressing the files of b.
+func New(b vfs.Backend, opts ...Option) *FS {
+	c := &FS{b: b, level: zstd.SpeedDefault, chunkSize: 128 << 10, entries: make(map[string]*entry)}
+	for _, opt := range opts {
+		opt(c)
+	}
+	// Neither fails with these options.
+	c.enc, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(c.level), zstd.WithEncoderConcurrency(1))
+	c.dec, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	return c
+}
+
+func pathErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (c *FS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	// Writes read the chunks they change, and append through the FS,
+	// since frames are written at offsets.
+	bflag := flag &^ os.O_APPEND
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		bflag = bflag&^os.O_WRONLY | os.O_RDWR
+	}
+	f, err := c.b.Open(name, bflag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return f, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[name]
+	switch {
+	case e == nil:
+		e = &entry{name: name}
+		if err := e.load(c, f, fi.Size()); err != nil {
+			f.Close()
+			return nil, pathErr("open", name, err)
+		}
+		c.entries[name] = e
+	case flag&os.O_TRUNC != 0:
+		e.mu.Lock()
+		e.reset(c)
+		e.mu.Unlock()
+	}
+	e.open++
+	return &file{fs: c, e: e, f: f, name: name, flag: flag}, nil
+}
+
+// info is what the backend says of a regular file, with its size
+// decompressed.
+type info struct {
+	fs.FileInfo
+	size int64
+}
+
+func (fi *info) Size() int64 { return fi.size }
+
+// info returns fi, of the file the backend has as name, with the size it
+// has decompressed: that of the file open on it, with the writes not yet
+// written, or that its footer gives.
+func (c *FS) info(name string, fi fs.FileInfo) fs.FileInfo {
+	if !fi.Mode().IsRegular() {
+		return fi
+	}
+	c.mu.Lock()
+	e := c.entries[name]
+	c.mu.Unlock()
+	if e != nil {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return &info{FileInfo: fi, size: e.size}
+	}
+	size, err := c.sizeOf(name, fi.Size())
+	if err != nil {
+		return fi
+	}
+	return &info{FileInfo: fi, size: size}
+}
+
+// sizeOf returns the decompressed size of the file the backend has as
+// name, in size bytes, from its footer.
+func (c *FS) sizeOf(name string, size int64) (int64, error) {
+	if size == 0 {
+		return 0, nil
+	}
+	f, err := c.b.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	ft, err := readFooter(f, size)
+	if err != nil {
+		return 0, err
+	}
+	return int64(ft.size), nil
+}
+
+func (c *FS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := c.b.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.info(name, fi), nil
+}
+
+func (c *FS) Lstat(name string) (fs.FileInfo, error) {
+	fi, err := c.b.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.info(name, fi), nil
+}
+
+// dirEntry is an entry of a listing, whose Info has the decompressed size.
+type dirEntry struct {
+	fs.DirEntry
+	c    *FS
+	name string
+}
+
+func (d *dirEntry) Info() (fs.FileInfo, error) {
+	fi, err := d.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return d.c.info(d.name, fi), nil
+}
+
+func (c *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := c.b.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		if e.Type().IsRegular() {
+			entries[i] = &dirEntry{DirEntry: e, c: c, name: path(name, e.Name())}
+		}
+	}
+	return entries, nil
+}
+
+// path returns the name of the entry name of the directory dir.
+func path(dir, name string) string {
+	if dir == "." {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// forget drops the entries of name and of everything under it, which no
+// longer name what they did. Files still open on them keep them.
+func (c *FS) forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n := range c.entries {
+		if n == name || strings.HasPrefix(n, name+"/") {
+			delete(c.entries, n)
+		}
+	}
+}
+
+func (c *FS) Mkdir(name string, perm fs.FileMode) error { return c.b.Mkdir(name, perm) }
+
+func (c *FS) Unlink(name string) error {
+	if err := c.b.Unlink(name); err != nil {
+		return err
+	}
+	c.forget(name)
+	return nil
+}
+
+func (c *FS) Rmdir(name string) error { return c.b.Rmdir(name) }
+
+func (c *FS) Rename(oldname, newname string) error {
+	if err := c.b.Rename(oldname, newname); err != nil {
+		return err
+	}
+	c.forget(oldname)
+	c.forget(newname)
+	return nil
+}
+
+func (c *FS) Link(oldname, newname string) error   { return c.b.Link(oldname, newname) }
+func (c *FS) Symlink(target, newname string) error { return c.b.Symlink(target, newname) }
+func (c *FS) Readlink(name string) (string, error) { return c.b.Readlink(name) }
+
+func (c *FS) Chmod(name string, mode fs.FileMode) error { return c.b.Chmod(name, mode) }
+
+func (c *FS) Chtimes(name string, atime, mtime time.Time) error {
+	return c.b.Chtimes(name, atime, mtime)
+}
+
+func (c *FS) Getxattr(name, attr string) ([]byte, error) {
+	return vfs.Getxattr(c.b, name, attr)
+}
+
+func (c *FS) Setxattr(name, attr string, value []byte, flags int) error {
+	return vfs.Setxattr(c.b, name, attr, value, flags)
+}
+
+func (c *FS) Listxattr(name string) ([]string, error) { return vfs.Listxattr(c.b, name) }
+
+func (c *FS) Removexattr(name, attr string) error {
+	return vfs.Removexattr(c.b, name, attr)
+}
+
+func (c *FS) StatFS(name string) (vfs.FSStat, error) { return vfs.StatFS(c.b, name) }
+
+func (c *FS) SocketPath(name string) (string, error) { return vfs.SocketPath(c.b, name) }
@@ -0,0 +1,279 @@
+package compress_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/compress"
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+)
+
+// text is large and compresses well.
+var text = func() string {
+	var b strings.Builder
+	for i := range 50000 {
+		fmt.Fprintf(&b, "line %d of the file\n", i)
+	}
+	return b.String()
+}()
+
+func write(t *testing.T, b vfs.Backend, name, data string) {
+	t.Helper()
+	f, err := b.Open(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read(b vfs.Backend, name string) (string, error) {
+	f, err := b.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	return string(data), err
+}
+
+func size(t *testing.T, b vfs.Backend, name string) int64 {
+	t.Helper()
+	fi, err := b.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestRoundTrip(t *testing.T) {
+	m := memfs.New()
+	c := compress.New(m, compress.Level(9))
+	write(t, c, "text", text)
+	write(t, c, "empty", "")
+	if got, err := read(c, "text"); err != nil || got != text {
+		t.Errorf("read: %d bytes, %v, want %d", len(got), err, len(text))
+	}
+	if got := size(t, c, "text"); got != int64(len(text)) {
+		t.Errorf("stat: size %d, want %d", got, len(text))
+	}
+	if got := size(t, m, "text"); got > int64(len(text))/4 {
+		t.Errorf("the backend keeps %d bytes of %d", got, len(text))
+	}
+	if got := size(t, m, "empty"); got != 0 {
+		t.Errorf("the backend keeps %d bytes of an empty file", got)
+	}
+	entries, err := c.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]int64{"text": int64(len(text))}[e.Name()]; fi.Size() != want {
+			t.Errorf("info of %s: size %d, want %d", e.Name(), fi.Size(), want)
+		}
+	}
+	// The chunk size of a file is its own.
+	if got, err := read(compress.New(m, compress.ChunkSize(4<<10)), "text"); err != nil || got != text {
+		t.Errorf("read with another chunk size: %d bytes, %v", len(got), err)
+	}
+}
+
+// counting counts the bytes read from the files of a backend.
+type counting struct {
+	vfs.Backend
+	n int64
+}
+
+type countingFile struct {
+	vfs.File
+	c *counting
+}
+
+func (c *counting) Open(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	f, err := c.Backend.Open(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &countingFile{f, c}, nil
+}
+
+func (f *countingFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(b, off)
+	f.c.n += int64(n)
+	return n, err
+}
+
+func TestReadAt(t *testing.T) {
+	// Random bytes do not compress, so what is read of the backend is
+	// about what is decompressed.
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	b := &counting{Backend: memfs.New()}
+	c := compress.New(b, compress.ChunkSize(64<<10))
+	write(t, c, "random", string(data))
+	f, err := c.Open("random", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, off := range []int64{3 << 20, 100, 4<<20 - 5, 64<<10 - 3, 2 << 20} {
+		b.n = 0
+		buf := make([]byte, 10)
+		n, err := f.ReadAt(buf, off)
+		if want := data[off:min(off+10, int64(len(data)))]; !bytes.Equal(buf[:n], want) || n < 10 && err != io.EOF {
+			t.Errorf("read at %d: %x, %v, want %x", off, buf[:n], err, want)
+		}
+		if b.n > 2*(64<<10+1<<10) {
+			t.Errorf("read at %d: read %d bytes of the backend", off, b.n)
+		}
+	}
+}
+
+func TestWrites(t *testing.T) {
+	m := memfs.New()
+	c := compress.New(m, compress.ChunkSize(4<<10))
+	want := []byte(text[:100000])
+	write(t, c, "f", string(want))
+	f, err := c.Open("f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(what string) {
+		t.Helper()
+		got := make([]byte, len(want)+10)
+		n, err := f.ReadAt(got, 0)
+		if !bytes.Equal(got[:n], want) || err != io.EOF {
+			t.Errorf("%s: read %d bytes, %v, want %d", what, n, err, len(want))
+		}
+		if fi, _ := f.Stat(); fi.Size() != int64(len(want)) {
+			t.Errorf("%s: stat: size %d, want %d", what, fi.Size(), len(want))
+		}
+	}
+	// Across a chunk boundary.
+	f.WriteAt([]byte("in the middle"), 4<<10-5)
+	copy(want[4<<10-5:], "in the middle")
+	check("write in the middle")
+	vfs.Truncate(f, 50000)
+	want = want[:50000]
+	check("truncate")
+	vfs.Truncate(f, 60000)
+	want = append(want, make([]byte, 10000)...)
+	check("grow")
+	f.WriteAt([]byte("past the end"), 70000)
+	want = append(want, make([]byte, 10000)...)
+	want = append(want, "past the end"...)
+	check("write past the end")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	a, err := c.Open("f", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(a, "appended")
+	want = append(want, "appended"...)
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := read(c, "f"); err != nil || got != string(want) {
+		t.Errorf("reopened: %d bytes, %v, want %d", len(got), err, len(want))
+	}
+	if got, err := read(compress.New(m), "f"); err != nil || got != string(want) {
+		t.Errorf("in another FS: %d bytes, %v, want %d", len(got), err, len(want))
+	}
+
+	// Writing over a file again and again does not grow it without
+	// bound.
+	for range 20 {
+		f, err := c.Open("f", os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt([]byte(text), 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	if got, err := read(c, "f"); err != nil || got != text {
+		t.Errorf("after writes over it: %d bytes, %v, want %d", len(got), err, len(text))
+	}
+	if got := size(t, m, "f"); got > int64(len(text))/2 {
+		t.Errorf("the backend keeps %d bytes of %d", got, len(text))
+	}
+}
+
+func TestShared(t *testing.T) {
+	c := compress.New(memfs.New())
+	w, err := c.Open("f", os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	io.WriteString(w, "not yet written")
+	if got, err := read(c, "f"); err != nil || got != "not yet written" {
+		t.Errorf("read of another file: %q, %v", got, err)
+	}
+	if got := size(t, c, "f"); got != 15 {
+		t.Errorf("stat: size %d", got)
+	}
+	if _, err := w.Read(make([]byte, 1)); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("read of a file open for writing: %v", err)
+	}
+}
+
+func TestNotCompressed(t *testing.T) {
+	m := memfs.New()
+	write(t, m, "plain", "not in the format")
+	c := compress.New(m)
+	if _, err := c.Open("plain", os.O_RDONLY, 0); !errors.Is(err, syscall.EIO) {
+		t.Errorf("open: %v", err)
+	}
+	if got := size(t, c, "plain"); got != 17 {
+		t.Errorf("stat: size %d", got)
+	}
+	write(t, c, "plain", "now it is")
+	if got, err := read(c, "plain"); err != nil || got != "now it is" {
+		t.Errorf("after truncating: %q, %v", got, err)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	m := memfs.New()
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `seq 1 100000 >/z/numbers
+wc -c </z/numbers
+tail -n 1 /z/numbers
+echo more >>/z/numbers
+tail -c 5 /z/numbers
+mv /z/numbers /z/moved && wc -l </z/moved`)
+	cmd.Stdout = &stdout
+	if err := tracer.New(cmd, tracer.WithMount("/z", compress.New(m))).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := "588895\n100000\nmore\n100001\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := size(t, m, "moved"); got > 588900/3 {
+		t.Errorf("the backend keeps %d bytes", got)
+	}
+}
@@ -0,0 +1,291 @@
+package compress
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// file is an open regular file, decompressing the chunks it reads and
+// holding those it writes in its entry.
+type file struct {
+	fs   *FS
+	e    *entry
+	f    vfs.File // the file of the backend
+	name string
+	flag int
+
+	mu     sync.Mutex
+	off    int64
+	closed bool
+	// wrote is set once the file has written or truncated, so that
+	// closing it writes what its entry holds to the backend.
+	wrote bool
+}
+
+var (
+	_ vfs.Truncater = (*file)(nil)
+	_ vfs.Syncer    = (*file)(nil)
+)
+
+// check validates f for an operation; f.mu must be held.
+func (f *file) check(op string, write bool) error {
+	return vfs.CheckFile(op, f.name, f.flag, f.closed, write)
+}
+
+// readAt reads the file at off.
+func (f *file) readAt(b []byte, off int64) (int, error) {
+	e := f.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if off >= e.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(b)), e.size)
+	n := int64(0)
+	for off+n < end {
+		pos := off + n
+		p, err := e.chunk(f.fs, f.f, pos/e.chunkSize)
+		if err != nil {
+			return int(n), pathErr("read", f.name, errno(err))
+		}
+		within := pos % e.chunkSize
+		want := min(end-pos, e.chunkSize-within)
+		got := int64(0)
+		if within < int64(len(p)) {
+			got = int64(copy(b[n:n+want], p[within:]))
+		}
+		clear(b[n+got : n+want])
+		n += want
+	}
+	if n < int64(len(b)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+// writeAt writes b at off, or at the end of the file if appending, and
+// returns the offset written at.
+func (f *file) writeAt(b []byte, off int64, appending bool) (int64, error) {
+	e := f.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f.wrote = true
+	if appending {
+		off = e.size
+	}
+	for n := 0; n < len(b); {
+		pos := off + int64(n)
+		i, within := pos/e.chunkSize, pos%e.chunkSize
+		want := min(int64(len(b)-n), e.chunkSize-within)
+		// The chunk is read first unless what is written covers all of it
+		// the file has.
+		old, held := e.dirty[i]
+		if start := i * e.chunkSize; !held && start < e.size && (within > 0 || pos+want < min(start+e.chunkSize, e.size)) {
+			p, err := e.chunk(f.fs, f.f, i)
+			if err != nil {
+				return off, pathErr("write", f.name, errno(err))
+			}
+			old = slices.Clone(p)
+		}
+		if end := int(within + want); end > len(old) {
+			old = append(old, make([]byte, end-len(old))...)
+		}
+		copy(old[within:], b[n:int64(n)+want])
+		e.grow(max(e.size, pos+want))
+		e.put(i, old)
+		n += int(want)
+	}
+	if len(e.dirty) > maxDirty {
+		if err := e.flush(f.fs, f.f); err != nil {
+			return off, pathErr("write", f.name, errno(err))
+		}
+	}
+	return off, nil
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, err := f.readAt(b, f.off)
+	f.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	err := f.check("read", false)
+	f.mu.Unlock()
+	switch {
+	case err != nil:
+		return 0, err
+	case off < 0:
+		return 0, pathErr("read", f.name, syscall.EINVAL)
+	case len(b) == 0:
+		return 0, nil
+	}
+	return f.readAt(b, off)
+}
+
+func (f *file) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	off, err := f.writeAt(b, f.off, f.flag&os.O_APPEND != 0)
+	if err != nil {
+		return 0, err
+	}
+	f.off = off + int64(len(b))
+	return len(b), nil
+}
+
+func (f *file) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	err := f.check("write", true)
+	f.mu.Unlock()
+	switch {
+	case err != nil:
+		return 0, err
+	case off < 0:
+		return 0, pathErr("write", f.name, syscall.EINVAL)
+	}
+	if _, err := f.writeAt(b, off, false); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Truncate changes the size the entry holds, to be written with the rest
+// of what the file wrote.
+func (f *file) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return pathErr("truncate", f.name, syscall.EINVAL)
+	}
+	f.e.mu.Lock()
+	defer f.e.mu.Unlock()
+	f.wrote = true
+	if err := f.e.truncate(f.fs, f.f, size); err != nil {
+		return pathErr("truncate", f.name, errno(err))
+	}
+	return nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, pathErr("seek", f.name, fs.ErrClosed)
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		f.e.mu.Lock()
+		offset += f.e.size
+		f.e.mu.Unlock()
+	default:
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	if offset < 0 {
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, pathErr("stat", f.name, fs.ErrClosed)
+	}
+	fi, err := f.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f.e.mu.Lock()
+	defer f.e.mu.Unlock()
+	return &info{FileInfo: fi, size: f.e.size}, nil
+}
+
+// Sync writes what the entry holds to the backend, if the file wrote, and
+// syncs the file of the backend.
+func (f *file) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return pathErr("fsync", f.name, fs.ErrClosed)
+	}
+	if f.wrote {
+		f.e.mu.Lock()
+		err := f.e.flush(f.fs, f.f)
+		f.e.mu.Unlock()
+		if err != nil {
+			return pathErr("fsync", f.name, errno(err))
+		}
+	}
+	return vfs.Sync(f.f)
+}
+
+// Close writes what the entry holds to the backend, if the file wrote, and
+// closes the file of the backend. The entry is dropped with its last file.
+func (f *file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return pathErr("close", f.name, fs.ErrClosed)
+	}
+	f.closed = true
+	var err error
+	if f.wrote {
+		f.e.mu.Lock()
+		if err = f.e.flush(f.fs, f.f); err != nil {
+			err = pathErr("close", f.name, errno(err))
+		}
+		f.e.mu.Unlock()
+	}
+	if cerr := f.f.Close(); err == nil {
+		err = cerr
+	}
+	c := f.fs
+	c.mu.Lock()
+	f.e.open--
+	if f.e.open == 0 && c.entries[f.e.name] == f.e {
+		delete(c.entries, f.e.name)
+	}
+	c.mu.Unlock()
+	return err
+}
+
+// errno returns the errno of err, or EIO for errors that have none.
+func errno(err error) error {
+	if pe, ok := err.(*fs.PathError); ok {
+		err = pe.Err
+	}
+	if _, ok := err.(syscall.Errno); ok {
+		return err
+	}
+	return syscall.EIO
+}
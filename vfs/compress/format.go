@@ -0,0 +1,314 @@
+package compress
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// A file as the backend keeps it is the magic number, the frames of its
+// chunks, in no particular order, its index and then its footer. The index
+// gives each chunk in order the offset and length of its frame, which is
+// empty for a chunk of zeros; the footer gives where the index is, the
+// size of the file decompressed, the chunk size and the number of chunks,
+// the CRC-32 of the index and the magic number again. A file the backend
+// keeps empty is an empty file too.
+const (
+	magic      = "cfz\x01"
+	footerSize = 32
+	indexSize  = 12 // of each chunk
+	// maxDirty is the number of chunks a file holds written before it
+	// writes them to the backend.
+	maxDirty = 64
+)
+
+type footer struct {
+	index     int64
+	size      int64
+	chunkSize int64
+	count     int64
+	crc       uint32
+}
+
+// readFooter reads the footer of a file the backend keeps in size bytes.
+func readFooter(r io.ReaderAt, size int64) (footer, error) {
+	var b [footerSize]byte
+	if size < int64(len(magic))+footerSize {
+		return footer{}, syscall.EIO
+	}
+	if _, err := r.ReadAt(b[:], size-footerSize); err != nil {
+		return footer{}, err
+	}
+	ft := footer{
+		index:     int64(binary.LittleEndian.Uint64(b[0:])),
+		size:      int64(binary.LittleEndian.Uint64(b[8:])),
+		chunkSize: int64(binary.LittleEndian.Uint32(b[16:])),
+		count:     int64(binary.LittleEndian.Uint32(b[20:])),
+		crc:       binary.LittleEndian.Uint32(b[24:]),
+	}
+	switch {
+	case string(b[28:]) != magic,
+		ft.chunkSize == 0 || ft.size < 0,
+		ft.count != (ft.size+ft.chunkSize-1)/ft.chunkSize,
+		ft.index < int64(len(magic)) || ft.index+ft.count*indexSize+footerSize != size:
+		return footer{}, syscall.EIO
+	}
+	return ft, nil
+}
+
+// frame is where the backend keeps a chunk.
+type frame struct {
+	off int64
+	n   int64
+}
+
+// entry is a file open, shared by the files open on it.
+type entry struct {
+	name string
+	open int // guarded by the FS's mu
+
+	mu        sync.Mutex
+	chunkSize int64
+	size      int64
+	frames    []frame
+	// end is where the frames end, and the index is written; live is the
+	// length of the frames in use, with those written over not counted.
+	end, live int64
+	// bsize is the size of the file in the backend.
+	bsize int64
+	// dirty are the chunks written and not yet written to the backend,
+	// and changed is set when there are, or the file was truncated.
+	dirty   map[int64][]byte
+	changed bool
+	// last is the chunk last decompressed, the lastN of the file.
+	last  []byte
+	lastN int64
+}
+
+// reset empties e, as the backend now keeps it.
+func (e *entry) reset(c *FS) {
+	e.chunkSize, e.size, e.frames = int64(c.chunkSize), 0, nil
+	e.end, e.live, e.bsize = 0, 0, 0
+	e.dirty, e.changed = make(map[int64][]byte), false
+	e.last, e.lastN = nil, -1
+}
+
+// load reads the index of the file r, which the backend keeps in size
+// bytes.
+func (e *entry) load(c *FS, r io.ReaderAt, size int64) error {
+	e.reset(c)
+	if size == 0 {
+		return nil
+	}
+	ft, err := readFooter(r, size)
+	if err != nil {
+		return err
+	}
+	index := make([]byte, ft.count*indexSize)
+	if _, err := r.ReadAt(index, ft.index); err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(index) != ft.crc {
+		return syscall.EIO
+	}
+	e.frames = make([]frame, ft.count)
+	for i := range e.frames {
+		b := index[i*indexSize:]
+		fr := frame{off: int64(binary.LittleEndian.Uint64(b)), n: int64(binary.LittleEndian.Uint32(b[8:]))}
+		if fr.n > 0 && (fr.off < int64(len(magic)) || fr.off+fr.n > ft.index) {
+			return syscall.EIO
+		}
+		e.frames[i] = fr
+		e.live += fr.n
+	}
+	e.chunkSize, e.size, e.end, e.bsize = ft.chunkSize, ft.size, ft.index, size
+	return nil
+}
+
+// grow extends the index to the chunks of a file of size bytes, the
+// chunks added being zeros.
+func (e *entry) grow(size int64) {
+	e.size = size
+	if n := (size + e.chunkSize - 1) / e.chunkSize; n > int64(len(e.frames)) {
+		e.frames = append(e.frames, make([]frame, n-int64(len(e.frames)))...)
+	}
+}
+
+// chunk returns the contents of the ith chunk, read with r if they are not
+// held; what they lack of the chunk, up to the end of the file, is zeros.
+// The contents must not be changed. e.mu must be held.
+func (e *entry) chunk(c *FS, r io.ReaderAt, i int64) ([]byte, error) {
+	if p, ok := e.dirty[i]; ok {
+		return p, nil
+	}
+	if i == e.lastN {
+		return e.last, nil
+	}
+	if i >= int64(len(e.frames)) || e.frames[i].n == 0 {
+		return nil, nil
+	}
+	fr := e.frames[i]
+	src := make([]byte, fr.n)
+	if _, err := r.ReadAt(src, fr.off); err != nil {
+		if err == io.EOF {
+			err = syscall.EIO
+		}
+		return nil, err
+	}
+	p, err := c.dec.DecodeAll(src, make([]byte, 0, e.chunkSize))
+	if err != nil || int64(len(p)) > e.chunkSize {
+		return nil, syscall.EIO
+	}
+	e.last, e.lastN = p, i
+	return p, nil
+}
+
+// truncate changes the size of the file; e.mu must be held.
+func (e *entry) truncate(c *FS, r io.ReaderAt, size int64) error {
+	e.changed = true
+	if size >= e.size {
+		e.grow(size)
+		return nil
+	}
+	n := (size + e.chunkSize - 1) / e.chunkSize
+	for i := n; i < int64(len(e.frames)); i++ {
+		e.live -= e.frames[i].n
+		delete(e.dirty, i)
+	}
+	e.frames = e.frames[:n]
+	if e.lastN >= n {
+		e.lastN = -1
+	}
+	if rem := size % e.chunkSize; rem > 0 {
+		p, err := e.chunk(c, r, n-1)
+		if err != nil {
+			return err
+		}
+		if int64(len(p)) > rem {
+			e.put(n-1, slices.Clone(p[:rem]))
+		}
+	}
+	e.size = size
+	return nil
+}
+
+// put holds p as the contents of the ith chunk.
+func (e *entry) put(i int64, p []byte) {
+	e.dirty[i] = p
+	e.changed = true
+	if i == e.lastN {
+		e.lastN = -1
+	}
+}
+
+// flush writes the chunks held to f, the file of the backend, and then
+// the index; e.mu must be held.
+func (e *entry) flush(c *FS, f vfs.File) error {
+	if !e.changed {
+		return nil
+	}
+	if e.size == 0 {
+		if e.bsize > 0 {
+			if err := vfs.Truncate(f, 0); err != nil {
+				return err
+			}
+		}
+		e.reset(c)
+		return nil
+	}
+	if e.end == 0 {
+		if _, err := f.WriteAt([]byte(magic), 0); err != nil {
+			return err
+		}
+		e.end = int64(len(magic))
+	}
+	held := make([]int64, 0, len(e.dirty))
+	for i := range e.dirty {
+		held = append(held, i)
+	}
+	slices.Sort(held)
+	for _, i := range held {
+		p := e.dirty[i]
+		e.live -= e.frames[i].n
+		e.frames[i] = frame{}
+		if !zeros(p) {
+			b := c.enc.EncodeAll(p, nil)
+			if _, err := f.WriteAt(b, e.end); err != nil {
+				return err
+			}
+			e.frames[i] = frame{off: e.end, n: int64(len(b))}
+			e.live += int64(len(b))
+			e.end += int64(len(b))
+		}
+		delete(e.dirty, i)
+	}
+	if garbage := e.end - int64(len(magic)) - e.live; garbage > e.live && garbage > e.chunkSize {
+		if err := e.compact(f); err != nil {
+			return err
+		}
+	}
+	index := make([]byte, 0, len(e.frames)*indexSize+footerSize)
+	for _, fr := range e.frames {
+		index = binary.LittleEndian.AppendUint64(index, uint64(fr.off))
+		index = binary.LittleEndian.AppendUint32(index, uint32(fr.n))
+	}
+	crc := crc32.ChecksumIEEE(index)
+	index = binary.LittleEndian.AppendUint64(index, uint64(e.end))
+	index = binary.LittleEndian.AppendUint64(index, uint64(e.size))
+	index = binary.LittleEndian.AppendUint32(index, uint32(e.chunkSize))
+	index = binary.LittleEndian.AppendUint32(index, uint32(len(e.frames)))
+	index = binary.LittleEndian.AppendUint32(index, crc)
+	index = append(index, magic...)
+	if _, err := f.WriteAt(index, e.end); err != nil {
+		return err
+	}
+	size := e.end + int64(len(index))
+	if size < e.bsize {
+		if err := vfs.Truncate(f, size); err != nil {
+			return err
+		}
+	}
+	e.bsize, e.changed = size, false
+	return nil
+}
+
+// compact moves the frames in use down over those written over, in the
+// order they are in the file, so that each moves only down.
+func (e *entry) compact(f vfs.File) error {
+	order := make([]int, 0, len(e.frames))
+	for i, fr := range e.frames {
+		if fr.n > 0 {
+			order = append(order, i)
+		}
+	}
+	slices.SortFunc(order, func(a, b int) int { return cmp.Compare(e.frames[a].off, e.frames[b].off) })
+	end := int64(len(magic))
+	var buf []byte
+	for _, i := range order {
+		fr := &e.frames[i]
+		if fr.off != end {
+			buf = slices.Grow(buf[:0], int(fr.n))[:fr.n]
+			if _, err := f.ReadAt(buf, fr.off); err != nil {
+				return err
+			}
+			if _, err := f.WriteAt(buf, end); err != nil {
+				return err
+			}
+			fr.off = end
+		}
+		end += fr.n
+	}
+	e.end = end
+	return nil
+}
+
+func zeros(p []byte) bool {
+	return len(bytes.Trim(p, "\x00")) == 0
+}
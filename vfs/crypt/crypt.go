@@ -0,0 +1,525 @@
+// Package crypt implements a vfs.Backend that encrypts the tree it keeps
+// in another backend, so that the files a command leaves in a database
+// file, a host directory or a bucket are unreadable without the key.
+//
+// File contents are encrypted with AES-256-GCM in chunks of 64 KiB, each
+// sealed with a nonce of its own, drawn at random every time the chunk is
+// written, under a key derived from the tree's key and a salt drawn at
+// random for each file. A chunk is bound to its place in the file, so
+// chunks cannot be swapped or moved between files unnoticed, and one that
+// does not decrypt fails the read with EIO. Dropping whole chunks from
+// the end of a file is not detected: it reads as a shorter file.
+//
+// Names are encrypted too, each path component on its own, and
+// deterministically so that they can be looked up, with a nonce derived
+// from the name itself. Equal names encrypt equally, wherever they are in
+// the tree, and a name encrypts to 4/3 of its length plus 38 bytes, so the
+// longest name a backend that allows 255 bytes can keep is 163 bytes; a
+// longer one fails with ENAMETOOLONG. Symlink targets and extended
+// attribute values are encrypted with random nonces; extended attribute
+// names, sizes of directories, and the shape of the tree are not hidden.
+// The backend keeps a file's contents with a header and 28 bytes per chunk
+// more than the plain size.
+//
+// Since the backend sees only encrypted names and targets, it cannot
+// follow symlinks itself: an FS resolves them, with an Lstat through the
+// backend of each directory a path goes through. Names in the backend
+// that do not decrypt with the key are left out of listings. Writes
+// through one open file are serialized; as with the kernel, writes to the
+// same file through different open files should not overlap.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// maxName is the longest encrypted name, as most filesystems allow.
+const maxName = 255
+
+// KeySize is the size of a key.
+const KeySize = 32
+
+// Config describes the key a tree is encrypted with. Exactly one of Key
+// and KeyFunc is set.
+type Config struct {
+	// Key is the key, of KeySize bytes.
+	Key []byte
+	// KeyFunc returns the key, as from a key management service that
+	// decrypts it. New calls it once.
+	KeyFunc func() ([]byte, error)
+}
+
+// EnvKey returns a KeyFunc that takes the key from the environment
+// variable name, in hex or base64.
+func EnvKey(name string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("crypt: $%s is not set", name)
+		}
+		s = strings.TrimSpace(s)
+		if key, err := hex.DecodeString(s); err == nil && len(key) == KeySize {
+			return key, nil
+		}
+		if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == KeySize {
+			return key, nil
+		}
+		return nil, fmt.Errorf("crypt: $%s is not a %d-byte key in hex or base64", name, KeySize)
+	}
+}
+
+// FS is a backend encrypting what it keeps in another.
+type FS struct {
+	b   vfs.Backend
+	key []byte
+	// names encrypts names and values, and nameIV derives a name's nonce.
+	names  cipher.AEAD
+	nameIV []byte
+}
+
+var (
+	_ vfs.Backend  = (*FS)(nil)
+	_ vfs.Xattrer  = (*FS)(nil)
+	_ vfs.StatFSer = (*FS)(nil)
+	_ vfs.Socketer = (*FS)(nil)
+)
+
+// New returns an FS keeping the tree in b, encrypted with the key cfg
+// describes.
+func New(b vfs.Backend, cfg Config) (*FS, error) {
+	key := cfg.Key
+	switch {
+	case (key == nil) == (cfg.KeyFunc == nil):
+		return nil, errors.New("crypt: one of Key and KeyFunc must be set")
+	case key == nil:
+		var err error
+		if key, err = cfg.KeyFunc(); err != nil {
+			return nil, err
+		}
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("crypt: key is %d bytes, not %d", len(key), KeySize)
+	}
+	c := &FS{b: b, key: key}
+	var err error
+	if c.names, err = c.aead(nil, "names"); err != nil {
+		return nil, err
+	}
+	if c.nameIV, err = hkdf.Key(sha256.New, key, nil, "name nonces", sha256.Size); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// aead returns an AES-GCM cipher with a key derived from c's for purpose,
+// with salt.
+func (c *FS) aead(salt []byte, purpose string) (cipher.AEAD, error) {
+	k, err := hkdf.Key(sha256.New, c.key, salt, purpose, KeySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var encoding = base64.RawURLEncoding
+
+// encryptName returns the name a path component is kept by in the
+// backend.
+func (c *FS) encryptName(name string) (string, error) {
+	mac := hmac.New(sha256.New, c.nameIV)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:c.names.NonceSize()]
+	s := encoding.EncodeToString(c.names.Seal(nonce, nonce, []byte(name), []byte("name")))
+	if len(s) > maxName {
+		return "", syscall.ENAMETOOLONG
+	}
+	return s, nil
+}
+
+// decryptName returns the path component the backend keeps as s, or false
+// if s does not decrypt with the key.
+func (c *FS) decryptName(s string) (string, bool) {
+	b, err := encoding.DecodeString(s)
+	if err != nil || len(b) < c.names.NonceSize() {
+		return "", false
+	}
+	nonce := b[:c.names.NonceSize()]
+	name, err := c.names.Open(nil, nonce, b[len(nonce):], []byte("name"))
+	if err != nil {
+		return "", false
+	}
+	return string(name), true
+}
+
+// plainLen returns the length of a symlink target the backend keeps as one
+// of n bytes.
+func (c *FS) plainLen(n int64) int64 {
+	return max(0, int64(encoding.DecodedLen(int(n)))-int64(c.names.NonceSize()+c.names.Overhead()))
+}
+
+// seal encrypts a symlink target or an attribute value, with a nonce of
+// its own, for what.
+func (c *FS) seal(b []byte, what string) []byte {
+	nonce := make([]byte, c.names.NonceSize(), c.names.NonceSize()+len(b)+c.names.Overhead())
+	rand.Read(nonce)
+	return c.names.Seal(nonce, nonce, b, []byte(what))
+}
+
+// unseal decrypts what seal encrypted, failing with EIO.
+func (c *FS) unseal(b []byte, what string) ([]byte, error) {
+	if len(b) < c.names.NonceSize() {
+		return nil, syscall.EIO
+	}
+	nonce := b[:c.names.NonceSize()]
+	p, err := c.names.Open(nil, nonce, b[len(nonce):], []byte(what))
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	return p, nil
+}
+
+func pathErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// rename returns err with the backend's encrypted name in it replaced with
+// name.
+func rename(err error, name string) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return pathErr(pe.Op, name, pe.Err)
+	}
+	return err
+}
+
+// resolve returns the name the backend keeps name by, following the
+// symlinks in it, and the final one if follow is set. Absolute targets are
+// resolved against the root of the tree.
+func (c *FS) resolve(op, name string, follow bool) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", pathErr(op, name, syscall.EINVAL)
+	}
+	p, err := vfs.Walk(name, ".", follow, func(dir, comp string, last bool) (string, fs.FileMode, string, error) {
+		enc, err := c.encryptName(comp)
+		if err != nil {
+			return "", 0, "", pathErr(op, name, err)
+		}
+		p := path.Join(dir, enc)
+		if last && !follow {
+			return p, 0, "", nil
+		}
+		fi, err := c.b.Lstat(p)
+		switch {
+		case err != nil && last && errors.Is(err, fs.ErrNotExist):
+			// What does not exist yet may be about to be made.
+			return p, 0, "", nil
+		case err != nil:
+			return "", 0, "", rename(err, name)
+		case fi.Mode()&fs.ModeSymlink == 0:
+			return p, fi.Mode(), "", nil
+		}
+		target, err := c.readlink(p)
+		if err != nil {
+			return "", 0, "", rename(err, name)
+		}
+		return p, fi.Mode(), target, nil
+	})
+	if errno, ok := err.(syscall.Errno); ok {
+		return "", pathErr(op, name, errno)
+	}
+	return p, err
+}
+
+// readlink returns the target of the symlink the backend keeps as p.
+func (c *FS) readlink(p string) (string, error) {
+	s, err := c.b.Readlink(p)
+	if err != nil {
+		return "", err
+	}
+	b, err := encoding.DecodeString(s)
+	if err != nil {
+		return "", syscall.EIO
+	}
+	target, err := c.unseal(b, "symlink")
+	return string(target), err
+}
+
+// info is what the backend says of a file, with the name and size it has
+// in the tree.
+type info struct {
+	fs.FileInfo
+	name string
+	size int64
+}
+
+func (fi *info) Name() string { return fi.name }
+func (fi *info) Size() int64  { return fi.size }
+
+// info returns fi, of a file the tree has as name.
+func (c *FS) info(fi fs.FileInfo, name string) fs.FileInfo {
+	size := fi.Size()
+	switch {
+	case fi.Mode().IsRegular():
+		size = plainSize(size)
+	case fi.Mode()&fs.ModeSymlink != 0:
+		size = c.plainLen(size)
+	}
+	return &info{FileInfo: fi, name: path.Base(name), size: size}
+}
+
+func (c *FS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	p, err := c.resolve("open", name, flag&syscall.O_NOFOLLOW == 0)
+	if err != nil {
+		return nil, err
+	}
+	writing := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	bflag := flag &^ os.O_APPEND
+	if writing {
+		// Writes read the chunks they change.
+		bflag = bflag&^os.O_WRONLY | os.O_RDWR
+	}
+	f, err := c.b.Open(p, bflag, perm)
+	if err != nil {
+		return nil, rename(err, name)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, rename(err, name)
+	}
+	if !fi.Mode().IsRegular() {
+		return &dirFile{File: f, c: c, name: name}, nil
+	}
+	return &file{c: c, f: f, name: name, appending: flag&os.O_APPEND != 0}, nil
+}
+
+func (c *FS) Stat(name string) (fs.FileInfo, error) {
+	p, err := c.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := c.b.Stat(p)
+	if err != nil {
+		return nil, rename(err, name)
+	}
+	return c.info(fi, name), nil
+}
+
+func (c *FS) Lstat(name string) (fs.FileInfo, error) {
+	p, err := c.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := c.b.Lstat(p)
+	if err != nil {
+		return nil, rename(err, name)
+	}
+	return c.info(fi, name), nil
+}
+
+// dirEntry is an entry of a listing, with the name it has in the tree.
+type dirEntry struct {
+	fs.DirEntry
+	c    *FS
+	name string
+}
+
+func (d *dirEntry) Name() string { return d.name }
+
+func (d *dirEntry) Info() (fs.FileInfo, error) {
+	fi, err := d.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return d.c.info(fi, d.name), nil
+}
+
+func (c *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := c.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := c.b.ReadDir(p)
+	if err != nil {
+		return nil, rename(err, name)
+	}
+	out := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		if n, ok := c.decryptName(e.Name()); ok {
+			out = append(out, &dirEntry{DirEntry: e, c: c, name: n})
+		}
+	}
+	// The backend sorted them by their encrypted names.
+	sortEntries(out)
+	return out, nil
+}
+
+func (c *FS) Mkdir(name string, perm fs.FileMode) error {
+	p, err := c.resolve("mkdir", name, false)
+	if err != nil {
+		return err
+	}
+	return rename(c.b.Mkdir(p, perm), name)
+}
+
+func (c *FS) Unlink(name string) error {
+	p, err := c.resolve("unlink", name, false)
+	if err != nil {
+		return err
+	}
+	return rename(c.b.Unlink(p), name)
+}
+
+func (c *FS) Rmdir(name string) error {
+	p, err := c.resolve("rmdir", name, false)
+	if err != nil {
+		return err
+	}
+	return rename(c.b.Rmdir(p), name)
+}
+
+func (c *FS) Rename(oldname, newname string) error {
+	oldp, err := c.resolve("rename", oldname, false)
+	if err != nil {
+		return err
+	}
+	newp, err := c.resolve("rename", newname, false)
+	if err != nil {
+		return err
+	}
+	return rename(c.b.Rename(oldp, newp), oldname)
+}
+
+func (c *FS) Link(oldname, newname string) error {
+	oldp, err := c.resolve("link", oldname, false)
+	if err != nil {
+		return err
+	}
+	newp, err := c.resolve("link", newname, false)
+	if err != nil {
+		return err
+	}
+	return rename(c.b.Link(oldp, newp), newname)
+}
+
+func (c *FS) Symlink(target, newname string) error {
+	p, err := c.resolve("symlink", newname, false)
+	if err != nil {
+		return err
+	}
+	return rename(c.b.Symlink(encoding.EncodeToString(c.seal([]byte(target), "symlink")), p), newname)
+}
+
+func (c *FS) Readlink(name string) (string, error) {
+	p, err := c.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	target, err := c.readlink(p)
+	if err != nil {
+		if errors.Is(err, syscall.EIO) {
+			return "", pathErr("readlink", name, err)
+		}
+		return "", rename(err, name)
+	}
+	return target, nil
+}
+
+func (c *FS) Chmod(name string, mode fs.FileMode) error {
+	p, err := c.resolve("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	return rename(c.b.Chmod(p, mode), name)
+}
+
+func (c *FS) Chtimes(name string, atime, mtime time.Time) error {
+	p, err := c.resolve("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+	return rename(c.b.Chtimes(p, atime, mtime), name)
+}
+
+// Getxattr decrypts the value the backend keeps. Attribute names are kept
+// as they are.
+func (c *FS) Getxattr(name, attr string) ([]byte, error) {
+	p, err := c.resolve("getxattr", name, true)
+	if err != nil {
+		return nil, err
+	}
+	v, err := vfs.Getxattr(c.b, p, attr)
+	if err != nil {
+		return nil, rename(err, name)
+	}
+	if v, err = c.unseal(v, "xattr "+attr); err != nil {
+		return nil, pathErr("getxattr", name, err)
+	}
+	return v, nil
+}
+
+func (c *FS) Setxattr(name, attr string, value []byte, flags int) error {
+	p, err := c.resolve("setxattr", name, true)
+	if err != nil {
+		return err
+	}
+	return rename(vfs.Setxattr(c.b, p, attr, c.seal(value, "xattr "+attr), flags), name)
+}
+
+func (c *FS) Listxattr(name string) ([]string, error) {
+	p, err := c.resolve("listxattr", name, true)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := vfs.Listxattr(c.b, p)
+	return attrs, rename(err, name)
+}
+
+func (c *FS) Removexattr(name, attr string) error {
+	p, err := c.resolve("removexattr", name, true)
+	if err != nil {
+		return err
+	}
+	return rename(vfs.Removexattr(c.b, p, attr), name)
+}
+
+func (c *FS) StatFS(name string) (vfs.FSStat, error) {
+	p, err := c.resolve("statfs", name, true)
+	if err != nil {
+		return vfs.FSStat{}, err
+	}
+	st, err := vfs.StatFS(c.b, p)
+	return st, rename(err, name)
+}
+
+// SocketPath returns the backend's host path for name, under its
+// encrypted name.
+func (c *FS) SocketPath(name string) (string, error) {
+	p, err := c.resolve("socket", name, true)
+	if err != nil {
+		return "", err
+	}
+	s, err := vfs.SocketPath(c.b, p)
+	return s, rename(err, name)
+}
@@ -0,0 +1,333 @@
+package crypt_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/crypt"
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+)
+
+var key = bytes.Repeat([]byte{7}, crypt.KeySize)
+
+func newFS(t *testing.T, b vfs.Backend) *crypt.FS {
+	t.Helper()
+	c, err := crypt.New(b, crypt.Config{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func write(t *testing.T, b vfs.Backend, name, data string) {
+	t.Helper()
+	f, err := b.Open(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read(b vfs.Backend, name string) (string, error) {
+	f, err := b.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	return string(data), err
+}
+
+// backendFiles returns the contents of every file in b, by name.
+func backendFiles(t *testing.T, b vfs.Backend) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	var walk func(dir string)
+	walk = func(dir string) {
+		entries, err := b.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			name := filepath.Join(dir, e.Name())
+			files[name] = ""
+			switch {
+			case e.IsDir():
+				walk(name)
+			case e.Type().IsRegular():
+				files[name], _ = read(b, name)
+			}
+		}
+	}
+	walk(".")
+	return files
+}
+
+func TestReadWrite(t *testing.T) {
+	m := memfs.New()
+	c := newFS(t, m)
+	big := strings.Repeat("the secret plans ", 20000)
+	if err := c.Mkdir("secret-dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write(t, c, "secret-dir/secret-file", big)
+	if got, err := read(c, "secret-dir/secret-file"); err != nil || got != big {
+		t.Fatalf("read back %d bytes, %v", len(got), err)
+	}
+	fi, err := c.Stat("secret-dir/secret-file")
+	if err != nil || fi.Size() != int64(len(big)) || fi.Name() != "secret-file" {
+		t.Errorf("stat: %v, %v", fi, err)
+	}
+	for name, data := range backendFiles(t, m) {
+		if strings.Contains(name, "secret") || strings.Contains(data, "secret") {
+			t.Errorf("the backend has %q in the clear", name)
+		}
+	}
+
+	f, err := c.Open("secret-dir/secret-file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// A write across a chunk boundary, and one past the end.
+	want := []byte(big)
+	if _, err := f.WriteAt([]byte("ACROSS"), 65533); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[65533:], "ACROSS")
+	end := int64(len(big)) + 70000
+	if _, err := f.WriteAt([]byte("END"), end); err != nil {
+		t.Fatal(err)
+	}
+	want = append(append(want, make([]byte, 70000)...), "END"...)
+	if got, err := read(c, "secret-dir/secret-file"); err != nil || got != string(want) {
+		t.Errorf("after writes: %d bytes, %v, want %d", len(got), err, len(want))
+	}
+	b := make([]byte, 10)
+	if n, err := f.ReadAt(b, 65530); err != nil || string(b[:n]) != string(want[65530:65540]) {
+		t.Errorf("read across a chunk boundary: %q, %v", b[:n], err)
+	}
+	for _, size := range []int64{200000, 65536, 100, 0, 70000} {
+		if err := vfs.Truncate(f, size); err != nil {
+			t.Fatalf("truncate to %d: %v", size, err)
+		}
+		if size <= int64(len(want)) {
+			want = want[:size]
+		} else {
+			want = append(want, make([]byte, size-int64(len(want)))...)
+		}
+		if got, err := read(c, "secret-dir/secret-file"); err != nil || got != string(want) {
+			t.Errorf("after truncating to %d: %d bytes, %v", size, len(got), err)
+		}
+		if fi, _ := f.Stat(); fi.Size() != size {
+			t.Errorf("size after truncating to %d: %d", size, fi.Size())
+		}
+	}
+
+	a, err := c.Open("log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(a, "one\n")
+	write(t, c, "log", "replaced\n")
+	io.WriteString(a, "two\n")
+	a.Close()
+	if got, err := read(c, "log"); err != nil || got != "replaced\ntwo\n" {
+		t.Errorf("append after another file replaced the contents: %q, %v", got, err)
+	}
+	if got, err := read(c, "missing"); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("read of a missing file: %q, %v", got, err)
+	}
+}
+
+func TestNames(t *testing.T) {
+	m := memfs.New()
+	c := newFS(t, m)
+	for _, d := range []string{"a", "a/b", "z"} {
+		if err := c.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(t, c, "a/b/file", "data")
+	write(t, c, "a/other", "other")
+	for target, link := range map[string]string{"b": "a/rel", "/a/b": "abs", "../a/b/file": "z/up"} {
+		if err := c.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{"a/rel/file": "data", "abs/file": "data", "z/up": "data"} {
+		if got, err := read(c, name); err != nil || got != want {
+			t.Errorf("%s: %q, %v", name, got, err)
+		}
+	}
+	if target, err := c.Readlink("abs"); err != nil || target != "/a/b" {
+		t.Errorf("readlink: %q, %v", target, err)
+	}
+	if fi, err := c.Lstat("abs"); err != nil || fi.Size() != 4 || fi.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("lstat of a symlink: %v, %v", fi, err)
+	}
+	entries, err := c.ReadDir("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil || fi.Name() != e.Name() {
+			t.Errorf("info of %s: %v, %v", e.Name(), fi, err)
+		}
+		names = append(names, e.Name())
+	}
+	if got := strings.Join(names, " "); got != "b other rel" {
+		t.Errorf("readdir: %q", got)
+	}
+	if err := c.Rename("a/other", "z/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Link("z/moved", "z/linked"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := read(c, "z/linked"); err != nil || got != "other" {
+		t.Errorf("hard link: %q, %v", got, err)
+	}
+	if err := c.Unlink("z/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rmdir("a"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("rmdir of a full directory: %v", err)
+	}
+	if _, err := c.Stat("z/moved"); !errors.Is(err, syscall.ENOENT) || !strings.Contains(err.Error(), "z/moved") {
+		t.Errorf("stat of a removed file: %v", err)
+	}
+	if err := c.Mkdir(strings.Repeat("n", 164), 0o755); !errors.Is(err, syscall.ENAMETOOLONG) {
+		t.Errorf("mkdir of a long name: %v", err)
+	}
+	if err := c.Mkdir(strings.Repeat("n", 163), 0o755); err != nil {
+		t.Errorf("mkdir of the longest name: %v", err)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	m := memfs.New()
+	c := newFS(t, m)
+	write(t, c, "file", "data")
+	// A stranger's file, which does not decrypt.
+	write(t, m, "plain", "plain")
+	other, err := crypt.New(m, crypt.Config{Key: bytes.Repeat([]byte{8}, crypt.KeySize)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := other.ReadDir("."); err != nil || len(entries) != 0 {
+		t.Errorf("listing with another key: %v, %v", entries, err)
+	}
+	if entries, err := c.ReadDir("."); err != nil || len(entries) != 1 {
+		t.Errorf("listing with a stranger's file: %v, %v", entries, err)
+	}
+}
+
+// encrypted returns the name of a file in m other than "plain".
+func encrypted(t *testing.T, m vfs.Backend) string {
+	t.Helper()
+	for name := range backendFiles(t, m) {
+		if name != "plain" {
+			return name
+		}
+	}
+	t.Fatal("no file")
+	return ""
+}
+
+func TestTampering(t *testing.T) {
+	m := memfs.New()
+	c := newFS(t, m)
+	write(t, c, "file", strings.Repeat("x", 3*65536))
+	enc := encrypted(t, m)
+	f, err := m.Open(enc, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Swap the first two chunks.
+	first, second := make([]byte, 65536+28), make([]byte, 65536+28)
+	f.ReadAt(first, 32)
+	f.ReadAt(second, 32+int64(len(first)))
+	f.WriteAt(second, 32)
+	f.WriteAt(first, 32+int64(len(first)))
+	f.Close()
+	if _, err := read(c, "file"); !errors.Is(err, syscall.EIO) {
+		t.Errorf("read of swapped chunks: %v", err)
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	m := memfs.New()
+	c := newFS(t, m)
+	write(t, c, "file", "")
+	if err := c.Setxattr("file", "user.secret", []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Getxattr("file", "user.secret"); err != nil || string(v) != "value" {
+		t.Errorf("getxattr: %q, %v", v, err)
+	}
+	if v, err := m.Getxattr(encrypted(t, m), "user.secret"); err != nil || bytes.Contains(v, []byte("value")) {
+		t.Errorf("the backend has the value in the clear: %q, %v", v, err)
+	}
+}
+
+func TestEnvKey(t *testing.T) {
+	t.Setenv("CRYPT_TEST_KEY", hex.EncodeToString(key))
+	c, err := crypt.New(memfs.New(), crypt.Config{KeyFunc: crypt.EnvKey("CRYPT_TEST_KEY")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, c, "f", "x")
+	t.Setenv("CRYPT_TEST_KEY", "short")
+	if _, err := crypt.New(memfs.New(), crypt.Config{KeyFunc: crypt.EnvKey("CRYPT_TEST_KEY")}); err == nil {
+		t.Error("no error for a short key")
+	}
+	if _, err := crypt.New(memfs.New(), crypt.Config{KeyFunc: crypt.EnvKey("CRYPT_TEST_UNSET")}); err == nil {
+		t.Error("no error for an unset variable")
+	}
+}
+
+func TestTracer(t *testing.T) {
+	dir := t.TempDir()
+	c := newFS(t, vfs.Dir(dir))
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `mkdir /enc/notes && echo top secret >/enc/notes/plan.txt
+echo more >>/enc/notes/plan.txt
+ln -s notes/plan.txt /enc/link
+cat /enc/link
+ls /enc /enc/notes`)
+	cmd.Stdout = &stdout
+	if err := tracer.New(cmd, tracer.WithMount("/enc", c)).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := "top secret\nmore\n/enc:\nlink\nnotes\n\n/enc/notes:\nplan.txt\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		data, _ := os.ReadFile(p)
+		if strings.Contains(p, "plan") || strings.Contains(p, "notes") || bytes.Contains(data, []byte("secret")) {
+			t.Errorf("%s is in the clear", p)
+		}
+		return nil
+	})
+}
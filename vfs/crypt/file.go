@@ -0,0 +1,391 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// A file as the backend keeps it is a header, the magic number and the
+// file's salt, and then its chunks in order, each a nonce, the chunk's
+// encrypted contents and the tag sealing them. A file the backend keeps
+// empty is an empty file too; its header is written with its first byte.
+const (
+	magic      = "cfe\x01"
+	headerSize = 32
+	chunkSize  = 64 << 10
+	// overhead is what sealing a chunk adds to it, with GCM's standard
+	// nonce and tag sizes.
+	overhead = 12 + 16
+)
+
+// plainSize returns the size of a file the backend keeps in size bytes.
+func plainSize(size int64) int64 {
+	if size <= headerSize {
+		return 0
+	}
+	size -= headerSize
+	n := size / (chunkSize + overhead) * chunkSize
+	if rem := size % (chunkSize + overhead); rem > overhead {
+		n += rem - overhead
+	}
+	return n
+}
+
+// backendSize returns the size the backend keeps a file of size bytes in.
+func backendSize(size int64) int64 {
+	n := headerSize + size/chunkSize*(chunkSize+overhead)
+	if rem := size % chunkSize; rem > 0 {
+		n += rem + overhead
+	}
+	return n
+}
+
+// chunkOffset returns where the backend keeps the ith chunk of a file.
+func chunkOffset(i int64) int64 { return headerSize + i*(chunkSize+overhead) }
+
+// file is an open regular file, decrypting what it reads and encrypting
+// what it writes.
+type file struct {
+	c         *FS
+	f         vfs.File
+	name      string
+	appending bool
+
+	mu     sync.Mutex
+	off    int64
+	closed bool
+	// aead is the cipher of the contents, for the header they were last
+	// seen with.
+	aead   cipher.AEAD
+	header [headerSize]byte
+}
+
+// cipher sets aead to the cipher of the file's contents, derived from the
+// salt in its header. The header is read again each time, since another
+// open file may have truncated the file and given it a new salt. A file
+// the backend keeps empty is given its header if create is set, and has
+// no cipher otherwise.
+func (f *file) cipher(create bool) error {
+	var h [headerSize]byte
+	n, err := f.f.ReadAt(h[:], 0)
+	switch {
+	case n == 0 && (err == io.EOF || err == nil):
+		f.aead = nil
+		if !create {
+			return nil
+		}
+		copy(h[:], magic)
+		rand.Read(h[len(magic):])
+		if _, err := f.f.WriteAt(h[:], 0); err != nil {
+			return err
+		}
+	case n < headerSize || !bytes.HasPrefix(h[:], []byte(magic)):
+		return pathErr("read", f.name, syscall.EIO)
+	case f.aead != nil && h == f.header:
+		return nil
+	}
+	aead, err := f.c.aead(h[len(magic):], "contents")
+	if err != nil {
+		return err
+	}
+	f.aead, f.header = aead, h
+	return nil
+}
+
+// size returns the size of the file.
+func (f *file) size() (int64, error) {
+	fi, err := f.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return plainSize(fi.Size()), nil
+}
+
+func chunkAD(i int64) []byte { return binary.BigEndian.AppendUint64(nil, uint64(i)) }
+
+// readChunk returns the decrypted contents of the ith chunk, which are
+// empty past the end of the file.
+func (f *file) readChunk(i int64) ([]byte, error) {
+	buf := make([]byte, chunkSize+overhead)
+	n, err := f.f.ReadAt(buf, chunkOffset(i))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if n <= overhead || f.aead == nil {
+		return nil, syscall.EIO
+	}
+	nonce := buf[:f.aead.NonceSize()]
+	p, err := f.aead.Open(nil, nonce, buf[len(nonce):n], chunkAD(i))
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	return p, nil
+}
+
+// writeChunk encrypts p as the ith chunk, with a new nonce.
+func (f *file) writeChunk(i int64, p []byte) error {
+	buf := make([]byte, f.aead.NonceSize(), overhead+len(p))
+	rand.Read(buf)
+	buf = f.aead.Seal(buf, buf, p, chunkAD(i))
+	_, err := f.f.WriteAt(buf, chunkOffset(i))
+	return err
+}
+
+func (f *file) readAt(b []byte, off int64) (int, error) {
+	size, err := f.size()
+	if err != nil {
+		return 0, err
+	}
+	if err := f.cipher(false); err != nil {
+		return 0, err
+	}
+	n := 0
+	for n < len(b) {
+		if off >= size {
+			return n, io.EOF
+		}
+		p, err := f.readChunk(off / chunkSize)
+		if err != nil {
+			return n, pathErr("read", f.name, err)
+		}
+		in := off % chunkSize
+		if in >= int64(len(p)) {
+			return n, io.EOF
+		}
+		m := copy(b[n:], p[in:])
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// writeAt writes b at off, filling any gap from the end of the file with
+// zeros, a chunk at a time: each chunk written is read, changed and sealed
+// again.
+func (f *file) writeAt(b []byte, off int64) (int, error) {
+	size, err := f.size()
+	if err != nil {
+		return 0, err
+	}
+	if err := f.cipher(true); err != nil {
+		return 0, err
+	}
+	for size < off {
+		n := min(off-size, chunkSize-size%chunkSize)
+		if err := f.update(size, make([]byte, n), size); err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	n := 0
+	for n < len(b) {
+		m := min(len(b)-n, chunkSize-int(off%chunkSize))
+		if err := f.update(off, b[n:n+m], size); err != nil {
+			return n, err
+		}
+		n += m
+		off += int64(m)
+		size = max(size, off)
+	}
+	return n, nil
+}
+
+// update writes b, which does not cross a chunk boundary, at off in a file
+// of size bytes.
+func (f *file) update(off int64, b []byte, size int64) error {
+	i, in := off/chunkSize, off%chunkSize
+	var p []byte
+	if i*chunkSize < size {
+		var err error
+		if p, err = f.readChunk(i); err != nil {
+			return pathErr("write", f.name, err)
+		}
+	}
+	if end := int(in) + len(b); end > len(p) {
+		p = append(p, make([]byte, end-len(p))...)
+	}
+	copy(p[in:], b)
+	return f.writeChunk(i, p)
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, pathErr("read", f.name, fs.ErrClosed)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, err := f.readAt(b, f.off)
+	f.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case f.closed:
+		return 0, pathErr("read", f.name, fs.ErrClosed)
+	case off < 0:
+		return 0, pathErr("read", f.name, syscall.EINVAL)
+	}
+	return f.readAt(b, off)
+}
+
+func (f *file) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, pathErr("write", f.name, fs.ErrClosed)
+	}
+	if f.appending {
+		size, err := f.size()
+		if err != nil {
+			return 0, err
+		}
+		f.off = size
+	}
+	n, err := f.writeAt(b, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *file) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case f.closed:
+		return 0, pathErr("write", f.name, fs.ErrClosed)
+	case off < 0:
+		return 0, pathErr("write", f.name, syscall.EINVAL)
+	}
+	return f.writeAt(b, off)
+}
+
+// Truncate seals the chunk a shrunk file now ends in again, and writes
+// zeros to a grown one, which the backend cannot leave as a hole that
+// decrypts.
+func (f *file) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case f.closed:
+		return pathErr("truncate", f.name, fs.ErrClosed)
+	case size < 0:
+		return pathErr("truncate", f.name, syscall.EINVAL)
+	}
+	cur, err := f.size()
+	switch {
+	case err != nil:
+		return err
+	case size > cur:
+		_, err := f.writeAt(nil, size)
+		return err
+	case size == cur:
+		return nil
+	}
+	if err := f.cipher(false); err != nil {
+		return err
+	}
+	if rem := size % chunkSize; rem > 0 {
+		p, err := f.readChunk(size / chunkSize)
+		if err != nil {
+			return pathErr("truncate", f.name, err)
+		}
+		if err := f.writeChunk(size/chunkSize, p[:rem]); err != nil {
+			return err
+		}
+	}
+	return vfs.Truncate(f.f, backendSize(size))
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, pathErr("seek", f.name, fs.ErrClosed)
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		size, err := f.size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	if offset < 0 {
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	fi, err := f.f.Stat()
+	if err != nil {
+		return nil, rename(err, f.name)
+	}
+	return f.c.info(fi, f.name), nil
+}
+
+func (f *file) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return pathErr("fsync", f.name, fs.ErrClosed)
+	}
+	return rename(vfs.Sync(f.f), f.name)
+}
+
+func (f *file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return pathErr("close", f.name, fs.ErrClosed)
+	}
+	f.closed = true
+	return rename(f.f.Close(), f.name)
+}
+
+// dirFile is an open directory, or another file that is not regular, as
+// the backend opened it, with the name it has in the tree.
+type dirFile struct {
+	vfs.File
+	c    *FS
+	name string
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) {
+	fi, err := d.File.Stat()
+	if err != nil {
+		return nil, rename(err, d.name)
+	}
+	return d.c.info(fi, d.name), nil
+}
+
+func sortEntries(entries []fs.DirEntry) {
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+}
@@ -0,0 +1,241 @@
+// Package devfs implements a vfs.Backend holding the device files a
+// command expects to find in /dev, so that one traced in a minimal rootless
+// environment needs no real device nodes. Mounted at /dev it has:
+//
+//   - null, which reads as empty and discards what is written to it;
+//   - zero, which reads as zeros and discards what is written to it;
+//   - random and urandom, which read as random bytes from a source of
+//     randomness, crypto/rand's by default, and accept what is written;
+//   - fd, a symlink to /proc/self/fd, and stdin, stdout and stderr,
+//     symlinks to its entries 0, 1 and 2, which the tracer follows to the
+//     descriptors of the process that opens them.
+//
+// The devices report the device numbers Linux gives them, and the modes of
+// a devtmpfs. The set of files is fixed: operations that would change it
+// fail with EROFS. The symlinks lead out of the FS, so that Stat and Open
+// of one, which would follow it, fail with ENOENT; the tracer follows them
+// itself. All methods, and the methods of the files an FS opens, are safe
+// for concurrent use, as long as the source of randomness is.
+package devfs
+
+import (
+	"crypto/rand"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// FS is a /dev directory.
+type FS struct {
+	nodes map[string]*node
+	root  *node
+}
+
+var _ vfs.Backend = (*FS)(nil)
+
+// node is a file of the FS. read fills b as a read of a device does; it
+// is nil for the root and the symlinks.
+type node struct {
+	name   string
+	mode   fs.FileMode
+	rdev   uint64
+	target string
+	read   func(b []byte) (int, error)
+	mtime  time.Time
+}
+
+// New returns an FS whose random devices read from crypto/rand.
+func New() *FS {
+	return NewRand(rand.Reader)
+}
+
+// NewRand returns an FS whose random devices read from r.
+func NewRand(r io.Reader) *FS {
+	now := time.Now()
+	dev := func(name string, major, minor uint32, read func([]byte) (int, error)) *node {
+		return &node{
+			name:  name,
+			mode:  fs.ModeDevice | fs.ModeCharDevice | 0o666,
+			rdev:  mkdev(major, minor),
+			read:  read,
+			mtime: now,
+		}
+	}
+	link := func(name, target string) *node {
+		return &node{name: name, mode: fs.ModeSymlink | 0o777, target: target, mtime: now}
+	}
+	random := func(b []byte) (int, error) { return io.ReadFull(r, b) }
+	nodes := []*node{
+		dev("null", 1, 3, func([]byte) (int, error) { return 0, io.EOF }),
+		dev("zero", 1, 5, func(b []byte) (int, error) {
+			clear(b)
+			return len(b), nil
+		}),
+		dev("random", 1, 8, random),
+		dev("urandom", 1, 9, random),
+		link("fd", "/proc/self/fd"),
+		link("stdin", "/proc/self/fd/0"),
+		link("stdout", "/proc/self/fd/1"),
+		link("stderr", "/proc/self/fd/2"),
+	}
+	d := &FS{
+		nodes: make(map[string]*node),
+		root:  &node{name: ".", mode: fs.ModeDir | 0o755, mtime: now},
+	}
+	for _, n := range nodes {
+		d.nodes[n.name] = n
+	}
+	return d
+}
+
+// mkdev encodes a device number as the kernel's new_encode_dev does.
+func mkdev(major, minor uint32) uint64 {
+	return uint64(minor&0xff) | uint64(major)<<8 | uint64(minor&^0xff)<<12
+}
+
+func pathErr(op, name string, err syscall.Errno) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// lookup returns the file name names, without following a symlink.
+func (d *FS) lookup(op, name string) (*node, error) {
+	if name == "." {
+		return d.root, nil
+	}
+	first, _, nested := strings.Cut(name, "/")
+	n, ok := d.nodes[first]
+	switch {
+	case !ok:
+		return nil, pathErr(op, name, syscall.ENOENT)
+	case nested && n.mode&fs.ModeSymlink != 0:
+		// The rest of the path is outside the FS.
+		return nil, pathErr(op, name, syscall.ENOENT)
+	case nested:
+		return nil, pathErr(op, name, syscall.ENOTDIR)
+	}
+	return n, nil
+}
+
+func (d *FS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	n, err := d.lookup("open", name)
+	if err != nil {
+		if flag&os.O_CREATE != 0 && !strings.Contains(name, "/") {
+			return nil, pathErr("open", name, syscall.EROFS)
+		}
+		return nil, err
+	}
+	acc := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	switch {
+	case flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathErr("open", name, syscall.EEXIST)
+	case n.mode&fs.ModeSymlink != 0 && flag&syscall.O_NOFOLLOW != 0:
+		return nil, pathErr("open", name, syscall.ELOOP)
+	case n.mode&fs.ModeSymlink != 0:
+		return nil, pathErr("open", name, syscall.ENOENT)
+	case n.mode.IsDir() && (acc != os.O_RDONLY || flag&os.O_CREATE != 0):
+		return nil, pathErr("open", name, syscall.EISDIR)
+	case !n.mode.IsDir() && flag&syscall.O_DIRECTORY != 0:
+		return nil, pathErr("open", name, syscall.ENOTDIR)
+	}
+	return &file{node: n, flag: flag}, nil
+}
+
+func (d *FS) Stat(name string) (fs.FileInfo, error) {
+	n, err := d.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if n.mode&fs.ModeSymlink != 0 {
+		return nil, pathErr("stat", name, syscall.ENOENT)
+	}
+	return n.info(), nil
+}
+
+func (d *FS) Lstat(name string) (fs.FileInfo, error) {
+	n, err := d.lookup("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(), nil
+}
+
+func (d *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := d.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.mode.IsDir() {
+		return nil, pathErr("readdir", name, syscall.ENOTDIR)
+	}
+	entries := make([]fs.DirEntry, 0, len(d.nodes))
+	for _, n := range d.nodes {
+		entries = append(entries, fs.FileInfoToDirEntry(n.info()))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (d *FS) Readlink(name string) (string, error) {
+	n, err := d.lookup("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if n.mode&fs.ModeSymlink == 0 {
+		return "", pathErr("readlink", name, syscall.EINVAL)
+	}
+	return n.target, nil
+}
+
+// readOnly fails an operation that would change the FS with EROFS, or
+// with the error looking name up gives.
+func (d *FS) readOnly(op, name string) error {
+	if _, err := d.lookup(op, name); err != nil && path.Dir(name) != "." {
+		return err
+	}
+	return pathErr(op, name, syscall.EROFS)
+}
+
+func (d *FS) Mkdir(name string, perm fs.FileMode) error { return d.readOnly("mkdir", name) }
+func (d *FS) Unlink(name string) error                  { return d.readOnly("unlink", name) }
+func (d *FS) Rmdir(name string) error                   { return d.readOnly("rmdir", name) }
+func (d *FS) Rename(oldname, newname string) error      { return d.readOnly("rename", oldname) }
+func (d *FS) Link(oldname, newname string) error        { return d.readOnly("link", newname) }
+func (d *FS) Symlink(target, newname string) error      { return d.readOnly("symlink", newname) }
+func (d *FS) Chmod(name string, mode fs.FileMode) error { return d.readOnly("chmod", name) }
+
+func (d *FS) Chtimes(name string, atime, mtime time.Time) error {
+	return d.readOnly("chtimes", name)
+}
+
+func (n *node) info() *fileInfo {
+	fi := &fileInfo{n: n}
+	if n.mode&fs.ModeSymlink != 0 {
+		fi.size = int64(len(n.target))
+	}
+	return fi
+}
+
+type fileInfo struct {
+	n    *node
+	size int64
+}
+
+func (fi *fileInfo) Name() string       { return fi.n.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.n.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.n.mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.n.mode.IsDir() }
+func (fi *fileInfo) Sys() any {
+	nlink := uint64(1)
+	if fi.n.mode.IsDir() {
+		nlink = 2
+	}
+	return &vfs.Attr{Nlink: nlink, Atime: fi.n.mtime, Ctime: fi.n.mtime, Rdev: fi.n.rdev}
+}
@@ -0,0 +1,118 @@
+package devfs_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/devfs"
+)
+
+func TestDevices(t *testing.T) {
+	d := devfs.NewRand(strings.NewReader("0123456789"))
+	read := func(name string, n int) string {
+		t.Helper()
+		f, err := d.Open(name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if n, err := f.Write([]byte("discarded")); n != 9 || err != nil {
+			t.Errorf("write to %s: %d, %v", name, n, err)
+		}
+		b := make([]byte, n)
+		k, err := f.Read(b)
+		if err != nil && err != io.EOF {
+			t.Errorf("read of %s: %v", name, err)
+		}
+		return string(b[:k])
+	}
+	if got := read("null", 4); got != "" {
+		t.Errorf("null read %q", got)
+	}
+	if got := read("zero", 4); got != "\x00\x00\x00\x00" {
+		t.Errorf("zero read %q", got)
+	}
+	if got := read("urandom", 4) + read("random", 4); got != "01234567" {
+		t.Errorf("random devices read %q", got)
+	}
+
+	fi, err := d.Stat("null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != fs.ModeDevice|fs.ModeCharDevice|0o666 || fi.Sys().(*vfs.Attr).Rdev != 0x103 {
+		t.Errorf("null: %v %#x", fi.Mode(), fi.Sys().(*vfs.Attr).Rdev)
+	}
+	if target, err := d.Readlink("stdout"); target != "/proc/self/fd/1" || err != nil {
+		t.Errorf("stdout: %q, %v", target, err)
+	}
+	entries, err := d.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if got := strings.Join(names, " "); got != "fd null random stderr stdin stdout urandom zero" {
+		t.Errorf("entries: %s", got)
+	}
+	if _, err := d.Open("null", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644); err != nil {
+		t.Errorf("open for a shell redirection: %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	d := devfs.New()
+	for name, err := range map[string]error{
+		"create":  func() error { _, err := d.Open("tty", os.O_CREATE|os.O_WRONLY, 0o644); return err }(),
+		"mkdir":   d.Mkdir("shm", 0o755),
+		"unlink":  d.Unlink("null"),
+		"rename":  d.Rename("null", "void"),
+		"chmod":   d.Chmod("null", 0o600),
+		"symlink": d.Symlink("null", "l"),
+		"chtimes": d.Chtimes("null", time.Now(), time.Now()),
+	} {
+		if !errors.Is(err, syscall.EROFS) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	for name, err := range map[string]error{
+		"nested":  d.Mkdir("null/x", 0o755),
+		"missing": func() error { _, err := d.Stat("tty"); return err }(),
+	} {
+		if !errors.Is(err, syscall.ENOTDIR) && !errors.Is(err, syscall.ENOENT) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `echo dropped >/dev/null
+head -c 3 /dev/zero | od -An -tx1
+head -c 5 /dev/urandom | wc -c
+cat /dev/stdin
+echo out >/dev/stdout
+stat -c '%F %t:%T' /dev/null
+ls /dev`)
+	cmd.Stdin, cmd.Stdout = strings.NewReader("in\n"), &stdout
+	if err := tracer.New(cmd, tracer.WithMount("/dev", devfs.New())).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := " 00 00 00\n5\nin\nout\ncharacter special file 1:3\nfd\nnull\nrandom\nstderr\nstdin\nstdout\nurandom\nzero\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,70 @@
+package devfs
+
+import (
+	"io/fs"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// file is an open device or the open root. A device has no offset: reads
+// and writes at any offset act as at the current one, and seeks leave it
+// at 0.
+type file struct {
+	node   *node
+	flag   int
+	closed atomic.Bool
+}
+
+func (f *file) check(op string, write bool) error {
+	if err := vfs.CheckFile(op, f.node.name, f.flag, f.closed.Load(), write); err != nil {
+		return err
+	}
+	if f.node.read == nil {
+		return pathErr(op, f.node.name, syscall.EISDIR)
+	}
+	return nil
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return f.node.read(b)
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) { return f.Read(b) }
+
+func (f *file) Write(b []byte) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (f *file) WriteAt(b []byte, off int64) (int, error) { return f.Write(b) }
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	if f.closed.Load() {
+		return 0, &fs.PathError{Op: "seek", Path: f.node.name, Err: fs.ErrClosed}
+	}
+	return 0, nil
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	if f.closed.Load() {
+		return nil, &fs.PathError{Op: "stat", Path: f.node.name, Err: fs.ErrClosed}
+	}
+	return f.node.info(), nil
+}
+
+func (f *file) Close() error {
+	if f.closed.Swap(true) {
+		return &fs.PathError{Op: "close", Path: f.node.name, Err: fs.ErrClosed}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package vfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// ChangeKind says how an entry differs between two trees.
+type ChangeKind int
+
+const (
+	// Created entries exist only in the new tree.
+	Created ChangeKind = iota
+	// Modified entries exist in both trees with different contents,
+	// permission bits or file type.
+	Modified
+	// Deleted entries exist only in the old tree.
+	Deleted
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Created:
+		return "created"
+	case Modified:
+		return "modified"
+	case Deleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// Change is an entry in the difference between two trees.
+type Change struct {
+	Name string
+	Kind ChangeKind
+	// Before and After are the hex SHA-256 digests of the entry's
+	// contents in the old and new trees: the data of a regular file, or
+	// the target of a symlink. They are empty where the entry is missing
+	// or is neither.
+	Before, After string
+}
+
+// Diff returns the changes that make the tree a holds into the one b
+// holds, sorted by name. Times, owners and link counts are not compared,
+// so a file rewritten with the same contents is unchanged, and a
+// directory is modified only if its permission bits or type are. Every
+// entry under a created or deleted directory is reported on its own, as
+// is everything under a directory that replaced another kind of entry or
+// was replaced by one.
+//
+// Diff reads every regular file of both trees. To see what a traced
+// command changed, take a Snapshot of the tree before it runs, Restore it
+// into a memfs.FS, and compare that with the tree afterwards.
+func Diff(a, b Backend) ([]Change, error) {
+	d := differ{a: a, b: b}
+	if err := d.entry("."); err != nil {
+		return nil, fmt.Errorf("diff: %w", err)
+	}
+	slices.SortFunc(d.changes, func(x, y Change) int { return strings.Compare(x.Name, y.Name) })
+	return d.changes, nil
+}
+
+type differ struct {
+	a, b    Backend
+	changes []Change
+}
+
+// entry compares name, held in both trees, and what is under it.
+func (d *differ) entry(name string) error {
+	fa, err := d.a.Lstat(name)
+	if err != nil {
+		return err
+	}
+	fb, err := d.b.Lstat(name)
+	if err != nil {
+		return err
+	}
+	before, err := digest(d.a, name, fa)
+	if err != nil {
+		return err
+	}
+	after, err := digest(d.b, name, fb)
+	if err != nil {
+		return err
+	}
+	if fa.Mode() != fb.Mode() || before != after {
+		d.changes = append(d.changes, Change{Name: name, Kind: Modified, Before: before, After: after})
+	}
+	switch {
+	case fa.IsDir() && fb.IsDir():
+		return d.dir(name)
+	case fa.IsDir():
+		return d.all(d.a, name, Deleted)
+	case fb.IsDir():
+		return d.all(d.b, name, Created)
+	}
+	return nil
+}
+
+// dir compares the entries of the directory name, held in both trees.
+func (d *differ) dir(name string) error {
+	ea, err := d.a.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	eb, err := d.b.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	in := make(map[string]bool, len(eb))
+	for _, e := range eb {
+		in[e.Name()] = true
+	}
+	for _, e := range ea {
+		child := path.Join(name, e.Name())
+		if in[e.Name()] {
+			delete(in, e.Name())
+			if err := d.entry(child); err != nil {
+				return err
+			}
+		} else if err := d.one(d.a, child, Deleted); err != nil {
+			return err
+		}
+	}
+	for _, e := range eb {
+		if !in[e.Name()] {
+			continue
+		}
+		if err := d.one(d.b, path.Join(name, e.Name()), Created); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// one reports name, held only in the tree b, as kind, and everything under
+// it too.
+func (d *differ) one(b Backend, name string, kind ChangeKind) error {
+	fi, err := b.Lstat(name)
+	if err != nil {
+		return err
+	}
+	sum, err := digest(b, name, fi)
+	if err != nil {
+		return err
+	}
+	c := Change{Name: name, Kind: kind}
+	if kind == Deleted {
+		c.Before = sum
+	} else {
+		c.After = sum
+	}
+	d.changes = append(d.changes, c)
+	if fi.IsDir() {
+		return d.all(b, name, kind)
+	}
+	return nil
+}
+
+// all reports everything under the directory name in the tree b as kind.
+func (d *differ) all(b Backend, name string, kind ChangeKind) error {
+	entries, err := b.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := d.one(b, path.Join(name, e.Name()), kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// digest returns the hex SHA-256 digest of the contents of the entry
+// name, described by fi, or "" if it is not a regular file or symlink.
+func digest(b Backend, name string, fi fs.FileInfo) (string, error) {
+	h := sha256.New()
+	switch {
+	case fi.Mode().IsRegular():
+		f, err := b.Open(name, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+	case fi.Mode()&fs.ModeSymlink != 0:
+		target, err := b.Readlink(name)
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(h, target)
+	default:
+		return "", nil
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
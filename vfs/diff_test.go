@@ -0,0 +1,107 @@
+package vfs_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+)
+
+func sum(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func TestDiff(t *testing.T) {
+	before := memfs.New()
+	before.Mkdir("d", 0o755)
+	before.Mkdir("gone", 0o755)
+	before.Mkdir("was-dir", 0o755)
+	writeFile(t, before, "same", "same")
+	writeFile(t, before, "rewritten", "same")
+	writeFile(t, before, "mod", "old")
+	writeFile(t, before, "chmod", "x")
+	writeFile(t, before, "d/del", "del")
+	writeFile(t, before, "gone/a", "a")
+	writeFile(t, before, "was-dir/b", "b")
+	before.Symlink("mod", "link")
+
+	var archive bytes.Buffer
+	if err := vfs.Snapshot(before, &archive); err != nil {
+		t.Fatal(err)
+	}
+	after := memfs.New()
+	if err := vfs.Restore(after, &archive); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := vfs.Diff(before, after); err != nil || len(got) != 0 {
+		t.Fatalf("restored tree differs: %v, %v", got, err)
+	}
+
+	writeFile(t, after, "rewritten", "same")
+	writeFile(t, after, "mod", "new")
+	after.Chmod("chmod", 0o755)
+	after.Unlink("d/del")
+	writeFile(t, after, "d/new", "new")
+	after.Unlink("gone/a")
+	after.Rmdir("gone")
+	after.Unlink("was-dir/b")
+	after.Rmdir("was-dir")
+	writeFile(t, after, "was-dir", "now a file")
+	after.Mkdir("added", 0o755)
+	writeFile(t, after, "added/z", "z")
+	after.Unlink("link")
+	after.Symlink("d/new", "link")
+
+	got, err := vfs.Diff(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []vfs.Change{
+		{Name: "added", Kind: vfs.Created},
+		{Name: "added/z", Kind: vfs.Created, After: sum("z")},
+		{Name: "chmod", Kind: vfs.Modified, Before: sum("x"), After: sum("x")},
+		{Name: "d/del", Kind: vfs.Deleted, Before: sum("del")},
+		{Name: "d/new", Kind: vfs.Created, After: sum("new")},
+		{Name: "gone", Kind: vfs.Deleted},
+		{Name: "gone/a", Kind: vfs.Deleted, Before: sum("a")},
+		{Name: "link", Kind: vfs.Modified, Before: sum("mod"), After: sum("d/new")},
+		{Name: "mod", Kind: vfs.Modified, Before: sum("old"), After: sum("new")},
+		{Name: "was-dir", Kind: vfs.Modified, After: sum("now a file")},
+		{Name: "was-dir/b", Kind: vfs.Deleted, Before: sum("b")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestDiffDir(t *testing.T) {
+	// Backends of different kinds compare by what they hold.
+	host := vfs.Dir(t.TempDir())
+	host.Mkdir("d", 0o755)
+	writeFile(t, host, "d/f", "data")
+	mem := memfs.New()
+	mem.Chmod(".", 0o755)
+	host.Chmod(".", 0o755)
+	mem.Mkdir("d", 0o755)
+	writeFile(t, mem, "d/f", "data")
+	got, err := vfs.Diff(host, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("got %v", got)
+	}
+	writeFile(t, mem, "d/f", "other")
+	got, err = vfs.Diff(host, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Name != "d/f" || got[0].Kind != vfs.Modified {
+		t.Errorf("got %v", got)
+	}
+}
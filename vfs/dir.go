@@ -0,0 +1,297 @@
+package vfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Dir is a Backend that stores files under a directory of the host
+// filesystem. It keeps extended attributes in those of the files.
+//
+// Names are resolved below a descriptor of the directory with openat2 and
+// RESOLVE_BENEATH, so that a symlink in the tree cannot lead out of it:
+// one that would, being absolute or climbing above the directory, fails
+// with EXDEV. Each call opens the directory anew, Dir being its path. A
+// name's directory is opened that way and the name looked up through it,
+// or the file opened itself where a final symlink is to be followed.
+// Kernels without openat2 resolve names as openat would.
+type Dir string
+
+var (
+	_ Backend  = Dir("")
+	_ Xattrer  = Dir("")
+	_ StatFSer = Dir("")
+	_ Socketer = Dir("")
+)
+
+// open opens name below d with flags, and mode if it creates the file. The
+// name "." opens d itself, which need not be a directory.
+func (d Dir) open(name string, flags int, mode uint32) (int, error) {
+	if name == "." {
+		return unix.Open(string(d), flags|unix.O_CLOEXEC, mode)
+	}
+	root, err := unix.Open(string(d), unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	defer unix.Close(root)
+	how := unix.OpenHow{Flags: uint64(flags | unix.O_CLOEXEC), Resolve: unix.RESOLVE_BENEATH}
+	if flags&(unix.O_CREAT|unix.O_TMPFILE) != 0 {
+		how.Mode = uint64(mode)
+	}
+	fd, err := unix.Openat2(root, name, &how)
+	if err == unix.ENOSYS {
+		fd, err = unix.Openat(root, name, flags|unix.O_CLOEXEC, mode)
+	}
+	return fd, err
+}
+
+// at calls fn with the path, through a descriptor of the directory of
+// name opened below d, of name.
+func (d Dir) at(op, name string, fn func(p string) error) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: syscall.EINVAL}
+	}
+	dir, err := d.open(path.Dir(name), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	defer unix.Close(dir)
+	return named(fn(fdPath(dir)+"/"+path.Base(name)), op, name)
+}
+
+// pinned calls fn with the path, through a descriptor of it, of the named
+// file, following a final symlink.
+func (d Dir) pinned(op, name string, fn func(p string) error) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: syscall.EINVAL}
+	}
+	fd, err := d.open(name, unix.O_PATH, 0)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	defer unix.Close(fd)
+	return named(fn(fdPath(fd)), op, name)
+}
+
+// fdPath returns the path through which the file open at fd is reached.
+func fdPath(fd int) string { return "/proc/self/fd/" + strconv.Itoa(fd) }
+
+// named returns err, from a call on a path through a descriptor, as the
+// error of op on name.
+func named(err error, op, name string) error {
+	var pe *fs.PathError
+	var le *os.LinkError
+	switch {
+	case errors.As(err, &pe):
+		return &fs.PathError{Op: op, Path: name, Err: pe.Err}
+	case errors.As(err, &le):
+		return &fs.PathError{Op: op, Path: name, Err: le.Err}
+	case err != nil:
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+// namedInfo is what is known of a file reached through a descriptor, by
+// the name it was asked for.
+type namedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi namedInfo) Name() string { return fi.name }
+
+func (d Dir) Open(name string, flag int, perm fs.FileMode) (File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EINVAL}
+	}
+	fd, err := d.open(name, flag, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(string(d), filepath.FromSlash(name))), nil
+}
+
+func (d Dir) Stat(name string) (fs.FileInfo, error) {
+	var fi fs.FileInfo
+	err := d.pinned("stat", name, func(p string) error {
+		var err error
+		fi, err = os.Stat(p)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return namedInfo{fi, path.Base(name)}, nil
+}
+
+func (d Dir) Lstat(name string) (fs.FileInfo, error) {
+	var fi fs.FileInfo
+	err := d.at("lstat", name, func(p string) error {
+		var err error
+		fi, err = os.Lstat(p)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return namedInfo{fi, path.Base(name)}, nil
+}
+
+func (d Dir) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := d.Open(name, os.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, named(err, "readdir", name)
+	}
+	defer f.Close()
+	entries, err := f.(*os.File).ReadDir(-1)
+	if err != nil {
+		return nil, named(err, "readdir", name)
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+func (d Dir) Mkdir(name string, perm fs.FileMode) error {
+	return d.at("mkdir", name, func(p string) error { return os.Mkdir(p, perm) })
+}
+
+func (d Dir) Unlink(name string) error {
+	return d.at("unlink", name, syscall.Unlink)
+}
+
+func (d Dir) Rmdir(name string) error {
+	return d.at("rmdir", name, syscall.Rmdir)
+}
+
+func (d Dir) Rename(oldname, newname string) error {
+	return d.at("rename", oldname, func(oldp string) error {
+		return d.at("rename", newname, func(newp string) error { return os.Rename(oldp, newp) })
+	})
+}
+
+func (d Dir) Link(oldname, newname string) error {
+	return d.at("link", oldname, func(oldp string) error {
+		return d.at("link", newname, func(newp string) error { return os.Link(oldp, newp) })
+	})
+}
+
+func (d Dir) Symlink(target, newname string) error {
+	return d.at("symlink", newname, func(p string) error { return os.Symlink(target, p) })
+}
+
+func (d Dir) Readlink(name string) (string, error) {
+	var target string
+	err := d.at("readlink", name, func(p string) error {
+		var err error
+		target, err = os.Readlink(p)
+		return err
+	})
+	return target, err
+}
+
+func (d Dir) Chmod(name string, mode fs.FileMode) error {
+	return d.pinned("chmod", name, func(p string) error { return os.Chmod(p, mode) })
+}
+
+func (d Dir) Chtimes(name string, atime, mtime time.Time) error {
+	return d.pinned("chtimes", name, func(p string) error { return os.Chtimes(p, atime, mtime) })
+}
+
+func (d Dir) Getxattr(name, attr string) ([]byte, error) {
+	var v []byte
+	err := d.pinned("getxattr", name, func(p string) error {
+		// The value may grow between asking its size and reading it.
+		for {
+			n, err := syscall.Getxattr(p, attr, nil)
+			if err != nil {
+				return err
+			}
+			b := make([]byte, n)
+			n, err = syscall.Getxattr(p, attr, b)
+			if err == syscall.ERANGE {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			v = b[:n]
+			return nil
+		}
+	})
+	return v, err
+}
+
+func (d Dir) Setxattr(name, attr string, value []byte, flags int) error {
+	return d.pinned("setxattr", name, func(p string) error {
+		return syscall.Setxattr(p, attr, value, flags)
+	})
+}
+
+func (d Dir) Listxattr(name string) ([]string, error) {
+	var attrs []string
+	err := d.pinned("listxattr", name, func(p string) error {
+		for {
+			n, err := syscall.Listxattr(p, nil)
+			if err != nil {
+				return err
+			}
+			b := make([]byte, n)
+			n, err = syscall.Listxattr(p, b)
+			if err == syscall.ERANGE {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, a := range strings.Split(string(b[:n]), "\x00") {
+				if a != "" {
+					attrs = append(attrs, a)
+				}
+			}
+			slices.Sort(attrs)
+			return nil
+		}
+	})
+	return attrs, err
+}
+
+// StatFS describes the host filesystem the named file is on.
+func (d Dir) StatFS(name string) (FSStat, error) {
+	var st FSStat
+	err := d.pinned("statfs", name, func(p string) error {
+		var err error
+		st, err = HostStatFS(p)
+		return err
+	})
+	return st, err
+}
+
+// SocketPath returns the host path of the named file, in the directory
+// its directory resolves to below d.
+func (d Dir) SocketPath(name string) (string, error) {
+	var sp string
+	err := d.at("socket", name, func(p string) error {
+		dir, err := os.Readlink(path.Dir(p))
+		sp = filepath.Join(dir, path.Base(p))
+		return err
+	})
+	return sp, err
+}
+
+func (d Dir) Removexattr(name, attr string) error {
+	return d.pinned("removexattr", name, func(p string) error {
+		return syscall.Removexattr(p, attr)
+	})
+}
@@ -0,0 +1,118 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestDir(t *testing.T) {
+	d := Dir(t.TempDir())
+	if err := d.Mkdir("sub", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := d.Open("sub/a.txt", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("read back %q, %v", b, err)
+	}
+	f.Close()
+
+	if err := d.Rename("sub/a.txt", "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := d.ReadDir(".")
+	if err != nil || len(entries) != 2 || entries[0].Name() != "b.txt" {
+		t.Fatalf("unexpected entries %v, %v", entries, err)
+	}
+	if err := d.Link("b.txt", "hard"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Unlink("hard"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Symlink("b.txt", "link"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := d.Readlink("link"); err != nil || target != "b.txt" {
+		t.Errorf("readlink: %q, %v", target, err)
+	}
+	if fi, err := d.Lstat("link"); err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("lstat: %v, %v", fi, err)
+	}
+	if err := d.Unlink("link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Rmdir("b.txt"); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("rmdir of a file: got %v", err)
+	}
+	if err := d.Unlink("b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat("b.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat after unlink: got %v", err)
+	}
+	if _, err := d.Open("../escape", os.O_RDONLY, 0); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("open outside the root: got %v", err)
+	}
+}
+
+func TestDirBeneath(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(outside+"/secret", []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d := Dir(t.TempDir())
+	if err := d.Mkdir("sub", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := d.Open("sub/a.txt", os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	for target, name := range map[string]string{outside: "abs", "../../" + outside: "up", "../sub": "inside"} {
+		if err := d.Symlink(target, "sub/"+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := d.Stat("sub/inside/a.txt"); err != nil {
+		t.Errorf("stat through a symlink inside the root: %v", err)
+	}
+	for _, name := range []string{"sub/abs/secret", "sub/up/secret"} {
+		if _, err := d.Open(name, os.O_RDONLY, 0); !errors.Is(err, syscall.EXDEV) {
+			t.Errorf("open %s: got %v, want EXDEV", name, err)
+		}
+		if _, err := d.Stat(name); !errors.Is(err, syscall.EXDEV) {
+			t.Errorf("stat %s: got %v, want EXDEV", name, err)
+		}
+		if err := d.Chmod(name, 0o777); !errors.Is(err, syscall.EXDEV) {
+			t.Errorf("chmod %s: got %v, want EXDEV", name, err)
+		}
+		if err := d.Unlink(name); !errors.Is(err, syscall.EXDEV) {
+			t.Errorf("unlink %s: got %v, want EXDEV", name, err)
+		}
+	}
+	if _, err := d.Stat("sub/abs"); !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("stat of a final symlink out of the root: got %v, want EXDEV", err)
+	}
+	if fi, err := d.Lstat("sub/abs"); err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("lstat of a symlink out of the root: %v, %v", fi, err)
+	}
+	if _, err := os.Stat(outside + "/secret"); err != nil {
+		t.Fatal(err)
+	}
+}
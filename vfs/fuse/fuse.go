@@ -0,0 +1,460 @@
+// Package fuse serves a vfs.Backend as a FUSE filesystem mounted on the
+// host, so that processes the tracer does not trace can see and change the
+// tree its command sees: a helper collecting the command's output, say,
+// or someone looking into it from a shell while it runs.
+//
+// The kernel is told to cache nothing, neither names, attributes nor file
+// contents, so that each side sees at once what the other changes. To
+// order the operations of the mount with those of a tracer as those of
+// processes sharing a kernel filesystem are ordered, give both the same
+// shared.FS; advisory locks are still kept apart, by the kernel for the
+// mount and by the tracer for its command.
+//
+// Mounting takes CAP_SYS_ADMIN, or an unprivileged user can mount with
+// fusermount3 or fusermount, which Mount looks for on the PATH. The kernel
+// checks permissions against the modes and owners the backend reports,
+// and the backend is used as the user that mounted it. Only regular files,
+// directories and symlinks can be made through the mount.
+package fuse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// Options configures a mount.
+type Options struct {
+	// ReadOnly mounts the tree read-only.
+	ReadOnly bool
+	// AllowOther lets users other than the one mounting use the mount,
+	// which fusermount allows only if /etc/fuse.conf has
+	// user_allow_other.
+	AllowOther bool
+}
+
+// Server serves a backend at a mount point.
+type Server struct {
+	b        vfs.Backend
+	dir      string
+	dev      *os.File
+	uid, gid uint32
+	// fusermount is the program that mounted the tree, which unmounts it
+	// too, if mount(2) was not allowed.
+	fusermount string
+	bufs       sync.Pool
+	// wg counts the requests being served, and done is closed once serve
+	// has returned.
+	wg   sync.WaitGroup
+	done chan struct{}
+
+	mu sync.Mutex
+	// nodes holds the nodes the kernel knows of, by ID, and ids their IDs
+	// by name.
+	nodes   map[uint64]*node
+	ids     map[string]uint64
+	nextID  uint64
+	handles map[uint64]*handle
+	nextFh  uint64
+}
+
+// node is a name the kernel has looked up, and how many times.
+type node struct {
+	name    string
+	lookups uint64
+}
+
+// handle is a file or directory the kernel has open.
+type handle struct {
+	mu      sync.Mutex
+	f       vfs.File
+	append  bool
+	entries []dirent
+}
+
+type dirent struct {
+	name string
+	mode fs.FileMode
+}
+
+// Mount mounts b at dir, which must be a directory, and serves it until
+// Close.
+func Mount(dir string, b vfs.Backend, opts Options) (*Server, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		b:       b,
+		dir:     dir,
+		uid:     uint32(os.Getuid()),
+		gid:     uint32(os.Getgid()),
+		nodes:   map[uint64]*node{rootID: {name: ".", lookups: 1}},
+		ids:     map[string]uint64{".": rootID},
+		nextID:  rootID + 1,
+		handles: make(map[uint64]*handle),
+		nextFh:  1,
+		done:    make(chan struct{}),
+	}
+	s.bufs.New = func() any { b := make([]byte, bufSize); return &b }
+	if err := s.mount(opts); err != nil {
+		return nil, fmt.Errorf("fuse: mount %s: %w", dir, err)
+	}
+	go s.serve()
+	if err := s.pollHack(); err != nil {
+		_ = s.Close()
+		return nil, fmt.Errorf("fuse: mount %s: %w", dir, err)
+	}
+	return s, nil
+}
+
+// pollHackName names a file in the root, outside the backend, that Mount
+// has the kernel poll, so that it learns the server does not answer polls
+// before a file in the tree is opened by the process serving it. The
+// runtime's poller adds each file a Go program opens to an epoll set, and
+// the kernel would ask the server to poll a file in the tree, while the
+// thread asking holds on to what the server needs to answer: with
+// GOMAXPROCS at 1, the only P.
+const (
+	pollHackName = ".cfc-ptrace-poll"
+	pollHackID   = 1 << 63
+)
+
+func (s *Server) pollHack() error {
+	fd, err := unix.Open(filepath.Join(s.dir, pollHackName), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	ep, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(ep)
+	// The poll request is answered with ENOSYS, which the kernel takes as
+	// the answer for every file; whether the file is added hardly matters.
+	// unix.EpollCtl is a raw system call, which would keep the P the
+	// server needs to answer.
+	ev := unix.EpollEvent{Events: unix.EPOLLIN}
+	_, _, _ = unix.Syscall6(unix.SYS_EPOLL_CTL, uintptr(ep), unix.EPOLL_CTL_ADD, uintptr(fd), uintptr(unsafe.Pointer(&ev)), 0, 0)
+	return nil
+}
+
+// pollHackInfo describes the file of pollHackName.
+type pollHackInfo struct{}
+
+func (pollHackInfo) Name() string       { return pollHackName }
+func (pollHackInfo) Size() int64        { return 0 }
+func (pollHackInfo) Mode() fs.FileMode  { return 0o444 }
+func (pollHackInfo) ModTime() time.Time { return time.Unix(0, 0) }
+func (pollHackInfo) IsDir() bool        { return false }
+func (pollHackInfo) Sys() any           { return nil }
+
+// mount mounts the tree with mount(2) if it may, or with fusermount.
+func (s *Server) mount(opts Options) error {
+	fd, err := unix.Open("/dev/fuse", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	data := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d,default_permissions", fd, s.uid, s.gid)
+	if opts.AllowOther {
+		data += ",allow_other"
+	}
+	flags := uintptr(unix.MS_NOSUID | unix.MS_NODEV)
+	if opts.ReadOnly {
+		flags |= unix.MS_RDONLY
+	}
+	err = unix.Mount("cfc-ptrace", s.dir, "fuse.cfc-ptrace", flags, data)
+	if err == nil {
+		s.dev = os.NewFile(uintptr(fd), "/dev/fuse")
+		return nil
+	}
+	_ = unix.Close(fd)
+	if err != unix.EPERM {
+		return err
+	}
+	return s.fusermountMount(opts)
+}
+
+// fusermountMount has fusermount mount the tree, and receives the
+// descriptor of /dev/fuse it opened over a socket, as libfuse does.
+func (s *Server) fusermountMount(opts Options) error {
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		if p, err := exec.LookPath(name); err == nil {
+			s.fusermount = p
+			break
+		}
+	}
+	if s.fusermount == "" {
+		return errors.New("mounting takes CAP_SYS_ADMIN or fusermount")
+	}
+	o := []string{"fsname=cfc-ptrace", "subtype=cfc-ptrace", "default_permissions", "nosuid", "nodev"}
+	if opts.ReadOnly {
+		o = append(o, "ro")
+	}
+	if opts.AllowOther {
+		o = append(o, "allow_other")
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fds[0])
+	remote := os.NewFile(uintptr(fds[1]), "fusermount")
+	var stderr bytes.Buffer
+	cmd := exec.Command(s.fusermount, "-o", strings.Join(o, ","), "--", s.dir)
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	remote.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", s.fusermount, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	oob := make([]byte, unix.CmsgSpace(4))
+	_, oobn, _, _, err := unix.Recvmsg(fds[0], make([]byte, 1), oob, 0)
+	if err != nil {
+		return err
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) == 0 {
+		return fmt.Errorf("%s sent no descriptor", s.fusermount)
+	}
+	rights, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil || len(rights) != 1 {
+		return fmt.Errorf("%s sent no descriptor", s.fusermount)
+	}
+	unix.CloseOnExec(rights[0])
+	if err := unix.SetNonblock(rights[0], false); err != nil {
+		return err
+	}
+	s.dev = os.NewFile(uintptr(rights[0]), "/dev/fuse")
+	return nil
+}
+
+// Close unmounts the tree and returns once the requests being served
+// have been answered, closing the files left open. A mount still in use is
+// unmounted lazily instead: Close returns at once, and the files open in
+// it are served until the last is closed.
+func (s *Server) Close() error {
+	busy, err := s.unmount()
+	if err != nil {
+		return fmt.Errorf("fuse: unmount %s: %w", s.dir, err)
+	}
+	if !busy {
+		<-s.done
+	}
+	return nil
+}
+
+// unmount unmounts the tree, lazily if it is busy.
+func (s *Server) unmount() (busy bool, err error) {
+	if s.fusermount != "" {
+		if exec.Command(s.fusermount, "-u", "--", s.dir).Run() == nil {
+			return false, nil
+		}
+		if out, err := exec.Command(s.fusermount, "-u", "-z", "--", s.dir).CombinedOutput(); err != nil {
+			return false, fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+		}
+		return true, nil
+	}
+	err = unix.Unmount(s.dir, 0)
+	if err == unix.EBUSY {
+		return true, unix.Unmount(s.dir, unix.MNT_DETACH)
+	}
+	return false, err
+}
+
+// serve reads requests until the kernel lets go of the tree, serving each
+// on a goroutine of its own.
+//
+// The device is read without the runtime's poller: a process reading
+// files in the tree it serves has the poller ask the kernel whether they
+// can be polled, and the kernel asks the server, which must be reading to
+// hear it.
+func (s *Server) serve() {
+	defer close(s.done)
+	for {
+		buf := s.bufs.Get().(*[]byte)
+		n, err := s.dev.Read(*buf)
+		if err != nil {
+			s.bufs.Put(buf)
+			// ENOENT is a request interrupted before it was read.
+			if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.ENOENT) {
+				continue
+			}
+			// ENODEV once the tree is unmounted.
+			break
+		}
+		req, err := parseRequest((*buf)[:n])
+		if err != nil {
+			s.bufs.Put(buf)
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.bufs.Put(buf)
+			s.handle(req)
+		}()
+	}
+	s.wg.Wait()
+	s.dev.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for fh, h := range s.handles {
+		if h.f != nil {
+			_ = h.f.Close()
+		}
+		delete(s.handles, fh)
+	}
+}
+
+// reply answers the request unique with out, or with errno if it is
+// non-zero.
+func (s *Server) reply(unique uint64, errno syscall.Errno, out []byte) {
+	if errno != 0 {
+		out = nil
+	}
+	e := make(encoder, 0, outHeaderSize+len(out))
+	e.u32(uint32(outHeaderSize + len(out)))
+	e.u32(uint32(-int32(errno)))
+	e.u64(unique)
+	// A reply to a request interrupted meanwhile fails with ENOENT, and
+	// one after the tree has gone fails too; neither is news.
+	_, _ = s.dev.Write(append(e, out...))
+}
+
+// name returns the name of node id.
+func (s *Server) name(id uint64) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nodes[id]
+	if !ok {
+		return "", syscall.ESTALE
+	}
+	return n.name, nil
+}
+
+// child returns the name of the entry called name in directory node id.
+func (s *Server) child(id uint64, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", syscall.EINVAL
+	}
+	dir, err := s.name(id)
+	if err != nil {
+		return "", err
+	}
+	if dir == "." {
+		return name, nil
+	}
+	return dir + "/" + name, nil
+}
+
+// lookup returns the ID of the node for name, counting the lookup the
+// kernel will forget.
+func (s *Server) lookup(name string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.ids[name]
+	if !ok {
+		id = s.nextID
+		s.nextID++
+		s.ids[name] = id
+		s.nodes[id] = &node{name: name}
+	}
+	s.nodes[id].lookups++
+	return id
+}
+
+// forget forgets n lookups of node id.
+func (s *Server) forget(id, n uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nd, ok := s.nodes[id]
+	if !ok || id == rootID {
+		return
+	}
+	nd.lookups -= min(n, nd.lookups)
+	if nd.lookups == 0 {
+		delete(s.nodes, id)
+		if s.ids[nd.name] == id {
+			delete(s.ids, nd.name)
+		}
+	}
+}
+
+// removed drops name, which has just been removed, so that a new file of
+// that name gets a node of its own. Nodes the kernel still knows keep the
+// name until forgotten.
+func (s *Server) removed(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.ids, name)
+}
+
+// renamed moves the nodes of oldname and everything below it to newname.
+func (s *Server) renamed(oldname, newname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.ids, newname)
+	for id, n := range s.nodes {
+		rest, ok := strings.CutPrefix(n.name, oldname)
+		if !ok || (rest != "" && rest[0] != '/') {
+			continue
+		}
+		if s.ids[n.name] == id {
+			delete(s.ids, n.name)
+		}
+		n.name = newname + rest
+		s.ids[n.name] = id
+	}
+}
+
+// open adds h to the open handles and returns its number.
+func (s *Server) open(h *handle) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fh := s.nextFh
+	s.nextFh++
+	s.handles[fh] = h
+	return fh
+}
+
+// handleOf returns open handle fh.
+func (s *Server) handleOf(fh uint64) (*handle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.handles[fh]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	return h, nil
+}
+
+// release closes handle fh.
+func (s *Server) release(fh uint64) error {
+	s.mu.Lock()
+	h, ok := s.handles[fh]
+	delete(s.handles, fh)
+	s.mu.Unlock()
+	if !ok || h.f == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.f.Close()
+}
@@ -0,0 +1,171 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/shared"
+)
+
+// mount mounts b at a temporary directory, skipping the test where FUSE
+// cannot be mounted.
+func mount(t *testing.T, b vfs.Backend, opts Options) string {
+	dir := t.TempDir()
+	s, err := Mount(dir, b, opts)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return dir
+}
+
+func TestFiles(t *testing.T) {
+	m := memfs.New()
+	dir := mount(t, m, Options{})
+	p := func(name string) string { return filepath.Join(dir, name) }
+
+	if err := os.WriteFile(p("f"), []byte("hello\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(p("f"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("again\n"))
+	f.Close()
+	if b, err := os.ReadFile(p("f")); string(b) != "hello\nagain\n" {
+		t.Errorf("read %q, %v", b, err)
+	}
+	// What the mount wrote is in the backend.
+	if fi, err := m.Stat("f"); err != nil || fi.Size() != 12 || fi.Mode().Perm() != 0o644 {
+		t.Errorf("backend has %v, %v", fi, err)
+	}
+
+	if err := os.MkdirAll(p("d/e"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(p("f"), p("d/e/g")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("e/g", p("d/link")); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(p("d/link")); target != "e/g" || err != nil {
+		t.Errorf("readlink %q, %v", target, err)
+	}
+	if b, err := os.ReadFile(p("d/link")); string(b) != "hello\nagain\n" {
+		t.Errorf("read through symlink %q, %v", b, err)
+	}
+	if err := os.Truncate(p("d/e/g"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(p("d/e/g"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(p("d/e/g")); err != nil || fi.Size() != 5 || fi.Mode() != 0o600 {
+		t.Errorf("stat %v, %v", fi, err)
+	}
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.Chtimes(p("d/e/g"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := m.Stat("d/e/g"); err != nil || !fi.ModTime().Equal(mtime) {
+		t.Errorf("backend has %v, %v", fi, err)
+	}
+	entries, err := os.ReadDir(p("d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if !slices.Equal(names, []string{"e", "link"}) {
+		t.Errorf("entries %q", names)
+	}
+
+	// What the backend changes the mount sees at once.
+	if err := m.Mkdir("fresh", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(p("fresh")); err != nil || !fi.IsDir() {
+		t.Errorf("stat of a new directory %v, %v", fi, err)
+	}
+
+	if err := os.Remove(p("d/e")); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("removing a full directory: %v", err)
+	}
+	for _, name := range []string{"d/link", "d/e/g", "d/e", "d"} {
+		if err := os.Remove(p(name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(p("d")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat of a removed directory: %v", err)
+	}
+	if err := syscall.Mkfifo(p("fifo"), 0o644); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("mkfifo: %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	m := memfs.New()
+	f, _ := m.Open("f", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Write([]byte("data"))
+	f.Close()
+	dir := mount(t, m, Options{ReadOnly: true})
+	if b, err := os.ReadFile(filepath.Join(dir, "f")); string(b) != "data" {
+		t.Errorf("read %q, %v", b, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "g"), nil, 0o644); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("write to a read-only mount: %v", err)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	// The tracer and the mount share one backend, ordered by a shared.FS.
+	b := shared.New(memfs.New())
+	dir := mount(t, b, Options{})
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `echo from the command >/mem/out
+while [ ! -e /mem/in ]; do sleep 0.01; done
+cat /mem/in`)
+	cmd.Stdout = &stdout
+	tr := tracer.New(cmd, tracer.WithMount("/mem", b))
+	if err := tr.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// An untraced process sees the command's file through the mount, and
+	// the command the one it writes.
+	var got []byte
+	for deadline := time.Now().Add(5 * time.Second); len(got) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		got, _ = os.ReadFile(filepath.Join(dir, "out"))
+	}
+	if string(got) != "from the command\n" {
+		t.Errorf("read %q through the mount", got)
+	}
+	if err := exec.Command("/bin/sh", "-c", "echo from the host >"+filepath.Join(dir, "in")).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != "from the host\n" {
+		t.Errorf("the command read %q", got)
+	}
+}
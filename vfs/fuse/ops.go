@@ -0,0 +1,559 @@
+package fuse
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// handle serves req and replies to it, if it takes a reply.
+func (s *Server) handle(req request) {
+	d := &decoder{b: req.body}
+	switch req.opcode {
+	case opForget:
+		s.forget(req.node, d.u64())
+		return
+	case opBatchForget:
+		n := d.u32()
+		d.u32()
+		for range n {
+			id, lookups := d.u64(), d.u64()
+			if d.short {
+				break
+			}
+			s.forget(id, lookups)
+		}
+		return
+	case opInterrupt:
+		// Requests are served to the end, which the kernel waits for.
+		return
+	}
+	var (
+		out []byte
+		err error
+	)
+	if req.node == pollHackID || (req.opcode == opLookup && req.node == rootID && string(req.body) == pollHackName+"\x00") {
+		out, err = s.pollHackReply(req.opcode)
+	} else {
+		out, err = s.serve1(req, d)
+	}
+	if err == nil && d.short {
+		err = syscall.EINVAL
+	}
+	var e syscall.Errno
+	if err != nil {
+		e = errno(err)
+	}
+	s.reply(req.unique, e, out)
+}
+
+// serve1 serves a request that takes a reply, with what it replies.
+func (s *Server) serve1(req request, d *decoder) ([]byte, error) {
+	switch req.opcode {
+	case opInit:
+		return s.init(d)
+	case opDestroy, opFlush, opFsyncdir:
+		return nil, nil
+	case opLookup:
+		name, err := s.child(req.node, d.str())
+		if err != nil {
+			return nil, err
+		}
+		return s.entryFor(name)
+	case opGetattr:
+		flags := d.u32()
+		d.u32()
+		fh := d.u64()
+		return s.getattr(req.node, flags&getattrFh != 0, fh)
+	case opSetattr:
+		return s.setattr(req.node, d)
+	case opReadlink:
+		name, err := s.name(req.node)
+		if err != nil {
+			return nil, err
+		}
+		target, err := s.b.Readlink(name)
+		return []byte(target), err
+	case opSymlink:
+		newname, target := d.str(), d.str()
+		name, err := s.child(req.node, newname)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.b.Symlink(target, name); err != nil {
+			return nil, err
+		}
+		return s.entryFor(name)
+	case opMknod:
+		mode := d.u32()
+		d.take(12) // rdev and umask, which the kernel has applied
+		name, err := s.child(req.node, d.str())
+		if err != nil {
+			return nil, err
+		}
+		if mode&syscall.S_IFMT != syscall.S_IFREG {
+			return nil, syscall.EPERM
+		}
+		f, err := s.b.Open(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileMode(mode))
+		if err != nil {
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+		return s.entryFor(name)
+	case opMkdir:
+		mode := d.u32()
+		d.u32() // umask, which the kernel has applied
+		name, err := s.child(req.node, d.str())
+		if err != nil {
+			return nil, err
+		}
+		if err := s.b.Mkdir(name, fileMode(mode)); err != nil {
+			return nil, err
+		}
+		return s.entryFor(name)
+	case opUnlink, opRmdir:
+		name, err := s.child(req.node, d.str())
+		if err != nil {
+			return nil, err
+		}
+		if req.opcode == opUnlink {
+			err = s.b.Unlink(name)
+		} else {
+			err = s.b.Rmdir(name)
+		}
+		if err == nil {
+			s.removed(name)
+		}
+		return nil, err
+	case opRename, opRename2:
+		newdir := d.u64()
+		var flags uint32
+		if req.opcode == opRename2 {
+			flags = d.u32()
+			d.u32()
+		}
+		return nil, s.rename(req.node, newdir, d.str(), d.str(), flags)
+	case opLink:
+		oldname, err := s.name(d.u64())
+		if err != nil {
+			return nil, err
+		}
+		name, err := s.child(req.node, d.str())
+		if err != nil {
+			return nil, err
+		}
+		if err := s.b.Link(oldname, name); err != nil {
+			return nil, err
+		}
+		return s.entryFor(name)
+	case opOpen:
+		flags := d.u32()
+		name, err := s.name(req.node)
+		if err != nil {
+			return nil, err
+		}
+		return s.openFile(name, int(flags)&^(os.O_CREATE|os.O_EXCL|syscall.O_NOCTTY), 0)
+	case opCreate:
+		flags, mode := d.u32(), d.u32()
+		d.u32() // umask, which the kernel has applied
+		d.u32()
+		name, err := s.child(req.node, d.str())
+		if err != nil {
+			return nil, err
+		}
+		open, err := s.openFile(name, int(flags)|os.O_CREATE, fileMode(mode))
+		if err != nil {
+			return nil, err
+		}
+		entry, err := s.entryFor(name)
+		if err != nil {
+			_ = s.release(decodeFh(open))
+			return nil, err
+		}
+		return append(entry, open...), nil
+	case opRead:
+		fh, off, size := d.u64(), d.u64(), d.u32()
+		return s.read(fh, int64(off), int(min(size, maxWrite)))
+	case opWrite:
+		fh, off, size := d.u64(), d.u64(), d.u32()
+		d.take(20) // write_flags, lock_owner, flags and padding
+		return s.write(fh, int64(off), d.take(int(size)))
+	case opRelease, opReleasedir:
+		return nil, s.release(d.u64())
+	case opFsync:
+		h, err := s.handleOf(d.u64())
+		if err != nil {
+			return nil, err
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return nil, vfs.Sync(h.f)
+	case opStatfs:
+		name, err := s.name(req.node)
+		if err != nil {
+			return nil, err
+		}
+		return s.statfs(name)
+	case opOpendir:
+		name, err := s.name(req.node)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := s.b.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		h := &handle{entries: []dirent{{".", fs.ModeDir}, {"..", fs.ModeDir}}}
+		for _, e := range entries {
+			h.entries = append(h.entries, dirent{e.Name(), e.Type()})
+		}
+		var e encoder
+		e.u64(s.open(h))
+		e.u32(0)
+		e.u32(0)
+		return e, nil
+	case opReaddir:
+		fh, off, size := d.u64(), d.u64(), d.u32()
+		return s.readdir(fh, off, int(size))
+	case opGetxattr, opListxattr:
+		size := d.u32()
+		d.u32()
+		name, err := s.name(req.node)
+		if err != nil {
+			return nil, err
+		}
+		var value []byte
+		if req.opcode == opGetxattr {
+			value, err = vfs.Getxattr(s.b, name, d.str())
+		} else {
+			var attrs []string
+			attrs, err = vfs.Listxattr(s.b, name)
+			for _, a := range attrs {
+				value = append(append(value, a...), 0)
+			}
+		}
+		switch {
+		case err != nil:
+			return nil, err
+		case size == 0:
+			var e encoder
+			e.u32(uint32(len(value)))
+			e.u32(0)
+			return e, nil
+		case len(value) > int(size):
+			return nil, syscall.ERANGE
+		}
+		return value, nil
+	case opSetxattr:
+		size, flags := d.u32(), d.u32()
+		name, err := s.name(req.node)
+		if err != nil {
+			return nil, err
+		}
+		attr := d.str()
+		return nil, vfs.Setxattr(s.b, name, attr, d.take(int(size)), int(flags))
+	case opRemovexattr:
+		name, err := s.name(req.node)
+		if err != nil {
+			return nil, err
+		}
+		return nil, vfs.Removexattr(s.b, name, d.str())
+	}
+	return nil, syscall.ENOSYS
+}
+
+// pollHackReply answers a request for the file of pollHackName, which is
+// opened with handle 0 and polled, and nothing else.
+func (s *Server) pollHackReply(opcode uint32) ([]byte, error) {
+	var e encoder
+	switch opcode {
+	case opLookup:
+		e.entry(pollHackID, pollHackInfo{}, s.uid, s.gid)
+	case opGetattr:
+		e = s.attrOut(pollHackID, pollHackInfo{})
+	case opOpen:
+		e = make(encoder, 16)
+	case opRelease, opFlush:
+	default:
+		return nil, syscall.ENOSYS
+	}
+	return e, nil
+}
+
+// init answers the kernel's first request, agreeing on the protocol.
+func (s *Server) init(d *decoder) ([]byte, error) {
+	major, minor, readahead, flags := d.u32(), d.u32(), d.u32(), d.u32()
+	d.rest()
+	if major != 7 {
+		return nil, syscall.EPROTO
+	}
+	var e encoder
+	e.u32(7)
+	e.u32(min(minor, protoMinor))
+	e.u32(readahead)
+	e.u32(flags & (initAsyncRead | initBigWrites))
+	e.u32(12<<16 | 16) // max_background, and congestion_threshold below it
+	e.u32(maxWrite)
+	e.u32(1) // time_gran, in nanoseconds
+	e = append(e, make([]byte, 64-len(e))...)
+	return e, nil
+}
+
+// entryFor looks name up, returning a struct fuse_entry_out for it.
+func (s *Server) entryFor(name string) ([]byte, error) {
+	fi, err := s.b.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	var e encoder
+	e.entry(s.lookup(name), fi, s.uid, s.gid)
+	return e, nil
+}
+
+// attrOut returns a struct fuse_attr_out describing node id as fi.
+func (s *Server) attrOut(id uint64, fi fs.FileInfo) []byte {
+	var e encoder
+	e.u64(0) // attr_valid
+	e.u32(0)
+	e.u32(0)
+	e.attr(id, fi, s.uid, s.gid)
+	return e
+}
+
+func (s *Server) getattr(id uint64, useFh bool, fh uint64) ([]byte, error) {
+	var (
+		fi  fs.FileInfo
+		err error
+	)
+	if h, herr := s.handleOf(fh); useFh && herr == nil && h.f != nil {
+		h.mu.Lock()
+		fi, err = h.f.Stat()
+		h.mu.Unlock()
+	} else {
+		var name string
+		if name, err = s.name(id); err == nil {
+			fi, err = s.b.Lstat(name)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.attrOut(id, fi), nil
+}
+
+func (s *Server) setattr(id uint64, d *decoder) ([]byte, error) {
+	valid := d.u32()
+	d.u32()
+	fh, size := d.u64(), d.u64()
+	d.u64() // lock_owner
+	atime, mtime := d.u64(), d.u64()
+	d.u64() // ctime
+	atimensec, mtimensec := d.u32(), d.u32()
+	d.u32() // ctimensec
+	mode := d.u32()
+	d.u32()
+	uid, gid := d.u32(), d.u32()
+	if d.short {
+		return nil, syscall.EINVAL
+	}
+	name, err := s.name(id)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := s.b.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	if valid&(fattrUID|fattrGID) != 0 {
+		// A backend has no way to change owners, so only the owners it
+		// has are accepted.
+		a := attrOf(fi, s.uid, s.gid)
+		if (valid&fattrUID != 0 && uid != a.Uid) || (valid&fattrGID != 0 && gid != a.Gid) {
+			return nil, syscall.EPERM
+		}
+	}
+	if valid&fattrMode != 0 {
+		if err := s.b.Chmod(name, fileMode(mode)); err != nil {
+			return nil, err
+		}
+	}
+	if valid&fattrSize != 0 {
+		if err := s.truncate(name, valid&fattrFh != 0, fh, int64(size)); err != nil {
+			return nil, err
+		}
+	}
+	if valid&(fattrAtime|fattrMtime) != 0 {
+		var at, mt time.Time
+		now := time.Now()
+		switch {
+		case valid&fattrAtimeNow != 0:
+			at = now
+		case valid&fattrAtime != 0:
+			at = time.Unix(int64(atime), int64(atimensec))
+		}
+		switch {
+		case valid&fattrMtimeNow != 0:
+			mt = now
+		case valid&fattrMtime != 0:
+			mt = time.Unix(int64(mtime), int64(mtimensec))
+		}
+		if err := s.b.Chtimes(name, at, mt); err != nil {
+			return nil, err
+		}
+	}
+	if fi, err = s.b.Lstat(name); err != nil {
+		return nil, err
+	}
+	return s.attrOut(id, fi), nil
+}
+
+// truncate changes the size of name, through handle fh if useFh is set.
+func (s *Server) truncate(name string, useFh bool, fh uint64, size int64) error {
+	if h, err := s.handleOf(fh); useFh && err == nil && h.f != nil {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return vfs.Truncate(h.f, size)
+	}
+	f, err := s.b.Open(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = vfs.Truncate(f, size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *Server) rename(olddir, newdir uint64, oldname, newname string, flags uint32) error {
+	from, err := s.child(olddir, oldname)
+	if err != nil {
+		return err
+	}
+	to, err := s.child(newdir, newname)
+	if err != nil {
+		return err
+	}
+	switch flags {
+	case 0:
+	case renameNoreplace:
+		// Not atomic with the rename, unless the backend is a
+		// shared.FS whose other users wait for the directory.
+		if _, err := s.b.Lstat(to); err == nil {
+			return syscall.EEXIST
+		}
+	default:
+		return syscall.EINVAL
+	}
+	if err := s.b.Rename(from, to); err != nil {
+		return err
+	}
+	s.renamed(from, to)
+	return nil
+}
+
+// openFile opens name, returning a struct fuse_open_out for the handle.
+func (s *Server) openFile(name string, flags int, perm fs.FileMode) ([]byte, error) {
+	f, err := s.b.Open(name, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+	var e encoder
+	e.u64(s.open(&handle{f: f, append: flags&os.O_APPEND != 0}))
+	e.u32(fopenDirectIO)
+	e.u32(0)
+	return e, nil
+}
+
+// decodeFh returns the handle in a struct fuse_open_out.
+func decodeFh(open []byte) uint64 {
+	return (&decoder{b: open}).u64()
+}
+
+func (s *Server) read(fh uint64, off int64, size int) ([]byte, error) {
+	h, err := s.handleOf(fh)
+	if err != nil || h.f == nil {
+		return nil, syscall.EBADF
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b := make([]byte, size)
+	n, err := h.f.ReadAt(b, off)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+func (s *Server) write(fh uint64, off int64, data []byte) ([]byte, error) {
+	h, err := s.handleOf(fh)
+	if err != nil || h.f == nil {
+		return nil, syscall.EBADF
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var n int
+	if h.append {
+		// The kernel's idea of where the end is may be out of date, and
+		// the backend knows better.
+		n, err = h.f.Write(data)
+	} else {
+		n, err = h.f.WriteAt(data, off)
+	}
+	if err != nil && n == 0 {
+		return nil, err
+	}
+	var e encoder
+	e.u32(uint32(n))
+	e.u32(0)
+	return e, nil
+}
+
+func (s *Server) readdir(fh, off uint64, size int) ([]byte, error) {
+	h, err := s.handleOf(fh)
+	if err != nil || h.entries == nil {
+		return nil, syscall.EBADF
+	}
+	var e encoder
+	for i := off; i < uint64(len(h.entries)); i++ {
+		ent := h.entries[i]
+		// struct fuse_dirent, padded to eight bytes.
+		n := 24 + (len(ent.name)+7)&^7
+		if len(e)+n > size {
+			break
+		}
+		e.u64(unknownIno)
+		e.u64(i + 1)
+		e.u32(uint32(len(ent.name)))
+		e.u32(unixMode(ent.mode) >> 12)
+		e = append(e, ent.name...)
+		e = append(e, make([]byte, n-24-len(ent.name))...)
+	}
+	return e, nil
+}
+
+func (s *Server) statfs(name string) ([]byte, error) {
+	st, err := vfs.StatFS(s.b, name)
+	if err != nil {
+		return nil, err
+	}
+	const bsize = 4096
+	var e encoder
+	e.u64(uint64(st.Bytes / bsize))
+	e.u64(uint64(st.BytesFree / bsize))
+	e.u64(uint64(st.BytesFree / bsize))
+	e.u64(uint64(st.Inodes))
+	e.u64(uint64(st.InodesFree))
+	e.u32(bsize)
+	e.u32(255) // namelen
+	e.u32(bsize)
+	e = append(e, make([]byte, 4+6*4)...)
+	return e, nil
+}
@@ -0,0 +1,303 @@
+package fuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// The opcodes of the FUSE protocol this package answers. Others are
+// answered with ENOSYS, which the kernel takes to mean it need not ask
+// again.
+const (
+	opLookup      = 1
+	opForget      = 2
+	opGetattr     = 3
+	opSetattr     = 4
+	opReadlink    = 5
+	opSymlink     = 6
+	opMknod       = 8
+	opMkdir       = 9
+	opUnlink      = 10
+	opRmdir       = 11
+	opRename      = 12
+	opLink        = 13
+	opOpen        = 14
+	opRead        = 15
+	opWrite       = 16
+	opStatfs      = 17
+	opRelease     = 18
+	opFsync       = 20
+	opSetxattr    = 21
+	opGetxattr    = 22
+	opListxattr   = 23
+	opRemovexattr = 24
+	opFlush       = 25
+	opInit        = 26
+	opOpendir     = 27
+	opReaddir     = 28
+	opReleasedir  = 29
+	opFsyncdir    = 30
+	opCreate      = 35
+	opInterrupt   = 36
+	opDestroy     = 38
+	opBatchForget = 42
+	opRename2     = 45
+)
+
+const (
+	// protoMinor is the minor version of protocol 7 spoken, the last
+	// before the structures this package uses changed.
+	protoMinor = 31
+	// maxWrite is the most bytes a write request carries, which is as
+	// much as the kernel sends without being asked for more pages.
+	maxWrite = 128 << 10
+	// bufSize holds a write request of maxWrite bytes with its headers.
+	bufSize = maxWrite + 4096
+	// rootID is the node ID of the root of the mount.
+	rootID = 1
+	// unknownIno is the inode number given for directory entries, which
+	// are listed without looking each up.
+	unknownIno    = 0xffffffff
+	inHeaderSize  = 40
+	outHeaderSize = 16
+)
+
+// Flags of the init reply.
+const (
+	initAsyncRead = 1 << 0
+	initBigWrites = 1 << 5
+)
+
+// Setattr valid bits, and the getattr flag that names a handle.
+const (
+	fattrMode     = 1 << 0
+	fattrUID      = 1 << 1
+	fattrGID      = 1 << 2
+	fattrSize     = 1 << 3
+	fattrAtime    = 1 << 4
+	fattrMtime    = 1 << 5
+	fattrFh       = 1 << 6
+	fattrAtimeNow = 1 << 7
+	fattrMtimeNow = 1 << 8
+	getattrFh     = 1 << 0
+)
+
+// fopenDirectIO has reads and writes of an open file go to the server
+// rather than the page cache, so that they see what the tracer's command
+// does to the file.
+const fopenDirectIO = 1 << 0
+
+// renameNoreplace is the flag of rename2 that keeps an existing file;
+// others are refused.
+const renameNoreplace = 1 << 0
+
+// request is a request the kernel sent.
+type request struct {
+	opcode uint32
+	unique uint64
+	node   uint64
+	body   []byte
+}
+
+func parseRequest(b []byte) (request, error) {
+	if len(b) < inHeaderSize || int(binary.LittleEndian.Uint32(b)) != len(b) {
+		return request{}, errors.New("fuse: short request")
+	}
+	return request{
+		opcode: binary.LittleEndian.Uint32(b[4:]),
+		unique: binary.LittleEndian.Uint64(b[8:]),
+		node:   binary.LittleEndian.Uint64(b[16:]),
+		body:   b[inHeaderSize:],
+	}, nil
+}
+
+// decoder reads the fields of a request body in turn. Reading past its end
+// yields zeros and sets short, for the request to be refused with EINVAL.
+type decoder struct {
+	b     []byte
+	short bool
+}
+
+func (d *decoder) take(n int) []byte {
+	if len(d.b) < n {
+		d.short = true
+		d.b = nil
+		return make([]byte, n)
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) u32() uint32 { return binary.LittleEndian.Uint32(d.take(4)) }
+func (d *decoder) u64() uint64 { return binary.LittleEndian.Uint64(d.take(8)) }
+
+// str reads a NUL-terminated string.
+func (d *decoder) str() string {
+	i := bytes.IndexByte(d.b, 0)
+	if i < 0 {
+		d.short = true
+		d.b = nil
+		return ""
+	}
+	s := string(d.b[:i])
+	d.b = d.b[i+1:]
+	return s
+}
+
+// rest returns what is left of the body.
+func (d *decoder) rest() []byte {
+	b := d.b
+	d.b = nil
+	return b
+}
+
+type encoder []byte
+
+func (e *encoder) u32(v uint32) { *e = binary.LittleEndian.AppendUint32(*e, v) }
+func (e *encoder) u64(v uint64) { *e = binary.LittleEndian.AppendUint64(*e, v) }
+
+// attr appends a struct fuse_attr describing fi, the file of node id.
+func (e *encoder) attr(id uint64, fi fs.FileInfo, uid, gid uint32) {
+	a := attrOf(fi, uid, gid)
+	if a.Ino == 0 {
+		a.Ino = id
+	}
+	size := uint64(fi.Size())
+	e.u64(a.Ino)
+	e.u64(size)
+	e.u64((size + 511) / 512)
+	for _, t := range []time.Time{a.Atime, fi.ModTime(), a.Ctime} {
+		e.u64(uint64(t.Unix()))
+	}
+	for _, t := range []time.Time{a.Atime, fi.ModTime(), a.Ctime} {
+		e.u32(uint32(t.Nanosecond()))
+	}
+	e.u32(unixMode(fi.Mode()))
+	e.u32(uint32(a.Nlink))
+	e.u32(a.Uid)
+	e.u32(a.Gid)
+	e.u32(uint32(a.Rdev))
+	e.u32(4096) // blksize
+	e.u32(0)    // flags
+}
+
+// entry appends a struct fuse_entry_out for node id. Nothing is to be
+// cached, so the kernel asks again each time.
+func (e *encoder) entry(id uint64, fi fs.FileInfo, uid, gid uint32) {
+	e.u64(id)
+	e.u64(0) // generation
+	e.u64(0) // entry_valid
+	e.u64(0) // attr_valid
+	e.u32(0)
+	e.u32(0)
+	e.attr(id, fi, uid, gid)
+}
+
+// attrOf returns the metadata of fi that fs.FileInfo has no place for,
+// from a *vfs.Attr or, for a host file, a *syscall.Stat_t, defaulting to
+// the server's owner and the modification time.
+func attrOf(fi fs.FileInfo, uid, gid uint32) vfs.Attr {
+	a := vfs.Attr{Nlink: 1, Uid: uid, Gid: gid, Atime: fi.ModTime(), Ctime: fi.ModTime()}
+	if fi.IsDir() {
+		a.Nlink = 2
+	}
+	switch sys := fi.Sys().(type) {
+	case *vfs.Attr:
+		a = *sys
+		if a.Atime.IsZero() {
+			a.Atime = fi.ModTime()
+		}
+		if a.Ctime.IsZero() {
+			a.Ctime = fi.ModTime()
+		}
+		if a.Nlink == 0 {
+			a.Nlink = 1
+		}
+	case *syscall.Stat_t:
+		a = vfs.Attr{
+			Ino:   sys.Ino,
+			Nlink: uint64(sys.Nlink),
+			Uid:   sys.Uid,
+			Gid:   sys.Gid,
+			Atime: time.Unix(sys.Atim.Unix()),
+			Ctime: time.Unix(sys.Ctim.Unix()),
+			Rdev:  uint64(sys.Rdev),
+		}
+	}
+	return a
+}
+
+// unixMode converts an fs.FileMode to st_mode bits.
+func unixMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	switch {
+	case m.IsDir():
+		mode |= syscall.S_IFDIR
+	case m&fs.ModeSymlink != 0:
+		mode |= syscall.S_IFLNK
+	case m&fs.ModeNamedPipe != 0:
+		mode |= syscall.S_IFIFO
+	case m&fs.ModeSocket != 0:
+		mode |= syscall.S_IFSOCK
+	case m&fs.ModeCharDevice != 0:
+		mode |= syscall.S_IFCHR
+	case m&fs.ModeDevice != 0:
+		mode |= syscall.S_IFBLK
+	default:
+		mode |= syscall.S_IFREG
+	}
+	if m&fs.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
+// fileMode converts the permission bits of st_mode bits to an fs.FileMode.
+func fileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0o777)
+	if mode&syscall.S_ISUID != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+// errno maps an error returned by a backend to the errno the kernel hands
+// on.
+func errno(err error) syscall.Errno {
+	var e syscall.Errno
+	if errors.As(err, &e) {
+		return e
+	}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, fs.ErrExist):
+		return syscall.EEXIST
+	case errors.Is(err, fs.ErrPermission):
+		return syscall.EACCES
+	case errors.Is(err, fs.ErrInvalid):
+		return syscall.EINVAL
+	case errors.Is(err, fs.ErrClosed):
+		return syscall.EBADF
+	}
+	return syscall.EIO
+}
@@ -0,0 +1,99 @@
+package httpfs
+
+import (
+	"io"
+	"io/fs"
+	"sync"
+	"syscall"
+)
+
+// file is an open file, read through the cache of its FS.
+type file struct {
+	fs  *FS
+	obj *object
+
+	mu     sync.Mutex
+	off    int64
+	closed bool
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, pathErr("read", f.obj.name, fs.ErrClosed)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, err := f.fs.readAt("read", f.obj, b, f.off)
+	f.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	closed := f.closed
+	f.mu.Unlock()
+	switch {
+	case closed:
+		return 0, pathErr("read", f.obj.name, fs.ErrClosed)
+	case off < 0:
+		return 0, pathErr("read", f.obj.name, syscall.EINVAL)
+	case len(b) == 0:
+		return 0, nil
+	}
+	return f.fs.readAt("read", f.obj, b, off)
+}
+
+func (f *file) Write([]byte) (int, error) {
+	return 0, pathErr("write", f.obj.name, syscall.EBADF)
+}
+
+func (f *file) WriteAt([]byte, int64) (int, error) {
+	return 0, pathErr("write", f.obj.name, syscall.EBADF)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, pathErr("seek", f.obj.name, fs.ErrClosed)
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.obj.size
+	default:
+		return 0, pathErr("seek", f.obj.name, syscall.EINVAL)
+	}
+	if offset < 0 {
+		return 0, pathErr("seek", f.obj.name, syscall.EINVAL)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, pathErr("stat", f.obj.name, fs.ErrClosed)
+	}
+	return f.obj.info(), nil
+}
+
+func (f *file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return pathErr("close", f.obj.name, fs.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,452 @@
+// Package httpfs implements a read-only vfs.Backend over files served by
+// an HTTP server, such as a CDN, so that a command can open files that are
+// fetched only when it reads them.
+//
+// A name maps to the URL Config.URL + "/" + name. HTTP has no directory
+// listings, so the names of the files are given in Config.Files, and the
+// directories are the ones they are in. Without Files every name the
+// server has is a file, the root is the only directory, and it lists as
+// empty.
+//
+// Opening or statting a file makes a HEAD request, which must give the
+// length of the file. Reads are range requests for whole blocks, and the
+// blocks read are kept in memory, up to Config.CacheSize bytes, so that
+// reading the same part again makes no request. A file whose server gives
+// it an ETag keeps its blocks from one open to the next: the HEAD request
+// checks the tag with If-None-Match, and the cached blocks are dropped
+// once it changes. A range request checks a strong tag with If-Match, so
+// that a read of a file that changes while it is open fails with ESTALE
+// rather than mixing the two versions. A server that ignores ranges works
+// too, but each read of it fetches the whole file up to what is read.
+//
+// Operations that would change a file fail with EROFS. All methods, and
+// the methods of the files an FS opens, are safe for concurrent use.
+package httpfs
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// blockSize is the unit in which files are read and cached.
+const blockSize = 64 << 10
+
+// Config describes the files a server has.
+type Config struct {
+	// URL is the URL the names are relative to, such as
+	// https://cdn.example.com/assets.
+	URL string
+	// Files lists the names of the files under URL, if they are known.
+	Files []string
+	// Header is added to every request, to carry credentials for one.
+	Header http.Header
+	// Client makes the requests. The default is http.DefaultClient.
+	Client *http.Client
+	// CacheSize is the most bytes of file contents kept in memory. The
+	// default is 64 MiB.
+	CacheSize int64
+}
+
+// FS is an HTTP server seen as a read-only filesystem.
+type FS struct {
+	vfs.ReadOnly
+
+	cfg    Config
+	base   *url.URL
+	client *http.Client
+	// files and dirs are the names Config.Files gives, and the
+	// directories they are in; files is nil without it.
+	files map[string]bool
+	dirs  map[string]bool
+
+	mu     sync.Mutex
+	cached map[string]*object
+	lru    *list.List // of *block, the most recently read at the front
+	size   int64      // the bytes the blocks hold
+}
+
+var _ vfs.Backend = (*FS)(nil)
+
+// New returns an FS for the files cfg describes. It makes no requests.
+func New(cfg Config) (*FS, error) {
+	base, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("httpfs: %q is not an http or https URL", cfg.URL)
+	}
+	if cfg.CacheSize <= 0 {
+		cfg.CacheSize = 64 << 20
+	}
+	c := &FS{cfg: cfg, base: base, client: cfg.Client, cached: make(map[string]*object), lru: list.New()}
+	if c.client == nil {
+		c.client = http.DefaultClient
+	}
+	c.ReadOnly = func(op, name string) error {
+		_, _, err := c.lookup(op, name)
+		return err
+	}
+	if cfg.Files != nil {
+		c.files = make(map[string]bool)
+		c.dirs = map[string]bool{".": true}
+		for _, name := range cfg.Files {
+			if !fs.ValidPath(name) || name == "." {
+				return nil, fmt.Errorf("httpfs: bad file name %q", name)
+			}
+			c.files[name] = true
+			for d := path.Dir(name); d != "."; d = path.Dir(d) {
+				c.dirs[d] = true
+			}
+		}
+		for name := range c.files {
+			if c.dirs[name] {
+				return nil, fmt.Errorf("httpfs: %q is both a file and a directory", name)
+			}
+		}
+	}
+	return c, nil
+}
+
+func pathErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// request makes a request for the file name, with the configured headers
+// and then header.
+func (c *FS) request(method, name string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base.JoinPath(name).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range c.cfg.Header {
+		req.Header[k] = vs
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	return c.client.Do(req)
+}
+
+// statusErr returns the errno an unsuccessful response stands for.
+func statusErr(resp *http.Response) syscall.Errno {
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return syscall.ENOENT
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return syscall.EACCES
+	case http.StatusPreconditionFailed:
+		return syscall.ESTALE
+	}
+	return syscall.EIO
+}
+
+// drain reads the rest of the body of resp and closes it, so that the
+// connection can be used again.
+func drain(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// info describes a file or directory.
+type info struct {
+	name  string
+	size  int64
+	mode  fs.FileMode
+	mtime time.Time
+}
+
+func (fi *info) Name() string       { return fi.name }
+func (fi *info) Size() int64        { return fi.size }
+func (fi *info) Mode() fs.FileMode  { return fi.mode }
+func (fi *info) ModTime() time.Time { return fi.mtime }
+func (fi *info) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *info) Sys() any           { return nil }
+
+func dirInfo(name string) *info {
+	return &info{name: path.Base(name), mode: fs.ModeDir | 0o555}
+}
+
+// object is a version of a file, with the blocks of it that are cached.
+type object struct {
+	name   string
+	etag   string
+	size   int64
+	mtime  time.Time
+	blocks map[int64]*list.Element
+}
+
+func (o *object) info() *info {
+	return &info{name: path.Base(o.name), size: o.size, mode: 0o444, mtime: o.mtime}
+}
+
+// block is a cached blockSize piece of an object, or its last piece.
+type block struct {
+	obj  *object
+	n    int64
+	data []byte
+}
+
+// head returns the current version of the file name, which is the cached
+// one if its ETag still matches.
+func (c *FS) head(op, name string) (*object, error) {
+	c.mu.Lock()
+	old := c.cached[name]
+	c.mu.Unlock()
+	h := make(http.Header)
+	if old != nil && old.etag != "" {
+		h.Set("If-None-Match", old.etag)
+	}
+	resp, err := c.request(http.MethodHead, name, h)
+	if err != nil {
+		return nil, pathErr(op, name, err)
+	}
+	drain(resp)
+	switch {
+	case resp.StatusCode == http.StatusNotModified && old != nil:
+		return old, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, pathErr(op, name, statusErr(resp))
+	case resp.ContentLength < 0:
+		return nil, pathErr(op, name, syscall.EIO)
+	}
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	o := &object{
+		name:   name,
+		etag:   resp.Header.Get("ETag"),
+		size:   resp.ContentLength,
+		mtime:  mtime,
+		blocks: make(map[int64]*list.Element),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cur := c.cached[name]
+	if cur != nil && cur.etag != "" && cur.etag == o.etag && cur.size == o.size {
+		return cur, nil
+	}
+	if cur != nil {
+		c.drop(cur)
+	}
+	c.cached[name] = o
+	return o, nil
+}
+
+// drop forgets the cached blocks of o; c.mu must be held.
+func (c *FS) drop(o *object) {
+	for n, e := range o.blocks {
+		c.size -= int64(len(e.Value.(*block).data))
+		c.lru.Remove(e)
+		delete(o.blocks, n)
+	}
+}
+
+// cache adds data as block n of o, evicting the least recently read blocks
+// past the cache size; c.mu must be held.
+func (c *FS) cache(o *object, n int64, data []byte) {
+	if e, ok := o.blocks[n]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	o.blocks[n] = c.lru.PushFront(&block{obj: o, n: n, data: data})
+	c.size += int64(len(data))
+	for c.size > c.cfg.CacheSize && c.lru.Len() > 1 {
+		b := c.lru.Remove(c.lru.Back()).(*block)
+		delete(b.obj.blocks, b.n)
+		c.size -= int64(len(b.data))
+	}
+}
+
+// readAt reads o at off: from the cache up to the first block it does not
+// have, and from the server after it.
+func (c *FS) readAt(op string, o *object, b []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(b)), o.size)
+	last := (end - 1) / blockSize
+	n := int64(0)
+	c.mu.Lock()
+	for i := off / blockSize; i <= last; i++ {
+		e, ok := o.blocks[i]
+		if !ok {
+			break
+		}
+		c.lru.MoveToFront(e)
+		n += int64(copy(b[n:end-off], e.Value.(*block).data[off+n-i*blockSize:]))
+	}
+	c.mu.Unlock()
+	if off+n < end {
+		first := (off + n) / blockSize
+		data, err := c.fetch(op, o, first, last)
+		if err != nil {
+			return 0, err
+		}
+		copy(b[n:end-off], data[off+n-first*blockSize:])
+		n = end - off
+	}
+	if n < int64(len(b)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+// fetch reads blocks first through last of o, caching them.
+func (c *FS) fetch(op string, o *object, first, last int64) ([]byte, error) {
+	start, end := first*blockSize, min((last+1)*blockSize, o.size)
+	h := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", start, end-1)}}
+	if o.etag != "" && !strings.HasPrefix(o.etag, "W/") {
+		h.Set("If-Match", o.etag)
+	}
+	resp, err := c.request(http.MethodGet, o.name, h)
+	if err != nil {
+		return nil, pathErr(op, o.name, err)
+	}
+	defer drain(resp)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range and sent the whole file.
+		if _, err := io.CopyN(io.Discard, resp.Body, start); err != nil {
+			return nil, pathErr(op, o.name, err)
+		}
+	default:
+		return nil, pathErr(op, o.name, statusErr(resp))
+	}
+	data := make([]byte, end-start)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, pathErr(op, o.name, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n := first; n <= last; n++ {
+		i := (n - first) * blockSize
+		c.cache(o, n, data[i:min(i+blockSize, int64(len(data)))])
+	}
+	return data, nil
+}
+
+// lookup returns what name is: a directory, or failing that a file.
+func (c *FS) lookup(op, name string) (*info, *object, error) {
+	switch {
+	case !fs.ValidPath(name):
+		return nil, nil, pathErr(op, name, syscall.EINVAL)
+	case name == "." || c.dirs[name]:
+		return dirInfo(name), nil, nil
+	case c.files != nil && !c.files[name]:
+		return nil, nil, pathErr(op, name, syscall.ENOENT)
+	}
+	o, err := c.head(op, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return o.info(), o, nil
+}
+
+func (c *FS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	fi, o, err := c.lookup("open", name)
+	switch {
+	case err != nil:
+		if flag&os.O_CREATE != 0 && errorIs(err, syscall.ENOENT) {
+			return nil, pathErr("open", name, syscall.EROFS)
+		}
+		return nil, err
+	case flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0:
+		if fi.IsDir() {
+			return nil, pathErr("open", name, syscall.EISDIR)
+		}
+		return nil, pathErr("open", name, syscall.EROFS)
+	case fi.IsDir():
+		return &vfs.DirFile{Info: fi}, nil
+	case flag&syscall.O_DIRECTORY != 0:
+		return nil, pathErr("open", name, syscall.ENOTDIR)
+	}
+	return &file{fs: c, obj: o}, nil
+}
+
+func errorIs(err error, errno syscall.Errno) bool {
+	pe, ok := err.(*fs.PathError)
+	return ok && pe.Err == errno
+}
+
+func (c *FS) Stat(name string) (fs.FileInfo, error) {
+	fi, _, err := c.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+func (c *FS) Lstat(name string) (fs.FileInfo, error) {
+	fi, _, err := c.lookup("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+func (c *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	fi, _, err := c.lookup("readdir", name)
+	switch {
+	case err != nil:
+		return nil, err
+	case !fi.IsDir():
+		return nil, pathErr("readdir", name, syscall.ENOTDIR)
+	}
+	var entries []fs.DirEntry
+	add := func(child string, dir bool) {
+		if path.Dir(child) == name {
+			entries = append(entries, &dirEntry{fs: c, name: child, dir: dir})
+		}
+	}
+	for d := range c.dirs {
+		if d != "." {
+			add(d, true)
+		}
+	}
+	for f := range c.files {
+		add(f, false)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// dirEntry is an entry of a directory, whose information for a file takes
+// a request to get.
+type dirEntry struct {
+	fs   *FS
+	name string
+	dir  bool
+}
+
+func (e *dirEntry) Name() string { return path.Base(e.name) }
+func (e *dirEntry) IsDir() bool  { return e.dir }
+
+func (e *dirEntry) Type() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+func (e *dirEntry) Info() (fs.FileInfo, error) { return e.fs.Stat(e.name) }
+
+func (c *FS) Readlink(name string) (string, error) {
+	if _, _, err := c.lookup("readlink", name); err != nil {
+		return "", err
+	}
+	return "", pathErr("readlink", name, syscall.EINVAL)
+}
@@ -0,0 +1,254 @@
+package httpfs_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs/httpfs"
+)
+
+// server serves files from memory with ETags, counting the GET requests
+// that reach it.
+type server struct {
+	mu     sync.Mutex
+	files  map[string]string
+	gets   int
+	ranges bool
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[strings.TrimPrefix(r.URL.Path, "/files/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodGet {
+		s.gets++
+	}
+	if !s.ranges {
+		r.Header.Del("Range")
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum([]byte(data))))
+	// ServeContent handles Range, If-Match and If-None-Match.
+	http.ServeContent(w, r, "", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), strings.NewReader(data))
+}
+
+func (s *server) set(name, data string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = data
+}
+
+func (s *server) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets
+}
+
+func newFS(t *testing.T, files map[string]string, cfg httpfs.Config) (*httpfs.FS, *server) {
+	t.Helper()
+	s := &server{files: files, ranges: true}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	cfg.URL = srv.URL + "/files"
+	c, err := httpfs.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+func TestRead(t *testing.T) {
+	big := strings.Repeat("0123456789", 20000)
+	c, s := newFS(t, map[string]string{"big": big, "small": "small"}, httpfs.Config{})
+	f, err := c.Open("big", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if s.count() != 0 {
+		t.Errorf("open made %d GETs", s.count())
+	}
+	b := make([]byte, 5)
+	if n, err := f.ReadAt(b, 150005); n != 5 || err != nil || string(b) != "56789" {
+		t.Errorf("read at: %d, %v, %q", n, err, b)
+	}
+	if n, err := f.ReadAt(b, 150000); n != 5 || err != nil || string(b) != "01234" || s.count() != 1 {
+		t.Errorf("read of a cached block: %d, %v, %q, after %d GETs", n, err, b, s.count())
+	}
+	if n, err := f.ReadAt(b, 199998); n != 2 || err != io.EOF {
+		t.Errorf("read at the end: %d, %v", n, err)
+	}
+	if got, err := io.ReadAll(f); err != nil || string(got) != big {
+		t.Errorf("read all: %d bytes, %v", len(got), err)
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != 200000 || fi.Mode() != 0o444 {
+		t.Errorf("stat: %v, %v", fi, err)
+	}
+
+	gets := s.count()
+	g, err := c.Open("big", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if got, err := io.ReadAll(g); err != nil || string(got) != big || s.count() != gets {
+		t.Errorf("read of an unchanged file made %d GETs, %v", s.count()-gets, err)
+	}
+	h, err := c.Open("small", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	s.set("big", "changed")
+	s.set("small", "changed")
+	if _, err := f.ReadAt(b, 0); err != nil {
+		t.Errorf("read of a cached block of a changed file: %v", err)
+	}
+	if _, err := h.ReadAt(b, 0); !errors.Is(err, syscall.ESTALE) {
+		t.Errorf("read of a changed file: %v", err)
+	}
+	if g, err := c.Open("big", os.O_RDONLY, 0); err != nil {
+		t.Error(err)
+	} else if got, err := io.ReadAll(g); err != nil || string(got) != "changed" {
+		t.Errorf("read of the new version: %q, %v", got, err)
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	big := strings.Repeat("x", 1<<20)
+	c, s := newFS(t, map[string]string{"big": big}, httpfs.Config{CacheSize: 128 << 10})
+	f, err := c.Open("big", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got, err := io.ReadAll(f); err != nil || string(got) != big {
+		t.Fatalf("read all: %d bytes, %v", len(got), err)
+	}
+	gets := s.count()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, 0); err != nil || s.count() != gets+1 {
+		t.Errorf("read of an evicted block: %v, after %d more GETs", err, s.count()-gets)
+	}
+}
+
+func TestNoRanges(t *testing.T) {
+	c, s := newFS(t, map[string]string{"f": "hello world"}, httpfs.Config{})
+	s.ranges = false
+	f, err := c.Open("f", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if n, err := f.ReadAt(b, 6); n != 5 || err != nil || string(b) != "world" {
+		t.Errorf("read at: %d, %v, %q", n, err, b)
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	files := map[string]string{"a/b/c": "c", "a/f": "f", "z": "z"}
+	c, _ := newFS(t, files, httpfs.Config{Files: []string{"a/b/c", "a/f", "z"}})
+	for name, want := range map[string]string{".": "a/ z", "a": "b/ f", "a/b": "c"} {
+		entries, err := c.ReadDir(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(t, entries); got != want {
+			t.Errorf("%s holds %s, want %s", name, got, want)
+		}
+	}
+	for name, want := range map[string]error{"z": syscall.ENOTDIR, "missing": syscall.ENOENT} {
+		if _, err := c.ReadDir(name); !errors.Is(err, want) {
+			t.Errorf("readdir %s: %v, want %v", name, err, want)
+		}
+	}
+	if _, err := httpfs.New(httpfs.Config{URL: "http://x", Files: []string{"a", "a/b"}}); err == nil {
+		t.Error("a file that is also a directory was accepted")
+	}
+
+	c, _ = newFS(t, files, httpfs.Config{})
+	if entries, err := c.ReadDir("."); err != nil || len(entries) != 0 {
+		t.Errorf("root without files: %v, %v", entries, err)
+	}
+	if fi, err := c.Stat("a/b/c"); err != nil || fi.Size() != 1 {
+		t.Errorf("stat without files: %v, %v", fi, err)
+	}
+	if _, err := c.Stat("a/b"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat of a directory without files: %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	c, _ := newFS(t, map[string]string{"f": "f"}, httpfs.Config{})
+	for name, err := range map[string]error{
+		"open for writing":  func() error { _, err := c.Open("f", os.O_RDWR, 0); return err }(),
+		"create":            func() error { _, err := c.Open("g", os.O_CREATE|os.O_WRONLY, 0o644); return err }(),
+		"mkdir":             c.Mkdir("d", 0o755),
+		"unlink":            c.Unlink("f"),
+		"rename":            c.Rename("f", "g"),
+		"chmod":             c.Chmod("f", 0o600),
+		"symlink":           c.Symlink("f", "l"),
+		"chtimes":           c.Chtimes("f", time.Now(), time.Now()),
+		"remove of nothing": c.Unlink("missing/g"),
+	} {
+		if !errors.Is(err, syscall.EROFS) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	f, _ := c.Open("f", os.O_RDONLY, 0)
+	if _, err := f.Write([]byte("x")); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("write: %v", err)
+	}
+	if _, err := c.Open("missing", os.O_RDONLY, 0); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("open of a missing file: %v", err)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	c, _ := newFS(t, map[string]string{"data/hello.txt": "from the server\n"},
+		httpfs.Config{Files: []string{"data/hello.txt"}})
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `cat /cdn/data/hello.txt
+ls /cdn/data
+echo x >/cdn/data/new || echo refused`)
+	cmd.Stdout = &stdout
+	if err := tracer.New(cmd, tracer.WithMount("/cdn", c)).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := "from the server\nhello.txt\nrefused\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func names(t *testing.T, entries []fs.DirEntry) string {
+	var s []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		} else if _, err := e.Info(); err != nil {
+			t.Errorf("info of %s: %v", name, err)
+		}
+		s = append(s, name)
+	}
+	return strings.Join(s, " ")
+}
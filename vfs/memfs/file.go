@@ -0,0 +1,229 @@
+package memfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// file is an open handle on an inode. Its offset is guarded by the FS lock
+// along with the inode itself.
+type file struct {
+	fs     *FS
+	node   *inode
+	name   string
+	flag   int
+	off    int64
+	closed bool
+}
+
+// check validates f for an operation; the FS lock must be held.
+func (f *file) check(op string, write bool) error {
+	if err := vfs.CheckFile(op, f.name, f.flag, f.closed, write); err != nil {
+		return err
+	}
+	if f.node.mode.IsDir() {
+		return pathErr(op, f.name, syscall.EISDIR)
+	}
+	return nil
+}
+
+func (f *file) readAt(b []byte, off int64) int {
+	if off >= int64(len(f.node.data)) {
+		return 0
+	}
+	n := copy(b, f.node.data[off:])
+	f.node.atime = f.fs.now()
+	return n
+}
+
+func (f *file) writeAt(b []byte, off int64) int {
+	if end := off + int64(len(b)); end > int64(len(f.node.data)) {
+		if end > int64(cap(f.node.data)) {
+			grown := make([]byte, end, max(end, 2*int64(cap(f.node.data))))
+			copy(grown, f.node.data)
+			f.node.data = grown
+		} else {
+			f.node.data = f.node.data[:end]
+		}
+	}
+	n := copy(f.node.data[off:], b)
+	now := f.fs.now()
+	f.node.mtime, f.node.ctime = now, now
+	return n
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	n := f.readAt(b, f.off)
+	f.off += int64(n)
+	if n == 0 && len(b) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, pathErr("read", f.name, syscall.EINVAL)
+	}
+	n := f.readAt(b, off)
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *file) Write(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.off = int64(len(f.node.data))
+	}
+	n := f.writeAt(b, f.off)
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *file) WriteAt(b []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, pathErr("write", f.name, syscall.EINVAL)
+	}
+	return f.writeAt(b, off), nil
+}
+
+// Truncate changes the size of the file, keeping the data below it and
+// zeroing what it grows by.
+func (f *file) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return pathErr("truncate", f.name, syscall.EINVAL)
+	}
+	data := f.node.data
+	if size <= int64(len(data)) {
+		// A later growth must read zeros, not what was cut off.
+		clear(data[size:])
+		f.node.data = data[:size]
+	} else {
+		f.writeAt(nil, size)
+	}
+	now := f.fs.now()
+	f.node.mtime, f.node.ctime = now, now
+	return nil
+}
+
+// PunchHole zeroes the part of the range inside the file. Files are held
+// contiguously, so the hole takes as much memory as the data it replaces.
+func (f *file) PunchHole(off, n int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("fallocate", true); err != nil {
+		return err
+	}
+	if off < 0 || n <= 0 {
+		return pathErr("fallocate", f.name, syscall.EINVAL)
+	}
+	if size := int64(len(f.node.data)); off < size {
+		clear(f.node.data[off:min(size, off+n)])
+	}
+	now := f.fs.now()
+	f.node.mtime, f.node.ctime = now, now
+	return nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	default:
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	if offset < 0 {
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	return f.node.info(f.name), nil
+}
+
+func (f *file) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// fileInfo is a snapshot of an inode's metadata.
+type fileInfo struct {
+	name  string
+	size  int64
+	mode  fs.FileMode
+	mtime time.Time
+	attr  vfs.Attr
+}
+
+// info snapshots n; the FS lock must be held.
+func (n *inode) info(name string) *fileInfo {
+	size := int64(len(n.data))
+	if n.mode&fs.ModeSymlink != 0 {
+		size = int64(len(n.target))
+	}
+	return &fileInfo{
+		name:  name,
+		size:  size,
+		mode:  n.mode,
+		mtime: n.mtime,
+		attr:  vfs.Attr{Ino: n.ino, Nlink: n.nlink, Atime: n.atime, Ctime: n.ctime},
+	}
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() any           { return &fi.attr }
@@ -0,0 +1,485 @@
+// Package memfs implements a vfs.Backend that keeps the whole tree in
+// memory.
+//
+// The tree supports directories, symbolic links, permission bits,
+// access/modification/change timestamps and extended attributes. Absolute symlink targets are
+// resolved against the root of the FS. Permission bits are recorded and
+// reported but not enforced; the FS behaves as if every caller were root.
+// All methods, and the methods of the files it returns, are safe for
+// concurrent use.
+package memfs
+
+import (
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// FS is an in-memory filesystem tree.
+type FS struct {
+	mu      sync.Mutex
+	root    *inode
+	nextIno uint64
+	now     func() time.Time
+}
+
+var (
+	_ vfs.Backend = (*FS)(nil)
+	_ vfs.Xattrer = (*FS)(nil)
+)
+
+type inode struct {
+	ino    uint64
+	mode   fs.FileMode
+	nlink  uint64
+	data   []byte            // regular files
+	target string            // symlinks
+	parent *inode            // directories
+	kids   map[string]*inode // directories
+	xattrs map[string][]byte
+
+	atime, mtime, ctime time.Time
+}
+
+// New returns an FS containing only an empty root directory.
+func New() *FS {
+	m := &FS{now: time.Now}
+	m.root = m.newInode(fs.ModeDir | 0o755)
+	m.root.parent = m.root
+	m.root.kids = make(map[string]*inode)
+	m.root.nlink = 2
+	return m
+}
+
+func (m *FS) newInode(mode fs.FileMode) *inode {
+	m.nextIno++
+	now := m.now()
+	return &inode{ino: m.nextIno, mode: mode, nlink: 1, atime: now, mtime: now, ctime: now}
+}
+
+func pathErr(op, name string, err syscall.Errno) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// walk resolves name to an inode. Symlinks in intermediate components are
+// always followed; a final symlink is followed only if follow is set.
+func (m *FS) walk(name string, follow bool) (*inode, syscall.Errno) {
+	n, err := vfs.Walk(name, m.root, follow, func(dir *inode, c string, _ bool) (*inode, fs.FileMode, string, error) {
+		child, ok := dir.kids[c]
+		if !ok {
+			return nil, 0, "", syscall.ENOENT
+		}
+		return child, child.mode, child.target, nil
+	})
+	if err != nil {
+		return nil, err.(syscall.Errno)
+	}
+	return n, 0
+}
+
+// parent resolves the directory containing name and returns it with the
+// final path element. name must not be ".".
+func (m *FS) parent(op, name string) (*inode, string, error) {
+	if !fs.ValidPath(name) {
+		return nil, "", pathErr(op, name, syscall.EINVAL)
+	}
+	if name == "." {
+		return nil, "", pathErr(op, name, syscall.EBUSY)
+	}
+	dir, base := path.Split(name)
+	d, errno := m.walk(strings.TrimSuffix(dir, "/"), true)
+	if errno != 0 {
+		return nil, "", pathErr(op, name, errno)
+	}
+	if !d.mode.IsDir() {
+		return nil, "", pathErr(op, name, syscall.ENOTDIR)
+	}
+	return d, base, nil
+}
+
+func (m *FS) lookup(op, name string, follow bool) (*inode, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathErr(op, name, syscall.EINVAL)
+	}
+	n, errno := m.walk(name, follow)
+	if errno != 0 {
+		return nil, pathErr(op, name, errno)
+	}
+	return n, nil
+}
+
+// link inserts n into dir under base and updates the directory's times.
+func (m *FS) link(dir *inode, base string, n *inode) {
+	dir.kids[base] = n
+	if n.mode.IsDir() {
+		n.parent = dir
+		dir.nlink++
+	}
+	now := m.now()
+	dir.mtime, dir.ctime = now, now
+}
+
+func (m *FS) unlink(dir *inode, base string) {
+	n := dir.kids[base]
+	delete(dir.kids, base)
+	if n.mode.IsDir() {
+		dir.nlink--
+		n.nlink = 0
+	} else {
+		n.nlink--
+	}
+	now := m.now()
+	dir.mtime, dir.ctime = now, now
+	n.ctime = now
+}
+
+func (m *FS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n *inode
+	if name == "." {
+		n = m.root
+	} else {
+		dir, base, err := m.parent("open", name)
+		if err != nil {
+			return nil, err
+		}
+		n = dir.kids[base]
+		switch {
+		case n == nil && flag&os.O_CREATE != 0:
+			n = m.newInode(perm.Perm())
+			m.link(dir, base, n)
+		case n == nil:
+			return nil, pathErr("open", name, syscall.ENOENT)
+		case flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+			return nil, pathErr("open", name, syscall.EEXIST)
+		case n.mode&fs.ModeSymlink != 0 && flag&syscall.O_NOFOLLOW != 0:
+			return nil, pathErr("open", name, syscall.ELOOP)
+		case n.mode&fs.ModeSymlink != 0:
+			var errno syscall.Errno
+			if n, errno = m.walk(name, true); errno != 0 {
+				return nil, pathErr("open", name, errno)
+			}
+		}
+	}
+
+	acc := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	if n.mode.IsDir() && (acc != os.O_RDONLY || flag&os.O_CREATE != 0) {
+		return nil, pathErr("open", name, syscall.EISDIR)
+	}
+	if !n.mode.IsDir() && flag&syscall.O_DIRECTORY != 0 {
+		return nil, pathErr("open", name, syscall.ENOTDIR)
+	}
+	if flag&os.O_TRUNC != 0 && acc != os.O_RDONLY && n.mode.IsRegular() {
+		n.data = nil
+		now := m.now()
+		n.mtime, n.ctime = now, now
+	}
+	return &file{fs: m, node: n, name: path.Base(name), flag: flag}, nil
+}
+
+func (m *FS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(path.Base(name)), nil
+}
+
+func (m *FS) Lstat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(path.Base(name)), nil
+}
+
+func (m *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !n.mode.IsDir() {
+		return nil, pathErr("readdir", name, syscall.ENOTDIR)
+	}
+	entries := make([]fs.DirEntry, 0, len(n.kids))
+	for base, kid := range n.kids {
+		entries = append(entries, fs.FileInfoToDirEntry(kid.info(base)))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	n.atime = m.now()
+	return entries, nil
+}
+
+func (m *FS) Mkdir(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, base, err := m.parent("mkdir", name)
+	if err != nil {
+		if name == "." {
+			return pathErr("mkdir", name, syscall.EEXIST)
+		}
+		return err
+	}
+	if _, ok := dir.kids[base]; ok {
+		return pathErr("mkdir", name, syscall.EEXIST)
+	}
+	n := m.newInode(fs.ModeDir | perm.Perm())
+	n.kids = make(map[string]*inode)
+	n.nlink = 2
+	m.link(dir, base, n)
+	return nil
+}
+
+func (m *FS) Unlink(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, base, err := m.parent("unlink", name)
+	if err != nil {
+		return err
+	}
+	n, ok := dir.kids[base]
+	if !ok {
+		return pathErr("unlink", name, syscall.ENOENT)
+	}
+	if n.mode.IsDir() {
+		return pathErr("unlink", name, syscall.EISDIR)
+	}
+	m.unlink(dir, base)
+	return nil
+}
+
+func (m *FS) Rmdir(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, base, err := m.parent("rmdir", name)
+	if err != nil {
+		return err
+	}
+	n, ok := dir.kids[base]
+	switch {
+	case !ok:
+		return pathErr("rmdir", name, syscall.ENOENT)
+	case !n.mode.IsDir():
+		return pathErr("rmdir", name, syscall.ENOTDIR)
+	case len(n.kids) > 0:
+		return pathErr("rmdir", name, syscall.ENOTEMPTY)
+	}
+	m.unlink(dir, base)
+	return nil
+}
+
+func (m *FS) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	odir, obase, err := m.parent("rename", oldname)
+	if err != nil {
+		return err
+	}
+	ndir, nbase, err := m.parent("rename", newname)
+	if err != nil {
+		return err
+	}
+	src, ok := odir.kids[obase]
+	if !ok {
+		return pathErr("rename", oldname, syscall.ENOENT)
+	}
+	dst, exists := ndir.kids[nbase]
+	if exists && dst == src {
+		return nil
+	}
+	if src.mode.IsDir() {
+		for d := ndir; ; d = d.parent {
+			if d == src {
+				return pathErr("rename", newname, syscall.EINVAL)
+			}
+			if d == m.root {
+				break
+			}
+		}
+	}
+	if exists {
+		switch {
+		case src.mode.IsDir() && !dst.mode.IsDir():
+			return pathErr("rename", newname, syscall.ENOTDIR)
+		case !src.mode.IsDir() && dst.mode.IsDir():
+			return pathErr("rename", newname, syscall.EISDIR)
+		case dst.mode.IsDir() && len(dst.kids) > 0:
+			return pathErr("rename", newname, syscall.ENOTEMPTY)
+		}
+		m.unlink(ndir, nbase)
+	}
+	delete(odir.kids, obase)
+	if src.mode.IsDir() {
+		odir.nlink--
+	}
+	now := m.now()
+	odir.mtime, odir.ctime = now, now
+	src.ctime = now
+	m.link(ndir, nbase, src)
+	return nil
+}
+
+func (m *FS) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	odir, obase, err := m.parent("link", oldname)
+	if err != nil {
+		return err
+	}
+	ndir, nbase, err := m.parent("link", newname)
+	if err != nil {
+		return err
+	}
+	src, ok := odir.kids[obase]
+	switch {
+	case !ok:
+		return pathErr("link", oldname, syscall.ENOENT)
+	case src.mode.IsDir():
+		return pathErr("link", oldname, syscall.EPERM)
+	}
+	if _, ok := ndir.kids[nbase]; ok {
+		return pathErr("link", newname, syscall.EEXIST)
+	}
+	m.link(ndir, nbase, src)
+	src.nlink++
+	src.ctime = m.now()
+	return nil
+}
+
+func (m *FS) Symlink(target, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, base, err := m.parent("symlink", newname)
+	if err != nil {
+		return err
+	}
+	if _, ok := dir.kids[base]; ok {
+		return pathErr("symlink", newname, syscall.EEXIST)
+	}
+	n := m.newInode(fs.ModeSymlink | 0o777)
+	n.target = target
+	m.link(dir, base, n)
+	return nil
+}
+
+func (m *FS) Readlink(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if n.mode&fs.ModeSymlink == 0 {
+		return "", pathErr("readlink", name, syscall.EINVAL)
+	}
+	n.atime = m.now()
+	return n.target, nil
+}
+
+func (m *FS) Chmod(name string, mode fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	const settable = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+	n.mode = n.mode&^settable | mode&settable
+	n.ctime = m.now()
+	return nil
+}
+
+func (m *FS) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+	if !atime.IsZero() {
+		n.atime = atime
+	}
+	if !mtime.IsZero() {
+		n.mtime = mtime
+	}
+	n.ctime = m.now()
+	return nil
+}
+
+func (m *FS) Getxattr(name, attr string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("getxattr", name, true)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := n.xattrs[attr]
+	if !ok {
+		return nil, pathErr("getxattr", name, syscall.ENODATA)
+	}
+	return slices.Clone(v), nil
+}
+
+func (m *FS) Setxattr(name, attr string, value []byte, flags int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("setxattr", name, true)
+	if err != nil {
+		return err
+	}
+	_, ok := n.xattrs[attr]
+	switch {
+	case ok && flags&vfs.XattrCreate != 0:
+		return pathErr("setxattr", name, syscall.EEXIST)
+	case !ok && flags&vfs.XattrReplace != 0:
+		return pathErr("setxattr", name, syscall.ENODATA)
+	}
+	if n.xattrs == nil {
+		n.xattrs = make(map[string][]byte)
+	}
+	n.xattrs[attr] = slices.Clone(value)
+	n.ctime = m.now()
+	return nil
+}
+
+func (m *FS) Listxattr(name string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("listxattr", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Sorted(maps.Keys(n.xattrs)), nil
+}
+
+func (m *FS) Removexattr(name, attr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("removexattr", name, true)
+	if err != nil {
+		return err
+	}
+	if _, ok := n.xattrs[attr]; !ok {
+		return pathErr("removexattr", name, syscall.ENODATA)
+	}
+	delete(n.xattrs, attr)
+	n.ctime = m.now()
+	return nil
+}
@@ -0,0 +1,277 @@
+package memfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+func writeFile(t *testing.T, m *FS, name, data string) {
+	t.Helper()
+	f, err := m.Open(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, m *FS, name string) string {
+	t.Helper()
+	f, err := m.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestReadWrite(t *testing.T) {
+	m := New()
+	writeFile(t, m, "a.txt", "hello")
+	if got := readFile(t, m, "a.txt"); got != "hello" {
+		t.Fatalf("got %q", got)
+	}
+
+	f, err := m.Open("a.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(f, " world")
+	if _, err := f.Read(make([]byte, 1)); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("read on a write-only file: got %v", err)
+	}
+	f.Close()
+	if got := readFile(t, m, "a.txt"); got != "hello world" {
+		t.Fatalf("got %q", got)
+	}
+
+	f, _ = m.Open("a.txt", os.O_RDWR, 0)
+	f.WriteAt([]byte("J"), 8)
+	f.Seek(-5, io.SeekEnd)
+	b := make([]byte, 5)
+	n, _ := f.Read(b)
+	if string(b[:n]) != "woJld" {
+		t.Errorf("got %q", b[:n])
+	}
+	if _, err := f.Seek(-100, io.SeekCurrent); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("seek before start: got %v", err)
+	}
+	f.Close()
+	if _, err := f.Read(b); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("read after close: got %v", err)
+	}
+
+	if _, err := m.Open("a.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("O_EXCL on existing file: got %v", err)
+	}
+	if _, err := m.Open("missing", os.O_RDONLY, 0); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("open missing: got %v", err)
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	m := New()
+	if err := m.Mkdir("d", 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mkdir("d", 0o750); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("mkdir of existing dir: got %v", err)
+	}
+	writeFile(t, m, "d/b", "")
+	writeFile(t, m, "d/a", "")
+	entries, err := m.ReadDir("d")
+	if err != nil || len(entries) != 2 || entries[0].Name() != "a" || entries[1].Name() != "b" {
+		t.Fatalf("readdir: %v, %v", entries, err)
+	}
+	fi, _ := m.Stat("d")
+	if !fi.IsDir() || fi.Mode().Perm() != 0o750 {
+		t.Errorf("unexpected mode %v", fi.Mode())
+	}
+	if err := m.Rmdir("d"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("rmdir of non-empty dir: got %v", err)
+	}
+	if err := m.Unlink("d"); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("unlink of dir: got %v", err)
+	}
+	if _, err := m.Open("d", os.O_WRONLY, 0); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("open dir for writing: got %v", err)
+	}
+	if _, err := m.Open("d/a", os.O_RDONLY|syscall.O_DIRECTORY, 0); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("O_DIRECTORY on a file: got %v", err)
+	}
+	if _, err := m.Stat("d/a/x"); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("stat through a file: got %v", err)
+	}
+	m.Unlink("d/a")
+	m.Unlink("d/b")
+	if err := m.Rmdir("d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Rmdir("."); !errors.Is(err, syscall.EBUSY) {
+		t.Errorf("rmdir of root: got %v", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	m := New()
+	m.Mkdir("a", 0o755)
+	m.Mkdir("a/b", 0o755)
+	m.Mkdir("c", 0o755)
+	writeFile(t, m, "a/f", "data")
+	writeFile(t, m, "c/g", "old")
+
+	if err := m.Rename("a/f", "c/g"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, m, "c/g"); got != "data" {
+		t.Errorf("got %q", got)
+	}
+	if err := m.Rename("a", "a/b/x"); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("rename into own subtree: got %v", err)
+	}
+	if err := m.Rename("c/g", "a"); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("rename file over dir: got %v", err)
+	}
+	if err := m.Rename("a", "c"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("rename over non-empty dir: got %v", err)
+	}
+	if err := m.Rename("a", "z"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Stat("z/b"); err != nil {
+		t.Errorf("renamed dir lost its children: %v", err)
+	}
+}
+
+func TestLink(t *testing.T) {
+	m := New()
+	m.Mkdir("d", 0o755)
+	writeFile(t, m, "f", "shared")
+	if err := m.Link("f", "d/g"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Link("f", "d/g"); !errors.Is(err, syscall.EEXIST) {
+		t.Errorf("link over existing name: got %v", err)
+	}
+	if err := m.Link("d", "e"); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("link to a directory: got %v", err)
+	}
+	if err := m.Unlink("f"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, m, "d/g"); got != "shared" {
+		t.Errorf("got %q", got)
+	}
+	fi, err := m.Stat("d/g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := fi.Sys().(*vfs.Attr).Nlink; n != 1 {
+		t.Errorf("nlink = %d after unlinking one name", n)
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	m := New()
+	m.Mkdir("dir", 0o755)
+	writeFile(t, m, "dir/file", "contents")
+	if err := m.Symlink("dir/file", "rel"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Symlink("/dir", "abs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Symlink("../dir/file", "dir/up"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"rel", "abs/file", "dir/up"} {
+		if got := readFile(t, m, name); got != "contents" {
+			t.Errorf("%s: got %q", name, got)
+		}
+	}
+	fi, err := m.Lstat("rel")
+	if err != nil || fi.Mode()&fs.ModeSymlink == 0 || fi.Size() != int64(len("dir/file")) {
+		t.Errorf("lstat: %v, %v", fi, err)
+	}
+	if target, err := m.Readlink("abs"); err != nil || target != "/dir" {
+		t.Errorf("readlink: %q, %v", target, err)
+	}
+	if _, err := m.Readlink("dir"); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("readlink of a dir: got %v", err)
+	}
+	if _, err := m.Open("rel", os.O_RDONLY|syscall.O_NOFOLLOW, 0); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("O_NOFOLLOW: got %v", err)
+	}
+	m.Symlink("loop2", "loop1")
+	m.Symlink("loop1", "loop2")
+	if _, err := m.Stat("loop1"); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("symlink loop: got %v", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	m := New()
+	clock := time.Unix(1000, 0)
+	m.now = func() time.Time { return clock }
+	writeFile(t, m, "f", "x")
+	if err := m.Chmod("f", 0o600|fs.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	atime, mtime := time.Unix(10, 0), time.Unix(20, 0)
+	if err := m.Chtimes("f", atime, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	m.Chtimes("f", time.Time{}, mtime)
+	fi, _ := m.Stat("f")
+	attr := fi.Sys().(*vfs.Attr)
+	if fi.Mode() != 0o600|fs.ModeSetuid || !fi.ModTime().Equal(mtime) || !attr.Atime.Equal(atime) {
+		t.Errorf("unexpected metadata %v %v %v", fi.Mode(), fi.ModTime(), attr.Atime)
+	}
+	if attr.Ino == 0 || attr.Nlink != 1 || !attr.Ctime.Equal(clock) {
+		t.Errorf("unexpected attr %+v", attr)
+	}
+	root, _ := m.Stat(".")
+	if root.Sys().(*vfs.Attr).Ino == attr.Ino {
+		t.Error("inode numbers should be unique")
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	m := New()
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := m.Open("shared", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer f.Close()
+			for range 100 {
+				f.Write([]byte{byte('a' + i)})
+			}
+		}()
+	}
+	wg.Wait()
+	if got := len(readFile(t, m, "shared")); got != 800 {
+		t.Errorf("expected 800 bytes, got %d", got)
+	}
+}
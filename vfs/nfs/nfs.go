@@ -0,0 +1,298 @@
+// Package nfs exports a vfs.Backend read-only over NFS version 3, so that
+// the tree a tracer's command sees can be mounted where FUSE cannot be: in
+// another container, say, or on another machine, for looking into while
+// the command runs.
+//
+// The MOUNT and NFS programs are both served over TCP, on the one port, and
+// no portmapper is registered with, so a client is told the port itself:
+//
+//	mount -t nfs -o ro,vers=3,proto=tcp,port=P,mountport=P,mountproto=tcp,nolock HOST:/ DIR
+//
+// Any directory of the tree can be mounted by its path. Calls that would
+// change the tree fail with NFS3ERR_ROFS. The server checks no credentials,
+// and every client can read every file, so listen only where those allowed
+// the whole tree can reach. Files are reached by name, as backends keep
+// them, and a handle names the path it was looked up by: one renamed while
+// a client has it goes stale. To order the server's operations with those
+// of a tracer writing to the tree, give both the same shared.FS.
+package nfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// Server exports a backend to the clients of the listeners it serves.
+type Server struct {
+	b        vfs.Backend
+	uid, gid uint32
+	// gen is in the handles of this server, so that those of another go
+	// stale.
+	gen uint64
+
+	mu sync.Mutex
+	// names holds the names clients have handles for, by ID, and ids
+	// their IDs by name.
+	names  map[uint64]string
+	ids    map[string]uint64
+	nextID uint64
+	lis    map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// rootID is the ID of the root of the tree.
+const rootID = 1
+
+// NewServer returns a Server exporting b. Files without an owner of
+// their own belong to the user running the server.
+func NewServer(b vfs.Backend) *Server {
+	return &Server{
+		b:      b,
+		uid:    uint32(os.Getuid()),
+		gid:    uint32(os.Getgid()),
+		gen:    uint64(time.Now().UnixNano()),
+		names:  map[uint64]string{rootID: "."},
+		ids:    map[string]uint64{".": rootID},
+		nextID: rootID + 1,
+		lis:    make(map[net.Listener]struct{}),
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on lis and serves their calls, until lis
+// fails or the Server is closed, which it returns nil after.
+func (s *Server) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return lis.Close()
+	}
+	s.lis[lis] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.lis, lis)
+		s.mu.Unlock()
+	}()
+	for {
+		c, err := lis.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return nil
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(c)
+	}
+}
+
+// Close stops the listeners being served and closes the connections,
+// waiting for the calls being answered.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for lis := range s.lis {
+		lis.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// serveConn answers the calls on c in turn, each a record of RFC 5531's
+// record marking, until c fails.
+func (s *Server) serveConn(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+	r := bufio.NewReader(c)
+	for {
+		call, err := readRecord(r)
+		if err != nil {
+			return
+		}
+		reply := s.call(call)
+		if reply == nil {
+			continue
+		}
+		var e encoder
+		e.u32(1<<31 | uint32(len(reply)))
+		if _, err := c.Write(append(e, reply...)); err != nil {
+			return
+		}
+	}
+}
+
+// readRecord reads the fragments of a record, up to the last.
+func readRecord(r io.Reader) ([]byte, error) {
+	var rec []byte
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(hdr[:])
+		last := n&(1<<31) != 0
+		n &^= 1 << 31
+		if len(rec)+int(n) > maxRecord {
+			return nil, errors.New("nfs: record too long")
+		}
+		rec = append(rec, make([]byte, n)...)
+		if _, err := io.ReadFull(r, rec[len(rec)-int(n):]); err != nil {
+			return nil, err
+		}
+		if last {
+			return rec, nil
+		}
+	}
+}
+
+// call answers the RPC call b, returning the reply, or nil for a message
+// that is not a call.
+func (s *Server) call(b []byte) []byte {
+	d := &decoder{b: b}
+	xid, typ := d.u32(), d.u32()
+	if d.short || typ != msgCall {
+		return nil
+	}
+	vers, prog, progVers, proc := d.u32(), d.u32(), d.u32(), d.u32()
+	d.u32()
+	d.opaque(400) // credentials
+	d.u32()
+	d.opaque(400) // verifier
+	var e encoder
+	e.u32(xid)
+	e.u32(msgReply)
+	if vers != rpcVers {
+		e.u32(replyDenied)
+		e.u32(rpcMismatch)
+		e.u32(rpcVers)
+		e.u32(rpcVers)
+		return e
+	}
+	e.u32(replyAccepted)
+	e.u32(authNone)
+	e.u32(0)
+	if d.short {
+		e.u32(acceptGarbageArgs)
+		return e
+	}
+	var (
+		body []byte
+		ok   bool
+	)
+	switch {
+	case prog == progNFS && progVers == versNFS:
+		body, ok = s.nfs(proc, d)
+	case prog == progMount && progVers == versMount:
+		body, ok = s.mount(proc, d)
+	case prog == progNFS || prog == progMount:
+		// Both are served at version 3 alone.
+		e.u32(acceptProgMismatch)
+		e.u32(versNFS)
+		e.u32(versNFS)
+		return e
+	default:
+		e.u32(acceptProgUnavail)
+		return e
+	}
+	switch {
+	case !ok:
+		e.u32(acceptProcUnavail)
+	case d.short:
+		e.u32(acceptGarbageArgs)
+	default:
+		e.u32(acceptSuccess)
+		e = append(e, body...)
+	}
+	return e
+}
+
+// id returns the ID of name, giving it one if it has none.
+func (s *Server) id(name string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.ids[name]
+	if !ok {
+		id = s.nextID
+		s.nextID++
+		s.ids[name] = id
+		s.names[id] = name
+	}
+	return id
+}
+
+// handle returns the handle of the file with ID id.
+func (s *Server) handle(id uint64) []byte {
+	var e encoder
+	e.u64(s.gen)
+	e.u64(id)
+	return e
+}
+
+// name returns the name and ID handle h names, failing with
+// NFS3ERR_BADHANDLE or NFS3ERR_STALE.
+func (s *Server) name(h []byte) (string, uint64, error) {
+	if len(h) != handleSize {
+		return "", 0, errBadHandle
+	}
+	d := &decoder{b: h}
+	gen, id := d.u64(), d.u64()
+	s.mu.Lock()
+	name, ok := s.names[id]
+	s.mu.Unlock()
+	if gen != s.gen || !ok {
+		return "", 0, syscall.ESTALE
+	}
+	return name, id, nil
+}
+
+var (
+	// errBadHandle is a handle no server made.
+	errBadHandle = errors.New("nfs: bad handle")
+	// errTooSmall is a reply too small to list a directory entry in.
+	errTooSmall = errors.New("nfs: reply too small")
+)
+
+// join returns the name of the entry elem in the directory dir, which is
+// dir itself for "." and its parent for "..".
+func join(dir, elem string) string {
+	switch elem {
+	case ".":
+		return dir
+	case "..":
+		return path.Dir(dir)
+	}
+	return path.Join(dir, elem)
+}
@@ -0,0 +1,258 @@
+package nfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"os"
+	"slices"
+	"syscall"
+	"testing"
+
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+)
+
+// client makes calls to a Server, as much of an NFS client as the tests
+// need.
+type client struct {
+	t   *testing.T
+	c   net.Conn
+	r   *bufio.Reader
+	xid uint32
+}
+
+func dial(t *testing.T, s *Server) *client {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	c, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return &client{t: t, c: c, r: bufio.NewReader(c)}
+}
+
+// call calls proc of prog, returning the reply's body after its accept
+// status, which it returns too.
+func (c *client) call(prog, proc uint32, args encoder) (uint32, *decoder) {
+	c.t.Helper()
+	c.xid++
+	var e encoder
+	e.u32(0) // the record mark, filled in below
+	e.u32(c.xid)
+	e.u32(msgCall)
+	e.u32(rpcVers)
+	e.u32(prog)
+	e.u32(3)
+	e.u32(proc)
+	e.u32(authSys)
+	var cred encoder
+	cred.u32(0) // stamp
+	cred.str("host")
+	cred.u32(1000)
+	cred.u32(1000)
+	cred.u32(0) // gids
+	e.opaque(cred)
+	e.u64(0) // verifier
+	e = append(e, args...)
+	binary.BigEndian.PutUint32(e, 1<<31|uint32(len(e)-4))
+	if _, err := c.c.Write(e); err != nil {
+		c.t.Fatal(err)
+	}
+	rec, err := readRecord(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	d := &decoder{b: rec}
+	if xid, typ, stat := d.u32(), d.u32(), d.u32(); xid != c.xid || typ != msgReply || stat != replyAccepted {
+		c.t.Fatalf("reply %d %d %d to call %d", xid, typ, stat, c.xid)
+	}
+	d.u32()
+	d.opaque(400)
+	return d.u32(), d
+}
+
+// nfs calls proc of the NFS program, failing the test unless the call is
+// accepted, and returns the status of the reply's body and the rest.
+func (c *client) nfs(proc uint32, args encoder) (uint32, *decoder) {
+	c.t.Helper()
+	accept, d := c.call(progNFS, proc, args)
+	if accept != acceptSuccess {
+		c.t.Fatalf("procedure %d: accept status %d", proc, accept)
+	}
+	return d.u32(), d
+}
+
+type attr struct {
+	typ, mode    uint32
+	size, fileid uint64
+}
+
+func readAttr(d *decoder) attr {
+	var a attr
+	a.typ, a.mode = d.u32(), d.u32()
+	d.take(12) // nlink, uid, gid
+	a.size = d.u64()
+	d.take(8 + 8 + 8) // used, rdev, fsid
+	a.fileid = d.u64()
+	d.take(24)
+	return a
+}
+
+func readPostOp(d *decoder) *attr {
+	if d.u32() == 0 {
+		return nil
+	}
+	a := readAttr(d)
+	return &a
+}
+
+func args(fs ...func(*encoder)) encoder {
+	var e encoder
+	for _, f := range fs {
+		f(&e)
+	}
+	return e
+}
+
+func handle(h []byte) func(*encoder) { return func(e *encoder) { e.opaque(h) } }
+func str(s string) func(*encoder)    { return func(e *encoder) { e.str(s) } }
+func u32(v uint32) func(*encoder)    { return func(e *encoder) { e.u32(v) } }
+func u64(v uint64) func(*encoder)    { return func(e *encoder) { e.u64(v) } }
+
+func (c *client) mnt(dir string) (uint32, []byte) {
+	c.t.Helper()
+	accept, d := c.call(progMount, mountMnt, args(str(dir)))
+	if accept != acceptSuccess {
+		c.t.Fatalf("mnt: accept status %d", accept)
+	}
+	st := d.u32()
+	if st != nfsOK {
+		return st, nil
+	}
+	return st, d.opaque(maxHandle)
+}
+
+func (c *client) lookup(dir []byte, name string) []byte {
+	c.t.Helper()
+	st, d := c.nfs(procLookup, args(handle(dir), str(name)))
+	if st != nfsOK {
+		c.t.Fatalf("lookup %s: status %d", name, st)
+	}
+	return d.opaque(maxHandle)
+}
+
+// readdir lists dir with READDIRPLUS, asking for count bytes at a time.
+func (c *client) readdir(dir []byte, count uint32) []string {
+	c.t.Helper()
+	var (
+		names  []string
+		cookie uint64
+	)
+	for {
+		st, d := c.nfs(procReaddirplus, args(handle(dir), u64(cookie), u64(0), u32(count), u32(count)))
+		if st != nfsOK {
+			c.t.Fatalf("readdirplus: status %d", st)
+		}
+		readPostOp(d)
+		d.u64()
+		for d.u32() == 1 {
+			d.u64()
+			names = append(names, d.str(maxPath))
+			cookie = d.u64()
+			readPostOp(d)
+			if d.u32() == 1 {
+				d.opaque(maxHandle)
+			}
+		}
+		if d.u32() == 1 || d.short {
+			return names
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	m := memfs.New()
+	m.Mkdir("d", 0o755)
+	f, _ := m.Open("d/f", os.O_WRONLY|os.O_CREATE, 0o644)
+	f.Write([]byte("hello"))
+	f.Close()
+	m.Symlink("d/f", "link")
+	s := NewServer(m)
+	defer s.Close()
+	c := dial(t, s)
+
+	st, root := c.mnt("/")
+	if st != nfsOK {
+		t.Fatalf("mnt: status %d", st)
+	}
+	fh := c.lookup(c.lookup(root, "d"), "f")
+	st, d := c.nfs(procGetattr, args(handle(fh)))
+	if a := readAttr(d); st != nfsOK || a.typ != 1 || a.mode != 0o644 || a.size != 5 {
+		t.Errorf("getattr: status %d, %+v", st, a)
+	}
+	for _, r := range []struct {
+		off  uint64
+		want string
+		eof  bool
+	}{{0, "hel", false}, {3, "lo", true}, {9, "", true}} {
+		st, d := c.nfs(procRead, args(handle(fh), u64(r.off), u32(3)))
+		readPostOp(d)
+		d.u32()
+		eof := d.u32() == 1
+		if got := string(d.opaque(maxRead)); st != nfsOK || got != r.want || eof != r.eof {
+			t.Errorf("read at %d: status %d, %q, eof %v", r.off, st, got, eof)
+		}
+	}
+	st, d = c.nfs(procReadlink, args(handle(c.lookup(root, "link"))))
+	readPostOp(d)
+	if target := d.str(maxPath); st != nfsOK || target != "d/f" {
+		t.Errorf("readlink: status %d, %q", st, target)
+	}
+
+	// What the backend changes is seen at once, a few entries at a time.
+	for _, name := range []string{"a", "b", "c"} {
+		m.Mkdir(name, 0o755)
+	}
+	if names := c.readdir(root, 400); !slices.Equal(names, []string{".", "..", "a", "b", "c", "d", "link"}) {
+		t.Errorf("readdirplus listed %q", names)
+	}
+	if st, _ := c.nfs(procReaddir, args(handle(root), u64(0), u64(0), u32(8))); st != nfsTooSmall {
+		t.Errorf("readdir into 8 bytes: status %d", st)
+	}
+
+	if st, _ := c.nfs(procWrite, args(handle(fh), u64(0), u32(1), u32(0), str("x"))); st != uint32(syscall.EROFS) {
+		t.Errorf("write: status %d", st)
+	}
+	if st, _ := c.nfs(procGetattr, args(handle([]byte("short")))); st != nfsBadHandle {
+		t.Errorf("getattr of a bad handle: status %d", st)
+	}
+	other := NewServer(m)
+	other.gen++
+	if st, _ := c.nfs(procGetattr, args(handle(other.handle(rootID)))); st != nfsStale {
+		t.Errorf("getattr of another server's handle: status %d", st)
+	}
+	if st, h := c.mnt("/d"); st != nfsOK || len(h) != handleSize {
+		t.Errorf("mnt /d: status %d", st)
+	}
+	if st, _ := c.mnt("/link"); st != uint32(syscall.ENOTDIR) {
+		t.Errorf("mnt of a file: status %d", st)
+	}
+	if st, _ := c.mnt("/nope"); st != uint32(syscall.ENOENT) {
+		t.Errorf("mnt of nothing: status %d", st)
+	}
+	m.Unlink("d/f")
+	if st, _ := c.nfs(procGetattr, args(handle(fh))); st != uint32(syscall.ENOENT) {
+		t.Errorf("getattr of a removed file: status %d", st)
+	}
+
+	if accept, _ := c.call(progNFS, 99, nil); accept != acceptProcUnavail {
+		t.Errorf("an unknown procedure: accept status %d", accept)
+	}
+	if accept, _ := c.call(100000, 0, nil); accept != acceptProgUnavail {
+		t.Errorf("an unknown program: accept status %d", accept)
+	}
+}
@@ -0,0 +1,380 @@
+package nfs
+
+import (
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// maxHandle is the most bytes of a handle argument, NFS3_FHSIZE.
+const maxHandle = 64
+
+// nfs serves a call to procedure proc of the NFS program with the
+// arguments d holds, returning the body of the reply, or false for a
+// procedure there is none of.
+func (s *Server) nfs(proc uint32, d *decoder) ([]byte, bool) {
+	var e encoder
+	switch proc {
+	case procNull:
+	case procGetattr:
+		s.getattr(&e, d)
+	case procLookup:
+		s.lookup(&e, d)
+	case procAccess:
+		s.access(&e, d)
+	case procReadlink:
+		s.readlink(&e, d)
+	case procRead:
+		s.read(&e, d)
+	case procReaddir:
+		s.readdir(&e, d, false)
+	case procReaddirplus:
+		s.readdir(&e, d, true)
+	case procFsstat:
+		s.fsstat(&e, d)
+	case procFsinfo:
+		s.fsinfo(&e, d)
+	case procPathconf:
+		s.pathconf(&e, d)
+	case procSetattr, procWrite, procCreate, procMkdir, procSymlink,
+		procMknod, procRemove, procRmdir, procCommit:
+		// What fails is followed by the attributes of one file before and
+		// after, of which there are none to give.
+		e.u32(uint32(syscall.EROFS))
+		e.u64(0)
+	case procRename:
+		e.u32(uint32(syscall.EROFS))
+		e.u64(0)
+		e.u64(0)
+	case procLink:
+		e.u32(uint32(syscall.EROFS))
+		e.u32(0)
+		e.u64(0)
+	default:
+		return nil, false
+	}
+	return e, true
+}
+
+// mount serves a call to procedure proc of the MOUNT program.
+func (s *Server) mount(proc uint32, d *decoder) ([]byte, bool) {
+	var e encoder
+	switch proc {
+	case mountNull, mountUmntall:
+	case mountMnt:
+		name := strings.TrimPrefix(path.Clean("/"+d.str(maxPath)), "/")
+		if name == "" {
+			name = "."
+		}
+		fi, err := s.b.Stat(name)
+		if err == nil && !fi.IsDir() {
+			err = syscall.ENOTDIR
+		}
+		if err != nil {
+			e.u32(status(err))
+			break
+		}
+		e.u32(nfsOK)
+		e.opaque(s.handle(s.id(name)))
+		e.u32(1)
+		e.u32(authSys)
+	case mountDump:
+		// Mounts are not kept track of.
+		e.bool(false)
+	case mountUmnt:
+		d.str(maxPath)
+	case mountExport:
+		e.bool(true)
+		e.str("/")
+		e.bool(false) // groups
+		e.bool(false)
+	default:
+		return nil, false
+	}
+	return e, true
+}
+
+// file reads a handle argument, returning the name it names and its
+// attributes.
+func (s *Server) file(d *decoder) (string, uint64, fs.FileInfo, error) {
+	name, id, err := s.name(d.opaque(maxHandle))
+	if err != nil {
+		return "", 0, nil, err
+	}
+	fi, err := s.b.Lstat(name)
+	return name, id, fi, err
+}
+
+// postOp appends the post_op_attr of the file with ID id, which fi
+// describes if it is not nil.
+func (s *Server) postOp(e *encoder, id uint64, fi fs.FileInfo) {
+	e.bool(fi != nil)
+	if fi != nil {
+		e.attr(id, fi, s.uid, s.gid)
+	}
+}
+
+// fail appends the status of err, and the post_op_attr, if any, that is
+// all a failed call of most procedures returns.
+func (s *Server) fail(e *encoder, err error, id uint64, fi fs.FileInfo) {
+	e.u32(status(err))
+	s.postOp(e, id, fi)
+}
+
+func (s *Server) getattr(e *encoder, d *decoder) {
+	_, id, fi, err := s.file(d)
+	if err != nil {
+		e.u32(status(err))
+		return
+	}
+	e.u32(nfsOK)
+	e.attr(id, fi, s.uid, s.gid)
+}
+
+func (s *Server) lookup(e *encoder, d *decoder) {
+	dir, dirID, dirInfo, err := s.file(d)
+	elem := d.str(maxPath)
+	if err == nil && !dirInfo.IsDir() {
+		err = syscall.ENOTDIR
+	}
+	if err == nil && (elem == "" || strings.Contains(elem, "/")) {
+		err = syscall.ENOENT
+	}
+	if err != nil {
+		s.fail(e, err, dirID, dirInfo)
+		return
+	}
+	name := join(dir, elem)
+	fi, err := s.b.Lstat(name)
+	if err != nil {
+		s.fail(e, err, dirID, dirInfo)
+		return
+	}
+	id := s.id(name)
+	e.u32(nfsOK)
+	e.opaque(s.handle(id))
+	s.postOp(e, id, fi)
+	s.postOp(e, dirID, dirInfo)
+}
+
+// access grants reading what anyone may read, and looking in and
+// executing what anyone may execute, the server checking no credentials.
+func (s *Server) access(e *encoder, d *decoder) {
+	_, id, fi, err := s.file(d)
+	want := d.u32()
+	if err != nil {
+		s.fail(e, err, id, fi)
+		return
+	}
+	var granted uint32
+	perm := fi.Mode().Perm()
+	if perm&0o444 != 0 {
+		granted |= accessRead
+	}
+	if perm&0o111 != 0 {
+		if fi.IsDir() {
+			granted |= accessLookup
+		} else {
+			granted |= accessExecute
+		}
+	}
+	e.u32(nfsOK)
+	s.postOp(e, id, fi)
+	e.u32(granted & want)
+}
+
+func (s *Server) readlink(e *encoder, d *decoder) {
+	name, id, fi, err := s.file(d)
+	if err == nil && fi.Mode()&fs.ModeSymlink == 0 {
+		err = syscall.EINVAL
+	}
+	var target string
+	if err == nil {
+		target, err = s.b.Readlink(name)
+	}
+	if err != nil {
+		s.fail(e, err, id, fi)
+		return
+	}
+	e.u32(nfsOK)
+	s.postOp(e, id, fi)
+	e.str(target)
+}
+
+func (s *Server) read(e *encoder, d *decoder) {
+	name, id, fi, err := s.file(d)
+	off, count := d.u64(), d.u32()
+	switch {
+	case err != nil:
+	case fi.IsDir():
+		err = syscall.EISDIR
+	case !fi.Mode().IsRegular():
+		err = syscall.EINVAL
+	}
+	if err != nil {
+		s.fail(e, err, id, fi)
+		return
+	}
+	var (
+		buf []byte
+		eof = true
+	)
+	if off < uint64(fi.Size()) {
+		var f vfs.File
+		f, err = s.b.Open(name, os.O_RDONLY, 0)
+		if err != nil {
+			s.fail(e, err, id, fi)
+			return
+		}
+		buf = make([]byte, min(count, maxRead))
+		var n int
+		n, err = f.ReadAt(buf, int64(off))
+		f.Close()
+		if err != nil && err != io.EOF {
+			s.fail(e, err, id, fi)
+			return
+		}
+		buf = buf[:n]
+		eof = err == io.EOF || off+uint64(n) >= uint64(fi.Size())
+	}
+	e.u32(nfsOK)
+	s.postOp(e, id, fi)
+	e.u32(uint32(len(buf)))
+	e.bool(eof)
+	e.opaque(buf)
+}
+
+// readdir serves READDIR, or READDIRPLUS if plus is set, listing "." and
+// ".." ahead of the entries the backend has. The cookie of an entry is
+// its place in the list, counting from one.
+func (s *Server) readdir(e *encoder, d *decoder, plus bool) {
+	dir, dirID, dirInfo, err := s.file(d)
+	cookie := d.u64()
+	d.take(8) // cookieverf
+	if plus {
+		d.u32() // dircount
+	}
+	maxCount := int(d.u32())
+	if err == nil && !dirInfo.IsDir() {
+		err = syscall.ENOTDIR
+	}
+	var entries []fs.DirEntry
+	if err == nil {
+		entries, err = s.b.ReadDir(dir)
+	}
+	if err != nil {
+		s.fail(e, err, dirID, dirInfo)
+		return
+	}
+	names := make([]string, 0, len(entries)+2)
+	names = append(names, ".", "..")
+	for _, ent := range entries {
+		names = append(names, ent.Name())
+	}
+	// The status, post_op_attr, cookie verifier and the end of the list
+	// take this much of the reply, and an entry at least the words of
+	// each field and its name.
+	size := 4 + 88 + 8 + 8
+	entrySize := 4 + 8 + 4 + 8
+	if plus {
+		entrySize += 88 + 8 + handleSize
+	}
+	var list encoder
+	n := 0
+	for i := int(min(cookie, uint64(len(names)))); i < len(names); i++ {
+		size += entrySize + len(names[i]) + pad(len(names[i]))
+		if size > maxCount {
+			break
+		}
+		name := join(dir, names[i])
+		id := s.id(name)
+		list.bool(true)
+		list.u64(id)
+		list.str(names[i])
+		list.u64(uint64(i + 1))
+		if plus {
+			fi, err := s.b.Lstat(name)
+			if err != nil {
+				fi = nil
+			}
+			s.postOp(&list, id, fi)
+			list.bool(true)
+			list.opaque(s.handle(id))
+		}
+		n++
+	}
+	eof := int(min(cookie, uint64(len(names))))+n == len(names)
+	if n == 0 && !eof {
+		s.fail(e, errTooSmall, dirID, dirInfo)
+		return
+	}
+	e.u32(nfsOK)
+	s.postOp(e, dirID, dirInfo)
+	e.u64(0) // cookieverf
+	*e = append(*e, list...)
+	e.bool(false)
+	e.bool(eof)
+}
+
+func (s *Server) fsstat(e *encoder, d *decoder) {
+	name, id, fi, err := s.file(d)
+	var st vfs.FSStat
+	if err == nil {
+		st, err = vfs.StatFS(s.b, name)
+	}
+	if err != nil {
+		s.fail(e, err, id, fi)
+		return
+	}
+	e.u32(nfsOK)
+	s.postOp(e, id, fi)
+	e.u64(uint64(st.Bytes))
+	e.u64(uint64(st.BytesFree))
+	e.u64(uint64(st.BytesFree))
+	e.u64(uint64(st.Inodes))
+	e.u64(uint64(st.InodesFree))
+	e.u64(uint64(st.InodesFree))
+	e.u32(0) // invarsec
+}
+
+func (s *Server) fsinfo(e *encoder, d *decoder) {
+	_, id, fi, err := s.file(d)
+	if err != nil {
+		s.fail(e, err, id, fi)
+		return
+	}
+	e.u32(nfsOK)
+	s.postOp(e, id, fi)
+	for range 2 { // reads, then writes, which all fail
+		e.u32(maxRead)
+		e.u32(prefRead)
+		e.u32(4096)
+	}
+	e.u32(prefRead) // dtpref
+	e.u64(math.MaxInt64)
+	e.u32(0) // time_delta: a nanosecond
+	e.u32(1)
+	e.u32(0x1 | 0x2 | 0x8) // FSF3_LINK | FSF3_SYMLINK | FSF3_HOMOGENEOUS
+}
+
+func (s *Server) pathconf(e *encoder, d *decoder) {
+	_, id, fi, err := s.file(d)
+	if err != nil {
+		s.fail(e, err, id, fi)
+		return
+	}
+	e.u32(nfsOK)
+	s.postOp(e, id, fi)
+	e.u32(math.MaxInt32) // linkmax
+	e.u32(255)           // name_max
+	e.bool(true)         // no_trunc
+	e.bool(true)         // chown_restricted
+	e.bool(false)        // case_insensitive
+	e.bool(true)         // case_preserving
+}
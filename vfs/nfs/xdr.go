@@ -0,0 +1,288 @@
+package nfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// The programs served, and their versions.
+const (
+	progNFS   = 100003
+	progMount = 100005
+	versNFS   = 3
+	versMount = 3
+)
+
+// ONC RPC message fields, from RFC 5531.
+const (
+	rpcVers       = 2
+	msgCall       = 0
+	msgReply      = 1
+	replyAccepted = 0
+	replyDenied   = 1
+	rpcMismatch   = 0
+
+	acceptSuccess      = 0
+	acceptProgUnavail  = 1
+	acceptProgMismatch = 2
+	acceptProcUnavail  = 3
+	acceptGarbageArgs  = 4
+
+	authNone = 0
+	authSys  = 1
+)
+
+// The procedures of NFS version 3, from RFC 1813.
+const (
+	procNull = iota
+	procGetattr
+	procSetattr
+	procLookup
+	procAccess
+	procReadlink
+	procRead
+	procWrite
+	procCreate
+	procMkdir
+	procSymlink
+	procMknod
+	procRemove
+	procRmdir
+	procRename
+	procLink
+	procReaddir
+	procReaddirplus
+	procFsstat
+	procFsinfo
+	procPathconf
+	procCommit
+)
+
+// The procedures of the MOUNT protocol, version 3.
+const (
+	mountNull = iota
+	mountMnt
+	mountDump
+	mountUmnt
+	mountUmntall
+	mountExport
+)
+
+// nfsstat3 values that are not errnos. The others are the errnos of the
+// same number, which MOUNT's mountstat3 shares.
+const (
+	nfsOK          = 0
+	nfsNameTooLong = 63
+	nfsNotEmpty    = 66
+	nfsDquot       = 69
+	nfsStale       = 70
+	nfsBadHandle   = 10001
+	nfsNotSupp     = 10004
+	nfsTooSmall    = 10005
+	nfsServerFault = 10006
+)
+
+// Bits of the ACCESS procedure.
+const (
+	accessRead    = 0x01
+	accessLookup  = 0x02
+	accessExecute = 0x20
+)
+
+const (
+	// maxRecord is the largest call accepted, which the largest write a
+	// client sends is well within.
+	maxRecord = 2 << 20
+	// maxPath is the most bytes of a name or path argument.
+	maxPath = 4096
+	// handleSize is the length of a file handle: the server's
+	// generation, and the ID of the name.
+	handleSize = 16
+	// maxRead is the most bytes a read returns, and prefRead the size of
+	// read the client is asked to use.
+	maxRead  = 1 << 20
+	prefRead = 128 << 10
+)
+
+// decoder reads the XDR fields of a call in turn. Reading past its end
+// yields zeros and sets short, for the call to be refused as garbage.
+type decoder struct {
+	b     []byte
+	short bool
+}
+
+func (d *decoder) take(n int) []byte {
+	if n < 0 || len(d.b) < n {
+		d.short = true
+		d.b = nil
+		return make([]byte, max(n, 0))
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) u32() uint32 { return binary.BigEndian.Uint32(d.take(4)) }
+func (d *decoder) u64() uint64 { return binary.BigEndian.Uint64(d.take(8)) }
+
+// opaque reads variable-length opaque data of at most limit bytes.
+func (d *decoder) opaque(limit int) []byte {
+	n := d.u32()
+	if n > uint32(limit) {
+		d.short = true
+		d.b = nil
+		return nil
+	}
+	b := d.take(int(n))
+	d.take(pad(int(n)))
+	return b
+}
+
+func (d *decoder) str(limit int) string { return string(d.opaque(limit)) }
+
+// pad returns the bytes that follow n bytes of opaque data.
+func pad(n int) int { return -n & 3 }
+
+type encoder []byte
+
+func (e *encoder) u32(v uint32) { *e = binary.BigEndian.AppendUint32(*e, v) }
+func (e *encoder) u64(v uint64) { *e = binary.BigEndian.AppendUint64(*e, v) }
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.u32(1)
+	} else {
+		e.u32(0)
+	}
+}
+
+func (e *encoder) opaque(b []byte) {
+	e.u32(uint32(len(b)))
+	*e = append(*e, b...)
+	*e = append(*e, make([]byte, pad(len(b)))...)
+}
+
+func (e *encoder) str(s string) { e.opaque([]byte(s)) }
+
+func (e *encoder) time(t time.Time) {
+	e.u32(uint32(t.Unix()))
+	e.u32(uint32(t.Nanosecond()))
+}
+
+// attr appends the fattr3 of fi, the file with ID id.
+func (e *encoder) attr(id uint64, fi fs.FileInfo, uid, gid uint32) {
+	a := vfs.Attr{Nlink: 1, Uid: uid, Gid: gid, Atime: fi.ModTime(), Ctime: fi.ModTime()}
+	if fi.IsDir() {
+		a.Nlink = 2
+	}
+	switch sys := fi.Sys().(type) {
+	case *vfs.Attr:
+		a.Nlink = max(sys.Nlink, 1)
+		a.Uid, a.Gid, a.Rdev = sys.Uid, sys.Gid, sys.Rdev
+		if !sys.Atime.IsZero() {
+			a.Atime = sys.Atime
+		}
+		if !sys.Ctime.IsZero() {
+			a.Ctime = sys.Ctime
+		}
+	case *syscall.Stat_t:
+		a.Nlink, a.Uid, a.Gid, a.Rdev = uint64(sys.Nlink), sys.Uid, sys.Gid, uint64(sys.Rdev)
+		a.Atime = time.Unix(sys.Atim.Unix())
+		a.Ctime = time.Unix(sys.Ctim.Unix())
+	}
+	e.u32(fileType(fi.Mode()))
+	e.u32(mode(fi.Mode()))
+	e.u32(uint32(a.Nlink))
+	e.u32(a.Uid)
+	e.u32(a.Gid)
+	e.u64(uint64(fi.Size()))
+	e.u64(uint64(fi.Size()))
+	e.u32(unix.Major(a.Rdev))
+	e.u32(unix.Minor(a.Rdev))
+	e.u64(0) // fsid
+	e.u64(id)
+	e.time(a.Atime)
+	e.time(fi.ModTime())
+	e.time(a.Ctime)
+}
+
+// fileType returns the ftype3 of a file of mode m.
+func fileType(m fs.FileMode) uint32 {
+	switch {
+	case m.IsDir():
+		return 2
+	case m&fs.ModeSymlink != 0:
+		return 5
+	case m&fs.ModeNamedPipe != 0:
+		return 7
+	case m&fs.ModeSocket != 0:
+		return 6
+	case m&fs.ModeCharDevice != 0:
+		return 4
+	case m&fs.ModeDevice != 0:
+		return 3
+	}
+	return 1
+}
+
+// mode returns the permission bits of m as st_mode has them.
+func mode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
+// status maps an error returned by a backend to an nfsstat3.
+func status(err error) uint32 {
+	var e syscall.Errno
+	if errors.As(err, &e) {
+		switch e {
+		case syscall.EPERM, syscall.ENOENT, syscall.EIO, syscall.ENXIO,
+			syscall.EACCES, syscall.EEXIST, syscall.EXDEV, syscall.ENODEV,
+			syscall.ENOTDIR, syscall.EISDIR, syscall.EINVAL, syscall.EFBIG,
+			syscall.ENOSPC, syscall.EROFS, syscall.EMLINK:
+			return uint32(e)
+		case syscall.ENAMETOOLONG:
+			return nfsNameTooLong
+		case syscall.ENOTEMPTY:
+			return nfsNotEmpty
+		case syscall.EDQUOT:
+			return nfsDquot
+		case syscall.ESTALE:
+			return nfsStale
+		case syscall.ENOTSUP:
+			return nfsNotSupp
+		}
+		return uint32(syscall.EIO)
+	}
+	switch {
+	case errors.Is(err, errBadHandle):
+		return nfsBadHandle
+	case errors.Is(err, errTooSmall):
+		return nfsTooSmall
+	case errors.Is(err, fs.ErrNotExist):
+		return uint32(syscall.ENOENT)
+	case errors.Is(err, fs.ErrExist):
+		return uint32(syscall.EEXIST)
+	case errors.Is(err, fs.ErrPermission):
+		return uint32(syscall.EACCES)
+	case errors.Is(err, fs.ErrInvalid):
+		return uint32(syscall.EINVAL)
+	}
+	return uint32(syscall.EIO)
+}
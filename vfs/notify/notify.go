@@ -0,0 +1,190 @@
+// Package notify implements a vfs.Backend that calls functions as the
+// regular files of another backend are closed and synced, so that an
+// embedder can upload a file, drop what it caches of it or update a build
+// graph the moment the command is done writing it, rather than polling
+// the backend for changes.
+//
+// Under the tracer a file is closed once the last descriptor of it goes
+// away, through close, dup2, exec or exit, and synced by fsync and
+// fdatasync. The tracer's own opens, as to copy a program it executes,
+// are reported too. The functions are called after the backend has closed
+// or synced the file without error, so what they read of it includes what
+// was written, and on the goroutine that closed or synced it, which for
+// the tracer stops the command until they return: one with slow work to
+// do should hand it off.
+package notify
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// Option configures an FS.
+type Option func(*FS)
+
+// OnClose calls fn with the name of each regular file closed, and whether
+// it was modified, by being created, truncated or written, through that
+// open.
+func OnClose(fn func(name string, modified bool)) Option {
+	return func(n *FS) { n.onClose = fn }
+}
+
+// OnFsync calls fn with the name of each regular file synced.
+func OnFsync(fn func(name string)) Option {
+	return func(n *FS) { n.onFsync = fn }
+}
+
+// FS is a backend reporting the closes and syncs of another's files.
+type FS struct {
+	b       vfs.Backend
+	onClose func(name string, modified bool)
+	onFsync func(name string)
+}
+
+var (
+	_ vfs.Backend  = (*FS)(nil)
+	_ vfs.Xattrer  = (*FS)(nil)
+	_ vfs.StatFSer = (*FS)(nil)
+	_ vfs.Socketer = (*FS)(nil)
+)
+
+// New returns an FS reporting the closes and syncs of the files of b.
+func New(b vfs.Backend, opts ...Option) *FS {
+	n := &FS{b: b}
+	for _, opt := range opts {
+		opt(n)
+	}
+	return n
+}
+
+func (n *FS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	created := flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL
+	if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE {
+		_, err := n.b.Lstat(name)
+		created = errors.Is(err, fs.ErrNotExist)
+	}
+	f, err := n.b.Open(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return f, nil
+	}
+	nf := &file{File: f, n: n, name: name}
+	nf.modified.Store(created || flag&os.O_TRUNC != 0)
+	return nf, nil
+}
+
+func (n *FS) Stat(name string) (fs.FileInfo, error)      { return n.b.Stat(name) }
+func (n *FS) Lstat(name string) (fs.FileInfo, error)     { return n.b.Lstat(name) }
+func (n *FS) ReadDir(name string) ([]fs.DirEntry, error) { return n.b.ReadDir(name) }
+func (n *FS) Mkdir(name string, perm fs.FileMode) error  { return n.b.Mkdir(name, perm) }
+func (n *FS) Unlink(name string) error                   { return n.b.Unlink(name) }
+func (n *FS) Rmdir(name string) error                    { return n.b.Rmdir(name) }
+func (n *FS) Rename(oldname, newname string) error       { return n.b.Rename(oldname, newname) }
+func (n *FS) Link(oldname, newname string) error         { return n.b.Link(oldname, newname) }
+func (n *FS) Symlink(target, newname string) error       { return n.b.Symlink(target, newname) }
+func (n *FS) Readlink(name string) (string, error)       { return n.b.Readlink(name) }
+func (n *FS) Chmod(name string, mode fs.FileMode) error  { return n.b.Chmod(name, mode) }
+
+func (n *FS) Chtimes(name string, atime, mtime time.Time) error {
+	return n.b.Chtimes(name, atime, mtime)
+}
+
+func (n *FS) Getxattr(name, attr string) ([]byte, error) {
+	return vfs.Getxattr(n.b, name, attr)
+}
+
+func (n *FS) Setxattr(name, attr string, value []byte, flags int) error {
+	return vfs.Setxattr(n.b, name, attr, value, flags)
+}
+
+func (n *FS) Listxattr(name string) ([]string, error) { return vfs.Listxattr(n.b, name) }
+
+func (n *FS) Removexattr(name, attr string) error {
+	return vfs.Removexattr(n.b, name, attr)
+}
+
+func (n *FS) StatFS(name string) (vfs.FSStat, error) { return vfs.StatFS(n.b, name) }
+
+func (n *FS) SocketPath(name string) (string, error) { return vfs.SocketPath(n.b, name) }
+
+// file is an open regular file, noting whether it has been modified.
+type file struct {
+	vfs.File
+	n        *FS
+	name     string
+	modified atomic.Bool
+	closed   atomic.Bool
+}
+
+var (
+	_ vfs.Truncater   = (*file)(nil)
+	_ vfs.HolePuncher = (*file)(nil)
+	_ vfs.Syncer      = (*file)(nil)
+)
+
+func (f *file) Write(b []byte) (int, error) {
+	n, err := f.File.Write(b)
+	if n > 0 {
+		f.modified.Store(true)
+	}
+	return n, err
+}
+
+func (f *file) WriteAt(b []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(b, off)
+	if n > 0 {
+		f.modified.Store(true)
+	}
+	return n, err
+}
+
+func (f *file) Truncate(size int64) error {
+	if err := vfs.Truncate(f.File, size); err != nil {
+		return err
+	}
+	f.modified.Store(true)
+	return nil
+}
+
+func (f *file) PunchHole(off, n int64) error {
+	if err := vfs.PunchHole(f.File, off, n); err != nil {
+		return err
+	}
+	f.modified.Store(true)
+	return nil
+}
+
+// Sync syncs the file of the backend, and reports it once synced.
+func (f *file) Sync() error {
+	if err := vfs.Sync(f.File); err != nil {
+		return err
+	}
+	if f.n.onFsync != nil {
+		f.n.onFsync(f.name)
+	}
+	return nil
+}
+
+// Close closes the file of the backend, and reports it once closed, the
+// first time only.
+func (f *file) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	if f.closed.CompareAndSwap(false, true) && f.n.onClose != nil {
+		f.n.onClose(f.name, f.modified.Load())
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package notify_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/notify"
+)
+
+// recorder records what an FS reports.
+type recorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recorder) add(format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) fs(b vfs.Backend) *notify.FS {
+	return notify.New(b,
+		notify.OnClose(func(name string, modified bool) { r.add("close %s %v", name, modified) }),
+		notify.OnFsync(func(name string) { r.add("fsync %s", name) }))
+}
+
+func (r *recorder) take() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := strings.Join(r.events, ", ")
+	r.events = nil
+	return s
+}
+
+func TestHooks(t *testing.T) {
+	var r recorder
+	m := memfs.New()
+	n := r.fs(m)
+	for _, step := range []struct {
+		name string
+		do   func(vfs.File) error
+		flag int
+		want string
+	}{
+		{"create", nil, os.O_CREATE | os.O_WRONLY, "close f true"},
+		{"read", func(f vfs.File) error { _, err := io.ReadAll(f); return err }, os.O_RDONLY, "close f false"},
+		{"open for writing only", nil, os.O_RDWR, "close f false"},
+		{"write", func(f vfs.File) error { _, err := f.Write([]byte("x")); return err }, os.O_WRONLY, "close f true"},
+		{"truncate", func(f vfs.File) error { return vfs.Truncate(f, 0) }, os.O_WRONLY, "close f true"},
+		{"open with O_TRUNC", nil, os.O_WRONLY | os.O_TRUNC, "close f true"},
+		{"sync", func(f vfs.File) error {
+			f.WriteAt([]byte("y"), 0)
+			return vfs.Sync(f)
+		}, os.O_RDWR, "fsync f, close f true"},
+		{"reopen with O_CREATE", nil, os.O_CREATE | os.O_RDWR, "close f false"},
+	} {
+		f, err := n.Open("f", step.flag, 0o644)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if step.do != nil {
+			if err := step.do(f); err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		f.Close()
+		if got := r.take(); got != step.want {
+			t.Errorf("%s: got %q, want %q", step.name, got, step.want)
+		}
+	}
+	if err := n.Mkdir("d", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	d, err := n.Open("d", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	if got := r.take(); got != "" {
+		t.Errorf("directory: got %q", got)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	var r recorder
+	cmd := exec.Command("/bin/sh", "-c", `echo hello >/n/a
+cat /n/a >/dev/null
+exec 3>>/n/b; echo one >&3; sync /n/b; echo two >&3; exec 3>&-
+sync /n/a`)
+	if err := tracer.New(cmd, tracer.WithMount("/n", r.fs(memfs.New()))).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(r.take(), ", ")
+	// sync opens the file it syncs itself.
+	want := []string{"close a true", "close a false", "fsync b", "close b false", "close b true", "fsync a", "close a false"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,120 @@
+package oci
+
+import (
+	"io"
+	"io/fs"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// info describes an entry of the image.
+type info struct {
+	name string
+	e    *entry
+}
+
+func (e *entry) info(name string) *info { return &info{name: name, e: e} }
+
+func (fi *info) Name() string       { return fi.name }
+func (fi *info) Size() int64        { return fi.e.size }
+func (fi *info) Mode() fs.FileMode  { return fi.e.mode }
+func (fi *info) ModTime() time.Time { return fi.e.mtime }
+func (fi *info) IsDir() bool        { return fi.e.mode.IsDir() }
+func (fi *info) Sys() any {
+	return &vfs.Attr{
+		Ino:   fi.e.ino,
+		Nlink: 1,
+		Uid:   fi.e.uid,
+		Gid:   fi.e.gid,
+		Atime: fi.e.atime,
+		Ctime: fi.e.ctime,
+		Rdev:  fi.e.rdev,
+	}
+}
+
+// dirEntry is an entry of a directory ReadDir lists.
+type dirEntry struct {
+	name string
+	e    *entry
+}
+
+func (d *dirEntry) Name() string               { return d.name }
+func (d *dirEntry) IsDir() bool                { return d.e.mode.IsDir() }
+func (d *dirEntry) Type() fs.FileMode          { return d.e.mode.Type() }
+func (d *dirEntry) Info() (fs.FileInfo, error) { return d.e.info(d.name), nil }
+
+// file is an open file, read from its layer's data.
+type file struct {
+	name string
+	e    *entry
+	info *info
+	r    *io.SectionReader
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, pathErr("read", f.name, fs.ErrClosed)
+	}
+	return f.r.Read(b)
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	closed := f.closed
+	f.mu.Unlock()
+	switch {
+	case closed:
+		return 0, pathErr("read", f.name, fs.ErrClosed)
+	case off < 0:
+		return 0, pathErr("read", f.name, syscall.EINVAL)
+	}
+	return f.r.ReadAt(b, off)
+}
+
+func (f *file) Write([]byte) (int, error) {
+	return 0, pathErr("write", f.name, syscall.EBADF)
+}
+
+func (f *file) WriteAt([]byte, int64) (int, error) {
+	return 0, pathErr("write", f.name, syscall.EBADF)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, pathErr("seek", f.name, fs.ErrClosed)
+	}
+	off, err := f.r.Seek(offset, whence)
+	if err != nil {
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	return off, nil
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, pathErr("stat", f.name, fs.ErrClosed)
+	}
+	return f.info, nil
+}
+
+func (f *file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return pathErr("close", f.name, fs.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
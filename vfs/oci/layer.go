@@ -0,0 +1,251 @@
+package oci
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Whiteout files, as the OCI image spec names them: ".wh.NAME" in a layer
+// hides NAME in the layers below, and ".wh..wh..opq" in a directory hides
+// everything the layers below have in it.
+const (
+	whiteoutPrefix = ".wh."
+	opaqueMarker   = ".wh..wh..opq"
+)
+
+// layer is one layer of the image. It is unpacked the first time a lookup
+// reaches it: the names it has are indexed, and the contents of its
+// regular files copied into data, an unlinked temporary file.
+type layer struct {
+	// digest is what the blob must hash to, if it is known, and open
+	// opens the blob, compressed or not.
+	digest string
+	open   func() (io.ReadCloser, error)
+	tmp    string
+	inos   *atomic.Uint64
+
+	once sync.Once
+	err  error
+	// entries holds what the layer has by name, and children the names
+	// of what it has in each directory. whiteouts are the names it
+	// hides, and opaque the directories whose lower contents it hides.
+	entries   map[string]*entry
+	children  map[string][]string
+	whiteouts map[string]bool
+	opaque    map[string]bool
+	data      *os.File
+}
+
+// entry is a file of a layer. A regular file's contents are the size
+// bytes of its layer's data at off. A hard link to a file of a lower
+// layer has link set instead, to the name it was linked to.
+type entry struct {
+	name   string
+	layer  *layer
+	mode   fs.FileMode
+	size   int64
+	off    int64
+	target string
+	link   string
+	uid    uint32
+	gid    uint32
+	rdev   uint64
+	ino    uint64
+	mtime  time.Time
+	atime  time.Time
+	ctime  time.Time
+}
+
+// load unpacks the layer, once.
+func (l *layer) load() error {
+	l.once.Do(func() { l.err = l.unpack() })
+	return l.err
+}
+
+func (l *layer) unpack() error {
+	rc, err := l.open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	var h hash.Hash
+	var r io.Reader = rc
+	if l.digest != "" {
+		alg, _, _ := strings.Cut(l.digest, ":")
+		if alg != "sha256" {
+			return fmt.Errorf("oci: layer %s: unsupported digest", l.digest)
+		}
+		h = sha256.New()
+		r = io.TeeReader(rc, h)
+	}
+	br := bufio.NewReader(r)
+	var tr *tar.Reader
+	switch magic, _ := br.Peek(4); {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("oci: layer %s: %w", l.digest, err)
+		}
+		defer zr.Close()
+		tr = tar.NewReader(zr)
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return fmt.Errorf("oci: layer %s: zstd compression is not supported", l.digest)
+	default:
+		tr = tar.NewReader(br)
+	}
+	data, err := os.CreateTemp(l.tmp, "oci-layer-")
+	if err != nil {
+		return err
+	}
+	// The contents are only ever read through the descriptor.
+	os.Remove(data.Name())
+	l.data = data
+	l.entries = map[string]*entry{}
+	l.children = map[string][]string{}
+	l.whiteouts = map[string]bool{}
+	l.opaque = map[string]bool{}
+	var off int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("oci: layer %s: %w", l.digest, err)
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if name == ".." || strings.HasPrefix(name, "../") {
+			continue
+		}
+		dir, base := path.Split(name)
+		dir = path.Clean(dir)
+		switch {
+		case base == opaqueMarker:
+			l.opaque[dir] = true
+			l.implicitDir(dir)
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			l.whiteouts[path.Join(dir, base[len(whiteoutPrefix):])] = true
+			l.implicitDir(dir)
+			continue
+		}
+		e := &entry{
+			name:  name,
+			layer: l,
+			mode:  hdr.FileInfo().Mode(),
+			uid:   uint32(hdr.Uid),
+			gid:   uint32(hdr.Gid),
+			mtime: hdr.ModTime,
+			atime: hdr.AccessTime,
+			ctime: hdr.ChangeTime,
+			ino:   l.inos.Add(1),
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeGNUSparse:
+			n, err := io.Copy(data, tr)
+			if err != nil {
+				return fmt.Errorf("oci: layer %s: %w", l.digest, err)
+			}
+			e.off, e.size = off, n
+			off += n
+		case tar.TypeLink:
+			target := path.Clean(strings.TrimPrefix(hdr.Linkname, "/"))
+			if t, ok := l.entries[target]; ok {
+				*e = *t
+				e.name = name
+			} else {
+				e.link = target
+			}
+		case tar.TypeSymlink:
+			e.target, e.size = hdr.Linkname, int64(len(hdr.Linkname))
+		case tar.TypeChar, tar.TypeBlock:
+			e.rdev = mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		case tar.TypeDir, tar.TypeFifo:
+		default:
+			// Other kinds, such as extended headers a reader does not
+			// know, have nothing to serve.
+			continue
+		}
+		if e.mode.IsDir() {
+			if old, ok := l.entries[name]; ok && old.mode.IsDir() {
+				e.ino = old.ino
+			}
+		}
+		l.add(e)
+	}
+	if h != nil {
+		// The digest covers the whole blob, past the end of the archive.
+		if _, err := io.Copy(io.Discard, br); err != nil {
+			return fmt.Errorf("oci: layer %s: %w", l.digest, err)
+		}
+		if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != l.digest {
+			return fmt.Errorf("oci: layer %s: digest mismatch: got %s", l.digest, got)
+		}
+	}
+	return nil
+}
+
+// add records e in the layer, with the directories it is in.
+func (l *layer) add(e *entry) {
+	if _, ok := l.entries[e.name]; !ok && e.name != "." {
+		dir := path.Dir(e.name)
+		l.children[dir] = append(l.children[dir], path.Base(e.name))
+		l.implicitDir(dir)
+	}
+	l.entries[e.name] = e
+}
+
+// implicitDir records dir as a directory of the layer, if the archive
+// only had files below it.
+func (l *layer) implicitDir(dir string) {
+	if _, ok := l.entries[dir]; ok {
+		return
+	}
+	l.add(&entry{name: dir, layer: l, mode: fs.ModeDir | 0o755, ino: l.inos.Add(1)})
+}
+
+// hides reports whether the layer hides name from the layers below it: by
+// a whiteout of it or of a directory above it, by an opaque directory
+// above it, or by having something other than a directory above it.
+func (l *layer) hides(name string) bool {
+	if l.whiteouts[name] {
+		return true
+	}
+	for d := name; d != "."; {
+		d = path.Dir(d)
+		if l.opaque[d] || l.whiteouts[d] {
+			return true
+		}
+		if e, ok := l.entries[d]; ok && !e.mode.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// contents returns a reader of the contents of the regular file e.
+func (e *entry) contents() *io.SectionReader {
+	return io.NewSectionReader(e.layer.data, e.off, e.size)
+}
+
+func mkdev(major, minor uint32) uint64 {
+	return uint64(minor&0xff) | uint64(major)<<8 | uint64(minor&^0xff)<<12
+}
+
+// errNoLayers is returned for an image without any.
+var errNoLayers = errors.New("oci: image has no layers")
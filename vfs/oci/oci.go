@@ -0,0 +1,356 @@
+// Package oci implements a read-only vfs.Backend serving the filesystem of
+// an OCI or Docker container image, so that a command can be run on an
+// image's root without a container runtime, and without root.
+//
+// The image is pulled from a registry by reference, such as alpine:3.20 or
+// ghcr.io/owner/repo@sha256:..., or read from an OCI image layout
+// directory, or from a directory of layer archives. Its layers are merged
+// as a container runtime merges them: a file in a higher layer hides the
+// same name lower down, and whiteouts hide lower files and directory
+// contents.
+//
+// The image is served lazily. New fetches only the manifest and the image
+// configuration. A layer is fetched, checked against its digest and
+// unpacked the first time a lookup reaches it; lookups go from the top
+// layer down and stop at the first that has the name, so the layers below
+// are fetched only once a name is missing from every layer above, or a
+// directory listed. The contents of an unpacked layer's files are kept in
+// an unlinked temporary file, and read from there.
+//
+// Operations that would change a file fail with EROFS; an overlay.FS over
+// an FS makes it writable. All methods, and the methods of the files an FS
+// opens, are safe for concurrent use.
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// Config describes where an image comes from. Exactly one of Ref and Dir
+// is set.
+type Config struct {
+	// Ref is a reference to an image in a registry, as docker pull
+	// takes one. A name without a registry is on Docker Hub, and one
+	// without a tag or digest is the latest.
+	Ref string
+	// Dir is an OCI image layout, a directory with an index.json, or a
+	// directory of layer archives, tar files that may be gzipped, stacked
+	// in the order their names sort, the lowest first.
+	Dir string
+	// Platform picks the image from an index of images for several, as
+	// "os/arch" or "os/arch/variant". The default is the tracer's own,
+	// such as linux/amd64.
+	Platform string
+
+	// Username and Password authenticate to the registry, if it needs
+	// them.
+	Username, Password string
+	// PlainHTTP talks to the registry over HTTP rather than HTTPS, for
+	// a registry on a local network.
+	PlainHTTP bool
+	// Client makes the requests. The default is http.DefaultClient.
+	Client *http.Client
+	// TempDir is where the contents of unpacked layers are kept. The
+	// default is os.TempDir.
+	TempDir string
+}
+
+// Image is what the image's configuration says a container of it runs,
+// for a caller to run the command it means.
+type Image struct {
+	User       string
+	Env        []string
+	Entrypoint []string
+	Cmd        []string
+	WorkingDir string
+}
+
+// FS is the merged filesystem of an image.
+type FS struct {
+	vfs.ReadOnly
+
+	// layers are the image's layers, the top first.
+	layers []*layer
+	image  Image
+	inos   atomic.Uint64
+	root   *entry
+}
+
+var (
+	_ vfs.Backend  = (*FS)(nil)
+	_ vfs.StatFSer = (*FS)(nil)
+)
+
+// New returns an FS for the image cfg describes. It fetches the image's
+// manifest and configuration, but none of its layers.
+func New(cfg Config) (*FS, error) {
+	if (cfg.Ref == "") == (cfg.Dir == "") {
+		return nil, fmt.Errorf("oci: one of Ref and Dir must be set")
+	}
+	if cfg.Platform == "" {
+		cfg.Platform = defaultPlatform()
+	}
+	f := &FS{}
+	f.ReadOnly = func(op, name string) error {
+		_, err := f.walk(op, name, false)
+		return err
+	}
+	f.root = &entry{name: ".", mode: fs.ModeDir | 0o755, ino: f.inos.Add(1)}
+	add := func(digest string, open func() (io.ReadCloser, error)) {
+		l := &layer{digest: digest, open: open, tmp: cfg.TempDir, inos: &f.inos}
+		f.layers = slices.Insert(f.layers, 0, l)
+	}
+
+	var b blobs
+	ref := ""
+	switch {
+	case cfg.Ref != "":
+		r, err := parseReference(cfg.Ref)
+		if err != nil {
+			return nil, err
+		}
+		b, ref = newRegistry(r, cfg), r.ref
+	default:
+		if _, err := os.Stat(path.Join(cfg.Dir, "index.json")); err == nil {
+			b = layout(cfg.Dir)
+			break
+		}
+		names, err := tarballs(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			add("", func() (io.ReadCloser, error) { return os.Open(name) })
+		}
+		if len(f.layers) == 0 {
+			return nil, errNoLayers
+		}
+		return f, nil
+	}
+
+	m, err := resolve(b, ref, cfg.Platform)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Layers) == 0 {
+		return nil, errNoLayers
+	}
+	for _, d := range m.Layers {
+		add(d.Digest, func() (io.ReadCloser, error) { return b.blob(d.Digest) })
+	}
+	if m.Config.Digest != "" {
+		if f.image, err = readImage(b, m.Config.Digest); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// readImage reads the image configuration blob digest names.
+func readImage(b blobs, digest string) (Image, error) {
+	rc, err := b.blob(digest)
+	if err != nil {
+		return Image{}, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, maxManifest))
+	if err != nil {
+		return Image{}, err
+	}
+	if _, err := parseManifest(digest, data); err != nil {
+		return Image{}, err
+	}
+	var c struct {
+		Config Image `json:"config"`
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return Image{}, fmt.Errorf("oci: config %s: %w", digest, err)
+	}
+	return c.Config, nil
+}
+
+// Image returns what the image's configuration says to run. An image read
+// from a directory of layer archives has none, and the Image is empty.
+func (f *FS) Image() Image { return f.image }
+
+func pathErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// find returns what the merged filesystem has as name, with the layers
+// from the ith down.
+func (f *FS) find(op, name string, i int) (*entry, error) {
+	for _, l := range f.layers[i:] {
+		if err := l.load(); err != nil {
+			return nil, pathErr(op, name, err)
+		}
+		if e, ok := l.entries[name]; ok {
+			if e.link != "" {
+				return f.find(op, e.link, slices.Index(f.layers, l)+1)
+			}
+			return e, nil
+		}
+		if l.hides(name) {
+			break
+		}
+	}
+	if name == "." {
+		return f.root, nil
+	}
+	return nil, pathErr(op, name, syscall.ENOENT)
+}
+
+// walk resolves name to an entry. Symlinks in intermediate components are
+// always followed; a final symlink is followed only if follow is set.
+// Absolute targets are resolved against the root of the image.
+func (f *FS) walk(op, name string, follow bool) (*entry, error) {
+	// Names are walked rather than entries, as a hard link's entry is
+	// that of its target.
+	if !fs.ValidPath(name) {
+		return nil, pathErr(op, name, syscall.EINVAL)
+	}
+	p, err := vfs.Walk(name, ".", follow, func(dir, c string, _ bool) (string, fs.FileMode, string, error) {
+		child := path.Join(dir, c)
+		e, err := f.find(op, child, 0)
+		if err != nil {
+			return "", 0, "", underlying(err)
+		}
+		return child, e.mode, e.target, nil
+	})
+	if err != nil {
+		return nil, pathErr(op, name, err)
+	}
+	return f.find(op, p, 0)
+}
+
+// underlying returns the error a *fs.PathError wraps.
+func underlying(err error) error {
+	if pe, ok := err.(*fs.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
+
+func (f *FS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	e, err := f.walk("open", name, flag&syscall.O_NOFOLLOW == 0)
+	switch {
+	case err != nil:
+		if flag&os.O_CREATE != 0 && underlying(err) == syscall.ENOENT {
+			return nil, pathErr("open", name, syscall.EROFS)
+		}
+		return nil, err
+	case e.mode&fs.ModeSymlink != 0:
+		return nil, pathErr("open", name, syscall.ELOOP)
+	case flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathErr("open", name, syscall.EEXIST)
+	case flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0:
+		if e.mode.IsDir() {
+			return nil, pathErr("open", name, syscall.EISDIR)
+		}
+		return nil, pathErr("open", name, syscall.EROFS)
+	case e.mode.IsDir():
+		return &vfs.DirFile{Info: e.info(path.Base(name))}, nil
+	case flag&syscall.O_DIRECTORY != 0:
+		return nil, pathErr("open", name, syscall.ENOTDIR)
+	}
+	// Devices and fifos have no contents in the image, and read as empty.
+	return &file{name: name, e: e, info: e.info(path.Base(name)), r: e.contents()}, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	e, err := f.walk("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return e.info(path.Base(name)), nil
+}
+
+func (f *FS) Lstat(name string) (fs.FileInfo, error) {
+	e, err := f.walk("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return e.info(path.Base(name)), nil
+}
+
+// ReadDir lists name as the layers merge it: each layer adds what it has
+// in the directory, unless a higher one has the same name or hides it,
+// from the top layer down to the first that makes the directory opaque or
+// hides it altogether.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	d, err := f.walk("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !d.mode.IsDir() {
+		return nil, pathErr("readdir", name, syscall.ENOTDIR)
+	}
+	dir := d.name
+	seen := make(map[string]bool)
+	var entries []fs.DirEntry
+	for i, l := range f.layers {
+		if err := l.load(); err != nil {
+			return nil, pathErr("readdir", name, err)
+		}
+		e, ok := l.entries[dir]
+		if ok && !e.mode.IsDir() {
+			break
+		}
+		for _, c := range l.children[dir] {
+			child := path.Join(dir, c)
+			if seen[child] {
+				continue
+			}
+			seen[child] = true
+			ce := l.entries[child]
+			if ce.link != "" {
+				if ce, err = f.find("readdir", ce.link, i+1); err != nil {
+					continue
+				}
+			}
+			entries = append(entries, &dirEntry{name: c, e: ce})
+		}
+		// What the layer hides is as good as seen.
+		for w := range l.whiteouts {
+			if path.Dir(w) == dir {
+				seen[w] = true
+			}
+		}
+		if l.opaque[dir] || l.hides(dir) {
+			break
+		}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// StatFS reports the image as full: it has no room for anything more.
+func (f *FS) StatFS(name string) (vfs.FSStat, error) {
+	if _, err := f.walk("statfs", name, true); err != nil {
+		return vfs.FSStat{}, err
+	}
+	return vfs.FSStat{}, nil
+}
+
+func (f *FS) Readlink(name string) (string, error) {
+	e, err := f.walk("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if e.mode&fs.ModeSymlink == 0 {
+		return "", pathErr("readlink", name, syscall.EINVAL)
+	}
+	return e.target, nil
+}
@@ -0,0 +1,426 @@
+package oci_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/oci"
+)
+
+// file is an entry of a layer archive. A link is a hard link, and a target
+// a symlink's.
+type file struct {
+	name, data, link, target string
+	mode                     int64
+	typ                      byte
+}
+
+func archive(t *testing.T, compress bool, files ...file) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(&buf)
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: f.mode, Typeflag: f.typ, ModTime: time.Unix(1e9, 0)}
+		switch {
+		case f.typ == tar.TypeChar:
+			hdr.Devmajor, hdr.Devminor = 1, 3
+		case f.link != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeLink, f.link
+		case f.target != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, f.target
+		case strings.HasSuffix(f.name, "/"):
+			hdr.Typeflag = tar.TypeDir
+		case f.typ == 0:
+			hdr.Typeflag, hdr.Size = tar.TypeReg, int64(len(f.data))
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0o644
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if zw != nil {
+		zw.Close()
+	}
+	return buf.Bytes()
+}
+
+// layers returns the layers of the test image, the lowest first: the
+// upper ones replace a file, white one out, make a directory opaque and
+// link to files of their own and of the layers below.
+func layers(t *testing.T) [][]byte {
+	return [][]byte{
+		archive(t, true,
+			file{name: "etc/", mode: 0o755},
+			file{name: "etc/passwd", data: "root:x:0:0\n"},
+			file{name: "etc/gone", data: "gone\n"},
+			file{name: "opt/a", data: "a"},
+			file{name: "opt/b", data: "b"},
+			file{name: "bin/busybox", data: "#!busybox\n", mode: 0o755},
+			file{name: "bin/sh", target: "busybox"},
+			file{name: "lib/libc.so", data: "libc"},
+			file{name: "dev/null", typ: tar.TypeChar, mode: 0o666},
+		),
+		archive(t, false,
+			file{name: "etc/.wh.gone"},
+			file{name: "etc/hostname", data: "box\n"},
+			file{name: "etc/hostname2", link: "etc/hostname"},
+			file{name: "opt/.wh..wh..opq"},
+			file{name: "opt/c", data: "c"},
+			file{name: "usr/lib/libc.so", link: "lib/libc.so"},
+			file{name: "lib64", target: "/lib"},
+		),
+		archive(t, true,
+			file{name: "etc/passwd", data: "root:x:0:0:replaced\n"},
+		),
+	}
+}
+
+// check checks the test image's merged filesystem.
+func check(t *testing.T, c *oci.FS) {
+	t.Helper()
+	for name, want := range map[string]string{
+		"etc/passwd":      "root:x:0:0:replaced\n",
+		"etc/hostname":    "box\n",
+		"etc/hostname2":   "box\n",
+		"usr/lib/libc.so": "libc",
+		"lib64/libc.so":   "libc",
+		"bin/sh":          "#!busybox\n",
+		"opt/c":           "c",
+		"dev/null":        "",
+	} {
+		f, err := c.Open(name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Errorf("open %s: %v", name, err)
+			continue
+		}
+		b, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || string(b) != want {
+			t.Errorf("%s: got %q, %v, want %q", name, b, err, want)
+		}
+	}
+	for _, name := range []string{"etc/gone", "opt/a", "missing", "etc/passwd/x"} {
+		if _, err := c.Stat(name); err == nil {
+			t.Errorf("stat %s: found", name)
+		}
+	}
+	if _, err := c.Stat("etc/passwd/x"); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("stat below a file: %v", err)
+	}
+	for dir, want := range map[string]string{
+		".":   "bin/ dev/ etc/ lib/ lib64 opt/ usr/",
+		"etc": "hostname hostname2 passwd",
+		"opt": "c",
+		"bin": "busybox sh",
+	} {
+		entries, err := c.ReadDir(dir)
+		if err != nil {
+			t.Errorf("readdir %s: %v", dir, err)
+		} else if got := names(t, entries); got != want {
+			t.Errorf("readdir %s: got %q, want %q", dir, got, want)
+		}
+	}
+	if target, err := c.Readlink("bin/sh"); err != nil || target != "busybox" {
+		t.Errorf("readlink: %q, %v", target, err)
+	}
+	fi, err := c.Lstat("dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&fs.ModeCharDevice == 0 || fi.Sys().(*vfs.Attr).Rdev != 0x103 {
+		t.Errorf("dev/null: %v, %+v", fi.Mode(), fi.Sys())
+	}
+	a, _ := c.Stat("etc/hostname")
+	b, _ := c.Stat("etc/hostname2")
+	if a.Sys().(*vfs.Attr).Ino != b.Sys().(*vfs.Attr).Ino {
+		t.Error("hard links have different inode numbers")
+	}
+	if fi, err := c.Stat("bin/busybox"); err != nil || fi.Mode().Perm() != 0o755 || !fi.ModTime().Equal(time.Unix(1e9, 0)) {
+		t.Errorf("bin/busybox: %v, %v", fi, err)
+	}
+}
+
+func TestTarballs(t *testing.T) {
+	dir := t.TempDir()
+	for i, l := range layers(t) {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.tar", i)), l, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := oci.New(oci.Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, c)
+	if img := c.Image(); img.Cmd != nil || img.Env != nil {
+		t.Errorf("image of tarballs: %+v", img)
+	}
+}
+
+// image is a test image: its blobs by digest, and the index of it.
+type image struct {
+	blobs map[string][]byte
+	root  string
+}
+
+func digest(b []byte) string { return fmt.Sprintf("sha256:%x", sha256.Sum256(b)) }
+
+func newImage(t *testing.T) *image {
+	img := &image{blobs: map[string][]byte{}}
+	add := func(b []byte, mediaType string) map[string]any {
+		d := digest(b)
+		img.blobs[d] = b
+		return map[string]any{"mediaType": mediaType, "digest": d, "size": len(b)}
+	}
+	config, _ := json.Marshal(map[string]any{"config": map[string]any{
+		"Env": []string{"PATH=/bin"},
+		"Cmd": []string{"/bin/sh"},
+	}})
+	var ls []map[string]any
+	for _, l := range layers(t) {
+		ls = append(ls, add(l, "application/vnd.oci.image.layer.v1.tar+gzip"))
+	}
+	m, _ := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        add(config, "application/vnd.oci.image.config.v1+json"),
+		"layers":        ls,
+	})
+	md := add(m, "application/vnd.oci.image.manifest.v1+json")
+	md["platform"] = map[string]string{"os": "linux", "architecture": runtime.GOARCH}
+	other := add([]byte(`{"layers":[]}`), "application/vnd.oci.image.manifest.v1+json")
+	other["platform"] = map[string]string{"os": "linux", "architecture": "s390x"}
+	index, _ := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.index.v1+json",
+		"manifests":     []any{other, md},
+	})
+	img.root = string(index)
+	return img
+}
+
+func TestLayout(t *testing.T) {
+	img := newImage(t)
+	dir := t.TempDir()
+	for d, b := range img.blobs {
+		name := filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(d, "sha256:"))
+		os.MkdirAll(filepath.Dir(name), 0o755)
+		if err := os.WriteFile(name, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0o644)
+	if err := os.WriteFile(filepath.Join(dir, "index.json"), []byte(img.root), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := oci.New(oci.Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, c)
+	if _, err := oci.New(oci.Config{Dir: dir, Platform: "linux/riscv64"}); err == nil {
+		t.Error("no error for a platform the index lacks")
+	}
+}
+
+// registry serves an image as a registry does, behind a token server, and
+// counts the blobs fetched.
+type registry struct {
+	img     *image
+	mu      sync.Mutex
+	fetched map[string]int
+	tokens  int
+}
+
+func (s *registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.URL.Path == "/token" {
+		if r.URL.Query().Get("scope") != "repository:team/app:pull" {
+			http.Error(w, "bad scope", http.StatusBadRequest)
+			return
+		}
+		s.tokens++
+		fmt.Fprint(w, `{"token":"secret"}`)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	p, ok := strings.CutPrefix(r.URL.Path, "/v2/team/app/")
+	switch {
+	case !ok:
+		http.NotFound(w, r)
+	case p == "manifests/1.0":
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		io.WriteString(w, s.img.root)
+	case strings.HasPrefix(p, "manifests/"), strings.HasPrefix(p, "blobs/"):
+		_, d, _ := strings.Cut(p, "/")
+		b, ok := s.img.blobs[d]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.fetched[d]++
+		w.Write(b)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *registry) count(b []byte) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetched[digest(b)]
+}
+
+func newRegistry(t *testing.T) (*oci.FS, *registry) {
+	t.Helper()
+	s := &registry{img: newImage(t), fetched: map[string]int{}}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	c, err := oci.New(oci.Config{Ref: strings.TrimPrefix(srv.URL, "http://") + "/team/app:1.0", PlainHTTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+func TestRegistry(t *testing.T) {
+	c, s := newRegistry(t)
+	ls := layers(t)
+	if img := c.Image(); strings.Join(img.Env, " ") != "PATH=/bin" || strings.Join(img.Cmd, " ") != "/bin/sh" {
+		t.Errorf("image: %+v", img)
+	}
+	for i, l := range ls {
+		if n := s.count(l); n != 0 {
+			t.Errorf("layer %d fetched %d times by New", i, n)
+		}
+	}
+	// The top layer has the file, so no other is needed.
+	if _, err := c.Stat("etc/passwd"); err != nil {
+		t.Fatal(err)
+	}
+	if s.count(ls[2]) != 1 || s.count(ls[1]) != 0 || s.count(ls[0]) != 0 {
+		t.Errorf("fetched %d %d %d layers for the top's file", s.count(ls[0]), s.count(ls[1]), s.count(ls[2]))
+	}
+	check(t, c)
+	for i, l := range ls {
+		if n := s.count(l); n != 1 {
+			t.Errorf("layer %d fetched %d times", i, n)
+		}
+	}
+	if s.tokens != 1 {
+		t.Errorf("%d tokens fetched", s.tokens)
+	}
+}
+
+func TestDigestMismatch(t *testing.T) {
+	c, s := newRegistry(t)
+	top := layers(t)[2]
+	s.mu.Lock()
+	s.img.blobs[digest(top)] = archive(t, true, file{name: "etc/passwd", data: "tampered\n"})
+	s.mu.Unlock()
+	if _, err := c.Stat("etc/passwd"); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("stat of a tampered layer: %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "layer.tar"), layers(t)[0], 0o644)
+	c, err := oci.New(oci.Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, err := range map[string]error{
+		"open for writing":  func() error { _, err := c.Open("etc/passwd", os.O_RDWR, 0); return err }(),
+		"create":            func() error { _, err := c.Open("etc/new", os.O_CREATE|os.O_WRONLY, 0o644); return err }(),
+		"mkdir":             c.Mkdir("d", 0o755),
+		"unlink":            c.Unlink("etc/passwd"),
+		"rename":            c.Rename("etc/passwd", "etc/p"),
+		"chmod":             c.Chmod("etc/passwd", 0o600),
+		"symlink":           c.Symlink("etc/passwd", "l"),
+		"link":              c.Link("etc/passwd", "l"),
+		"chtimes":           c.Chtimes("etc/passwd", time.Now(), time.Now()),
+		"remove of nothing": c.Unlink("etc/missing"),
+	} {
+		if !errors.Is(err, syscall.EROFS) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	f, _ := c.Open("etc/passwd", os.O_RDONLY, 0)
+	if _, err := f.Write([]byte("x")); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("write: %v", err)
+	}
+	if _, err := c.Open("etc", os.O_WRONLY, 0); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("open of a directory for writing: %v", err)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	c, _ := newRegistry(t)
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `cat /img/etc/passwd
+ls /img/opt /img/etc
+echo x >/img/etc/new || echo refused`)
+	cmd.Stdout = &stdout
+	if err := tracer.New(cmd, tracer.WithMount("/img", c)).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := "root:x:0:0:replaced\n/img/etc:\nhostname\nhostname2\npasswd\n\n/img/opt:\nc\nrefused\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func names(t *testing.T, entries []fs.DirEntry) string {
+	var s []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		} else if _, err := e.Info(); err != nil {
+			t.Errorf("info of %s: %v", name, err)
+		}
+		s = append(s, name)
+	}
+	return strings.Join(s, " ")
+}
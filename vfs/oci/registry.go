@@ -0,0 +1,398 @@
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Media types of the manifests and indexes an image is found through.
+const (
+	mediaOCIIndex      = "application/vnd.oci.image.index.v1+json"
+	mediaOCIManifest   = "application/vnd.oci.image.manifest.v1+json"
+	mediaDockerList    = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaDockerImage   = "application/vnd.docker.distribution.manifest.v2+json"
+	manifestAcceptList = mediaOCIIndex + ", " + mediaOCIManifest + ", " + mediaDockerList + ", " + mediaDockerImage
+)
+
+// descriptor points at a blob, as manifests and indexes do.
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+		Variant      string `json:"variant"`
+	} `json:"platform"`
+}
+
+// manifest is an image manifest or an index of them, which have the same
+// shape where it matters.
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+// maxManifest bounds the size of a manifest or index.
+const maxManifest = 4 << 20
+
+// parseManifest parses the manifest or index b, which ref named, checking
+// it against ref if that is a digest.
+func parseManifest(ref string, b []byte) (*manifest, error) {
+	if alg, want, ok := strings.Cut(ref, ":"); ok && alg == "sha256" {
+		if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != want {
+			return nil, fmt.Errorf("oci: manifest %s: digest mismatch", ref)
+		}
+	}
+	m := new(manifest)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("oci: manifest %s: %w", ref, err)
+	}
+	return m, nil
+}
+
+func (m *manifest) isIndex() bool {
+	return m.MediaType == mediaOCIIndex || m.MediaType == mediaDockerList || m.Manifests != nil && m.Layers == nil
+}
+
+// pick returns the manifest of the index for platform, an "os/arch" or
+// "os/arch/variant".
+func (m *manifest) pick(platform string) (descriptor, error) {
+	for _, d := range m.Manifests {
+		p := d.Platform
+		if p == nil {
+			continue
+		}
+		want := p.OS + "/" + p.Architecture
+		if strings.Count(platform, "/") == 2 {
+			want += "/" + p.Variant
+		}
+		if want == platform {
+			return d, nil
+		}
+	}
+	return descriptor{}, fmt.Errorf("oci: no manifest for %s", platform)
+}
+
+// blobs fetches the blobs of an image by digest.
+type blobs interface {
+	// manifest returns the manifest or index ref names, a tag or a
+	// digest, or the top-level one if ref is empty.
+	manifest(ref string) (*manifest, error)
+	blob(digest string) (io.ReadCloser, error)
+}
+
+// resolve returns the manifest of the image ref names in b, by way of an
+// index for platform if there is one.
+func resolve(b blobs, ref, platform string) (*manifest, error) {
+	m, err := b.manifest(ref)
+	for depth := 0; err == nil && m.isIndex(); depth++ {
+		if depth == 4 {
+			return nil, errors.New("oci: indexes nested too deep")
+		}
+		var d descriptor
+		if d, err = m.pick(platform); err == nil {
+			m, err = b.manifest(d.Digest)
+		}
+	}
+	return m, err
+}
+
+// defaultPlatform is the platform of the tracer's own binaries.
+func defaultPlatform() string {
+	p := "linux/" + runtime.GOARCH
+	if runtime.GOARCH == "arm" {
+		p += "/v7"
+	}
+	return p
+}
+
+// layout is an OCI image layout directory.
+type layout string
+
+func (d layout) path(digest string) (string, error) {
+	alg, sum, ok := strings.Cut(digest, ":")
+	if !ok || alg == "" || sum == "" || strings.ContainsAny(digest, "/\\") {
+		return "", fmt.Errorf("oci: bad digest %q", digest)
+	}
+	return filepath.Join(string(d), "blobs", alg, sum), nil
+}
+
+func (d layout) manifest(ref string) (*manifest, error) {
+	name := filepath.Join(string(d), "index.json")
+	if ref != "" {
+		var err error
+		if name, err = d.path(ref); err != nil {
+			return nil, err
+		}
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(ref, b)
+}
+
+func (d layout) blob(digest string) (io.ReadCloser, error) {
+	name, err := d.path(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
+
+// tarballs returns the layers of a directory of layer archives, the
+// lowest first, as their names sort.
+func tarballs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			names = append(names, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// reference is an image reference parsed: the registry host, the
+// repository in it, and a tag or digest.
+type reference struct {
+	host, repo, ref string
+}
+
+// parseReference parses an image reference as docker pull takes one, such
+// as alpine, ghcr.io/owner/repo:tag or localhost:5000/repo@sha256:....
+func parseReference(s string) (reference, error) {
+	r := reference{host: "registry-1.docker.io"}
+	name := s
+	if i := strings.IndexByte(name, '@'); i >= 0 {
+		name, r.ref = name[:i], name[i+1:]
+	} else if i := strings.LastIndexByte(name, ':'); i > strings.LastIndexByte(name, '/') {
+		name, r.ref = name[:i], name[i+1:]
+	}
+	if r.ref == "" {
+		r.ref = "latest"
+	}
+	if first, rest, ok := strings.Cut(name, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		r.host, name = first, rest
+	}
+	if r.host == "docker.io" || r.host == "index.docker.io" {
+		r.host = "registry-1.docker.io"
+	}
+	if r.host == "registry-1.docker.io" && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if name == "" || strings.ToLower(name) != name {
+		return reference{}, fmt.Errorf("oci: bad image reference %q", s)
+	}
+	r.repo = name
+	return r, nil
+}
+
+// registry fetches an image's blobs from a registry, with the Docker
+// Registry HTTP API that OCI distribution standardized.
+type registry struct {
+	base     *url.URL
+	repo     string
+	client   *http.Client
+	user     string
+	password string
+
+	mu    sync.Mutex
+	token string
+}
+
+func newRegistry(r reference, cfg Config) *registry {
+	scheme := "https"
+	if cfg.PlainHTTP {
+		scheme = "http"
+	}
+	c := &registry{
+		base:     &url.URL{Scheme: scheme, Host: r.host},
+		repo:     r.repo,
+		client:   cfg.Client,
+		user:     cfg.Username,
+		password: cfg.Password,
+	}
+	if c.client == nil {
+		c.client = http.DefaultClient
+	}
+	return c
+}
+
+// get fetches the API path p, authenticating as the registry asks.
+func (c *registry) get(p, accept string) (*http.Response, error) {
+	do := func() (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, c.base.JoinPath("v2", c.repo, p).String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		c.mu.Lock()
+		token := c.token
+		c.mu.Unlock()
+		switch {
+		case token != "":
+			req.Header.Set("Authorization", "Bearer "+token)
+		case c.user != "":
+			req.SetBasicAuth(c.user, c.password)
+		}
+		return c.client.Do(req)
+	}
+	resp, err := do()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		drain(resp)
+		if err := c.authenticate(challenge); err != nil {
+			return nil, err
+		}
+		if resp, err = do(); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		drain(resp)
+		return nil, fmt.Errorf("oci: %s: %s", p, resp.Status)
+	}
+	return resp, nil
+}
+
+// authenticate gets a token for the repository from the realm a Bearer
+// challenge names. Basic challenges need no token: get then sends the
+// credentials themselves.
+func (c *registry) authenticate(challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		if c.user == "" {
+			return errors.New("oci: registry wants credentials")
+		}
+		return nil
+	}
+	p := parseChallenge(params)
+	realm, err := url.Parse(p["realm"])
+	if err != nil || p["realm"] == "" {
+		return fmt.Errorf("oci: bad challenge %q", challenge)
+	}
+	q := realm.Query()
+	if s := p["service"]; s != "" {
+		q.Set("service", s)
+	}
+	scope := p["scope"]
+	if scope == "" {
+		scope = "repository:" + c.repo + ":pull"
+	}
+	q.Set("scope", scope)
+	realm.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oci: token: %s", resp.Status)
+	}
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return fmt.Errorf("oci: token: %w", err)
+	}
+	if t.Token == "" {
+		t.Token = t.AccessToken
+	}
+	c.mu.Lock()
+	c.token = t.Token
+	c.mu.Unlock()
+	return nil
+}
+
+// parseChallenge parses the comma-separated key="value" parameters of a
+// WWW-Authenticate challenge.
+func parseChallenge(s string) map[string]string {
+	p := make(map[string]string)
+	for s != "" {
+		s = strings.TrimLeft(s, ", ")
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				break
+			}
+			val, s = rest[1:end+1], rest[end+2:]
+		} else {
+			val, s, _ = strings.Cut(rest, ",")
+		}
+		p[strings.ToLower(strings.TrimSpace(key))] = val
+	}
+	return p
+}
+
+func (c *registry) manifest(ref string) (*manifest, error) {
+	resp, err := c.get("manifests/"+ref, manifestAcceptList)
+	if err != nil {
+		return nil, err
+	}
+	defer drain(resp)
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxManifest))
+	if err != nil {
+		return nil, fmt.Errorf("oci: manifest %s: %w", ref, err)
+	}
+	m, err := parseManifest(ref, b)
+	if err != nil {
+		return nil, err
+	}
+	if m.MediaType == "" {
+		m.MediaType = resp.Header.Get("Content-Type")
+	}
+	return m, nil
+}
+
+func (c *registry) blob(digest string) (io.ReadCloser, error) {
+	resp, err := c.get("blobs/"+digest, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// drain reads the rest of the body of resp and closes it, so that the
+// connection can be used again.
+func drain(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
@@ -0,0 +1,88 @@
+package overlay
+
+import (
+	"path"
+	"sort"
+)
+
+// ChangeKind says how an entry in an FS differs from its lower layer.
+type ChangeKind int
+
+const (
+	// Added entries exist only in the upper layer.
+	Added ChangeKind = iota
+	// Modified entries exist in both layers, the upper entry taking the
+	// place of the lower one.
+	Modified
+	// Deleted entries exist only in the lower layer, hidden by a
+	// whiteout.
+	Deleted
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Modified:
+		return "modified"
+	case Deleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// Change is an entry in the difference between an FS and its lower layer.
+type Change struct {
+	Name string
+	Kind ChangeKind
+}
+
+// Diff returns the changes made through o, sorted by name.
+//
+// Directories copied up to hold changes below them are reported as
+// modified. A directory that took the place of a deleted lower entry is
+// modified too, and everything in it is added, since nothing of the lower
+// entry shows through. The contents of a deleted directory are not
+// reported separately.
+func (o *FS) Diff() ([]Change, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var changes []Change
+	if err := o.diffDir(".", &changes); err != nil {
+		return nil, err
+	}
+	for w := range o.whiteouts {
+		if _, err := o.upper.Lstat(w); err == nil || o.hidden(path.Dir(w)) {
+			continue
+		}
+		if _, err := o.lower.Lstat(w); err == nil {
+			changes = append(changes, Change{Name: w, Kind: Deleted})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes, nil
+}
+
+// diffDir appends the changes held in the upper directory dir.
+func (o *FS) diffDir(dir string, changes *[]Change) error {
+	entries, err := o.upper.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := path.Join(dir, e.Name())
+		kind := Added
+		if !o.hidden(dir) {
+			if _, err := o.lower.Lstat(name); err == nil {
+				kind = Modified
+			}
+		}
+		*changes = append(*changes, Change{Name: name, Kind: kind})
+		if e.IsDir() {
+			if err := o.diffDir(name, changes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
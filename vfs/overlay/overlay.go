@@ -0,0 +1,720 @@
+// Package overlay implements a copy-on-write vfs.Backend, in the manner of
+// overlayfs but without privileges.
+//
+// An FS presents a read-only lower backend, typically a vfs.Dir over part
+// of the host filesystem, merged with a writable upper backend such as a
+// memfs.FS. Reads go to whichever layer holds a name, upper first. The
+// first change to a lower file copies it up, with its extended attributes
+// if the upper layer keeps them, and all changes are made in the upper
+// layer. The lower layer is never written. Names deleted from
+// the lower layer are recorded as whiteouts in memory. Diff reports what
+// the upper layer holds over the lower one.
+//
+// Symlinks are resolved by the FS itself, so a link in one layer can point
+// into the other. Absolute symlink targets are resolved against the root of
+// the FS. Devices, pipes and sockets in the lower layer are opened in place
+// rather than copied up, since their contents are not files to capture.
+// Files already open keep reading the layer they were opened from when a
+// copy-up happens. Renaming a directory that exists in the lower layer
+// fails with EXDEV, as in overlayfs, which makes tools fall back to copying
+// it.
+//
+// All methods are safe for concurrent use.
+package overlay
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// FS is a lower backend overlaid with a writable upper one.
+type FS struct {
+	mu    sync.Mutex
+	lower vfs.Backend
+	upper vfs.Backend
+	// whiteouts holds names whose lower entry, and everything below it,
+	// is hidden. A whiteout outlives an upper entry created in its place,
+	// which makes a directory made there opaque.
+	whiteouts map[string]bool
+}
+
+var (
+	_ vfs.Backend  = (*FS)(nil)
+	_ vfs.Xattrer  = (*FS)(nil)
+	_ vfs.StatFSer = (*FS)(nil)
+	_ vfs.Socketer = (*FS)(nil)
+)
+
+// New returns an FS showing lower with upper on top. Upper should be empty
+// or hold the upper layer of an FS used before; whiteouts are not kept in
+// it, so deletions do not carry over.
+func New(lower, upper vfs.Backend) *FS {
+	return &FS{lower: lower, upper: upper, whiteouts: make(map[string]bool)}
+}
+
+// pathErr returns err, or the errno inside it, as a *fs.PathError for op
+// on name, so errors name what the caller asked for rather than a name
+// within a layer.
+func pathErr(op, name string, err error) error {
+	var (
+		pe *fs.PathError
+		le *os.LinkError
+	)
+	switch {
+	case errors.As(err, &pe):
+		err = pe.Err
+	case errors.As(err, &le):
+		err = le.Err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// hidden reports whether lower entries at name are hidden by a whiteout on
+// name or one of its parents.
+func (o *FS) hidden(name string) bool {
+	for p := name; ; p = path.Dir(p) {
+		if o.whiteouts[p] {
+			return true
+		}
+		if p == "." {
+			return false
+		}
+	}
+}
+
+// layer returns the layer that holds name, whose parents must already be
+// resolved, and what it holds there.
+func (o *FS) layer(name string) (vfs.Backend, fs.FileInfo, error) {
+	fi, err := o.upper.Lstat(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return o.upper, fi, err
+	}
+	if o.hidden(name) {
+		return nil, nil, syscall.ENOENT
+	}
+	fi, err = o.lower.Lstat(name)
+	return o.lower, fi, err
+}
+
+// walk resolves the symlinks in name and returns the name it leads to. A
+// final symlink is followed only if follow is set. The result need not
+// exist, but its parents do and are directories.
+func (o *FS) walk(name string, follow bool) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", syscall.EINVAL
+	}
+	return vfs.Walk(name, ".", follow, func(dir, c string, last bool) (string, fs.FileMode, string, error) {
+		cur := path.Join(dir, c)
+		if last && !follow {
+			return cur, 0, "", nil
+		}
+		b, fi, err := o.layer(cur)
+		if last && errors.Is(err, fs.ErrNotExist) {
+			return cur, 0, "", nil
+		}
+		if err != nil {
+			return "", 0, "", err
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			return cur, fi.Mode(), "", nil
+		}
+		target, err := b.Readlink(cur)
+		return cur, fi.Mode(), target, err
+	})
+}
+
+// copyUp copies the lower entry at name, with its parents, into the upper
+// layer unless it is there already.
+func (o *FS) copyUp(name string) error {
+	b, fi, err := o.layer(name)
+	if err != nil || b == o.upper {
+		return err
+	}
+	if err := o.copyUpDir(path.Dir(name)); err != nil {
+		return err
+	}
+	switch mode := fi.Mode(); {
+	case mode.IsDir():
+		err = o.upper.Mkdir(name, mode.Perm())
+	case mode&fs.ModeSymlink != 0:
+		var target string
+		if target, err = o.lower.Readlink(name); err == nil {
+			err = o.upper.Symlink(target, name)
+		}
+		return err
+	case mode.IsRegular():
+		err = o.copyFile(name, mode.Perm())
+	default:
+		return syscall.EPERM
+	}
+	if err != nil {
+		return err
+	}
+	if err := o.upper.Chmod(name, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := o.copyXattrs(name); err != nil {
+		return err
+	}
+	return o.upper.Chtimes(name, fi.ModTime(), fi.ModTime())
+}
+
+// copyXattrs copies the extended attributes of name up, if both layers
+// keep them.
+func (o *FS) copyXattrs(name string) error {
+	if _, ok := o.upper.(vfs.Xattrer); !ok {
+		return nil
+	}
+	attrs, err := vfs.Listxattr(o.lower, name)
+	if errors.Is(err, syscall.ENOTSUP) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		v, err := vfs.Getxattr(o.lower, name, attr)
+		if err == nil {
+			err = vfs.Setxattr(o.upper, name, attr, v, 0)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyUpDir makes sure the directory name, which must exist, is in the
+// upper layer.
+func (o *FS) copyUpDir(name string) error {
+	if name == "." {
+		return nil
+	}
+	_, fi, err := o.layer(name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return syscall.ENOTDIR
+	}
+	return o.copyUp(name)
+}
+
+func (o *FS) copyFile(name string, perm fs.FileMode) error {
+	src, err := o.lower.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := o.upper.Open(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// remove records that name has gone from the upper layer, hiding the
+// lower entry it may have covered.
+func (o *FS) remove(name string) {
+	for w := range o.whiteouts {
+		if strings.HasPrefix(w, name+"/") {
+			delete(o.whiteouts, w)
+		}
+	}
+	if o.hidden(name) {
+		return
+	}
+	if _, err := o.lower.Lstat(name); err == nil {
+		o.whiteouts[name] = true
+	}
+}
+
+// cover hides any lower entry at name, which is about to get an upper
+// entry created in its place, so a new directory does not show it through.
+func (o *FS) cover(name string) {
+	if _, err := o.lower.Lstat(name); err == nil {
+		o.whiteouts[name] = true
+	}
+}
+
+// modifies reports whether opening with flag can change the file.
+func modifies(flag int) bool {
+	return flag&(os.O_WRONLY|os.O_RDWR) != 0 || flag&os.O_TRUNC != 0
+}
+
+func (o *FS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.walk(name, flag&syscall.O_NOFOLLOW == 0)
+	if err != nil {
+		return nil, pathErr("open", name, err)
+	}
+	b, fi, err := o.layer(p)
+	switch {
+	case err == nil && fi.Mode()&fs.ModeSymlink != 0:
+		return nil, pathErr("open", name, syscall.ELOOP)
+	case err == nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathErr("open", name, syscall.EEXIST)
+	case err == nil && b == o.lower && modifies(flag):
+		if fi.IsDir() {
+			return nil, pathErr("open", name, syscall.EISDIR)
+		}
+		if fi.Mode().IsRegular() {
+			if err := o.copyUp(p); err != nil {
+				return nil, pathErr("open", name, err)
+			}
+			b = o.upper
+		}
+	case err == nil:
+	case errors.Is(err, fs.ErrNotExist) && flag&os.O_CREATE != 0:
+		if err := o.copyUpDir(path.Dir(p)); err != nil {
+			return nil, pathErr("open", name, err)
+		}
+		f, err := o.upper.Open(p, flag, perm)
+		if err != nil {
+			return nil, pathErr("open", name, err)
+		}
+		o.cover(p)
+		return f, nil
+	default:
+		return nil, pathErr("open", name, err)
+	}
+	if b == o.lower {
+		flag &^= os.O_CREATE
+	}
+	f, err := b.Open(p, flag, perm)
+	if err != nil {
+		return nil, pathErr("open", name, err)
+	}
+	return f, nil
+}
+
+func (o *FS) Stat(name string) (fs.FileInfo, error) {
+	return o.stat("stat", name, true)
+}
+
+func (o *FS) Lstat(name string) (fs.FileInfo, error) {
+	return o.stat("lstat", name, false)
+}
+
+func (o *FS) stat(op, name string, follow bool) (fs.FileInfo, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.walk(name, follow)
+	if err != nil {
+		return nil, pathErr(op, name, err)
+	}
+	_, fi, err := o.layer(p)
+	if err != nil {
+		return nil, pathErr(op, name, err)
+	}
+	return fi, nil
+}
+
+func (o *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.walk(name, true)
+	if err != nil {
+		return nil, pathErr("readdir", name, err)
+	}
+	entries, err := o.readDir(p)
+	if err != nil {
+		return nil, pathErr("readdir", name, err)
+	}
+	return entries, nil
+}
+
+// readDir merges the entries of the resolved directory name in both
+// layers.
+func (o *FS) readDir(name string) ([]fs.DirEntry, error) {
+	b, fi, err := o.layer(name)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+	var upper []fs.DirEntry
+	if b == o.upper {
+		if upper, err = o.upper.ReadDir(name); err != nil {
+			return nil, err
+		}
+		if o.hidden(name) {
+			return upper, nil
+		}
+		if fi, err := o.lower.Lstat(name); err != nil || !fi.IsDir() {
+			return upper, nil
+		}
+	}
+	lower, err := o.lower.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(upper))
+	for _, e := range upper {
+		seen[e.Name()] = true
+	}
+	entries := upper
+	for _, e := range lower {
+		if !seen[e.Name()] && !o.whiteouts[path.Join(name, e.Name())] {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (o *FS) Mkdir(name string, perm fs.FileMode) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.walk(name, false)
+	if err != nil {
+		return pathErr("mkdir", name, err)
+	}
+	if err := o.create(p); err != nil {
+		return pathErr("mkdir", name, err)
+	}
+	if err := o.upper.Mkdir(p, perm); err != nil {
+		return pathErr("mkdir", name, err)
+	}
+	o.cover(p)
+	return nil
+}
+
+// create prepares the upper layer for a new entry at the resolved name,
+// which must not exist.
+func (o *FS) create(name string) error {
+	if name == "." {
+		return syscall.EEXIST
+	}
+	_, _, err := o.layer(name)
+	if err == nil {
+		return syscall.EEXIST
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return o.copyUpDir(path.Dir(name))
+}
+
+func (o *FS) Unlink(name string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.walk(name, false)
+	if err != nil {
+		return pathErr("unlink", name, err)
+	}
+	b, fi, err := o.layer(p)
+	switch {
+	case err != nil:
+		return pathErr("unlink", name, err)
+	case fi.IsDir():
+		return pathErr("unlink", name, syscall.EISDIR)
+	case b == o.upper:
+		if err := o.upper.Unlink(p); err != nil {
+			return pathErr("unlink", name, err)
+		}
+	}
+	o.remove(p)
+	return nil
+}
+
+func (o *FS) Rmdir(name string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.walk(name, false)
+	if err != nil {
+		return pathErr("rmdir", name, err)
+	}
+	if p == "." {
+		return pathErr("rmdir", name, syscall.EBUSY)
+	}
+	entries, err := o.readDir(p)
+	if err != nil {
+		return pathErr("rmdir", name, err)
+	}
+	if len(entries) > 0 {
+		return pathErr("rmdir", name, syscall.ENOTEMPTY)
+	}
+	if b, _, _ := o.layer(p); b == o.upper {
+		if err := o.upper.Rmdir(p); err != nil {
+			return pathErr("rmdir", name, err)
+		}
+	}
+	o.remove(p)
+	return nil
+}
+
+func (o *FS) Rename(oldname, newname string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	oldp, err := o.walk(oldname, false)
+	if err != nil {
+		return pathErr("rename", oldname, err)
+	}
+	newp, err := o.walk(newname, false)
+	if err != nil {
+		return pathErr("rename", newname, err)
+	}
+	if err := o.rename(oldp, newp); err != nil {
+		return pathErr("rename", oldname, err)
+	}
+	return nil
+}
+
+func (o *FS) rename(oldp, newp string) error {
+	_, src, err := o.layer(oldp)
+	if err != nil {
+		return err
+	}
+	if oldp == "." || newp == "." {
+		return syscall.EBUSY
+	}
+	if oldp == newp {
+		return nil
+	}
+	if src.IsDir() && strings.HasPrefix(newp, oldp+"/") {
+		return syscall.EINVAL
+	}
+	if src.IsDir() && !o.hidden(oldp) {
+		if _, err := o.lower.Lstat(oldp); err == nil {
+			return syscall.EXDEV
+		}
+	}
+	_, dst, err := o.layer(newp)
+	switch {
+	case err == nil && src.IsDir() && !dst.IsDir():
+		return syscall.ENOTDIR
+	case err == nil && !src.IsDir() && dst.IsDir():
+		return syscall.EISDIR
+	case err == nil && dst.IsDir():
+		entries, err := o.readDir(newp)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+	if err := o.copyUp(oldp); err != nil {
+		return err
+	}
+	if err := o.copyUpDir(path.Dir(newp)); err != nil {
+		return err
+	}
+	if err := o.upper.Rename(oldp, newp); err != nil {
+		return err
+	}
+	o.remove(oldp)
+	o.cover(newp)
+	return nil
+}
+
+func (o *FS) Link(oldname, newname string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	oldp, err := o.walk(oldname, false)
+	if err != nil {
+		return pathErr("link", oldname, err)
+	}
+	newp, err := o.walk(newname, false)
+	if err != nil {
+		return pathErr("link", newname, err)
+	}
+	_, fi, err := o.layer(oldp)
+	if err != nil {
+		return pathErr("link", oldname, err)
+	}
+	if fi.IsDir() {
+		return pathErr("link", oldname, syscall.EPERM)
+	}
+	if err := o.create(newp); err != nil {
+		return pathErr("link", newname, err)
+	}
+	if err := o.copyUp(oldp); err != nil {
+		return pathErr("link", oldname, err)
+	}
+	if err := o.upper.Link(oldp, newp); err != nil {
+		return pathErr("link", newname, err)
+	}
+	o.cover(newp)
+	return nil
+}
+
+func (o *FS) Symlink(target, newname string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.walk(newname, false)
+	if err != nil {
+		return pathErr("symlink", newname, err)
+	}
+	if err := o.create(p); err != nil {
+		return pathErr("symlink", newname, err)
+	}
+	if err := o.upper.Symlink(target, p); err != nil {
+		return pathErr("symlink", newname, err)
+	}
+	o.cover(p)
+	return nil
+}
+
+func (o *FS) Readlink(name string) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.walk(name, false)
+	if err != nil {
+		return "", pathErr("readlink", name, err)
+	}
+	b, _, err := o.layer(p)
+	if err != nil {
+		return "", pathErr("readlink", name, err)
+	}
+	target, err := b.Readlink(p)
+	if err != nil {
+		return "", pathErr("readlink", name, err)
+	}
+	return target, nil
+}
+
+func (o *FS) Chmod(name string, mode fs.FileMode) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.modify(name)
+	if err == nil {
+		err = o.upper.Chmod(p, mode)
+	}
+	if err != nil {
+		return pathErr("chmod", name, err)
+	}
+	return nil
+}
+
+func (o *FS) Chtimes(name string, atime, mtime time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.modify(name)
+	if err == nil {
+		err = o.upper.Chtimes(p, atime, mtime)
+	}
+	if err != nil {
+		return pathErr("chtimes", name, err)
+	}
+	return nil
+}
+
+// modify resolves name, following a final symlink, and copies what it
+// leads to up for a change to its metadata.
+func (o *FS) modify(name string) (string, error) {
+	p, err := o.walk(name, true)
+	if err != nil {
+		return "", err
+	}
+	return p, o.copyUp(p)
+}
+
+func (o *FS) Getxattr(name, attr string) ([]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.walk(name, true)
+	var b vfs.Backend
+	if err == nil {
+		b, _, err = o.layer(p)
+	}
+	var v []byte
+	if err == nil {
+		v, err = vfs.Getxattr(b, p, attr)
+	}
+	if err != nil {
+		return nil, pathErr("getxattr", name, err)
+	}
+	return v, nil
+}
+
+func (o *FS) Listxattr(name string) ([]string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.walk(name, true)
+	var b vfs.Backend
+	if err == nil {
+		b, _, err = o.layer(p)
+	}
+	var attrs []string
+	if err == nil {
+		attrs, err = vfs.Listxattr(b, p)
+	}
+	if err != nil {
+		return nil, pathErr("listxattr", name, err)
+	}
+	return attrs, nil
+}
+
+func (o *FS) Setxattr(name, attr string, value []byte, flags int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.modify(name)
+	if err == nil {
+		err = vfs.Setxattr(o.upper, p, attr, value, flags)
+	}
+	if err != nil {
+		return pathErr("setxattr", name, err)
+	}
+	return nil
+}
+
+func (o *FS) Removexattr(name, attr string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.modify(name)
+	if err == nil {
+		err = vfs.Removexattr(o.upper, p, attr)
+	}
+	if err != nil {
+		return pathErr("removexattr", name, err)
+	}
+	return nil
+}
+
+// SocketPath returns the host path of the named file in the layer that
+// holds it. A name neither holds is in the upper layer, where a socket is
+// bound; its parent directories are copied up for it.
+func (o *FS) SocketPath(name string) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.walk(name, false)
+	if err != nil {
+		return "", pathErr("socket", name, err)
+	}
+	l, _, err := o.layer(p)
+	switch {
+	case err == nil:
+		return vfs.SocketPath(l, p)
+	case !errors.Is(err, fs.ErrNotExist):
+		return "", pathErr("socket", name, err)
+	}
+	if err := o.copyUpDir(path.Dir(p)); err != nil {
+		return "", pathErr("socket", name, err)
+	}
+	return vfs.SocketPath(o.upper, p)
+}
+
+// StatFS describes the upper layer, which holds whatever is written.
+func (o *FS) StatFS(name string) (vfs.FSStat, error) {
+	return vfs.StatFS(o.upper, ".")
+}
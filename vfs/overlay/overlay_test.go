@@ -0,0 +1,242 @@
+package overlay
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+)
+
+// newFS returns an overlay of a host directory holding files, given by
+// name and contents, with a memfs on top. Names ending in a slash are
+// directories.
+func newFS(t *testing.T, files map[string]string) (*FS, string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if name[len(name)-1] == '/' {
+			if err := os.MkdirAll(p, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return New(vfs.Dir(dir), memfs.New()), dir
+}
+
+func readFile(t *testing.T, b vfs.Backend, name string) string {
+	t.Helper()
+	f, err := b.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func writeFile(t *testing.T, b vfs.Backend, name string, flag int, data string) {
+	t.Helper()
+	f, err := b.Open(name, os.O_WRONLY|flag, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func names(t *testing.T, b vfs.Backend, dir string) []string {
+	t.Helper()
+	entries, err := b.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestCopyUp(t *testing.T) {
+	o, dir := newFS(t, map[string]string{"d/a": "lower"})
+	if got := readFile(t, o, "d/a"); got != "lower" {
+		t.Fatalf("read through: got %q", got)
+	}
+	writeFile(t, o, "d/a", os.O_APPEND, "+upper")
+	if got := readFile(t, o, "d/a"); got != "lower+upper" {
+		t.Errorf("after copy-up: got %q", got)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "d/a")); string(b) != "lower" {
+		t.Errorf("lower layer changed to %q", b)
+	}
+	writeFile(t, o, "d/new", os.O_CREATE, "new")
+	if _, err := os.Stat(filepath.Join(dir, "d/new")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("created file reached the lower layer: %v", err)
+	}
+	if got, want := names(t, o, "d"), []string{"a", "new"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("readdir: got %v, want %v", got, want)
+	}
+	if err := o.Chmod("d", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := o.Stat("d"); err != nil || fi.Mode().Perm() != 0o700 {
+		t.Errorf("stat after chmod: %v, %v", fi, err)
+	}
+}
+
+func TestXattrCopyUp(t *testing.T) {
+	o, dir := newFS(t, map[string]string{"a": "lower"})
+	if err := syscall.Setxattr(filepath.Join(dir, "a"), "user.lower", []byte("1"), 0); err != nil {
+		t.Skipf("host directory keeps no user xattrs: %v", err)
+	}
+	if err := o.Setxattr("a", "user.upper", []byte("2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := o.Listxattr("a"); err != nil || !reflect.DeepEqual(got, []string{"user.lower", "user.upper"}) {
+		t.Errorf("listxattr after copy-up: %v, %v", got, err)
+	}
+	if n, _ := syscall.Listxattr(filepath.Join(dir, "a"), make([]byte, 64)); n != len("user.lower\x00") {
+		t.Errorf("lower layer xattrs changed, list is %d bytes", n)
+	}
+}
+
+func TestWhiteouts(t *testing.T) {
+	o, _ := newFS(t, map[string]string{"a": "a", "d/b": "b", "d/c": "c"})
+	if err := o.Unlink("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Stat("a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat of a deleted lower file: got %v", err)
+	}
+	if err := o.Rmdir("d"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("rmdir of a non-empty lower dir: got %v", err)
+	}
+	if err := o.Unlink("d/b"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(t, o, "d"), []string{"c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("readdir: got %v, want %v", got, want)
+	}
+	if err := o.Unlink("d/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Rmdir("d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Mkdir("d", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, o, "d"); len(got) != 0 {
+		t.Errorf("recreated directory shows %v", got)
+	}
+	writeFile(t, o, "a", os.O_CREATE|os.O_EXCL, "again")
+	if got := readFile(t, o, "a"); got != "again" {
+		t.Errorf("recreated file has %q", got)
+	}
+	if got, want := names(t, o, "."), []string{"a", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("readdir: got %v, want %v", got, want)
+	}
+}
+
+func TestRename(t *testing.T) {
+	o, _ := newFS(t, map[string]string{"a": "a", "d/b": "b", "e/": ""})
+	if err := o.Rename("a", "e/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Lstat("a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("renamed file still at its old name: %v", err)
+	}
+	if got := readFile(t, o, "e/a"); got != "a" {
+		t.Errorf("renamed file has %q", got)
+	}
+	if err := o.Rename("d", "f"); !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("rename of a lower directory: got %v", err)
+	}
+	if err := o.Mkdir("g", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Rename("g", "h"); err != nil {
+		t.Errorf("rename of an upper directory: %v", err)
+	}
+	if err := o.Rename("e/a", "d"); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("rename over a directory: got %v", err)
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	o, _ := newFS(t, map[string]string{"d/a": "target"})
+	if err := o.Symlink("/d", "link"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, o, "link/a"); got != "target" {
+		t.Errorf("read through an upper symlink into the lower layer: got %q", got)
+	}
+	writeFile(t, o, "link/a", os.O_TRUNC, "changed")
+	if got := readFile(t, o, "d/a"); got != "changed" {
+		t.Errorf("write through a symlink: got %q", got)
+	}
+	if target, err := o.Readlink("link"); err != nil || target != "/d" {
+		t.Errorf("readlink: %q, %v", target, err)
+	}
+	if _, err := o.Open("link", os.O_RDONLY|syscall.O_NOFOLLOW, 0); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("open with O_NOFOLLOW: got %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	o, _ := newFS(t, map[string]string{"keep": "", "mod": "", "del": "", "d/x": "", "gone/y": ""})
+	writeFile(t, o, "mod", os.O_TRUNC, "changed")
+	writeFile(t, o, "d/new", os.O_CREATE, "")
+	if err := o.Unlink("del"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Unlink("gone/y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Rmdir("gone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Mkdir("added", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, o, "added/z", os.O_CREATE, "")
+
+	got, err := o.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{"added", Added},
+		{"added/z", Added},
+		{"d", Modified},
+		{"d/new", Added},
+		{"del", Deleted},
+		{"gone", Deleted},
+		{"mod", Modified},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
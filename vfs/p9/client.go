@@ -0,0 +1,252 @@
+package p9
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+)
+
+// response is a message read for a request.
+type response struct {
+	typ  uint8
+	body []byte
+	err  error
+}
+
+// conn multiplexes requests over a connection to a server, by tag.
+type conn struct {
+	rw    io.ReadWriteCloser
+	msize uint32
+
+	wmu sync.Mutex // serializes writes to rw
+
+	mu      sync.Mutex
+	pending map[uint16]chan response
+	nextTag uint16
+	nextFid uint32
+	freeFid []uint32
+	err     error // why the connection is no longer usable
+}
+
+func newConn(rw io.ReadWriteCloser, msize uint32) (*conn, error) {
+	c := &conn{rw: rw, msize: msize, pending: make(map[uint16]chan response)}
+	// Tversion is sent before the reader runs, as the only request in
+	// flight, and fixes the msize the reader takes.
+	var e encoder
+	e.u32(msize)
+	e.str(version)
+	if err := c.write(msgTversion, noTag, e); err != nil {
+		return nil, err
+	}
+	typ, _, body, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if typ != msgTversion+1 {
+		return nil, fmt.Errorf("p9: version: unexpected message %d", typ)
+	}
+	d := decoder{b: body}
+	msize, v := d.u32(), d.str()
+	switch {
+	case d.err != nil:
+		return nil, d.err
+	case v != version:
+		return nil, fmt.Errorf("p9: server speaks %q, not %s", v, version)
+	case msize <= ioHeader:
+		return nil, fmt.Errorf("p9: server msize %d too small", msize)
+	}
+	c.msize = min(c.msize, msize)
+	go c.readLoop()
+	return c, nil
+}
+
+// write sends a message with the given type, tag and body.
+func (c *conn) write(typ uint8, tag uint16, body []byte) error {
+	msg := make([]byte, 7, 7+len(body))
+	binary.LittleEndian.PutUint32(msg, uint32(7+len(body)))
+	msg[4] = typ
+	binary.LittleEndian.PutUint16(msg[5:], tag)
+	msg = append(msg, body...)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.rw.Write(msg)
+	return err
+}
+
+// read reads a message.
+func (c *conn) read() (typ uint8, tag uint16, body []byte, err error) {
+	var hdr [7]byte
+	if _, err := io.ReadFull(c.rw, hdr[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[:])
+	if size < 7 || c.msize != 0 && size > c.msize {
+		return 0, 0, nil, fmt.Errorf("p9: bad message size %d", size)
+	}
+	body = make([]byte, size-7)
+	if _, err := io.ReadFull(c.rw, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return hdr[4], binary.LittleEndian.Uint16(hdr[5:]), body, nil
+}
+
+// readLoop hands each message read to the request with its tag, until
+// the connection fails, which fails every request.
+func (c *conn) readLoop() {
+	for {
+		typ, tag, body, err := c.read()
+		c.mu.Lock()
+		if err != nil {
+			c.err = fmt.Errorf("p9: connection lost: %w", err)
+			for tag, ch := range c.pending {
+				ch <- response{err: c.err}
+				delete(c.pending, tag)
+			}
+			c.mu.Unlock()
+			return
+		}
+		ch, ok := c.pending[tag]
+		delete(c.pending, tag)
+		c.mu.Unlock()
+		if ok {
+			ch <- response{typ: typ, body: body}
+		}
+	}
+}
+
+// rpc sends a request and waits for its response, returning the body of
+// the response, or the errno of an Rlerror.
+func (c *conn) rpc(typ uint8, body []byte) ([]byte, error) {
+	ch := make(chan response, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	tag := c.nextTag
+	for _, used := c.pending[tag]; used || tag == noTag; _, used = c.pending[tag] {
+		tag++
+	}
+	c.nextTag = tag + 1
+	c.pending[tag] = ch
+	c.mu.Unlock()
+
+	if err := c.write(typ, tag, body); err != nil {
+		c.mu.Lock()
+		delete(c.pending, tag)
+		c.mu.Unlock()
+		return nil, err
+	}
+	resp := <-ch
+	switch {
+	case resp.err != nil:
+		return nil, resp.err
+	case resp.typ == msgRlerror:
+		d := decoder{b: resp.body}
+		if errno := d.u32(); d.err == nil {
+			return nil, syscall.Errno(errno)
+		}
+		return nil, d.err
+	case resp.typ != typ+1:
+		return nil, fmt.Errorf("p9: unexpected message %d for %d", resp.typ, typ)
+	}
+	return resp.body, nil
+}
+
+// newFid returns a fid no file is using.
+func (c *conn) newFid() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := len(c.freeFid); n > 0 {
+		fid := c.freeFid[n-1]
+		c.freeFid = c.freeFid[:n-1]
+		return fid
+	}
+	fid := c.nextFid
+	c.nextFid++
+	return fid
+}
+
+// clunk releases fid on the server and for reuse.
+func (c *conn) clunk(fid uint32) error {
+	var e encoder
+	e.u32(fid)
+	_, err := c.rpc(msgTclunk, e)
+	// The fid is released even if Tclunk fails, as the protocol has it.
+	c.mu.Lock()
+	c.freeFid = append(c.freeFid, fid)
+	c.mu.Unlock()
+	return err
+}
+
+// attach returns a fid for the root of the tree aname, with its qid.
+func (c *conn) attach(uname, aname string, uid uint32) (uint32, qid, error) {
+	fid := c.newFid()
+	var e encoder
+	e.u32(fid)
+	e.u32(noFid)
+	e.str(uname)
+	e.str(aname)
+	e.u32(uid)
+	body, err := c.rpc(msgTattach, e)
+	if err != nil {
+		return 0, qid{}, err
+	}
+	d := decoder{b: body}
+	q := d.qid()
+	return fid, q, d.err
+}
+
+// walk clones fid as a new fid for the file that names leads to, which
+// must all exist. It returns the qid of each name walked, which are fewer
+// than the names if one of them is not there; the new fid is then not
+// made.
+func (c *conn) walk(fid uint32, names []string) (uint32, []qid, error) {
+	newFid := c.newFid()
+	var qids []qid
+	from := fid
+	for first := true; first || len(names) > 0; first = false {
+		n := min(len(names), maxWalk)
+		var e encoder
+		e.u32(from)
+		e.u32(newFid)
+		e.u16(uint16(n))
+		for _, name := range names[:n] {
+			e.str(name)
+		}
+		body, err := c.rpc(msgTwalk, e)
+		if err != nil {
+			c.release(newFid, from != fid)
+			return 0, qids, err
+		}
+		d := decoder{b: body}
+		got := int(d.u16())
+		for range got {
+			qids = append(qids, d.qid())
+		}
+		if d.err != nil {
+			c.release(newFid, from != fid)
+			return 0, qids, d.err
+		}
+		if got < n {
+			c.release(newFid, from != fid)
+			return 0, qids, nil
+		}
+		names = names[n:]
+		from = newFid
+	}
+	return newFid, qids, nil
+}
+
+// release frees a fid walk allocated, clunking it if the server has it.
+func (c *conn) release(fid uint32, made bool) {
+	if made {
+		c.clunk(fid)
+		return
+	}
+	c.mu.Lock()
+	c.freeFid = append(c.freeFid, fid)
+	c.mu.Unlock()
+}
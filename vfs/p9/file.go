@@ -0,0 +1,225 @@
+package p9
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// file is an open file, holding a fid for it. The fid of a directory is
+// not opened on the server, as its entries are listed through ReadDir.
+type file struct {
+	fs     *FS
+	fid    uint32
+	name   string
+	flag   int
+	iounit uint32
+	opened bool
+
+	mu     sync.Mutex
+	off    int64
+	closed bool
+}
+
+// check returns the error an operation on f fails with before it is
+// sent, if any.
+func (f *file) check(op string, write bool) error {
+	f.mu.Lock()
+	closed := f.closed
+	f.mu.Unlock()
+	if err := vfs.CheckFile(op, f.name, f.flag, closed, write); err != nil {
+		return err
+	}
+	if !f.opened && !write {
+		return pathErr(op, f.name, syscall.EISDIR)
+	}
+	return nil
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAt(b, f.off)
+	f.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, pathErr("read", f.name, syscall.EINVAL)
+	}
+	return f.readAt(b, off)
+}
+
+// readAt reads b from off in requests of at most the iounit, stopping
+// short at the end of the file.
+func (f *file) readAt(b []byte, off int64) (int, error) {
+	n := 0
+	for n < len(b) {
+		var e encoder
+		e.u32(f.fid)
+		e.u64(uint64(off) + uint64(n))
+		e.u32(uint32(min(len(b)-n, int(f.iounit))))
+		body, err := f.fs.c.rpc(msgTread, e)
+		if err != nil {
+			return n, pathErr("read", f.name, err)
+		}
+		d := decoder{b: body}
+		data := d.take(int(d.u32()))
+		if d.err != nil {
+			return n, pathErr("read", f.name, d.err)
+		}
+		if len(data) == 0 {
+			return n, io.EOF
+		}
+		n += copy(b[n:], data)
+	}
+	return n, nil
+}
+
+func (f *file) Write(b []byte) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		a, err := f.fs.getattr(f.fid)
+		if err != nil {
+			return 0, pathErr("write", f.name, err)
+		}
+		f.off = int64(a.size)
+	}
+	n, err := f.writeAt(b, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *file) WriteAt(b []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, pathErr("write", f.name, syscall.EINVAL)
+	}
+	return f.writeAt(b, off)
+}
+
+// writeAt writes b at off in requests of at most the iounit.
+func (f *file) writeAt(b []byte, off int64) (int, error) {
+	if !f.opened {
+		return 0, pathErr("write", f.name, syscall.EISDIR)
+	}
+	n := 0
+	for n < len(b) {
+		chunk := b[n : n+min(len(b)-n, int(f.iounit))]
+		var e encoder
+		e.u32(f.fid)
+		e.u64(uint64(off) + uint64(n))
+		e.u32(uint32(len(chunk)))
+		e = append(e, chunk...)
+		body, err := f.fs.c.rpc(msgTwrite, e)
+		if err != nil {
+			return n, pathErr("write", f.name, err)
+		}
+		d := decoder{b: body}
+		count := int(d.u32())
+		if d.err != nil {
+			return n, pathErr("write", f.name, d.err)
+		}
+		if count == 0 || count > len(chunk) {
+			return n, pathErr("write", f.name, syscall.EIO)
+		}
+		n += count
+	}
+	return n, nil
+}
+
+// Truncate sets the size of the file on the server. 9P2000.L has no
+// message to punch holes, so vfs.PunchHole writes zeros instead.
+func (f *file) Truncate(size int64) error {
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return pathErr("truncate", f.name, syscall.EINVAL)
+	}
+	if !f.opened {
+		return pathErr("truncate", f.name, syscall.EISDIR)
+	}
+	if err := f.fs.setattrFid(f.fid, setattrSize, 0, uint64(size), time.Unix(0, 0), time.Unix(0, 0)); err != nil {
+		return pathErr("truncate", f.name, err)
+	}
+	return nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, pathErr("seek", f.name, fs.ErrClosed)
+	}
+	if !f.opened {
+		return 0, nil
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		a, err := f.fs.getattr(f.fid)
+		if err != nil {
+			return 0, pathErr("seek", f.name, err)
+		}
+		offset += int64(a.size)
+	default:
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	if offset < 0 {
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	f.mu.Lock()
+	closed := f.closed
+	f.mu.Unlock()
+	if closed {
+		return nil, pathErr("stat", f.name, fs.ErrClosed)
+	}
+	a, err := f.fs.getattr(f.fid)
+	if err != nil {
+		return nil, pathErr("stat", f.name, err)
+	}
+	return newInfo(path.Base(f.name), a), nil
+}
+
+func (f *file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return pathErr("close", f.name, fs.ErrClosed)
+	}
+	f.closed = true
+	if err := f.fs.c.clunk(f.fid); err != nil {
+		return pathErr("close", f.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,725 @@
+// Package p9 implements a vfs.Backend that is a client of a 9P2000.L
+// server, such as diod or u9fs, so that a command can use a tree a server
+// exports without mounting it, which takes root.
+//
+// Names are walked from the root of the tree attached, and symlinks in
+// them are resolved by the client, an absolute target against the root of
+// the tree. Errors the server reports are returned as the errnos it
+// gives. Ownership, permissions and times are those the server reports,
+// and the server applies its own access checks, as the user the FS
+// attaches as.
+//
+// Requests are multiplexed over the one connection, so all methods, and
+// the methods of the files an FS opens, are safe for concurrent use. Once
+// the connection fails, every request made on it fails.
+package p9
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// Config describes how to attach to a server.
+type Config struct {
+	// Aname names the tree to attach to, for a server that exports more
+	// than one, as diod does by path.
+	Aname string
+	// Uname and Uid are the user to attach as. The defaults are the
+	// user's name and uid.
+	Uname string
+	Uid   *uint32
+	// Gid is the group files the FS creates belong to. The default is the
+	// user's gid.
+	Gid *uint32
+	// Msize is the most bytes a message can hold, which the server can
+	// lower. The default is 512 KiB.
+	Msize uint32
+}
+
+// FS is a tree a 9P2000.L server exports.
+type FS struct {
+	c       *conn
+	root    uint32 // the fid of the root
+	rootQid qid
+	gid     uint32
+}
+
+var _ vfs.Backend = (*FS)(nil)
+
+// Dial connects to the server at addr on the named network, such as "tcp"
+// or "unix", and attaches to it.
+func Dial(network, addr string, cfg Config) (*FS, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	f, err := New(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// New attaches to the server at the other end of rw. The FS owns rw, and
+// Close closes it.
+func New(rw io.ReadWriteCloser, cfg Config) (*FS, error) {
+	if cfg.Msize == 0 {
+		cfg.Msize = 512 << 10
+	}
+	if cfg.Uname == "" {
+		cfg.Uname = os.Getenv("USER")
+	}
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	if cfg.Uid != nil {
+		uid = *cfg.Uid
+	}
+	if cfg.Gid != nil {
+		gid = *cfg.Gid
+	}
+	c, err := newConn(rw, cfg.Msize)
+	if err != nil {
+		return nil, err
+	}
+	root, rootQid, err := c.attach(cfg.Uname, cfg.Aname, uid)
+	if err != nil {
+		rw.Close()
+		return nil, fmt.Errorf("p9: attach %q: %w", cfg.Aname, err)
+	}
+	return &FS{c: c, root: root, rootQid: rootQid, gid: gid}, nil
+}
+
+// Close closes the connection to the server. Files still open fail
+// afterwards.
+func (f *FS) Close() error {
+	f.c.clunk(f.root)
+	return f.c.rw.Close()
+}
+
+func pathErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// walk returns a new fid for the file at name, with its qid. Symlinks in
+// intermediate components are always followed; a final symlink is
+// followed only if follow is set. The caller clunks the fid.
+func (f *FS) walk(op, name string, follow bool) (uint32, qid, error) {
+	if !fs.ValidPath(name) {
+		return 0, qid{}, pathErr(op, name, syscall.EINVAL)
+	}
+	// resolved names the directory reached, from the root and free of
+	// symlinks; comps are the names left to walk from it.
+	var resolved []string
+	comps := strings.Split(name, "/")
+	links := 0
+	for {
+		for len(comps) > 0 && (comps[0] == "" || comps[0] == ".") {
+			comps = comps[1:]
+		}
+		if len(comps) > 0 && comps[0] == ".." {
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			comps = comps[1:]
+			continue
+		}
+		// Walk the names up to the next "..", in one request, and look
+		// for a symlink among them afterwards: the server does not
+		// follow them.
+		var run []string
+		for len(comps) > 0 && comps[0] != ".." {
+			if c := comps[0]; c != "" && c != "." {
+				run = append(run, c)
+			}
+			comps = comps[1:]
+		}
+		names := append(append([]string(nil), resolved...), run...)
+		fid, qids, err := f.c.walk(f.root, names)
+		if err != nil {
+			return 0, qid{}, pathErr(op, name, err)
+		}
+		complete := len(qids) == len(names)
+		got := qids[min(len(resolved), len(qids)):]
+		link := -1
+		for i, q := range got {
+			if q.typ&qtSymlink != 0 && (i < len(run)-1 || len(comps) > 0 || follow) {
+				link = i
+				break
+			}
+		}
+		switch {
+		case link >= 0:
+			if complete {
+				f.c.clunk(fid)
+			}
+			target, err := f.readlinkAt(names[:len(resolved)+link+1])
+			if err != nil {
+				return 0, qid{}, pathErr(op, name, err)
+			}
+			if links++; links > vfs.MaxSymlinks {
+				return 0, qid{}, pathErr(op, name, syscall.ELOOP)
+			}
+			resolved = append(resolved, run[:link]...)
+			if path.IsAbs(target) {
+				resolved = nil
+			}
+			comps = append(append(strings.Split(target, "/"), run[link+1:]...), comps...)
+		case !complete && len(got) > 0 && got[len(got)-1].typ&qtDir == 0:
+			return 0, qid{}, pathErr(op, name, syscall.ENOTDIR)
+		case !complete:
+			return 0, qid{}, pathErr(op, name, syscall.ENOENT)
+		case len(comps) == 0:
+			last := f.rootQid
+			if len(qids) > 0 {
+				last = qids[len(qids)-1]
+			}
+			return fid, last, nil
+		default:
+			// A ".." follows, which needs the last name to be a directory.
+			f.c.clunk(fid)
+			if len(qids) > 0 && qids[len(qids)-1].typ&qtDir == 0 {
+				return 0, qid{}, pathErr(op, name, syscall.ENOTDIR)
+			}
+			resolved = names
+		}
+	}
+}
+
+// readlinkAt returns the target of the symlink names lead to, or EINVAL
+// if it is not a symlink.
+func (f *FS) readlinkAt(names []string) (string, error) {
+	fid, qids, err := f.c.walk(f.root, names)
+	switch {
+	case err != nil:
+		return "", err
+	case len(qids) < len(names):
+		return "", syscall.ENOENT
+	}
+	defer f.c.clunk(fid)
+	if qids[len(qids)-1].typ&qtSymlink == 0 {
+		return "", syscall.EINVAL
+	}
+	var e encoder
+	e.u32(fid)
+	body, err := f.c.rpc(msgTreadlink, e)
+	if err != nil {
+		return "", err
+	}
+	d := decoder{b: body}
+	target := d.str()
+	return target, d.err
+}
+
+// parent returns a fid for the directory holding name, with the final
+// element of name.
+func (f *FS) parent(op, name string) (uint32, string, error) {
+	if !fs.ValidPath(name) {
+		return 0, "", pathErr(op, name, syscall.EINVAL)
+	}
+	if name == "." {
+		return 0, "", pathErr(op, name, syscall.EBUSY)
+	}
+	dir, base := path.Split(name)
+	fid, q, err := f.walk(op, path.Clean(dir), true)
+	if err != nil {
+		return 0, "", err
+	}
+	if q.typ&qtDir == 0 {
+		f.c.clunk(fid)
+		return 0, "", pathErr(op, name, syscall.ENOTDIR)
+	}
+	return fid, base, nil
+}
+
+// getattr returns the attributes of the file fid is for.
+func (f *FS) getattr(fid uint32) (attr, error) {
+	var e encoder
+	e.u32(fid)
+	e.u64(getattrBasic)
+	body, err := f.c.rpc(msgTgetattr, e)
+	if err != nil {
+		return attr{}, err
+	}
+	d := decoder{b: body}
+	a := d.attr()
+	return a, d.err
+}
+
+// lopen opens the file fid is for with the os.O_* flags flag, returning
+// the most bytes a read or write of it should ask for.
+func (f *FS) lopen(fid uint32, flag int) (uint32, error) {
+	var e encoder
+	e.u32(fid)
+	e.u32(protoFlags(flag))
+	body, err := f.c.rpc(msgTlopen, e)
+	if err != nil {
+		return 0, err
+	}
+	return f.iounit(body)
+}
+
+// iounit returns the I/O size of an Rlopen or Rlcreate, which the server
+// can leave to the msize.
+func (f *FS) iounit(body []byte) (uint32, error) {
+	d := decoder{b: body}
+	d.qid()
+	n := d.u32()
+	if limit := f.c.msize - ioHeader; n == 0 || n > limit {
+		n = limit
+	}
+	return n, d.err
+}
+
+// protoFlags converts os.O_* flags to those of the protocol.
+func protoFlags(flag int) uint32 {
+	var p uint32
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_WRONLY:
+		p = lWronly
+	case os.O_RDWR:
+		p = lRdwr
+	}
+	for _, m := range []struct {
+		os    int
+		proto uint32
+	}{
+		{os.O_CREATE, lCreate},
+		{os.O_EXCL, lExcl},
+		{os.O_TRUNC, lTrunc},
+		{os.O_APPEND, lAppend},
+		{syscall.O_DIRECTORY, lDirectory},
+		{syscall.O_NOFOLLOW, lNofollow},
+	} {
+		if flag&m.os != 0 {
+			p |= m.proto
+		}
+	}
+	return p
+}
+
+func (f *FS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	if flag&os.O_CREATE != 0 && name != "." {
+		return f.create(name, flag, perm)
+	}
+	fid, q, err := f.walk("open", name, flag&syscall.O_NOFOLLOW == 0)
+	if err != nil {
+		return nil, err
+	}
+	return f.open(name, fid, q, flag)
+}
+
+// open opens the file fid is for, which was walked to.
+func (f *FS) open(name string, fid uint32, q qid, flag int) (vfs.File, error) {
+	acc := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	var err error
+	switch {
+	case q.typ&qtSymlink != 0:
+		err = syscall.ELOOP
+	case q.typ&qtDir != 0 && (acc != os.O_RDONLY || flag&os.O_CREATE != 0):
+		err = syscall.EISDIR
+	case q.typ&qtDir != 0:
+		// Directories are listed by name, so the fid is kept for
+		// Tgetattr without being opened.
+		return &file{fs: f, fid: fid, name: name, flag: flag}, nil
+	case flag&syscall.O_DIRECTORY != 0:
+		err = syscall.ENOTDIR
+	}
+	if err != nil {
+		f.c.clunk(fid)
+		return nil, pathErr("open", name, err)
+	}
+	iounit, err := f.lopen(fid, flag&^(os.O_CREATE|os.O_EXCL))
+	if err != nil {
+		f.c.clunk(fid)
+		return nil, pathErr("open", name, err)
+	}
+	return &file{fs: f, fid: fid, name: name, flag: flag, iounit: iounit, opened: true}, nil
+}
+
+// create opens name with O_CREATE, which makes it with Tlcreate unless it
+// is there.
+func (f *FS) create(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	dfid, base, err := f.parent("open", name)
+	if err != nil {
+		return nil, err
+	}
+	fid, qids, err := f.c.walk(dfid, []string{base})
+	if err == nil && len(qids) == 1 {
+		f.c.clunk(dfid)
+		if flag&os.O_EXCL != 0 {
+			f.c.clunk(fid)
+			return nil, pathErr("open", name, syscall.EEXIST)
+		}
+		if qids[0].typ&qtSymlink != 0 && flag&syscall.O_NOFOLLOW == 0 {
+			f.c.clunk(fid)
+			if fid, qids[0], err = f.walk("open", name, true); err != nil {
+				return nil, err
+			}
+		}
+		return f.open(name, fid, qids[0], flag)
+	}
+	if err != nil && err != syscall.ENOENT {
+		f.c.clunk(dfid)
+		return nil, pathErr("open", name, err)
+	}
+	// Tlcreate turns the directory's fid into one for the new file.
+	var e encoder
+	e.u32(dfid)
+	e.str(base)
+	e.u32(protoFlags(flag &^ os.O_TRUNC))
+	e.u32(unixPerm(perm))
+	e.u32(f.gid)
+	body, err := f.c.rpc(msgTlcreate, e)
+	if err != nil {
+		f.c.clunk(dfid)
+		return nil, pathErr("open", name, err)
+	}
+	iounit, err := f.iounit(body)
+	if err != nil {
+		f.c.clunk(dfid)
+		return nil, pathErr("open", name, err)
+	}
+	return &file{fs: f, fid: dfid, name: name, flag: flag, iounit: iounit, opened: true}, nil
+}
+
+// unixPerm converts the permission bits of m to those of a Unix mode.
+func unixPerm(m fs.FileMode) uint32 {
+	p := uint32(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		p |= syscall.S_ISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		p |= syscall.S_ISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		p |= syscall.S_ISVTX
+	}
+	return p
+}
+
+// stat returns the information for the file at name.
+func (f *FS) stat(op, name string, follow bool) (fs.FileInfo, error) {
+	fid, _, err := f.walk(op, name, follow)
+	if err != nil {
+		return nil, err
+	}
+	defer f.c.clunk(fid)
+	a, err := f.getattr(fid)
+	if err != nil {
+		return nil, pathErr(op, name, err)
+	}
+	return newInfo(path.Base(name), a), nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error)  { return f.stat("stat", name, true) }
+func (f *FS) Lstat(name string) (fs.FileInfo, error) { return f.stat("lstat", name, false) }
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	fid, q, err := f.walk("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	defer f.c.clunk(fid)
+	if q.typ&qtDir == 0 {
+		return nil, pathErr("readdir", name, syscall.ENOTDIR)
+	}
+	iounit, err := f.lopen(fid, os.O_RDONLY)
+	if err != nil {
+		return nil, pathErr("readdir", name, err)
+	}
+	var entries []fs.DirEntry
+	for off := uint64(0); ; {
+		var e encoder
+		e.u32(fid)
+		e.u64(off)
+		e.u32(iounit)
+		body, err := f.c.rpc(msgTreaddir, e)
+		if err != nil {
+			return nil, pathErr("readdir", name, err)
+		}
+		d := decoder{b: body}
+		d.b = d.take(int(d.u32()))
+		if len(d.b) == 0 {
+			break
+		}
+		for len(d.b) > 0 && d.err == nil {
+			q := d.qid()
+			off = d.u64()
+			typ := d.u8()
+			child := d.str()
+			if child != "." && child != ".." {
+				entries = append(entries, &dirEntry{fs: f, name: path.Join(name, child), typ: direntMode(typ, q)})
+			}
+		}
+		if d.err != nil {
+			return nil, pathErr("readdir", name, d.err)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// direntMode returns the type bits an entry of Rreaddir has.
+func direntMode(typ uint8, q qid) fs.FileMode {
+	switch {
+	case typ == syscall.DT_DIR || q.typ&qtDir != 0:
+		return fs.ModeDir
+	case typ == syscall.DT_LNK || q.typ&qtSymlink != 0:
+		return fs.ModeSymlink
+	case typ == syscall.DT_FIFO:
+		return fs.ModeNamedPipe
+	case typ == syscall.DT_SOCK:
+		return fs.ModeSocket
+	case typ == syscall.DT_CHR:
+		return fs.ModeDevice | fs.ModeCharDevice
+	case typ == syscall.DT_BLK:
+		return fs.ModeDevice
+	}
+	return 0
+}
+
+// dirEntry is an entry of a directory, whose information takes a request
+// to get.
+type dirEntry struct {
+	fs   *FS
+	name string
+	typ  fs.FileMode
+}
+
+func (e *dirEntry) Name() string               { return path.Base(e.name) }
+func (e *dirEntry) IsDir() bool                { return e.typ.IsDir() }
+func (e *dirEntry) Type() fs.FileMode          { return e.typ }
+func (e *dirEntry) Info() (fs.FileInfo, error) { return e.fs.Lstat(e.name) }
+
+func (f *FS) Mkdir(name string, perm fs.FileMode) error {
+	dfid, base, err := f.parent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	defer f.c.clunk(dfid)
+	var e encoder
+	e.u32(dfid)
+	e.str(base)
+	e.u32(unixPerm(perm))
+	e.u32(f.gid)
+	if _, err := f.c.rpc(msgTmkdir, e); err != nil {
+		return pathErr("mkdir", name, err)
+	}
+	return nil
+}
+
+func (f *FS) unlinkat(op, name string, flags uint32) error {
+	dfid, base, err := f.parent(op, name)
+	if err != nil {
+		return err
+	}
+	defer f.c.clunk(dfid)
+	var e encoder
+	e.u32(dfid)
+	e.str(base)
+	e.u32(flags)
+	if _, err := f.c.rpc(msgTunlinkat, e); err != nil {
+		return pathErr(op, name, err)
+	}
+	return nil
+}
+
+func (f *FS) Unlink(name string) error { return f.unlinkat("unlink", name, 0) }
+func (f *FS) Rmdir(name string) error  { return f.unlinkat("rmdir", name, atRemoveDir) }
+
+func (f *FS) Rename(oldname, newname string) error {
+	ofid, obase, err := f.parent("rename", oldname)
+	if err != nil {
+		return err
+	}
+	defer f.c.clunk(ofid)
+	nfid, nbase, err := f.parent("rename", newname)
+	if err != nil {
+		return err
+	}
+	defer f.c.clunk(nfid)
+	var e encoder
+	e.u32(ofid)
+	e.str(obase)
+	e.u32(nfid)
+	e.str(nbase)
+	if _, err := f.c.rpc(msgTrenameat, e); err != nil {
+		return pathErr("rename", oldname, err)
+	}
+	return nil
+}
+
+func (f *FS) Link(oldname, newname string) error {
+	fid, _, err := f.walk("link", oldname, false)
+	if err != nil {
+		return err
+	}
+	defer f.c.clunk(fid)
+	dfid, base, err := f.parent("link", newname)
+	if err != nil {
+		return err
+	}
+	defer f.c.clunk(dfid)
+	var e encoder
+	e.u32(dfid)
+	e.u32(fid)
+	e.str(base)
+	if _, err := f.c.rpc(msgTlink, e); err != nil {
+		return pathErr("link", newname, err)
+	}
+	return nil
+}
+
+func (f *FS) Symlink(target, newname string) error {
+	dfid, base, err := f.parent("symlink", newname)
+	if err != nil {
+		return err
+	}
+	defer f.c.clunk(dfid)
+	var e encoder
+	e.u32(dfid)
+	e.str(base)
+	e.str(target)
+	e.u32(f.gid)
+	if _, err := f.c.rpc(msgTsymlink, e); err != nil {
+		return pathErr("symlink", newname, err)
+	}
+	return nil
+}
+
+func (f *FS) Readlink(name string) (string, error) {
+	fid, q, err := f.walk("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	defer f.c.clunk(fid)
+	if q.typ&qtSymlink == 0 {
+		return "", pathErr("readlink", name, syscall.EINVAL)
+	}
+	var e encoder
+	e.u32(fid)
+	body, err := f.c.rpc(msgTreadlink, e)
+	if err != nil {
+		return "", pathErr("readlink", name, err)
+	}
+	d := decoder{b: body}
+	target := d.str()
+	if d.err != nil {
+		return "", pathErr("readlink", name, d.err)
+	}
+	return target, nil
+}
+
+// setattr sets the attributes valid names of the file at name.
+func (f *FS) setattr(op, name string, valid, mode uint32, atime, mtime time.Time) error {
+	fid, _, err := f.walk(op, name, true)
+	if err != nil {
+		return err
+	}
+	defer f.c.clunk(fid)
+	if err := f.setattrFid(fid, valid, mode, 0, atime, mtime); err != nil {
+		return pathErr(op, name, err)
+	}
+	return nil
+}
+
+// setattrFid sets the attributes valid names of the file fid stands for.
+func (f *FS) setattrFid(fid, valid, mode uint32, size uint64, atime, mtime time.Time) error {
+	var e encoder
+	e.u32(fid)
+	e.u32(valid)
+	e.u32(mode)
+	e.u32(0) // uid
+	e.u32(0) // gid
+	e.u64(size)
+	e.time(atime)
+	e.time(mtime)
+	_, err := f.c.rpc(msgTsetattr, e)
+	return err
+}
+
+func (f *FS) Chmod(name string, mode fs.FileMode) error {
+	return f.setattr("chmod", name, setattrMode, unixPerm(mode), time.Time{}, time.Time{})
+}
+
+func (f *FS) Chtimes(name string, atime, mtime time.Time) error {
+	var valid uint32
+	if !atime.IsZero() {
+		valid |= setattrAtime | setattrAtimeSet
+	}
+	if !mtime.IsZero() {
+		valid |= setattrMtime | setattrMtimeSet
+	}
+	if atime.IsZero() {
+		atime = time.Unix(0, 0)
+	}
+	if mtime.IsZero() {
+		mtime = time.Unix(0, 0)
+	}
+	return f.setattr("chtimes", name, valid, 0, atime, mtime)
+}
+
+// info is the information Rgetattr gives for a file. Sys returns a
+// *vfs.Attr.
+type info struct {
+	name string
+	a    attr
+}
+
+func newInfo(name string, a attr) *info { return &info{name: name, a: a} }
+
+func (i *info) Name() string       { return i.name }
+func (i *info) Size() int64        { return int64(i.a.size) }
+func (i *info) Mode() fs.FileMode  { return fileMode(i.a.mode) }
+func (i *info) ModTime() time.Time { return i.a.mtime }
+func (i *info) IsDir() bool        { return i.Mode().IsDir() }
+
+func (i *info) Sys() any {
+	return &vfs.Attr{
+		Ino:   i.a.qid.path,
+		Nlink: i.a.nlink,
+		Uid:   i.a.uid,
+		Gid:   i.a.gid,
+		Atime: i.a.atime,
+		Ctime: i.a.ctime,
+	}
+}
+
+// fileMode converts a Unix mode to an fs.FileMode.
+func fileMode(m uint32) fs.FileMode {
+	mode := fs.FileMode(m & 0o777)
+	switch m & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		mode |= fs.ModeDir
+	case syscall.S_IFLNK:
+		mode |= fs.ModeSymlink
+	case syscall.S_IFIFO:
+		mode |= fs.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		mode |= fs.ModeSocket
+	case syscall.S_IFCHR:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case syscall.S_IFBLK:
+		mode |= fs.ModeDevice
+	}
+	if m&syscall.S_ISUID != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if m&syscall.S_ISGID != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if m&syscall.S_ISVTX != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
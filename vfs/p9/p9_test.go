@@ -0,0 +1,259 @@
+package p9
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// newFS serves a temporary directory and attaches to it.
+func newFS(t *testing.T, cfg Config) (*FS, string) {
+	t.Helper()
+	dir := t.TempDir()
+	client, srv := net.Pipe()
+	go serve(dir, srv)
+	f, err := New(client, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f, dir
+}
+
+func TestFiles(t *testing.T) {
+	// A small msize splits reads and writes over several requests.
+	f, dir := newFS(t, Config{Msize: 4096})
+	data := strings.Repeat("0123456789", 1000)
+	w, err := f.Open("file", os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := w.Write([]byte(data)); n != len(data) || err != nil {
+		t.Fatalf("write: %d, %v", n, err)
+	}
+	if _, err := w.Read(make([]byte, 1)); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("read of a file opened for writing: %v", err)
+	}
+	w.Close()
+	if got, err := os.ReadFile(filepath.Join(dir, "file")); err != nil || string(got) != data {
+		t.Errorf("host file holds %q, %v", got, err)
+	}
+
+	r, err := f.Open("file", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || string(got) != data {
+		t.Errorf("read: %q, %v", got, err)
+	}
+	b := make([]byte, 5)
+	if n, err := r.ReadAt(b, 9995); n != 5 || err != nil || string(b) != "56789" {
+		t.Errorf("read at the end: %q, %v", b[:n], err)
+	}
+	if n, err := r.ReadAt(b, 9998); n != 2 || err != io.EOF {
+		t.Errorf("read past the end: %d, %v", n, err)
+	}
+	if off, err := r.Seek(-10, io.SeekEnd); off != 9990 || err != nil {
+		t.Errorf("seek from the end: %d, %v", off, err)
+	}
+	fi, err := r.Stat()
+	if err != nil || fi.Size() != 10000 || fi.Mode() != 0o640 {
+		t.Errorf("stat of an open file: %v, %v", fi, err)
+	}
+	host, _ := os.Stat(filepath.Join(dir, "file"))
+	if a, ok := fi.Sys().(*vfs.Attr); !ok || a.Ino != host.Sys().(*syscall.Stat_t).Ino || a.Nlink != 1 {
+		t.Errorf("attributes: %+v", fi.Sys())
+	}
+	r.Close()
+	if _, err := r.Read(b); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("read after close: %v", err)
+	}
+
+	a, err := f.Open("file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Write([]byte("!"))
+	a.Close()
+	if fi, err := f.Stat("file"); err != nil || fi.Size() != 10001 {
+		t.Errorf("stat after an append: %v, %v", fi, err)
+	}
+	tr, _ := f.Open("file", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o600)
+	if fi, err := tr.Stat(); err != nil || fi.Size() != 0 || fi.Mode() != 0o640 {
+		t.Errorf("stat after truncating: %v, %v", fi, err)
+	}
+	tr.Close()
+	if _, err := f.Open("file", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644); !errors.Is(err, syscall.EEXIST) {
+		t.Errorf("exclusive create of an existing file: %v", err)
+	}
+}
+
+func TestTree(t *testing.T) {
+	f, dir := newFS(t, Config{})
+	for _, err := range []error{
+		f.Mkdir("d", 0o755),
+		f.Mkdir("d/sub", 0o700),
+		os.WriteFile(filepath.Join(dir, "d/f"), []byte("hi"), 0o644),
+		f.Symlink("d", "rel"),
+		f.Symlink("/d/sub", "abs"),
+		f.Symlink("../f", "d/sub/up"),
+		f.Symlink("../../rel/sub/../../d", "d/sub/top"),
+		f.Link("d/f", "hard"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]fs.FileMode{
+		".":         fs.ModeDir | 0o755,
+		"d/sub":     fs.ModeDir | 0o700,
+		"rel/f":     0o644,
+		"abs":       fs.ModeDir | 0o700,
+		"abs/up":    0o644,
+		"d/sub/top": fs.ModeDir | 0o755,
+	} {
+		if fi, err := f.Stat(name); err != nil || fi.Mode() != want {
+			t.Errorf("stat %s: %v, %v, want mode %v", name, fi, err, want)
+		}
+	}
+	if fi, err := f.Lstat("abs"); err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("lstat of a symlink: %v, %v", fi, err)
+	}
+	if target, err := f.Readlink("abs"); err != nil || target != "/d/sub" {
+		t.Errorf("readlink: %q, %v", target, err)
+	}
+	if fi, err := f.Stat("hard"); err != nil || fi.Sys().(*vfs.Attr).Nlink != 2 {
+		t.Errorf("stat of a hard link: %v, %v", fi, err)
+	}
+	r, err := f.Open("abs/up", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || string(got) != "hi" {
+		t.Errorf("read through symlinks: %q, %v", got, err)
+	}
+	r.Close()
+
+	entries, err := f.ReadDir("rel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if _, err := e.Info(); err != nil {
+			t.Errorf("info of %s: %v", e.Name(), err)
+		}
+		names = append(names, e.Name())
+	}
+	if got := strings.Join(names, " "); got != "f sub" || !entries[1].IsDir() {
+		t.Errorf("d holds %s", got)
+	}
+
+	if err := f.Rename("d/f", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Chmod("moved", 0o600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := f.Chtimes("moved", time.Time{}, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "moved")); err != nil || fi.Mode() != 0o600 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("host file after rename, chmod and chtimes: %v, %v", fi, err)
+	}
+	if err := f.Unlink("moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Rmdir("d/sub"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("rmdir of a directory with entries: %v", err)
+	}
+	f.Unlink("d/sub/up")
+	f.Unlink("d/sub/top")
+	if err := f.Rmdir("d/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "d/sub")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("directory not removed: %v", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	f, dir := newFS(t, Config{})
+	os.Mkdir(filepath.Join(dir, "d"), 0o755)
+	os.WriteFile(filepath.Join(dir, "f"), nil, 0o644)
+	os.Symlink("f", filepath.Join(dir, "link"))
+	os.Symlink("loop", filepath.Join(dir, "loop"))
+	os.Symlink("f/../d", filepath.Join(dir, "bad"))
+	for name, want := range map[string]error{
+		"missing":   syscall.ENOENT,
+		"d/missing": syscall.ENOENT,
+		"f/x":       syscall.ENOTDIR,
+		"bad":       syscall.ENOTDIR,
+		"loop":      syscall.ELOOP,
+	} {
+		if _, err := f.Stat(name); !errors.Is(err, want) {
+			t.Errorf("stat %s: %v, want %v", name, err, want)
+		}
+	}
+	if _, err := f.Open("d", os.O_RDWR, 0); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("open of a directory for writing: %v", err)
+	}
+	if _, err := f.Open("link", os.O_RDONLY|syscall.O_NOFOLLOW, 0); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("open of a symlink with O_NOFOLLOW: %v", err)
+	}
+	if _, err := f.Readlink("f"); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("readlink of a file: %v", err)
+	}
+	if err := f.Mkdir("d", 0o755); !errors.Is(err, syscall.EEXIST) {
+		t.Errorf("mkdir of an existing directory: %v", err)
+	}
+	if _, err := f.ReadDir("f"); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("readdir of a file: %v", err)
+	}
+
+	d, err := f.Open("d", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := d.Stat(); err != nil || !fi.IsDir() {
+		t.Errorf("stat of an open directory: %v, %v", fi, err)
+	}
+	f.c.rw.Close()
+	if _, err := f.Stat("f"); err == nil {
+		t.Error("stat after the connection closed succeeded")
+	}
+}
+
+func TestTracer(t *testing.T) {
+	f, dir := newFS(t, Config{})
+	os.WriteFile(filepath.Join(dir, "in"), []byte("from the server\n"), 0o644)
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `cat /9p/in
+mkdir /9p/out && tr a-z A-Z </9p/in >/9p/out/upper
+ls /9p /9p/out`)
+	cmd.Stdout = &stdout
+	if err := tracer.New(cmd, tracer.WithMount("/9p", f)).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := "from the server\n/9p:\nin\nout\n\n/9p/out:\nupper\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "out/upper")); err != nil || string(got) != "FROM THE SERVER\n" {
+		t.Errorf("host file holds %q, %v", got, err)
+	}
+}
@@ -0,0 +1,150 @@
+package p9
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// The message types of 9P2000.L this package uses. Each R-message is its
+// T-message plus one.
+const (
+	msgRlerror   = 7
+	msgTlopen    = 12
+	msgTlcreate  = 14
+	msgTsymlink  = 16
+	msgTreadlink = 22
+	msgTgetattr  = 24
+	msgTsetattr  = 26
+	msgTreaddir  = 40
+	msgTfsync    = 50
+	msgTlink     = 70
+	msgTmkdir    = 72
+	msgTrenameat = 74
+	msgTunlinkat = 76
+	msgTversion  = 100
+	msgTattach   = 104
+	msgTwalk     = 110
+	msgTread     = 116
+	msgTwrite    = 118
+	msgTclunk    = 120
+)
+
+const (
+	version = "9P2000.L"
+	noTag   = 0xffff
+	noFid   = 0xffffffff
+	// maxWalk is the most names a Twalk can hold.
+	maxWalk = 16
+	// ioHeader is the size of the header of Tread, Twrite and Rread
+	// around their data, at most.
+	ioHeader = 4 + 1 + 2 + 4 + 8 + 4
+)
+
+// Open flags as the protocol has them, which are those of Linux on x86.
+const (
+	lWronly    = 0x1
+	lRdwr      = 0x2
+	lCreate    = 0x40
+	lExcl      = 0x80
+	lTrunc     = 0x200
+	lAppend    = 0x400
+	lDirectory = 0x10000
+	lNofollow  = 0x20000
+)
+
+// Qid types.
+const (
+	qtDir     = 0x80
+	qtSymlink = 0x02
+)
+
+// Tgetattr and Tsetattr masks.
+const (
+	getattrBasic = 0x7ff
+
+	setattrMode     = 0x1
+	setattrSize     = 0x8
+	setattrAtime    = 0x10
+	setattrMtime    = 0x20
+	setattrAtimeSet = 0x80
+	setattrMtimeSet = 0x100
+)
+
+// atRemoveDir is the flag of Tunlinkat that removes a directory.
+const atRemoveDir = 0x200
+
+// qid identifies a file on the server.
+type qid struct {
+	typ     uint8
+	version uint32
+	path    uint64
+}
+
+// attr is the body of an Rgetattr.
+type attr struct {
+	valid               uint64
+	qid                 qid
+	mode, uid, gid      uint32
+	nlink, rdev, size   uint64
+	blksize, blocks     uint64
+	atime, mtime, ctime time.Time
+}
+
+var errShort = errors.New("p9: message too short")
+
+// encoder builds the body of a message.
+type encoder []byte
+
+func (e *encoder) u8(v uint8)   { *e = append(*e, v) }
+func (e *encoder) u16(v uint16) { *e = binary.LittleEndian.AppendUint16(*e, v) }
+func (e *encoder) u32(v uint32) { *e = binary.LittleEndian.AppendUint32(*e, v) }
+func (e *encoder) u64(v uint64) { *e = binary.LittleEndian.AppendUint64(*e, v) }
+
+func (e *encoder) str(s string) {
+	e.u16(uint16(len(s)))
+	*e = append(*e, s...)
+}
+
+func (e *encoder) time(t time.Time) {
+	e.u64(uint64(t.Unix()))
+	e.u64(uint64(t.Nanosecond()))
+}
+
+// decoder reads the body of a message, recording the first error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = errShort
+		return make([]byte, n)
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8   { return d.take(1)[0] }
+func (d *decoder) u16() uint16 { return binary.LittleEndian.Uint16(d.take(2)) }
+func (d *decoder) u32() uint32 { return binary.LittleEndian.Uint32(d.take(4)) }
+func (d *decoder) u64() uint64 { return binary.LittleEndian.Uint64(d.take(8)) }
+func (d *decoder) str() string { return string(d.take(int(d.u16()))) }
+
+func (d *decoder) qid() qid {
+	return qid{typ: d.u8(), version: d.u32(), path: d.u64()}
+}
+
+func (d *decoder) time() time.Time {
+	sec, nsec := d.u64(), d.u64()
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+func (d *decoder) attr() attr {
+	a := attr{valid: d.u64(), qid: d.qid(), mode: d.u32(), uid: d.u32(), gid: d.u32()}
+	a.nlink, a.rdev, a.size, a.blksize, a.blocks = d.u64(), d.u64(), d.u64(), d.u64(), d.u64()
+	a.atime, a.mtime, a.ctime = d.time(), d.time(), d.time()
+	return a
+}
@@ -0,0 +1,355 @@
+package p9
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// server is a 9P2000.L server of a host directory, as much of one as the
+// tests need. It answers requests in order, one at a time.
+type server struct {
+	root string
+	fids map[uint32]*serverFid
+}
+
+type serverFid struct {
+	path string
+	fd   int // -1 until opened
+}
+
+func serve(root string, rw io.ReadWriteCloser) {
+	s := &server{root: root, fids: make(map[uint32]*serverFid)}
+	defer rw.Close()
+	for {
+		var hdr [7]byte
+		if _, err := io.ReadFull(rw, hdr[:]); err != nil {
+			return
+		}
+		body := make([]byte, binary.LittleEndian.Uint32(hdr[:])-7)
+		if _, err := io.ReadFull(rw, body); err != nil {
+			return
+		}
+		typ := hdr[4]
+		reply, err := s.handle(typ, &decoder{b: body})
+		if err != nil {
+			var errno syscall.Errno
+			if !errors.As(err, &errno) {
+				errno = syscall.EIO
+			}
+			typ, reply = msgRlerror-1, nil
+			reply.u32(uint32(errno))
+		}
+		msg := binary.LittleEndian.AppendUint32(nil, uint32(7+len(reply)))
+		msg = append(msg, typ+1, hdr[5], hdr[6])
+		if _, err := rw.Write(append(msg, reply...)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *server) fid(fid uint32) (*serverFid, error) {
+	f, ok := s.fids[fid]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	return f, nil
+}
+
+func (s *server) qid(path string) (qid, error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return qid{}, err
+	}
+	return statQid(&st), nil
+}
+
+func statQid(st *syscall.Stat_t) qid {
+	q := qid{path: st.Ino}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		q.typ = qtDir
+	case syscall.S_IFLNK:
+		q.typ = qtSymlink
+	}
+	return q
+}
+
+func putQid(e *encoder, q qid) {
+	e.u8(q.typ)
+	e.u32(q.version)
+	e.u64(q.path)
+}
+
+func (s *server) handle(typ uint8, d *decoder) (encoder, error) {
+	var e encoder
+	switch typ {
+	case msgTversion:
+		msize, _ := d.u32(), d.str()
+		e.u32(msize)
+		e.str(version)
+	case msgTattach:
+		fid, _, _, _, _ := d.u32(), d.u32(), d.str(), d.str(), d.u32()
+		q, err := s.qid(s.root)
+		if err != nil {
+			return nil, err
+		}
+		s.fids[fid] = &serverFid{path: s.root, fd: -1}
+		putQid(&e, q)
+	case msgTwalk:
+		f, err := s.fid(d.u32())
+		if err != nil {
+			return nil, err
+		}
+		newFid := d.u32()
+		var qids []qid
+		p := f.path
+		n := int(d.u16())
+		for i := 0; i < n; i++ {
+			next := filepath.Join(p, d.str())
+			q, err := s.qid(next)
+			if err != nil && i == 0 {
+				return nil, err
+			}
+			if err != nil {
+				break
+			}
+			qids = append(qids, q)
+			p = next
+		}
+		if len(qids) == n {
+			s.fids[newFid] = &serverFid{path: p, fd: -1}
+		}
+		e.u16(uint16(len(qids)))
+		for _, q := range qids {
+			putQid(&e, q)
+		}
+	case msgTgetattr:
+		f, err := s.fid(d.u32())
+		if err != nil {
+			return nil, err
+		}
+		var st syscall.Stat_t
+		if err := syscall.Lstat(f.path, &st); err != nil {
+			return nil, err
+		}
+		e.u64(getattrBasic)
+		putQid(&e, statQid(&st))
+		e.u32(st.Mode)
+		e.u32(st.Uid)
+		e.u32(st.Gid)
+		e.u64(uint64(st.Nlink))
+		e.u64(st.Rdev)
+		e.u64(uint64(st.Size))
+		e.u64(uint64(st.Blksize))
+		e.u64(uint64(st.Blocks))
+		for _, t := range []syscall.Timespec{st.Atim, st.Mtim, st.Ctim, {}} {
+			e.u64(uint64(t.Sec))
+			e.u64(uint64(t.Nsec))
+		}
+		e.u64(0) // gen
+		e.u64(0) // data_version
+	case msgTlopen:
+		f, err := s.fid(d.u32())
+		if err != nil {
+			return nil, err
+		}
+		fd, err := syscall.Open(f.path, int(d.u32())|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, err
+		}
+		f.fd = fd
+		q, _ := s.qid(f.path)
+		putQid(&e, q)
+		e.u32(0)
+	case msgTlcreate:
+		f, err := s.fid(d.u32())
+		if err != nil {
+			return nil, err
+		}
+		p := filepath.Join(f.path, d.str())
+		flags, mode := d.u32(), d.u32()
+		fd, err := syscall.Open(p, int(flags)|syscall.O_CREAT|syscall.O_CLOEXEC, mode)
+		if err != nil {
+			return nil, err
+		}
+		f.path, f.fd = p, fd
+		q, _ := s.qid(p)
+		putQid(&e, q)
+		e.u32(0)
+	case msgTread:
+		f, err := s.fid(d.u32())
+		if err != nil {
+			return nil, err
+		}
+		off, count := d.u64(), d.u32()
+		b := make([]byte, count)
+		n, err := syscall.Pread(f.fd, b, int64(off))
+		if err != nil {
+			return nil, err
+		}
+		e.u32(uint32(n))
+		e = append(e, b[:n]...)
+	case msgTwrite:
+		f, err := s.fid(d.u32())
+		if err != nil {
+			return nil, err
+		}
+		off := d.u64()
+		b := d.take(int(d.u32()))
+		n, err := syscall.Pwrite(f.fd, b, int64(off))
+		if err != nil {
+			return nil, err
+		}
+		e.u32(uint32(n))
+	case msgTreaddir:
+		f, err := s.fid(d.u32())
+		if err != nil {
+			return nil, err
+		}
+		off, count := d.u64(), d.u32()
+		entries, err := os.ReadDir(f.path)
+		if err != nil {
+			return nil, err
+		}
+		names := []string{".", ".."}
+		for _, ent := range entries {
+			names = append(names, ent.Name())
+		}
+		var data encoder
+		for i := int(off); i < len(names); i++ {
+			q, err := s.qid(filepath.Join(f.path, names[i]))
+			if err != nil {
+				return nil, err
+			}
+			if len(data)+13+8+1+2+len(names[i]) > int(count) {
+				break
+			}
+			putQid(&data, q)
+			data.u64(uint64(i + 1))
+			data.u8(0) // DT_UNKNOWN, left to the qid
+			data.str(names[i])
+		}
+		e.u32(uint32(len(data)))
+		e = append(e, data...)
+	case msgTmkdir:
+		f, err := s.fid(d.u32())
+		if err != nil {
+			return nil, err
+		}
+		p := filepath.Join(f.path, d.str())
+		if err := syscall.Mkdir(p, d.u32()); err != nil {
+			return nil, err
+		}
+		q, _ := s.qid(p)
+		putQid(&e, q)
+	case msgTunlinkat:
+		f, err := s.fid(d.u32())
+		if err != nil {
+			return nil, err
+		}
+		p := filepath.Join(f.path, d.str())
+		if d.u32()&atRemoveDir != 0 {
+			err = syscall.Rmdir(p)
+		} else {
+			err = syscall.Unlink(p)
+		}
+		if err != nil {
+			return nil, err
+		}
+	case msgTrenameat:
+		from, err := s.fid(d.u32())
+		if err != nil {
+			return nil, err
+		}
+		oldname := d.str()
+		to, err := s.fid(d.u32())
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Rename(filepath.Join(from.path, oldname), filepath.Join(to.path, d.str())); err != nil {
+			return nil, err
+		}
+	case msgTlink:
+		dir, err := s.fid(d.u32())
+		if err != nil {
+			return nil, err
+		}
+		f, err := s.fid(d.u32())
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Link(f.path, filepath.Join(dir.path, d.str())); err != nil {
+			return nil, err
+		}
+	case msgTsymlink:
+		f, err := s.fid(d.u32())
+		if err != nil {
+			return nil, err
+		}
+		p := filepath.Join(f.path, d.str())
+		if err := syscall.Symlink(d.str(), p); err != nil {
+			return nil, err
+		}
+		q, _ := s.qid(p)
+		putQid(&e, q)
+	case msgTreadlink:
+		f, err := s.fid(d.u32())
+		if err != nil {
+			return nil, err
+		}
+		target, err := os.Readlink(f.path)
+		if err != nil {
+			return nil, err
+		}
+		e.str(target)
+	case msgTsetattr:
+		f, err := s.fid(d.u32())
+		if err != nil {
+			return nil, err
+		}
+		valid, mode, _, _, size := d.u32(), d.u32(), d.u32(), d.u32(), d.u64()
+		atime, mtime := d.time(), d.time()
+		if valid&setattrMode != 0 {
+			if err := syscall.Chmod(f.path, mode); err != nil {
+				return nil, err
+			}
+		}
+		if valid&setattrSize != 0 {
+			if err := syscall.Truncate(f.path, int64(size)); err != nil {
+				return nil, err
+			}
+		}
+		if valid&setattrAtimeSet == 0 {
+			atime = time.Time{}
+		}
+		if valid&setattrMtimeSet == 0 {
+			mtime = time.Time{}
+		}
+		if valid&(setattrAtime|setattrMtime) != 0 {
+			if err := os.Chtimes(f.path, atime, mtime); err != nil {
+				return nil, err
+			}
+		}
+	case msgTclunk:
+		fid := d.u32()
+		f, err := s.fid(fid)
+		if err != nil {
+			return nil, err
+		}
+		if f.fd >= 0 {
+			syscall.Close(f.fd)
+		}
+		delete(s.fids, fid)
+	default:
+		return nil, syscall.EOPNOTSUPP
+	}
+	if d.err != nil {
+		return nil, syscall.EINVAL
+	}
+	return e, nil
+}
@@ -0,0 +1,414 @@
+// Package quota implements a vfs.Backend that bounds how much the tree of
+// another backend can grow, so that a runaway command fills its quota
+// instead of the memory or disk behind the backend.
+//
+// Usage is counted from when the FS is made, as the bytes and inodes the
+// calls through it add less those they remove: a file written counts its
+// new size, and one unlinked, or replaced by a rename, gives back what it
+// held unless other hard links keep it. What the tree held to begin with
+// is not counted, so removing it makes room. Bytes are counted by file
+// size, holes included. A hard link takes no inode.
+//
+// A call that would go past a limit fails with ENOSPC, or with EFBIG for a
+// write past the largest file size, as the kernel fails them, and changes
+// nothing. Writes that grow a file are serialized, so that two cannot
+// both take the last of the quota; other calls run concurrently, as the
+// backend allows.
+package quota
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// Limits bounds the growth of a tree. A zero field is no limit.
+type Limits struct {
+	// Bytes is the most bytes the regular files may hold.
+	Bytes int64
+	// FileSize is the largest a regular file may grow.
+	FileSize int64
+	// Inodes is the most files, directories and symlinks there may be.
+	Inodes int64
+}
+
+// FS is a backend whose growth is bounded.
+type FS struct {
+	b vfs.Backend
+	l Limits
+
+	// grow serializes writes that grow files.
+	grow sync.Mutex
+
+	mu            sync.Mutex
+	bytes, inodes int64
+	// truncs counts the files truncated, which may have shrunk under
+	// files open on them.
+	truncs uint64
+}
+
+var (
+	_ vfs.Backend  = (*FS)(nil)
+	_ vfs.Xattrer  = (*FS)(nil)
+	_ vfs.StatFSer = (*FS)(nil)
+	_ vfs.Socketer = (*FS)(nil)
+)
+
+// New returns an FS bounding the growth of b by l.
+func New(b vfs.Backend, l Limits) *FS {
+	return &FS{b: b, l: l}
+}
+
+// Usage returns the bytes and inodes the calls through q have added, less
+// those they have removed, which may leave them below zero.
+func (q *FS) Usage() (bytes, inodes int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes, q.inodes
+}
+
+func pathErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// add counts bytes and inodes more, failing with ENOSPC if that would pass
+// a limit.
+func (q *FS) add(bytes, inodes int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if bytes > 0 && q.l.Bytes > 0 && q.bytes+bytes > q.l.Bytes ||
+		inodes > 0 && q.l.Inodes > 0 && q.inodes+inodes > q.l.Inodes {
+		return syscall.ENOSPC
+	}
+	q.bytes += bytes
+	q.inodes += inodes
+	return nil
+}
+
+// freed returns the bytes and inodes removing the entry fi describes
+// gives back: none if other links keep it.
+func freed(fi fs.FileInfo) (bytes, inodes int64) {
+	var nlink uint64 = 1
+	switch sys := fi.Sys().(type) {
+	case *vfs.Attr:
+		nlink = sys.Nlink
+	case *syscall.Stat_t:
+		nlink = uint64(sys.Nlink)
+	}
+	if nlink > 1 {
+		return 0, 0
+	}
+	if fi.Mode().IsRegular() {
+		bytes = fi.Size()
+	}
+	return bytes, 1
+}
+
+// sameFile reports whether fi1 and fi2 describe the same inode.
+func sameFile(fi1, fi2 fs.FileInfo) bool {
+	if a1, ok := fi1.Sys().(*vfs.Attr); ok {
+		a2, ok := fi2.Sys().(*vfs.Attr)
+		return ok && a1.Ino != 0 && a1.Ino == a2.Ino
+	}
+	return os.SameFile(fi1, fi2)
+}
+
+func (q *FS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	var old fs.FileInfo
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		fi, err := q.b.Lstat(name)
+		switch {
+		case err == nil:
+			old = fi
+		case !errors.Is(err, fs.ErrNotExist):
+			return nil, err
+		case flag&os.O_CREATE != 0:
+			// The file is made, unless the Open fails.
+			if err := q.add(0, 1); err != nil {
+				return nil, pathErr("open", name, err)
+			}
+		}
+	}
+	f, err := q.b.Open(name, flag, perm)
+	if err != nil {
+		if flag&os.O_CREATE != 0 && old == nil {
+			q.add(0, -1)
+		}
+		return nil, err
+	}
+	if old != nil && flag&os.O_TRUNC != 0 && old.Mode().IsRegular() && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		q.mu.Lock()
+		q.bytes -= old.Size()
+		q.truncs++
+		q.mu.Unlock()
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, nil
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return f, nil
+	}
+	q.mu.Lock()
+	truncs := q.truncs
+	q.mu.Unlock()
+	return &file{q: q, f: f, name: name, appending: flag&os.O_APPEND != 0, size: fi.Size(), truncs: truncs}, nil
+}
+
+func (q *FS) Stat(name string) (fs.FileInfo, error)      { return q.b.Stat(name) }
+func (q *FS) Lstat(name string) (fs.FileInfo, error)     { return q.b.Lstat(name) }
+func (q *FS) ReadDir(name string) ([]fs.DirEntry, error) { return q.b.ReadDir(name) }
+
+func (q *FS) Mkdir(name string, perm fs.FileMode) error {
+	if err := q.add(0, 1); err != nil {
+		return pathErr("mkdir", name, err)
+	}
+	err := q.b.Mkdir(name, perm)
+	if err != nil {
+		q.add(0, -1)
+	}
+	return err
+}
+
+func (q *FS) Symlink(target, newname string) error {
+	if err := q.add(0, 1); err != nil {
+		return pathErr("symlink", newname, err)
+	}
+	err := q.b.Symlink(target, newname)
+	if err != nil {
+		q.add(0, -1)
+	}
+	return err
+}
+
+func (q *FS) Unlink(name string) error {
+	fi, lerr := q.b.Lstat(name)
+	if err := q.b.Unlink(name); err != nil {
+		return err
+	}
+	if lerr == nil {
+		bytes, inodes := freed(fi)
+		q.add(-bytes, -inodes)
+	}
+	return nil
+}
+
+func (q *FS) Rmdir(name string) error {
+	if err := q.b.Rmdir(name); err != nil {
+		return err
+	}
+	q.add(0, -1)
+	return nil
+}
+
+func (q *FS) Rename(oldname, newname string) error {
+	src, serr := q.b.Lstat(oldname)
+	dst, derr := q.b.Lstat(newname)
+	if err := q.b.Rename(oldname, newname); err != nil {
+		return err
+	}
+	if serr == nil && derr == nil && !sameFile(src, dst) {
+		bytes, inodes := freed(dst)
+		q.add(-bytes, -inodes)
+	}
+	return nil
+}
+
+func (q *FS) Link(oldname, newname string) error   { return q.b.Link(oldname, newname) }
+func (q *FS) Readlink(name string) (string, error) { return q.b.Readlink(name) }
+
+func (q *FS) Chmod(name string, mode fs.FileMode) error { return q.b.Chmod(name, mode) }
+
+func (q *FS) Chtimes(name string, atime, mtime time.Time) error {
+	return q.b.Chtimes(name, atime, mtime)
+}
+
+func (q *FS) Getxattr(name, attr string) ([]byte, error) {
+	return vfs.Getxattr(q.b, name, attr)
+}
+
+func (q *FS) Setxattr(name, attr string, value []byte, flags int) error {
+	return vfs.Setxattr(q.b, name, attr, value, flags)
+}
+
+func (q *FS) Listxattr(name string) ([]string, error) { return vfs.Listxattr(q.b, name) }
+
+func (q *FS) Removexattr(name, attr string) error {
+	return vfs.Removexattr(q.b, name, attr)
+}
+
+// StatFS reports each limit as the size of the storage, less what the
+// calls through q have used, or what the backend has left if that is less.
+// What has no limit is as the backend reports it.
+func (q *FS) StatFS(name string) (vfs.FSStat, error) {
+	st, err := vfs.StatFS(q.b, name)
+	if err != nil {
+		return st, err
+	}
+	bytes, inodes := q.Usage()
+	bound := func(total, free *int64, limit, used int64) {
+		if limit == 0 {
+			return
+		}
+		if left := max(limit-used, 0); *total == 0 || left < *free {
+			*free = left
+		}
+		*total = limit
+	}
+	bound(&st.Bytes, &st.BytesFree, q.l.Bytes, bytes)
+	bound(&st.Inodes, &st.InodesFree, q.l.Inodes, inodes)
+	return st, nil
+}
+
+// file is a regular file open for writing, whose writes past its end are
+// counted. It follows the offset of the backend's file, to know where a
+// write lands.
+type file struct {
+	q         *FS
+	f         vfs.File
+	name      string
+	appending bool
+
+	mu  sync.Mutex
+	off int64
+	// size is the size of the file after the last write that grew it,
+	// below which a write cannot grow it unless a file has been truncated
+	// since, which truncs tells.
+	size   int64
+	truncs uint64
+}
+
+// write writes b at off, or with Write at the file offset, which is off
+// unless appending, counting what it adds to the file.
+func (f *file) write(b []byte, off int64, sequential bool) (int, error) {
+	appending := sequential && f.appending
+	do := func() (int, error) {
+		if sequential {
+			return f.f.Write(b)
+		}
+		return f.f.WriteAt(b, off)
+	}
+	q := f.q
+	q.mu.Lock()
+	truncs := q.truncs
+	q.mu.Unlock()
+	if !appending && off+int64(len(b)) <= f.size && truncs == f.truncs || len(b) == 0 {
+		return do()
+	}
+	q.grow.Lock()
+	defer q.grow.Unlock()
+	fi, err := f.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	if appending {
+		off = size
+	}
+	end := off + int64(len(b))
+	if q.l.FileSize > 0 && end > q.l.FileSize {
+		return 0, pathErr("write", f.name, syscall.EFBIG)
+	}
+	if err := q.add(max(0, end-size), 0); err != nil {
+		return 0, pathErr("write", f.name, err)
+	}
+	n, err := do()
+	if n < len(b) {
+		// Give back what was not written.
+		q.add(min(0, max(off+int64(n), size)-end), 0)
+	}
+	f.size, f.truncs = max(size, off+int64(n)), truncs
+	if appending {
+		f.off = off
+	}
+	return n, err
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.f.Read(b)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) { return f.f.ReadAt(b, off) }
+
+func (f *file) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.write(b, f.off, true)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *file) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, pathErr("write", f.name, syscall.EINVAL)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.write(b, off, false)
+}
+
+// Truncate counts what growing the file adds, and gives back what
+// shrinking it takes away.
+func (f *file) Truncate(size int64) error {
+	q := f.q
+	switch {
+	case size < 0:
+		return pathErr("truncate", f.name, syscall.EINVAL)
+	case q.l.FileSize > 0 && size > q.l.FileSize:
+		return pathErr("truncate", f.name, syscall.EFBIG)
+	}
+	q.grow.Lock()
+	defer q.grow.Unlock()
+	fi, err := f.f.Stat()
+	if err != nil {
+		return err
+	}
+	grown := max(0, size-fi.Size())
+	if err := q.add(grown, 0); err != nil {
+		return pathErr("truncate", f.name, err)
+	}
+	if err := vfs.Truncate(f.f, size); err != nil {
+		q.add(-grown, 0)
+		return err
+	}
+	if size < fi.Size() {
+		q.mu.Lock()
+		q.bytes -= fi.Size() - size
+		q.truncs++
+		q.mu.Unlock()
+	}
+	return nil
+}
+
+// PunchHole leaves the usage as it is, since bytes are counted by file
+// size.
+func (f *file) PunchHole(off, n int64) error { return vfs.PunchHole(f.f, off, n) }
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	off, err := f.f.Seek(offset, whence)
+	if err == nil {
+		f.off = off
+	}
+	return off, err
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.f.Stat() }
+func (f *file) Sync() error                { return vfs.Sync(f.f) }
+func (f *file) Close() error               { return f.f.Close() }
+
+// SocketPath returns the backend's host path for name. A socket bound
+// there is not counted against the limits.
+func (q *FS) SocketPath(name string) (string, error) {
+	return vfs.SocketPath(q.b, name)
+}
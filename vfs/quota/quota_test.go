@@ -0,0 +1,183 @@
+package quota_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/quota"
+)
+
+func write(b vfs.Backend, name string, flag int, data string) error {
+	f, err := b.Open(name, os.O_WRONLY|os.O_CREATE|flag, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func usage(t *testing.T, q *quota.FS, bytes, inodes int64) {
+	t.Helper()
+	if b, i := q.Usage(); b != bytes || i != inodes {
+		t.Errorf("usage %d bytes, %d inodes, want %d, %d", b, i, bytes, inodes)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	q := quota.New(memfs.New(), quota.Limits{Bytes: 10, FileSize: 8})
+	if err := write(q, "a", 0, "12345"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(q, "a", 0, "123"); err != nil {
+		t.Fatal(err)
+	}
+	usage(t, q, 5, 1)
+	if err := write(q, "a", os.O_APPEND, "678"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(q, "a", os.O_APPEND, "9"); !errors.Is(err, syscall.EFBIG) {
+		t.Errorf("write past the file size: %v", err)
+	}
+	if err := write(q, "b", 0, "123"); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("write past the quota: %v", err)
+	}
+	usage(t, q, 8, 2)
+	if err := write(q, "a", os.O_TRUNC, "1"); err != nil {
+		t.Fatal(err)
+	}
+	usage(t, q, 1, 2)
+
+	// WriteAt past the end counts the hole.
+	f, err := q.Open("b", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("x"), 7); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("y"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(f); string(got) != "y\x00\x00\x00x" {
+		t.Errorf("read %q after the writes", got)
+	}
+	f.Close()
+	usage(t, q, 9, 2)
+}
+
+func TestTruncate(t *testing.T) {
+	q := quota.New(memfs.New(), quota.Limits{Bytes: 10, FileSize: 8})
+	if err := write(q, "a", 0, "12345"); err != nil {
+		t.Fatal(err)
+	}
+	f, _ := q.Open("a", os.O_RDWR, 0)
+	defer f.Close()
+	if err := vfs.Truncate(f, 2); err != nil {
+		t.Fatal(err)
+	}
+	usage(t, q, 2, 1)
+	if err := vfs.Truncate(f, 9); !errors.Is(err, syscall.EFBIG) {
+		t.Errorf("truncate past the file size limit: got %v", err)
+	}
+	if err := vfs.Truncate(f, 8); err != nil {
+		t.Fatal(err)
+	}
+	usage(t, q, 8, 1)
+	if err := vfs.PunchHole(f, 0, 8); err != nil {
+		t.Fatal(err)
+	}
+	usage(t, q, 8, 1)
+	// The file that shrank is grown again by writes below its old end.
+	vfs.Truncate(f, 0)
+	if _, err := f.WriteAt([]byte("123"), 0); err != nil {
+		t.Fatal(err)
+	}
+	usage(t, q, 3, 1)
+}
+
+func TestInodes(t *testing.T) {
+	mem := memfs.New()
+	write(mem, "old", 0, "already there")
+	q := quota.New(mem, quota.Limits{Inodes: 3})
+	if err := q.Mkdir("d", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Symlink("d", "link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(q, "d/f", 0, "data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Mkdir("e", 0o755); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("mkdir past the quota: %v", err)
+	}
+	if _, err := q.Open("g", os.O_WRONLY|os.O_CREATE, 0o644); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("create past the quota: %v", err)
+	}
+	if _, err := mem.Lstat("g"); err == nil {
+		t.Error("file made past the quota")
+	}
+	// A hard link takes no inode, and removing one name of two gives
+	// nothing back.
+	if err := q.Link("d/f", "d/f2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Unlink("d/f"); err != nil {
+		t.Fatal(err)
+	}
+	usage(t, q, 4, 3)
+	if err := q.Unlink("d/f2"); err != nil {
+		t.Fatal(err)
+	}
+	usage(t, q, 0, 2)
+
+	// Removing what was there to begin with makes room, and so does a
+	// rename over a file.
+	if err := q.Unlink("old"); err != nil {
+		t.Fatal(err)
+	}
+	usage(t, q, -13, 1)
+	write(q, "x", 0, "xx")
+	write(q, "y", 0, "y")
+	if err := q.Rename("x", "y"); err != nil {
+		t.Fatal(err)
+	}
+	usage(t, q, -11, 2)
+}
+
+func TestStatFS(t *testing.T) {
+	dir := t.TempDir()
+	host, err := vfs.HostStatFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := quota.New(vfs.Dir(dir), quota.Limits{Bytes: 10})
+	if err := write(q, "a", os.O_CREATE, "1234"); err != nil {
+		t.Fatal(err)
+	}
+	st, err := q.StatFS("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Bytes are bounded by the quota, and inodes only by the host.
+	if st.Bytes != 10 || st.BytesFree != 6 || st.Inodes != host.Inodes || st.Type != host.Type {
+		t.Errorf("statfs: got %+v, host has %+v", st, host)
+	}
+	if st, _ := vfs.StatFS(quota.New(memfs.New(), quota.Limits{Inodes: 5}), "."); st != (vfs.FSStat{Inodes: 5, InodesFree: 5}) {
+		t.Errorf("statfs of a bounded memfs: got %+v", st)
+	}
+}
@@ -0,0 +1,133 @@
+package vfs
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// MaxSymlinks is the number of symlinks followed during a single lookup
+// before it fails with ELOOP, matching Linux's limit.
+const MaxSymlinks = 40
+
+// Walk resolves the slash-separated name in a tree of entries of type E,
+// beginning at the directory root; empty and "." components are skipped.
+// lookup returns the entry called name in the directory dir, with its mode
+// and, for a symlink, its target; last is set for the final component.
+// Symlinks in intermediate components are always followed; a final
+// symlink is followed only if follow is set. Absolute targets are resolved
+// against root. Walk fails with ENOTDIR, ELOOP or the error lookup
+// returns, which callers wrap for the operation and name.
+func Walk[E any](name string, root E, follow bool, lookup func(dir E, name string, last bool) (E, fs.FileMode, string, error)) (E, error) {
+	type step struct {
+		e    E
+		mode fs.FileMode
+	}
+	var zero E
+	stack := []step{{root, fs.ModeDir}}
+	comps := strings.Split(name, "/")
+	links := 0
+	for len(comps) > 0 {
+		c := comps[0]
+		comps = comps[1:]
+		cur := stack[len(stack)-1]
+		if c == "" || c == "." {
+			continue
+		}
+		if !cur.mode.IsDir() {
+			return zero, syscall.ENOTDIR
+		}
+		if c == ".." {
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+		e, mode, target, err := lookup(cur.e, c, len(comps) == 0)
+		if err != nil {
+			return zero, err
+		}
+		if mode&fs.ModeSymlink != 0 && (follow || len(comps) > 0) {
+			if links++; links > MaxSymlinks {
+				return zero, syscall.ELOOP
+			}
+			if path.IsAbs(target) {
+				stack = stack[:1]
+			}
+			comps = append(strings.Split(target, "/"), comps...)
+			continue
+		}
+		stack = append(stack, step{e, mode})
+	}
+	return stack[len(stack)-1].e, nil
+}
+
+// ReadOnly gives a read-only Backend the methods that would change it,
+// failing each with EROFS. It is called with the op and the name each
+// changes to look the name up, and the error it returns is returned
+// instead, unless it is a *fs.PathError for ENOENT.
+type ReadOnly func(op, name string) error
+
+func (lookup ReadOnly) fail(op, name string) error {
+	if err := lookup(op, name); err != nil {
+		if pe, ok := err.(*fs.PathError); !ok || pe.Err != syscall.ENOENT {
+			return err
+		}
+	}
+	return &fs.PathError{Op: op, Path: name, Err: syscall.EROFS}
+}
+
+func (lookup ReadOnly) Mkdir(name string, perm fs.FileMode) error { return lookup.fail("mkdir", name) }
+func (lookup ReadOnly) Unlink(name string) error                  { return lookup.fail("unlink", name) }
+func (lookup ReadOnly) Rmdir(name string) error                   { return lookup.fail("rmdir", name) }
+
+func (lookup ReadOnly) Rename(oldname, newname string) error { return lookup.fail("rename", oldname) }
+func (lookup ReadOnly) Link(oldname, newname string) error   { return lookup.fail("link", newname) }
+
+func (lookup ReadOnly) Symlink(target, newname string) error { return lookup.fail("symlink", newname) }
+
+func (lookup ReadOnly) Chmod(name string, mode fs.FileMode) error { return lookup.fail("chmod", name) }
+
+func (lookup ReadOnly) Chtimes(name string, atime, mtime time.Time) error {
+	return lookup.fail("chtimes", name)
+}
+
+// DirFile is an open directory, whose entries the tracer lists through
+// ReadDir. Info describes it.
+type DirFile struct {
+	Info fs.FileInfo
+}
+
+func (d *DirFile) Read([]byte) (int, error) { return 0, d.err("read", syscall.EISDIR) }
+func (d *DirFile) ReadAt([]byte, int64) (int, error) {
+	return 0, d.err("read", syscall.EISDIR)
+}
+func (d *DirFile) Write([]byte) (int, error) { return 0, d.err("write", syscall.EBADF) }
+func (d *DirFile) WriteAt([]byte, int64) (int, error) {
+	return 0, d.err("write", syscall.EBADF)
+}
+func (d *DirFile) Seek(int64, int) (int64, error) { return 0, nil }
+func (d *DirFile) Stat() (fs.FileInfo, error)     { return d.Info, nil }
+func (d *DirFile) Close() error                   { return nil }
+
+func (d *DirFile) err(op string, errno syscall.Errno) error {
+	return &fs.PathError{Op: op, Path: d.Info.Name(), Err: errno}
+}
+
+// CheckFile returns the error op on the file name, opened with flag, fails
+// with before it is made: fs.ErrClosed once the file is closed, or EBADF
+// if it is a write and the file is not open for writing, or a read and it
+// is not open for reading.
+func CheckFile(op, name string, flag int, closed, write bool) error {
+	acc := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	switch {
+	case closed:
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrClosed}
+	case write && acc == os.O_RDONLY, !write && acc == os.O_WRONLY:
+		return &fs.PathError{Op: op, Path: name, Err: syscall.EBADF}
+	}
+	return nil
+}
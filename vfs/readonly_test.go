@@ -0,0 +1,104 @@
+package vfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+	tree := map[string]struct {
+		mode   fs.FileMode
+		target string
+	}{
+		"d":      {mode: fs.ModeDir},
+		"d/f":    {},
+		"d/abs":  {mode: fs.ModeSymlink, target: "/d/f"},
+		"d/rel":  {mode: fs.ModeSymlink, target: "../d"},
+		"d/loop": {mode: fs.ModeSymlink, target: "loop"},
+		"d/up":   {mode: fs.ModeSymlink, target: "f/.."},
+	}
+	lookup := func(dir, name string, _ bool) (string, fs.FileMode, string, error) {
+		p := path.Join(dir, name)
+		e, ok := tree[p]
+		if !ok {
+			return "", 0, "", syscall.ENOENT
+		}
+		return p, e.mode, e.target, nil
+	}
+	for _, tt := range []struct {
+		name   string
+		follow bool
+		want   string
+		err    error
+	}{
+		{name: ".", want: "."},
+		{name: "d/rel/f", want: "d/f"},
+		{name: "d/abs", follow: true, want: "d/f"},
+		{name: "d/abs", want: "d/abs"},
+		{name: "d/up", follow: true, err: syscall.ENOTDIR},
+		{name: "d/loop", follow: true, err: syscall.ELOOP},
+		{name: "d/missing", err: syscall.ENOENT},
+		{name: "d//./f", want: "d/f"},
+	} {
+		got, err := Walk(tt.name, ".", tt.follow, lookup)
+		if tt.err != nil {
+			if err != tt.err {
+				t.Errorf("Walk(%q, %v) = %v, want %v", tt.name, tt.follow, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Walk(%q, %v) = %q, %v, want %q", tt.name, tt.follow, got, err, tt.want)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	lookup := ReadOnly(func(op, name string) error {
+		if name == "missing" {
+			return &fs.PathError{Op: op, Path: name, Err: syscall.ENOENT}
+		}
+		if name == "file/x" {
+			return &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		return nil
+	})
+	for name, want := range map[string]error{"missing": syscall.EROFS, "file/x": syscall.ENOTDIR, "file": syscall.EROFS} {
+		if err := lookup.Mkdir(name, 0o755); !errors.Is(err, want) {
+			t.Errorf("Mkdir(%q) = %v, want %v", name, err, want)
+		}
+	}
+}
+
+func TestDirFile(t *testing.T) {
+	d := &DirFile{Info: namedInfo{name: "d"}}
+	if _, err := d.Read(nil); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("Read = %v, want EISDIR", err)
+	}
+	if _, err := d.Write(nil); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("Write = %v, want EBADF", err)
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	for _, tt := range []struct {
+		flag          int
+		closed, write bool
+		want          error
+	}{
+		{flag: os.O_RDONLY},
+		{flag: os.O_RDONLY, write: true, want: syscall.EBADF},
+		{flag: os.O_WRONLY, want: syscall.EBADF},
+		{flag: os.O_RDWR, write: true},
+		{flag: os.O_RDWR, closed: true, want: fs.ErrClosed},
+	} {
+		err := CheckFile("read", "f", tt.flag, tt.closed, tt.write)
+		if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("CheckFile(%#o, %v, %v) = %v, want %v", tt.flag, tt.closed, tt.write, err, tt.want)
+		}
+	}
+}
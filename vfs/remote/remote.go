@@ -0,0 +1,234 @@
+// Package remote serves a vfs.Backend over gRPC, so that the files a
+// tracer shows its command can live in another process or on another
+// machine. A Server wraps any backend; a Backend is the client side, and is
+// itself a vfs.Backend to give to tracer.WithMount:
+//
+//	// On the machine with the files:
+//	s := grpc.NewServer()
+//	remotepb.RegisterBackendServer(s, remote.NewServer(vfs.Dir("/srv/data")))
+//	s.Serve(lis)
+//
+//	// Next to the tracer:
+//	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+//	t := tracer.New(cmd, tracer.WithMount("/data", remote.New(conn)))
+//
+// Every call is one round trip; nothing is cached. Errors keep the errno
+// they wrap on the server, so the command sees the errno it would have
+// seen locally. A call that fails in transport fails with the gRPC error,
+// which the tracer reports as EIO. The protocol is in remotepb/remote.proto.
+package remote
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/remote/remotepb"
+)
+
+// Backend is a vfs.Backend whose calls are served by a Server.
+type Backend struct {
+	c remotepb.BackendClient
+}
+
+var _ vfs.Backend = (*Backend)(nil)
+
+// New returns a Backend that makes its calls over conn.
+func New(conn grpc.ClientConnInterface) *Backend {
+	return &Backend{c: remotepb.NewBackendClient(conn)}
+}
+
+// ctx is the context calls are made in. The Backend interface has no
+// context of its own; deadlines belong in interceptors on the connection.
+var ctx = context.Background()
+
+func (b *Backend) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	resp, err := b.c.Open(ctx, &remotepb.OpenRequest{Name: name, Flag: int32(flag), Perm: uint32(perm)})
+	if err != nil {
+		return nil, errorFrom(err)
+	}
+	return &file{c: b.c, id: resp.File}, nil
+}
+
+func (b *Backend) Stat(name string) (fs.FileInfo, error) {
+	m, err := b.c.Stat(ctx, &remotepb.PathRequest{Name: name})
+	if err != nil {
+		return nil, errorFrom(err)
+	}
+	return newFileInfo(m), nil
+}
+
+func (b *Backend) Lstat(name string) (fs.FileInfo, error) {
+	m, err := b.c.Lstat(ctx, &remotepb.PathRequest{Name: name})
+	if err != nil {
+		return nil, errorFrom(err)
+	}
+	return newFileInfo(m), nil
+}
+
+func (b *Backend) ReadDir(name string) ([]fs.DirEntry, error) {
+	resp, err := b.c.ReadDir(ctx, &remotepb.PathRequest{Name: name})
+	if err != nil {
+		return nil, errorFrom(err)
+	}
+	entries := make([]fs.DirEntry, len(resp.Entries))
+	for i, e := range resp.Entries {
+		if e.Info != nil {
+			entries[i] = fs.FileInfoToDirEntry(newFileInfo(e.Info))
+		} else {
+			entries[i] = &dirEntry{b: b, dir: path.Clean(name), name: e.Name, typ: fs.FileMode(e.Type)}
+		}
+	}
+	return entries, nil
+}
+
+func (b *Backend) Mkdir(name string, perm fs.FileMode) error {
+	_, err := b.c.Mkdir(ctx, &remotepb.MkdirRequest{Name: name, Perm: uint32(perm)})
+	return errorFrom(err)
+}
+
+func (b *Backend) Unlink(name string) error {
+	_, err := b.c.Unlink(ctx, &remotepb.PathRequest{Name: name})
+	return errorFrom(err)
+}
+
+func (b *Backend) Rmdir(name string) error {
+	_, err := b.c.Rmdir(ctx, &remotepb.PathRequest{Name: name})
+	return errorFrom(err)
+}
+
+func (b *Backend) Rename(oldname, newname string) error {
+	_, err := b.c.Rename(ctx, &remotepb.RenameRequest{OldName: oldname, NewName: newname})
+	return errorFrom(err)
+}
+
+func (b *Backend) Link(oldname, newname string) error {
+	_, err := b.c.Link(ctx, &remotepb.RenameRequest{OldName: oldname, NewName: newname})
+	return errorFrom(err)
+}
+
+func (b *Backend) Symlink(target, newname string) error {
+	_, err := b.c.Symlink(ctx, &remotepb.SymlinkRequest{Target: target, NewName: newname})
+	return errorFrom(err)
+}
+
+func (b *Backend) Readlink(name string) (string, error) {
+	resp, err := b.c.Readlink(ctx, &remotepb.PathRequest{Name: name})
+	if err != nil {
+		return "", errorFrom(err)
+	}
+	return resp.Target, nil
+}
+
+func (b *Backend) Chmod(name string, mode fs.FileMode) error {
+	_, err := b.c.Chmod(ctx, &remotepb.ChmodRequest{Name: name, Mode: uint32(mode)})
+	return errorFrom(err)
+}
+
+func (b *Backend) Chtimes(name string, atime, mtime time.Time) error {
+	req := &remotepb.ChtimesRequest{Name: name}
+	if !atime.IsZero() {
+		ns := atime.UnixNano()
+		req.Atime = &ns
+	}
+	if !mtime.IsZero() {
+		ns := mtime.UnixNano()
+		req.Mtime = &ns
+	}
+	_, err := b.c.Chtimes(ctx, req)
+	return errorFrom(err)
+}
+
+// file is a file open on the server.
+type file struct {
+	c  remotepb.BackendClient
+	id uint64
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	resp, err := f.c.Read(ctx, &remotepb.ReadRequest{File: f.id, Size: int32(min(len(p), maxChunk))})
+	if err != nil {
+		return 0, errorFrom(err)
+	}
+	n := copy(p, resp.Data)
+	if n == 0 && resp.Eof {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	total := 0
+	for total < len(p) {
+		at := off + int64(total)
+		resp, err := f.c.Read(ctx, &remotepb.ReadRequest{File: f.id, Size: int32(min(len(p)-total, maxChunk)), Offset: &at})
+		if err != nil {
+			return total, errorFrom(err)
+		}
+		total += copy(p[total:], resp.Data)
+		if resp.Eof && total < len(p) {
+			return total, io.EOF
+		}
+	}
+	return total, nil
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	return f.write(p, nil)
+}
+
+func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	return f.write(p, &off)
+}
+
+// write writes p in chunks, at *off if off is not nil.
+func (f *file) write(p []byte, off *int64) (int, error) {
+	total := 0
+	for {
+		req := &remotepb.WriteRequest{File: f.id, Data: p[total:min(len(p), total+maxChunk)]}
+		if off != nil {
+			at := *off + int64(total)
+			req.Offset = &at
+		}
+		resp, err := f.c.Write(ctx, req)
+		if err != nil {
+			return total, errorFrom(err)
+		}
+		total += int(resp.N)
+		switch {
+		case total == len(p):
+			return total, nil
+		case resp.N == 0:
+			return total, io.ErrShortWrite
+		}
+	}
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	resp, err := f.c.Seek(ctx, &remotepb.SeekRequest{File: f.id, Offset: offset, Whence: int32(whence)})
+	if err != nil {
+		return 0, errorFrom(err)
+	}
+	return resp.Offset, nil
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	m, err := f.c.FileStat(ctx, &remotepb.FileRequest{File: f.id})
+	if err != nil {
+		return nil, errorFrom(err)
+	}
+	return newFileInfo(m), nil
+}
+
+func (f *file) Close() error {
+	_, err := f.c.CloseFile(ctx, &remotepb.FileRequest{File: f.id})
+	return errorFrom(err)
+}
@@ -0,0 +1,175 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/remote/remotepb"
+)
+
+// serve serves b over an in-memory connection and returns a client for it.
+func serve(t *testing.T, b vfs.Backend) *Backend {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	srv := NewServer(b)
+	remotepb.RegisterBackendServer(s, srv)
+	go s.Serve(lis)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		s.Stop()
+		srv.Close()
+	})
+	return New(conn)
+}
+
+func TestFiles(t *testing.T) {
+	b := serve(t, memfs.New())
+	if err := b.Mkdir("d", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := b.Open("d/f", os.O_RDWR|os.O_CREATE, 0o640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := bytes.Repeat([]byte("0123456789abcdef"), maxChunk/8)
+	if n, err := f.Write(big); n != len(big) || err != nil {
+		t.Fatalf("write: %d, %v", n, err)
+	}
+	if _, err := f.WriteAt([]byte("AT"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if off, err := f.Seek(0, io.SeekStart); off != 0 || err != nil {
+		t.Fatalf("seek: %d, %v", off, err)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(big[1:], "AT")
+	if !bytes.Equal(got, big) {
+		t.Errorf("read back %d bytes, not what was written", len(got))
+	}
+	p := make([]byte, 4)
+	if n, err := f.ReadAt(p, int64(len(big))-2); n != 2 || err != io.EOF {
+		t.Errorf("read at the end: %d, %v", n, err)
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != int64(len(big)) || fi.Mode() != 0o640 {
+		t.Errorf("stat: %v, %v", fi, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(p); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("read after close: %v", err)
+	}
+
+	if err := b.Symlink("f", "d/link"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := b.Readlink("d/link"); target != "f" || err != nil {
+		t.Errorf("readlink: %q, %v", target, err)
+	}
+	if fi, err := b.Lstat("d/link"); err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("lstat: %v, %v", fi, err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := b.Chtimes("d/f", time.Time{}, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Chmod("d/f", 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := b.Stat("d/link")
+	if err != nil || !fi.ModTime().Equal(mtime) || fi.Mode() != 0o600 {
+		t.Errorf("stat: %v, %v", fi, err)
+	}
+	if attr, ok := fi.Sys().(*vfs.Attr); !ok || attr.Ino == 0 || attr.Nlink != 1 {
+		t.Errorf("attr: %#v", fi.Sys())
+	}
+	if err := b.Link("d/f", "d/g"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Rename("d/g", "h"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := b.ReadDir("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if got := strings.Join(names, " "); got != "f link" {
+		t.Errorf("entries %s", got)
+	}
+	if info, err := entries[1].Info(); err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("info: %v, %v", info, err)
+	}
+	for _, err := range []error{b.Unlink("h"), b.Unlink("d/f"), b.Unlink("d/link"), b.Rmdir("d")} {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	b := serve(t, memfs.New())
+	_, err := b.Stat("missing")
+	var pe *fs.PathError
+	if !errors.As(err, &pe) || pe.Op != "stat" || pe.Path != "missing" || pe.Err != syscall.ENOENT {
+		t.Errorf("stat: %#v", err)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%v is not fs.ErrNotExist", err)
+	}
+	b.Mkdir("d", 0o755)
+	if err := b.Mkdir("d", 0o755); !errors.Is(err, syscall.EEXIST) {
+		t.Errorf("mkdir: %v", err)
+	}
+	b.Mkdir("d/e", 0o755)
+	if err := b.Rmdir("d"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("rmdir: %v", err)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	m := memfs.New()
+	b := serve(t, m)
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `echo remote >/remote/f && cat /remote/f && ls /remote && cat /remote/missing 2>/dev/null || echo $?`)
+	cmd.Stdout = &stdout
+	if err := tracer.New(cmd, tracer.WithMount("/remote", b)).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "remote\nf\n1\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := m.Stat("f"); err != nil {
+		t.Errorf("file not on the server: %v", err)
+	}
+}
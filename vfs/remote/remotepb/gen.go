@@ -0,0 +1,5 @@
+// Package remotepb holds the protocol buffers and gRPC service of the
+// remote backend, generated from remote.proto.
+package remotepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative remote.proto
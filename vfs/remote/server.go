@@ -0,0 +1,228 @@
+package remote
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/remote/remotepb"
+)
+
+// Server serves a vfs.Backend to Backend clients. Register it with a
+// grpc.Server through remotepb.RegisterBackendServer.
+//
+// Files stay open until a client closes them or the Server is closed; a
+// client that goes away without closing its files leaves them open.
+type Server struct {
+	remotepb.UnimplementedBackendServer
+
+	b     vfs.Backend
+	mu    sync.Mutex
+	files map[uint64]vfs.File
+	next  uint64
+}
+
+// NewServer returns a Server for b.
+func NewServer(b vfs.Backend) *Server {
+	return &Server{b: b, files: make(map[uint64]vfs.File)}
+}
+
+// Close closes every file clients have left open.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	files := s.files
+	s.files = make(map[uint64]vfs.File)
+	s.mu.Unlock()
+	var first error
+	for _, f := range files {
+		if err := f.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (s *Server) file(id uint64) (vfs.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[id]
+	if !ok {
+		return nil, statusFor(syscall.EBADF)
+	}
+	return f, nil
+}
+
+var empty = &remotepb.Empty{}
+
+// reply returns an empty reply, or the status for err.
+func reply(err error) (*remotepb.Empty, error) {
+	if err != nil {
+		return nil, statusFor(err)
+	}
+	return empty, nil
+}
+
+func infoReply(fi fs.FileInfo, err error) (*remotepb.FileInfo, error) {
+	if err != nil {
+		return nil, statusFor(err)
+	}
+	return infoMessage(fi), nil
+}
+
+func (s *Server) Open(_ context.Context, req *remotepb.OpenRequest) (*remotepb.OpenResponse, error) {
+	f, err := s.b.Open(req.Name, int(req.Flag), fs.FileMode(req.Perm))
+	if err != nil {
+		return nil, statusFor(err)
+	}
+	s.mu.Lock()
+	s.next++
+	id := s.next
+	s.files[id] = f
+	s.mu.Unlock()
+	return &remotepb.OpenResponse{File: id}, nil
+}
+
+func (s *Server) Stat(_ context.Context, req *remotepb.PathRequest) (*remotepb.FileInfo, error) {
+	return infoReply(s.b.Stat(req.Name))
+}
+
+func (s *Server) Lstat(_ context.Context, req *remotepb.PathRequest) (*remotepb.FileInfo, error) {
+	return infoReply(s.b.Lstat(req.Name))
+}
+
+func (s *Server) ReadDir(_ context.Context, req *remotepb.PathRequest) (*remotepb.ReadDirResponse, error) {
+	entries, err := s.b.ReadDir(req.Name)
+	if err != nil {
+		return nil, statusFor(err)
+	}
+	resp := &remotepb.ReadDirResponse{Entries: make([]*remotepb.DirEntry, len(entries))}
+	for i, e := range entries {
+		m := &remotepb.DirEntry{Name: e.Name(), Type: uint32(e.Type())}
+		if fi, err := e.Info(); err == nil {
+			m.Info = infoMessage(fi)
+		}
+		resp.Entries[i] = m
+	}
+	return resp, nil
+}
+
+func (s *Server) Mkdir(_ context.Context, req *remotepb.MkdirRequest) (*remotepb.Empty, error) {
+	return reply(s.b.Mkdir(req.Name, fs.FileMode(req.Perm)))
+}
+
+func (s *Server) Unlink(_ context.Context, req *remotepb.PathRequest) (*remotepb.Empty, error) {
+	return reply(s.b.Unlink(req.Name))
+}
+
+func (s *Server) Rmdir(_ context.Context, req *remotepb.PathRequest) (*remotepb.Empty, error) {
+	return reply(s.b.Rmdir(req.Name))
+}
+
+func (s *Server) Rename(_ context.Context, req *remotepb.RenameRequest) (*remotepb.Empty, error) {
+	return reply(s.b.Rename(req.OldName, req.NewName))
+}
+
+func (s *Server) Link(_ context.Context, req *remotepb.RenameRequest) (*remotepb.Empty, error) {
+	return reply(s.b.Link(req.OldName, req.NewName))
+}
+
+func (s *Server) Symlink(_ context.Context, req *remotepb.SymlinkRequest) (*remotepb.Empty, error) {
+	return reply(s.b.Symlink(req.Target, req.NewName))
+}
+
+func (s *Server) Readlink(_ context.Context, req *remotepb.PathRequest) (*remotepb.ReadlinkResponse, error) {
+	target, err := s.b.Readlink(req.Name)
+	if err != nil {
+		return nil, statusFor(err)
+	}
+	return &remotepb.ReadlinkResponse{Target: target}, nil
+}
+
+func (s *Server) Chmod(_ context.Context, req *remotepb.ChmodRequest) (*remotepb.Empty, error) {
+	return reply(s.b.Chmod(req.Name, fs.FileMode(req.Mode)))
+}
+
+func (s *Server) Chtimes(_ context.Context, req *remotepb.ChtimesRequest) (*remotepb.Empty, error) {
+	var atime, mtime time.Time
+	if req.Atime != nil {
+		atime = time.Unix(0, *req.Atime)
+	}
+	if req.Mtime != nil {
+		mtime = time.Unix(0, *req.Mtime)
+	}
+	return reply(s.b.Chtimes(req.Name, atime, mtime))
+}
+
+func (s *Server) Read(_ context.Context, req *remotepb.ReadRequest) (*remotepb.ReadResponse, error) {
+	f, err := s.file(req.File)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, min(max(req.Size, 0), maxChunk))
+	var n int
+	if req.Offset != nil {
+		n, err = f.ReadAt(buf, *req.Offset)
+	} else {
+		n, err = f.Read(buf)
+	}
+	resp := &remotepb.ReadResponse{Data: buf[:n]}
+	if err == io.EOF {
+		resp.Eof, err = true, nil
+	}
+	if err != nil {
+		return nil, statusFor(err)
+	}
+	return resp, nil
+}
+
+func (s *Server) Write(_ context.Context, req *remotepb.WriteRequest) (*remotepb.WriteResponse, error) {
+	f, err := s.file(req.File)
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	if req.Offset != nil {
+		n, err = f.WriteAt(req.Data, *req.Offset)
+	} else {
+		n, err = f.Write(req.Data)
+	}
+	if err != nil {
+		return nil, statusFor(err)
+	}
+	return &remotepb.WriteResponse{N: int64(n)}, nil
+}
+
+func (s *Server) Seek(_ context.Context, req *remotepb.SeekRequest) (*remotepb.SeekResponse, error) {
+	f, err := s.file(req.File)
+	if err != nil {
+		return nil, err
+	}
+	off, err := f.Seek(req.Offset, int(req.Whence))
+	if err != nil {
+		return nil, statusFor(err)
+	}
+	return &remotepb.SeekResponse{Offset: off}, nil
+}
+
+func (s *Server) FileStat(_ context.Context, req *remotepb.FileRequest) (*remotepb.FileInfo, error) {
+	f, err := s.file(req.File)
+	if err != nil {
+		return nil, err
+	}
+	return infoReply(f.Stat())
+}
+
+func (s *Server) CloseFile(_ context.Context, req *remotepb.FileRequest) (*remotepb.Empty, error) {
+	s.mu.Lock()
+	f, ok := s.files[req.File]
+	delete(s.files, req.File)
+	s.mu.Unlock()
+	if !ok {
+		return reply(syscall.EBADF)
+	}
+	return reply(f.Close())
+}
@@ -0,0 +1,176 @@
+package remote
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/remote/remotepb"
+)
+
+// maxChunk is the most data one Read or Write call carries, well below the
+// 4MiB gRPC allows a message by default.
+const maxChunk = 1 << 20
+
+// statusFor returns the status a call that failed with err ends with.
+func statusFor(err error) error {
+	e := &remotepb.Error{Message: err.Error()}
+	var pe *fs.PathError
+	var le *os.LinkError
+	switch {
+	case errors.As(err, &pe):
+		e.Op, e.Path, e.Message = pe.Op, pe.Path, pe.Err.Error()
+	case errors.As(err, &le):
+		e.Op, e.Path, e.Message = le.Op, le.Old, le.Err.Error()
+	}
+	var errno syscall.Errno
+	switch {
+	case errors.As(err, &errno):
+	case errors.Is(err, fs.ErrNotExist):
+		errno = syscall.ENOENT
+	case errors.Is(err, fs.ErrExist):
+		errno = syscall.EEXIST
+	case errors.Is(err, fs.ErrPermission):
+		errno = syscall.EACCES
+	case errors.Is(err, fs.ErrInvalid):
+		errno = syscall.EINVAL
+	case errors.Is(err, fs.ErrClosed):
+		errno = syscall.EBADF
+	}
+	e.Errno = uint32(errno)
+	code := codes.Unknown
+	switch errno {
+	case syscall.ENOENT:
+		code = codes.NotFound
+	case syscall.EEXIST:
+		code = codes.AlreadyExists
+	case syscall.EACCES, syscall.EPERM:
+		code = codes.PermissionDenied
+	case syscall.EINVAL:
+		code = codes.InvalidArgument
+	}
+	st, derr := status.New(code, err.Error()).WithDetails(e)
+	if derr != nil {
+		return status.Error(code, err.Error())
+	}
+	return st.Err()
+}
+
+// errorFrom returns the error a call that ended with err failed with on
+// the server. Errors of the transport itself are returned as they are.
+func errorFrom(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, d := range st.Details() {
+		e, ok := d.(*remotepb.Error)
+		if !ok {
+			continue
+		}
+		var inner error = syscall.Errno(e.Errno)
+		if e.Errno == 0 {
+			inner = errors.New(e.Message)
+		}
+		if e.Op == "" {
+			return inner
+		}
+		return &fs.PathError{Op: e.Op, Path: e.Path, Err: inner}
+	}
+	return err
+}
+
+func infoMessage(fi fs.FileInfo) *remotepb.FileInfo {
+	m := &remotepb.FileInfo{
+		Name:    fi.Name(),
+		Size:    fi.Size(),
+		Mode:    uint32(fi.Mode()),
+		ModTime: fi.ModTime().UnixNano(),
+	}
+	switch sys := fi.Sys().(type) {
+	case *vfs.Attr:
+		m.Attr = &remotepb.Attr{
+			Ino:   sys.Ino,
+			Nlink: sys.Nlink,
+			Uid:   sys.Uid,
+			Gid:   sys.Gid,
+			Atime: sys.Atime.UnixNano(),
+			Ctime: sys.Ctime.UnixNano(),
+		}
+	case *syscall.Stat_t:
+		// Host files lose their device numbers on the way.
+		m.Attr = &remotepb.Attr{
+			Ino:   sys.Ino,
+			Nlink: uint64(sys.Nlink),
+			Uid:   sys.Uid,
+			Gid:   sys.Gid,
+			Atime: sys.Atim.Nano(),
+			Ctime: sys.Ctim.Nano(),
+		}
+	}
+	return m
+}
+
+// fileInfo is an fs.FileInfo received from the server. Sys returns a
+// *vfs.Attr if the server sent one.
+type fileInfo struct {
+	m    *remotepb.FileInfo
+	attr *vfs.Attr
+}
+
+func newFileInfo(m *remotepb.FileInfo) *fileInfo {
+	fi := &fileInfo{m: m}
+	if a := m.Attr; a != nil {
+		fi.attr = &vfs.Attr{
+			Ino:   a.Ino,
+			Nlink: a.Nlink,
+			Uid:   a.Uid,
+			Gid:   a.Gid,
+			Atime: time.Unix(0, a.Atime),
+			Ctime: time.Unix(0, a.Ctime),
+		}
+	}
+	return fi
+}
+
+func (fi *fileInfo) Name() string       { return fi.m.Name }
+func (fi *fileInfo) Size() int64        { return fi.m.Size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fs.FileMode(fi.m.Mode) }
+func (fi *fileInfo) ModTime() time.Time { return time.Unix(0, fi.m.ModTime) }
+func (fi *fileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+
+func (fi *fileInfo) Sys() any {
+	if fi.attr == nil {
+		return nil
+	}
+	return fi.attr
+}
+
+// dirEntry is an entry the server could not stat, which Info looks up
+// again.
+type dirEntry struct {
+	b    *Backend
+	dir  string
+	name string
+	typ  fs.FileMode
+}
+
+func (e *dirEntry) Name() string      { return e.name }
+func (e *dirEntry) IsDir() bool       { return e.typ.IsDir() }
+func (e *dirEntry) Type() fs.FileMode { return e.typ }
+
+func (e *dirEntry) Info() (fs.FileInfo, error) {
+	if e.dir == "." {
+		return e.b.Lstat(e.name)
+	}
+	return e.b.Lstat(e.dir + "/" + e.name)
+}
@@ -0,0 +1,202 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// emptyHash is the SHA-256 of no bytes, which requests without a body sign.
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// request makes an S3 request for key, with query parameters, headers and
+// a body whose SHA-256 is bodyHash. The response is returned whatever its
+// status; errors are only those of the transport.
+func (c *FS) request(method, key string, query url.Values, header http.Header, body io.Reader, size int64, bodyHash string) (*http.Response, error) {
+	u := *c.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if bodyHash == "" {
+		bodyHash = emptyHash
+	}
+	c.sign(req, bodyHash, c.now())
+	return c.client.Do(req)
+}
+
+// statusErr returns the errno an unsuccessful response stands for.
+func statusErr(resp *http.Response) syscall.Errno {
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return syscall.ENOENT
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return syscall.EACCES
+	case http.StatusPreconditionFailed:
+		return syscall.ESTALE
+	case http.StatusRequestedRangeNotSatisfiable:
+		return syscall.EINVAL
+	}
+	return syscall.EIO
+}
+
+// drain reads the rest of the body of resp and closes it, so that the
+// connection can be used again.
+func drain(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// sign adds an AWS Signature Version 4 to req, made at time now over every
+// header req has, if the FS has credentials.
+func (c *FS) sign(req *http.Request, bodyHash string, now time.Time) {
+	if c.cfg.AccessKeyID == "" {
+		return
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", bodyHash)
+	if c.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.cfg.SessionToken)
+	}
+
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		k = strings.ToLower(k)
+		names = append(names, k)
+		values[k] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&headers, "%s:%s\n", k, values[k])
+	}
+	signed := strings.Join(names, ";")
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signed,
+		bodyHash,
+	}, "\n")
+
+	scope := day + "/" + c.cfg.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := hmacSHA256([]byte("AWS4"+c.cfg.SecretAccessKey), day)
+	for _, s := range []string{c.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.cfg.AccessKeyID, scope, signed, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode encodes s as SigV4 requires: every byte but the unreserved
+// characters, and slashes unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes q sorted by key, as SigV4 requires. The same
+// string is sent, so that what is signed is what the server sees.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// listResult is the ListObjectsV2 response body.
+type listResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+		ETag         string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list lists the keys under prefix, grouped at the next slash, calling fn
+// for each page until it returns false. At most max keys are asked for in
+// a page if max is positive.
+func (c *FS) list(prefix string, max int, fn func(*listResult) bool) error {
+	q := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+	if max > 0 {
+		q.Set("max-keys", strconv.Itoa(max))
+	}
+	for {
+		resp, err := c.request(http.MethodGet, "", q, nil, nil, 0, "")
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			drain(resp)
+			return statusErr(resp)
+		}
+		var res listResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		drain(resp)
+		if err != nil {
+			return fmt.Errorf("list: %w", err)
+		}
+		if !fn(&res) || !res.IsTruncated {
+			return nil
+		}
+		q.Set("continuation-token", res.NextContinuationToken)
+	}
+}
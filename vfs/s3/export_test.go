@@ -0,0 +1,4 @@
+package s3
+
+// NewFakeFS lets tests outside the package use newFS.
+var NewFakeFS = newFS
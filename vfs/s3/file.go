@@ -0,0 +1,297 @@
+package s3
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// file is an open object. Reads go to the object until the first write,
+// which moves its contents to local.
+type file struct {
+	fs   *FS
+	name string
+	flag int
+
+	mu     sync.Mutex
+	info   info
+	off    int64
+	local  *os.File
+	dirty  bool
+	closed bool
+}
+
+// check validates f for an operation; f.mu must be held.
+func (f *file) check(op string, write bool) error {
+	return vfs.CheckFile(op, f.name, f.flag, f.closed, write)
+}
+
+// get reads len(b) bytes of the object at off, which must be within it.
+func (f *file) get(op string, b []byte, off int64) error {
+	h := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+int64(len(b))-1)}}
+	if f.info.etag != "" {
+		h.Set("If-Match", f.info.etag)
+	}
+	resp, err := f.fs.request(http.MethodGet, f.fs.key(f.name), nil, h, nil, 0, "")
+	if err != nil {
+		return pathErr(op, f.name, err)
+	}
+	defer drain(resp)
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		return pathErr(op, f.name, statusErr(resp))
+	}
+	if _, err := io.ReadFull(resp.Body, b); err != nil {
+		return pathErr(op, f.name, err)
+	}
+	return nil
+}
+
+// readAt reads at off; f.mu must be held.
+func (f *file) readAt(op string, b []byte, off int64) (int, error) {
+	if f.local != nil {
+		n, err := f.local.ReadAt(b, off)
+		if err != nil && err != io.EOF {
+			return n, pathErr(op, f.name, err)
+		}
+		return n, err
+	}
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(b)), f.info.size-off))
+	if err := f.get(op, b[:n], off); err != nil {
+		return 0, err
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, err := f.readAt("read", b, f.off)
+	f.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, pathErr("read", f.name, syscall.EINVAL)
+	}
+	return f.readAt("read", b, off)
+}
+
+// copyDown moves the contents of the object to a local file, if they are
+// not there yet; f.mu must be held.
+func (f *file) copyDown(op string) error {
+	if f.local != nil {
+		return nil
+	}
+	local, err := os.CreateTemp(f.fs.cfg.TempDir, "s3-")
+	if err != nil {
+		return pathErr(op, f.name, err)
+	}
+	os.Remove(local.Name())
+	if f.info.size > 0 {
+		// Copy in pieces of a size to keep each request short.
+		const piece = 8 << 20
+		buf := make([]byte, min(f.info.size, piece))
+		for off := int64(0); off < f.info.size; off += int64(len(buf)) {
+			b := buf[:min(int64(len(buf)), f.info.size-off)]
+			if err := f.get(op, b, off); err != nil {
+				local.Close()
+				return err
+			}
+			if _, err := local.WriteAt(b, off); err != nil {
+				local.Close()
+				return pathErr(op, f.name, err)
+			}
+		}
+	}
+	f.local = local
+	return nil
+}
+
+// writeAt writes at off; f.mu must be held.
+func (f *file) writeAt(b []byte, off int64) (int, error) {
+	if err := f.copyDown("write"); err != nil {
+		return 0, err
+	}
+	n, err := f.local.WriteAt(b, off)
+	f.dirty = true
+	f.info.size = max(f.info.size, off+int64(n))
+	f.info.mtime = f.fs.now()
+	if err != nil {
+		return n, pathErr("write", f.name, err)
+	}
+	return n, nil
+}
+
+func (f *file) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.off = f.info.size
+	}
+	n, err := f.writeAt(b, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *file) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, pathErr("write", f.name, syscall.EINVAL)
+	}
+	return f.writeAt(b, off)
+}
+
+// Truncate changes the size of the local copy of the file, which is only
+// made of what of the object is below the new size.
+func (f *file) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return pathErr("truncate", f.name, syscall.EINVAL)
+	}
+	if f.local == nil {
+		f.info.size = min(f.info.size, size)
+	}
+	if err := f.copyDown("truncate"); err != nil {
+		return err
+	}
+	if err := f.local.Truncate(size); err != nil {
+		return pathErr("truncate", f.name, err)
+	}
+	f.dirty = true
+	f.info.size = size
+	f.info.mtime = f.fs.now()
+	return nil
+}
+
+// PunchHole punches the hole in the local copy of the file. The object
+// uploaded holds zeros for it.
+func (f *file) PunchHole(off, n int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("fallocate", true); err != nil {
+		return err
+	}
+	if err := f.copyDown("fallocate"); err != nil {
+		return err
+	}
+	if err := vfs.PunchHole(f.local, off, n); err != nil {
+		return pathErr("fallocate", f.name, err)
+	}
+	f.dirty = true
+	f.info.mtime = f.fs.now()
+	return nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, pathErr("seek", f.name, fs.ErrClosed)
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.size
+	default:
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	if offset < 0 {
+		return 0, pathErr("seek", f.name, syscall.EINVAL)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, pathErr("stat", f.name, fs.ErrClosed)
+	}
+	fi := f.info
+	return &fi, nil
+}
+
+// Close uploads what was written to the file.
+func (f *file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return pathErr("close", f.name, fs.ErrClosed)
+	}
+	f.closed = true
+	if f.local == nil {
+		return nil
+	}
+	defer f.local.Close()
+	return f.upload("close")
+}
+
+// Sync uploads what was written to the file since it was opened or last
+// synced.
+func (f *file) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return pathErr("fsync", f.name, fs.ErrClosed)
+	}
+	if f.local == nil {
+		return nil
+	}
+	return f.upload("fsync")
+}
+
+// upload puts the file's local copy, if it was written to, as its object.
+func (f *file) upload(op string) error {
+	if !f.dirty {
+		return nil
+	}
+	if _, err := f.local.Seek(0, io.SeekStart); err != nil {
+		return pathErr(op, f.name, err)
+	}
+	if err := f.fs.put(op, f.name, f.fs.key(f.name), io.LimitReader(f.local, f.info.size), f.info.size); err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
@@ -0,0 +1,443 @@
+// Package s3 implements a vfs.Backend over a bucket of Amazon S3, or of
+// any object store that speaks its API, so that tools that expect local
+// files can work on objects.
+//
+// A name maps to the object key Config.Prefix + name. Directories are the
+// prefixes that keys share up to a slash, as S3 tools take them, and Mkdir
+// records one as an empty object whose key ends in a slash. Objects are
+// read lazily, with a range request for each read; opening a file
+// downloads nothing. The first write to a file copies it into a local
+// temporary file, unless it was truncated, and closing the file uploads it
+// in one request. Until then others see the object as it was, and if the
+// upload fails, so does Close. A read of an object that changes while it
+// is open fails with ESTALE.
+//
+// S3 has no symlinks, hard links, permission bits or access times. Symlink
+// and Link fail with EPERM, files report mode 0644 and directories 0755,
+// and Chmod and Chtimes change nothing. Renaming a file copies the object
+// through the FS and deletes the original; renaming a directory fails with
+// EXDEV, which makes tools fall back to copying it.
+//
+// All methods, and the methods of the files an FS opens, are safe for
+// concurrent use.
+package s3
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// Config describes a bucket.
+type Config struct {
+	// URL is the URL of the bucket, such as
+	// https://bucket.s3.us-east-1.amazonaws.com, or
+	// http://localhost:9000/bucket for path-style access.
+	URL string
+	// Prefix is put before every key. It should end in a slash.
+	Prefix string
+	// Region is the region requests are signed for. The default is
+	// us-east-1.
+	Region string
+	// AccessKeyID and SecretAccessKey sign requests, along with
+	// SessionToken for temporary credentials. Without them requests are
+	// made anonymously.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Client makes the requests. The default is http.DefaultClient.
+	Client *http.Client
+	// TempDir holds the files being written. The default is os.TempDir().
+	TempDir string
+}
+
+// ConfigFromEnv returns a Config for the bucket at url with the region and
+// credentials the AWS_REGION, AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables give.
+func ConfigFromEnv(url string) Config {
+	return Config{
+		URL:             url,
+		Region:          os.Getenv("AWS_REGION"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// FS is a bucket seen as a filesystem.
+type FS struct {
+	cfg    Config
+	base   *url.URL
+	client *http.Client
+	now    func() time.Time
+}
+
+var _ vfs.Backend = (*FS)(nil)
+
+// New returns an FS for the bucket cfg describes. It makes no requests.
+func New(cfg Config) (*FS, error) {
+	base, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &FS{cfg: cfg, base: base, client: client, now: time.Now}, nil
+}
+
+func pathErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// key returns the key of the object holding the file name.
+func (c *FS) key(name string) string { return c.cfg.Prefix + name }
+
+// dirPrefix returns the prefix of the keys below the directory name, which
+// is also the key of its marker object.
+func (c *FS) dirPrefix(name string) string {
+	if name == "." {
+		return c.cfg.Prefix
+	}
+	return c.cfg.Prefix + name + "/"
+}
+
+// info describes a file or directory.
+type info struct {
+	name  string
+	size  int64
+	mode  fs.FileMode
+	mtime time.Time
+	etag  string
+}
+
+func (fi *info) Name() string       { return fi.name }
+func (fi *info) Size() int64        { return fi.size }
+func (fi *info) Mode() fs.FileMode  { return fi.mode }
+func (fi *info) ModTime() time.Time { return fi.mtime }
+func (fi *info) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *info) Sys() any           { return nil }
+
+func dirInfo(name string) *info {
+	return &info{name: path.Base(name), mode: fs.ModeDir | 0o755}
+}
+
+// head returns the object holding the file name.
+func (c *FS) head(op, name string) (*info, error) {
+	resp, err := c.request(http.MethodHead, c.key(name), nil, nil, nil, 0, "")
+	if err != nil {
+		return nil, pathErr(op, name, err)
+	}
+	drain(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, pathErr(op, name, statusErr(resp))
+	}
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &info{
+		name:  path.Base(name),
+		size:  resp.ContentLength,
+		mode:  0o644,
+		mtime: mtime,
+		etag:  resp.Header.Get("ETag"),
+	}, nil
+}
+
+// isDir reports whether any key lies below the directory name.
+func (c *FS) isDir(op, name string) (bool, error) {
+	if name == "." {
+		return true, nil
+	}
+	found := false
+	err := c.list(c.dirPrefix(name), 1, func(res *listResult) bool {
+		found = len(res.Contents) > 0 || len(res.CommonPrefixes) > 0
+		return false
+	})
+	if err != nil {
+		return false, pathErr(op, name, err)
+	}
+	return found, nil
+}
+
+// lookup returns what name is: an object, or failing that a directory.
+func (c *FS) lookup(op, name string) (*info, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathErr(op, name, syscall.EINVAL)
+	}
+	if name == "." {
+		return dirInfo(name), nil
+	}
+	fi, err := c.head(op, name)
+	if err == nil || !isNotExist(err) {
+		return fi, err
+	}
+	dir, err := c.isDir(op, name)
+	switch {
+	case err != nil:
+		return nil, err
+	case !dir:
+		return nil, pathErr(op, name, syscall.ENOENT)
+	}
+	return dirInfo(name), nil
+}
+
+func isNotExist(err error) bool {
+	pe, ok := err.(*fs.PathError)
+	return ok && pe.Err == syscall.ENOENT
+}
+
+// checkParent fails unless the parent of name is a directory.
+func (c *FS) checkParent(op, name string) error {
+	dir := path.Dir(name)
+	fi, err := c.lookup(op, dir)
+	switch {
+	case isNotExist(err):
+		return pathErr(op, name, syscall.ENOENT)
+	case err != nil:
+		return err
+	case !fi.IsDir():
+		return pathErr(op, name, syscall.ENOTDIR)
+	}
+	return nil
+}
+
+// put uploads size bytes from body as the object key.
+func (c *FS) put(op, name, key string, body io.Reader, size int64) error {
+	if body == nil {
+		body = strings.NewReader("")
+	}
+	resp, err := c.request(http.MethodPut, key, nil, nil, body, size, "UNSIGNED-PAYLOAD")
+	if err != nil {
+		return pathErr(op, name, err)
+	}
+	drain(resp)
+	if resp.StatusCode != http.StatusOK {
+		return pathErr(op, name, statusErr(resp))
+	}
+	return nil
+}
+
+func (c *FS) delete(op, name, key string) error {
+	resp, err := c.request(http.MethodDelete, key, nil, nil, nil, 0, "")
+	if err != nil {
+		return pathErr(op, name, err)
+	}
+	drain(resp)
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return pathErr(op, name, statusErr(resp))
+	}
+	return nil
+}
+
+func (c *FS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	fi, err := c.lookup("open", name)
+	create := flag&os.O_CREATE != 0
+	acc := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	switch {
+	case isNotExist(err) && create:
+		if err := c.checkParent("open", name); err != nil {
+			return nil, err
+		}
+		if err := c.put("open", name, c.key(name), nil, 0); err != nil {
+			return nil, err
+		}
+		fi = &info{name: path.Base(name), mode: 0o644, mtime: c.now()}
+	case err != nil:
+		return nil, err
+	case create && flag&os.O_EXCL != 0:
+		return nil, pathErr("open", name, syscall.EEXIST)
+	case fi.IsDir() && (acc != os.O_RDONLY || create):
+		return nil, pathErr("open", name, syscall.EISDIR)
+	case fi.IsDir():
+		return &vfs.DirFile{Info: fi}, nil
+	case flag&syscall.O_DIRECTORY != 0:
+		return nil, pathErr("open", name, syscall.ENOTDIR)
+	case flag&os.O_TRUNC != 0 && acc != os.O_RDONLY && fi.size > 0:
+		if err := c.put("open", name, c.key(name), nil, 0); err != nil {
+			return nil, err
+		}
+		fi.size, fi.etag = 0, ""
+	}
+	return &file{fs: c, name: name, flag: flag, info: *fi}, nil
+}
+
+func (c *FS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := c.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+func (c *FS) Lstat(name string) (fs.FileInfo, error) {
+	fi, err := c.lookup("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+func (c *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathErr("readdir", name, syscall.EINVAL)
+	}
+	prefix := c.dirPrefix(name)
+	found := name == "."
+	seen := make(map[string]bool)
+	var entries []fs.DirEntry
+	add := func(fi *info) {
+		if fi.name != "" && !seen[fi.name] {
+			seen[fi.name] = true
+			entries = append(entries, fs.FileInfoToDirEntry(fi))
+		}
+	}
+	err := c.list(prefix, 0, func(res *listResult) bool {
+		for _, p := range res.CommonPrefixes {
+			found = true
+			add(dirInfo(strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/")))
+		}
+		for _, o := range res.Contents {
+			found = true
+			if o.Key == prefix {
+				continue // the directory's own marker
+			}
+			add(&info{name: strings.TrimPrefix(o.Key, prefix), size: o.Size, mode: 0o644, mtime: o.LastModified, etag: o.ETag})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, pathErr("readdir", name, err)
+	}
+	if !found {
+		if _, err := c.head("readdir", name); err == nil {
+			return nil, pathErr("readdir", name, syscall.ENOTDIR)
+		}
+		return nil, pathErr("readdir", name, syscall.ENOENT)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (c *FS) Mkdir(name string, perm fs.FileMode) error {
+	_, err := c.lookup("mkdir", name)
+	switch {
+	case err == nil:
+		return pathErr("mkdir", name, syscall.EEXIST)
+	case !isNotExist(err):
+		return err
+	}
+	if err := c.checkParent("mkdir", name); err != nil {
+		return err
+	}
+	return c.put("mkdir", name, c.dirPrefix(name), nil, 0)
+}
+
+func (c *FS) Unlink(name string) error {
+	fi, err := c.lookup("unlink", name)
+	switch {
+	case err != nil:
+		return err
+	case fi.IsDir():
+		return pathErr("unlink", name, syscall.EISDIR)
+	}
+	return c.delete("unlink", name, c.key(name))
+}
+
+func (c *FS) Rmdir(name string) error {
+	fi, err := c.lookup("rmdir", name)
+	switch {
+	case err != nil:
+		return err
+	case name == ".":
+		return pathErr("rmdir", name, syscall.EBUSY)
+	case !fi.IsDir():
+		return pathErr("rmdir", name, syscall.ENOTDIR)
+	}
+	prefix := c.dirPrefix(name)
+	empty := true
+	err = c.list(prefix, 2, func(res *listResult) bool {
+		for _, o := range res.Contents {
+			empty = empty && o.Key == prefix
+		}
+		empty = empty && len(res.CommonPrefixes) == 0
+		return false
+	})
+	switch {
+	case err != nil:
+		return pathErr("rmdir", name, err)
+	case !empty:
+		return pathErr("rmdir", name, syscall.ENOTEMPTY)
+	}
+	return c.delete("rmdir", name, prefix)
+}
+
+func (c *FS) Rename(oldname, newname string) error {
+	fi, err := c.lookup("rename", oldname)
+	switch {
+	case err != nil:
+		return err
+	case fi.IsDir():
+		return pathErr("rename", oldname, syscall.EXDEV)
+	case oldname == newname:
+		return nil
+	}
+	switch to, err := c.lookup("rename", newname); {
+	case err == nil && to.IsDir():
+		return pathErr("rename", newname, syscall.EISDIR)
+	case err != nil && !isNotExist(err):
+		return err
+	case err != nil:
+		if err := c.checkParent("rename", newname); err != nil {
+			return err
+		}
+	}
+	resp, err := c.request(http.MethodGet, c.key(oldname), nil, nil, nil, 0, "")
+	if err != nil {
+		return pathErr("rename", oldname, err)
+	}
+	defer drain(resp)
+	if resp.StatusCode != http.StatusOK {
+		return pathErr("rename", oldname, statusErr(resp))
+	}
+	if err := c.put("rename", newname, c.key(newname), resp.Body, resp.ContentLength); err != nil {
+		return err
+	}
+	return c.delete("rename", oldname, c.key(oldname))
+}
+
+func (c *FS) Link(oldname, newname string) error {
+	return pathErr("link", newname, syscall.EPERM)
+}
+
+func (c *FS) Symlink(target, newname string) error {
+	return pathErr("symlink", newname, syscall.EPERM)
+}
+
+func (c *FS) Readlink(name string) (string, error) {
+	if _, err := c.lookup("readlink", name); err != nil {
+		return "", err
+	}
+	return "", pathErr("readlink", name, syscall.EINVAL)
+}
+
+func (c *FS) Chmod(name string, mode fs.FileMode) error {
+	_, err := c.lookup("chmod", name)
+	return err
+}
+
+func (c *FS) Chtimes(name string, atime, mtime time.Time) error {
+	_, err := c.lookup("chtimes", name)
+	return err
+}
@@ -0,0 +1,28 @@
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"testing"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs/s3"
+)
+
+func TestTracer(t *testing.T) {
+	b, _ := s3.NewFakeFS(t, map[string]string{"root/in/data.txt": "from the bucket\n"})
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `cat /s3/in/data.txt
+ls /s3 /s3/in
+mkdir /s3/out && tr a-z A-Z </s3/in/data.txt >/s3/out/upper && cat /s3/out/upper
+mv /s3/out/upper /s3/out/moved && ls /s3/out`)
+	cmd.Stdout = &stdout
+	if err := tracer.New(cmd, tracer.WithMount("/s3", b)).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := "from the bucket\n/s3:\nin\n\n/s3/in:\ndata.txt\nFROM THE BUCKET\nmoved\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,342 @@
+// Package shared implements a vfs.Backend that lets several tracers, or
+// the clients of one remote.Server, share another backend as processes
+// sharing a kernel filesystem would: one process tree can write files
+// that another reads as they are written, or publish each by renaming it
+// into place for another to pick up.
+//
+// Backends are each safe for concurrent use, but not every one makes its
+// operations atomic with respect to each other; one may check that a file
+// is not there before creating it, or replace a file by removing it
+// before renaming another in its place. An FS orders the operations of
+// its callers so that they are. Those changing the entries of a
+// directory, as creating, removing, linking and renaming do, hold the
+// lock of the directory's name, which lookups in it share; a rename holds
+// those of both its directories, taken in order. Reads and writes of a
+// regular file hold the lock of its inode, shared by reads, so that a
+// read sees all or none of each write, however the backend applies it.
+// Operations on different files and directories go on at once.
+//
+// Each tracer keeps the advisory locks of flock and fcntl apart, and
+// WithLeases and WithPassthrough copy files out of the backend, so the
+// process trees sharing a backend should not rely on the one or use the
+// others.
+package shared
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+)
+
+// FS is a backend ordering the operations on another.
+type FS struct {
+	b      vfs.Backend
+	dirs   table // by name
+	inodes table // by inode number, or name where there is none
+	// changes counts the changes made to names and their metadata.
+	changes atomic.Uint64
+}
+
+var (
+	_ vfs.Backend  = (*FS)(nil)
+	_ vfs.Xattrer  = (*FS)(nil)
+	_ vfs.StatFSer = (*FS)(nil)
+	_ vfs.Socketer = (*FS)(nil)
+	_ vfs.Changer  = (*FS)(nil)
+)
+
+// New returns an FS sharing b.
+func New(b vfs.Backend) *FS {
+	return &FS{b: b, dirs: table{locks: make(map[any]*rwlock)}, inodes: table{locks: make(map[any]*rwlock)}}
+}
+
+// table holds the locks held or waited for, by key.
+type table struct {
+	mu    sync.Mutex
+	locks map[any]*rwlock
+}
+
+type rwlock struct {
+	sync.RWMutex
+	refs int
+}
+
+// get returns the lock of k, for put to give back.
+func (t *table) get(k any) *rwlock {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.locks[k]
+	if l == nil {
+		l = &rwlock{}
+		t.locks[k] = l
+	}
+	l.refs++
+	return l
+}
+
+// put gives back the lock of k, which goes once none has it.
+func (t *table) put(k any, l *rwlock) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l.refs--; l.refs == 0 {
+		delete(t.locks, k)
+	}
+}
+
+// lock locks k, shared or not, and returns the function unlocking it.
+func (t *table) lock(k any, shared bool) func() {
+	l := t.get(k)
+	if shared {
+		l.RLock()
+		return func() { l.RUnlock(); t.put(k, l) }
+	}
+	l.Lock()
+	return func() { l.Unlock(); t.put(k, l) }
+}
+
+// lookup locks the directory of name for looking name up, and returns
+// the function unlocking it.
+func (s *FS) lookup(name string) func() { return s.dirs.lock(path.Dir(name), true) }
+
+// change locks the directory of name for changing its entry, and returns
+// the function counting the change and unlocking it.
+func (s *FS) change(name string) func() {
+	unlock := s.dirs.lock(path.Dir(name), false)
+	return func() { s.changes.Add(1); unlock() }
+}
+
+// change2 locks the directories of a and b, in order, for changing their
+// entries, and returns the function counting the change and unlocking
+// them.
+func (s *FS) change2(a, b string) func() {
+	da, db := path.Dir(a), path.Dir(b)
+	switch {
+	case da == db:
+		return s.change(a)
+	case da > db:
+		da, db = db, da
+	}
+	ua := s.dirs.lock(da, false)
+	ub := s.dirs.lock(db, false)
+	return func() { s.changes.Add(1); ub(); ua() }
+}
+
+// Changes counts the changes made through s, by any of its callers, to
+// names and their metadata.
+func (s *FS) Changes() uint64 { return s.changes.Load() }
+
+// inode returns the key of the inode fi describes, the file opened as
+// name.
+func inode(fi fs.FileInfo, name string) any {
+	switch sys := fi.Sys().(type) {
+	case *syscall.Stat_t:
+		return sys.Ino
+	case *vfs.Attr:
+		if sys.Ino != 0 {
+			return sys.Ino
+		}
+	}
+	return name
+}
+
+// Open opens name with its directory locked, for changing if the open may
+// create the file. A file truncated by the open has its inode locked too.
+func (s *FS) Open(name string, flag int, perm fs.FileMode) (vfs.File, error) {
+	var unlock func()
+	if flag&os.O_CREATE != 0 {
+		unlock = s.change(name)
+	} else {
+		unlock = s.lookup(name)
+	}
+	defer unlock()
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if fi, err := s.b.Stat(name); err == nil && fi.Mode().IsRegular() {
+			defer s.inodes.lock(inode(fi, name), false)()
+		}
+	}
+	f, err := s.b.Open(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return f, nil
+	}
+	k := inode(fi, name)
+	return &file{File: f, s: s, key: k, l: s.inodes.get(k)}, nil
+}
+
+func (s *FS) Stat(name string) (fs.FileInfo, error) {
+	defer s.lookup(name)()
+	return s.b.Stat(name)
+}
+
+func (s *FS) Lstat(name string) (fs.FileInfo, error) {
+	defer s.lookup(name)()
+	return s.b.Lstat(name)
+}
+
+// ReadDir reads the directory name with its own lock shared.
+func (s *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	defer s.dirs.lock(path.Clean(name), true)()
+	return s.b.ReadDir(name)
+}
+
+func (s *FS) Mkdir(name string, perm fs.FileMode) error {
+	defer s.change(name)()
+	return s.b.Mkdir(name, perm)
+}
+
+func (s *FS) Unlink(name string) error {
+	defer s.change(name)()
+	return s.b.Unlink(name)
+}
+
+func (s *FS) Rmdir(name string) error {
+	defer s.change(name)()
+	return s.b.Rmdir(name)
+}
+
+func (s *FS) Rename(oldname, newname string) error {
+	defer s.change2(oldname, newname)()
+	return s.b.Rename(oldname, newname)
+}
+
+func (s *FS) Link(oldname, newname string) error {
+	defer s.change2(oldname, newname)()
+	return s.b.Link(oldname, newname)
+}
+
+func (s *FS) Symlink(target, newname string) error {
+	defer s.change(newname)()
+	return s.b.Symlink(target, newname)
+}
+
+func (s *FS) Readlink(name string) (string, error) {
+	defer s.lookup(name)()
+	return s.b.Readlink(name)
+}
+
+func (s *FS) Chmod(name string, mode fs.FileMode) error {
+	defer s.lookup(name)()
+	defer s.changes.Add(1)
+	return s.b.Chmod(name, mode)
+}
+
+func (s *FS) Chtimes(name string, atime, mtime time.Time) error {
+	defer s.lookup(name)()
+	defer s.changes.Add(1)
+	return s.b.Chtimes(name, atime, mtime)
+}
+
+func (s *FS) Getxattr(name, attr string) ([]byte, error) {
+	defer s.lookup(name)()
+	return vfs.Getxattr(s.b, name, attr)
+}
+
+func (s *FS) Setxattr(name, attr string, value []byte, flags int) error {
+	defer s.lookup(name)()
+	defer s.changes.Add(1)
+	return vfs.Setxattr(s.b, name, attr, value, flags)
+}
+
+func (s *FS) Listxattr(name string) ([]string, error) {
+	defer s.lookup(name)()
+	return vfs.Listxattr(s.b, name)
+}
+
+func (s *FS) Removexattr(name, attr string) error {
+	defer s.lookup(name)()
+	defer s.changes.Add(1)
+	return vfs.Removexattr(s.b, name, attr)
+}
+
+func (s *FS) StatFS(name string) (vfs.FSStat, error) { return vfs.StatFS(s.b, name) }
+
+func (s *FS) SocketPath(name string) (string, error) { return vfs.SocketPath(s.b, name) }
+
+// file is an open regular file, holding the lock of its inode, l, until
+// it is closed.
+type file struct {
+	vfs.File
+	s      *FS
+	key    any
+	l      *rwlock
+	closed sync.Once
+}
+
+var (
+	_ vfs.Truncater   = (*file)(nil)
+	_ vfs.HolePuncher = (*file)(nil)
+	_ vfs.Syncer      = (*file)(nil)
+)
+
+func (f *file) Read(b []byte) (int, error) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	return f.File.Read(b)
+}
+
+func (f *file) ReadAt(b []byte, off int64) (int, error) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	return f.File.ReadAt(b, off)
+}
+
+func (f *file) Write(b []byte) (int, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.File.Write(b)
+}
+
+func (f *file) WriteAt(b []byte, off int64) (int, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.File.WriteAt(b, off)
+}
+
+func (f *file) Truncate(size int64) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return vfs.Truncate(f.File, size)
+}
+
+func (f *file) PunchHole(off, n int64) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return vfs.PunchHole(f.File, off, n)
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	return f.File.Stat()
+}
+
+// Sync syncs the file with its inode locked, as a backend writing back
+// what it holds on sync writes.
+func (f *file) Sync() error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return vfs.Sync(f.File)
+}
+
+// Close closes the file with its inode locked, as a backend writing back
+// what it holds on close writes, and gives back the lock.
+func (f *file) Close() error {
+	f.l.Lock()
+	err := f.File.Close()
+	f.l.Unlock()
+	f.closed.Do(func() { f.s.inodes.put(f.key, f.l) })
+	return err
+}
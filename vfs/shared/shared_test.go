@@ -0,0 +1,185 @@
+package shared_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/maxmcd/cfc-ptrace/tracer"
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/shared"
+)
+
+// racy is a backend whose operations are not atomic: it creates a file
+// after checking it is not there, renames over a file after removing it,
+// and writes a byte at a time.
+type racy struct{ vfs.Backend }
+
+type racyFile struct{ vfs.File }
+
+func (r racy) Open(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		if _, err := r.Backend.Lstat(name); err == nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+		}
+		runtime.Gosched()
+		flag &^= os.O_EXCL
+	}
+	f, err := r.Backend.Open(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return racyFile{f}, nil
+}
+
+func (r racy) Rename(oldname, newname string) error {
+	if fi, err := r.Backend.Lstat(newname); err == nil && !fi.IsDir() {
+		r.Backend.Unlink(newname)
+		runtime.Gosched()
+	}
+	return r.Backend.Rename(oldname, newname)
+}
+
+func (f racyFile) WriteAt(b []byte, off int64) (int, error) {
+	for i := range b {
+		if _, err := f.File.WriteAt(b[i:i+1], off+int64(i)); err != nil {
+			return i, err
+		}
+		runtime.Gosched()
+	}
+	return len(b), nil
+}
+
+func TestWrites(t *testing.T) {
+	s := shared.New(racy{memfs.New()})
+	w, err := s.Open("f", os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.WriteAt(bytes.Repeat([]byte("a"), 64), 0)
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; !stop.Load(); i++ {
+			w.WriteAt(bytes.Repeat([]byte{"ab"[i%2]}, 64), 0)
+		}
+	}()
+	r, err := s.Open("f", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for range 1000 {
+		b := make([]byte, 64)
+		r.ReadAt(b, 0)
+		if c := bytes.Count(b, b[:1]); c != len(b) {
+			t.Fatalf("read half a write: %q", b)
+		}
+		runtime.Gosched()
+	}
+	stop.Store(true)
+	wg.Wait()
+}
+
+func TestRename(t *testing.T) {
+	s := shared.New(racy{memfs.New()})
+	write := func(name, data string) {
+		f, err := s.Open(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		f.WriteAt([]byte(data), 0)
+		f.Close()
+	}
+	write("out", "0")
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for !stop.Load() {
+			write("tmp", "new")
+			s.Rename("tmp", "out")
+		}
+	}()
+	for range 1000 {
+		f, err := s.Open("out", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("open while renamed over: %v", err)
+		}
+		b, _ := io.ReadAll(f)
+		f.Close()
+		if got := string(b); got != "0" && got != "new" {
+			t.Fatalf("read %q", got)
+		}
+		runtime.Gosched()
+	}
+	stop.Store(true)
+	wg.Wait()
+}
+
+func TestExclusiveCreate(t *testing.T) {
+	s := shared.New(racy{memfs.New()})
+	var created atomic.Int32
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := s.Open("lock", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+			switch {
+			case err == nil:
+				created.Add(1)
+				f.Close()
+			case !errors.Is(err, fs.ErrExist):
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := created.Load(); n != 1 {
+		t.Errorf("%d creates succeeded", n)
+	}
+}
+
+func TestTracers(t *testing.T) {
+	// A producer publishes files by renaming them into place, and a
+	// consumer run by another tracer waits for the last.
+	s := shared.New(memfs.New())
+	producer := exec.Command("/bin/sh", "-c", `for i in 1 2 3 4 5 6 7 8 9 10; do echo $i >/s/tmp; mv /s/tmp /s/out; done`)
+	var stdout bytes.Buffer
+	consumer := exec.Command("/bin/sh", "-c", `until read n </s/out 2>/dev/null && [ "$n" = 10 ]; do :; done; echo got $n`)
+	consumer.Stdout = &stdout
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, cmd := range []*exec.Cmd{consumer, producer} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = tracer.New(cmd, tracer.WithMount("/s", s)).Run(context.Background())
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := strings.TrimSpace(stdout.String()); got != "got 10" {
+		t.Errorf("got %q", got)
+	}
+}
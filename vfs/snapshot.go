@@ -0,0 +1,260 @@
+package vfs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Snapshot writes the tree b holds to w as a tar archive in the PAX
+// format, which records access and change times along with each entry's
+// permission bits, modification time and, where b reports them, owner.
+// Entries come in lexical order, each directory before what it holds,
+// starting with the root as "./". Regular files that share an inode are
+// written once and linked to after. Entries other than directories,
+// regular files and symlinks are left out.
+func Snapshot(b Backend, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	s := snapshotter{b: b, tw: tw, links: make(map[uint64]string)}
+	if err := s.add("."); err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	return nil
+}
+
+type snapshotter struct {
+	b     Backend
+	tw    *tar.Writer
+	links map[uint64]string // the first name of each inode linked more than once
+}
+
+// add writes the entry name, and everything under it if it is a
+// directory.
+func (s *snapshotter) add(name string) error {
+	fi, err := s.b.Lstat(name)
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(unixMode(fi.Mode())),
+		ModTime: fi.ModTime(),
+		Format:  tar.FormatPAX,
+	}
+	attr := sysAttr(fi)
+	if attr != nil {
+		hdr.Uid, hdr.Gid = int(attr.Uid), int(attr.Gid)
+		hdr.AccessTime, hdr.ChangeTime = attr.Atime, attr.Ctime
+	}
+	switch {
+	case fi.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name = name + "/"
+	case fi.Mode()&fs.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		if hdr.Linkname, err = s.b.Readlink(name); err != nil {
+			return err
+		}
+	case fi.Mode().IsRegular():
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = fi.Size()
+		if attr != nil && attr.Nlink > 1 {
+			if first, ok := s.links[attr.Ino]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+			} else {
+				s.links[attr.Ino] = name
+			}
+		}
+	default:
+		return nil
+	}
+	if err := s.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		f, err := s.b.Open(name, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(s.tw, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	case tar.TypeDir:
+		entries, err := s.b.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := s.add(path.Join(name, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sysAttr returns the Attr of fi, from the Stat_t of a host file if that
+// is what it has, or nil.
+func sysAttr(fi fs.FileInfo) *Attr {
+	switch sys := fi.Sys().(type) {
+	case *Attr:
+		return sys
+	case *syscall.Stat_t:
+		return &Attr{
+			Ino:   sys.Ino,
+			Nlink: uint64(sys.Nlink),
+			Uid:   sys.Uid,
+			Gid:   sys.Gid,
+			Atime: time.Unix(sys.Atim.Unix()),
+			Ctime: time.Unix(sys.Ctim.Unix()),
+		}
+	}
+	return nil
+}
+
+// unixMode returns the mode bits of m as a Unix mode has them, without
+// the file type.
+func unixMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
+// Restore writes the entries of the tar archive r, as Snapshot writes
+// them, into b. Entries already in b are replaced, except that a
+// directory stays and takes the mode and times of the one restored over
+// it; entries the archive does not name are left alone. Directories an
+// entry needs that the archive lacks are made. Owners are not restored,
+// as a Backend has no way to change them.
+//
+// Modes and times are set once everything is written, deepest first, so
+// that a read-only directory still takes what goes in it and its times
+// end as the archive has them.
+func Restore(b Backend, r io.Reader) error {
+	tr := tar.NewReader(r)
+	var done []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("restore: %w", err)
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if !fs.ValidPath(name) {
+			return fmt.Errorf("restore: bad name %q", hdr.Name)
+		}
+		hdr.Name = name
+		if err := restore(b, hdr, tr); err != nil {
+			return fmt.Errorf("restore: %w", err)
+		}
+		done = append(done, hdr)
+	}
+	for _, hdr := range slices.Backward(done) {
+		if hdr.Typeflag == tar.TypeSymlink {
+			// Chmod and Chtimes would follow the symlink.
+			continue
+		}
+		if err := b.Chmod(hdr.Name, hdr.FileInfo().Mode()); err != nil {
+			return fmt.Errorf("restore: %w", err)
+		}
+		if err := b.Chtimes(hdr.Name, hdr.AccessTime, hdr.ModTime); err != nil {
+			return fmt.Errorf("restore: %w", err)
+		}
+	}
+	return nil
+}
+
+// restore writes the entry hdr describes, with its contents read from r.
+func restore(b Backend, hdr *tar.Header, r io.Reader) error {
+	name := hdr.Name
+	if name != "." {
+		if err := mkdirAll(b, path.Dir(name)); err != nil {
+			return err
+		}
+	}
+	fi, err := b.Lstat(name)
+	exists := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		if exists && fi.IsDir() {
+			return nil
+		}
+		if exists {
+			if err := b.Unlink(name); err != nil {
+				return err
+			}
+		}
+		return b.Mkdir(name, 0o700)
+	}
+	if exists {
+		if fi.IsDir() {
+			return &fs.PathError{Op: "restore", Path: name, Err: syscall.EISDIR}
+		}
+		if err := b.Unlink(name); err != nil {
+			return err
+		}
+	}
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		return b.Symlink(hdr.Linkname, name)
+	case tar.TypeLink:
+		return b.Link(path.Clean(strings.TrimPrefix(hdr.Linkname, "/")), name)
+	case tar.TypeReg:
+		f, err := b.Open(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	return fmt.Errorf("%s: unsupported entry type %q", name, hdr.Typeflag)
+}
+
+// mkdirAll makes the directory name and any parents it lacks.
+func mkdirAll(b Backend, name string) error {
+	if fi, err := b.Stat(name); err == nil {
+		if !fi.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if name != "." {
+		if err := mkdirAll(b, path.Dir(name)); err != nil {
+			return err
+		}
+	}
+	err := b.Mkdir(name, 0o755)
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+package vfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxmcd/cfc-ptrace/vfs"
+	"github.com/maxmcd/cfc-ptrace/vfs/memfs"
+)
+
+func writeFile(t *testing.T, b vfs.Backend, name, data string) {
+	t.Helper()
+	f, err := b.Open(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(f, data)
+	f.Close()
+}
+
+func readFile(t *testing.T, b vfs.Backend, name string) string {
+	t.Helper()
+	f, err := b.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSnapshot(t *testing.T) {
+	src := memfs.New()
+	src.Mkdir("bin", 0o755)
+	src.Mkdir("ro", 0o755)
+	writeFile(t, src, "bin/tool", "#!/bin/sh\n")
+	writeFile(t, src, "ro/kept", "inside a read-only directory")
+	src.Link("bin/tool", "bin/alias")
+	src.Symlink("bin/tool", "link")
+	src.Chmod("bin/tool", 0o755|fs.ModeSetuid)
+	src.Chmod("ro", 0o555)
+	mtime := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	atime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, name := range []string{"bin/tool", "ro", "bin", "."} {
+		src.Chtimes(name, atime, mtime)
+	}
+
+	var archive bytes.Buffer
+	if err := vfs.Snapshot(src, &archive); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	if got := strings.Join(names, " "); got != "./ bin/ bin/alias bin/tool link ro/ ro/kept" {
+		t.Errorf("archive holds %s", got)
+	}
+
+	dst := memfs.New()
+	if err := vfs.Restore(dst, bytes.NewReader(archive.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{".", "bin", "bin/tool", "bin/alias", "ro", "ro/kept"} {
+		want, _ := src.Stat(name)
+		got, err := dst.Stat(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got.Mode() != want.Mode() || got.Size() != want.Size() || !got.ModTime().Equal(want.ModTime()) {
+			t.Errorf("%s: restored as %v %d %v, want %v %d %v", name,
+				got.Mode(), got.Size(), got.ModTime(), want.Mode(), want.Size(), want.ModTime())
+		}
+	}
+	if fi, _ := dst.Stat("bin/tool"); !fi.Sys().(*vfs.Attr).Atime.Equal(atime) {
+		t.Errorf("access time %v, want %v", fi.Sys().(*vfs.Attr).Atime, atime)
+	}
+	tool, _ := dst.Stat("bin/tool")
+	alias, _ := dst.Stat("bin/alias")
+	if tool.Sys().(*vfs.Attr).Ino != alias.Sys().(*vfs.Attr).Ino || tool.Sys().(*vfs.Attr).Nlink != 2 {
+		t.Error("hard link restored as a copy")
+	}
+	if target, err := dst.Readlink("link"); err != nil || target != "bin/tool" {
+		t.Errorf("readlink: %q, %v", target, err)
+	}
+	if got := readFile(t, dst, "ro/kept"); got != "inside a read-only directory" {
+		t.Errorf("ro/kept holds %q", got)
+	}
+}
+
+func TestRestoreOver(t *testing.T) {
+	src := memfs.New()
+	src.Mkdir("d", 0o755)
+	writeFile(t, src, "d/file", "new")
+	src.Symlink("d", "was-a-file")
+	var archive bytes.Buffer
+	if err := vfs.Snapshot(src, &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := vfs.Dir(t.TempDir())
+	dst.Mkdir("d", 0o700)
+	writeFile(t, dst, "d/file", "old contents")
+	writeFile(t, dst, "d/other", "untouched")
+	writeFile(t, dst, "was-a-file", "")
+	if err := vfs.Restore(dst, &archive); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, dst, "d/file"); got != "new" {
+		t.Errorf("d/file holds %q", got)
+	}
+	if got := readFile(t, dst, "d/other"); got != "untouched" {
+		t.Errorf("d/other holds %q", got)
+	}
+	if fi, err := dst.Lstat("was-a-file"); err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("was-a-file: %v, %v", fi, err)
+	}
+	if fi, _ := dst.Stat("d"); fi.Mode().Perm() != 0o755 {
+		t.Errorf("d has mode %v", fi.Mode())
+	}
+}
+
+func TestRestoreBadName(t *testing.T) {
+	for _, name := range []string{"../escape", "a/../../escape"} {
+		var archive bytes.Buffer
+		tw := tar.NewWriter(&archive)
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644})
+		tw.Close()
+		if err := vfs.Restore(memfs.New(), &archive); err == nil {
+			t.Errorf("restore of %q succeeded", name)
+		}
+	}
+	// Archives from elsewhere may name entries absolutely and leave out
+	// their directories.
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "/a/b/c", Typeflag: tar.TypeReg, Mode: 0o644, Size: 2})
+	tw.Write([]byte("hi"))
+	tw.Close()
+	b := memfs.New()
+	if err := vfs.Restore(b, &archive); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, b, "a/b/c"); got != "hi" {
+		t.Errorf("a/b/c holds %q", got)
+	}
+}
@@ -0,0 +1,304 @@
+// Package vfs defines the interface between the tracer's syscall layer and
+// the stores that hold virtual files.
+//
+// Names passed to a Backend follow the io/fs conventions: they are
+// slash-separated, unrooted paths relative to the root of the backend, with
+// "." naming the root itself. Errors should be *fs.PathError values wrapping
+// a syscall.Errno where one applies, so the tracer can hand the tracee the
+// errno it would have seen from the kernel.
+package vfs
+
+import (
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Backend is a store of virtual files.
+type Backend interface {
+	// Open opens the named file with the given os.O_* flags, creating
+	// it with perm if O_CREATE is set.
+	Open(name string, flag int, perm fs.FileMode) (File, error)
+	// Stat returns information about the named file, following a final
+	// symlink.
+	Stat(name string) (fs.FileInfo, error)
+	// Lstat is like Stat but describes a final symlink itself.
+	Lstat(name string) (fs.FileInfo, error)
+	// ReadDir returns the entries of the named directory sorted by name.
+	ReadDir(name string) ([]fs.DirEntry, error)
+	// Mkdir creates the named directory.
+	Mkdir(name string, perm fs.FileMode) error
+	// Unlink removes the named non-directory.
+	Unlink(name string) error
+	// Rmdir removes the named empty directory.
+	Rmdir(name string) error
+	// Rename moves oldname to newname, replacing newname if it exists.
+	Rename(oldname, newname string) error
+	// Link creates newname as a hard link to oldname. A final symlink in
+	// oldname is linked itself rather than followed.
+	Link(oldname, newname string) error
+	// Symlink creates newname as a symbolic link to target. The target
+	// is stored verbatim.
+	Symlink(target, newname string) error
+	// Readlink returns the target of the named symbolic link.
+	Readlink(name string) (string, error)
+	// Chmod changes the permission bits of the named file.
+	Chmod(name string, mode fs.FileMode) error
+	// Chtimes changes the access and modification times of the named
+	// file. A zero time leaves the corresponding timestamp unchanged.
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// File is an open virtual file.
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Stat() (fs.FileInfo, error)
+}
+
+// Attr carries the POSIX metadata that fs.FileInfo has no place for.
+// Backends return an *Attr from FileInfo.Sys so that emulated stat calls can
+// report it.
+type Attr struct {
+	Ino   uint64
+	Nlink uint64
+	Uid   uint32
+	Gid   uint32
+	Atime time.Time
+	Ctime time.Time
+	// Rdev is the device number of a device file.
+	Rdev uint64
+}
+
+// Truncater is implemented by files that can change their size. Growing a
+// file leaves a hole that reads as zeros.
+type Truncater interface {
+	Truncate(size int64) error
+}
+
+// HolePuncher is implemented by files that can free the storage behind a
+// range, which then reads as zeros, without changing their size.
+type HolePuncher interface {
+	PunchHole(off, n int64) error
+}
+
+// Truncate changes the size of f, with its Truncate method if it has one.
+// Otherwise a file may only be grown, by writing a zero byte at its new
+// end; shrinking it fails with EOPNOTSUPP.
+func Truncate(f File, size int64) error {
+	if size < 0 {
+		return syscall.EINVAL
+	}
+	if t, ok := f.(Truncater); ok {
+		return t.Truncate(size)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	switch {
+	case size < fi.Size():
+		return syscall.EOPNOTSUPP
+	case size > fi.Size():
+		_, err = f.WriteAt([]byte{0}, size-1)
+	}
+	return err
+}
+
+// PunchHole frees the n bytes of f at off, with its PunchHole method if it
+// has one or with fallocate(2) for a host file. Otherwise the part of the
+// range inside the file is overwritten with zeros, which reads the same but
+// keeps the storage.
+func PunchHole(f File, off, n int64) error {
+	switch {
+	case off < 0 || n <= 0:
+		return syscall.EINVAL
+	case n > math.MaxInt64-off:
+		return syscall.EFBIG
+	}
+	switch f := f.(type) {
+	case HolePuncher:
+		return f.PunchHole(off, n)
+	case *os.File:
+		return syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, off, n)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	end := min(off+n, fi.Size())
+	zeros := make([]byte, min(end-off, 64<<10))
+	for off < end {
+		k := min(end-off, int64(len(zeros)))
+		if _, err := f.WriteAt(zeros[:k], off); err != nil {
+			return err
+		}
+		off += k
+	}
+	return nil
+}
+
+// Syncer is implemented by files that can commit what was written to them
+// to the storage behind their backend, as fsync(2) does.
+type Syncer interface {
+	Sync() error
+}
+
+// Sync commits what was written to f with its Sync method, if it has one.
+// A file without one has nothing to commit, and Sync does nothing.
+func Sync(f File) error {
+	if s, ok := f.(Syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Ioctler is implemented by files that answer ioctls of their own, which
+// the tracer forwards to them as WithIoctls says. arg is the argument the
+// request's number gives the size of, copied from the command's memory and
+// back again as its direction says; Ioctl returns what the syscall does.
+type Ioctler interface {
+	Ioctl(request uint, arg []byte) (int, error)
+}
+
+// fallocate(2) modes, which package syscall does not define.
+const (
+	fallocKeepSize  = 0x1
+	fallocPunchHole = 0x2
+)
+
+// Xattrer is implemented by backends that keep extended attributes. Like
+// Chmod, its methods follow a final symlink. An attribute a file does not
+// have is ENODATA.
+type Xattrer interface {
+	// Getxattr returns the value of the attribute attr of the named
+	// file.
+	Getxattr(name, attr string) ([]byte, error)
+	// Setxattr sets the attribute attr of the named file to value. With
+	// XattrCreate it fails with EEXIST if the attribute is set already,
+	// and with XattrReplace with ENODATA if it is not.
+	Setxattr(name, attr string, value []byte, flags int) error
+	// Listxattr returns the names of the attributes of the named file,
+	// sorted.
+	Listxattr(name string) ([]string, error)
+	// Removexattr removes the attribute attr of the named file.
+	Removexattr(name, attr string) error
+}
+
+// Flags of Xattrer.Setxattr, with the values of setxattr(2).
+const (
+	XattrCreate  = 0x1
+	XattrReplace = 0x2
+)
+
+// Getxattr calls b.Getxattr, failing with ENOTSUP if b is not an Xattrer.
+func Getxattr(b Backend, name, attr string) ([]byte, error) {
+	x, ok := b.(Xattrer)
+	if !ok {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: syscall.ENOTSUP}
+	}
+	return x.Getxattr(name, attr)
+}
+
+// Setxattr calls b.Setxattr, failing with ENOTSUP if b is not an Xattrer.
+func Setxattr(b Backend, name, attr string, value []byte, flags int) error {
+	x, ok := b.(Xattrer)
+	if !ok {
+		return &fs.PathError{Op: "setxattr", Path: name, Err: syscall.ENOTSUP}
+	}
+	return x.Setxattr(name, attr, value, flags)
+}
+
+// Listxattr calls b.Listxattr, failing with ENOTSUP if b is not an
+// Xattrer.
+func Listxattr(b Backend, name string) ([]string, error) {
+	x, ok := b.(Xattrer)
+	if !ok {
+		return nil, &fs.PathError{Op: "listxattr", Path: name, Err: syscall.ENOTSUP}
+	}
+	return x.Listxattr(name)
+}
+
+// Removexattr calls b.Removexattr, failing with ENOTSUP if b is not an
+// Xattrer.
+func Removexattr(b Backend, name, attr string) error {
+	x, ok := b.(Xattrer)
+	if !ok {
+		return &fs.PathError{Op: "removexattr", Path: name, Err: syscall.ENOTSUP}
+	}
+	return x.Removexattr(name, attr)
+}
+
+// FSStat describes the storage behind a backend, as statfs(2) does that of
+// a filesystem. A zero total is unknown, as is a zero Type.
+type FSStat struct {
+	// Type is the magic number of the filesystem, as statfs reports it.
+	Type int64
+	// Bytes and Inodes are what the storage can hold, and BytesFree and
+	// InodesFree what of them is left.
+	Bytes, BytesFree   int64
+	Inodes, InodesFree int64
+}
+
+// StatFSer is implemented by backends that know how much they can hold.
+type StatFSer interface {
+	// StatFS describes the storage holding the named file.
+	StatFS(name string) (FSStat, error)
+}
+
+// StatFS calls b.StatFS, or describes nothing if b is not a StatFSer.
+func StatFS(b Backend, name string) (FSStat, error) {
+	if s, ok := b.(StatFSer); ok {
+		return s.StatFS(name)
+	}
+	return FSStat{}, nil
+}
+
+// Socketer is implemented by backends that keep their files on the host,
+// where the Unix domain sockets the command binds in them can live.
+type Socketer interface {
+	// SocketPath returns the host path of the named file, at which a
+	// socket is bound or connected to. The file need not exist, but its
+	// parents do.
+	SocketPath(name string) (string, error)
+}
+
+// SocketPath calls b.SocketPath, or fails with EOPNOTSUPP if b is not a
+// Socketer.
+func SocketPath(b Backend, name string) (string, error) {
+	if s, ok := b.(Socketer); ok {
+		return s.SocketPath(name)
+	}
+	return "", &fs.PathError{Op: "socket", Path: name, Err: syscall.EOPNOTSUPP}
+}
+
+// Changer is implemented by backends that others than the tracer serving
+// them may change, as the tracers sharing one do. Changes counts the
+// changes made to names and their metadata, going up once each is made,
+// so that what a tracer remembers of the tree can be forgotten as it does.
+type Changer interface {
+	Changes() uint64
+}
+
+// HostStatFS describes the host filesystem holding the file at p, for
+// backends that keep their data there.
+func HostStatFS(p string) (FSStat, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return FSStat{}, &fs.PathError{Op: "statfs", Path: p, Err: err}
+	}
+	return FSStat{
+		Type:       int64(st.Type),
+		Bytes:      int64(st.Blocks) * int64(st.Bsize),
+		BytesFree:  int64(st.Bavail) * int64(st.Bsize),
+		Inodes:     int64(st.Files),
+		InodesFree: int64(st.Ffree),
+	}, nil
+}